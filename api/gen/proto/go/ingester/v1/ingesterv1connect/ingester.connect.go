@@ -37,6 +37,13 @@ type IngesterServiceClient interface {
 	MergeProfilesStacktraces(context.Context) *connect_go.BidiStreamForClient[v11.MergeProfilesStacktracesRequest, v11.MergeProfilesStacktracesResponse]
 	MergeProfilesLabels(context.Context) *connect_go.BidiStreamForClient[v11.MergeProfilesLabelsRequest, v11.MergeProfilesLabelsResponse]
 	MergeProfilesPprof(context.Context) *connect_go.BidiStreamForClient[v11.MergeProfilesPprofRequest, v11.MergeProfilesPprofResponse]
+	StorageUsage(context.Context, *connect_go.Request[v11.StorageUsageRequest]) (*connect_go.Response[v11.StorageUsageResponse], error)
+	SelectProfileIDs(context.Context, *connect_go.Request[v11.SelectProfileIDsRequest]) (*connect_go.Response[v11.SelectProfileIDsResponse], error)
+	GetProfile(context.Context, *connect_go.Request[v11.GetProfileRequest]) (*connect_go.Response[v11.GetProfileResponse], error)
+	SelectHistograms(context.Context, *connect_go.Request[v11.SelectHistogramsRequest]) (*connect_go.Response[v11.SelectHistogramsResponse], error)
+	Capabilities(context.Context, *connect_go.Request[v11.CapabilitiesRequest]) (*connect_go.Response[v11.CapabilitiesResponse], error)
+	SelectTargetMetadata(context.Context, *connect_go.Request[v11.SelectTargetMetadataRequest]) (*connect_go.Response[v11.SelectTargetMetadataResponse], error)
+	BlockMetadata(context.Context, *connect_go.Request[v11.BlockMetadataRequest]) (*connect_go.Response[v11.BlockMetadataResponse], error)
 }
 
 // NewIngesterServiceClient constructs a client for the ingester.v1.IngesterService service. By
@@ -94,6 +101,41 @@ func NewIngesterServiceClient(httpClient connect_go.HTTPClient, baseURL string,
 			baseURL+"/ingester.v1.IngesterService/MergeProfilesPprof",
 			opts...,
 		),
+		storageUsage: connect_go.NewClient[v11.StorageUsageRequest, v11.StorageUsageResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/StorageUsage",
+			opts...,
+		),
+		selectProfileIDs: connect_go.NewClient[v11.SelectProfileIDsRequest, v11.SelectProfileIDsResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/SelectProfileIDs",
+			opts...,
+		),
+		getProfile: connect_go.NewClient[v11.GetProfileRequest, v11.GetProfileResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/GetProfile",
+			opts...,
+		),
+		selectHistograms: connect_go.NewClient[v11.SelectHistogramsRequest, v11.SelectHistogramsResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/SelectHistograms",
+			opts...,
+		),
+		capabilities: connect_go.NewClient[v11.CapabilitiesRequest, v11.CapabilitiesResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/Capabilities",
+			opts...,
+		),
+		selectTargetMetadata: connect_go.NewClient[v11.SelectTargetMetadataRequest, v11.SelectTargetMetadataResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/SelectTargetMetadata",
+			opts...,
+		),
+		blockMetadata: connect_go.NewClient[v11.BlockMetadataRequest, v11.BlockMetadataResponse](
+			httpClient,
+			baseURL+"/ingester.v1.IngesterService/BlockMetadata",
+			opts...,
+		),
 	}
 }
 
@@ -108,6 +150,13 @@ type ingesterServiceClient struct {
 	mergeProfilesStacktraces *connect_go.Client[v11.MergeProfilesStacktracesRequest, v11.MergeProfilesStacktracesResponse]
 	mergeProfilesLabels      *connect_go.Client[v11.MergeProfilesLabelsRequest, v11.MergeProfilesLabelsResponse]
 	mergeProfilesPprof       *connect_go.Client[v11.MergeProfilesPprofRequest, v11.MergeProfilesPprofResponse]
+	storageUsage             *connect_go.Client[v11.StorageUsageRequest, v11.StorageUsageResponse]
+	selectProfileIDs         *connect_go.Client[v11.SelectProfileIDsRequest, v11.SelectProfileIDsResponse]
+	getProfile               *connect_go.Client[v11.GetProfileRequest, v11.GetProfileResponse]
+	selectHistograms         *connect_go.Client[v11.SelectHistogramsRequest, v11.SelectHistogramsResponse]
+	capabilities             *connect_go.Client[v11.CapabilitiesRequest, v11.CapabilitiesResponse]
+	selectTargetMetadata     *connect_go.Client[v11.SelectTargetMetadataRequest, v11.SelectTargetMetadataResponse]
+	blockMetadata            *connect_go.Client[v11.BlockMetadataRequest, v11.BlockMetadataResponse]
 }
 
 // Push calls ingester.v1.IngesterService.Push.
@@ -155,6 +204,41 @@ func (c *ingesterServiceClient) MergeProfilesPprof(ctx context.Context) *connect
 	return c.mergeProfilesPprof.CallBidiStream(ctx)
 }
 
+// StorageUsage calls ingester.v1.IngesterService.StorageUsage.
+func (c *ingesterServiceClient) StorageUsage(ctx context.Context, req *connect_go.Request[v11.StorageUsageRequest]) (*connect_go.Response[v11.StorageUsageResponse], error) {
+	return c.storageUsage.CallUnary(ctx, req)
+}
+
+// SelectProfileIDs calls ingester.v1.IngesterService.SelectProfileIDs.
+func (c *ingesterServiceClient) SelectProfileIDs(ctx context.Context, req *connect_go.Request[v11.SelectProfileIDsRequest]) (*connect_go.Response[v11.SelectProfileIDsResponse], error) {
+	return c.selectProfileIDs.CallUnary(ctx, req)
+}
+
+// GetProfile calls ingester.v1.IngesterService.GetProfile.
+func (c *ingesterServiceClient) GetProfile(ctx context.Context, req *connect_go.Request[v11.GetProfileRequest]) (*connect_go.Response[v11.GetProfileResponse], error) {
+	return c.getProfile.CallUnary(ctx, req)
+}
+
+// SelectHistograms calls ingester.v1.IngesterService.SelectHistograms.
+func (c *ingesterServiceClient) SelectHistograms(ctx context.Context, req *connect_go.Request[v11.SelectHistogramsRequest]) (*connect_go.Response[v11.SelectHistogramsResponse], error) {
+	return c.selectHistograms.CallUnary(ctx, req)
+}
+
+// Capabilities calls ingester.v1.IngesterService.Capabilities.
+func (c *ingesterServiceClient) Capabilities(ctx context.Context, req *connect_go.Request[v11.CapabilitiesRequest]) (*connect_go.Response[v11.CapabilitiesResponse], error) {
+	return c.capabilities.CallUnary(ctx, req)
+}
+
+// SelectTargetMetadata calls ingester.v1.IngesterService.SelectTargetMetadata.
+func (c *ingesterServiceClient) SelectTargetMetadata(ctx context.Context, req *connect_go.Request[v11.SelectTargetMetadataRequest]) (*connect_go.Response[v11.SelectTargetMetadataResponse], error) {
+	return c.selectTargetMetadata.CallUnary(ctx, req)
+}
+
+// BlockMetadata calls ingester.v1.IngesterService.BlockMetadata.
+func (c *ingesterServiceClient) BlockMetadata(ctx context.Context, req *connect_go.Request[v11.BlockMetadataRequest]) (*connect_go.Response[v11.BlockMetadataResponse], error) {
+	return c.blockMetadata.CallUnary(ctx, req)
+}
+
 // IngesterServiceHandler is an implementation of the ingester.v1.IngesterService service.
 type IngesterServiceHandler interface {
 	Push(context.Context, *connect_go.Request[v1.PushRequest]) (*connect_go.Response[v1.PushResponse], error)
@@ -166,6 +250,13 @@ type IngesterServiceHandler interface {
 	MergeProfilesStacktraces(context.Context, *connect_go.BidiStream[v11.MergeProfilesStacktracesRequest, v11.MergeProfilesStacktracesResponse]) error
 	MergeProfilesLabels(context.Context, *connect_go.BidiStream[v11.MergeProfilesLabelsRequest, v11.MergeProfilesLabelsResponse]) error
 	MergeProfilesPprof(context.Context, *connect_go.BidiStream[v11.MergeProfilesPprofRequest, v11.MergeProfilesPprofResponse]) error
+	StorageUsage(context.Context, *connect_go.Request[v11.StorageUsageRequest]) (*connect_go.Response[v11.StorageUsageResponse], error)
+	SelectProfileIDs(context.Context, *connect_go.Request[v11.SelectProfileIDsRequest]) (*connect_go.Response[v11.SelectProfileIDsResponse], error)
+	GetProfile(context.Context, *connect_go.Request[v11.GetProfileRequest]) (*connect_go.Response[v11.GetProfileResponse], error)
+	SelectHistograms(context.Context, *connect_go.Request[v11.SelectHistogramsRequest]) (*connect_go.Response[v11.SelectHistogramsResponse], error)
+	Capabilities(context.Context, *connect_go.Request[v11.CapabilitiesRequest]) (*connect_go.Response[v11.CapabilitiesResponse], error)
+	SelectTargetMetadata(context.Context, *connect_go.Request[v11.SelectTargetMetadataRequest]) (*connect_go.Response[v11.SelectTargetMetadataResponse], error)
+	BlockMetadata(context.Context, *connect_go.Request[v11.BlockMetadataRequest]) (*connect_go.Response[v11.BlockMetadataResponse], error)
 }
 
 // NewIngesterServiceHandler builds an HTTP handler from the service implementation. It returns the
@@ -220,6 +311,41 @@ func NewIngesterServiceHandler(svc IngesterServiceHandler, opts ...connect_go.Ha
 		svc.MergeProfilesPprof,
 		opts...,
 	))
+	mux.Handle("/ingester.v1.IngesterService/StorageUsage", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/StorageUsage",
+		svc.StorageUsage,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectProfileIDs", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectProfileIDs",
+		svc.SelectProfileIDs,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/GetProfile", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/GetProfile",
+		svc.GetProfile,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectHistograms", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectHistograms",
+		svc.SelectHistograms,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/Capabilities", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/Capabilities",
+		svc.Capabilities,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectTargetMetadata", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectTargetMetadata",
+		svc.SelectTargetMetadata,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/BlockMetadata", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/BlockMetadata",
+		svc.BlockMetadata,
+		opts...,
+	))
 	return "/ingester.v1.IngesterService/", mux
 }
 
@@ -261,3 +387,31 @@ func (UnimplementedIngesterServiceHandler) MergeProfilesLabels(context.Context,
 func (UnimplementedIngesterServiceHandler) MergeProfilesPprof(context.Context, *connect_go.BidiStream[v11.MergeProfilesPprofRequest, v11.MergeProfilesPprofResponse]) error {
 	return connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.MergeProfilesPprof is not implemented"))
 }
+
+func (UnimplementedIngesterServiceHandler) StorageUsage(context.Context, *connect_go.Request[v11.StorageUsageRequest]) (*connect_go.Response[v11.StorageUsageResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.StorageUsage is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) SelectProfileIDs(context.Context, *connect_go.Request[v11.SelectProfileIDsRequest]) (*connect_go.Response[v11.SelectProfileIDsResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.SelectProfileIDs is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) GetProfile(context.Context, *connect_go.Request[v11.GetProfileRequest]) (*connect_go.Response[v11.GetProfileResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.GetProfile is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) SelectHistograms(context.Context, *connect_go.Request[v11.SelectHistogramsRequest]) (*connect_go.Response[v11.SelectHistogramsResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.SelectHistograms is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) Capabilities(context.Context, *connect_go.Request[v11.CapabilitiesRequest]) (*connect_go.Response[v11.CapabilitiesResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.Capabilities is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) SelectTargetMetadata(context.Context, *connect_go.Request[v11.SelectTargetMetadataRequest]) (*connect_go.Response[v11.SelectTargetMetadataResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.SelectTargetMetadata is not implemented"))
+}
+
+func (UnimplementedIngesterServiceHandler) BlockMetadata(context.Context, *connect_go.Request[v11.BlockMetadataRequest]) (*connect_go.Response[v11.BlockMetadataResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("ingester.v1.IngesterService.BlockMetadata is not implemented"))
+}
@@ -64,4 +64,39 @@ func RegisterIngesterServiceHandler(mux *mux.Router, svc IngesterServiceHandler,
 		svc.MergeProfilesPprof,
 		opts...,
 	))
+	mux.Handle("/ingester.v1.IngesterService/StorageUsage", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/StorageUsage",
+		svc.StorageUsage,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectProfileIDs", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectProfileIDs",
+		svc.SelectProfileIDs,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/GetProfile", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/GetProfile",
+		svc.GetProfile,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectHistograms", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectHistograms",
+		svc.SelectHistograms,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/Capabilities", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/Capabilities",
+		svc.Capabilities,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/SelectTargetMetadata", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/SelectTargetMetadata",
+		svc.SelectTargetMetadata,
+		opts...,
+	))
+	mux.Handle("/ingester.v1.IngesterService/BlockMetadata", connect_go.NewUnaryHandler(
+		"/ingester.v1.IngesterService/BlockMetadata",
+		svc.BlockMetadata,
+		opts...,
+	))
 }
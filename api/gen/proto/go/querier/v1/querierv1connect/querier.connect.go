@@ -35,6 +35,25 @@ type QuerierServiceClient interface {
 	SelectMergeStacktraces(context.Context, *connect_go.Request[v1.SelectMergeStacktracesRequest]) (*connect_go.Response[v1.SelectMergeStacktracesResponse], error)
 	SelectMergeProfile(context.Context, *connect_go.Request[v1.SelectMergeProfileRequest]) (*connect_go.Response[v11.Profile], error)
 	SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error)
+	// SelectHeatmap returns the distribution over time of the totals of the profiles.
+	SelectHeatmap(context.Context, *connect_go.Request[v1.SelectHeatmapRequest]) (*connect_go.Response[v1.SelectHeatmapResponse], error)
+	// StorageUsage estimates the stored bytes and profiles per value of a label.
+	StorageUsage(context.Context, *connect_go.Request[v1.StorageUsageRequest]) (*connect_go.Response[v1.StorageUsageResponse], error)
+	// SelectProfileIDs returns the IDs of the profiles matching the selector, the most recent first.
+	SelectProfileIDs(context.Context, *connect_go.Request[v1.SelectProfileIDsRequest]) (*connect_go.Response[v1.SelectProfileIDsResponse], error)
+	// GetProfile returns a single profile by its ID.
+	GetProfile(context.Context, *connect_go.Request[v1.GetProfileRequest]) (*connect_go.Response[v11.Profile], error)
+	// SelectStackSeries returns the series contributing the most value under a node of the flamegraph.
+	SelectStackSeries(context.Context, *connect_go.Request[v1.SelectStackSeriesRequest]) (*connect_go.Response[v1.SelectStackSeriesResponse], error)
+	// SelectOffCPU splits the wall-clock time of the stacktraces into on-CPU and off-CPU time. The
+	// off-CPU time is approximated by subtracting the on-CPU time, sampled independently.
+	SelectOffCPU(context.Context, *connect_go.Request[v1.SelectOffCPURequest]) (*connect_go.Response[v1.SelectOffCPUResponse], error)
+	// SelectMergeStacktracesMulti merges the profiles of several queries at once, the profiles
+	// matching more than one of them being read once.
+	SelectMergeStacktracesMulti(context.Context, *connect_go.Request[v1.SelectMergeStacktracesMultiRequest]) (*connect_go.Response[v1.SelectMergeStacktracesMultiResponse], error)
+	// SelectTargetMetadata returns the metadata gathered when scraping the targets of the series
+	// matching the selector, such as their build info.
+	SelectTargetMetadata(context.Context, *connect_go.Request[v1.SelectTargetMetadataRequest]) (*connect_go.Response[v1.SelectTargetMetadataResponse], error)
 }
 
 // NewQuerierServiceClient constructs a client for the querier.v1.QuerierService service. By
@@ -82,18 +101,66 @@ func NewQuerierServiceClient(httpClient connect_go.HTTPClient, baseURL string, o
 			baseURL+"/querier.v1.QuerierService/SelectSeries",
 			opts...,
 		),
+		selectHeatmap: connect_go.NewClient[v1.SelectHeatmapRequest, v1.SelectHeatmapResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectHeatmap",
+			opts...,
+		),
+		storageUsage: connect_go.NewClient[v1.StorageUsageRequest, v1.StorageUsageResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/StorageUsage",
+			opts...,
+		),
+		selectProfileIDs: connect_go.NewClient[v1.SelectProfileIDsRequest, v1.SelectProfileIDsResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectProfileIDs",
+			opts...,
+		),
+		getProfile: connect_go.NewClient[v1.GetProfileRequest, v11.Profile](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/GetProfile",
+			opts...,
+		),
+		selectStackSeries: connect_go.NewClient[v1.SelectStackSeriesRequest, v1.SelectStackSeriesResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectStackSeries",
+			opts...,
+		),
+		selectOffCPU: connect_go.NewClient[v1.SelectOffCPURequest, v1.SelectOffCPUResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectOffCPU",
+			opts...,
+		),
+		selectMergeStacktracesMulti: connect_go.NewClient[v1.SelectMergeStacktracesMultiRequest, v1.SelectMergeStacktracesMultiResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectMergeStacktracesMulti",
+			opts...,
+		),
+		selectTargetMetadata: connect_go.NewClient[v1.SelectTargetMetadataRequest, v1.SelectTargetMetadataResponse](
+			httpClient,
+			baseURL+"/querier.v1.QuerierService/SelectTargetMetadata",
+			opts...,
+		),
 	}
 }
 
 // querierServiceClient implements QuerierServiceClient.
 type querierServiceClient struct {
-	profileTypes           *connect_go.Client[v1.ProfileTypesRequest, v1.ProfileTypesResponse]
-	labelValues            *connect_go.Client[v1.LabelValuesRequest, v1.LabelValuesResponse]
-	labelNames             *connect_go.Client[v1.LabelNamesRequest, v1.LabelNamesResponse]
-	series                 *connect_go.Client[v1.SeriesRequest, v1.SeriesResponse]
-	selectMergeStacktraces *connect_go.Client[v1.SelectMergeStacktracesRequest, v1.SelectMergeStacktracesResponse]
-	selectMergeProfile     *connect_go.Client[v1.SelectMergeProfileRequest, v11.Profile]
-	selectSeries           *connect_go.Client[v1.SelectSeriesRequest, v1.SelectSeriesResponse]
+	profileTypes                *connect_go.Client[v1.ProfileTypesRequest, v1.ProfileTypesResponse]
+	labelValues                 *connect_go.Client[v1.LabelValuesRequest, v1.LabelValuesResponse]
+	labelNames                  *connect_go.Client[v1.LabelNamesRequest, v1.LabelNamesResponse]
+	series                      *connect_go.Client[v1.SeriesRequest, v1.SeriesResponse]
+	selectMergeStacktraces      *connect_go.Client[v1.SelectMergeStacktracesRequest, v1.SelectMergeStacktracesResponse]
+	selectMergeProfile          *connect_go.Client[v1.SelectMergeProfileRequest, v11.Profile]
+	selectSeries                *connect_go.Client[v1.SelectSeriesRequest, v1.SelectSeriesResponse]
+	selectHeatmap               *connect_go.Client[v1.SelectHeatmapRequest, v1.SelectHeatmapResponse]
+	storageUsage                *connect_go.Client[v1.StorageUsageRequest, v1.StorageUsageResponse]
+	selectProfileIDs            *connect_go.Client[v1.SelectProfileIDsRequest, v1.SelectProfileIDsResponse]
+	getProfile                  *connect_go.Client[v1.GetProfileRequest, v11.Profile]
+	selectStackSeries           *connect_go.Client[v1.SelectStackSeriesRequest, v1.SelectStackSeriesResponse]
+	selectOffCPU                *connect_go.Client[v1.SelectOffCPURequest, v1.SelectOffCPUResponse]
+	selectMergeStacktracesMulti *connect_go.Client[v1.SelectMergeStacktracesMultiRequest, v1.SelectMergeStacktracesMultiResponse]
+	selectTargetMetadata        *connect_go.Client[v1.SelectTargetMetadataRequest, v1.SelectTargetMetadataResponse]
 }
 
 // ProfileTypes calls querier.v1.QuerierService.ProfileTypes.
@@ -131,6 +198,46 @@ func (c *querierServiceClient) SelectSeries(ctx context.Context, req *connect_go
 	return c.selectSeries.CallUnary(ctx, req)
 }
 
+// SelectHeatmap calls querier.v1.QuerierService.SelectHeatmap.
+func (c *querierServiceClient) SelectHeatmap(ctx context.Context, req *connect_go.Request[v1.SelectHeatmapRequest]) (*connect_go.Response[v1.SelectHeatmapResponse], error) {
+	return c.selectHeatmap.CallUnary(ctx, req)
+}
+
+// StorageUsage calls querier.v1.QuerierService.StorageUsage.
+func (c *querierServiceClient) StorageUsage(ctx context.Context, req *connect_go.Request[v1.StorageUsageRequest]) (*connect_go.Response[v1.StorageUsageResponse], error) {
+	return c.storageUsage.CallUnary(ctx, req)
+}
+
+// SelectProfileIDs calls querier.v1.QuerierService.SelectProfileIDs.
+func (c *querierServiceClient) SelectProfileIDs(ctx context.Context, req *connect_go.Request[v1.SelectProfileIDsRequest]) (*connect_go.Response[v1.SelectProfileIDsResponse], error) {
+	return c.selectProfileIDs.CallUnary(ctx, req)
+}
+
+// GetProfile calls querier.v1.QuerierService.GetProfile.
+func (c *querierServiceClient) GetProfile(ctx context.Context, req *connect_go.Request[v1.GetProfileRequest]) (*connect_go.Response[v11.Profile], error) {
+	return c.getProfile.CallUnary(ctx, req)
+}
+
+// SelectStackSeries calls querier.v1.QuerierService.SelectStackSeries.
+func (c *querierServiceClient) SelectStackSeries(ctx context.Context, req *connect_go.Request[v1.SelectStackSeriesRequest]) (*connect_go.Response[v1.SelectStackSeriesResponse], error) {
+	return c.selectStackSeries.CallUnary(ctx, req)
+}
+
+// SelectOffCPU calls querier.v1.QuerierService.SelectOffCPU.
+func (c *querierServiceClient) SelectOffCPU(ctx context.Context, req *connect_go.Request[v1.SelectOffCPURequest]) (*connect_go.Response[v1.SelectOffCPUResponse], error) {
+	return c.selectOffCPU.CallUnary(ctx, req)
+}
+
+// SelectMergeStacktracesMulti calls querier.v1.QuerierService.SelectMergeStacktracesMulti.
+func (c *querierServiceClient) SelectMergeStacktracesMulti(ctx context.Context, req *connect_go.Request[v1.SelectMergeStacktracesMultiRequest]) (*connect_go.Response[v1.SelectMergeStacktracesMultiResponse], error) {
+	return c.selectMergeStacktracesMulti.CallUnary(ctx, req)
+}
+
+// SelectTargetMetadata calls querier.v1.QuerierService.SelectTargetMetadata.
+func (c *querierServiceClient) SelectTargetMetadata(ctx context.Context, req *connect_go.Request[v1.SelectTargetMetadataRequest]) (*connect_go.Response[v1.SelectTargetMetadataResponse], error) {
+	return c.selectTargetMetadata.CallUnary(ctx, req)
+}
+
 // QuerierServiceHandler is an implementation of the querier.v1.QuerierService service.
 type QuerierServiceHandler interface {
 	ProfileTypes(context.Context, *connect_go.Request[v1.ProfileTypesRequest]) (*connect_go.Response[v1.ProfileTypesResponse], error)
@@ -140,6 +247,25 @@ type QuerierServiceHandler interface {
 	SelectMergeStacktraces(context.Context, *connect_go.Request[v1.SelectMergeStacktracesRequest]) (*connect_go.Response[v1.SelectMergeStacktracesResponse], error)
 	SelectMergeProfile(context.Context, *connect_go.Request[v1.SelectMergeProfileRequest]) (*connect_go.Response[v11.Profile], error)
 	SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error)
+	// SelectHeatmap returns the distribution over time of the totals of the profiles.
+	SelectHeatmap(context.Context, *connect_go.Request[v1.SelectHeatmapRequest]) (*connect_go.Response[v1.SelectHeatmapResponse], error)
+	// StorageUsage estimates the stored bytes and profiles per value of a label.
+	StorageUsage(context.Context, *connect_go.Request[v1.StorageUsageRequest]) (*connect_go.Response[v1.StorageUsageResponse], error)
+	// SelectProfileIDs returns the IDs of the profiles matching the selector, the most recent first.
+	SelectProfileIDs(context.Context, *connect_go.Request[v1.SelectProfileIDsRequest]) (*connect_go.Response[v1.SelectProfileIDsResponse], error)
+	// GetProfile returns a single profile by its ID.
+	GetProfile(context.Context, *connect_go.Request[v1.GetProfileRequest]) (*connect_go.Response[v11.Profile], error)
+	// SelectStackSeries returns the series contributing the most value under a node of the flamegraph.
+	SelectStackSeries(context.Context, *connect_go.Request[v1.SelectStackSeriesRequest]) (*connect_go.Response[v1.SelectStackSeriesResponse], error)
+	// SelectOffCPU splits the wall-clock time of the stacktraces into on-CPU and off-CPU time. The
+	// off-CPU time is approximated by subtracting the on-CPU time, sampled independently.
+	SelectOffCPU(context.Context, *connect_go.Request[v1.SelectOffCPURequest]) (*connect_go.Response[v1.SelectOffCPUResponse], error)
+	// SelectMergeStacktracesMulti merges the profiles of several queries at once, the profiles
+	// matching more than one of them being read once.
+	SelectMergeStacktracesMulti(context.Context, *connect_go.Request[v1.SelectMergeStacktracesMultiRequest]) (*connect_go.Response[v1.SelectMergeStacktracesMultiResponse], error)
+	// SelectTargetMetadata returns the metadata gathered when scraping the targets of the series
+	// matching the selector, such as their build info.
+	SelectTargetMetadata(context.Context, *connect_go.Request[v1.SelectTargetMetadataRequest]) (*connect_go.Response[v1.SelectTargetMetadataResponse], error)
 }
 
 // NewQuerierServiceHandler builds an HTTP handler from the service implementation. It returns the
@@ -184,6 +310,46 @@ func NewQuerierServiceHandler(svc QuerierServiceHandler, opts ...connect_go.Hand
 		svc.SelectSeries,
 		opts...,
 	))
+	mux.Handle("/querier.v1.QuerierService/SelectHeatmap", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectHeatmap",
+		svc.SelectHeatmap,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/StorageUsage", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/StorageUsage",
+		svc.StorageUsage,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectProfileIDs", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectProfileIDs",
+		svc.SelectProfileIDs,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/GetProfile", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/GetProfile",
+		svc.GetProfile,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectStackSeries", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectStackSeries",
+		svc.SelectStackSeries,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectOffCPU", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectOffCPU",
+		svc.SelectOffCPU,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectMergeStacktracesMulti", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectMergeStacktracesMulti",
+		svc.SelectMergeStacktracesMulti,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectTargetMetadata", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectTargetMetadata",
+		svc.SelectTargetMetadata,
+		opts...,
+	))
 	return "/querier.v1.QuerierService/", mux
 }
 
@@ -217,3 +383,35 @@ func (UnimplementedQuerierServiceHandler) SelectMergeProfile(context.Context, *c
 func (UnimplementedQuerierServiceHandler) SelectSeries(context.Context, *connect_go.Request[v1.SelectSeriesRequest]) (*connect_go.Response[v1.SelectSeriesResponse], error) {
 	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectSeries is not implemented"))
 }
+
+func (UnimplementedQuerierServiceHandler) SelectHeatmap(context.Context, *connect_go.Request[v1.SelectHeatmapRequest]) (*connect_go.Response[v1.SelectHeatmapResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectHeatmap is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) StorageUsage(context.Context, *connect_go.Request[v1.StorageUsageRequest]) (*connect_go.Response[v1.StorageUsageResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.StorageUsage is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) SelectProfileIDs(context.Context, *connect_go.Request[v1.SelectProfileIDsRequest]) (*connect_go.Response[v1.SelectProfileIDsResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectProfileIDs is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) GetProfile(context.Context, *connect_go.Request[v1.GetProfileRequest]) (*connect_go.Response[v11.Profile], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.GetProfile is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) SelectStackSeries(context.Context, *connect_go.Request[v1.SelectStackSeriesRequest]) (*connect_go.Response[v1.SelectStackSeriesResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectStackSeries is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) SelectOffCPU(context.Context, *connect_go.Request[v1.SelectOffCPURequest]) (*connect_go.Response[v1.SelectOffCPUResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectOffCPU is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) SelectMergeStacktracesMulti(context.Context, *connect_go.Request[v1.SelectMergeStacktracesMultiRequest]) (*connect_go.Response[v1.SelectMergeStacktracesMultiResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectMergeStacktracesMulti is not implemented"))
+}
+
+func (UnimplementedQuerierServiceHandler) SelectTargetMetadata(context.Context, *connect_go.Request[v1.SelectTargetMetadataRequest]) (*connect_go.Response[v1.SelectTargetMetadataResponse], error) {
+	return nil, connect_go.NewError(connect_go.CodeUnimplemented, errors.New("querier.v1.QuerierService.SelectTargetMetadata is not implemented"))
+}
@@ -54,4 +54,44 @@ func RegisterQuerierServiceHandler(mux *mux.Router, svc QuerierServiceHandler, o
 		svc.SelectSeries,
 		opts...,
 	))
+	mux.Handle("/querier.v1.QuerierService/SelectHeatmap", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectHeatmap",
+		svc.SelectHeatmap,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/StorageUsage", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/StorageUsage",
+		svc.StorageUsage,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectProfileIDs", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectProfileIDs",
+		svc.SelectProfileIDs,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/GetProfile", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/GetProfile",
+		svc.GetProfile,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectStackSeries", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectStackSeries",
+		svc.SelectStackSeries,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectOffCPU", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectOffCPU",
+		svc.SelectOffCPU,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectMergeStacktracesMulti", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectMergeStacktracesMulti",
+		svc.SelectMergeStacktracesMulti,
+		opts...,
+	))
+	mux.Handle("/querier.v1.QuerierService/SelectTargetMetadata", connect_go.NewUnaryHandler(
+		"/querier.v1.QuerierService/SelectTargetMetadata",
+		svc.SelectTargetMetadata,
+		opts...,
+	))
 }
@@ -0,0 +1,321 @@
+// Package client captures the runtime profiles of a Go application and pushes them to Phlare,
+// so the application can be profiled without running an agent.
+//
+//	profiler, err := client.Start(client.Config{
+//		URL:    "http://phlare:4100",
+//		Labels: map[string]string{"service_name": "my-app"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer profiler.Stop()
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/multierror"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// ProfileType is a type of profile captured by the profiler. Its value is the name of the
+// profiles in Phlare.
+type ProfileType string
+
+const (
+	ProfileCPU       ProfileType = "process_cpu"
+	ProfileHeap      ProfileType = "memory"
+	ProfileGoroutine ProfileType = "goroutine"
+	ProfileMutex     ProfileType = "mutex"
+	ProfileBlock     ProfileType = "block"
+)
+
+// DefaultProfileTypes are the types of profiles captured when none are configured.
+var DefaultProfileTypes = []ProfileType{ProfileCPU, ProfileHeap, ProfileGoroutine}
+
+const (
+	defaultInterval = 15 * time.Second
+
+	// idempotencyKeyHeader identifies a push, so the retries of a push whose response was lost
+	// are not ingested twice.
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Config configures the profiler.
+type Config struct {
+	// URL is the URL of Phlare, or of its distributors.
+	URL string
+	// TenantID is the tenant the profiles are pushed to. It can be left empty when Phlare runs
+	// without multi-tenancy.
+	TenantID string
+	// Labels are attached to all the profiles pushed.
+	Labels map[string]string
+	// ProfileTypes are the types of profiles captured. Defaults to DefaultProfileTypes.
+	ProfileTypes []ProfileType
+	// Interval is the period of the profiles. Defaults to 15 seconds.
+	Interval time.Duration
+
+	// MutexProfileFraction is set with runtime.SetMutexProfileFraction when the mutex profile
+	// is captured. Defaults to 5.
+	MutexProfileFraction int
+	// BlockProfileRate is set with runtime.SetBlockProfileRate when the block profile is
+	// captured. Defaults to 10000 nanoseconds.
+	BlockProfileRate int
+
+	// Backoff configures the retries of the pushes failing with a retryable error. Defaults to
+	// 3 retries, waiting between 1 and 10 seconds.
+	Backoff backoff.Config
+	// HTTPClient is the client used to push the profiles. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Logger logs the failures of the profiler. Defaults to a no-op logger.
+	Logger log.Logger
+}
+
+func (cfg *Config) setDefaults() {
+	if len(cfg.ProfileTypes) == 0 {
+		cfg.ProfileTypes = DefaultProfileTypes
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultInterval
+	}
+	if cfg.MutexProfileFraction <= 0 {
+		cfg.MutexProfileFraction = 5
+	}
+	if cfg.BlockProfileRate <= 0 {
+		cfg.BlockProfileRate = 10000
+	}
+	if cfg.Backoff == (backoff.Config{}) {
+		cfg.Backoff = backoff.Config{
+			MinBackoff: time.Second,
+			MaxBackoff: 10 * time.Second,
+			MaxRetries: 3,
+		}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.NewNopLogger()
+	}
+}
+
+// Profiler captures the profiles of the application on an interval and pushes them to Phlare.
+type Profiler struct {
+	cfg    Config
+	client pushv1connect.PusherServiceClient
+	labels []*typesv1.LabelPair
+
+	cpu    bool
+	cpuBuf bytes.Buffer
+	deltas map[ProfileType]*deltaProfiler
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Start starts capturing the profiles of the application and pushing them to Phlare, until
+// the profiler is stopped.
+func Start(cfg Config) (*Profiler, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("the URL of Phlare is required")
+	}
+	cfg.setDefaults()
+
+	p := &Profiler{
+		cfg:    cfg,
+		deltas: map[ProfileType]*deltaProfiler{},
+	}
+	p.client = pushv1connect.NewPusherServiceClient(cfg.HTTPClient, cfg.URL, connect.WithInterceptors(p.headersInterceptor()))
+	for name, value := range cfg.Labels {
+		p.labels = append(p.labels, &typesv1.LabelPair{Name: name, Value: value})
+	}
+	sort.Slice(p.labels, func(i, j int) bool { return p.labels[i].Name < p.labels[j].Name })
+
+	for _, t := range cfg.ProfileTypes {
+		switch t {
+		case ProfileCPU:
+			p.cpu = true
+		case ProfileMutex:
+			runtime.SetMutexProfileFraction(cfg.MutexProfileFraction)
+			p.deltas[t] = &deltaProfiler{}
+		case ProfileBlock:
+			runtime.SetBlockProfileRate(cfg.BlockProfileRate)
+			p.deltas[t] = &deltaProfiler{}
+		case ProfileHeap, ProfileGoroutine:
+		default:
+			return nil, fmt.Errorf("unsupported profile type: %q", t)
+		}
+	}
+	if p.cpu {
+		if err := pprof.StartCPUProfile(&p.cpuBuf); err != nil {
+			return nil, fmt.Errorf("failed to start the CPU profile: %w", err)
+		}
+	}
+	// The first profiles of the cumulative types are the baseline of the next ones.
+	for t := range p.deltas {
+		if _, err := p.capture(t); err != nil {
+			level.Warn(cfg.Logger).Log("msg", "failed to collect profile", "type", t, "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.wg.Add(1)
+	go p.loop(ctx)
+	return p, nil
+}
+
+// Stop stops the profiler. The profiles captured since the last push are discarded.
+func (p *Profiler) Stop() {
+	p.cancel()
+	p.wg.Wait()
+	if p.cpu {
+		pprof.StopCPUProfile()
+	}
+}
+
+func (p *Profiler) loop(ctx context.Context) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		series, err := p.collect()
+		if err != nil {
+			level.Warn(p.cfg.Logger).Log("msg", "failed to collect profiles", "err", err)
+		}
+		if len(series) == 0 {
+			continue
+		}
+		if err := p.push(ctx, series); err != nil {
+			level.Error(p.cfg.Logger).Log("msg", "failed to push profiles", "err", err)
+		}
+	}
+}
+
+// collect captures the profiles of the interval. The profiles of a type failing to be captured
+// are skipped.
+func (p *Profiler) collect() ([]*pushv1.RawProfileSeries, error) {
+	var (
+		series []*pushv1.RawProfileSeries
+		errs   = multierror.New()
+	)
+	for _, t := range p.cfg.ProfileTypes {
+		raw, err := p.capture(t)
+		if err != nil {
+			errs.Add(fmt.Errorf("%s: %w", t, err))
+			continue
+		}
+		if raw == nil {
+			continue
+		}
+		labels := make([]*typesv1.LabelPair, 0, len(p.labels)+1)
+		labels = append(labels, &typesv1.LabelPair{Name: "__name__", Value: string(t)})
+		labels = append(labels, p.labels...)
+		series = append(series, &pushv1.RawProfileSeries{
+			Labels:  labels,
+			Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: raw}},
+		})
+	}
+	return series, errs.Err()
+}
+
+func (p *Profiler) capture(t ProfileType) ([]byte, error) {
+	if t == ProfileCPU {
+		pprof.StopCPUProfile()
+		raw := append([]byte(nil), p.cpuBuf.Bytes()...)
+		p.cpuBuf.Reset()
+		if err := pprof.StartCPUProfile(&p.cpuBuf); err != nil {
+			return nil, err
+		}
+		return raw, nil
+	}
+
+	name := string(t)
+	if t == ProfileHeap {
+		name = "heap"
+	}
+	var buf bytes.Buffer
+	if err := pprof.Lookup(name).WriteTo(&buf, 0); err != nil {
+		return nil, err
+	}
+	d, ok := p.deltas[t]
+	if !ok {
+		return buf.Bytes(), nil
+	}
+	prof, err := profile.Parse(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if prof, err = d.delta(prof); err != nil || prof == nil {
+		return nil, err
+	}
+	buf.Reset()
+	if err := prof.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// push pushes the profiles, retrying on the errors that are not caused by the request itself.
+// All the attempts carry the same idempotency key.
+func (p *Profiler) push(ctx context.Context, series []*pushv1.RawProfileSeries) error {
+	key := uuid.NewString()
+	retries := backoff.New(ctx, p.cfg.Backoff)
+	var err error
+	for retries.Ongoing() {
+		req := connect.NewRequest(&pushv1.PushRequest{Series: series})
+		req.Header().Set(idempotencyKeyHeader, key)
+		if _, err = p.client.Push(ctx, req); err == nil || !retryable(err) {
+			return err
+		}
+		level.Warn(p.cfg.Logger).Log("msg", "push failed, retrying", "err", err)
+		retries.Wait()
+	}
+	if err == nil {
+		err = retries.Err()
+	}
+	return err
+}
+
+func retryable(err error) bool {
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable, connect.CodeResourceExhausted, connect.CodeDeadlineExceeded,
+		connect.CodeAborted, connect.CodeInternal, connect.CodeUnknown:
+		return true
+	}
+	return false
+}
+
+func (p *Profiler) headersInterceptor() connect.UnaryInterceptorFunc {
+	return func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			if p.cfg.TenantID != "" {
+				req.Header().Set("X-Scope-OrgID", p.cfg.TenantID)
+			}
+			return next(ctx, req)
+		}
+	}
+}
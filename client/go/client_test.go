@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/google/pprof/profile"
+	"github.com/grafana/dskit/backoff"
+	"github.com/stretchr/testify/require"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+type fakePusher struct {
+	mtx      sync.Mutex
+	requests []*connect.Request[pushv1.PushRequest]
+	errs     []error
+}
+
+func (f *fakePusher) Push(_ context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.requests = append(f.requests, req)
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func (f *fakePusher) Requests() []*connect.Request[pushv1.PushRequest] {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]*connect.Request[pushv1.PushRequest](nil), f.requests...)
+}
+
+func newServer(t *testing.T, pusher *fakePusher) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(pushv1connect.NewPusherServiceHandler(pusher))
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s.URL
+}
+
+func TestProfiler(t *testing.T) {
+	pusher := &fakePusher{}
+	profiler, err := Start(Config{
+		URL:          newServer(t, pusher),
+		TenantID:     "tenant-a",
+		Labels:       map[string]string{"service_name": "test"},
+		ProfileTypes: []ProfileType{ProfileCPU, ProfileHeap, ProfileGoroutine, ProfileMutex},
+		Interval:     50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(pusher.Requests()) >= 2 }, 5*time.Second, 10*time.Millisecond)
+	profiler.Stop()
+
+	req := pusher.Requests()[0]
+	require.Equal(t, "tenant-a", req.Header().Get("X-Scope-OrgID"))
+	require.NotEmpty(t, req.Header().Get(idempotencyKeyHeader))
+
+	var names []string
+	for _, s := range req.Msg.Series {
+		require.Equal(t, "service_name", s.Labels[1].Name)
+		require.Equal(t, "test", s.Labels[1].Value)
+		names = append(names, s.Labels[0].Value)
+		require.Len(t, s.Samples, 1)
+		_, err := profile.ParseData(s.Samples[0].RawProfile)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"process_cpu", "memory", "goroutine", "mutex"}, names)
+}
+
+func TestProfiler_PushRetries(t *testing.T) {
+	pusher := &fakePusher{}
+	p := &Profiler{
+		cfg: Config{
+			Backoff: backoff.Config{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxRetries: 3},
+		},
+		client: pushv1connect.NewPusherServiceClient(http.DefaultClient, newServer(t, pusher)),
+	}
+	p.cfg.setDefaults()
+	series := []*pushv1.RawProfileSeries{{Labels: []*typesv1.LabelPair{{Name: "__name__", Value: "goroutine"}}}}
+
+	pusher.errs = []error{
+		connect.NewError(connect.CodeUnavailable, nil),
+		connect.NewError(connect.CodeResourceExhausted, nil),
+	}
+	require.NoError(t, p.push(context.Background(), series))
+	requests := pusher.Requests()
+	require.Len(t, requests, 3)
+	require.Equal(t, requests[0].Header().Get(idempotencyKeyHeader), requests[2].Header().Get(idempotencyKeyHeader))
+
+	pusher.requests = nil
+	pusher.errs = []error{connect.NewError(connect.CodeInvalidArgument, nil)}
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(p.push(context.Background(), series)))
+	require.Len(t, pusher.Requests(), 1)
+}
+
+func TestDeltaProfiler(t *testing.T) {
+	fn := &profile.Function{ID: 1, Name: "foo"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+	newProfile := func(timeNanos int64, values ...int64) *profile.Profile {
+		p := &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "contentions", Unit: "count"}},
+			PeriodType: &profile.ValueType{Type: "contentions", Unit: "count"},
+			TimeNanos:  timeNanos,
+			Function:   []*profile.Function{fn},
+			Location:   []*profile.Location{loc},
+		}
+		for i, v := range values {
+			p.Sample = append(p.Sample, &profile.Sample{
+				Location: []*profile.Location{loc},
+				Value:    []int64{v},
+				Label:    map[string][]string{"i": {string(rune('a' + i))}},
+			})
+		}
+		return p
+	}
+
+	var d deltaProfiler
+	delta, err := d.delta(newProfile(1, 10, 5))
+	require.NoError(t, err)
+	require.Nil(t, delta)
+
+	delta, err = d.delta(newProfile(3, 15, 5, 2))
+	require.NoError(t, err)
+	require.Equal(t, int64(3), delta.TimeNanos)
+	require.Equal(t, int64(2), delta.DurationNanos)
+	values := map[string]int64{}
+	for _, s := range delta.Sample {
+		values[s.Label["i"][0]] = s.Value[0]
+	}
+	require.Equal(t, map[string]int64{"a": 5, "c": 2}, values)
+}
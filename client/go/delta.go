@@ -0,0 +1,40 @@
+package client
+
+import (
+	"github.com/google/pprof/profile"
+)
+
+// deltaProfiler turns the cumulative profiles of a type into the profiles of the
+// values accumulated since the previous collection.
+type deltaProfiler struct {
+	previous *profile.Profile
+}
+
+// delta returns the difference between the profile and the previous one, or nil for the first
+// profile, which is only kept as a baseline.
+func (d *deltaProfiler) delta(p *profile.Profile) (*profile.Profile, error) {
+	previous := d.previous
+	d.previous = p.Copy()
+	if previous == nil {
+		return nil, nil
+	}
+
+	previous.Scale(-1)
+	delta, err := profile.Merge([]*profile.Profile{previous, p})
+	if err != nil {
+		return nil, err
+	}
+	samples := delta.Sample[:0]
+	for _, s := range delta.Sample {
+		for _, v := range s.Value {
+			if v != 0 {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	delta.Sample = samples
+	delta.TimeNanos = p.TimeNanos
+	delta.DurationNanos = p.TimeNanos - previous.TimeNanos
+	return delta.Compact(), nil
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	_ "embed"
 	"flag"
 	"fmt"
 	"os"
 	"sort"
 
+	"github.com/go-kit/log"
 	"github.com/grafana/dskit/flagext"
 	"github.com/prometheus/common/version"
 
@@ -23,6 +25,9 @@ type mainFlags struct {
 	PrintModules bool `yaml:"-"`
 	PrintHelp    bool `yaml:"-"`
 	PrintHelpAll bool `yaml:"-"`
+
+	ValidateConfig       bool `yaml:"-"`
+	ValidateConfigOnline bool `yaml:"-"`
 }
 
 func (mf *mainFlags) Clone() flagext.Registerer {
@@ -42,6 +47,8 @@ func (mf *mainFlags) RegisterFlags(fs *flag.FlagSet) {
 	fs.BoolVar(&mf.PrintHelp, "h", false, "Print basic help.")
 	fs.BoolVar(&mf.PrintHelp, "help", false, "Print basic help.")
 	fs.BoolVar(&mf.PrintHelpAll, "help-all", false, "Print help, also including advanced and experimental parameters.")
+	fs.BoolVar(&mf.ValidateConfig, "config.validate", false, "Validate the configuration, including the runtime configuration files of the per-tenant overrides, and exit.")
+	fs.BoolVar(&mf.ValidateConfigOnline, "config.validate-online", false, "When validating the configuration, also check the storage bucket is reachable.")
 }
 
 func main() {
@@ -54,6 +61,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if flags.ValidateConfig {
+		logger := log.NewLogfmtLogger(os.Stderr)
+		if err := phlare.ValidateConfig(context.Background(), flags.Config, logger, flags.ValidateConfigOnline); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, "config is valid")
+		return
+	}
+
 	f, err := phlare.New(flags.Config)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed creating phlare: %v\n", err)
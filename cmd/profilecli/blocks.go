@@ -1,16 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log/level"
 	"github.com/olekukonko/tablewriter"
 
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	"github.com/grafana/phlare/pkg/phlaredb"
 	"github.com/grafana/phlare/pkg/phlaredb/block"
@@ -26,22 +30,41 @@ func fileInfo(f *block.File) string {
 	return ""
 }
 
+// newBlockQuerier returns a querier of the blocks of the bucket, reading their files from the
+// cache directory when one is set.
+func newBlockQuerier(ctx context.Context, bucket phlareobjstore.BucketReader) (*phlaredb.BlockQuerier, error) {
+	querier := phlaredb.NewBlockQuerier(ctx, bucket)
+	if cfg.blocks.cacheDir != "" {
+		cache, err := block.NewFileCache(cfg.blocks.cacheDir, cfg.blocks.cacheMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		querier.SetFileCache(cache)
+	}
+	return querier, nil
+}
+
 func blocksList(ctx context.Context) error {
 	bucket, err := filesystem.NewBucket(cfg.blocks.path)
 	if err != nil {
 		return err
 	}
 
-	metas, err := phlaredb.NewBlockQuerier(ctx, bucket).BlockMetas(ctx)
+	querier, err := newBlockQuerier(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	metas, err := querier.BlockMetas(ctx)
 	if err != nil {
 		return err
 	}
 
 	table := tablewriter.NewWriter(output(ctx))
-	table.SetHeader([]string{"Block ID", "MinTime", "MaxTime", "Duration", "Index", "Profiles", "Stacktraces", "Locations", "Functions", "Strings"})
+	table.SetHeader([]string{"Block ID", "Version", "MinTime", "MaxTime", "Duration", "Index", "Profiles", "Stacktraces", "Locations", "Functions", "Strings"})
 	for _, blockInfo := range metas {
 		table.Append([]string{
 			blockInfo.ULID.String(),
+			strconv.Itoa(int(blockInfo.Version)),
 			blockInfo.MinTime.Time().Format(time.RFC3339),
 			blockInfo.MaxTime.Time().Format(time.RFC3339),
 			blockInfo.MaxTime.Time().Sub(blockInfo.MinTime.Time()).String(),
@@ -74,3 +97,87 @@ func blocksList(ctx context.Context) error {
 
 	return nil
 }
+
+func blocksReplay(ctx context.Context, path string) error {
+	bucket, err := filesystem.NewBucket(cfg.blocks.path)
+	if err != nil {
+		return err
+	}
+	querier, err := newBlockQuerier(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if err := querier.Sync(ctx); err != nil {
+		return err
+	}
+	defer querier.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	table := tablewriter.NewWriter(output(ctx))
+	table.SetHeader([]string{"Time", "Operation", "Selector", "Captured", "Block ID", "Rows", "Replayed", "Error"})
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var capture phlaredb.QueryCapture
+		if err := json.Unmarshal(scanner.Bytes(), &capture); err != nil {
+			return err
+		}
+		replayed, err := querier.ReplayQueryCapture(ctx, &capture)
+		if err != nil {
+			return err
+		}
+		for _, b := range replayed {
+			var errMsg string
+			if b.Err != nil {
+				errMsg = b.Err.Error()
+			}
+			table.Append([]string{
+				capture.Time.Format(time.RFC3339),
+				capture.Operation,
+				capture.Selector,
+				capture.Duration.String(),
+				b.ULID,
+				strconv.FormatInt(b.Rows, 10),
+				b.Duration.String(),
+				errMsg,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	table.Render()
+
+	return nil
+}
+
+func blocksRewriteVersionRun(ctx context.Context, version int, ids []string) error {
+	if len(ids) == 0 {
+		entries, err := os.ReadDir(cfg.blocks.path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if _, ok := block.IsBlockDir(e.Name()); ok {
+				ids = append(ids, e.Name())
+			}
+		}
+	}
+	for _, id := range ids {
+		changed, err := phlaredb.RewriteBlockVersion(ctx, logger, filepath.Join(cfg.blocks.path, id), block.MetaVersion(version))
+		if err != nil {
+			return fmt.Errorf("rewrite block %s: %w", id, err)
+		}
+		status := "unchanged"
+		if changed {
+			status = "rewritten"
+		}
+		fmt.Fprintf(output(ctx), "%s\t%s\n", id, status)
+	}
+	return nil
+}
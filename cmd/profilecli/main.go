@@ -21,6 +21,8 @@ var cfg struct {
 	blocks  struct {
 		path               string
 		restoreMissingMeta bool
+		cacheDir           string
+		cacheMaxBytes      int64
 	}
 }
 
@@ -40,14 +42,29 @@ func main() {
 
 	blocksCmd := app.Command("blocks", "Operate on Grafana Phlare's blocks.")
 	blocksCmd.Flag("path", "Path to blocks directory").Default("./data/local").StringVar(&cfg.blocks.path)
+	blocksCmd.Flag("cache-dir", "Directory keeping verified local copies of the files of the blocks across runs, for example when the blocks directory is a mounted bucket. Disabled when empty.").StringVar(&cfg.blocks.cacheDir)
+	blocksCmd.Flag("cache-max-bytes", "Maximum size of the local copies of the cache directory, the least recently used are deleted first. 0 for no limit.").Default("10737418240").Int64Var(&cfg.blocks.cacheMaxBytes)
 
 	blocksListCmd := blocksCmd.Command("list", "List blocks.")
 	blocksListCmd.Flag("restore-missing-meta", "").Default("false").BoolVar(&cfg.blocks.restoreMissingMeta)
 
+	blocksReplayCmd := blocksCmd.Command("replay", "Replay the queries of a query capture file against the blocks.")
+	blocksReplayFile := blocksReplayCmd.Arg("file", "query capture file path").Required().ExistingFile()
+
+	blocksRewriteVersionCmd := blocksCmd.Command("rewrite-version", "Rewrite blocks in another format version, for example so they can be read by components not upgraded yet.")
+	blocksRewriteVersion := blocksRewriteVersionCmd.Flag("format-version", "Format version to rewrite the blocks in.").Required().Int()
+	blocksRewriteVersionIDs := blocksRewriteVersionCmd.Arg("block-id", "IDs of the blocks to rewrite, all the blocks when empty.").Strings()
+
 	parquetCmd := app.Command("parquet", "Operate on a Parquet file.")
 	parquetInspectCmd := parquetCmd.Command("inspect", "Inspect a parquet file's structure.")
 	parquetInspectFiles := parquetInspectCmd.Arg("file", "parquet file path").Required().ExistingFiles()
 
+	pushCaptureCmd := app.Command("push-capture", "Operate on the push requests captured by the distributors.")
+	pushCaptureReplayCmd := pushCaptureCmd.Command("replay", "Push the requests of a push capture file again.")
+	pushCaptureReplayFile := pushCaptureReplayCmd.Arg("file", "push capture file path").Required().ExistingFile()
+	pushCaptureReplayURL := pushCaptureReplayCmd.Flag("url", "URL of the distributor.").Default("http://localhost:4100").String()
+	pushCaptureReplayTenantID := pushCaptureReplayCmd.Flag("tenant-id", "Tenant ID the requests are pushed to. Defaults to the tenant ID the requests were captured with.").String()
+
 	queryCmd := app.Command("query", "Query profile store.")
 	queryParams := addQueryParams(queryCmd)
 	queryOutput := queryCmd.Flag("output", "How to output the result, examples: console, raw, pprof=./my.pprof").Default("console").String()
@@ -64,12 +81,18 @@ func main() {
 	switch parsedCmd {
 	case blocksListCmd.FullCommand():
 		os.Exit(checkError(blocksList(ctx)))
+	case blocksReplayCmd.FullCommand():
+		os.Exit(checkError(blocksReplay(ctx, *blocksReplayFile)))
+	case blocksRewriteVersionCmd.FullCommand():
+		os.Exit(checkError(blocksRewriteVersionRun(ctx, *blocksRewriteVersion, *blocksRewriteVersionIDs)))
 	case parquetInspectCmd.FullCommand():
 		for _, file := range *parquetInspectFiles {
 			if err := parquetInspect(ctx, file); err != nil {
 				os.Exit(checkError(err))
 			}
 		}
+	case pushCaptureReplayCmd.FullCommand():
+		os.Exit(checkError(pushCaptureReplay(ctx, *pushCaptureReplayFile, *pushCaptureReplayURL, *pushCaptureReplayTenantID)))
 	case queryMergeCmd.FullCommand():
 		if err := queryMerge(ctx, queryParams, *queryOutput); err != nil {
 			os.Exit(checkError(err))
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log/level"
+
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	"github.com/grafana/phlare/pkg/distributor"
+)
+
+// pushCaptureReplay pushes the requests of a push capture file again, with the tenant ID they
+// were captured with unless tenantID is set.
+func pushCaptureReplay(ctx context.Context, path, url, tenantID string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// the file is read up to its current size: it's still written when the distributor replayed
+	// to captures its pushes.
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	client := pushv1connect.NewPusherServiceClient(http.DefaultClient, url)
+	var pushed, failed int
+	err = distributor.ReadPushCaptures(io.LimitReader(f, info.Size()), func(c *distributor.CapturedPush) error {
+		req, err := c.PushRequest()
+		if err != nil {
+			return err
+		}
+		pushReq := connect.NewRequest(req)
+		pushTenantID := tenantID
+		if pushTenantID == "" {
+			pushTenantID = c.TenantID
+		}
+		pushReq.Header().Set("X-Scope-OrgID", pushTenantID)
+		if _, err := client.Push(ctx, pushReq); err != nil {
+			failed++
+			level.Warn(logger).Log("msg", "captured push failed", "time", c.Time, "tenant", c.TenantID, "err", err)
+			return nil
+		}
+		pushed++
+		return nil
+	})
+	fmt.Fprintf(output(ctx), "replayed %d pushes, %d failed\n", pushed+failed, failed)
+	return err
+}
@@ -2,7 +2,9 @@ package agent
 
 import (
 	"context"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
@@ -25,7 +27,11 @@ type Agent struct {
 	groups               map[string]*TargetGroup
 	pusherClientProvider PusherClientProvider
 
-	mtx sync.Mutex
+	mtx sync.RWMutex
+
+	captureMtx sync.Mutex
+	// captured are the IDs of the captures started, until they expire.
+	captured map[string]time.Time
 }
 
 type TargetManager interface {
@@ -61,6 +67,9 @@ func (a *Agent) running(ctx context.Context) error {
 	if err := a.manager.ApplyConfig(a.jobs); err != nil {
 		return nil
 	}
+	if a.Config.RemoteConfig.URL.String() != "" {
+		go a.pollRemoteConfig(ctx)
+	}
 
 	for {
 		select {
@@ -86,6 +95,8 @@ func (a *Agent) running(ctx context.Context) error {
 
 func (a *Agent) ActiveTargets() map[string][]*Target {
 	result := map[string][]*Target{}
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
 
 	// todo: (callum) maybe return not a map + sort so the results don't reorder on every load?
 	for g, tg := range a.groups {
@@ -93,20 +104,45 @@ func (a *Agent) ActiveTargets() map[string][]*Target {
 		for _, target := range tg.activeTargets {
 			result[g] = append(result[g], target)
 		}
+		tg.mtx.RUnlock()
 	}
 	return result
 }
 
 func (a *Agent) DroppedTargets() []*Target {
 	result := []*Target{}
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
 
 	for _, tg := range a.groups {
 		tg.mtx.RLock()
 		result = append(result, tg.droppedTargets...)
+		tg.mtx.RUnlock()
 	}
 	return result
 }
 
+// ApplyScrapeConfigs replaces the scrape configs of the agent. The targets of the jobs removed or
+// changed are stopped, and the targets of the new jobs are discovered.
+func (a *Agent) ApplyScrapeConfigs(configs []*ScrapeConfig) error {
+	a.mtx.Lock()
+	jobs := make(map[string]discovery.Configs, len(configs))
+	for _, cfg := range configs {
+		jobs[cfg.JobName] = cfg.ServiceDiscoveryConfig.Configs()
+	}
+	a.Config.ScrapeConfigs = configs
+	for jobName, group := range a.groups {
+		if cfg := jobConfig(jobName, a.Config); cfg.JobName != "" && reflect.DeepEqual(cfg, group.config) {
+			continue
+		}
+		group.sync(nil)
+		delete(a.groups, jobName)
+	}
+	a.jobs = jobs
+	a.mtx.Unlock()
+	return a.manager.ApplyConfig(jobs)
+}
+
 func jobConfig(jobName string, config *Config) ScrapeConfig {
 	for _, cfg := range config.ScrapeConfigs {
 		if cfg.JobName == jobName {
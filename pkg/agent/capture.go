@@ -0,0 +1,333 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+const (
+	// CaptureIDLabel is the label of the profiles captured on demand, giving the ID of their capture.
+	CaptureIDLabel = "capture_id"
+	// DefaultCaptureTTL is how long the captures are served to the agents polling their config.
+	DefaultCaptureTTL = 10 * time.Minute
+	// DefaultMaxCaptures is how many captures are kept at most, the oldest being evicted first.
+	DefaultMaxCaptures = 10000
+	// DefaultMaxCaptureBytes is the size the captures kept take at most, the oldest being evicted
+	// first.
+	DefaultMaxCaptureBytes = 16 << 20
+
+	defaultCaptureDuration = model.Duration(30 * time.Second)
+	maxCaptureDuration     = model.Duration(5 * time.Minute)
+	// captureTimeoutMargin is the time given to the targets to answer, on top of the duration.
+	captureTimeoutMargin = 10 * time.Second
+)
+
+// Capture asks the agents to profile the targets matching its selector now, for a duration. The
+// profiles captured are labeled with its ID and labels, such as the labels of the alert which
+// triggered it.
+type Capture struct {
+	ID string `yaml:"id" json:"id"`
+	// Selector selects the targets to profile by their labels, such as {service_name="api"}.
+	Selector string `yaml:"selector" json:"selector"`
+	// AgentSelector restricts the capture to the agents whose labels match, all by default.
+	AgentSelector string         `yaml:"agent_selector,omitempty" json:"agent_selector,omitempty"`
+	Duration      model.Duration `yaml:"duration,omitempty" json:"duration,omitempty"`
+	// Labels are added to the profiles captured, unless the targets already have them.
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	// Expires is when the agents stop picking the capture up.
+	Expires time.Time `yaml:"expires" json:"expires"`
+
+	matchers      []*labels.Matcher
+	agentMatchers []*labels.Matcher
+}
+
+// Validate validates the capture, applies its defaults and prepares its selectors.
+func (c *Capture) Validate() error {
+	matchers, err := parser.ParseMetricSelector(c.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector %q: %w", c.Selector, err)
+	}
+	c.matchers = matchers
+	c.agentMatchers = nil
+	if c.AgentSelector != "" {
+		if c.agentMatchers, err = parser.ParseMetricSelector(c.AgentSelector); err != nil {
+			return fmt.Errorf("invalid agent selector %q: %w", c.AgentSelector, err)
+		}
+	}
+	if c.Duration == 0 {
+		c.Duration = defaultCaptureDuration
+	}
+	if c.Duration < model.Duration(time.Second) || c.Duration > maxCaptureDuration {
+		return fmt.Errorf("capture duration must be between 1s and %s", maxCaptureDuration)
+	}
+	for name := range c.Labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid capture label name %q", name)
+		}
+	}
+	return nil
+}
+
+func matchesAll(matchers []*labels.Matcher, lbls labels.Labels) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// size estimates the memory taken by the capture.
+func (c *Capture) size() int {
+	n := len(c.ID) + len(c.Selector) + len(c.AgentSelector)
+	for name, value := range c.Labels {
+		n += len(name) + len(value)
+	}
+	return n
+}
+
+// CaptureStore keeps the captures requested by the tenants, until they expire. The agents pick
+// them up when polling their config.
+//
+// The store is in memory and local to the instance: the agents only see the captures requested
+// from the instance they poll. It keeps at most maxCaptures captures taking maxBytes, evicting the
+// oldest ones first.
+type CaptureStore struct {
+	ttl         time.Duration
+	maxCaptures int
+	maxBytes    int
+	now         func() time.Time
+
+	mtx      sync.Mutex
+	captures map[string][]*Capture
+	count    int
+	bytes    int
+}
+
+// NewCaptureStore returns a store serving the captures for ttl, with the default limits.
+func NewCaptureStore(ttl time.Duration) *CaptureStore {
+	return &CaptureStore{
+		ttl:         ttl,
+		maxCaptures: DefaultMaxCaptures,
+		maxBytes:    DefaultMaxCaptureBytes,
+		now:         time.Now,
+		captures:    make(map[string][]*Capture),
+	}
+}
+
+// Add validates and stores a capture of the tenant, giving it an ID.
+func (s *CaptureStore) Add(tenantID string, c *Capture) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	now := s.now()
+	id, err := ulid.New(ulid.Timestamp(now), rand.Reader)
+	if err != nil {
+		return err
+	}
+	c.ID = id.String()
+	// the agents poll their config periodically, and need time to pick the capture up.
+	c.Expires = now.Add(s.ttl)
+
+	size := c.size()
+	if size > s.maxBytes {
+		return fmt.Errorf("capture too large: %d bytes, the limit is %d", size, s.maxBytes)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.captures[tenantID] = append(s.pruneLocked(tenantID, now), c)
+	s.count++
+	s.bytes += size
+	for s.count > s.maxCaptures || s.bytes > s.maxBytes {
+		s.evictOldestLocked()
+	}
+	return nil
+}
+
+// evictOldestLocked removes the capture requested first, among all the tenants.
+func (s *CaptureStore) evictOldestLocked() {
+	// the IDs are ULIDs, sorted by the time the captures were requested.
+	var (
+		oldest   string
+		captures []*Capture
+	)
+	for tenantID, c := range s.captures {
+		if captures == nil || c[0].ID < captures[0].ID {
+			oldest, captures = tenantID, c
+		}
+	}
+	s.count--
+	s.bytes -= captures[0].size()
+	if len(captures) == 1 {
+		delete(s.captures, oldest)
+		return
+	}
+	s.captures[oldest] = captures[1:]
+}
+
+// Pending returns the captures of the tenant which have not expired, for the agent identified by
+// its labels, or for all the agents if nil.
+func (s *CaptureStore) Pending(tenantID string, agent labels.Labels) []*Capture {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var result []*Capture
+	for _, c := range s.pruneLocked(tenantID, s.now()) {
+		if agent == nil || matchesAll(c.agentMatchers, agent) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (s *CaptureStore) pruneLocked(tenantID string, now time.Time) []*Capture {
+	captures := s.captures[tenantID][:0]
+	for _, c := range s.captures[tenantID] {
+		if now.Before(c.Expires) {
+			captures = append(captures, c)
+			continue
+		}
+		s.count--
+		s.bytes -= c.size()
+	}
+	if len(captures) == 0 {
+		delete(s.captures, tenantID)
+		return nil
+	}
+	s.captures[tenantID] = captures
+	return captures
+}
+
+// alertmanagerWebhook is the payload of the webhooks of the Alertmanager.
+type alertmanagerWebhook struct {
+	Alerts []struct {
+		Status string            `json:"status"`
+		Labels map[string]string `json:"labels"`
+	} `json:"alerts"`
+}
+
+type capturesResponse struct {
+	Captures []*Capture `json:"captures"`
+}
+
+// NewCaptureHandler returns the handler requesting captures (POST) and listing the pending ones
+// (GET). The captures are requested with a Capture in JSON, or with the webhook of an Alertmanager
+// when the selector query parameter is set: every firing alert then requests a capture of the
+// targets matching the selector, labeled with the labels of the alert.
+func NewCaptureHandler(store *CaptureStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, err := tenant.ExtractTenantIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet {
+			util.WriteJSONResponse(w, capturesResponse{Captures: store.Pending(tenantID, nil)})
+			return
+		}
+
+		var captures []*Capture
+		if selector := r.URL.Query().Get("selector"); selector != "" {
+			var duration model.Duration
+			if v := r.URL.Query().Get("duration"); v != "" {
+				if duration, err = model.ParseDuration(v); err != nil {
+					http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			var webhook alertmanagerWebhook
+			if err := json.NewDecoder(r.Body).Decode(&webhook); err != nil {
+				http.Error(w, fmt.Sprintf("invalid alertmanager webhook: %v", err), http.StatusBadRequest)
+				return
+			}
+			for _, alert := range webhook.Alerts {
+				if alert.Status != "firing" {
+					continue
+				}
+				captures = append(captures, &Capture{
+					Selector:      selector,
+					AgentSelector: r.URL.Query().Get("agent_selector"),
+					Duration:      duration,
+					Labels:        alert.Labels,
+				})
+			}
+		} else {
+			var c Capture
+			if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+				http.Error(w, fmt.Sprintf("invalid capture: %v", err), http.StatusBadRequest)
+				return
+			}
+			captures = append(captures, &c)
+		}
+		for _, c := range captures {
+			if err := store.Add(tenantID, c); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		util.WriteJSONResponse(w, capturesResponse{Captures: captures})
+	})
+}
+
+// startCaptures starts the captures not started yet, on the active targets matching them.
+func (a *Agent) startCaptures(ctx context.Context, captures []*Capture) {
+	now := time.Now()
+	a.captureMtx.Lock()
+	defer a.captureMtx.Unlock()
+	for id, expires := range a.captured {
+		if now.After(expires) {
+			delete(a.captured, id)
+		}
+	}
+	for _, c := range captures {
+		if _, ok := a.captured[c.ID]; ok {
+			continue
+		}
+		if a.captured == nil {
+			a.captured = make(map[string]time.Time)
+		}
+		a.captured[c.ID] = c.Expires
+		if err := c.Validate(); err != nil {
+			level.Warn(a.logger).Log("msg", "invalid capture", "id", c.ID, "err", err)
+			continue
+		}
+
+		extra := labels.Labels{{Name: CaptureIDLabel, Value: c.ID}}
+		for name, value := range c.Labels {
+			extra = append(extra, labels.Label{Name: name, Value: value})
+		}
+		sort.Sort(extra)
+		var targets []*Target
+		for _, group := range a.ActiveTargets() {
+			for _, t := range group {
+				if matchesAll(c.matchers, t.Labels()) {
+					targets = append(targets, t)
+				}
+			}
+		}
+		level.Info(a.logger).Log("msg", "starting capture", "id", c.ID, "selector", c.Selector, "targets", len(targets))
+		for _, t := range targets {
+			go func(t *Target, id string, duration time.Duration) {
+				if err := t.capture(ctx, duration, extra); err != nil {
+					level.Error(a.logger).Log("msg", "capture failed", "id", id, "target", t.Labels().String(), "err", err)
+				}
+			}(t, c.ID, time.Duration(c.Duration))
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/parca-dev/parca/pkg/scrape"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+func TestCaptureStore(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewCaptureStore(time.Minute)
+	s.now = func() time.Time { return now }
+
+	require.Error(t, s.Add("tenant-a", &Capture{Selector: "{"}))
+	require.Error(t, s.Add("tenant-a", &Capture{Selector: `{service_name="api"}`, Duration: model.Duration(time.Hour)}))
+	require.Error(t, s.Add("tenant-a", &Capture{Selector: `{service_name="api"}`, Labels: map[string]string{"__name__": "cpu"}}))
+
+	c := &Capture{Selector: `{service_name="api"}`, AgentSelector: `{region="eu"}`}
+	require.NoError(t, s.Add("tenant-a", c))
+	require.NotEmpty(t, c.ID)
+	require.Equal(t, defaultCaptureDuration, c.Duration)
+	require.Equal(t, now.Add(time.Minute), c.Expires)
+
+	require.Len(t, s.Pending("tenant-a", nil), 1)
+	require.Len(t, s.Pending("tenant-a", labels.FromStrings("region", "eu")), 1)
+	require.Empty(t, s.Pending("tenant-a", labels.FromStrings("region", "us")))
+	require.Empty(t, s.Pending("tenant-b", nil))
+
+	now = now.Add(time.Minute)
+	require.Empty(t, s.Pending("tenant-a", nil), "expired")
+}
+
+func TestCaptureStore_Limits(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewCaptureStore(time.Minute)
+	s.now = func() time.Time { now = now.Add(time.Millisecond); return now }
+	s.maxCaptures = 2
+
+	var ids []string
+	for _, tenantID := range []string{"tenant-a", "tenant-b", "tenant-a"} {
+		c := &Capture{Selector: `{service_name="api"}`}
+		require.NoError(t, s.Add(tenantID, c))
+		ids = append(ids, c.ID)
+	}
+	require.Equal(t, 2, s.count)
+	a := s.Pending("tenant-a", nil)
+	require.Len(t, a, 1, "the oldest capture is evicted")
+	require.Equal(t, ids[2], a[0].ID)
+	require.Len(t, s.Pending("tenant-b", nil), 1)
+
+	s.maxBytes = s.bytes + 10
+	require.Error(t, s.Add("tenant-a", &Capture{Selector: `{service_name="api"}`, Labels: map[string]string{"alertname": strings.Repeat("x", 100)}}))
+	require.NoError(t, s.Add("tenant-a", &Capture{Selector: `{service_name="api"}`, Labels: map[string]string{"a": "b"}}))
+	require.Empty(t, s.Pending("tenant-b", nil), "evicted to fit the bytes limit")
+	require.LessOrEqual(t, s.bytes, s.maxBytes)
+
+	now = now.Add(time.Minute)
+	require.Empty(t, s.Pending("tenant-a", nil))
+	require.Equal(t, 0, s.count)
+	require.Equal(t, 0, s.bytes)
+}
+
+func TestCaptureHandler(t *testing.T) {
+	store := NewCaptureStore(time.Minute)
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(true).Wrap(NewCaptureHandler(store)))
+	defer s.Close()
+
+	post := func(query url.Values, body string) (int, capturesResponse) {
+		req, err := http.NewRequest(http.MethodPost, s.URL+"?"+query.Encode(), strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Scope-OrgID", "tenant-a")
+		resp, err := s.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var result capturesResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		}
+		return resp.StatusCode, result
+	}
+
+	code, resp := post(nil, `{"selector": "{service_name=\"api\"}", "duration": "10s", "labels": {"alertname": "HighLatency"}}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Captures, 1)
+	require.Equal(t, model.Duration(10*time.Second), resp.Captures[0].Duration)
+
+	code, _ = post(nil, `{"selector": "{"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// the webhook of the Alertmanager requests a capture by firing alert.
+	code, resp = post(url.Values{"selector": {`{service_name="checkout"}`}, "duration": {"1m"}}, `{
+		"status": "firing",
+		"alerts": [
+			{"status": "firing", "labels": {"alertname": "SLOBreach", "slo": "checkout-latency"}},
+			{"status": "resolved", "labels": {"alertname": "SLOBreach", "slo": "checkout-errors"}}
+		]
+	}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Captures, 1)
+	require.Equal(t, map[string]string{"alertname": "SLOBreach", "slo": "checkout-latency"}, resp.Captures[0].Labels)
+	require.Equal(t, model.Duration(time.Minute), resp.Captures[0].Duration)
+
+	require.Len(t, store.Pending("tenant-a", nil), 2)
+}
+
+type capturePusher struct {
+	mtx      sync.Mutex
+	requests []*pushv1.PushRequest
+}
+
+func (p *capturePusher) Push(_ context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.requests = append(p.requests, req.Msg)
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func TestAgent_Capture(t *testing.T) {
+	var seconds []string
+	var mtx sync.Mutex
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		seconds = append(seconds, r.URL.Query().Get("seconds"))
+		mtx.Unlock()
+		_, _ = w.Write([]byte("profile"))
+	}))
+	defer target.Close()
+
+	pusher := &capturePusher{}
+	cfg := ScrapeConfig{JobName: "api"}
+	require.NoError(t, cfg.Validate())
+	// only the CPU is captured.
+	for name, p := range cfg.ProfilingConfig.PprofConfig {
+		enabled := name == pprofProcessCPU
+		p.Enabled = &enabled
+	}
+	tg := NewTargetGroup(context.Background(), cfg.JobName, cfg, func() pushv1connect.PusherServiceClient { return pusher }, "", log.NewNopLogger())
+	targets, _, err := tg.targetsFromGroup(&targetgroup.Group{
+		Targets: []model.LabelSet{{model.AddressLabel: model.LabelValue(strings.TrimPrefix(target.URL, "http://"))}},
+		Labels:  model.LabelSet{"service_name": "api"},
+	})
+	require.NoError(t, err)
+	require.Len(t, targets, 1)
+	require.Equal(t, pprofProcessCPU, targets[0].labels.Get(scrape.ProfileName))
+	tg.activeTargets[targets[0].Hash()] = targets[0]
+
+	a := &Agent{logger: log.NewNopLogger(), groups: map[string]*TargetGroup{"api": tg}}
+	captures := []*Capture{
+		{ID: "01capture", Selector: `{service_name="api"}`, Duration: model.Duration(time.Second), Labels: map[string]string{"alertname": "SLOBreach"}, Expires: time.Now().Add(time.Minute)},
+		{ID: "02other", Selector: `{service_name="other"}`, Expires: time.Now().Add(time.Minute)},
+	}
+	a.startCaptures(context.Background(), captures)
+	// the captures polled again are not started twice.
+	a.startCaptures(context.Background(), captures)
+
+	require.Eventually(t, func() bool {
+		pusher.mtx.Lock()
+		defer pusher.mtx.Unlock()
+		return len(pusher.requests) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	pusher.mtx.Lock()
+	defer pusher.mtx.Unlock()
+	require.Len(t, pusher.requests, 1)
+	lbls := map[string]string{}
+	for _, l := range pusher.requests[0].Series[0].Labels {
+		lbls[l.Name] = l.Value
+	}
+	require.Equal(t, "01capture", lbls[CaptureIDLabel])
+	require.Equal(t, "SLOBreach", lbls["alertname"])
+	require.Equal(t, "api", lbls["service_name"])
+	mtx.Lock()
+	defer mtx.Unlock()
+	require.Equal(t, []string{"1"}, seconds, "the delta profile is taken over the duration of the capture")
+}
@@ -4,7 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"net/url"
-	"path/filepath"
+	"path"
 	"time"
 
 	"github.com/grafana/dskit/flagext"
@@ -23,6 +23,7 @@ import (
 type Config struct {
 	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs,omitempty"`
 	ClientConfig  ClientConfig    `yaml:"client,omitempty"`
+	RemoteConfig  RemoteConfig    `yaml:"remote_config,omitempty"`
 }
 
 // RegisterFlags with prefix registers flags where every name is prefixed by
@@ -39,6 +40,7 @@ func (c *ClientConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 // RegisterFlags registers flags.
 func (c *Config) RegisterFlags(flags *flag.FlagSet) {
 	c.ClientConfig.RegisterFlagsWithPrefix("", flags)
+	c.RemoteConfig.RegisterFlagsWithPrefix("", flags)
 }
 
 func (c *Config) Validate() error {
@@ -77,6 +79,18 @@ type ScrapeConfig struct {
 	RelabelConfigs         []*relabel.Config            `yaml:"relabel_configs,omitempty"`
 	ServiceDiscoveryConfig ServiceDiscoveryConfig       `yaml:",inline"`
 	ProfilingConfig        *parcaconfig.ProfilingConfig `yaml:"profiling_config,omitempty"`
+	// EnabledProfileTypes restricts the profile types scraped to those listed, by the name of
+	// their series, for example process_cpu or memory. All the profile types of the profiling
+	// config are scraped when empty.
+	EnabledProfileTypes []string `yaml:"enabled_profile_types,omitempty"`
+	// DisabledProfileTypes lists the profile types never scraped, for example mutex or block. It
+	// takes precedence over EnabledProfileTypes.
+	DisabledProfileTypes []string             `yaml:"disabled_profile_types,omitempty"`
+	PerfEvent            PerfEventConfig      `yaml:"perf_event,omitempty"`
+	JavaAsyncProfiler    AsyncProfilerConfig  `yaml:"java_async_profiler,omitempty"`
+	PySpy                SpyConfig            `yaml:"py_spy,omitempty"`
+	Rbspy                SpyConfig            `yaml:"rbspy,omitempty"`
+	TargetMetadata       TargetMetadataConfig `yaml:"target_metadata,omitempty"`
 
 	HTTPClientConfig commonconfig.HTTPClientConfig `yaml:",inline"`
 }
@@ -112,10 +126,11 @@ func (c *ScrapeConfig) Validate() error {
 			}
 		}
 	}
-	// If path prefix is specified, add to PprofConfig path
+	// If path prefix is specified, add to PprofConfig path. Those are URL paths, joined with slashes
+	// on Windows too.
 	if c.ProfilingConfig.PprofPrefix != "" {
 		for pt := range c.ProfilingConfig.PprofConfig {
-			c.ProfilingConfig.PprofConfig[pt].Path = filepath.Join(c.ProfilingConfig.PprofPrefix, c.ProfilingConfig.PprofConfig[pt].Path)
+			c.ProfilingConfig.PprofConfig[pt].Path = path.Join(c.ProfilingConfig.PprofPrefix, c.ProfilingConfig.PprofConfig[pt].Path)
 		}
 	}
 
@@ -136,6 +151,21 @@ func (c *ScrapeConfig) Validate() error {
 			return fmt.Errorf("%v scrape_interval must be at least 2 seconds in %v", pprofProcessCPU, c.JobName)
 		}
 	}
+	if err := c.PerfEvent.Validate(); err != nil {
+		return fmt.Errorf("%w in %v", err, c.JobName)
+	}
+	if err := c.JavaAsyncProfiler.Validate(); err != nil {
+		return fmt.Errorf("%w in %v", err, c.JobName)
+	}
+	if err := c.PySpy.validate("py-spy"); err != nil {
+		return fmt.Errorf("%w in %v", err, c.JobName)
+	}
+	if err := c.Rbspy.validate("rbspy"); err != nil {
+		return fmt.Errorf("%w in %v", err, c.JobName)
+	}
+	if err := c.TargetMetadata.validate(); err != nil {
+		return fmt.Errorf("%w in %v", err, c.JobName)
+	}
 	return nil
 }
 
@@ -143,6 +173,7 @@ type ServiceDiscoveryConfig struct {
 	StaticConfigs       discovery.StaticConfig `yaml:"static_configs"`
 	KubernetesSDConfigs []*kubernetes.SDConfig `yaml:"kubernetes_sd_configs,omitempty"`
 	HTTPSDConfigs       []*http.SDConfig       `yaml:"http_sd_configs,omitempty"`
+	ProcessSDConfigs    []*ProcessSDConfig     `yaml:"process_sd_configs,omitempty"`
 }
 
 func (cfg ServiceDiscoveryConfig) Configs() (res discovery.Configs) {
@@ -155,5 +186,8 @@ func (cfg ServiceDiscoveryConfig) Configs() (res discovery.Configs) {
 	for _, x := range cfg.HTTPSDConfigs {
 		res = append(res, x)
 	}
+	for _, x := range cfg.ProcessSDConfigs {
+		res = append(res, x)
+	}
 	return res
 }
@@ -1,10 +1,15 @@
 package agent
 
 import (
+	"context"
+	"sort"
 	"strings"
 	"testing"
 
 	parcaconfig "github.com/parca-dev/parca/pkg/config"
+	"github.com/parca-dev/parca/pkg/scrape"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,3 +28,34 @@ func TestValidate(t *testing.T) {
 		require.True(t, strings.HasPrefix(p.Path, "/prefix"))
 	}
 }
+
+func TestProfileTypes(t *testing.T) {
+	profileTypes := func(cfg ScrapeConfig) []string {
+		require.NoError(t, cfg.Validate())
+		tg := NewTargetGroup(context.Background(), cfg.JobName, cfg, nil, "", nil)
+		targets, _, err := tg.targetsFromGroup(&targetgroup.Group{
+			Targets: []model.LabelSet{{model.AddressLabel: "localhost:6060"}},
+		})
+		require.NoError(t, err)
+		var result []string
+		for _, target := range targets {
+			result = append(result, target.labels.Get(scrape.ProfileName))
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	require.Equal(t, []string{"memory", "process_cpu"}, profileTypes(ScrapeConfig{
+		JobName:             "enabled",
+		EnabledProfileTypes: []string{"process_cpu", "memory"},
+	}))
+	require.NotContains(t, profileTypes(ScrapeConfig{
+		JobName:              "disabled",
+		DisabledProfileTypes: []string{"mutex", "block"},
+	}), "mutex")
+	require.Equal(t, []string{"process_cpu"}, profileTypes(ScrapeConfig{
+		JobName:              "both",
+		EnabledProfileTypes:  []string{"process_cpu", "memory"},
+		DisabledProfileTypes: []string{"memory"},
+	}))
+}
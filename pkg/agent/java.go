@@ -0,0 +1,219 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	defaultJattachPath         = "jattach"
+	defaultAsyncProfilerEvent  = "cpu"
+	defaultAsyncProfilerPeriod = model.Duration(10 * time.Millisecond)
+
+	// asyncProfilerLibrary is where the library is copied in the mount namespace of the JVMs, which
+	// load it from there.
+	asyncProfilerLibrary = "/tmp/libasyncProfiler-phlare.so"
+)
+
+// AsyncProfilerConfig configures the profiling of the JVMs which don't expose pprof endpoints,
+// attaching async-profiler to them.
+type AsyncProfilerConfig struct {
+	// Enabled profiles the CPU of the JVMs of the targets with a __pid__ or __container_id__ label
+	// using async-profiler, instead of scraping them. Their other profile types are dropped.
+	Enabled bool `yaml:"enabled"`
+	// LibraryPath is the path of libasyncProfiler.so on the host of the agent.
+	LibraryPath string `yaml:"library_path"`
+	// JattachPath is the path of the jattach binary used to load async-profiler into the JVMs.
+	JattachPath string `yaml:"jattach_path,omitempty"`
+	// Event is the event sampled by async-profiler: cpu, or itimer when perf_event is unavailable.
+	Event string `yaml:"event,omitempty"`
+	// Interval is the CPU time between two samples.
+	Interval model.Duration `yaml:"interval,omitempty"`
+}
+
+func (c *AsyncProfilerConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.LibraryPath == "" {
+		return fmt.Errorf("java_async_profiler library_path is empty")
+	}
+	if c.JattachPath == "" {
+		c.JattachPath = defaultJattachPath
+	}
+	if c.Event == "" {
+		c.Event = defaultAsyncProfilerEvent
+	}
+	if c.Event != "cpu" && c.Event != "itimer" {
+		return fmt.Errorf("java_async_profiler event must be cpu or itimer, got %q", c.Event)
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultAsyncProfilerPeriod
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("java_async_profiler interval must be positive")
+	}
+	return nil
+}
+
+// asyncProfiler profiles the JVMs by loading async-profiler into them with jattach.
+type asyncProfiler struct {
+	cfg AsyncProfilerConfig
+	run func(ctx context.Context, name string, args ...string) error
+}
+
+func newAsyncProfiler(cfg AsyncProfilerConfig) *asyncProfiler {
+	return &asyncProfiler{cfg: cfg, run: runCommand}
+}
+
+func (a *asyncProfiler) name() string { return "async-profiler" }
+
+func (a *asyncProfiler) supports(pid int) bool { return isJVM(pid) }
+
+func runCommand(ctx context.Context, name string, args ...string) error {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", name, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// collect profiles the JVM for the duration, and writes the gzipped pprof profile to w.
+func (a *asyncProfiler) collect(ctx context.Context, pid int, duration time.Duration, w io.Writer) error {
+	if err := a.installLibrary(pid); err != nil {
+		return err
+	}
+	interval := time.Duration(a.cfg.Interval)
+	start := time.Now()
+	if err := a.jattach(ctx, pid, fmt.Sprintf("start,event=%s,interval=%d", a.cfg.Event, interval.Nanoseconds())); err != nil {
+		return err
+	}
+	// the output is written in the mount namespace of the JVM.
+	output := fmt.Sprintf("/tmp/phlare-async-profiler-%d.collapsed", pid)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// don't leave the profiler running in the JVM.
+		_ = a.jattach(context.Background(), pid, "stop")
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if err := a.jattach(ctx, pid, fmt.Sprintf("stop,file=%s,collapsed", output)); err != nil {
+		return err
+	}
+
+	path := filepath.Join(procRoot, strconv.Itoa(pid), "root", output)
+	defer os.Remove(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := parseCollapsed(f, interval, start, time.Since(start))
+	if err != nil {
+		return err
+	}
+	p.Comments = append(p.Comments, "runtime=jvm", "spy="+a.name())
+	return p.Write(w)
+}
+
+func (a *asyncProfiler) jattach(ctx context.Context, pid int, command string) error {
+	return a.run(ctx, a.cfg.JattachPath, strconv.Itoa(pid), "load", asyncProfilerLibrary, "true", command)
+}
+
+// installLibrary copies async-profiler into the mount namespace of the JVM, unless already there.
+func (a *asyncProfiler) installLibrary(pid int) error {
+	src, err := os.Open(a.cfg.LibraryPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(procRoot, strconv.Itoa(pid), "root", asyncProfilerLibrary)
+	if info, err := os.Stat(dst); err == nil && info.Size() == srcInfo.Size() {
+		return nil
+	}
+	tmp := dst + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// parseCollapsed converts the collapsed stacks output by async-profiler, py-spy and rbspy, one
+// "root;...;leaf count" line per stacktrace, to a CPU profile.
+func parseCollapsed(r io.Reader, interval time.Duration, start time.Time, duration time.Duration) (*profile.Profile, error) {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        int64(interval),
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(duration),
+	}
+	locations := make(map[string]*profile.Location)
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 64<<10), 16<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid collapsed stack %q", line)
+		}
+		count, err := strconv.ParseInt(line[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid collapsed stack count %q: %w", line, err)
+		}
+		frames := strings.Split(line[:i], ";")
+		sample := &profile.Sample{
+			Location: make([]*profile.Location, 0, len(frames)),
+			Value:    []int64{count, count * int64(interval)},
+		}
+		// the frames are root first, and the locations leaf first.
+		for j := len(frames) - 1; j >= 0; j-- {
+			loc, ok := locations[frames[j]]
+			if !ok {
+				fn := &profile.Function{ID: uint64(len(p.Function) + 1), Name: frames[j], SystemName: frames[j]}
+				p.Function = append(p.Function, fn)
+				loc = &profile.Location{ID: uint64(len(p.Location) + 1), Line: []profile.Line{{Function: fn}}}
+				p.Location = append(p.Location, loc)
+				locations[frames[j]] = loc
+			}
+			sample.Location = append(sample.Location, loc)
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
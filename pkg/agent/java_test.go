@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAsyncProfilerConfig(t *testing.T) {
+	cfg := AsyncProfilerConfig{Enabled: true}
+	require.Error(t, cfg.Validate(), "library_path is required")
+
+	cfg.LibraryPath = "/opt/async-profiler/lib/libasyncProfiler.so"
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, AsyncProfilerConfig{
+		Enabled:     true,
+		LibraryPath: "/opt/async-profiler/lib/libasyncProfiler.so",
+		JattachPath: defaultJattachPath,
+		Event:       "cpu",
+		Interval:    model.Duration(10 * time.Millisecond),
+	}, cfg)
+
+	cfg.Event = "alloc"
+	require.Error(t, cfg.Validate())
+}
+
+func TestParseCollapsed(t *testing.T) {
+	start := time.Unix(10, 0)
+	p, err := parseCollapsed(strings.NewReader(`java/lang/Thread.run;com/example/App.work;com/example/App.hash 3
+java/lang/Thread.run;com/example/App.work 2
+
+java/lang/Thread.run;com/example/App.work;com/example/App.hash 1
+`), 10*time.Millisecond, start, time.Second)
+	require.NoError(t, err)
+	require.NoError(t, p.CheckValid())
+	require.Len(t, p.Sample, 3)
+	require.Len(t, p.Function, 3)
+	require.Equal(t, []int64{3, int64(30 * time.Millisecond)}, p.Sample[0].Value)
+	require.Equal(t, "com/example/App.hash", p.Sample[0].Location[0].Line[0].Function.Name)
+	require.Equal(t, "java/lang/Thread.run", p.Sample[0].Location[2].Line[0].Function.Name)
+	require.Equal(t, start.UnixNano(), p.TimeNanos)
+
+	_, err = parseCollapsed(strings.NewReader("java/lang/Thread.run\n"), time.Millisecond, start, time.Second)
+	require.Error(t, err)
+}
+
+// fakeProc replaces the procfs with a temporary directory.
+func fakeProc(t *testing.T) string {
+	root := t.TempDir()
+	previous := procRoot
+	procRoot = root
+	t.Cleanup(func() { procRoot = previous })
+	return root
+}
+
+func addFakeProcess(t *testing.T, root, pid, exe, cgroup string) {
+	dir := filepath.Join(root, pid)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "root", "tmp"), 0o755))
+	if exe != "" {
+		require.NoError(t, os.Symlink(exe, filepath.Join(dir, "exe")))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup"), []byte(cgroup), 0o644))
+}
+
+func TestProcessRef(t *testing.T) {
+	root := fakeProc(t)
+	const id = "4f0c3a9e1b2d"
+	addFakeProcess(t, root, "10", "/pause", "0::/kubepods.slice/cri-containerd-other.scope\n")
+	addFakeProcess(t, root, "20", "/bin/sh", "0::/kubepods.slice/cri-containerd-"+id+".scope\n")
+	addFakeProcess(t, root, "21", "/usr/lib/jvm/bin/java", "0::/kubepods.slice/cri-containerd-"+id+".scope\n")
+
+	cfg := ScrapeConfig{JavaAsyncProfiler: AsyncProfilerConfig{Enabled: true}}
+	ref, err := processTargetRef(cfg, labels.FromStrings(ContainerIDLabel, "containerd://"+id))
+	require.NoError(t, err)
+	require.Equal(t, &processRef{containerID: id}, ref)
+	require.Equal(t, id, ref.String())
+
+	pid, err := ref.resolve(isJVM)
+	require.NoError(t, err)
+	require.Equal(t, 21, pid, "the JVM of the container")
+	pid, err = ref.resolve(func(int) bool { return false })
+	require.NoError(t, err)
+	require.Equal(t, 20, pid)
+	require.False(t, isJVM(20))
+
+	_, err = (&processRef{containerID: "missing"}).resolve(isJVM)
+	require.Error(t, err)
+
+	ref, err = processTargetRef(ScrapeConfig{}, labels.FromStrings(PIDLabel, "42"))
+	require.NoError(t, err)
+	require.Nil(t, ref, "the processes are scraped unless profiled by the agent")
+}
+
+func TestAsyncProfilerCollect(t *testing.T) {
+	root := fakeProc(t)
+	addFakeProcess(t, root, "21", "/usr/lib/jvm/bin/java", "")
+	library := filepath.Join(t.TempDir(), "libasyncProfiler.so")
+	require.NoError(t, os.WriteFile(library, []byte("library"), 0o644))
+
+	cfg := AsyncProfilerConfig{Enabled: true, LibraryPath: library}
+	require.NoError(t, cfg.Validate())
+	var commands []string
+	a := newAsyncProfiler(cfg)
+	a.run = func(_ context.Context, name string, args ...string) error {
+		require.Equal(t, defaultJattachPath, name)
+		require.Equal(t, []string{"21", "load", asyncProfilerLibrary, "true"}, args[:4])
+		commands = append(commands, args[4])
+		if strings.HasPrefix(args[4], "stop,file=") {
+			output := strings.TrimSuffix(strings.TrimPrefix(args[4], "stop,file="), ",collapsed")
+			return os.WriteFile(filepath.Join(root, "21", "root", output), []byte("main;work 5\n"), 0o644)
+		}
+		return nil
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, a.collect(context.Background(), 21, 10*time.Millisecond, &buf))
+	require.Equal(t, []string{
+		"start,event=cpu,interval=10000000",
+		"stop,file=/tmp/phlare-async-profiler-21.collapsed,collapsed",
+	}, commands)
+
+	installed, err := os.ReadFile(filepath.Join(root, "21", "root", asyncProfilerLibrary))
+	require.NoError(t, err)
+	require.Equal(t, "library", string(installed))
+	_, err = os.Stat(filepath.Join(root, "21", "root", "tmp", "phlare-async-profiler-21.collapsed"))
+	require.True(t, os.IsNotExist(err), "the output is removed")
+
+	p, err := profile.Parse(&buf)
+	require.NoError(t, err)
+	require.Len(t, p.Sample, 1)
+	require.Equal(t, []int64{5, int64(50 * time.Millisecond)}, p.Sample[0].Value)
+	require.Equal(t, "work", p.Sample[0].Location[0].Line[0].Function.Name)
+}
@@ -0,0 +1,364 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+const defaultPerfSampleFrequency = 100
+
+var errPerfUnsupported = errors.New("perf_event sampling is only supported on Linux")
+
+// PerfEventConfig configures the sampling of the CPU of the targets which don't expose pprof
+// endpoints, using perf_event on their process.
+type PerfEventConfig struct {
+	// Enabled samples the process_cpu profile of the targets with a __pid__ or __container_id__
+	// label using perf_event, instead of scraping it. Their other profile types are dropped.
+	Enabled bool `yaml:"enabled"`
+	// SampleFrequency is the number of samples per second and thread.
+	SampleFrequency int `yaml:"sample_frequency,omitempty"`
+}
+
+func (c *PerfEventConfig) Validate() error {
+	if c.SampleFrequency == 0 {
+		c.SampleFrequency = defaultPerfSampleFrequency
+	}
+	if c.SampleFrequency < 0 || c.SampleFrequency > 1000 {
+		return fmt.Errorf("perf_event sample_frequency must be between 1 and 1000")
+	}
+	return nil
+}
+
+// procMapping is a memory mapping of a process, as listed by /proc/<pid>/maps.
+type procMapping struct {
+	Start, Limit, Offset uint64
+	Executable           bool
+	Path                 string
+}
+
+// parseProcMaps parses the executable mappings of /proc/<pid>/maps.
+func parseProcMaps(r io.Reader) ([]*procMapping, error) {
+	var mappings []*procMapping
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		// 7f2b1c000000-7f2b1c021000 r-xp 00000000 08:01 1234 /usr/lib/libc.so.6
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("invalid mapping %q", s.Text())
+		}
+		start, limit, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping range %q", fields[0])
+		}
+		m := &procMapping{Executable: strings.Contains(fields[1], "x")}
+		var err error
+		if m.Start, err = strconv.ParseUint(start, 16, 64); err != nil {
+			return nil, err
+		}
+		if m.Limit, err = strconv.ParseUint(limit, 16, 64); err != nil {
+			return nil, err
+		}
+		if m.Offset, err = strconv.ParseUint(fields[2], 16, 64); err != nil {
+			return nil, err
+		}
+		if len(fields) > 5 {
+			m.Path = strings.Join(fields[5:], " ")
+		}
+		if m.Executable {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, s.Err()
+}
+
+func readProcMaps(pid int) ([]*procMapping, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "maps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseProcMaps(f)
+}
+
+// elfSymbols resolves the addresses of a mapped ELF file to the names of its functions.
+type elfSymbols struct {
+	progs   []elf.ProgHeader
+	symbols []elf.Symbol
+}
+
+func openELFSymbols(path string) (*elfSymbols, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := &elfSymbols{}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			s.progs = append(s.progs, p.ProgHeader)
+		}
+	}
+	symbols, _ := f.Symbols()
+	dynamic, _ := f.DynamicSymbols()
+	for _, sym := range append(symbols, dynamic...) {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+			s.symbols = append(s.symbols, sym)
+		}
+	}
+	sort.Slice(s.symbols, func(i, j int) bool { return s.symbols[i].Value < s.symbols[j].Value })
+	return s, nil
+}
+
+// lookup returns the function of the address of the process, in the mapping of the file.
+func (s *elfSymbols) lookup(m *procMapping, addr uint64) (string, bool) {
+	fileOffset := addr - m.Start + m.Offset
+	for _, p := range s.progs {
+		if fileOffset < p.Off || fileOffset >= p.Off+p.Filesz {
+			continue
+		}
+		vaddr := fileOffset - p.Off + p.Vaddr
+		i := sort.Search(len(s.symbols), func(i int) bool { return s.symbols[i].Value > vaddr }) - 1
+		if i < 0 {
+			return "", false
+		}
+		sym := s.symbols[i]
+		if vaddr >= sym.Value+sym.Size && sym.Size > 0 {
+			return "", false
+		}
+		return sym.Name, true
+	}
+	return "", false
+}
+
+// symbolizer resolves the addresses of a process to functions, from the symbol tables of its
+// mapped files. The addresses it can't resolve are kept as is.
+type symbolizer interface {
+	symbolize(m *procMapping, addr uint64) (string, bool)
+}
+
+type procSymbolizer struct {
+	pid   int
+	files map[string]*elfSymbols
+}
+
+func newProcSymbolizer(pid int) *procSymbolizer {
+	return &procSymbolizer{pid: pid, files: make(map[string]*elfSymbols)}
+}
+
+func (s *procSymbolizer) symbolize(m *procMapping, addr uint64) (string, bool) {
+	if !strings.HasPrefix(m.Path, "/") {
+		return "", false
+	}
+	syms, ok := s.files[m.Path]
+	if !ok {
+		// the files are read from the mount namespace of the process.
+		syms, _ = openELFSymbols(filepath.Join(procRoot, strconv.Itoa(s.pid), "root", m.Path))
+		s.files[m.Path] = syms
+	}
+	if syms == nil {
+		return "", false
+	}
+	return syms.lookup(m, addr)
+}
+
+// buildPerfProfile aggregates the sampled stacktraces, leaf first, to a CPU profile.
+func buildPerfProfile(stacks [][]uint64, mappings []*procMapping, sym symbolizer, frequency int, start time.Time, duration time.Duration) *profile.Profile {
+	period := int64(time.Second) / int64(frequency)
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        period,
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(duration),
+	}
+
+	profileMappings := make(map[*procMapping]*profile.Mapping, len(mappings))
+	mappingOf := func(addr uint64) (*procMapping, *profile.Mapping) {
+		i := sort.Search(len(mappings), func(i int) bool { return mappings[i].Limit > addr })
+		if i == len(mappings) || mappings[i].Start > addr {
+			return nil, nil
+		}
+		m := mappings[i]
+		pm, ok := profileMappings[m]
+		if !ok {
+			pm = &profile.Mapping{ID: uint64(len(p.Mapping) + 1), Start: m.Start, Limit: m.Limit, Offset: m.Offset, File: m.Path}
+			profileMappings[m] = pm
+			p.Mapping = append(p.Mapping, pm)
+		}
+		return m, pm
+	}
+
+	var (
+		functions = make(map[string]*profile.Function)
+		locations = make(map[uint64]*profile.Location)
+		samples   = make(map[string]*profile.Sample)
+		key       bytes.Buffer
+	)
+	for _, stack := range stacks {
+		key.Reset()
+		locs := make([]*profile.Location, 0, len(stack))
+		for i, addr := range stack {
+			// the callers are return addresses, which are symbolized at the call instruction.
+			if i > 0 {
+				addr--
+			}
+			loc, ok := locations[addr]
+			if !ok {
+				loc = &profile.Location{ID: uint64(len(p.Location) + 1), Address: addr}
+				m, pm := mappingOf(addr)
+				loc.Mapping = pm
+				if m != nil {
+					if name, ok := sym.symbolize(m, addr); ok {
+						fn, ok := functions[name]
+						if !ok {
+							fn = &profile.Function{ID: uint64(len(p.Function) + 1), Name: name, SystemName: name, Filename: m.Path}
+							functions[name] = fn
+							p.Function = append(p.Function, fn)
+						}
+						loc.Line = []profile.Line{{Function: fn}}
+					}
+				}
+				locations[addr] = loc
+				p.Location = append(p.Location, loc)
+			}
+			locs = append(locs, loc)
+			fmt.Fprintf(&key, "%d,", loc.ID)
+		}
+		s, ok := samples[key.String()]
+		if !ok {
+			s = &profile.Sample{Location: locs, Value: []int64{0, 0}}
+			samples[key.String()] = s
+			p.Sample = append(p.Sample, s)
+		}
+		s.Value[0]++
+		s.Value[1] += period
+	}
+	return p
+}
+
+// checkPerfCapabilities returns why the process can't be sampled with perf_event, from the
+// perf_event_paranoid setting and the capabilities of the agent.
+func checkPerfCapabilities(paranoid int, effectiveCaps uint64) error {
+	const (
+		capSysAdmin = 21
+		capPerfmon  = 38
+	)
+	if effectiveCaps&(1<<capSysAdmin) != 0 || effectiveCaps&(1<<capPerfmon) != 0 {
+		return nil
+	}
+	// above 2, perf_event is restricted to the privileged processes.
+	if paranoid > 2 {
+		return fmt.Errorf("perf_event_paranoid is %d: the agent requires CAP_PERFMON or CAP_SYS_ADMIN, or perf_event_paranoid at most 2", paranoid)
+	}
+	return nil
+}
+
+// parseEffectiveCaps returns the effective capabilities of a /proc/<pid>/status file.
+func parseEffectiveCaps(r io.Reader) (uint64, error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if v := s.Text(); strings.HasPrefix(v, "CapEff:") {
+			return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(v, "CapEff:")), 16, 64)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return 0, err
+	}
+	return 0, errors.New("no CapEff in the process status")
+}
+
+const (
+	perfRecordSample = 9
+	// perfContextMax is the lowest of the markers of the contexts of the callchains, such as
+	// PERF_CONTEXT_USER, which are not addresses.
+	perfContextMax = ^uint64(4095 - 1)
+)
+
+// parsePerfSamples appends the callchains of the PERF_RECORD_SAMPLE records of the ring buffer
+// data, sampled with PERF_SAMPLE_TID and PERF_SAMPLE_CALLCHAIN. The other records are skipped.
+func parsePerfSamples(stacks [][]uint64, data []byte, order binary.ByteOrder) ([][]uint64, error) {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return stacks, fmt.Errorf("truncated perf_event record header")
+		}
+		// struct perf_event_header { u32 type; u16 misc; u16 size; }
+		typ, size := order.Uint32(data), int(order.Uint16(data[6:]))
+		if size < 8 || size > len(data) {
+			return stacks, fmt.Errorf("invalid perf_event record size %d", size)
+		}
+		record := data[8:size]
+		data = data[size:]
+		if typ != perfRecordSample {
+			continue
+		}
+		// u32 pid, tid; u64 nr; u64 ips[nr];
+		if len(record) < 16 {
+			return stacks, fmt.Errorf("truncated perf_event sample")
+		}
+		nr := order.Uint64(record[8:])
+		if nr > uint64(len(record)-16)/8 {
+			return stacks, fmt.Errorf("truncated perf_event callchain")
+		}
+		stack := make([]uint64, 0, nr)
+		for i := uint64(0); i < nr; i++ {
+			if ip := order.Uint64(record[16+8*i:]); ip < perfContextMax {
+				stack = append(stack, ip)
+			}
+		}
+		if len(stack) > 0 {
+			stacks = append(stacks, stack)
+		}
+	}
+	return stacks, nil
+}
+
+// perfProfiler samples any process with perf_event.
+type perfProfiler struct {
+	cfg PerfEventConfig
+}
+
+func (perfProfiler) name() string { return "perf" }
+
+func (perfProfiler) supports(int) bool { return true }
+
+func (p perfProfiler) collect(ctx context.Context, pid int, duration time.Duration, w io.Writer) error {
+	return collectPerfProfile(ctx, pid, p.cfg.SampleFrequency, duration, w)
+}
+
+// collectPerfProfile samples the CPU of the process with perf_event for the duration, and writes
+// the gzipped pprof profile of the samples to w.
+func collectPerfProfile(ctx context.Context, pid, frequency int, duration time.Duration, w io.Writer) error {
+	if err := checkPerfAccess(pid); err != nil {
+		return err
+	}
+	start := time.Now()
+	stacks, err := samplePerf(ctx, pid, frequency, duration)
+	if err != nil {
+		return err
+	}
+	// the mappings are read after the sampling, to include the libraries loaded meanwhile.
+	mappings, err := readProcMaps(pid)
+	if err != nil {
+		return err
+	}
+	p := buildPerfProfile(stacks, mappings, newProcSymbolizer(pid), frequency, start, time.Since(start))
+	p.Comments = append(p.Comments, "spy=perf")
+	return p.Write(w)
+}
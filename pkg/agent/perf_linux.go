@@ -0,0 +1,186 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// perfDataPages is the number of pages of the ring buffer of each thread, a power of 2.
+	perfDataPages = 16
+	// perfDrainInterval is how often the ring buffers are read, before they overflow.
+	perfDrainInterval = 100 * time.Millisecond
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// checkPerfAccess returns why the agent can't sample the process with perf_event.
+func checkPerfAccess(pid int) error {
+	b, err := os.ReadFile("/proc/sys/kernel/perf_event_paranoid")
+	if err != nil {
+		return fmt.Errorf("perf_event is not available: %w", err)
+	}
+	paranoid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("invalid perf_event_paranoid: %w", err)
+	}
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	caps, err := parseEffectiveCaps(f)
+	if err != nil {
+		return err
+	}
+	if err := checkPerfCapabilities(paranoid, caps); err != nil {
+		return err
+	}
+	// the maps of the process are only readable by the agent if it is allowed to trace it.
+	if _, err := readProcMaps(pid); err != nil {
+		return fmt.Errorf("the agent is not allowed to trace the process %d: %w", pid, err)
+	}
+	return nil
+}
+
+type perfEvent struct {
+	fd   int
+	mem  []byte
+	page *unix.PerfEventMmapPage
+	data []byte
+}
+
+func openPerfEvent(tid, frequency int) (*perfEvent, error) {
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_SOFTWARE,
+		Config:      unix.PERF_COUNT_SW_CPU_CLOCK,
+		Sample:      uint64(frequency),
+		Sample_type: unix.PERF_SAMPLE_TID | unix.PERF_SAMPLE_CALLCHAIN,
+		Bits:        unix.PerfBitDisabled | unix.PerfBitFreq | unix.PerfBitExcludeKernel | unix.PerfBitExcludeHv,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, tid, -1, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := os.Getpagesize()
+	mem, err := unix.Mmap(fd, 0, (1+perfDataPages)*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	return &perfEvent{
+		fd:   fd,
+		mem:  mem,
+		page: (*unix.PerfEventMmapPage)(unsafe.Pointer(&mem[0])),
+		data: mem[pageSize:],
+	}, nil
+}
+
+// drain parses the records written to the ring buffer since the last drain.
+func (e *perfEvent) drain(stacks [][]uint64) ([][]uint64, error) {
+	head := atomic.LoadUint64(&e.page.Data_head)
+	tail := e.page.Data_tail
+	if head == tail {
+		return stacks, nil
+	}
+	size := uint64(len(e.data))
+	// the records wrap around the end of the ring buffer.
+	records := make([]byte, 0, head-tail)
+	for off := tail; off < head; {
+		start := off % size
+		end := size
+		if n := head - off; start+n < size {
+			end = start + n
+		}
+		records = append(records, e.data[start:end]...)
+		off += end - start
+	}
+	atomic.StoreUint64(&e.page.Data_tail, head)
+	return parsePerfSamples(stacks, records, nativeEndian)
+}
+
+func (e *perfEvent) close() {
+	_ = unix.Munmap(e.mem)
+	_ = unix.Close(e.fd)
+}
+
+// samplePerf samples the user space callchains of the threads of the process, for the duration or
+// until the context is done. The threads started during the sampling are not sampled.
+func samplePerf(ctx context.Context, pid, frequency int, duration time.Duration) ([][]uint64, error) {
+	tasks, err := os.ReadDir(filepath.Join(procRoot, strconv.Itoa(pid), "task"))
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*perfEvent, 0, len(tasks))
+	defer func() {
+		for _, e := range events {
+			e.close()
+		}
+	}()
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		e, err := openPerfEvent(tid, frequency)
+		if errors.Is(err, unix.ESRCH) {
+			// the thread exited.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("perf_event_open of thread %d: %w", tid, err)
+		}
+		events = append(events, e)
+	}
+	for _, e := range events {
+		if err := unix.IoctlSetInt(e.fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	var stacks [][]uint64
+	drain := func() error {
+		for _, e := range events {
+			if stacks, err = e.drain(stacks); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(perfDrainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return stacks, drain()
+		case <-ticker.C:
+			if err := drain(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
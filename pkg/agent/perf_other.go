@@ -0,0 +1,16 @@
+//go:build !linux
+
+package agent
+
+import (
+	"context"
+	"time"
+)
+
+func checkPerfAccess(int) error {
+	return errPerfUnsupported
+}
+
+func samplePerf(context.Context, int, int, time.Duration) ([][]uint64, error) {
+	return nil, errPerfUnsupported
+}
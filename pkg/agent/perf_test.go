@@ -0,0 +1,145 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parca-dev/parca/pkg/scrape"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcMaps(t *testing.T) {
+	mappings, err := parseProcMaps(strings.NewReader(`00400000-00452000 r-xp 00000000 08:02 173521 /usr/bin/dbus-daemon
+00651000-00652000 r--p 00051000 08:02 173521 /usr/bin/dbus-daemon
+7f2b1c000000-7f2b1c021000 r-xp 00002000 08:01 1234 /usr/lib/my lib.so
+7ffd8a7e1000-7ffd8a7e3000 r-xp 00000000 00:00 0 [vdso]
+7ffd8a7f0000-7ffd8a7f1000 rw-p 00000000 00:00 0
+`))
+	require.NoError(t, err)
+	require.Equal(t, []*procMapping{
+		{Start: 0x400000, Limit: 0x452000, Executable: true, Path: "/usr/bin/dbus-daemon"},
+		{Start: 0x7f2b1c000000, Limit: 0x7f2b1c021000, Offset: 0x2000, Executable: true, Path: "/usr/lib/my lib.so"},
+		{Start: 0x7ffd8a7e1000, Limit: 0x7ffd8a7e3000, Executable: true, Path: "[vdso]"},
+	}, mappings)
+
+	_, err = parseProcMaps(strings.NewReader("00400000 r-xp 00000000 08:02 173521\n"))
+	require.Error(t, err)
+}
+
+func TestCheckPerfCapabilities(t *testing.T) {
+	caps, err := parseEffectiveCaps(strings.NewReader("Name:\tphlare\nCapInh:\t0000000000000000\nCapEff:\t0000004000000000\n"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1)<<38, caps)
+
+	require.NoError(t, checkPerfCapabilities(2, 0))
+	require.NoError(t, checkPerfCapabilities(3, caps), "CAP_PERFMON")
+	require.NoError(t, checkPerfCapabilities(3, 1<<21), "CAP_SYS_ADMIN")
+	require.Error(t, checkPerfCapabilities(3, 0))
+
+	_, err = parseEffectiveCaps(strings.NewReader("Name:\tphlare\n"))
+	require.Error(t, err)
+}
+
+func TestParsePerfSamples(t *testing.T) {
+	var data []byte
+	record := func(typ uint32, payload ...uint64) {
+		b := make([]byte, 8+8*len(payload))
+		binary.LittleEndian.PutUint32(b, typ)
+		binary.LittleEndian.PutUint16(b[6:], uint16(len(b)))
+		for i, v := range payload {
+			binary.LittleEndian.PutUint64(b[8+8*i:], v)
+		}
+		data = append(data, b...)
+	}
+	perfContextUser := ^uint64(511) // -512
+	// pid and tid, callchain
+	record(perfRecordSample, 1|1<<32, 3, perfContextUser, 0x1000, 0x2000)
+	// PERF_RECORD_LOST
+	record(2, 1, 10)
+	record(perfRecordSample, 1|2<<32, 1, 0x3000)
+
+	stacks, err := parsePerfSamples(nil, data, binary.LittleEndian)
+	require.NoError(t, err)
+	require.Equal(t, [][]uint64{{0x1000, 0x2000}, {0x3000}}, stacks)
+
+	_, err = parsePerfSamples(nil, data[:len(data)-4], binary.LittleEndian)
+	require.Error(t, err)
+}
+
+type fakeSymbolizer map[uint64]string
+
+func (s fakeSymbolizer) symbolize(_ *procMapping, addr uint64) (string, bool) {
+	name, ok := s[addr]
+	return name, ok
+}
+
+func TestBuildPerfProfile(t *testing.T) {
+	mappings := []*procMapping{
+		{Start: 0x1000, Limit: 0x2000, Executable: true, Path: "/bin/app"},
+		{Start: 0x5000, Limit: 0x6000, Executable: true, Path: "/lib/libc.so"},
+	}
+	sym := fakeSymbolizer{0x1100: "main", 0x1200 - 1: "run", 0x5100: "write"}
+	start := time.Unix(10, 0)
+	p := buildPerfProfile([][]uint64{
+		{0x1100, 0x1200},
+		{0x1100, 0x1200},
+		{0x5100, 0x1200},
+		{0x9000},
+	}, mappings, sym, 100, start, time.Second)
+
+	require.NoError(t, p.CheckValid())
+	require.Equal(t, int64(10*time.Millisecond), p.Period)
+	require.Equal(t, start.UnixNano(), p.TimeNanos)
+	require.Len(t, p.Mapping, 2)
+	require.Len(t, p.Function, 3)
+	require.Len(t, p.Sample, 3)
+	require.Equal(t, []int64{2, int64(20 * time.Millisecond)}, p.Sample[0].Value)
+	require.Equal(t, "main", p.Sample[0].Location[0].Line[0].Function.Name)
+	require.Equal(t, "run", p.Sample[0].Location[1].Line[0].Function.Name)
+	require.Equal(t, "/lib/libc.so", p.Sample[1].Location[0].Mapping.File)
+	// the addresses out of the mappings are kept unsymbolized.
+	require.Nil(t, p.Sample[2].Location[0].Mapping)
+	require.Empty(t, p.Sample[2].Location[0].Line)
+}
+
+func TestPerfEventTargets(t *testing.T) {
+	cfg := ScrapeConfig{JobName: "processes", PerfEvent: PerfEventConfig{Enabled: true}}
+	require.NoError(t, cfg.Validate())
+	require.Equal(t, defaultPerfSampleFrequency, cfg.PerfEvent.SampleFrequency)
+
+	tg := NewTargetGroup(context.Background(), cfg.JobName, cfg, nil, "", nil)
+	targets, _, err := tg.targetsFromGroup(&targetgroup.Group{
+		Targets: []model.LabelSet{
+			{PIDLabel: "42"},
+			{model.AddressLabel: "localhost:6060"},
+		},
+	})
+	require.NoError(t, err)
+
+	var sampled []*Target
+	for _, target := range targets {
+		if target.process != nil {
+			sampled = append(sampled, target)
+		}
+	}
+	require.Len(t, sampled, 1, "only the CPU of the process is sampled")
+	require.Equal(t, &processRef{pid: 42}, sampled[0].process)
+	require.Equal(t, pprofProcessCPU, sampled[0].labels.Get(scrape.ProfileName))
+	require.Equal(t, "pid-42", sampled[0].labels.Get(model.InstanceLabel))
+	require.Greater(t, len(targets), 2)
+
+	// without the fallback, the targets need an address.
+	cfg.PerfEvent.Enabled = false
+	tg = NewTargetGroup(context.Background(), cfg.JobName, cfg, nil, "", nil)
+	_, _, err = tg.targetsFromGroup(&targetgroup.Group{Targets: []model.LabelSet{{PIDLabel: "42"}}})
+	require.Error(t, err)
+
+	_, _, err = populateLabels(labels.FromStrings(PIDLabel, "foo"), ScrapeConfig{JobName: "processes", PerfEvent: PerfEventConfig{Enabled: true}})
+	require.Error(t, err)
+}
@@ -0,0 +1,179 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// PIDLabel is the label of the targets giving the process profiled without scraping it,
+	// typically set by the relabeling of a discovery not finding any pprof port.
+	PIDLabel = "__pid__"
+	// ContainerIDLabel is the label of the targets giving the container of the process profiled
+	// without scraping it, such as the __meta_kubernetes_pod_container_id of the pods.
+	ContainerIDLabel = "__container_id__"
+	// ProfilerLabel is the label of the targets forcing the profiler of their process, such as
+	// py-spy, instead of choosing it from the executable of the process.
+	ProfilerLabel = "__profiler__"
+)
+
+// procRoot is the mount point of the procfs of the host.
+var procRoot = "/proc"
+
+// processProfiler profiles the CPU of the processes it supports.
+type processProfiler interface {
+	// name is the value of the __profiler__ label selecting the profiler.
+	name() string
+	supports(pid int) bool
+	// collect profiles the process for the duration, and writes the gzipped pprof profile to w.
+	collect(ctx context.Context, pid int, duration time.Duration, w io.Writer) error
+}
+
+// processProfilers returns the profilers enabled in the scrape config, by order of preference.
+// perf_event supports any process and comes last.
+func processProfilers(cfg ScrapeConfig) []processProfiler {
+	var profilers []processProfiler
+	if cfg.JavaAsyncProfiler.Enabled {
+		profilers = append(profilers, newAsyncProfiler(cfg.JavaAsyncProfiler))
+	}
+	if cfg.PySpy.Enabled {
+		profilers = append(profilers, newPySpy(cfg.PySpy))
+	}
+	if cfg.Rbspy.Enabled {
+		profilers = append(profilers, newRbspy(cfg.Rbspy))
+	}
+	if cfg.PerfEvent.Enabled {
+		profilers = append(profilers, perfProfiler{cfg: cfg.PerfEvent})
+	}
+	return profilers
+}
+
+// selectProfiler returns the profiler of the process, the first one supporting it unless forced by
+// name.
+func selectProfiler(profilers []processProfiler, forced string, pid int) (processProfiler, error) {
+	for _, p := range profilers {
+		if forced != "" && p.name() == forced {
+			return p, nil
+		}
+		if forced == "" && p.supports(pid) {
+			return p, nil
+		}
+	}
+	if forced != "" {
+		return nil, fmt.Errorf("the profiler %q is not enabled", forced)
+	}
+	return nil, fmt.Errorf("no profiler enabled supports the process %d (%s)", pid, executable(pid))
+}
+
+// processRef is the process of a target profiled by the agent itself rather than scraped.
+type processRef struct {
+	pid int
+	// containerID is resolved to the process of the container at every collection, as the
+	// process changes when the container restarts.
+	containerID string
+}
+
+// processTargetRef returns the process of the target when profiled without scraping it, or nil.
+func processTargetRef(cfg ScrapeConfig, lset labels.Labels) (*processRef, error) {
+	if len(processProfilers(cfg)) == 0 {
+		return nil, nil
+	}
+	if v := lset.Get(PIDLabel); v != "" {
+		pid, err := strconv.Atoi(v)
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("invalid %s label %q", PIDLabel, v)
+		}
+		return &processRef{pid: pid}, nil
+	}
+	if v := lset.Get(ContainerIDLabel); v != "" {
+		// containerd://<id>, docker://<id>, cri-o://<id>
+		if i := strings.Index(v, "://"); i >= 0 {
+			v = v[i+3:]
+		}
+		if v == "" {
+			return nil, fmt.Errorf("invalid %s label %q", ContainerIDLabel, lset.Get(ContainerIDLabel))
+		}
+		return &processRef{containerID: v}, nil
+	}
+	return nil, nil
+}
+
+func (r *processRef) String() string {
+	if r.containerID != "" {
+		return r.containerID
+	}
+	return fmt.Sprintf("pid-%d", r.pid)
+}
+
+// resolve returns the process to profile. The processes of a container are ordered by pid, the
+// first one preferred being returned if any.
+func (r *processRef) resolve(prefer func(pid int) bool) (int, error) {
+	if r.containerID == "" {
+		return r.pid, nil
+	}
+	pids, err := findContainerPIDs(r.containerID)
+	if err != nil {
+		return 0, err
+	}
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no process found for the container %s", r.containerID)
+	}
+	for _, pid := range pids {
+		if prefer(pid) {
+			return pid, nil
+		}
+	}
+	return pids[0], nil
+}
+
+// findContainerPIDs returns the processes whose cgroups belong to the container.
+func findContainerPIDs(containerID string) ([]int, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if inContainer(filepath.Join(procRoot, e.Name(), "cgroup"), containerID) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+func inContainer(cgroupPath, containerID string) bool {
+	f, err := os.Open(cgroupPath)
+	if err != nil {
+		// the process exited.
+		return false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 0::/kubepods.slice/kubepods-pod<uid>.slice/cri-containerd-<id>.scope
+		if strings.Contains(s.Text(), containerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// isJVM returns whether the executable of the process is java.
+func isJVM(pid int) bool {
+	return executable(pid) == "java"
+}
@@ -0,0 +1,89 @@
+package agent
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery"
+	"github.com/prometheus/prometheus/discovery/refresh"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+const (
+	processMetaLabelPrefix = model.MetaLabelPrefix + "process_"
+	processPIDLabel        = processMetaLabelPrefix + "pid"
+	processPPIDLabel       = processMetaLabelPrefix + "ppid"
+	processNameLabel       = processMetaLabelPrefix + "name"
+	processExeLabel        = processMetaLabelPrefix + "exe"
+	processServiceLabel    = processMetaLabelPrefix + "service"
+)
+
+// DefaultProcessSDConfig is the default process service discovery configuration.
+var DefaultProcessSDConfig = ProcessSDConfig{
+	RefreshInterval: model.Duration(time.Minute),
+}
+
+// ProcessSDConfig discovers the processes running on the host of the agent, on Linux and Windows.
+// The targets have the __pid__ label of their process, and no address.
+type ProcessSDConfig struct {
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+// Name returns the name of the Config.
+func (*ProcessSDConfig) Name() string { return "process" }
+
+// NewDiscoverer returns a Discoverer for the Config.
+func (c *ProcessSDConfig) NewDiscoverer(opts discovery.DiscovererOptions) (discovery.Discoverer, error) {
+	return refresh.NewDiscovery(opts.Logger, "process", time.Duration(c.RefreshInterval), refreshProcesses), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *ProcessSDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = DefaultProcessSDConfig
+	type plain ProcessSDConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = DefaultProcessSDConfig.RefreshInterval
+	}
+	return nil
+}
+
+// processInfo is a process discovered on the host.
+type processInfo struct {
+	pid, ppid int
+	// name is the name of the executable without extension, such as python3 or java.
+	name string
+	exe  string
+	// service is the Windows service running the process, if any.
+	service string
+}
+
+func refreshProcesses(context.Context) ([]*targetgroup.Group, error) {
+	processes, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+	group := &targetgroup.Group{
+		Source:  "process",
+		Targets: make([]model.LabelSet, 0, len(processes)),
+	}
+	for _, p := range processes {
+		pid := model.LabelValue(strconv.Itoa(p.pid))
+		target := model.LabelSet{
+			PIDLabel:         pid,
+			processPIDLabel:  pid,
+			processPPIDLabel: model.LabelValue(strconv.Itoa(p.ppid)),
+			processNameLabel: model.LabelValue(p.name),
+			processExeLabel:  model.LabelValue(p.exe),
+		}
+		if p.service != "" {
+			target[processServiceLabel] = model.LabelValue(p.service)
+		}
+		group.Targets = append(group.Targets, target)
+	}
+	return []*targetgroup.Group{group}, nil
+}
@@ -0,0 +1,68 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseProcStat(t *testing.T) {
+	comm, ppid, ok := parseProcStat([]byte("1234 (my (weird) app) S 42 1234 1234 0 -1 4194560\n"))
+	require.True(t, ok)
+	require.Equal(t, "my (weird) app", comm)
+	require.Equal(t, 42, ppid)
+
+	_, _, ok = parseProcStat([]byte("1234 app S"))
+	require.False(t, ok)
+}
+
+func TestProcessDiscovery(t *testing.T) {
+	root := fakeProc(t)
+	addFakeProcess(t, root, "2", "", "")
+	addFakeProcess(t, root, "10", "/usr/bin/python3.11", "")
+	// the executable is not readable.
+	addFakeProcess(t, root, "11", "", "")
+	addFakeProcess(t, root, "12", "", "")
+	for pid, stat := range map[string]string{
+		"2":  "2 (kthreadd) S 0 0 0",
+		"10": "10 (python3) S 1 10 10",
+		"11": "11 (nginx) S 1 11 11",
+		"12": "12 (kworker/0:1) I 2 0 0",
+	} {
+		require.NoError(t, os.WriteFile(filepath.Join(root, pid, "stat"), []byte(stat), 0o644))
+	}
+
+	groups, err := refreshProcesses(context.Background())
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	require.Equal(t, []model.LabelSet{
+		{
+			PIDLabel:         "10",
+			processPIDLabel:  "10",
+			processPPIDLabel: "1",
+			processNameLabel: "python3.11",
+			processExeLabel:  "/usr/bin/python3.11",
+		},
+		{
+			PIDLabel:         "11",
+			processPIDLabel:  "11",
+			processPPIDLabel: "1",
+			processNameLabel: "nginx",
+			processExeLabel:  "",
+		},
+	}, groups[0].Targets)
+}
+
+func TestProcessSDConfig(t *testing.T) {
+	var cfg ServiceDiscoveryConfig
+	require.NoError(t, yaml.Unmarshal([]byte("process_sd_configs:\n  - {}\n"), &cfg))
+	require.Equal(t, []*ProcessSDConfig{&DefaultProcessSDConfig}, cfg.ProcessSDConfigs)
+	require.Len(t, cfg.Configs(), 1)
+}
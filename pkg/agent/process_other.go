@@ -0,0 +1,74 @@
+//go:build !windows
+
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// executable returns the name of the executable of the process, such as python3.11.
+func executable(pid int) string {
+	return filepath.Base(executablePath(pid))
+}
+
+func executablePath(pid int) string {
+	exe, err := os.Readlink(filepath.Join(procRoot, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return ""
+	}
+	return exe
+}
+
+// listProcesses returns the processes of the procfs, except the kernel threads.
+func listProcesses() ([]processInfo, error) {
+	entries, err := os.ReadDir(procRoot)
+	if err != nil {
+		return nil, fmt.Errorf("listing the processes: %w", err)
+	}
+	var processes []processInfo
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join(procRoot, e.Name(), "stat"))
+		if err != nil {
+			// the process exited.
+			continue
+		}
+		comm, ppid, ok := parseProcStat(stat)
+		// the kernel threads are children of kthreadd.
+		if !ok || pid == 2 || ppid == 2 {
+			continue
+		}
+		p := processInfo{pid: pid, ppid: ppid, name: comm, exe: executablePath(pid)}
+		// the executables of the processes of other users can't be read without privileges.
+		if p.exe != "" {
+			p.name = filepath.Base(p.exe)
+		}
+		processes = append(processes, p)
+	}
+	return processes, nil
+}
+
+// parseProcStat returns the command and the parent of a /proc/<pid>/stat file:
+// "<pid> (<comm>) <state> <ppid> ...", where comm can contain spaces and parentheses.
+func parseProcStat(stat []byte) (comm string, ppid int, ok bool) {
+	start, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return "", 0, false
+	}
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return "", 0, false
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return "", 0, false
+	}
+	return string(stat[start+1 : end]), ppid, true
+}
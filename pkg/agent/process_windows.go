@@ -0,0 +1,114 @@
+//go:build windows
+
+package agent
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// executable returns the name of the executable of the process without extension, such as python.
+func executable(pid int) string {
+	return executableName(executablePath(pid))
+}
+
+func executablePath(pid int) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h) // nolint:errcheck
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:size])
+}
+
+func executableName(path string) string {
+	name := filepath.Base(path)
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".exe") {
+		name = name[:len(name)-len(ext)]
+	}
+	return name
+}
+
+// listProcesses returns the processes of the host, with the services they run.
+func listProcesses() ([]processInfo, error) {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(snapshot) // nolint:errcheck
+
+	// the services can't be listed without the permission, which doesn't prevent the discovery.
+	services, _ := listServiceProcesses()
+	var (
+		processes []processInfo
+		entry     = windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	)
+	for err = windows.Process32First(snapshot, &entry); err == nil; err = windows.Process32Next(snapshot, &entry) {
+		pid := int(entry.ProcessID)
+		// the System Idle Process.
+		if pid == 0 {
+			continue
+		}
+		processes = append(processes, processInfo{
+			pid:     pid,
+			ppid:    int(entry.ParentProcessID),
+			name:    executableName(windows.UTF16ToString(entry.ExeFile[:])),
+			exe:     executablePath(pid),
+			service: services[pid],
+		})
+	}
+	if !errors.Is(err, windows.ERROR_NO_MORE_FILES) {
+		return nil, err
+	}
+	return processes, nil
+}
+
+// listServiceProcesses returns the services running, by process. The processes hosting several
+// services, such as svchost, are given the first one.
+func listServiceProcesses() (map[int]string, error) {
+	scm, err := windows.OpenSCManager(nil, nil, windows.SC_MANAGER_ENUMERATE_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseServiceHandle(scm) // nolint:errcheck
+
+	var (
+		buf                         []byte
+		bytesNeeded, servicesReturn uint32
+	)
+	for {
+		var p *byte
+		if len(buf) > 0 {
+			p = &buf[0]
+		}
+		err = windows.EnumServicesStatusEx(scm, windows.SC_ENUM_PROCESS_INFO, windows.SERVICE_WIN32, windows.SERVICE_ACTIVE,
+			p, uint32(len(buf)), &bytesNeeded, &servicesReturn, nil, nil)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, windows.ERROR_MORE_DATA) || bytesNeeded <= uint32(len(buf)) {
+			return nil, err
+		}
+		buf = make([]byte, bytesNeeded)
+	}
+	services := make(map[int]string, servicesReturn)
+	if servicesReturn == 0 {
+		return services, nil
+	}
+	for _, s := range unsafe.Slice((*windows.ENUM_SERVICE_STATUS_PROCESS)(unsafe.Pointer(&buf[0])), servicesReturn) {
+		pid := int(s.ServiceStatusProcess.ProcessId)
+		if _, ok := services[pid]; pid != 0 && !ok {
+			services[pid] = windows.UTF16PtrToString(s.ServiceName)
+		}
+	}
+	return services, nil
+}
@@ -34,6 +34,7 @@ import (
 	"github.com/prometheus/prometheus/model/relabel"
 
 	agentv1v1 "github.com/grafana/phlare/api/gen/proto/go/agent/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
 )
 
 const (
@@ -92,12 +93,14 @@ func populateLabels(lset labels.Labels, cfg ScrapeConfig) (res, orig labels.Labe
 	if lset == nil {
 		return nil, preRelabelLabels, nil
 	}
-	if v := lset.Get(model.AddressLabel); v == "" {
-		return nil, nil, errors.New("no address")
+	// The processes profiled by the agent itself don't need any address.
+	process, err := processTargetRef(cfg, lset)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	if v := lset.Get(model.AddressLabel); v == "" {
-		return nil, nil, fmt.Errorf("no address")
+	addr := lset.Get(model.AddressLabel)
+	if addr == "" && process == nil {
+		return nil, nil, errors.New("no address")
 	}
 
 	lb = labels.NewBuilder(lset)
@@ -114,9 +117,8 @@ func populateLabels(lset labels.Labels, cfg ScrapeConfig) (res, orig labels.Labe
 		_, _, err := net.SplitHostPort(s + ":1234")
 		return err == nil
 	}
-	addr := lset.Get(model.AddressLabel)
 	// If it's an address with no trailing port, infer it based on the used scheme.
-	if addPort(addr) {
+	if addr != "" && addPort(addr) {
 		// Addresses reaching this point are already wrapped in [] if necessary.
 		switch lset.Get(model.SchemeLabel) {
 		case "http", "":
@@ -129,8 +131,10 @@ func populateLabels(lset labels.Labels, cfg ScrapeConfig) (res, orig labels.Labe
 		lb.Set(model.AddressLabel, addr)
 	}
 
-	if err := config.CheckTargetAddress(model.LabelValue(addr)); err != nil {
-		return nil, nil, err
+	if addr != "" {
+		if err := config.CheckTargetAddress(model.LabelValue(addr)); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Meta labels are deleted after relabelling. Other internal labels propagate to
@@ -141,8 +145,11 @@ func populateLabels(lset labels.Labels, cfg ScrapeConfig) (res, orig labels.Labe
 		}
 	}
 
-	// Default the instance label to the target address.
+	// Default the instance label to the target address, or its process.
 	if v := lset.Get(model.InstanceLabel); v == "" {
+		if addr == "" {
+			addr = process.String()
+		}
 		lb.Set(model.InstanceLabel, addr)
 	}
 
@@ -188,6 +195,9 @@ func (tg *TargetGroup) targetsFromGroup(group *targetgroup.Group) ([]*Target, []
 					profType = label.Value
 				}
 			}
+			if !phlaremodel.ProfileTypeEnabled(profType, tg.config.EnabledProfileTypes, tg.config.DisabledProfileTypes) {
+				continue
+			}
 			lbls, origLabels, err := populateLabels(lset, tg.config)
 			if err != nil {
 				return nil, nil, fmt.Errorf("instance %d in group %s: %s", i, group, err)
@@ -222,6 +232,14 @@ func (tg *TargetGroup) targetsFromGroup(group *targetgroup.Group) ([]*Target, []
 				continue
 			}
 			if lbls != nil || origLabels != nil {
+				// Only the CPU of the processes without pprof endpoints is profiled, by the agent.
+				process, err := processTargetRef(tg.config, lbls)
+				if err != nil {
+					return nil, nil, fmt.Errorf("instance %d in group %s: %s", i, group, err)
+				}
+				if process != nil && profType != pprofProcessCPU {
+					continue
+				}
 				params := tg.config.Params
 				if params == nil {
 					params = url.Values{}
@@ -240,6 +258,9 @@ func (tg *TargetGroup) targetsFromGroup(group *targetgroup.Group) ([]*Target, []
 					timeout:              timeout,
 					health:               agentv1v1.Health_HEALTH_UNSPECIFIED,
 					logger:               tg.logger,
+					process:              process,
+					profilers:            processProfilers(tg.config),
+					metadata:             tg.targetMetadata(process),
 				})
 			}
 		}
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	commonconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/net/context/ctxhttp"
+	"gopkg.in/yaml.v2"
+
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// RemoteConfig configures the agent to poll its scrape configs from Phlare.
+type RemoteConfig struct {
+	URL          flagext.URLValue  `yaml:"url"`
+	PollInterval time.Duration     `yaml:"poll_interval"`
+	Labels       map[string]string `yaml:"labels" doc:"description=Labels identifying the agent, sent with the polls of the scrape configs."`
+}
+
+// RegisterFlagsWithPrefix registers the remote config flags.
+func (c *RemoteConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.Var(&c.URL, prefix+"remote-config.url", "URL of the agent config endpoint of Phlare, for example http://phlare:4100/api/v1/agent/config. When set, the scrape configs are polled from it and replace the ones of the config file.")
+	f.DurationVar(&c.PollInterval, prefix+"remote-config.poll-interval", time.Minute, "How often the scrape configs are polled from the remote config URL.")
+}
+
+// ConfigRule assigns scrape configs to the agents whose labels match its selector.
+type ConfigRule struct {
+	// TenantID restricts the rule to the agents of a tenant. Empty to apply to all the tenants.
+	TenantID      string          `yaml:"tenant_id,omitempty"`
+	Selector      string          `yaml:"selector"`
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+
+	matchers []*labels.Matcher
+}
+
+// Validate validates the rule and prepares its selector.
+func (r *ConfigRule) Validate() error {
+	matchers, err := parser.ParseMetricSelector(r.Selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector %q: %w", r.Selector, err)
+	}
+	r.matchers = matchers
+	// The scrape configs are served as they are written, so the agents can apply their defaults.
+	// Validating a copy leaves them untouched.
+	for _, cfg := range r.ScrapeConfigs {
+		if cfg == nil {
+			return errors.New("empty scrape config")
+		}
+		out, err := yaml.Marshal(cfg)
+		if err != nil {
+			return err
+		}
+		var c ScrapeConfig
+		if err := yaml.Unmarshal(out, &c); err != nil {
+			return err
+		}
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ConfigRule) matches(tenantID string, lbls labels.Labels) bool {
+	if r.TenantID != "" && r.TenantID != tenantID {
+		return false
+	}
+	for _, m := range r.matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// remoteScrapeConfigs is the body of the responses of the agent config endpoint.
+type remoteScrapeConfigs struct {
+	ScrapeConfigs []*ScrapeConfig `yaml:"scrape_configs"`
+	// Captures are the captures pending for the agent.
+	Captures []*Capture `yaml:"captures,omitempty"`
+}
+
+// MatchConfigRules returns the scrape configs of the rules matching the agent. When several
+// rules define the same job, the first one wins.
+func MatchConfigRules(rules []*ConfigRule, tenantID string, lbls labels.Labels) []*ScrapeConfig {
+	var (
+		result []*ScrapeConfig
+		jobs   = map[string]struct{}{}
+	)
+	for _, r := range rules {
+		if !r.matches(tenantID, lbls) {
+			continue
+		}
+		for _, cfg := range r.ScrapeConfigs {
+			if _, ok := jobs[cfg.JobName]; ok {
+				continue
+			}
+			jobs[cfg.JobName] = struct{}{}
+			result = append(result, cfg)
+		}
+	}
+	return result
+}
+
+// NewConfigHandler returns the handler serving the scrape configs of an agent, identified by
+// the labels passed as query parameters. rules returns the current rules. The pending captures of
+// the store are served with them, if any.
+func NewConfigHandler(rules func() []*ConfigRule, captures *CaptureStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, err := tenant.ExtractTenantIDFromContext(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var lbls labels.Labels
+		for name, values := range r.URL.Query() {
+			if len(values) > 0 {
+				lbls = append(lbls, labels.Label{Name: name, Value: values[0]})
+			}
+		}
+		sort.Sort(lbls)
+		resp := remoteScrapeConfigs{ScrapeConfigs: MatchConfigRules(rules(), tenantID, lbls)}
+		if captures != nil {
+			resp.Captures = captures.Pending(tenantID, lbls)
+		}
+		util.WriteYAMLResponse(w, resp)
+	})
+}
+
+// pollRemoteConfig polls the scrape configs until the context is done, and applies them when
+// they change. The captures polled are started once.
+func (a *Agent) pollRemoteConfig(ctx context.Context) {
+	client, err := commonconfig.NewClientFromConfig(a.Config.ClientConfig.Client, "remote-config")
+	if err != nil {
+		level.Error(a.logger).Log("msg", "failed to create the remote config client", "err", err)
+		return
+	}
+	ticker := time.NewTicker(a.Config.RemoteConfig.PollInterval)
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		var cfg remoteScrapeConfigs
+		body, err := a.fetchRemoteConfig(ctx, client)
+		if err == nil {
+			err = yaml.UnmarshalStrict(body, &cfg)
+		}
+		if err != nil {
+			level.Warn(a.logger).Log("msg", "failed to fetch the remote config", "err", err)
+		} else {
+			// the captures change the body, the scrape configs are compared alone.
+			configs, err := yaml.Marshal(cfg.ScrapeConfigs)
+			if err == nil && !bytes.Equal(configs, last) {
+				err = a.applyRemoteConfig(cfg.ScrapeConfigs)
+			}
+			if err != nil {
+				level.Error(a.logger).Log("msg", "failed to apply the remote config", "err", err)
+			} else {
+				last = configs
+			}
+			a.startCaptures(ctx, cfg.Captures)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Agent) fetchRemoteConfig(ctx context.Context, client *http.Client) ([]byte, error) {
+	u := *a.Config.RemoteConfig.URL.URL
+	query := u.Query()
+	for name, value := range a.Config.RemoteConfig.Labels {
+		query.Set(name, value)
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgentHeader)
+	if a.Config.ClientConfig.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", a.Config.ClientConfig.TenantID)
+	}
+	resp, err := ctxhttp.Do(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+func (a *Agent) applyRemoteConfig(configs []*ScrapeConfig) error {
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	level.Info(a.logger).Log("msg", "applying the remote config", "jobs", len(configs))
+	return a.ApplyScrapeConfigs(configs)
+}
@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+const testConfigRules = `
+- selector: '{env="prod"}'
+  scrape_configs:
+    - job_name: prod
+      profiling_config:
+        path_prefix: /prefix
+      static_configs:
+        - targets: ['localhost:4100']
+- tenant_id: tenant-b
+  selector: '{}'
+  scrape_configs:
+    - job_name: tenant-b
+      static_configs:
+        - targets: ['localhost:4100']
+- selector: '{region=~"eu-.*"}'
+  scrape_configs:
+    - job_name: prod
+    - job_name: eu
+      static_configs:
+        - targets: ['localhost:4100']
+`
+
+func newTestConfigServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var rules []*ConfigRule
+	require.NoError(t, yaml.UnmarshalStrict([]byte(testConfigRules), &rules))
+	for _, r := range rules {
+		require.NoError(t, r.Validate())
+	}
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(true).Wrap(NewConfigHandler(func() []*ConfigRule { return rules }, nil)))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConfigRule_Validate_EmptyScrapeConfig(t *testing.T) {
+	var rules []*ConfigRule
+	require.NoError(t, yaml.UnmarshalStrict([]byte(`
+- selector: '{}'
+  scrape_configs:
+    -
+`), &rules))
+	require.Error(t, rules[0].Validate())
+}
+
+func TestConfigHandler(t *testing.T) {
+	s := newTestConfigServer(t)
+
+	for _, tc := range []struct {
+		tenantID string
+		labels   url.Values
+		jobs     []string
+	}{
+		{tenantID: "tenant-a", labels: url.Values{"env": {"prod"}}, jobs: []string{"prod"}},
+		{tenantID: "tenant-a", labels: url.Values{"env": {"dev"}}},
+		{tenantID: "tenant-b", labels: url.Values{"env": {"prod"}, "region": {"eu-west"}}, jobs: []string{"prod", "tenant-b", "eu"}},
+	} {
+		a := &Agent{Config: &Config{
+			ClientConfig: ClientConfig{TenantID: tc.tenantID},
+			RemoteConfig: RemoteConfig{Labels: map[string]string{}},
+		}}
+		require.NoError(t, a.Config.RemoteConfig.URL.Set(s.URL))
+		for name, values := range tc.labels {
+			a.Config.RemoteConfig.Labels[name] = values[0]
+		}
+		body, err := a.fetchRemoteConfig(context.Background(), s.Client())
+		require.NoError(t, err)
+
+		var cfg remoteScrapeConfigs
+		require.NoError(t, yaml.UnmarshalStrict(body, &cfg))
+		var jobs []string
+		for _, c := range cfg.ScrapeConfigs {
+			require.NoError(t, c.Validate())
+			jobs = append(jobs, c.JobName)
+			if c.JobName == "prod" {
+				// The prefix is applied once, by the agent.
+				for _, p := range c.ProfilingConfig.PprofConfig {
+					require.True(t, strings.HasPrefix(p.Path, "/prefix/debug"))
+				}
+			}
+		}
+		require.Equal(t, tc.jobs, jobs)
+	}
+}
+
+func TestAgent_RemoteConfig(t *testing.T) {
+	s := newTestConfigServer(t)
+	cfg := &Config{
+		ClientConfig: ClientConfig{TenantID: "tenant-a"},
+		RemoteConfig: RemoteConfig{
+			PollInterval: 10 * time.Millisecond,
+			Labels:       map[string]string{"env": "prod"},
+		},
+	}
+	require.NoError(t, cfg.RemoteConfig.URL.Set(s.URL))
+	a, err := New(cfg, log.NewNopLogger(), nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), a))
+	defer services.StopAndAwaitTerminated(context.Background(), a) //nolint:errcheck
+
+	require.Eventually(t, func() bool {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+		return len(a.Config.ScrapeConfigs) == 1 && a.Config.ScrapeConfigs[0].JobName == "prod"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSpySampleRate = 100
+
+// SpyConfig configures the profiling of the Python or Ruby processes which don't expose pprof
+// endpoints, running py-spy or rbspy on them.
+type SpyConfig struct {
+	// Enabled profiles the CPU of the Python, or Ruby, processes of the targets with a __pid__ or
+	// __container_id__ label, instead of scraping them. Their other profile types are dropped.
+	Enabled bool `yaml:"enabled"`
+	// Path is the path of the py-spy or rbspy binary.
+	Path string `yaml:"path,omitempty"`
+	// SampleRate is the number of samples per second.
+	SampleRate int `yaml:"sample_rate,omitempty"`
+}
+
+func (c *SpyConfig) validate(name string) error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Path == "" {
+		c.Path = name
+	}
+	if c.SampleRate == 0 {
+		c.SampleRate = defaultSpySampleRate
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1000 {
+		return fmt.Errorf("%s sample_rate must be between 1 and 1000", name)
+	}
+	return nil
+}
+
+// spyProfiler profiles the processes of an interpreter by running an external sampling profiler,
+// such as py-spy, outputting collapsed stacks.
+type spyProfiler struct {
+	profiler string
+	cfg      SpyConfig
+	// interpreter returns whether the executable is supported by the profiler.
+	interpreter func(exe string) bool
+	// args returns the arguments of the profiler writing the collapsed stacks to the output.
+	args func(pid, seconds, rate int, output string) []string
+	run  func(ctx context.Context, name string, args ...string) error
+}
+
+func newPySpy(cfg SpyConfig) *spyProfiler {
+	return &spyProfiler{
+		profiler:    "py-spy",
+		cfg:         cfg,
+		interpreter: func(exe string) bool { return strings.HasPrefix(exe, "python") },
+		args: func(pid, seconds, rate int, output string) []string {
+			return []string{
+				"record", "--pid", strconv.Itoa(pid), "--duration", strconv.Itoa(seconds), "--rate", strconv.Itoa(rate),
+				"--format", "raw", "--output", output, "--nonblocking",
+			}
+		},
+		run: runCommand,
+	}
+}
+
+func newRbspy(cfg SpyConfig) *spyProfiler {
+	return &spyProfiler{
+		profiler:    "rbspy",
+		cfg:         cfg,
+		interpreter: func(exe string) bool { return strings.HasPrefix(exe, "ruby") },
+		args: func(pid, seconds, rate int, output string) []string {
+			return []string{
+				"record", "--pid", strconv.Itoa(pid), "--duration", strconv.Itoa(seconds), "--rate", strconv.Itoa(rate),
+				"--format", "collapsed", "--file", output, "--silent", "--nonblocking",
+			}
+		},
+		run: runCommand,
+	}
+}
+
+func (s *spyProfiler) name() string { return s.profiler }
+
+func (s *spyProfiler) supports(pid int) bool { return s.interpreter(executable(pid)) }
+
+func (s *spyProfiler) collect(ctx context.Context, pid int, duration time.Duration, w io.Writer) error {
+	dir, err := os.MkdirTemp("", "phlare-"+s.profiler)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "profile.collapsed")
+
+	// the profilers only take whole seconds.
+	seconds := int(duration / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	start := time.Now()
+	if err := s.run(ctx, s.cfg.Path, s.args(pid, seconds, s.cfg.SampleRate, output)...); err != nil {
+		return err
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := parseCollapsed(f, time.Second/time.Duration(s.cfg.SampleRate), start, time.Since(start))
+	if err != nil {
+		return err
+	}
+	// the profiler is detected from the comments by the distributor.
+	p.Comments = append(p.Comments, "spy="+s.profiler)
+	return p.Write(w)
+}
@@ -0,0 +1,65 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpyCollect(t *testing.T) {
+	cfg := SpyConfig{Enabled: true}
+	require.NoError(t, cfg.validate("py-spy"))
+	require.Equal(t, SpyConfig{Enabled: true, Path: "py-spy", SampleRate: defaultSpySampleRate}, cfg)
+
+	s := newPySpy(cfg)
+	s.run = func(_ context.Context, name string, args ...string) error {
+		require.Equal(t, "py-spy", name)
+		require.Equal(t, []string{"record", "--pid", "42", "--duration", "14", "--rate", "100", "--format", "raw", "--output"}, args[:10])
+		return os.WriteFile(args[10], []byte("<module> (app.py:10);work (app.py:3) 7\n"), 0o644)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, s.collect(context.Background(), 42, 14*time.Second, &buf))
+
+	p, err := profile.Parse(&buf)
+	require.NoError(t, err)
+	require.Len(t, p.Sample, 1)
+	require.Equal(t, []int64{7, int64(70 * time.Millisecond)}, p.Sample[0].Value)
+	require.Equal(t, "work (app.py:3)", p.Sample[0].Location[0].Line[0].Function.Name)
+}
+
+func TestSelectProfiler(t *testing.T) {
+	root := fakeProc(t)
+	addFakeProcess(t, root, "10", "/usr/bin/python3.11", "")
+	addFakeProcess(t, root, "11", "/usr/local/bin/ruby", "")
+	addFakeProcess(t, root, "12", "/usr/bin/nginx", "")
+
+	cfg := ScrapeConfig{
+		JobName:   "processes",
+		PySpy:     SpyConfig{Enabled: true},
+		Rbspy:     SpyConfig{Enabled: true},
+		PerfEvent: PerfEventConfig{Enabled: true},
+	}
+	require.NoError(t, cfg.Validate())
+	profilers := processProfilers(cfg)
+
+	for pid, expected := range map[int]string{10: "py-spy", 11: "rbspy", 12: "perf"} {
+		p, err := selectProfiler(profilers, "", pid)
+		require.NoError(t, err)
+		require.Equal(t, expected, p.name())
+	}
+
+	p, err := selectProfiler(profilers, "perf", 10)
+	require.NoError(t, err)
+	require.Equal(t, "perf", p.name(), "forced by the __profiler__ label")
+	_, err = selectProfiler(profilers, "async-profiler", 10)
+	require.Error(t, err)
+
+	cfg.PerfEvent.Enabled = false
+	_, err = selectProfiler(processProfilers(cfg), "", 12)
+	require.Error(t, err)
+}
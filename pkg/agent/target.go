@@ -7,6 +7,7 @@ import (
 	"hash/fnv"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -123,6 +124,12 @@ type Target struct {
 	scrapeClient         *http.Client
 	pusherClientProvider PusherClientProvider
 
+	// process is the process profiled by the agent instead of scraping the target, if any.
+	process   *processRef
+	profilers []processProfiler
+	// metadata is the metadata of the target sent with its profiles, if enabled.
+	metadata *targetMetadata
+
 	hash              uint64
 	req               *http.Request
 	logger            log.Logger
@@ -176,7 +183,11 @@ func (t *Target) scrape(ctx context.Context) {
 		}
 	}
 
-	if err := t.fetchProfile(scrapeCtx, profileType, buf); err != nil {
+	fetch := t.fetchProfile
+	if t.process != nil {
+		fetch = t.collectProcessProfile
+	}
+	if err := fetch(scrapeCtx, profileType, buf); err != nil {
 		level.Error(t.logger).Log("msg", "fetch profile failed", "target", t.Labels().String(), "err", err)
 		t.health = agentv1.Health_HEALTH_DOWN
 		t.lastScrapeDuration = time.Since(start)
@@ -193,10 +204,17 @@ func (t *Target) scrape(ctx context.Context) {
 	t.lastScrapeDuration = time.Since(start)
 	t.lastError = nil
 	t.lastScrape = start
+	t.metadata.refresh(ctx, t.URL(), t.timeout)
+	t.push(ctx, b, nil)
+}
+
+// push pushes a profile of the target, with its labels and the extra ones it doesn't have.
+func (t *Target) push(ctx context.Context, b []byte, extra labels.Labels) {
 	// todo retry strategy
 	req := &pushv1.PushRequest{}
 	series := &pushv1.RawProfileSeries{
-		Labels: make([]*typesv1.LabelPair, 0, len(t.labels)),
+		Labels:   make([]*typesv1.LabelPair, 0, len(t.labels)),
+		Metadata: t.metadata.labels(),
 	}
 	for _, l := range t.labels {
 		if strings.HasPrefix(l.Name, "__") && l.Name != labels.MetricName {
@@ -207,6 +225,15 @@ func (t *Target) scrape(ctx context.Context) {
 			Value: l.Value,
 		})
 	}
+	for _, l := range extra {
+		if t.labels.Has(l.Name) {
+			continue
+		}
+		series.Labels = append(series.Labels, &typesv1.LabelPair{
+			Name:  l.Name,
+			Value: l.Value,
+		})
+	}
 	series.Samples = []*pushv1.RawSample{
 		{
 			RawProfile: b,
@@ -261,6 +288,86 @@ func (t *Target) fetchProfile(ctx context.Context, profileType string, buf io.Wr
 	return nil
 }
 
+// collectProcessProfile profiles the CPU of the process of the target for the duration of a delta
+// scrape.
+func (t *Target) collectProcessProfile(ctx context.Context, _ string, buf io.Writer) error {
+	return t.profileProcess(ctx, t.interval-time.Second, buf)
+}
+
+// profileProcess profiles the CPU of the process of the target with the profiler of its runtime:
+// async-profiler, py-spy, rbspy, or perf_event otherwise.
+func (t *Target) profileProcess(ctx context.Context, duration time.Duration, buf io.Writer) error {
+	forced := t.labels.Get(ProfilerLabel)
+	// the processes of a container supported by a profiler other than perf_event are preferred.
+	pid, err := t.process.resolve(func(pid int) bool {
+		for _, p := range t.profilers {
+			if p.name() != "perf" && p.supports(pid) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	p, err := selectProfiler(t.profilers, forced, pid)
+	if err != nil {
+		return err
+	}
+	level.Debug(t.logger).Log("msg", "profiling process", "labels", t.Labels().String(), "pid", pid, "profiler", p.name())
+	return p.collect(ctx, pid, duration, buf)
+}
+
+// capture profiles the target on demand for the duration, and pushes the profile with the extra
+// labels. The delta profiles are taken over the duration, the others as they are at the end of it.
+func (t *Target) capture(ctx context.Context, duration time.Duration, extra labels.Labels) error {
+	ctx, cancel := context.WithTimeout(ctx, duration+captureTimeoutMargin)
+	defer cancel()
+
+	var buf bytes.Buffer
+	if t.process != nil {
+		if err := t.profileProcess(ctx, duration, &buf); err != nil {
+			return err
+		}
+		t.push(ctx, buf.Bytes(), extra)
+		return nil
+	}
+
+	u := t.URL()
+	if query := u.Query(); query.Has("seconds") {
+		query.Set("seconds", strconv.Itoa(int(duration/time.Second)))
+		u.RawQuery = query.Encode()
+	} else {
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgentHeader)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := ctxhttp.Do(ctx, t.scrapeClient, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(&buf, resp.Body); err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status (%d) %v", resp.StatusCode, string(bytes.TrimSpace(buf.Bytes())))
+	}
+	if buf.Len() == 0 {
+		return fmt.Errorf("empty profile from %s", u.String())
+	}
+	t.push(ctx, buf.Bytes(), extra)
+	return nil
+}
+
 func (t *Target) stop() {
 	t.cancel()
 }
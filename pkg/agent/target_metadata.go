@@ -0,0 +1,265 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"golang.org/x/net/context/ctxhttp"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+const (
+	defaultTargetMetadataCmdlinePath     = "/debug/pprof/cmdline"
+	defaultTargetMetadataMetricsPath     = "/metrics"
+	defaultTargetMetadataRefreshInterval = model.Duration(5 * time.Minute)
+	// maxTargetMetadataResponseBytes bounds the size of the responses the metadata is read from.
+	maxTargetMetadataResponseBytes = 4 << 20
+	// redactedCmdlineValue replaces the values of the arguments of the command lines.
+	redactedCmdlineValue = "<redacted>"
+)
+
+// TargetMetadataConfig configures the metadata of the targets sent with their profiles, so that
+// the profiles can be related to the versions of the binaries that produced them.
+type TargetMetadataConfig struct {
+	// Enabled fetches the build information of the targets. The process targets are not
+	// supported.
+	Enabled bool `yaml:"enabled"`
+	// Cmdline also fetches the command line of the targets, with the values of its arguments
+	// redacted, as they may hold secrets.
+	Cmdline bool `yaml:"cmdline,omitempty"`
+	// CmdlinePath is the path of the command line of the target, with NUL separated arguments as
+	// served by net/http/pprof. It is prefixed by the pprof prefix of the profiling config.
+	CmdlinePath string `yaml:"cmdline_path,omitempty"`
+	// MetricsPath is the path of the Prometheus metrics of the target, which has the go_info and
+	// go_build_info metrics of the Go client.
+	MetricsPath string `yaml:"metrics_path,omitempty"`
+	// RefreshInterval is how often the metadata of a target is fetched.
+	RefreshInterval model.Duration `yaml:"refresh_interval,omitempty"`
+}
+
+func (c *TargetMetadataConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.CmdlinePath == "" {
+		c.CmdlinePath = defaultTargetMetadataCmdlinePath
+	}
+	if c.MetricsPath == "" {
+		c.MetricsPath = defaultTargetMetadataMetricsPath
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = defaultTargetMetadataRefreshInterval
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("target_metadata refresh_interval must be positive")
+	}
+	return nil
+}
+
+// targetMetadata is the metadata of a target, fetched at most once per refresh interval. The last
+// known values of a source are kept when it fails.
+type targetMetadata struct {
+	cfg         TargetMetadataConfig
+	pprofPrefix string
+	client      *http.Client
+	logger      log.Logger
+
+	mtx         sync.Mutex
+	lastRefresh time.Time
+	refreshing  bool
+	// cmdline and build are the last known metadata of each source, by name.
+	cmdline map[string]string
+	build   map[string]string
+}
+
+func newTargetMetadata(cfg TargetMetadataConfig, pprofPrefix string, client *http.Client, logger log.Logger) *targetMetadata {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &targetMetadata{
+		cfg:         cfg,
+		pprofPrefix: pprofPrefix,
+		client:      client,
+		logger:      logger,
+	}
+}
+
+// targetMetadata returns the metadata of a new target of the group, nil if it is disabled or the
+// target is a process.
+func (tg *TargetGroup) targetMetadata(process *processRef) *targetMetadata {
+	if process != nil {
+		return nil
+	}
+	return newTargetMetadata(tg.config.TargetMetadata, tg.config.ProfilingConfig.PprofPrefix, tg.scrapeClient, tg.logger)
+}
+
+// refresh fetches the metadata of the target at the address in the background, when the refresh
+// interval elapsed, so the scrapes are not delayed by it. The profiles are sent with the last known
+// metadata meanwhile.
+func (m *targetMetadata) refresh(ctx context.Context, base *url.URL, timeout time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.refreshing || time.Since(m.lastRefresh) < time.Duration(m.cfg.RefreshInterval) {
+		return
+	}
+	m.lastRefresh = time.Now()
+	m.refreshing = true
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		m.fetchAll(ctx, base)
+	}()
+}
+
+// fetchAll fetches the metadata of the target at the address. The last known values of a source
+// are kept when it fails.
+func (m *targetMetadata) fetchAll(ctx context.Context, base *url.URL) {
+	var (
+		cmdline, build map[string]string
+		cmdlineOK      bool
+		buildOK        bool
+	)
+	if m.cfg.Cmdline {
+		cmdlineURL := *base
+		cmdlineURL.Path = path.Join("/", m.pprofPrefix, m.cfg.CmdlinePath)
+		cmdlineURL.RawQuery = ""
+		if b, err := m.fetch(ctx, &cmdlineURL); err != nil {
+			level.Warn(m.logger).Log("msg", "fetching the command line of the target failed", "url", cmdlineURL.String(), "err", err)
+		} else {
+			cmdline, cmdlineOK = parseCmdline(b), true
+		}
+	}
+
+	metricsURL := *base
+	metricsURL.Path = m.cfg.MetricsPath
+	metricsURL.RawQuery = ""
+	if b, err := m.fetch(ctx, &metricsURL); err != nil {
+		level.Warn(m.logger).Log("msg", "fetching the metrics of the target failed", "url", metricsURL.String(), "err", err)
+	} else if build, err = parseBuildInfo(b); err != nil {
+		level.Warn(m.logger).Log("msg", "parsing the metrics of the target failed", "url", metricsURL.String(), "err", err)
+	} else {
+		buildOK = true
+	}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.refreshing = false
+	if cmdlineOK {
+		m.cmdline = cmdline
+	}
+	if buildOK {
+		m.build = build
+	}
+}
+
+func (m *targetMetadata) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgentHeader)
+	req.Header.Set("Accept", string(expfmt.FmtText))
+	resp, err := ctxhttp.Do(ctx, m.client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxTargetMetadataResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("server returned HTTP status (%d) %v", resp.StatusCode, resp.Status)
+	}
+	return b, nil
+}
+
+// labels returns the last known metadata of the target, sorted by name.
+func (m *targetMetadata) labels() []*typesv1.LabelPair {
+	if m == nil {
+		return nil
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	result := make([]*typesv1.LabelPair, 0, len(m.cmdline)+len(m.build))
+	for _, values := range []map[string]string{m.cmdline, m.build} {
+		for name, value := range values {
+			result = append(result, &typesv1.LabelPair{Name: name, Value: value})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// parseCmdline parses the command line served by net/http/pprof, whose arguments are separated by
+// NUL bytes. Only the program and the names of the flags are kept, the values of the arguments are
+// redacted.
+func parseCmdline(b []byte) map[string]string {
+	args := strings.Split(strings.TrimRight(string(b), "\x00"), "\x00")
+	for i := 1; i < len(args); i++ {
+		args[i] = redactArg(args[i])
+	}
+	cmdline := strings.TrimSpace(strings.Join(args, " "))
+	if cmdline == "" {
+		return nil
+	}
+	return map[string]string{"cmdline": cmdline}
+}
+
+// redactArg redacts the value of a command line argument: the value of a flag, or the whole
+// argument if it is not a flag, as it may be the value of the previous one.
+func redactArg(arg string) string {
+	if arg == "" || arg == "-" || arg == "--" {
+		return arg
+	}
+	if !strings.HasPrefix(arg, "-") {
+		return redactedCmdlineValue
+	}
+	if name, _, ok := strings.Cut(arg, "="); ok {
+		return name + "=" + redactedCmdlineValue
+	}
+	return arg
+}
+
+// parseBuildInfo returns the Go version and the build information of the go_info and
+// go_build_info metrics in the text exposition format.
+func parseBuildInfo(b []byte) (map[string]string, error) {
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	build := map[string]string{}
+	for family, labels := range map[string]map[string]string{
+		"go_info":       {"version": "go_version"},
+		"go_build_info": {"path": "build_path", "version": "build_version", "checksum": "build_checksum"},
+	} {
+		f, ok := families[family]
+		if !ok || len(f.Metric) == 0 {
+			continue
+		}
+		for _, l := range f.Metric[0].Label {
+			if name, ok := labels[l.GetName()]; ok && l.GetValue() != "" {
+				build[name] = l.GetValue()
+			}
+		}
+	}
+	return build, nil
+}
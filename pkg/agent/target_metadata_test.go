@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+const testBuildInfoMetrics = `# HELP go_build_info Build information about the main Go module.
+# TYPE go_build_info gauge
+go_build_info{checksum="h1:abc",path="github.com/grafana/checkout",version="v1.2.3"} 1
+# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines 42
+# HELP go_info Information about the Go environment.
+# TYPE go_info gauge
+go_info{version="go1.19.4"} 1
+`
+
+func TestTargetMetadata(t *testing.T) {
+	metricsStatus := http.StatusOK
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prefix/debug/pprof/cmdline", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("/bin/checkout\x00-config.file=prod.yaml\x00-api-key\x00secret\x00-debug\x00"))
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(metricsStatus)
+		_, _ = w.Write([]byte(testBuildInfoMetrics))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	base, err := url.Parse(server.URL + "/prefix/debug/pprof/profile?seconds=10")
+	require.NoError(t, err)
+
+	cfg := TargetMetadataConfig{Enabled: true, Cmdline: true}
+	require.NoError(t, cfg.validate())
+	m := newTargetMetadata(cfg, "/prefix", server.Client(), log.NewNopLogger())
+	expected := []*typesv1.LabelPair{
+		{Name: "build_checksum", Value: "h1:abc"},
+		{Name: "build_path", Value: "github.com/grafana/checkout"},
+		{Name: "build_version", Value: "v1.2.3"},
+		{Name: "cmdline", Value: "/bin/checkout -config.file=<redacted> -api-key <redacted> -debug"},
+		{Name: "go_version", Value: "go1.19.4"},
+	}
+	// the metadata is fetched in the background.
+	m.refresh(context.Background(), base, time.Second)
+	require.Eventually(t, func() bool {
+		return len(m.labels()) == len(expected)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, expected, m.labels())
+
+	// the last known values are kept when the target fails.
+	metricsStatus = http.StatusInternalServerError
+	m.fetchAll(context.Background(), base)
+	require.Equal(t, expected, m.labels())
+
+	// the command line is only fetched when enabled.
+	cfg.Cmdline = false
+	m = newTargetMetadata(cfg, "/prefix", server.Client(), log.NewNopLogger())
+	m.fetchAll(context.Background(), base)
+	require.Empty(t, m.labels())
+	metricsStatus = http.StatusOK
+	m.fetchAll(context.Background(), base)
+	require.Equal(t, []*typesv1.LabelPair{
+		{Name: "build_checksum", Value: "h1:abc"},
+		{Name: "build_path", Value: "github.com/grafana/checkout"},
+		{Name: "build_version", Value: "v1.2.3"},
+		{Name: "go_version", Value: "go1.19.4"},
+	}, m.labels())
+
+	require.Nil(t, newTargetMetadata(TargetMetadataConfig{}, "", server.Client(), log.NewNopLogger()).labels())
+}
+
+func TestTargetMetadataConfig(t *testing.T) {
+	cfg := TargetMetadataConfig{Enabled: true}
+	require.NoError(t, cfg.validate())
+	require.Equal(t, TargetMetadataConfig{
+		Enabled:         true,
+		CmdlinePath:     "/debug/pprof/cmdline",
+		MetricsPath:     "/metrics",
+		RefreshInterval: model.Duration(5 * time.Minute),
+	}, cfg)
+
+	cfg = TargetMetadataConfig{Enabled: true, RefreshInterval: -1}
+	require.Error(t, cfg.validate())
+}
@@ -0,0 +1,83 @@
+// Package arrow writes samples in the Apache Arrow IPC streaming format, so they can be loaded in
+// bulk by data frame libraries like pandas or polars.
+//
+// See https://arrow.apache.org/docs/format/Columnar.html#ipc-streaming-format.
+package arrow
+
+import (
+	"io"
+
+	"github.com/apache/arrow/go/v10/arrow"
+	"github.com/apache/arrow/go/v10/arrow/array"
+	"github.com/apache/arrow/go/v10/arrow/ipc"
+	"github.com/apache/arrow/go/v10/arrow/memory"
+)
+
+// ContentType is the media type of Arrow IPC streams.
+const ContentType = "application/vnd.apache.arrow.stream"
+
+// Sample is a row of the stream.
+type Sample struct {
+	// Timestamp of the profile of the sample, in milliseconds.
+	Timestamp int64
+	// Stacktrace lists the function names of the sample, from the leaf to the root.
+	Stacktrace []string
+	Value      int64
+}
+
+var schema = arrow.NewSchema([]arrow.Field{
+	{Name: "timestamp", Type: &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}},
+	{Name: "stacktrace", Type: arrow.ListOf(&arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String})},
+	{Name: "value", Type: arrow.PrimitiveTypes.Int64},
+}, nil)
+
+// SampleWriter writes samples as an Arrow IPC stream with the schema:
+//
+//	timestamp: timestamp[ms, tz=UTC]
+//	stacktrace: list<item: dictionary<values=string, indices=int32>>
+//	value: int64
+//
+// The function names of the stacktraces are dictionary encoded: the names seen for the first time
+// in a batch are sent in a dictionary delta before the batch.
+type SampleWriter struct {
+	w       *ipc.Writer
+	builder *array.RecordBuilder
+}
+
+func NewSampleWriter(w io.Writer) *SampleWriter {
+	return &SampleWriter{
+		w:       ipc.NewWriter(w, ipc.WithSchema(schema), ipc.WithDictionaryDeltas(true)),
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, schema),
+	}
+}
+
+// WriteBatch writes the samples as a record batch.
+func (s *SampleWriter) WriteBatch(samples []Sample) error {
+	var (
+		timestamps  = s.builder.Field(0).(*array.TimestampBuilder)
+		stacktraces = s.builder.Field(1).(*array.ListBuilder)
+		names       = stacktraces.ValueBuilder().(*array.BinaryDictionaryBuilder)
+		values      = s.builder.Field(2).(*array.Int64Builder)
+	)
+	for _, sample := range samples {
+		timestamps.Append(arrow.Timestamp(sample.Timestamp))
+		stacktraces.Append(true)
+		for _, name := range sample.Stacktrace {
+			if err := names.AppendString(name); err != nil {
+				return err
+			}
+		}
+		values.Append(sample.Value)
+	}
+	// the dictionary builder keeps the names of the previous batches, so the writer only sends the
+	// new ones as a delta.
+	rec := s.builder.NewRecord()
+	defer rec.Release()
+	return s.w.Write(rec)
+}
+
+// Close writes the end of the stream. It doesn't close the underlying writer.
+func (s *SampleWriter) Close() error {
+	s.builder.Release()
+	return s.w.Close()
+}
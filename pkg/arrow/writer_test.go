@@ -0,0 +1,98 @@
+package arrow
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/apache/arrow/go/v10/arrow"
+	"github.com/apache/arrow/go/v10/arrow/array"
+	"github.com/apache/arrow/go/v10/arrow/ipc"
+	"github.com/stretchr/testify/require"
+)
+
+// Test_SampleWriter reads the stream back with the Arrow Go implementation.
+func Test_SampleWriter(t *testing.T) {
+	batches := [][]Sample{
+		{
+			{Timestamp: 1000, Stacktrace: []string{"a", "main"}, Value: 3},
+			{Timestamp: 1000, Stacktrace: []string{"b", "main"}, Value: 1},
+		},
+		{
+			{Timestamp: 2000, Stacktrace: []string{"c", "a", "main"}, Value: 5},
+			{Timestamp: 2000, Value: -7},
+		},
+		{
+			{Timestamp: 3000, Stacktrace: []string{"main"}, Value: 2},
+		},
+	}
+	var buf bytes.Buffer
+	w := NewSampleWriter(&buf)
+	for _, b := range batches {
+		require.NoError(t, w.WriteBatch(b))
+	}
+	require.NoError(t, w.Close())
+
+	// the names seen for the first time are sent before each batch.
+	var types []ipc.MessageType
+	mr := ipc.NewMessageReader(bytes.NewReader(buf.Bytes()))
+	defer mr.Release()
+	for {
+		m, err := mr.Message()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		types = append(types, m.Type())
+	}
+	require.Equal(t, []ipc.MessageType{
+		ipc.MessageSchema,
+		ipc.MessageDictionaryBatch, ipc.MessageRecordBatch,
+		ipc.MessageDictionaryBatch, ipc.MessageRecordBatch,
+		ipc.MessageRecordBatch,
+	}, types)
+
+	r, err := ipc.NewReader(&buf)
+	require.NoError(t, err)
+	defer r.Release()
+
+	schema := r.Schema()
+	require.Equal(t, []string{"timestamp", "stacktrace", "value"}, []string{schema.Field(0).Name, schema.Field(1).Name, schema.Field(2).Name})
+	require.Equal(t, &arrow.TimestampType{Unit: arrow.Millisecond, TimeZone: "UTC"}, schema.Field(0).Type)
+	require.Equal(t, arrow.PrimitiveTypes.Int64, schema.Field(2).Type)
+
+	var actual [][]Sample
+	for r.Next() {
+		rec := r.Record()
+		var (
+			timestamps  = rec.Column(0).(*array.Timestamp)
+			stacktraces = rec.Column(1).(*array.List)
+			values      = rec.Column(2).(*array.Int64)
+			names       = stacktraces.ListValues().(*array.Dictionary)
+			dictionary  = names.Dictionary().(*array.String)
+			offsets     = stacktraces.Offsets()
+			batch       []Sample
+		)
+		for i := 0; i < int(rec.NumRows()); i++ {
+			s := Sample{Timestamp: int64(timestamps.Value(i)), Value: values.Value(i)}
+			for j := offsets[i]; j < offsets[i+1]; j++ {
+				s.Stacktrace = append(s.Stacktrace, dictionary.Value(names.GetValueIndex(int(j))))
+			}
+			batch = append(batch, s)
+		}
+		actual = append(actual, batch)
+	}
+	require.NoError(t, r.Err())
+	require.Equal(t, batches, actual)
+}
+
+func Test_SampleWriter_Empty(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, NewSampleWriter(&buf).Close())
+	r, err := ipc.NewReader(&buf)
+	require.NoError(t, err)
+	defer r.Release()
+	require.Equal(t, 3, len(r.Schema().Fields()))
+	require.False(t, r.Next())
+	require.NoError(t, r.Err())
+}
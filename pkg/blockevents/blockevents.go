@@ -0,0 +1,257 @@
+// Package blockevents notifies downstream systems of the lifecycle of the blocks in the object
+// storage, so data pipelines can react to new blocks without polling the bucket.
+package blockevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/backoff"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+type EventType string
+
+const (
+	BlockUploaded EventType = "uploaded"
+)
+
+// Event describes a change of a block of a tenant in the object storage.
+type Event struct {
+	Type            EventType        `json:"type"`
+	Timestamp       time.Time        `json:"timestamp"`
+	TenantID        string           `json:"tenantID"`
+	ULID            ulid.ULID        `json:"ulid"`
+	MinTime         model.Time       `json:"minTime"`
+	MaxTime         model.Time       `json:"maxTime"`
+	SizeBytes       uint64           `json:"sizeBytes"`
+	Source          block.SourceType `json:"source,omitempty"`
+	CompactionLevel int              `json:"compactionLevel"`
+}
+
+// NewEvent returns the event of the block described by the meta. The size of the block is the
+// sum of the sizes of its files.
+func NewEvent(typ EventType, tenantID string, meta *block.Meta) Event {
+	e := Event{
+		Type:            typ,
+		Timestamp:       time.Now().UTC(),
+		TenantID:        tenantID,
+		ULID:            meta.ULID,
+		MinTime:         meta.MinTime,
+		MaxTime:         meta.MaxTime,
+		Source:          meta.Source,
+		CompactionLevel: meta.Compaction.Level,
+	}
+	for _, f := range meta.Files {
+		e.SizeBytes += f.SizeBytes
+	}
+	return e
+}
+
+// Notifier is notified of the block events. Notify must not block.
+type Notifier interface {
+	Notify(Event)
+}
+
+// Nop is a Notifier ignoring the events.
+type Nop struct{}
+
+func (Nop) Notify(Event) {}
+
+type Config struct {
+	WebhookURLs flagext.StringSliceCSV `yaml:"webhook_urls"`
+	Events      flagext.StringSliceCSV `yaml:"events" category:"advanced"`
+	Timeout     time.Duration          `yaml:"timeout" category:"advanced"`
+	MaxRetries  int                    `yaml:"max_retries" category:"advanced"`
+	QueueSize   int                    `yaml:"queue_size" category:"advanced"`
+}
+
+// RegisterFlags registers the block events flags.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.Events = []string{string(BlockUploaded)}
+	f.Var(&cfg.WebhookURLs, "block-events.webhook-urls", "Comma-separated list of URLs the block events are posted to as JSON. Block events are disabled when empty.")
+	f.Var(&cfg.Events, "block-events.events", "Comma-separated list of the types of block events to post. The only type is uploaded, as the blocks are not compacted nor deleted from the object storage yet.")
+	f.DurationVar(&cfg.Timeout, "block-events.timeout", 10*time.Second, "Timeout of a webhook request.")
+	f.IntVar(&cfg.MaxRetries, "block-events.max-retries", 5, "Maximum number of retries of a failed webhook request.")
+	f.IntVar(&cfg.QueueSize, "block-events.queue-size", 1000, "Maximum number of block events waiting to be posted. Events are dropped when the queue is full.")
+}
+
+func (cfg *Config) Validate() error {
+	for _, e := range cfg.Events {
+		switch EventType(e) {
+		case BlockUploaded:
+		default:
+			return fmt.Errorf("invalid block event type %q", e)
+		}
+	}
+	if cfg.QueueSize <= 0 && len(cfg.WebhookURLs) > 0 {
+		return errors.New("block events queue size must be positive")
+	}
+	return nil
+}
+
+type metrics struct {
+	events  *prometheus.CounterVec
+	dropped prometheus.Counter
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		events: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "block_events_webhook_requests_total",
+			Help:      "Total number of block events posted to the webhooks, by type and result.",
+		}, []string{"type", "result"}),
+		dropped: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "block_events_dropped_total",
+			Help:      "Total number of block events dropped because the queue was full.",
+		}),
+	}
+}
+
+// Webhooks posts the block events to the configured URLs in the background. The events still
+// queued when the service stops are posted before it terminates, as long as the webhooks respond
+// within the timeout.
+type Webhooks struct {
+	services.Service
+
+	cfg     Config
+	client  *http.Client
+	logger  log.Logger
+	metrics *metrics
+
+	events map[EventType]bool
+	queue  chan Event
+}
+
+func NewWebhooks(cfg Config, client *http.Client, logger log.Logger, reg prometheus.Registerer) *Webhooks {
+	w := &Webhooks{
+		cfg:     cfg,
+		client:  client,
+		logger:  logger,
+		metrics: newMetrics(reg),
+		events:  make(map[EventType]bool, len(cfg.Events)),
+		queue:   make(chan Event, cfg.QueueSize),
+	}
+	for _, e := range cfg.Events {
+		w.events[EventType(e)] = true
+	}
+	w.Service = services.NewBasicService(nil, w.running, w.stopping)
+	return w
+}
+
+func (w *Webhooks) Notify(e Event) {
+	if !w.events[e.Type] {
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		w.metrics.dropped.Inc()
+		level.Warn(w.logger).Log("msg", "block events queue is full, dropping event", "type", e.Type, "tenant", e.TenantID, "block", e.ULID)
+	}
+}
+
+func (w *Webhooks) running(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-w.queue:
+			w.post(ctx, e)
+		}
+	}
+}
+
+// stopping posts the queued events, within the timeout of a single request.
+func (w *Webhooks) stopping(_ error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.cfg.Timeout)
+	defer cancel()
+	for {
+		select {
+		case e := <-w.queue:
+			w.post(ctx, e)
+		default:
+			return nil
+		}
+	}
+}
+
+// post sends the event to every URL, retrying failed requests.
+func (w *Webhooks) post(ctx context.Context, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		level.Error(w.logger).Log("msg", "failed to encode block event", "err", err)
+		return
+	}
+	for _, url := range w.cfg.WebhookURLs {
+		b := backoff.New(ctx, backoff.Config{
+			MinBackoff: 100 * time.Millisecond,
+			MaxBackoff: 10 * time.Second,
+			MaxRetries: w.cfg.MaxRetries + 1,
+		})
+		var (
+			sent bool
+			err  error
+		)
+		for b.Ongoing() {
+			var retry bool
+			if retry, err = w.send(ctx, url, body); err == nil {
+				sent = true
+				break
+			}
+			if !retry {
+				break
+			}
+			b.Wait()
+		}
+		if !sent {
+			if err == nil {
+				err = b.Err()
+			}
+			w.metrics.events.WithLabelValues(string(e.Type), "failure").Inc()
+			level.Error(w.logger).Log("msg", "failed to post block event", "url", url, "type", e.Type, "tenant", e.TenantID, "block", e.ULID, "err", err)
+			continue
+		}
+		w.metrics.events.WithLabelValues(string(e.Type), "success").Inc()
+	}
+}
+
+// send posts the body to the URL. It returns whether the request can be retried on error.
+func (w *Webhooks) send(ctx context.Context, url string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
@@ -0,0 +1,99 @@
+package blockevents
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+func Test_NewEvent(t *testing.T) {
+	meta := &block.Meta{
+		ULID:    ulid.MustNew(1, nil),
+		MinTime: 1000,
+		MaxTime: 2000,
+		Files: []block.File{
+			{RelPath: "index.tsdb", SizeBytes: 10},
+			{RelPath: "profiles.parquet", SizeBytes: 32},
+			{RelPath: block.MetaFilename},
+		},
+		Source: block.IngesterSource,
+	}
+	meta.Compaction.Level = 1
+	e := NewEvent(BlockUploaded, "tenant-a", meta)
+	require.Equal(t, uint64(42), e.SizeBytes)
+	require.Equal(t, "tenant-a", e.TenantID)
+	require.Equal(t, meta.ULID, e.ULID)
+	require.Equal(t, 1, e.CompactionLevel)
+}
+
+func Test_Webhooks(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		received []Event
+		failures = 2
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		// the first requests fail, and are retried.
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received = append(received, e)
+	}))
+	defer server.Close()
+
+	cfg := Config{}
+	flagext.DefaultValues(&cfg)
+	cfg.WebhookURLs = []string{server.URL}
+	require.NoError(t, cfg.Validate())
+	reg := prometheus.NewRegistry()
+	w := NewWebhooks(cfg, server.Client(), log.NewNopLogger(), reg)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), w))
+
+	meta := &block.Meta{ULID: ulid.MustNew(1, nil), MinTime: 1000, MaxTime: 2000}
+	w.Notify(NewEvent(BlockUploaded, "tenant-a", meta))
+	// the events of the types not enabled are not posted.
+	w.Notify(NewEvent("other", "tenant-a", meta))
+	w.Notify(NewEvent(BlockUploaded, "tenant-b", meta))
+
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(received) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), w))
+
+	require.Equal(t, BlockUploaded, received[0].Type)
+	require.Equal(t, "tenant-a", received[0].TenantID)
+	require.Equal(t, BlockUploaded, received[1].Type)
+	require.Equal(t, meta.ULID, received[1].ULID)
+	require.Equal(t, "tenant-b", received[1].TenantID)
+	require.Equal(t, 2., testutil.ToFloat64(w.metrics.events.WithLabelValues("uploaded", "success")))
+}
+
+func Test_ConfigValidate(t *testing.T) {
+	cfg := Config{}
+	flagext.DefaultValues(&cfg)
+	require.NoError(t, cfg.Validate())
+	cfg.Events = []string{"created"}
+	require.Error(t, cfg.Validate())
+}
@@ -0,0 +1,230 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/google/pprof/profile"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+const (
+	serviceName   = "phlare-canary"
+	profileName   = "process_cpu"
+	profileTypeID = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+
+	pollInterval = 500 * time.Millisecond
+)
+
+type Config struct {
+	URL      string         `yaml:"url" category:"advanced"`
+	TenantID string         `yaml:"tenant_id" category:"advanced"`
+	APIKey   flagext.Secret `yaml:"api_key" category:"advanced"`
+	Interval time.Duration  `yaml:"interval" category:"advanced"`
+	Timeout  time.Duration  `yaml:"timeout" category:"advanced"`
+}
+
+// RegisterFlags registers the canary flags.
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.URL, "canary.url", "", "URL of the Phlare API the canary pushes to and queries from. Defaults to the local server.")
+	f.StringVar(&cfg.TenantID, "canary.tenant-id", serviceName, "Tenant ID used by the canary when multitenancy is enabled.")
+	f.Var(&cfg.APIKey, "canary.api-key", "API key sent by the canary as a bearer token, required when the API keys are enabled. It must have the admin role, to push and query.")
+	f.DurationVar(&cfg.Interval, "canary.interval", 15*time.Second, "Interval between two read-after-write checks of the canary.")
+	f.DurationVar(&cfg.Timeout, "canary.timeout", 30*time.Second, "Deadline for a profile pushed by the canary to be queryable.")
+}
+
+type metrics struct {
+	checks         *prometheus.CounterVec
+	latency        prometheus.Histogram
+	lastSuccessful prometheus.Gauge
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	return &metrics{
+		checks: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "canary_checks_total",
+			Help:      "Total number of read-after-write checks of the canary, by result.",
+		}, []string{"result"}),
+		latency: promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+			Namespace: "phlare",
+			Name:      "canary_read_after_write_seconds",
+			Help:      "Time between the push of a profile by the canary and the profile being queryable.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 13),
+		}),
+		lastSuccessful: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Namespace: "phlare",
+			Name:      "canary_last_successful_check_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful read-after-write check of the canary.",
+		}),
+	}
+}
+
+// Canary periodically pushes a synthetic profile and verifies it is queryable within a deadline.
+type Canary struct {
+	services.Service
+
+	cfg     Config
+	logger  log.Logger
+	metrics *metrics
+
+	pusher  pushv1connect.PusherServiceClient
+	querier querierv1connect.QuerierServiceClient
+}
+
+func New(cfg Config, client connect.HTTPClient, logger log.Logger, reg prometheus.Registerer) *Canary {
+	interceptors := []connect.Interceptor{tenant.NewAuthInterceptor(true)}
+	if key := cfg.APIKey.String(); key != "" {
+		interceptors = append(interceptors, connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+			return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+				req.Header().Set("Authorization", "Bearer "+key)
+				return next(ctx, req)
+			}
+		}))
+	}
+	auth := connect.WithInterceptors(interceptors...)
+	c := &Canary{
+		cfg:     cfg,
+		logger:  logger,
+		metrics: newMetrics(reg),
+		pusher:  pushv1connect.NewPusherServiceClient(client, cfg.URL, auth),
+		querier: querierv1connect.NewQuerierServiceClient(client, cfg.URL, auth),
+	}
+	c.Service = services.NewTimerService(cfg.Interval, nil, c.iteration, nil)
+	return c
+}
+
+func (c *Canary) iteration(ctx context.Context) error {
+	latency, err := c.Check(ctx)
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "canary check failed", "err", err)
+		return nil
+	}
+	level.Debug(c.logger).Log("msg", "canary check succeeded", "latency", latency)
+	return nil
+}
+
+// Check pushes a synthetic profile and waits until it is queryable. It returns the time
+// between the push and the profile being queryable.
+func (c *Canary) Check(ctx context.Context) (time.Duration, error) {
+	latency, err := c.check(ctx)
+	if err != nil {
+		c.metrics.checks.WithLabelValues("failure").Inc()
+		return 0, err
+	}
+	c.metrics.checks.WithLabelValues("success").Inc()
+	c.metrics.latency.Observe(latency.Seconds())
+	c.metrics.lastSuccessful.SetToCurrentTime()
+	return latency, nil
+}
+
+func (c *Canary) check(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(tenant.InjectTenantID(ctx, c.cfg.TenantID), c.cfg.Timeout)
+	defer cancel()
+
+	// the profile is identified by its timestamp and its value.
+	ts := time.Now().Truncate(time.Millisecond)
+	value := rand.Int63n(1e9) + 1
+	raw, err := syntheticProfile(ts, value)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.pusher.Push(ctx, connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{{
+			Labels: []*typesv1.LabelPair{
+				{Name: model.MetricNameLabel, Value: profileName},
+				{Name: "service_name", Value: serviceName},
+			},
+			Samples: []*pushv1.RawSample{{RawProfile: raw}},
+		}},
+	})); err != nil {
+		return 0, fmt.Errorf("push failed: %w", err)
+	}
+	pushed := time.Now()
+
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		ProfileTypeID: profileTypeID,
+		LabelSelector: fmt.Sprintf(`{service_name="%s"}`, serviceName),
+		Start:         ts.UnixMilli(),
+		End:           ts.UnixMilli(),
+	})
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		resp, err := c.querier.SelectMergeStacktraces(ctx, req)
+		switch {
+		case err != nil:
+			lastErr = fmt.Errorf("query failed: %w", err)
+		case resp.Msg.Flamegraph != nil && resp.Msg.Flamegraph.Total == value:
+			return time.Since(pushed), nil
+		default:
+			lastErr = fmt.Errorf("profile pushed at %s not queryable", ts.Format(time.RFC3339Nano))
+		}
+		select {
+		case <-ctx.Done():
+			return 0, fmt.Errorf("deadline of %s exceeded: %w", c.cfg.Timeout, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// syntheticProfile returns a gzipped CPU profile with a single sample of the given value.
+func syntheticProfile(ts time.Time, value int64) ([]byte, error) {
+	fn := &profile.Function{ID: 1, Name: "phlare.canary", SystemName: "phlare.canary", Filename: "canary.go"}
+	loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn, Line: 1}}}
+	p := &profile.Profile{
+		SampleType:    []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        1,
+		TimeNanos:     ts.UnixNano(),
+		DurationNanos: int64(time.Second),
+		Sample:        []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+		Location:      []*profile.Location{loc},
+		Function:      []*profile.Function{fn},
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CheckHandler runs a single read-after-write check and reports its result.
+func (c *Canary) CheckHandler(w http.ResponseWriter, req *http.Request) {
+	latency, err := c.Check(req.Context())
+	result := struct {
+		Success bool    `json:"success"`
+		Latency float64 `json:"latencySeconds,omitempty"`
+		Error   string  `json:"error,omitempty"`
+	}{Success: err == nil, Latency: latency.Seconds()}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		result.Error = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		level.Error(c.logger).Log("msg", "failed to write canary check result", "err", err)
+	}
+}
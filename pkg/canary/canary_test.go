@@ -0,0 +1,106 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+)
+
+// fakeStore makes the pushed profiles queryable after the given number of queries.
+type fakeStore struct {
+	pushv1connect.UnimplementedPusherServiceHandler
+	querierv1connect.UnimplementedQuerierServiceHandler
+
+	mtx          sync.Mutex
+	queriesDelay int
+	queries      int
+	totals       map[int64]int64
+	tenants      []string
+}
+
+func (s *fakeStore) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.tenants = append(s.tenants, req.Header().Get("X-Scope-OrgID"))
+	for _, series := range req.Msg.Series {
+		for _, sample := range series.Samples {
+			p, err := profile.Parse(bytes.NewReader(sample.RawProfile))
+			if err != nil {
+				return nil, connect.NewError(connect.CodeInvalidArgument, err)
+			}
+			ts := time.Unix(0, p.TimeNanos).UnixMilli()
+			for _, sample := range p.Sample {
+				s.totals[ts] += sample.Value[0]
+			}
+		}
+	}
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func (s *fakeStore) SelectMergeStacktraces(ctx context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.queries++
+	resp := &querierv1.SelectMergeStacktracesResponse{Flamegraph: &querierv1.FlameGraph{}}
+	if s.queries > s.queriesDelay {
+		resp.Flamegraph.Total = s.totals[req.Msg.Start]
+	}
+	return connect.NewResponse(resp), nil
+}
+
+func newTestCanary(t *testing.T, store *fakeStore, timeout time.Duration) *Canary {
+	mux := http.NewServeMux()
+	mux.Handle(pushv1connect.NewPusherServiceHandler(store))
+	mux.Handle(querierv1connect.NewQuerierServiceHandler(store))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return New(Config{
+		URL:      srv.URL,
+		TenantID: "canary-tenant",
+		Interval: time.Second,
+		Timeout:  timeout,
+	}, srv.Client(), log.NewNopLogger(), prometheus.NewPedanticRegistry())
+}
+
+func Test_Check(t *testing.T) {
+	store := &fakeStore{totals: map[int64]int64{}, queriesDelay: 2}
+	c := newTestCanary(t, store, 10*time.Second)
+
+	_, err := c.Check(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 3, store.queries)
+	require.Equal(t, []string{"canary-tenant"}, store.tenants)
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.checks.WithLabelValues("success")))
+	require.Equal(t, 0.0, testutil.ToFloat64(c.metrics.checks.WithLabelValues("failure")))
+}
+
+func Test_Check_Timeout(t *testing.T) {
+	store := &fakeStore{totals: map[int64]int64{}, queriesDelay: 1000}
+	c := newTestCanary(t, store, time.Second)
+
+	_, err := c.Check(context.Background())
+	require.ErrorContains(t, err, "not queryable")
+	require.Equal(t, 1.0, testutil.ToFloat64(c.metrics.checks.WithLabelValues("failure")))
+
+	rec := httptest.NewRecorder()
+	c.CheckHandler(rec, httptest.NewRequest(http.MethodGet, "/canary/check", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), `"success":false`)
+}
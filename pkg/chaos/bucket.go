@@ -0,0 +1,145 @@
+package chaos
+
+import (
+	"context"
+	"io"
+
+	"github.com/thanos-io/objstore"
+
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+)
+
+// Bucket injects failures in the requests to the bucket: latency, errors, and reads of the
+// objects interrupted before their end.
+type Bucket struct {
+	phlareobjstore.Bucket
+	injector *Injector
+}
+
+// WrapBucket returns the bucket injecting the failures, or the bucket itself if the failures
+// aren't injected in the object storage.
+func WrapBucket(bkt phlareobjstore.Bucket, injector *Injector) phlareobjstore.Bucket {
+	if !injector.Targets(TargetObjstore) {
+		return bkt
+	}
+	return &Bucket{Bucket: bkt, injector: injector}
+}
+
+func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return err
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func (b *Bucket) Delete(ctx context.Context, name string) error {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return err
+	}
+	return b.Bucket.Delete(ctx, name)
+}
+
+func (b *Bucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return err
+	}
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+func (b *Bucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return b.partialReader(ctx, name, rc), nil
+}
+
+func (b *Bucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.GetRange(ctx, name, off, length)
+	if err != nil {
+		return nil, err
+	}
+	return b.partialReader(ctx, name, rc), nil
+}
+
+func (b *Bucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return false, err
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return objstore.ObjectAttributes{}, err
+	}
+	return b.Bucket.Attributes(ctx, name)
+}
+
+func (b *Bucket) ReaderAt(ctx context.Context, name string) (phlareobjstore.ReaderAt, error) {
+	if err := b.injector.before(ctx, TargetObjstore); err != nil {
+		return nil, err
+	}
+	r, err := b.Bucket.ReaderAt(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &readerAt{ReaderAt: r, ctx: ctx, injector: b.injector}, nil
+}
+
+// partialReader interrupts the read of the object at a random offset, if its read is chosen to
+// fail. The size of the object is unknown, the read is interrupted within its first 64KiB.
+func (b *Bucket) partialReader(ctx context.Context, name string, rc io.ReadCloser) io.ReadCloser {
+	if !b.injector.partialRead(TargetObjstore) {
+		return rc
+	}
+	size := int64(64 << 10)
+	if attrs, err := b.Bucket.Attributes(ctx, name); err == nil && attrs.Size > 0 {
+		size = attrs.Size
+	}
+	return &partialReadCloser{ReadCloser: rc, remaining: b.injector.intn(size)}
+}
+
+type partialReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *partialReadCloser) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// readerAt injects the failures in each read of the object.
+type readerAt struct {
+	phlareobjstore.ReaderAt
+	ctx      context.Context
+	injector *Injector
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.injector.before(r.ctx, TargetObjstore); err != nil {
+		return 0, err
+	}
+	if len(p) > 0 && r.injector.partialRead(TargetObjstore) {
+		n, err := r.ReaderAt.ReadAt(p[:r.injector.intn(int64(len(p)))], off)
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
@@ -0,0 +1,145 @@
+// Package chaos injects failures in the object storage and the RPCs between the components, to
+// test how a cluster copes with them. It is meant for testing environments only.
+package chaos
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/phlare/pkg/util"
+)
+
+// The targets of the failures.
+const (
+	TargetObjstore = "objstore"
+	TargetRPC      = "rpc"
+)
+
+// The faults injected.
+const (
+	faultLatency     = "latency"
+	faultError       = "error"
+	faultPartialRead = "partial_read"
+)
+
+// ErrInjected is the error of the failures injected.
+var ErrInjected = errors.New("chaos: injected failure")
+
+type Config struct {
+	Enabled                bool                   `yaml:"enabled" category:"experimental"`
+	Targets                flagext.StringSliceCSV `yaml:"targets" category:"experimental"`
+	Latency                time.Duration          `yaml:"latency" category:"experimental"`
+	LatencyProbability     float64                `yaml:"latency_probability" category:"experimental"`
+	ErrorProbability       float64                `yaml:"error_probability" category:"experimental"`
+	PartialReadProbability float64                `yaml:"partial_read_probability" category:"experimental"`
+}
+
+func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
+	cfg.Targets = []string{TargetObjstore, TargetRPC}
+	f.BoolVar(&cfg.Enabled, "chaos.enabled", false, "Inject failures in the object storage and the RPCs between the components. Only for testing environments.")
+	f.Var(&cfg.Targets, "chaos.targets", "Comma-separated list of the targets of the failures: 'objstore' and 'rpc'.")
+	f.DurationVar(&cfg.Latency, "chaos.latency", time.Second, "Maximum latency added to the requests, the latency added is random up to this value.")
+	f.Float64Var(&cfg.LatencyProbability, "chaos.latency-probability", 0, "Probability that latency is added to a request.")
+	f.Float64Var(&cfg.ErrorProbability, "chaos.error-probability", 0, "Probability that a request fails.")
+	f.Float64Var(&cfg.PartialReadProbability, "chaos.partial-read-probability", 0, "Probability that the read of an object, or of an RPC stream, is interrupted before its end.")
+}
+
+func (cfg *Config) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	for _, t := range cfg.Targets {
+		if t != TargetObjstore && t != TargetRPC {
+			return fmt.Errorf("unknown chaos target %q", t)
+		}
+	}
+	for _, p := range []float64{cfg.LatencyProbability, cfg.ErrorProbability, cfg.PartialReadProbability} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("the chaos probabilities must be between 0 and 1, got %v", p)
+		}
+	}
+	return nil
+}
+
+// Injector decides which requests fail, and how.
+type Injector struct {
+	cfg Config
+
+	mtx  sync.Mutex
+	rand *rand.Rand
+
+	injected *prometheus.CounterVec
+}
+
+// NewInjector returns the injector of the failures, nil when they are disabled.
+func NewInjector(cfg Config, reg prometheus.Registerer) *Injector {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &Injector{
+		cfg:  cfg,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+		injected: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: "phlare",
+			Name:      "chaos_injected_failures_total",
+			Help:      "The number of failures injected, by target and fault.",
+		}, []string{"target", "fault"}),
+	}
+}
+
+// Targets returns whether the failures are injected in the target.
+func (i *Injector) Targets(target string) bool {
+	return i != nil && util.StringsContain(i.cfg.Targets, target)
+}
+
+func (i *Injector) roll(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.rand.Float64() < p
+}
+
+func (i *Injector) intn(n int64) int64 {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	return i.rand.Int63n(n)
+}
+
+// before injects the latency and the error of a request, before it is sent.
+func (i *Injector) before(ctx context.Context, target string) error {
+	if i.cfg.Latency > 0 && i.roll(i.cfg.LatencyProbability) {
+		i.injected.WithLabelValues(target, faultLatency).Inc()
+		t := time.NewTimer(time.Duration(i.intn(int64(i.cfg.Latency))))
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if i.roll(i.cfg.ErrorProbability) {
+		i.injected.WithLabelValues(target, faultError).Inc()
+		return ErrInjected
+	}
+	return nil
+}
+
+// partialRead returns whether the read is interrupted.
+func (i *Injector) partialRead(target string) bool {
+	if i.roll(i.cfg.PartialReadProbability) {
+		i.injected.WithLabelValues(target, faultPartialRead).Inc()
+		return true
+	}
+	return false
+}
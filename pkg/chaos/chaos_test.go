@@ -0,0 +1,136 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+)
+
+func newInjector(cfg Config) *Injector {
+	cfg.Enabled = true
+	if cfg.Targets == nil {
+		cfg.Targets = []string{TargetObjstore, TargetRPC}
+	}
+	return NewInjector(cfg, prometheus.NewRegistry())
+}
+
+func TestDisabled(t *testing.T) {
+	i := NewInjector(Config{}, prometheus.NewRegistry())
+	require.Nil(t, i)
+	require.False(t, i.Targets(TargetObjstore))
+	require.Nil(t, NewInterceptor(i))
+
+	bkt, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+	require.Equal(t, bkt, WrapBucket(bkt, i))
+}
+
+func TestBucket(t *testing.T) {
+	ctx := context.Background()
+	fs, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	require.NoError(t, fs.Upload(ctx, "object", bytes.NewReader(data)))
+
+	// The failures are only injected in the targets.
+	bkt := WrapBucket(fs, newInjector(Config{ErrorProbability: 1, Targets: []string{TargetRPC}}))
+	_, err = bkt.Exists(ctx, "object")
+	require.NoError(t, err)
+
+	bkt = WrapBucket(fs, newInjector(Config{ErrorProbability: 1}))
+	_, err = bkt.Get(ctx, "object")
+	require.ErrorIs(t, err, ErrInjected)
+	_, err = bkt.ReaderAt(ctx, "object")
+	require.ErrorIs(t, err, ErrInjected)
+	require.ErrorIs(t, bkt.Upload(ctx, "object", bytes.NewReader(data)), ErrInjected)
+
+	bkt = WrapBucket(fs, newInjector(Config{PartialReadProbability: 1}))
+	rc, err := bkt.Get(ctx, "object")
+	require.NoError(t, err)
+	read, err := io.ReadAll(rc)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Less(t, len(read), len(data))
+	require.Equal(t, data[:len(read)], read)
+	require.NoError(t, rc.Close())
+
+	r, err := bkt.ReaderAt(ctx, "object")
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 10)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Less(t, n, len(buf))
+	require.Equal(t, data[10:10+n], buf[:n])
+	require.NoError(t, r.Close())
+}
+
+var (
+	_ phlareobjstore.Bucket = (*Bucket)(nil)
+	_ objstore.Bucket       = (*Bucket)(nil)
+)
+
+func TestInterceptor(t *testing.T) {
+	i := NewInterceptor(newInjector(Config{ErrorProbability: 1}))
+	var calls int
+	call := i.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		calls++
+		return connect.NewResponse(&ingestv1.LabelValuesResponse{}), nil
+	})
+
+	// The requests sent by the clients fail.
+	_, err := call(context.Background(), &clientRequest{connect.NewRequest(&ingestv1.LabelValuesRequest{})})
+	require.ErrorIs(t, err, ErrInjected)
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+	require.Equal(t, 0, calls)
+
+	// The requests are only failed once, by the client.
+	_, err = call(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestInterceptor_PartialStream(t *testing.T) {
+	i := NewInterceptor(newInjector(Config{PartialReadProbability: 1}))
+	conn := i.WrapStreamingClient(func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		return &endlessClientConn{}
+	})(context.Background(), connect.Spec{IsClient: true})
+
+	var err error
+	for n := 0; n <= 16 && err == nil; n++ {
+		err = conn.Receive(&ingestv1.LabelValuesResponse{})
+	}
+	require.ErrorIs(t, err, ErrInjected)
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+}
+
+// clientRequest is a request sent by a client.
+type clientRequest struct {
+	*connect.Request[ingestv1.LabelValuesRequest]
+}
+
+func (r *clientRequest) Spec() connect.Spec { return connect.Spec{IsClient: true} }
+
+// endlessClientConn is a stream which never ends.
+type endlessClientConn struct {
+	connect.StreamingClientConn
+}
+
+func (c *endlessClientConn) Receive(any) error { return nil }
+
+func TestValidate(t *testing.T) {
+	cfg := Config{Enabled: true, Targets: []string{"disk"}}
+	require.Error(t, cfg.Validate())
+	cfg = Config{Enabled: true, Targets: []string{TargetRPC}, ErrorProbability: 2}
+	require.Error(t, cfg.Validate())
+	cfg.ErrorProbability = 0.1
+	require.NoError(t, cfg.Validate())
+}
@@ -0,0 +1,86 @@
+package chaos
+
+import (
+	"context"
+
+	"github.com/bufbuild/connect-go"
+)
+
+// Interceptor injects failures in the requests sent by the clients of the components: latency,
+// errors, and streams of responses interrupted before their end. The handlers are left untouched,
+// so that each failure is injected once, even when both ends are in the same process.
+type Interceptor struct {
+	injector *Injector
+}
+
+// NewInterceptor returns the interceptor injecting the failures, nil if the failures aren't
+// injected in the RPCs.
+func NewInterceptor(injector *Injector) *Interceptor {
+	if !injector.Targets(TargetRPC) {
+		return nil
+	}
+	return &Interceptor{injector: injector}
+}
+
+func (i *Interceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if !req.Spec().IsClient {
+			return next(ctx, req)
+		}
+		if err := i.injector.before(ctx, TargetRPC); err != nil {
+			return nil, rpcError(err)
+		}
+		return next(ctx, req)
+	}
+}
+
+func (i *Interceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		conn := next(ctx, spec)
+		if err := i.injector.before(ctx, TargetRPC); err != nil {
+			return &failedClientConn{StreamingClientConn: conn, err: rpcError(err)}
+		}
+		if i.injector.partialRead(TargetRPC) {
+			return &partialClientConn{StreamingClientConn: conn, remaining: i.injector.intn(16)}
+		}
+		return conn
+	}
+}
+
+func (i *Interceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
+
+// rpcError returns the error of a request failed by the injector.
+func rpcError(err error) error {
+	switch err {
+	case context.Canceled:
+		return connect.NewError(connect.CodeCanceled, err)
+	case context.DeadlineExceeded:
+		return connect.NewError(connect.CodeDeadlineExceeded, err)
+	}
+	return connect.NewError(connect.CodeUnavailable, err)
+}
+
+// failedClientConn fails the stream before anything is sent.
+type failedClientConn struct {
+	connect.StreamingClientConn
+	err error
+}
+
+func (c *failedClientConn) Send(any) error    { return c.err }
+func (c *failedClientConn) Receive(any) error { return c.err }
+
+// partialClientConn interrupts the stream after a number of responses.
+type partialClientConn struct {
+	connect.StreamingClientConn
+	remaining int64
+}
+
+func (c *partialClientConn) Receive(msg any) error {
+	if c.remaining <= 0 {
+		return connect.NewError(connect.CodeUnavailable, ErrInjected)
+	}
+	c.remaining--
+	return c.StreamingClientConn.Receive(msg)
+}
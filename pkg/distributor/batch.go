@@ -0,0 +1,113 @@
+package distributor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/grafana/dskit/ring"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+// pushBatcher merges the series of the pushes sent to the same ingester for the same tenant
+// during the batch window into a single request, to reduce the overhead of many small pushes.
+type pushBatcher struct {
+	window      time.Duration
+	maxSize     int
+	pushTimeout time.Duration
+	send        func(ctx context.Context, ingester ring.InstanceDesc, series []*pushv1.RawProfileSeries) error
+	metrics     *metrics
+
+	mtx     sync.Mutex
+	batches map[batchKey]*pushBatch
+}
+
+type batchKey struct {
+	addr     string
+	tenantID string
+}
+
+type pushBatch struct {
+	ingester ring.InstanceDesc
+	series   []*pushv1.RawProfileSeries
+	size     int
+	timer    *time.Timer
+
+	// done is closed once the batch is sent, err is the result of the request.
+	done chan struct{}
+	err  error
+}
+
+func newPushBatcher(
+	window time.Duration,
+	maxSize int,
+	pushTimeout time.Duration,
+	send func(ctx context.Context, ingester ring.InstanceDesc, series []*pushv1.RawProfileSeries) error,
+	m *metrics,
+) *pushBatcher {
+	return &pushBatcher{
+		window:      window,
+		maxSize:     maxSize,
+		pushTimeout: pushTimeout,
+		send:        send,
+		metrics:     m,
+		batches:     map[batchKey]*pushBatch{},
+	}
+}
+
+// push adds the series to the batch of the ingester and the tenant, and waits for the batch to be
+// sent. The batch is sent at the end of the window, or as soon as its size reaches the maximum.
+// All the pushes of a batch get the result of its request.
+func (b *pushBatcher) push(ctx context.Context, ingester ring.InstanceDesc, tenantID string, series []*pushv1.RawProfileSeries) error {
+	var size int
+	for _, s := range series {
+		for _, sample := range s.Samples {
+			size += len(sample.RawProfile)
+		}
+	}
+
+	key := batchKey{addr: ingester.Addr, tenantID: tenantID}
+	b.mtx.Lock()
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &pushBatch{ingester: ingester, done: make(chan struct{})}
+		batch.timer = time.AfterFunc(b.window, func() { b.flush(key, batch) })
+		b.batches[key] = batch
+	}
+	batch.series = append(batch.series, series...)
+	batch.size += size
+	full := b.maxSize > 0 && batch.size >= b.maxSize
+	b.mtx.Unlock()
+
+	if full {
+		b.flush(key, batch)
+	}
+	select {
+	case <-batch.done:
+		return batch.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush sends the batch, unless it was already sent.
+func (b *pushBatcher) flush(key batchKey, batch *pushBatch) {
+	b.mtx.Lock()
+	if b.batches[key] != batch {
+		b.mtx.Unlock()
+		return
+	}
+	delete(b.batches, key)
+	b.mtx.Unlock()
+	batch.timer.Stop()
+
+	// The batch outlives the pushes it is made of, so it is sent with its own timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), b.pushTimeout)
+	defer cancel()
+	ctx = tenant.InjectTenantID(ctx, key.tenantID)
+	b.metrics.batchedSeries.Observe(float64(len(batch.series)))
+	batch.err = b.send(ctx, batch.ingester, batch.series)
+	close(batch.done)
+}
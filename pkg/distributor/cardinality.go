@@ -0,0 +1,233 @@
+package distributor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// labelCardinalityPeriod is the period after which the values of the labels of a tenant are
+// rotated: the counts cover the values seen during the last one to two periods, so the values
+// which are not used anymore stop counting against the limit. The tenants idle for a period are
+// forgotten.
+const labelCardinalityPeriod = time.Hour
+
+// labelCardinalityLimiter bounds the number of distinct values per label name of the series of
+// the tenants, e.g. pod names or request IDs, which would otherwise explode the number of series.
+// The hashes of the values are counted exactly: they are kept up to the limit, as the values
+// beyond it are not added.
+type labelCardinalityLimiter struct {
+	limits  Limits
+	metrics *metrics
+	now     func() time.Time
+
+	mtx       sync.Mutex
+	tenants   map[string]*tenantCardinality
+	nextSweep time.Time
+}
+
+type tenantCardinality struct {
+	mtx      sync.Mutex
+	rotation time.Time
+	labels   map[string]*labelCardinality
+}
+
+type labelCardinality struct {
+	// current has the values seen since the last rotation, previous the ones seen during the
+	// period before.
+	current  map[uint64]struct{}
+	previous map[uint64]struct{}
+	// count is the number of distinct values of both periods.
+	count int
+}
+
+func newLabelCardinality() *labelCardinality {
+	return &labelCardinality{current: map[uint64]struct{}{}, previous: map[uint64]struct{}{}}
+}
+
+func (c *labelCardinality) contains(h uint64) bool {
+	if _, ok := c.current[h]; ok {
+		return true
+	}
+	_, ok := c.previous[h]
+	return ok
+}
+
+func (c *labelCardinality) add(h uint64) {
+	if _, ok := c.current[h]; ok {
+		return
+	}
+	c.current[h] = struct{}{}
+	if _, ok := c.previous[h]; !ok {
+		c.count++
+	}
+}
+
+func newLabelCardinalityLimiter(limits Limits, m *metrics) *labelCardinalityLimiter {
+	return &labelCardinalityLimiter{
+		limits:  limits,
+		metrics: m,
+		now:     time.Now,
+		tenants: map[string]*tenantCardinality{},
+	}
+}
+
+// limit counts the values of the labels of the series. The series adding a value to a label
+// name beyond the limit of the tenant is either rejected, or has the value of the label
+// replaced by validation.OverflowProfileLabelValue. The values of the series rejected aren't
+// counted, and neither is the overflow value.
+func (l *labelCardinalityLimiter) limit(tenantID string, ls []*typesv1.LabelPair) ([]*typesv1.LabelPair, error) {
+	max := l.limits.MaxLabelValuesPerName(tenantID)
+	if max <= 0 {
+		return ls, nil
+	}
+	rewrite := l.limits.LabelValuesLimitAction(tenantID) == validation.LabelValuesLimitRewrite
+	t := l.tenant(tenantID)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rotate(l.now())
+
+	// the labels are checked before any value is counted, as the series may be rejected.
+	hashes := make([]uint64, len(ls))
+	for i, lbl := range ls {
+		if strings.HasPrefix(lbl.Name, "__") {
+			continue
+		}
+		hashes[i] = xxhash.Sum64String(lbl.Value)
+		c, ok := t.labels[lbl.Name]
+		if !ok || c.contains(hashes[i]) || c.count < max {
+			continue
+		}
+		if !rewrite {
+			return nil, validation.NewErrorf(validation.LabelValuesLimit, validation.LabelValuesLimitErrorMsg, phlaremodel.LabelPairsString(ls), max, lbl.Name)
+		}
+		l.metrics.rewrittenLabelValues.WithLabelValues(tenantID).Inc()
+		lbl.Value = validation.OverflowProfileLabelValue
+	}
+	for i, lbl := range ls {
+		if strings.HasPrefix(lbl.Name, "__") || lbl.Value == validation.OverflowProfileLabelValue {
+			continue
+		}
+		c, ok := t.labels[lbl.Name]
+		if !ok {
+			c = newLabelCardinality()
+			t.labels[lbl.Name] = c
+		}
+		c.add(hashes[i])
+	}
+	return ls, nil
+}
+
+func (t *tenantCardinality) rotate(now time.Time) {
+	if now.Before(t.rotation) {
+		return
+	}
+	// after an idle period longer than a rotation, the values are reset.
+	if now.After(t.rotation.Add(labelCardinalityPeriod)) {
+		t.labels = map[string]*labelCardinality{}
+	}
+	t.rotation = now.Add(labelCardinalityPeriod)
+	for name, c := range t.labels {
+		if len(c.current) == 0 {
+			delete(t.labels, name)
+			continue
+		}
+		c.previous = c.current
+		c.current = map[uint64]struct{}{}
+		c.count = len(c.previous)
+	}
+}
+
+func (l *labelCardinalityLimiter) tenant(tenantID string) *tenantCardinality {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep(l.now())
+	t, ok := l.tenants[tenantID]
+	if !ok {
+		t = &tenantCardinality{labels: map[string]*labelCardinality{}}
+		l.tenants[tenantID] = t
+	}
+	return t
+}
+
+// sweep forgets the tenants idle for longer than a rotation, whose values would be reset anyway.
+// It runs at most once per period.
+func (l *labelCardinalityLimiter) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = now.Add(labelCardinalityPeriod)
+	for tenantID, t := range l.tenants {
+		t.mtx.Lock()
+		idle := now.After(t.rotation.Add(labelCardinalityPeriod))
+		t.mtx.Unlock()
+		if idle {
+			delete(l.tenants, tenantID)
+		}
+	}
+}
+
+// LabelCardinality is the number of distinct values of a label name.
+type LabelCardinality struct {
+	Name   string `json:"name"`
+	Values int    `json:"values"`
+}
+
+// cardinalities returns the number of distinct values of the label names of the tenant, the
+// highest first.
+func (l *labelCardinalityLimiter) cardinalities(tenantID string) []LabelCardinality {
+	l.mtx.Lock()
+	t, ok := l.tenants[tenantID]
+	l.mtx.Unlock()
+	if !ok {
+		return []LabelCardinality{}
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rotate(l.now())
+	result := make([]LabelCardinality, 0, len(t.labels))
+	for name, c := range t.labels {
+		result = append(result, LabelCardinality{Name: name, Values: c.count})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Values != result[j].Values {
+			return result[i].Values > result[j].Values
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// LabelCardinalityResponse is the response of LabelCardinalityHandler.
+type LabelCardinalityResponse struct {
+	// Limit is the maximum number of distinct values per label name, 0 when disabled.
+	Limit  int                `json:"limit"`
+	Action string             `json:"action"`
+	Labels []LabelCardinality `json:"labels"`
+}
+
+// LabelCardinalityHandler returns the number of distinct values of the label names of the series
+// of the tenant, as counted by this distributor for its limit.
+func (d *Distributor) LabelCardinalityHandler(w http.ResponseWriter, req *http.Request) {
+	tenantID, err := tenant.ExtractTenantIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(LabelCardinalityResponse{
+		Limit:  d.limits.MaxLabelValuesPerName(tenantID),
+		Action: d.limits.LabelValuesLimitAction(tenantID),
+		Labels: d.labelCardinality.cardinalities(tenantID),
+	})
+}
@@ -0,0 +1,128 @@
+package distributor
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/grafana/dskit/services"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+)
+
+// IdempotencyKeyHeader is the header identifying a push request. Retries of the same push must
+// carry the same key. Pushes without key are identified by the hash of their payload.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// pushDeduplicator remembers the pushes successfully ingested during the deduplication window, so
+// retries of a push whose response was lost are not ingested twice. The pushes of all tenants are
+// kept in a single map, whose expired entries are pruned once per window while the service runs.
+type pushDeduplicator struct {
+	services.Service
+
+	window time.Duration
+	now    func() time.Time
+
+	mtx sync.Mutex
+	// pushes holds the expiry of the pushes ingested, and a zero time for the pushes in flight.
+	pushes map[pushID]time.Time
+}
+
+type pushID struct {
+	tenantID string
+	key      string
+}
+
+type pushStatus int
+
+const (
+	// pushReserved is the status of a push not seen yet, which must be released with done.
+	pushReserved pushStatus = iota
+	// pushInFlight is the status of a push whose ingestion has not completed yet.
+	pushInFlight
+	// pushSeen is the status of a push ingested during the deduplication window.
+	pushSeen
+)
+
+func newPushDeduplicator(window time.Duration) *pushDeduplicator {
+	d := &pushDeduplicator{
+		window: window,
+		now:    time.Now,
+		pushes: map[pushID]time.Time{},
+	}
+	d.Service = services.NewTimerService(window, nil, d.iteration, nil).WithName("push deduplicator")
+	return d
+}
+
+// reserve checks whether the push with the given key was already seen, and marks it in flight
+// otherwise, in a single step so concurrent retries of a push can't both be ingested.
+func (d *pushDeduplicator) reserve(tenantID, key string) pushStatus {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	id := pushID{tenantID: tenantID, key: key}
+	if expiry, ok := d.pushes[id]; ok {
+		if expiry.IsZero() {
+			return pushInFlight
+		}
+		if d.now().Before(expiry) {
+			return pushSeen
+		}
+	}
+	d.pushes[id] = time.Time{}
+	return pushReserved
+}
+
+// done releases a push reserved, which is remembered during the deduplication window if it was
+// ingested, and forgotten otherwise so it can be retried.
+func (d *pushDeduplicator) done(tenantID, key string, ingested bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	id := pushID{tenantID: tenantID, key: key}
+	if !ingested {
+		delete(d.pushes, id)
+		return
+	}
+	d.pushes[id] = d.now().Add(d.window)
+}
+
+func (d *pushDeduplicator) iteration(_ context.Context) error {
+	d.prune()
+	return nil
+}
+
+// prune forgets the pushes whose deduplication window has expired.
+func (d *pushDeduplicator) prune() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	now := d.now()
+	for id, expiry := range d.pushes {
+		if !expiry.IsZero() && !now.Before(expiry) {
+			delete(d.pushes, id)
+		}
+	}
+}
+
+// pushKey returns the key identifying the push: the idempotency key if any, the hash of the
+// payload otherwise.
+func pushKey(idempotencyKey string, req *pushv1.PushRequest) string {
+	if idempotencyKey != "" {
+		return idempotencyKey
+	}
+	h := xxhash.New()
+	for _, series := range req.Series {
+		for _, l := range series.Labels {
+			_, _ = h.WriteString(l.Name)
+			_, _ = h.Write([]byte{0})
+			_, _ = h.WriteString(l.Value)
+			_, _ = h.Write([]byte{0})
+		}
+		for _, sample := range series.Samples {
+			_, _ = h.Write(sample.RawProfile)
+			_, _ = h.Write([]byte{0})
+		}
+		_, _ = h.Write([]byte{1})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
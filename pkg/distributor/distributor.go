@@ -7,12 +7,14 @@ import (
 	"fmt"
 	"hash/fnv"
 	"net/http"
+	"regexp"
 	"strconv"
 	"time"
 
 	"github.com/bufbuild/connect-go"
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"github.com/google/uuid"
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/limiter"
@@ -65,8 +67,24 @@ var (
 
 // Config for a Distributor.
 type Config struct {
-	PushTimeout time.Duration
-	PoolConfig  clientpool.PoolConfig `yaml:"pool_config,omitempty"`
+	PushTimeout    time.Duration
+	PoolConfig     clientpool.PoolConfig `yaml:"pool_config,omitempty"`
+	MaxRecvMsgSize int                   `yaml:"max_recv_msg_size" category:"advanced"`
+
+	PushDeduplicationWindow time.Duration `yaml:"push_deduplication_window" category:"advanced"`
+
+	MaxInflightPushRequests int           `yaml:"max_inflight_push_requests" category:"advanced"`
+	PushQueueTimeout        time.Duration `yaml:"push_queue_timeout" category:"advanced"`
+
+	PushBatchWindow           time.Duration `yaml:"push_batch_window" category:"advanced"`
+	PushBatchMaxSizeBytes     int           `yaml:"push_batch_max_size_bytes" category:"advanced"`
+	IngesterClientCompression string        `yaml:"ingester_client_compression" category:"advanced"`
+
+	Forwarding    ForwardingConfig    `yaml:"forwarding"`
+	MetricsExport MetricsExportConfig `yaml:"metrics_export"`
+	PushCapture   PushCaptureConfig   `yaml:"push_capture"`
+
+	KubernetesEnrichment KubernetesEnrichmentConfig `yaml:"kubernetes_enrichment"`
 
 	// Distributors ring
 	DistributorRing RingConfig `yaml:"ring" doc:"hidden"`
@@ -76,9 +94,42 @@ type Config struct {
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	cfg.PoolConfig.RegisterFlagsWithPrefix("distributor", fs)
 	fs.DurationVar(&cfg.PushTimeout, "distributor.push.timeout", 5*time.Second, "Timeout when pushing data to ingester.")
+	fs.IntVar(&cfg.MaxRecvMsgSize, "distributor.max-recv-msg-size", 100<<20, "Maximum size of a push request body in bytes. Larger requests are rejected with 413 while they are being received. 0 to disable.")
+	fs.DurationVar(&cfg.PushDeduplicationWindow, "distributor.push-deduplication-window", 0, "Period during which the pushes successfully ingested are remembered, so retried pushes are acknowledged without being ingested twice. Pushes are identified by their "+IdempotencyKeyHeader+" header, or by the hash of their payload when the header is missing. The retries received while the push is still in progress are rejected with 409. 0 to disable.")
+	fs.IntVar(&cfg.MaxInflightPushRequests, "distributor.instance-max-inflight-push-requests", 0, "Maximum number of push requests processed at the same time by the distributor, across all the tenants. Pushes exceeding the limit wait for up to -distributor.push-queue-timeout, then are rejected with 429. 0 to disable.")
+	fs.DurationVar(&cfg.PushQueueTimeout, "distributor.push-queue-timeout", 0, "Maximum time a push waits for the in-flight push limits before being rejected with 429. 0 to reject the pushes exceeding the limits immediately.")
+	fs.DurationVar(&cfg.PushBatchWindow, "distributor.push-batch-window", 0, "Period during which the series pushed to the same ingester for the same tenant are batched into a single request. Batching reduces the overhead of many small pushes, at the cost of a higher push latency. 0 to disable.")
+	fs.IntVar(&cfg.PushBatchMaxSizeBytes, "distributor.push-batch-max-size-bytes", 4<<20, "Size of the profiles of a batch from which it is sent to the ingester before the end of the batch window. 0 for no limit.")
+	fs.StringVar(&cfg.IngesterClientCompression, "distributor.ingester-client-compression", "", "Compression of the requests sent to the ingesters. Supported values: 'gzip' and '' (disable compression).")
+	cfg.Forwarding.RegisterFlags(fs)
+	cfg.MetricsExport.RegisterFlags(fs)
+	cfg.PushCapture.RegisterFlags(fs)
+	cfg.KubernetesEnrichment.RegisterFlags(fs)
 	cfg.DistributorRing.RegisterFlags(fs)
 }
 
+// Validate validates the distributor config.
+func (cfg *Config) Validate() error {
+	switch cfg.IngesterClientCompression {
+	case "", "gzip":
+	default:
+		return fmt.Errorf("unsupported ingester client compression: %q", cfg.IngesterClientCompression)
+	}
+	if err := cfg.PoolConfig.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Forwarding.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.MetricsExport.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.PushCapture.Validate(); err != nil {
+		return err
+	}
+	return cfg.KubernetesEnrichment.Validate()
+}
+
 // Distributor coordinates replicates and distribution of log streams.
 type Distributor struct {
 	services.Service
@@ -96,6 +147,23 @@ type Distributor struct {
 	healthyInstancesCount  *atomic.Uint32
 	ingestionRateLimiter   *limiter.RateLimiter
 
+	// deduplicator is nil when the deduplication of pushes is disabled.
+	deduplicator *pushDeduplicator
+	// forwarder is nil when the forwarding of pushes is disabled.
+	forwarder *forwarder
+	// pushCapture is nil when the capture of the pushes is disabled.
+	pushCapture *pushCapturer
+	// kubernetes is nil when the enrichment of the series from the Kubernetes API is disabled.
+	kubernetes *kubernetesEnricher
+	// metricsExporter is nil when the export of metrics is disabled.
+	metricsExporter *metricsExporter
+	inflight        *inflightLimiter
+	// batcher is nil when the batching of pushes is disabled.
+	batcher     *pushBatcher
+	labelValues *pprofLabelValuesLimiter
+	// labelCardinality limits the distinct values per label name of the series.
+	labelCardinality *labelCardinalityLimiter
+
 	subservices        *services.Manager
 	subservicesWatcher *services.FailureWatcher
 
@@ -108,9 +176,29 @@ type Limits interface {
 	MaxLabelNameLength(userID string) int
 	MaxLabelValueLength(userID string) int
 	MaxLabelNamesPerSeries(userID string) int
+	MaxProfileSizeBytes(userID string) int
+	MaxInflightPushRequests(tenantID string) int
+	ProfileTypeEnabled(tenantID, name string) bool
+	CreationGracePeriod(tenantID string) time.Duration
+	FutureTimestampsAction(tenantID string) string
+	MaxProfileStacktraceDepth(userID string) int
+	IngestionDropFrames(userID string) (*regexp.Regexp, error)
+	NormalizeGoSymbols(userID string) bool
+	CanonicalizeSampleTypes(userID string) bool
+	MaxFunctionNameLength(userID string) int
+	DetectRuntimeLabels(tenantID string) bool
+	SanitizeLabelNames(userID string) bool
+	MaxProfileLabelValues(tenantID string) int
+	MaxLabelValuesPerName(tenantID string) int
+	LabelValuesLimitAction(tenantID string) string
+	RejectMalformedSymbols(tenantID string) bool
+	IngestionReplicationFactor(tenantID string) int
 }
 
 func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, limits Limits, reg prometheus.Registerer, logger log.Logger, clientsOptions ...connect.ClientOption) (*Distributor, error) {
+	if cfg.IngesterClientCompression == "gzip" {
+		clientsOptions = append(clientsOptions, connect.WithSendGzip())
+	}
 	d := &Distributor{
 		cfg:                   cfg,
 		logger:                logger,
@@ -120,10 +208,45 @@ func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactor
 		healthyInstancesCount: atomic.NewUint32(0),
 		limits:                limits,
 	}
+	if cfg.PushDeduplicationWindow > 0 {
+		d.deduplicator = newPushDeduplicator(cfg.PushDeduplicationWindow)
+	}
+	d.inflight = newInflightLimiter(cfg.MaxInflightPushRequests, cfg.PushQueueTimeout, limits, d.metrics)
+	d.labelValues = newPprofLabelValuesLimiter(limits, d.metrics)
+	d.labelCardinality = newLabelCardinalityLimiter(limits, d.metrics)
+	if cfg.PushBatchWindow > 0 {
+		d.batcher = newPushBatcher(cfg.PushBatchWindow, cfg.PushBatchMaxSizeBytes, cfg.PushTimeout, d.pushSeries, d.metrics)
+	}
 	var err error
+	if cfg.Forwarding.URL != "" {
+		if d.forwarder, err = newForwarder(cfg.Forwarding, http.DefaultClient, d.metrics, logger); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PushCapture.Dir != "" {
+		if d.pushCapture, err = newPushCapturer(cfg.PushCapture, logger); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.KubernetesEnrichment.Enabled {
+		client, err := newKubernetesClient(cfg.KubernetesEnrichment.Kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		d.kubernetes = newKubernetesEnricher(cfg.KubernetesEnrichment, client, d.metrics, logger)
+	}
 
 	subservices := []services.Service(nil)
 	subservices = append(subservices, d.pool)
+	if d.deduplicator != nil {
+		subservices = append(subservices, d.deduplicator)
+	}
+	if cfg.MetricsExport.RemoteWriteURL != "" {
+		if d.metricsExporter, err = newMetricsExporter(cfg.MetricsExport, cfg.DistributorRing.InstanceID, http.DefaultClient, d.metrics, logger); err != nil {
+			return nil, err
+		}
+		subservices = append(subservices, d.metricsExporter)
+	}
 
 	distributorsRing, distributorsLifecycler, err := newRingAndLifecycler(cfg.DistributorRing, d.healthyInstancesCount, logger, reg)
 	if err != nil {
@@ -162,29 +285,115 @@ func (d *Distributor) running(ctx context.Context) error {
 }
 
 func (d *Distributor) stopping(_ error) error {
+	if d.forwarder != nil {
+		d.forwarder.stop()
+	}
+	if d.pushCapture != nil {
+		if err := d.pushCapture.close(); err != nil {
+			level.Warn(d.logger).Log("msg", "failed to close push capture", "err", err)
+		}
+	}
 	return services.StopManagerAndAwaitStopped(context.Background(), d.subservices)
 }
 
 func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	resp, err := d.push(ctx, req)
+	if err != nil {
+		logPushError(ctx, d.logger, err)
+	}
+	return resp, err
+}
+
+// logPushError logs a failed push with its tenant and trace. The pushes rejected for a known
+// reason, already counted by the discarded metrics, are only logged at debug level.
+func logPushError(ctx context.Context, logger log.Logger, err error) {
+	tenantID, _ := tenant.ExtractTenantIDFromContext(ctx)
+	reason := validation.ReasonOf(err)
+	lvl := level.Warn
+	if reason != validation.Unknown {
+		lvl = level.Debug
+	}
+	lvl(util.LoggerWithTraceContext(ctx, logger)).Log("msg", "push failed", "tenant", tenantID, "reason", reason, "err", err)
+}
+
+func (d *Distributor) push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
 	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
 	if err != nil {
 		return nil, connect.NewError(connect.CodeUnauthenticated, err)
 	}
+	// the pushes are captured as received, before they are validated and rewritten.
+	if d.pushCapture != nil {
+		d.pushCapture.capture(tenantID, req.Msg)
+	}
+	release, err := d.inflight.acquire(ctx, tenantID)
+	if err != nil {
+		var profiles, bytes int
+		for _, series := range req.Msg.Series {
+			for _, raw := range series.Samples {
+				profiles++
+				bytes += len(raw.RawProfile)
+			}
+		}
+		validation.DiscardedProfiles.WithLabelValues(string(validation.InflightLimit), tenantID).Add(float64(profiles))
+		validation.DiscardedBytes.WithLabelValues(string(validation.InflightLimit), tenantID).Add(float64(bytes))
+		return nil, connect.NewError(connect.CodeResourceExhausted, err)
+	}
+	defer release()
+	// the profiles pushed as trees are converted to pprof, the format of the rest of the push.
+	if err := d.convertTrees(tenantID, req.Msg.Series); err != nil {
+		return nil, err
+	}
+	// the key is computed before the profiles are rewritten.
+	var ingested bool
+	if d.deduplicator != nil {
+		pushKeyStr := pushKey(req.Header().Get(IdempotencyKeyHeader), req.Msg)
+		switch d.deduplicator.reserve(tenantID, pushKeyStr) {
+		case pushSeen:
+			d.metrics.deduplicatedPushes.WithLabelValues(tenantID).Inc()
+			return connect.NewResponse(&pushv1.PushResponse{}), nil
+		case pushInFlight:
+			// the push can't be acknowledged before the ingestion in flight succeeds.
+			return nil, connect.NewError(connect.CodeAborted, fmt.Errorf("a push with the same key is in progress, retry later"))
+		}
+		defer func() { d.deduplicator.done(tenantID, pushKeyStr, ingested) }()
+	}
+	// the series of the profile types disabled are dropped, and the push succeeds so that they
+	// aren't retried.
+	if req.Msg.Series = d.dropDisabledProfileTypes(tenantID, req.Msg.Series); len(req.Msg.Series) == 0 {
+		return connect.NewResponse(&pushv1.PushResponse{}), nil
+	}
+	var forwardReq *pushv1.PushRequest
+	if d.forwarder != nil {
+		forwardReq = d.forwarder.request(req.Msg)
+	}
 	var (
+		exportIncrements           []counterIncrement
 		keys                       = make([]uint32, 0, len(req.Msg.Series))
 		profiles                   = make([]*profileTracker, 0, len(req.Msg.Series))
 		totalPushUncompressedBytes int64
 		totalProfiles              int64
+		maxDepth                   = d.limits.MaxProfileStacktraceDepth(tenantID)
+		normalizeGoSymbols         = d.limits.NormalizeGoSymbols(tenantID)
+		canonicalizeSampleTypes    = d.limits.CanonicalizeSampleTypes(tenantID)
+		maxFunctionNameLength      = d.limits.MaxFunctionNameLength(tenantID)
+		detectRuntimeLabels        = d.limits.DetectRuntimeLabels(tenantID)
+		sanitizeLabelNames         = d.limits.SanitizeLabelNames(tenantID)
+		rejectMalformedSymbols     = d.limits.RejectMalformedSymbols(tenantID)
+		creationGracePeriod        = d.limits.CreationGracePeriod(tenantID)
+		clampFutureTimestamps      = d.limits.FutureTimestampsAction(tenantID) == validation.FutureTimestampsClamp
+		now                        = time.Now()
 	)
+	dropFrames, err := d.limits.IngestionDropFrames(tenantID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
 
 	for _, series := range req.Msg.Series {
-		// include the labels in the size calculation
-		for _, lbs := range series.Labels {
-			totalPushUncompressedBytes += int64(len(lbs.Name))
-			totalPushUncompressedBytes += int64(len(lbs.Value))
+		if sanitizeLabelNames {
+			series.Labels = validation.SanitizeLabelNames(series.Labels, d.limits.MaxLabelNameLength(tenantID))
 		}
-		keys = append(keys, TokenFor(tenantID, labelsString(series.Labels)))
 		profName := phlaremodel.Labels(series.Labels).Get(scrape.ProfileName)
+		var runtime pprof.Runtime
 		for _, raw := range series.Samples {
 			usagestats.NewCounter(fmt.Sprintf("distributor_profile_type_%s_received", profName)).Inc(1)
 			profileReceivedStats.Inc(1)
@@ -192,14 +401,68 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 			bytesReceivedStats.Record(float64(len(raw.RawProfile)))
 			totalProfiles++
 			d.metrics.receivedCompressedBytes.WithLabelValues(profName, tenantID).Observe(float64(len(raw.RawProfile)))
-			p, err := pprof.RawFromBytes(raw.RawProfile)
+			maxProfileSize := d.limits.MaxProfileSizeBytes(tenantID)
+			p, err := pprof.RawFromBytesWithLimit(raw.RawProfile, int64(maxProfileSize))
+			if errors.Is(err, pprof.ErrDecompressedSizeLimitExceeded) {
+				return nil, profileSizeLimitError(tenantID, series.Labels, len(raw.RawProfile), maxProfileSize)
+			}
 			if err != nil {
 				return nil, connect.NewError(connect.CodeInvalidArgument, err)
 			}
 			d.metrics.receivedDecompressedBytes.WithLabelValues(profName, tenantID).Observe(float64(p.SizeBytes()))
 			d.metrics.receivedSamples.WithLabelValues(profName, tenantID).Observe(float64(len(p.Sample)))
 			totalPushUncompressedBytes += int64(p.SizeBytes())
+			if repairs := p.RepairSymbols(); repairs.Total() > 0 {
+				repairs.Each(func(kind string, n int) {
+					if n > 0 {
+						d.metrics.repairedSymbols.WithLabelValues(tenantID, kind).Add(float64(n))
+					}
+				})
+				if rejectMalformedSymbols {
+					validation.DiscardedProfiles.WithLabelValues(string(validation.MalformedSymbols), tenantID).Add(float64(1))
+					validation.DiscardedBytes.WithLabelValues(string(validation.MalformedSymbols), tenantID).Add(float64(len(raw.RawProfile)))
+					p.Close()
+					return nil, connect.NewError(connect.CodeInvalidArgument,
+						validation.NewErrorf(validation.MalformedSymbols, validation.MalformedSymbolsErrorMsg, phlaremodel.LabelPairsString(series.Labels), repairs.Total()),
+					)
+				}
+			}
+			if creationGracePeriod > 0 && p.TimeNanos > now.Add(creationGracePeriod).UnixNano() {
+				if !clampFutureTimestamps {
+					validation.DiscardedProfiles.WithLabelValues(string(validation.TooFarInFuture), tenantID).Add(float64(1))
+					validation.DiscardedBytes.WithLabelValues(string(validation.TooFarInFuture), tenantID).Add(float64(len(raw.RawProfile)))
+					err := validation.NewErrorf(validation.TooFarInFuture, validation.TooFarInFutureErrorMsg, phlaremodel.LabelPairsString(series.Labels), time.Unix(0, p.TimeNanos).UTC().Format(time.RFC3339), creationGracePeriod)
+					p.Close()
+					return nil, connect.NewError(connect.CodeInvalidArgument, err)
+				}
+				d.metrics.clampedTimestamps.WithLabelValues(tenantID).Inc()
+				p.TimeNanos = now.UnixNano()
+			}
+			if detectRuntimeLabels && runtime == (pprof.Runtime{}) {
+				runtime = p.DetectRuntime()
+			}
+			if normalizeGoSymbols {
+				p.NormalizeGoSymbols()
+			}
+			if canonicalizeSampleTypes {
+				if err := validation.ValidateSampleTypes(series.Labels, p.Profile); err != nil {
+					validation.DiscardedProfiles.WithLabelValues(string(validation.InvalidSampleType), tenantID).Add(float64(1))
+					validation.DiscardedBytes.WithLabelValues(string(validation.InvalidSampleType), tenantID).Add(float64(len(raw.RawProfile)))
+					p.Close()
+					return nil, connect.NewError(connect.CodeInvalidArgument, err)
+				}
+				p.CanonicalizeSampleTypes()
+			}
+			p.RemoveFrames(dropFrames)
+			if n := p.TruncateFunctionNames(maxFunctionNameLength); n > 0 {
+				d.metrics.truncatedFunctionNames.WithLabelValues(tenantID).Add(float64(n))
+			}
+			p.TruncateStacktraces(maxDepth)
+			d.labelValues.limit(tenantID, p)
 			p.Normalize()
+			if d.metricsExporter != nil {
+				exportIncrements = d.metricsExporter.observe(tenantID, series.Labels, p.Profile, exportIncrements)
+			}
 
 			// zip the data back into the buffer
 			bw := bytes.NewBuffer(raw.RawProfile[:0])
@@ -211,6 +474,21 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 			// generate a unique profile ID before pushing.
 			raw.ID = uuid.NewString()
 		}
+		if detectRuntimeLabels {
+			series.Labels = addRuntimeLabels(series.Labels, runtime)
+		}
+		series.Labels = d.kubernetes.enrich(series.Labels)
+		if series.Labels, err = d.labelCardinality.limit(tenantID, series.Labels); err != nil {
+			validation.DiscardedProfiles.WithLabelValues(string(validation.LabelValuesLimit), tenantID).Add(float64(totalProfiles))
+			validation.DiscardedBytes.WithLabelValues(string(validation.LabelValuesLimit), tenantID).Add(float64(totalPushUncompressedBytes))
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		// include the labels in the size calculation
+		for _, lbs := range series.Labels {
+			totalPushUncompressedBytes += int64(len(lbs.Name))
+			totalPushUncompressedBytes += int64(len(lbs.Value))
+		}
+		keys = append(keys, TokenFor(tenantID, labelsString(series.Labels)))
 		profiles = append(profiles, &profileTracker{profile: series})
 	}
 
@@ -242,6 +520,10 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 		if err != nil {
 			return nil, err
 		}
+		replicationSet, err = util.WriteReplicationSetForTenant(replicationSet, d.ingestersRing.ReplicationFactor(), d.limits.IngestionReplicationFactor(tenantID))
+		if err != nil {
+			return nil, err
+		}
 		profiles[i].minSuccess = len(replicationSet.Instances) - replicationSet.MaxErrors
 		profiles[i].maxFailures = replicationSet.MaxErrors
 		for _, ingester := range replicationSet.Instances {
@@ -270,12 +552,77 @@ func (d *Distributor) Push(ctx context.Context, req *connect.Request[pushv1.Push
 	case err := <-tracker.err:
 		return nil, err
 	case <-tracker.done:
+		ingested = true
+		if forwardReq != nil {
+			d.forwarder.forward(tenantID, forwardReq)
+		}
+		if d.metricsExporter != nil {
+			d.metricsExporter.add(exportIncrements)
+		}
 		return connect.NewResponse(&pushv1.PushResponse{}), nil
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
 }
 
+// dropDisabledProfileTypes returns the series whose profile types are enabled for the tenant.
+func (d *Distributor) dropDisabledProfileTypes(tenantID string, series []*pushv1.RawProfileSeries) []*pushv1.RawProfileSeries {
+	result := series[:0]
+	for _, s := range series {
+		if d.limits.ProfileTypeEnabled(tenantID, phlaremodel.Labels(s.Labels).Get(scrape.ProfileName)) {
+			result = append(result, s)
+			continue
+		}
+		var bytes int
+		for _, raw := range s.Samples {
+			bytes += len(raw.RawProfile)
+		}
+		validation.DiscardedProfiles.WithLabelValues(string(validation.ProfileTypeDisabled), tenantID).Add(float64(len(s.Samples)))
+		validation.DiscardedBytes.WithLabelValues(string(validation.ProfileTypeDisabled), tenantID).Add(float64(bytes))
+	}
+	return result
+}
+
+// convertTrees converts the profiles pushed in the tree format to pprof.
+func (d *Distributor) convertTrees(tenantID string, series []*pushv1.RawProfileSeries) error {
+	maxProfileSize := d.limits.MaxProfileSizeBytes(tenantID)
+	for _, s := range series {
+		for _, raw := range s.Samples {
+			if raw.Tree == nil {
+				continue
+			}
+			if len(raw.RawProfile) > 0 {
+				return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("profile with labels '%s' has both a raw profile and a tree", phlaremodel.LabelPairsString(s.Labels)))
+			}
+			p, err := pprof.FromTree(raw.Tree, int64(maxProfileSize))
+			if errors.Is(err, pprof.ErrDecompressedSizeLimitExceeded) {
+				return profileSizeLimitError(tenantID, s.Labels, raw.Tree.SizeVT(), maxProfileSize)
+			}
+			if err != nil {
+				return connect.NewError(connect.CodeInvalidArgument, err)
+			}
+			if raw.RawProfile, err = p.MarshalVT(); err != nil {
+				return connect.NewError(connect.CodeInternal, err)
+			}
+			raw.Tree = nil
+		}
+	}
+	return nil
+}
+
+// profileSizeLimitError discards a profile which exceeds the size limit once decompressed or
+// converted to pprof. The reason is sent in the RejectReasonHeader of the connect error, so
+// PushHTTPStatusMiddleware can answer with 413.
+func profileSizeLimitError(tenantID string, labels []*typesv1.LabelPair, bytes, maxProfileSize int) error {
+	validation.DiscardedProfiles.WithLabelValues(string(validation.ProfileSizeLimit), tenantID).Add(float64(1))
+	validation.DiscardedBytes.WithLabelValues(string(validation.ProfileSizeLimit), tenantID).Add(float64(bytes))
+	err := connect.NewError(connect.CodeResourceExhausted,
+		validation.NewErrorf(validation.ProfileSizeLimit, validation.ProfileSizeLimitErrorMsg, phlaremodel.LabelPairsString(labels), maxProfileSize),
+	)
+	err.Meta().Set(RejectReasonHeader, string(validation.ProfileSizeLimit))
+	return err
+}
+
 func (d *Distributor) sendProfiles(ctx context.Context, ingester ring.InstanceDesc, profileTrackers []*profileTracker, pushTracker *pushTracker) {
 	err := d.sendProfilesErr(ctx, ingester, profileTrackers)
 	// If we succeed, decrement each sample's pending count by one.  If we reach
@@ -307,20 +654,27 @@ func (d *Distributor) sendProfiles(ctx context.Context, ingester ring.InstanceDe
 }
 
 func (d *Distributor) sendProfilesErr(ctx context.Context, ingester ring.InstanceDesc, profileTrackers []*profileTracker) error {
-	c, err := d.pool.GetClientFor(ingester.Addr)
-	if err != nil {
-		return err
+	series := make([]*pushv1.RawProfileSeries, 0, len(profileTrackers))
+	for _, p := range profileTrackers {
+		series = append(series, p.profile)
 	}
 
-	req := connect.NewRequest(&pushv1.PushRequest{
-		Series: make([]*pushv1.RawProfileSeries, 0, len(profileTrackers)),
-	})
-
-	for _, p := range profileTrackers {
-		req.Msg.Series = append(req.Msg.Series, p.profile)
+	if d.batcher != nil {
+		tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+		if err != nil {
+			return err
+		}
+		return d.batcher.push(ctx, ingester, tenantID, series)
 	}
+	return d.pushSeries(ctx, ingester, series)
+}
 
-	_, err = c.(PushClient).Push(ctx, req)
+func (d *Distributor) pushSeries(ctx context.Context, ingester ring.InstanceDesc, series []*pushv1.RawProfileSeries) error {
+	c, err := d.pool.GetClientFor(ingester.Addr)
+	if err != nil {
+		return err
+	}
+	_, err = c.(PushClient).Push(ctx, connect.NewRequest(&pushv1.PushRequest{Series: series}))
 	return err
 }
 
@@ -3,30 +3,47 @@ package distributor
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/bufbuild/connect-go"
+	"github.com/cespare/xxhash/v2"
 	"github.com/dustin/go-humanize"
 	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/ring/client"
 	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
 	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	phlarepprof "github.com/grafana/phlare/pkg/pprof"
+	pproftesthelper "github.com/grafana/phlare/pkg/pprof/testhelper"
 	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/testhelper"
 	"github.com/grafana/phlare/pkg/validation"
@@ -78,6 +95,559 @@ func Test_ConnectPush(t *testing.T) {
 	require.Equal(t, 3, len(ing.requests[0].Series))
 }
 
+func Test_PushDeduplication(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing:         ringConfig,
+		PushDeduplicationWindow: time.Minute,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	// the distributor rewrites the profiles in place.
+	profile := testProfile(t)
+	push := func(tenantID, idempotencyKey, service string) {
+		req := connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels: []*typesv1.LabelPair{
+						{Name: "service_name", Value: service},
+						{Name: "__name__", Value: "cpu"},
+					},
+					Samples: []*pushv1.RawSample{{RawProfile: append([]byte(nil), profile...)}},
+				},
+			},
+		})
+		req.Header().Set(IdempotencyKeyHeader, idempotencyKey)
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), tenantID), req)
+		require.NoError(t, err)
+	}
+
+	// identical payloads are deduplicated.
+	push("foo", "", "a")
+	push("foo", "", "a")
+	require.Len(t, ing.requests, 1)
+	// but not across tenants.
+	push("bar", "", "a")
+	require.Len(t, ing.requests, 2)
+	// pushes with the same idempotency key are deduplicated.
+	push("foo", "key-1", "b")
+	push("foo", "key-1", "c")
+	require.Len(t, ing.requests, 3)
+	push("foo", "key-2", "c")
+	require.Len(t, ing.requests, 4)
+}
+
+func Test_PushDeduplicator(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newPushDeduplicator(time.Minute)
+	d.now = func() time.Time { return now }
+
+	// concurrent retries of a push in flight are not deduplicated before it is ingested.
+	require.Equal(t, pushReserved, d.reserve("foo", "a"))
+	require.Equal(t, pushInFlight, d.reserve("foo", "a"))
+	require.Equal(t, pushReserved, d.reserve("bar", "a"))
+	d.done("foo", "a", true)
+	require.Equal(t, pushSeen, d.reserve("foo", "a"))
+	// the pushes which failed can be retried.
+	d.done("bar", "a", false)
+	require.Equal(t, pushReserved, d.reserve("bar", "a"))
+
+	// the pushes are forgotten once the window has expired, whatever their tenant.
+	now = now.Add(time.Minute)
+	d.prune()
+	require.Len(t, d.pushes, 1)
+	require.Equal(t, pushInFlight, d.reserve("bar", "a"))
+	require.Equal(t, pushReserved, d.reserve("foo", "a"))
+}
+
+func Test_DisabledProfileTypes(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.IngestionDisabledProfileTypes = []string{"mutex", "block"}
+		tenantLimits["user-1"] = l
+		l = validation.MockDefaultLimits()
+		l.IngestionEnabledProfileTypes = []string{"process_cpu", "memory"}
+		tenantLimits["user-2"] = l
+	})
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, overrides, nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(tenantID string, names ...string) []string {
+		ing.requests = nil
+		req := &pushv1.PushRequest{}
+		for _, name := range names {
+			req.Series = append(req.Series, &pushv1.RawProfileSeries{
+				Labels:  []*typesv1.LabelPair{{Name: "__name__", Value: name}},
+				Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+			})
+		}
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(req))
+		require.NoError(t, err)
+		// the series are replicated to the same ingester.
+		var pushed []string
+		for _, r := range ing.requests {
+			for _, s := range r.Series {
+				name := phlaremodel.Labels(s.Labels).Get("__name__")
+				if len(pushed) == 0 || pushed[len(pushed)-1] != name {
+					pushed = append(pushed, name)
+				}
+			}
+		}
+		return pushed
+	}
+
+	require.Equal(t, []string{"process_cpu", "goroutine"}, push("user-1", "process_cpu", "mutex", "goroutine", "block"))
+	require.Equal(t, []string{"process_cpu", "memory"}, push("user-2", "process_cpu", "mutex", "memory", "goroutine"))
+	// the pushes of disabled profile types only succeed without reaching the ingesters.
+	require.Empty(t, push("user-1", "mutex"))
+	require.Equal(t, []string{"mutex"}, push("user-3", "mutex"))
+}
+
+func Test_FutureTimestamps(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.CreationGracePeriod = model.Duration(time.Hour)
+		tenantLimits["user-1"] = l
+		l = validation.MockDefaultLimits()
+		l.CreationGracePeriod = model.Duration(time.Hour)
+		l.FutureTimestampsAction = validation.FutureTimestampsClamp
+		tenantLimits["user-2"] = l
+	})
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, overrides, nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(tenantID string, ts time.Time) (int64, error) {
+		ing.requests = nil
+		p, err := phlarepprof.RawFromBytes(testProfile(t))
+		require.NoError(t, err)
+		p.TimeNanos = ts.UnixNano()
+		var buf bytes.Buffer
+		_, err = p.WriteTo(&buf)
+		require.NoError(t, err)
+		_, err = d.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{{
+				Labels:  []*typesv1.LabelPair{{Name: "__name__", Value: "memory"}},
+				Samples: []*pushv1.RawSample{{RawProfile: buf.Bytes()}},
+			}},
+		}))
+		if err != nil {
+			return 0, err
+		}
+		pushed, err := phlarepprof.RawFromBytes(ing.requests[0].Series[0].Samples[0].RawProfile)
+		require.NoError(t, err)
+		return pushed.TimeNanos, nil
+	}
+
+	now := time.Now()
+	ts, err := push("user-1", now.Add(30*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, now.Add(30*time.Minute).UnixNano(), ts)
+
+	_, err = push("user-1", time.Date(2106, time.January, 1, 0, 0, 0, 0, time.UTC))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	require.Contains(t, err.Error(), "2106-01-01T00:00:00Z")
+
+	ts, err = push("user-2", time.Date(2106, time.January, 1, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), time.Unix(0, ts), time.Minute)
+}
+
+func Test_PushTree(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(sample *pushv1.RawSample) error {
+		ing.requests = nil
+		_, err := d.Push(tenant.InjectTenantID(context.Background(), "user-1"), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{{
+				Labels:  []*typesv1.LabelPair{{Name: "__name__", Value: "process_cpu"}},
+				Samples: []*pushv1.RawSample{sample},
+			}},
+		}))
+		return err
+	}
+	tree := &pushv1.TreeProfile{
+		StringTable: []string{"", "cpu", "nanoseconds", "main", "work"},
+		SampleType:  1,
+		SampleUnit:  2,
+		TimeNanos:   time.Now().UnixNano(),
+		Nodes: []*pushv1.TreeNode{
+			{Name: 3, Self: 1},
+			{Parent: 1, Name: 4, Self: 2},
+		},
+	}
+	require.NoError(t, push(&pushv1.RawSample{Tree: tree}))
+	raw := ing.requests[0].Series[0].Samples[0]
+	require.Nil(t, raw.Tree)
+	p, err := phlarepprof.RawFromBytes(raw.RawProfile)
+	require.NoError(t, err)
+	require.Len(t, p.Sample, 2)
+	require.Equal(t, "cpu", p.StringTable[p.SampleType[0].Type])
+
+	err = push(&pushv1.RawSample{Tree: &pushv1.TreeProfile{StringTable: []string{"main"}}})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	err = push(&pushv1.RawSample{Tree: tree, RawProfile: testProfile(t)})
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func Test_Forwarding(t *testing.T) {
+	target := newFakeIngester(t, false)
+	var headers []http.Header
+	mux := http.NewServeMux()
+	path, handler := pushv1connect.NewPusherServiceHandler(target)
+	mux.Handle(path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		handler.ServeHTTP(w, r)
+	}))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+		Forwarding: ForwardingConfig{
+			URL:         s.URL,
+			TenantID:    "target",
+			BearerToken: flagext.SecretWithValue("token"),
+			Selector:    `{service_name="forwarded"}`,
+			Timeout:     time.Second,
+			MaxInFlight: 1,
+		},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	profile := testProfile(t)
+	_, err = d.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels: []*typesv1.LabelPair{
+					{Name: "service_name", Value: "forwarded"},
+					{Name: "__name__", Value: "cpu"},
+				},
+				Samples: []*pushv1.RawSample{{RawProfile: append([]byte(nil), profile...)}},
+			},
+			{
+				Labels: []*typesv1.LabelPair{
+					{Name: "service_name", Value: "other"},
+					{Name: "__name__", Value: "cpu"},
+				},
+				Samples: []*pushv1.RawSample{{RawProfile: append([]byte(nil), profile...)}},
+			},
+		},
+	}))
+	require.NoError(t, err)
+	d.forwarder.stop()
+
+	require.Len(t, ing.requests, 1)
+	require.Len(t, target.requests, 1)
+	require.Len(t, target.requests[0].Series, 1)
+	require.Equal(t, "forwarded", target.requests[0].Series[0].Labels[0].Value)
+	// the original profile is forwarded.
+	require.Equal(t, profile, target.requests[0].Series[0].Samples[0].RawProfile)
+	require.Equal(t, "target", headers[0].Get("X-Scope-OrgID"))
+	require.Equal(t, "Bearer token", headers[0].Get("Authorization"))
+}
+
+func Test_MetricsExport(t *testing.T) {
+	var received []*prompb.WriteRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		compressed, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		data, err := snappy.Decode(nil, compressed)
+		require.NoError(t, err)
+		req := &prompb.WriteRequest{}
+		require.NoError(t, req.Unmarshal(data))
+		received = append(received, req)
+	}))
+	defer s.Close()
+
+	ing := newFakeIngester(t, false)
+	cfg := Config{
+		DistributorRing: ringConfig,
+		MetricsExport: MetricsExportConfig{
+			RemoteWriteURL: s.URL,
+			BearerToken:    flagext.SecretWithValue("token"),
+			Interval:       time.Minute,
+			Timeout:        time.Second,
+			Rules: []MetricsExportRule{{
+				Name:        "phlare_profile_cpu_seconds_total",
+				ProfileType: "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+				Selector:    `{env="prod"}`,
+				Labels:      []string{"service_name"},
+				Scale:       1e-9,
+			}},
+		},
+	}
+	require.NoError(t, cfg.Validate())
+	d, err := New(cfg, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	push := func(service, env string, values ...int64) {
+		p := pproftesthelper.NewProfileBuilder(0).CPUProfile().WithLabels("service_name", service, "env", env)
+		for i, v := range values {
+			p.ForStacktraceString("main", fmt.Sprintf("f%d", i)).AddSamples(v)
+		}
+		raw, err := p.Profile.MarshalVT()
+		require.NoError(t, err)
+		_, err = d.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{{Labels: p.Labels, Samples: []*pushv1.RawSample{{RawProfile: raw}}}},
+		}))
+		require.NoError(t, err)
+	}
+	push("api", "prod", 1e9, 2e9)
+	push("api", "prod", 1e9)
+	push("api", "dev", 1e9)
+	push("db", "prod", 5e8)
+
+	require.NoError(t, d.metricsExporter.write(context.Background()))
+	require.Len(t, received, 1)
+	series := received[0].Timeseries
+	sort.Slice(series, func(i, j int) bool { return series[i].Labels[2].Value < series[j].Labels[2].Value })
+	require.Len(t, series, 2)
+	require.Equal(t, []prompb.Label{
+		{Name: "__name__", Value: "phlare_profile_cpu_seconds_total"},
+		{Name: "instance", Value: "foo"},
+		{Name: "service_name", Value: "api"},
+		{Name: "tenant", Value: "foo"},
+	}, series[0].Labels)
+	require.InDelta(t, 4., series[0].Samples[0].Value, 1e-9)
+	require.Equal(t, "db", series[1].Labels[2].Value)
+	require.InDelta(t, 0.5, series[1].Samples[0].Value, 1e-9)
+
+	// the idle counters are dropped once written.
+	d.metricsExporter.cfg.IdleTimeout = time.Minute
+	for _, c := range d.metricsExporter.counters {
+		if c.labels[2].Value == "db" {
+			c.updated = c.updated.Add(-2 * time.Minute)
+		}
+	}
+	require.NoError(t, d.metricsExporter.write(context.Background()))
+	require.Len(t, received, 2)
+	require.Len(t, received[1].Timeseries, 2)
+	require.Len(t, d.metricsExporter.counters, 1)
+	require.NoError(t, d.metricsExporter.write(context.Background()))
+	require.Len(t, received, 3)
+	require.Len(t, received[2].Timeseries, 1)
+	require.Equal(t, "api", received[2].Timeseries[0].Labels[2].Value)
+}
+
+func Test_PushPprofHandler(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(false).Wrap(http.HandlerFunc(d.PushPprofHandler)))
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name     string
+		labels   string
+		body     []byte
+		expected int
+	}{
+		{name: "ok", labels: `{__name__="cpu",service_name="foo"}`, body: testProfile(t), expected: http.StatusOK},
+		{name: "missing labels", body: testProfile(t), expected: http.StatusBadRequest},
+		{name: "invalid labels", labels: `{__name__=`, body: testProfile(t), expected: http.StatusBadRequest},
+		{name: "empty body", labels: `{__name__="cpu"}`, expected: http.StatusBadRequest},
+		{name: "invalid profile", labels: `{__name__="cpu"}`, body: []byte("foo"), expected: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := url.Parse(s.URL)
+			require.NoError(t, err)
+			u.RawQuery = url.Values{"labels": []string{tc.labels}}.Encode()
+			resp, err := http.Post(u.String(), "application/octet-stream", bytes.NewReader(tc.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+	require.Equal(t, 3, len(ing.requests[0].Series))
+	require.Equal(t, "foo", ing.requests[0].Series[0].Labels[1].Value)
+}
+
+func Test_PushJSONHandler(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(false).Wrap(http.HandlerFunc(d.PushJSONHandler)))
+	defer s.Close()
+
+	profile, err := json.Marshal(testProfile(t))
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name     string
+		body     string
+		expected int
+	}{
+		{name: "ok", body: `{"series": [{"labels": {"service_name": "foo", "__name__": "cpu"}, "samples": [{"rawProfile": ` + string(profile) + `}]}]}`, expected: http.StatusOK},
+		{name: "no series", body: `{"series": []}`, expected: http.StatusBadRequest},
+		{name: "invalid json", body: `{"series": [`, expected: http.StatusBadRequest},
+		{name: "invalid profile", body: `{"series": [{"labels": {"__name__": "cpu"}, "samples": [{"rawProfile": "Zm9v"}]}]}`, expected: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Post(s.URL, "application/json", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+	require.Equal(t, 3, len(ing.requests[0].Series))
+	require.Equal(t, "__name__", ing.requests[0].Series[0].Labels[0].Name)
+	require.Equal(t, "foo", ing.requests[0].Series[0].Labels[1].Value)
+}
+
+func Test_PushJSSelfProfileHandler(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, newOverrides(t), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(false).Wrap(http.HandlerFunc(d.PushJSSelfProfileHandler)))
+	defer s.Close()
+
+	trace := `{"resources": ["app.js"], "frames": [{"name": "main", "resourceId": 0}, {"name": "render"}], "stacks": [{"frameId": 0}, {"parentId": 0, "frameId": 1}], "samples": [{"timestamp": 10, "stackId": 1}, {"timestamp": 20}, {"timestamp": 30, "stackId": 0}]}`
+	labels := url.QueryEscape(`{service_name="frontend",page="/checkout"}`)
+	for _, tc := range []struct {
+		name     string
+		query    string
+		body     string
+		expected int
+	}{
+		{name: "ok", query: "?timeOrigin=1672531200000&labels=" + labels, body: trace, expected: http.StatusOK},
+		{name: "no labels", body: trace, expected: http.StatusBadRequest},
+		{name: "invalid time origin", query: "?timeOrigin=foo&labels=" + labels, body: trace, expected: http.StatusBadRequest},
+		{name: "invalid json", query: "?labels=" + labels, body: `{"samples": [`, expected: http.StatusBadRequest},
+		{name: "no samples", query: "?labels=" + labels, body: `{"samples": []}`, expected: http.StatusBadRequest},
+		{name: "invalid trace", query: "?labels=" + labels, body: `{"samples": [{"timestamp": 1, "stackId": 0}]}`, expected: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Post(s.URL+tc.query, "application/json", strings.NewReader(tc.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tc.expected, resp.StatusCode)
+		})
+	}
+	series := ing.requests[0].Series[0]
+	require.Equal(t, "wall", phlaremodel.Labels(series.Labels).Get("__name__"))
+	require.Equal(t, "/checkout", phlaremodel.Labels(series.Labels).Get("page"))
+	p, err := phlarepprof.RawFromBytes(series.Samples[0].RawProfile)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, time.January, 1, 0, 0, 0, int(10*time.Millisecond), time.UTC).UnixNano(), p.TimeNanos)
+	require.Len(t, p.Sample, 2)
+}
+
+func Test_PushPprofHandler_ProfileSizeLimit(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, _ map[string]*validation.Limits) {
+		defaults.MaxProfileSizeBytes = 16
+	}), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	s := httptest.NewServer(tenant.NewHTTPAuthMiddleware(false).Wrap(http.HandlerFunc(d.PushPprofHandler)))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	require.NoError(t, err)
+	u.RawQuery = url.Values{"labels": []string{`{__name__="cpu",service_name="foo"}`}}.Encode()
+	resp, err := http.Post(u.String(), "application/octet-stream", bytes.NewReader(testProfile(t)))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Empty(t, ing.requests)
+}
+
+func Test_ConnectPush_ProfileSizeLimit(t *testing.T) {
+	ing := newFakeIngester(t, false)
+	d, err := New(Config{
+		DistributorRing: ringConfig,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "foo"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		return ing, nil
+	}, validation.MockOverrides(func(defaults *validation.Limits, _ map[string]*validation.Limits) {
+		defaults.MaxProfileSizeBytes = 16
+	}), nil, log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	path, handler := pushv1connect.NewPusherServiceHandler(d, connect.WithInterceptors(tenant.NewAuthInterceptor(false)))
+	mux.Handle(path, PushHTTPStatusMiddleware().Wrap(handler))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	body, err := (&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{{
+			Labels:  []*typesv1.LabelPair{{Name: "__name__", Value: "cpu"}, {Name: "service_name", Value: "foo"}},
+			Samples: []*pushv1.RawSample{{RawProfile: testProfile(t)}},
+		}},
+	}).MarshalVT()
+	require.NoError(t, err)
+	resp, err := http.Post(s.URL+"/push.v1.PusherService/Push", "application/proto", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Empty(t, ing.requests)
+}
+
 func Test_Replication(t *testing.T) {
 	ingesters := map[string]*fakeIngester{
 		"1": newFakeIngester(t, false),
@@ -239,6 +809,108 @@ func Test_Limits(t *testing.T) {
 		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
 		require.Nil(t, resp)
 	})
+	t.Run("sanitized label names", func(t *testing.T) {
+		_, err := client.Push(tenant.InjectTenantID(context.Background(), "user-2"), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels: []*typesv1.LabelPair{
+						{Name: "clusterdddwqdqdqdqdqdqw", Value: "us-central1"},
+						{Name: "service.name", Value: "svc"},
+						{Name: "__name__", Value: "cpu"},
+					},
+					Samples: []*pushv1.RawSample{
+						{
+							RawProfile: testProfile(t),
+						},
+					},
+				},
+			},
+		}))
+		require.NoError(t, err)
+		require.Equal(t, []*typesv1.LabelPair{
+			{Name: "__name__", Value: "cpu"},
+			{Name: "clusterddd", Value: "us-central1"},
+			{Name: "service_na", Value: "svc"},
+		}, ing.requests[0].Series[0].Labels)
+	})
+	t.Run("malformed symbols", func(t *testing.T) {
+		push := func(tenantID string) error {
+			_, err := client.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+				Series: []*pushv1.RawProfileSeries{
+					{
+						Labels: []*typesv1.LabelPair{
+							{Name: "cluster", Value: "us"},
+							{Name: "__name__", Value: "cpu"},
+						},
+						Samples: []*pushv1.RawSample{
+							{
+								RawProfile: malformedTestProfile(t),
+							},
+						},
+					},
+				},
+			}))
+			return err
+		}
+		// repaired by default.
+		require.NoError(t, push("user-2"))
+		p, err := phlarepprof.RawFromBytes(ing.requests[len(ing.requests)-1].Series[0].Samples[0].RawProfile)
+		require.NoError(t, err)
+		require.Zero(t, p.RepairSymbols().Total())
+
+		err = push("user-3")
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+		require.Contains(t, err.Error(), "reject_malformed_symbols")
+	})
+	t.Run("runtime labels", func(t *testing.T) {
+		push := func(tenantID string) []*typesv1.LabelPair {
+			_, err := client.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+				Series: []*pushv1.RawProfileSeries{
+					{
+						Labels: []*typesv1.LabelPair{
+							{Name: "cluster", Value: "us"},
+							{Name: "__name__", Value: "memory"},
+							{Name: "__spy__", Value: "custom-sdk"},
+						},
+						Samples: []*pushv1.RawSample{
+							{
+								RawProfile: testProfile(t),
+							},
+						},
+					},
+				},
+			}))
+			require.NoError(t, err)
+			return ing.requests[len(ing.requests)-1].Series[0].Labels
+		}
+		require.Equal(t, []*typesv1.LabelPair{
+			{Name: "__name__", Value: "memory"},
+			{Name: "__spy__", Value: "custom-sdk"},
+			{Name: "cluster", Value: "us"},
+		}, push("user-3"))
+		require.Equal(t, []*typesv1.LabelPair{
+			{Name: "__name__", Value: "memory"},
+			{Name: "__runtime__", Value: "go"},
+			{Name: "__spy__", Value: "custom-sdk"},
+			{Name: "cluster", Value: "us"},
+		}, push("user-4"))
+	})
+}
+
+// malformedTestProfile returns a profile with a duplicate function and a sample referencing a
+// missing location.
+func malformedTestProfile(t *testing.T) []byte {
+	t.Helper()
+	p, err := phlarepprof.RawFromBytes(testProfile(t))
+	require.NoError(t, err)
+	defer p.Close()
+	fn := p.Function[0]
+	p.Function = append(p.Function, &profilev1.Function{Id: fn.Id, Name: fn.Name, SystemName: fn.SystemName, Filename: fn.Filename})
+	p.Sample[0].LocationId = append(p.Sample[0].LocationId, 1<<40)
+	buf := bytes.NewBuffer(nil)
+	_, err = p.WriteTo(buf)
+	require.NoError(t, err)
+	return buf.Bytes()
 }
 
 func newOverrides(t *testing.T) *validation.Overrides {
@@ -249,5 +921,321 @@ func newOverrides(t *testing.T) *validation.Overrides {
 		l.IngestionBurstSizeMB = 0.0015
 		l.MaxLabelNameLength = 10
 		tenantLimits["user-1"] = l
+
+		l = validation.MockDefaultLimits()
+		l.MaxLabelNameLength = 10
+		l.SanitizeLabelNames = true
+		tenantLimits["user-2"] = l
+
+		l = validation.MockDefaultLimits()
+		l.RejectMalformedSymbols = true
+		tenantLimits["user-3"] = l
+
+		l = validation.MockDefaultLimits()
+		l.DetectRuntimeLabels = true
+		tenantLimits["user-4"] = l
+	})
+}
+
+func Test_InflightLimits(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.MaxInflightPushRequests = 1
+		tenantLimits["user-1"] = l
+	})
+
+	t.Run("fail fast", func(t *testing.T) {
+		l := newInflightLimiter(2, 0, overrides, newMetrics(nil))
+		release, err := l.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		_, err = l.acquire(context.Background(), "user-1")
+		require.Error(t, err)
+
+		// the tenant without limit is only bound by the instance limit.
+		releaseOther, err := l.acquire(context.Background(), "user-2")
+		require.NoError(t, err)
+		_, err = l.acquire(context.Background(), "user-2")
+		require.Error(t, err)
+
+		release()
+		releaseOther()
+		release, err = l.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		release()
+		require.Empty(t, l.tenants)
 	})
+
+	t.Run("queue", func(t *testing.T) {
+		l := newInflightLimiter(0, time.Minute, overrides, newMetrics(nil))
+		release, err := l.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		time.AfterFunc(50*time.Millisecond, release)
+		release, err = l.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		release()
+	})
+
+	t.Run("queue timeout", func(t *testing.T) {
+		l := newInflightLimiter(0, 50*time.Millisecond, overrides, newMetrics(nil))
+		release, err := l.acquire(context.Background(), "user-1")
+		require.NoError(t, err)
+		defer release()
+		_, err = l.acquire(context.Background(), "user-1")
+		require.Error(t, err)
+	})
+}
+
+func Test_PushBatching(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests [][]*pushv1.RawProfileSeries
+		tenants  []string
+	)
+	send := func(ctx context.Context, ingester ring.InstanceDesc, series []*pushv1.RawProfileSeries) error {
+		tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+		require.NoError(t, err)
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests = append(requests, series)
+		tenants = append(tenants, tenantID)
+		return nil
+	}
+	series := func(size int) []*pushv1.RawProfileSeries {
+		return []*pushv1.RawProfileSeries{{Samples: []*pushv1.RawSample{{RawProfile: make([]byte, size)}}}}
+	}
+	ingester := ring.InstanceDesc{Addr: "foo"}
+
+	t.Run("window", func(t *testing.T) {
+		requests, tenants = nil, nil
+		b := newPushBatcher(100*time.Millisecond, 0, time.Second, send, newMetrics(nil))
+		var g errgroup.Group
+		for i := 0; i < 3; i++ {
+			g.Go(func() error { return b.push(context.Background(), ingester, "user-1", series(10)) })
+		}
+		require.NoError(t, g.Wait())
+		require.Len(t, requests, 1)
+		require.Len(t, requests[0], 3)
+		require.Equal(t, []string{"user-1"}, tenants)
+	})
+
+	t.Run("max size", func(t *testing.T) {
+		requests, tenants = nil, nil
+		b := newPushBatcher(time.Hour, 20, time.Second, send, newMetrics(nil))
+		var g errgroup.Group
+		g.Go(func() error { return b.push(context.Background(), ingester, "user-1", series(10)) })
+		g.Go(func() error { return b.push(context.Background(), ingester, "user-2", series(30)) })
+		require.NoError(t, b.push(context.Background(), ingester, "user-1", series(10)))
+		// the batches are sent before the end of the window once they are full.
+		require.NoError(t, g.Wait())
+		require.Len(t, requests, 2)
+		require.ElementsMatch(t, []string{"user-1", "user-2"}, tenants)
+	})
+}
+
+func Test_PprofLabelValuesLimit(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.MaxProfileLabelValues = 2
+		tenantLimits["user-1"] = l
+		tenantLimits["user-3"] = l
+	})
+	now := time.Unix(0, 0)
+	l := newPprofLabelValuesLimiter(overrides, newMetrics(nil))
+	l.now = func() time.Time { return now }
+
+	values := func(tenantID string, endpoints ...string) []string {
+		p := &phlarepprof.Profile{Profile: &profilev1.Profile{StringTable: []string{"", "endpoint"}}}
+		for i, e := range endpoints {
+			p.StringTable = append(p.StringTable, e)
+			p.Sample = append(p.Sample, &profilev1.Sample{Label: []*profilev1.Label{{Key: 1, Str: int64(i + 2)}}})
+		}
+		l.limit(tenantID, p)
+		result := make([]string, 0, len(p.Sample))
+		for _, s := range p.Sample {
+			result = append(result, p.StringTable[s.Label[0].Str])
+		}
+		return result
+	}
+
+	require.Equal(t, []string{"/a", "/b", "other", "/a"}, values("user-1", "/a", "/b", "/c", "/a"))
+	require.Equal(t, []string{"/b", "other"}, values("user-1", "/b", "/d"))
+	// tenants without limit are left untouched.
+	require.Equal(t, []string{"/a", "/b", "/c"}, values("user-2", "/a", "/b", "/c"))
+	// the values are forgotten after the period.
+	now = now.Add(pprofLabelValuesPeriod + time.Second)
+	require.Equal(t, []string{"/c", "/d", "other"}, values("user-1", "/c", "/d", "/a"))
+	// the idle tenants are forgotten.
+	require.Len(t, l.tenants, 1)
+	now = now.Add(2*pprofLabelValuesPeriod + time.Second)
+	values("user-3")
+	require.Len(t, l.tenants, 1)
+	require.Contains(t, l.tenants, "user-3")
+	// the values of the keys beyond the limit of keys are all replaced.
+	for i := len(l.tenants["user-3"].keys); i < maxPprofLabelKeys; i++ {
+		l.tenants["user-3"].keys[strconv.Itoa(i)] = map[string]struct{}{}
+	}
+	require.Equal(t, []string{"other"}, values("user-3", "/a"))
+	require.Len(t, l.tenants["user-3"].keys, maxPprofLabelKeys)
+}
+
+func Test_LabelCardinalityLimit(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.MaxLabelValuesPerName = 2
+		tenantLimits["user-1"] = l
+		l = validation.MockDefaultLimits()
+		l.MaxLabelValuesPerName = 2
+		l.LabelValuesLimitAction = validation.LabelValuesLimitRewrite
+		tenantLimits["user-2"] = l
+	})
+	now := time.Unix(0, 0)
+	l := newLabelCardinalityLimiter(overrides, newMetrics(nil))
+	l.now = func() time.Time { return now }
+
+	limit := func(tenantID, pod string) (string, error) {
+		ls, err := l.limit(tenantID, []*typesv1.LabelPair{
+			{Name: "__name__", Value: "cpu-" + pod},
+			{Name: "pod", Value: pod},
+		})
+		if err != nil {
+			return "", err
+		}
+		return phlaremodel.Labels(ls).Get("pod"), nil
+	}
+
+	for _, pod := range []string{"a", "b", "a"} {
+		_, err := limit("user-1", pod)
+		require.NoError(t, err)
+	}
+	_, err := limit("user-1", "c")
+	require.Equal(t, validation.LabelValuesLimit, validation.ReasonOf(err))
+	// the names starting with __ aren't limited.
+	require.Equal(t, []LabelCardinality{{Name: "pod", Values: 2}}, l.cardinalities("user-1"))
+
+	// the values of the series rejected aren't counted.
+	_, err = l.limit("user-1", []*typesv1.LabelPair{{Name: "namespace", Value: "a"}, {Name: "pod", Value: "d"}})
+	require.Error(t, err)
+	require.Equal(t, []LabelCardinality{{Name: "pod", Values: 2}}, l.cardinalities("user-1"))
+
+	for _, pod := range []string{"a", "b"} {
+		_, err := limit("user-2", pod)
+		require.NoError(t, err)
+	}
+	pod, err := limit("user-2", "c")
+	require.NoError(t, err)
+	require.Equal(t, validation.OverflowProfileLabelValue, pod)
+	// the overflow value doesn't count against the limit.
+	require.Equal(t, []LabelCardinality{{Name: "pod", Values: 2}}, l.cardinalities("user-2"))
+
+	// tenants without limit are left untouched.
+	for _, pod := range []string{"a", "b", "c"} {
+		_, err := limit("user-3", pod)
+		require.NoError(t, err)
+	}
+	require.Empty(t, l.cardinalities("user-3"))
+
+	// the values not seen during the last period are forgotten.
+	now = now.Add(labelCardinalityPeriod)
+	_, err = limit("user-1", "a")
+	require.NoError(t, err)
+	now = now.Add(labelCardinalityPeriod)
+	_, err = limit("user-1", "c")
+	require.NoError(t, err)
+	_, err = limit("user-1", "b")
+	require.Error(t, err)
+
+	// the tenants idle for a period are forgotten.
+	now = now.Add(2 * labelCardinalityPeriod)
+	_, err = limit("user-1", "a")
+	require.NoError(t, err)
+	require.Len(t, l.tenants, 1)
+}
+
+func Test_PushCapture(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(0, 0)
+	newCapturer := func(cfg PushCaptureConfig) *pushCapturer {
+		c, err := newPushCapturer(cfg, log.NewNopLogger())
+		require.NoError(t, err)
+		c.now = func() time.Time {
+			now = now.Add(time.Second)
+			return now
+		}
+		c.sample = func() float64 { return 0.5 }
+		return c
+	}
+	req := &pushv1.PushRequest{Series: []*pushv1.RawProfileSeries{{
+		Labels:  []*typesv1.LabelPair{{Name: "__name__", Value: "cpu"}},
+		Samples: []*pushv1.RawSample{{RawProfile: bytes.Repeat([]byte{1}, 100)}},
+	}}}
+	readCaptures := func() []*CapturedPush {
+		var captures []*CapturedPush
+		files, err := filepath.Glob(filepath.Join(dir, pushCaptureFilePrefix+"*"))
+		require.NoError(t, err)
+		for _, file := range files {
+			f, err := os.Open(file)
+			require.NoError(t, err)
+			require.NoError(t, ReadPushCaptures(f, func(c *CapturedPush) error {
+				captures = append(captures, c)
+				return nil
+			}))
+			require.NoError(t, f.Close())
+		}
+		return captures
+	}
+
+	c := newCapturer(PushCaptureConfig{Dir: dir, SampleRatio: 0.6, MaxSizeBytes: 1 << 20, Tenants: []string{"user-1", "user-2"}})
+	c.capture("user-1", req)
+	c.capture("user-3", req)
+	c.sample = func() float64 { return 0.7 }
+	c.capture("user-2", req)
+	require.NoError(t, c.close())
+	captures := readCaptures()
+	require.Len(t, captures, 1)
+	require.Equal(t, "user-1", captures[0].TenantID)
+	captured, err := captures[0].PushRequest()
+	require.NoError(t, err)
+	require.Equal(t, req.Series[0].Samples[0].RawProfile, captured.Series[0].Samples[0].RawProfile)
+	require.Equal(t, req.Series[0].Labels[0].Value, captured.Series[0].Labels[0].Value)
+
+	// the oldest files are removed, including the ones from before a restart.
+	c = newCapturer(PushCaptureConfig{Dir: dir, SampleRatio: 1, MaxSizeBytes: 8 * 400, RedactTenantIDs: true})
+	for i := 0; i < 100; i++ {
+		c.capture("user-1", req)
+	}
+	require.NoError(t, c.close())
+	require.LessOrEqual(t, c.size, c.cfg.MaxSizeBytes)
+	captures = readCaptures()
+	require.Greater(t, len(captures), 8)
+	for _, captured := range captures {
+		require.Equal(t, fmt.Sprintf("%016x", xxhash.Sum64String("user-1")), captured.TenantID)
+	}
+
+	// the pushes captured once closed are ignored, without opening a file.
+	files, err := filepath.Glob(filepath.Join(dir, pushCaptureFilePrefix+"*"))
+	require.NoError(t, err)
+	c.capture("user-1", req)
+	require.NoError(t, c.close())
+	require.Nil(t, c.current)
+	require.Len(t, readCaptures(), len(captures))
+	afterClose, err := filepath.Glob(filepath.Join(dir, pushCaptureFilePrefix+"*"))
+	require.NoError(t, err)
+	require.Equal(t, files, afterClose)
+}
+
+func Test_LogPushError(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	ctx := tenant.InjectTenantID(context.Background(), "user-1")
+
+	logPushError(ctx, logger, connect.NewError(connect.CodeInvalidArgument, validation.NewErrorf(validation.RateLimited, "too many pushes")))
+	require.Contains(t, buf.String(), "level=debug")
+	require.Contains(t, buf.String(), "tenant=user-1")
+	require.Contains(t, buf.String(), "reason=rate_limited")
+	require.Contains(t, buf.String(), `err="invalid_argument: too many pushes"`)
+
+	buf.Reset()
+	logPushError(ctx, logger, errors.New("ingester unavailable"))
+	require.Contains(t, buf.String(), "level=warn")
+	require.Contains(t, buf.String(), "reason=unknown")
 }
@@ -0,0 +1,206 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// ForwardingConfig configures the forwarding of the ingested profiles to another Phlare or
+// Pyroscope endpoint.
+type ForwardingConfig struct {
+	URL               string         `yaml:"url" category:"advanced"`
+	TenantID          string         `yaml:"tenant_id" category:"advanced"`
+	BasicAuthUsername string         `yaml:"basic_auth_username" category:"advanced"`
+	BasicAuthPassword flagext.Secret `yaml:"basic_auth_password" category:"advanced"`
+	BearerToken       flagext.Secret `yaml:"bearer_token" category:"advanced"`
+	Selector          string         `yaml:"selector" category:"advanced"`
+	Timeout           time.Duration  `yaml:"timeout" category:"advanced"`
+	MaxInFlight       int            `yaml:"max_in_flight" category:"advanced"`
+}
+
+// RegisterFlags registers the forwarding flags.
+func (cfg *ForwardingConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.URL, "distributor.forwarding.url", "", "URL of the Phlare or Pyroscope endpoint the ingested profiles are forwarded to. Forwarding is disabled when empty.")
+	f.StringVar(&cfg.TenantID, "distributor.forwarding.tenant-id", "", "Tenant ID the profiles are forwarded to. Defaults to the tenant of the push.")
+	f.StringVar(&cfg.BasicAuthUsername, "distributor.forwarding.basic-auth-username", "", "Username used to authenticate to the forwarding endpoint with basic auth.")
+	f.Var(&cfg.BasicAuthPassword, "distributor.forwarding.basic-auth-password", "Password used to authenticate to the forwarding endpoint with basic auth.")
+	f.Var(&cfg.BearerToken, "distributor.forwarding.bearer-token", "Bearer token used to authenticate to the forwarding endpoint.")
+	f.StringVar(&cfg.Selector, "distributor.forwarding.selector", "", "Label selector of the series forwarded, e.g. '{service_name=\"my-service\"}'. All the series are forwarded when empty.")
+	f.DurationVar(&cfg.Timeout, "distributor.forwarding.timeout", 10*time.Second, "Timeout when forwarding a push.")
+	f.IntVar(&cfg.MaxInFlight, "distributor.forwarding.max-in-flight", 100, "Maximum number of pushes being forwarded at the same time. Pushes exceeding the limit are not forwarded.")
+}
+
+// Validate validates the forwarding config.
+func (cfg *ForwardingConfig) Validate() error {
+	if cfg.URL == "" {
+		return nil
+	}
+	if _, err := url.Parse(cfg.URL); err != nil {
+		return fmt.Errorf("invalid forwarding url: %w", err)
+	}
+	if cfg.BasicAuthUsername != "" && cfg.BearerToken.String() != "" {
+		return errors.New("forwarding basic auth and bearer token are mutually exclusive")
+	}
+	if cfg.MaxInFlight <= 0 {
+		return errors.New("forwarding max in flight must be positive")
+	}
+	_, err := cfg.matchers()
+	return err
+}
+
+func (cfg *ForwardingConfig) matchers() ([]*labels.Matcher, error) {
+	if cfg.Selector == "" {
+		return nil, nil
+	}
+	matchers, err := parser.ParseMetricSelector(cfg.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarding selector: %w", err)
+	}
+	return matchers, nil
+}
+
+// forwarder pushes copies of the ingested profiles to the forwarding endpoint, in the background.
+// Forwarding failures do not fail the pushes.
+type forwarder struct {
+	cfg      ForwardingConfig
+	matchers []*labels.Matcher
+	client   pushv1connect.PusherServiceClient
+	logger   log.Logger
+	metrics  *metrics
+
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newForwarder(cfg ForwardingConfig, client connect.HTTPClient, m *metrics, logger log.Logger) (*forwarder, error) {
+	matchers, err := cfg.matchers()
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{
+		cfg:      cfg,
+		matchers: matchers,
+		logger:   log.With(logger, "component", "forwarder"),
+		metrics:  m,
+		inFlight: make(chan struct{}, cfg.MaxInFlight),
+	}
+	f.client = pushv1connect.NewPusherServiceClient(client, cfg.URL, connect.WithInterceptors(f.authInterceptor()))
+	return f, nil
+}
+
+func (f *forwarder) authInterceptor() connect.UnaryInterceptorFunc {
+	return func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			switch {
+			case f.cfg.BearerToken.String() != "":
+				req.Header().Set("Authorization", "Bearer "+f.cfg.BearerToken.String())
+			case f.cfg.BasicAuthUsername != "":
+				r := http.Request{Header: http.Header{}}
+				r.SetBasicAuth(f.cfg.BasicAuthUsername, f.cfg.BasicAuthPassword.String())
+				req.Header().Set("Authorization", r.Header.Get("Authorization"))
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// request returns a copy of the series of the push matching the selector, nil if none matches.
+// The copy is taken before the distributor rewrites the profiles in place.
+func (f *forwarder) request(req *pushv1.PushRequest) *pushv1.PushRequest {
+	var result *pushv1.PushRequest
+	for _, series := range req.Series {
+		if !f.matches(series.Labels) {
+			continue
+		}
+		if result == nil {
+			result = &pushv1.PushRequest{}
+		}
+		s := &pushv1.RawProfileSeries{
+			Labels:   make([]*typesv1.LabelPair, 0, len(series.Labels)),
+			Samples:  make([]*pushv1.RawSample, 0, len(series.Samples)),
+			Metadata: make([]*typesv1.LabelPair, 0, len(series.Metadata)),
+		}
+		for _, l := range series.Labels {
+			s.Labels = append(s.Labels, &typesv1.LabelPair{Name: l.Name, Value: l.Value})
+		}
+		for _, m := range series.Metadata {
+			s.Metadata = append(s.Metadata, &typesv1.LabelPair{Name: m.Name, Value: m.Value})
+		}
+		for _, sample := range series.Samples {
+			s.Samples = append(s.Samples, &pushv1.RawSample{
+				RawProfile: append([]byte(nil), sample.RawProfile...),
+			})
+		}
+		result.Series = append(result.Series, s)
+	}
+	return result
+}
+
+func (f *forwarder) matches(ls []*typesv1.LabelPair) bool {
+	for _, m := range f.matchers {
+		value := ""
+		for _, l := range ls {
+			if l.Name == m.Name {
+				value = l.Value
+				break
+			}
+		}
+		if !m.Matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// forward pushes the request in the background.
+func (f *forwarder) forward(tenantID string, req *pushv1.PushRequest) {
+	targetTenantID := tenantID
+	if f.cfg.TenantID != "" {
+		targetTenantID = f.cfg.TenantID
+	}
+	select {
+	case f.inFlight <- struct{}{}:
+	default:
+		f.metrics.forwardedPushes.WithLabelValues(tenantID, "dropped").Inc()
+		return
+	}
+	f.wg.Add(1)
+	go func() {
+		defer func() {
+			<-f.inFlight
+			f.wg.Done()
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), f.cfg.Timeout)
+		defer cancel()
+		r := connect.NewRequest(req)
+		r.Header().Set("X-Scope-OrgID", targetTenantID)
+		if _, err := f.client.Push(ctx, r); err != nil {
+			f.metrics.forwardedPushes.WithLabelValues(tenantID, "failure").Inc()
+			level.Warn(f.logger).Log("msg", "failed to forward push", "tenant", tenantID, "err", err)
+			return
+		}
+		f.metrics.forwardedPushes.WithLabelValues(tenantID, "success").Inc()
+	}()
+}
+
+// stop waits for the pushes being forwarded.
+func (f *forwarder) stop() {
+	f.wg.Wait()
+}
@@ -0,0 +1,292 @@
+package distributor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/felixge/httpsnoop"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/weaveworks/common/middleware"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/openapi"
+	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// PushPprofHandler accepts a single raw pprof profile as request body, so
+// profiles can be pushed with a plain curl command:
+//
+//	curl -X POST --data-binary @cpu.pb.gz \
+//	  'http://localhost:4100/api/v1/push/pprof?labels={__name__="process_cpu",service_name="my-service"}'
+//
+// The profile is pushed as a single series with the given labels.
+func (d *Distributor) PushPprofHandler(w http.ResponseWriter, req *http.Request) {
+	lbls := req.URL.Query().Get("labels")
+	if lbls == "" {
+		http.Error(w, "labels parameter is required", http.StatusBadRequest)
+		return
+	}
+	labels, err := phlaremodel.StringToLabelsPairs(lbls)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse labels: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		http.Error(w, "request body is empty", http.StatusBadRequest)
+		return
+	}
+
+	pushReq := connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  labels,
+				Samples: []*pushv1.RawSample{{RawProfile: body}},
+			},
+		},
+	})
+	pushReq.Header().Set(IdempotencyKeyHeader, req.Header.Get(IdempotencyKeyHeader))
+	_, err = d.Push(req.Context(), pushReq)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromError(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// The documentation of the push endpoints in the OpenAPI document.
+var (
+	PushPprofDoc = openapi.Route{
+		Summary: "Pushes a single pprof profile, optionally gzip compressed.",
+		Parameters: []openapi.Parameter{
+			{Name: "labels", In: "query", Required: true, Description: `The labels of the series, for example {__name__="process_cpu",service_name="my-service"}.`, Schema: &openapi.Schema{Type: "string"}},
+		},
+		RequestBody: map[string]*openapi.Schema{"application/octet-stream": {Type: "string", Format: "binary"}},
+	}
+	PushJSSelfProfileDoc = openapi.Route{
+		Summary: "Pushes a trace of the JS Self-Profiling API of the browsers.",
+		Parameters: []openapi.Parameter{
+			{Name: "labels", In: "query", Required: true, Description: `The labels of the series, for example {service_name="frontend",page="/checkout"}. The profile name defaults to wall.`, Schema: &openapi.Schema{Type: "string"}},
+			{Name: "timeOrigin", In: "query", Description: "The performance.timeOrigin of the page in milliseconds since epoch, the origin of the timestamps of the trace. By default, the trace ends at the time of the push.", Schema: &openapi.Schema{Type: "number"}},
+		},
+		RequestBody: map[string]*openapi.Schema{"application/json": openapi.SchemaOf(pprof.JSSelfProfile{})},
+	}
+	PushJSONDoc = openapi.Route{
+		Summary:     "Pushes the profiles of several series in JSON.",
+		RequestBody: map[string]*openapi.Schema{"application/json": openapi.SchemaOf(jsonPushRequest{})},
+	}
+)
+
+// PushJSSelfProfileHandler accepts a trace of the JS Self-Profiling API of the browsers, the result
+// of Profiler.stop(), as request body, so the main-thread profiles of the web pages are queried
+// like the others:
+//
+//	curl -X POST --data-binary @trace.json \
+//	  'http://localhost:4100/api/v1/push/js-self-profile?labels={service_name="frontend",page="/checkout"}&timeOrigin=1672531200000'
+//
+// The trace is converted to a wall-clock profile, pushed as a single series with the given labels.
+func (d *Distributor) PushJSSelfProfileHandler(w http.ResponseWriter, req *http.Request) {
+	tenantID, err := tenant.ExtractTenantIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	lbls := req.URL.Query().Get("labels")
+	if lbls == "" {
+		http.Error(w, "labels parameter is required", http.StatusBadRequest)
+		return
+	}
+	series, err := phlaremodel.StringToLabelsPairs(lbls)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse labels: %v", err), http.StatusBadRequest)
+		return
+	}
+	if phlaremodel.Labels(series).Get(labels.MetricName) == "" {
+		series = append(series, &typesv1.LabelPair{Name: labels.MetricName, Value: "wall"})
+		sort.Sort(phlaremodel.Labels(series))
+	}
+
+	var trace pprof.JSSelfProfile
+	if err := json.NewDecoder(req.Body).Decode(&trace); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to decode the trace: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(trace.Samples) == 0 {
+		http.Error(w, "the trace has no samples", http.StatusBadRequest)
+		return
+	}
+	// by default, the trace ends at the time of the push.
+	timeOrigin := time.Now().Add(-time.Duration(trace.Samples[len(trace.Samples)-1].Timestamp * float64(time.Millisecond)))
+	if v := req.URL.Query().Get("timeOrigin"); v != "" {
+		ms, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse timeOrigin: %v", err), http.StatusBadRequest)
+			return
+		}
+		timeOrigin = time.UnixMicro(int64(ms * 1000))
+	}
+
+	maxProfileSize := d.limits.MaxProfileSizeBytes(tenantID)
+	p, err := pprof.FromJSSelfProfile(&trace, timeOrigin, int64(maxProfileSize))
+	if errors.Is(err, pprof.ErrDecompressedSizeLimitExceeded) {
+		err = profileSizeLimitError(tenantID, series, int(req.ContentLength), maxProfileSize)
+		http.Error(w, err.Error(), httpStatusFromError(err))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	raw, err := p.MarshalVT()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pushReq := connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  series,
+				Samples: []*pushv1.RawSample{{RawProfile: raw}},
+			},
+		},
+	})
+	pushReq.Header().Set(IdempotencyKeyHeader, req.Header.Get(IdempotencyKeyHeader))
+	if _, err = d.Push(req.Context(), pushReq); err != nil {
+		http.Error(w, err.Error(), httpStatusFromError(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type jsonPushRequest struct {
+	Series []jsonPushSeries `json:"series"`
+}
+
+type jsonPushSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []jsonPushSample  `json:"samples"`
+}
+
+type jsonPushSample struct {
+	ID string `json:"id"`
+	// RawProfile is the pprof profile, optionally gzip compressed, encoded in base64.
+	RawProfile []byte `json:"rawProfile"`
+}
+
+// PushJSONHandler accepts the profiles of several series in JSON, the stable push endpoint of the
+// v1 HTTP API:
+//
+//	curl -X POST http://localhost:4100/api/v1/push \
+//	  -d '{"series": [{"labels": {"__name__": "process_cpu", "service_name": "my-service"}, "samples": [{"rawProfile": "<base64>"}]}]}'
+func (d *Distributor) PushJSONHandler(w http.ResponseWriter, req *http.Request) {
+	var body jsonPushRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("failed to decode the request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body.Series) == 0 {
+		http.Error(w, "no series to push", http.StatusBadRequest)
+		return
+	}
+
+	pushReq := &pushv1.PushRequest{Series: make([]*pushv1.RawProfileSeries, 0, len(body.Series))}
+	for _, s := range body.Series {
+		series := &pushv1.RawProfileSeries{
+			Labels:  make([]*typesv1.LabelPair, 0, len(s.Labels)),
+			Samples: make([]*pushv1.RawSample, 0, len(s.Samples)),
+		}
+		for name, value := range s.Labels {
+			series.Labels = append(series.Labels, &typesv1.LabelPair{Name: name, Value: value})
+		}
+		sort.Sort(phlaremodel.Labels(series.Labels))
+		for _, sample := range s.Samples {
+			series.Samples = append(series.Samples, &pushv1.RawSample{ID: sample.ID, RawProfile: sample.RawProfile})
+		}
+		pushReq.Series = append(pushReq.Series, series)
+	}
+	connectReq := connect.NewRequest(pushReq)
+	connectReq.Header().Set(IdempotencyKeyHeader, req.Header.Get(IdempotencyKeyHeader))
+	if _, err := d.Push(req.Context(), connectReq); err != nil {
+		http.Error(w, err.Error(), httpStatusFromError(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// RejectReasonHeader is the response header with the validation reason of the rejected pushes.
+const RejectReasonHeader = "X-Phlare-Reject-Reason"
+
+// PushHTTPStatusMiddleware answers the connect pushes rejected for the size of a profile with
+// status 413, rather than the 429 of their code CodeResourceExhausted, which clients retry.
+// Only the connect protocol is affected: the gRPC protocols always answer with status 200.
+func PushHTTPStatusMiddleware() middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			snooped := httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+					return func(code int) {
+						if code == http.StatusTooManyRequests && w.Header().Get(RejectReasonHeader) == string(validation.ProfileSizeLimit) {
+							code = http.StatusRequestEntityTooLarge
+						}
+						next(code)
+					}
+				},
+			})
+			next.ServeHTTP(snooped, r)
+		})
+	})
+}
+
+// httpStatusFromError maps the connect error codes returned by Push to a HTTP status code.
+func httpStatusFromError(err error) int {
+	// a profile too large is rejected for its size, not for a rate limit the client could wait for.
+	if validation.ReasonOf(err) == validation.ProfileSizeLimit {
+		return http.StatusRequestEntityTooLarge
+	}
+	switch connect.CodeOf(err) {
+	case connect.CodeInvalidArgument:
+		return http.StatusBadRequest
+	case connect.CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case connect.CodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case connect.CodeAborted:
+		return http.StatusConflict
+	case connect.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
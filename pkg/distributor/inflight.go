@@ -0,0 +1,114 @@
+package distributor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// inflightLimiter bounds the number of pushes processed at the same time, per tenant and for the
+// whole distributor, so bursts of pushes are rejected early instead of piling up in memory.
+type inflightLimiter struct {
+	limits       Limits
+	queueTimeout time.Duration
+	metrics      *metrics
+	// instanceLimit and instance are zero when the instance limit is disabled.
+	instanceLimit int
+	instance      *semaphore.Weighted
+
+	mtx     sync.Mutex
+	tenants map[string]*tenantInflight
+}
+
+type tenantInflight struct {
+	limit int
+	sem   *semaphore.Weighted
+	// users counts the pushes holding or waiting for the semaphore.
+	users int
+}
+
+func newInflightLimiter(instanceLimit int, queueTimeout time.Duration, limits Limits, m *metrics) *inflightLimiter {
+	l := &inflightLimiter{
+		limits:       limits,
+		queueTimeout: queueTimeout,
+		metrics:      m,
+		tenants:      make(map[string]*tenantInflight),
+	}
+	if instanceLimit > 0 {
+		l.instanceLimit = instanceLimit
+		l.instance = semaphore.NewWeighted(int64(instanceLimit))
+	}
+	return l
+}
+
+// acquire waits for the push to be within the tenant and the instance limits, for up to the
+// queue timeout. The returned function must be called once the push is processed.
+func (l *inflightLimiter) acquire(ctx context.Context, tenantID string) (func(), error) {
+	if l.queueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.queueTimeout)
+		defer cancel()
+	}
+
+	t := l.tenant(tenantID)
+	if t != nil && !l.acquireSemaphore(ctx, t.sem) {
+		l.releaseTenant(tenantID, t)
+		return nil, fmt.Errorf("too many in-flight push requests for the tenant (limit: %d)", t.limit)
+	}
+	if l.instance != nil && !l.acquireSemaphore(ctx, l.instance) {
+		if t != nil {
+			t.sem.Release(1)
+			l.releaseTenant(tenantID, t)
+		}
+		return nil, fmt.Errorf("too many in-flight push requests for the distributor (limit: %d)", l.instanceLimit)
+	}
+
+	l.metrics.inflightPushes.Inc()
+	return func() {
+		l.metrics.inflightPushes.Dec()
+		if l.instance != nil {
+			l.instance.Release(1)
+		}
+		if t != nil {
+			t.sem.Release(1)
+			l.releaseTenant(tenantID, t)
+		}
+	}, nil
+}
+
+func (l *inflightLimiter) acquireSemaphore(ctx context.Context, sem *semaphore.Weighted) bool {
+	if l.queueTimeout <= 0 {
+		return sem.TryAcquire(1)
+	}
+	return sem.Acquire(ctx, 1) == nil
+}
+
+// tenant returns the in-flight pushes of the tenant, or nil when the tenant has no limit. When
+// the limit changes, the new pushes are counted apart from the ones already in flight.
+func (l *inflightLimiter) tenant(tenantID string) *tenantInflight {
+	limit := l.limits.MaxInflightPushRequests(tenantID)
+	if limit <= 0 {
+		return nil
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	t, ok := l.tenants[tenantID]
+	if !ok || t.limit != limit {
+		t = &tenantInflight{limit: limit, sem: semaphore.NewWeighted(int64(limit))}
+		l.tenants[tenantID] = t
+	}
+	t.users++
+	return t
+}
+
+func (l *inflightLimiter) releaseTenant(tenantID string, t *tenantInflight) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	t.users--
+	if t.users == 0 && l.tenants[tenantID] == t {
+		delete(l.tenants, tenantID)
+	}
+}
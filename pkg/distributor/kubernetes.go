@@ -0,0 +1,299 @@
+package distributor
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/singleflight"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+const (
+	// LabelNameWorkload and LabelNameWorkloadKind are the labels of the workload owning the pod
+	// of a series, such as its deployment.
+	LabelNameWorkload     = "workload"
+	LabelNameWorkloadKind = "workload_kind"
+
+	// kubernetesErrorCacheTTL is how long the failed lookups are cached, so that an unavailable
+	// API server isn't queried by every push.
+	kubernetesErrorCacheTTL = 30 * time.Second
+	// maxKubernetesCacheEntries bounds the number of pods cached.
+	maxKubernetesCacheEntries = 100000
+)
+
+// KubernetesEnrichmentConfig configures the labels added to the series from the Kubernetes API,
+// so that the series of the pods can be queried by workload.
+type KubernetesEnrichmentConfig struct {
+	Enabled        bool                   `yaml:"enabled" category:"experimental"`
+	Kubeconfig     string                 `yaml:"kubeconfig" category:"experimental"`
+	CacheTTL       time.Duration          `yaml:"cache_ttl" category:"experimental"`
+	LookupTimeout  time.Duration          `yaml:"lookup_timeout" category:"experimental"`
+	PodLabel       string                 `yaml:"pod_label" category:"experimental"`
+	NamespaceLabel string                 `yaml:"namespace_label" category:"experimental"`
+	PodLabels      flagext.StringSliceCSV `yaml:"pod_labels" category:"experimental"`
+}
+
+// RegisterFlags registers the Kubernetes enrichment flags.
+func (cfg *KubernetesEnrichmentConfig) RegisterFlags(f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, "distributor.kubernetes-enrichment.enabled", false, "Add the namespace, the workload and the workload kind of the pod of the series pushed from the Kubernetes API, unless the series already have them. The distributors need the permissions to get and list the pods, and to get the replica sets and the jobs.")
+	f.StringVar(&cfg.Kubeconfig, "distributor.kubernetes-enrichment.kubeconfig", "", "Path of the kubeconfig file of the Kubernetes API. The in-cluster configuration is used when empty.")
+	f.DurationVar(&cfg.CacheTTL, "distributor.kubernetes-enrichment.cache-ttl", 10*time.Minute, "How long the workload of a pod is cached.")
+	f.DurationVar(&cfg.LookupTimeout, "distributor.kubernetes-enrichment.lookup-timeout", time.Second, "Timeout of the lookup of a pod. The series are pushed without the labels of their pod when it times out.")
+	f.StringVar(&cfg.PodLabel, "distributor.kubernetes-enrichment.pod-label", "pod", "Label of the series with the name of their pod.")
+	f.StringVar(&cfg.NamespaceLabel, "distributor.kubernetes-enrichment.namespace-label", "namespace", "Label of the series with the namespace of their pod. The pods of the series without it are looked up by name in all the namespaces, and the label is added.")
+	f.Var(&cfg.PodLabels, "distributor.kubernetes-enrichment.pod-labels", "Comma-separated list of the labels of the pods added to their series, for example app.kubernetes.io/version. The characters invalid in label names are replaced by underscores.")
+}
+
+// Validate validates the Kubernetes enrichment config.
+func (cfg *KubernetesEnrichmentConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.CacheTTL <= 0 {
+		return errors.New("kubernetes enrichment cache TTL must be positive")
+	}
+	if cfg.LookupTimeout <= 0 {
+		return errors.New("kubernetes enrichment lookup timeout must be positive")
+	}
+	for _, name := range []string{cfg.PodLabel, cfg.NamespaceLabel} {
+		if !model.LabelName(name).IsValid() {
+			return fmt.Errorf("invalid kubernetes enrichment label name %q", name)
+		}
+	}
+	return nil
+}
+
+// newKubernetesClient returns the client of the Kubernetes API of the kubeconfig, or of the
+// cluster the distributor runs in.
+func newKubernetesClient(kubeconfig string) (kubernetes.Interface, error) {
+	var (
+		restConfig *rest.Config
+		err        error
+	)
+	if kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure the kubernetes client: %w", err)
+	}
+	restConfig.UserAgent = "phlare-distributor"
+	return kubernetes.NewForConfig(restConfig)
+}
+
+type kubernetesPodKey struct {
+	namespace, name string
+}
+
+type kubernetesPodEntry struct {
+	// labels are added to the series of the pod, nil when it isn't found.
+	labels  []*typesv1.LabelPair
+	expires time.Time
+}
+
+// kubernetesEnricher adds the labels of the workloads of the pods to their series. The workloads
+// are looked up once per pod and cache TTL, by a single push at a time.
+type kubernetesEnricher struct {
+	cfg     KubernetesEnrichmentConfig
+	client  kubernetes.Interface
+	metrics *metrics
+	logger  log.Logger
+	now     func() time.Time
+
+	lookups singleflight.Group
+	mtx     sync.Mutex
+	pods    map[kubernetesPodKey]kubernetesPodEntry
+}
+
+func newKubernetesEnricher(cfg KubernetesEnrichmentConfig, client kubernetes.Interface, metrics *metrics, logger log.Logger) *kubernetesEnricher {
+	return &kubernetesEnricher{
+		cfg:     cfg,
+		client:  client,
+		metrics: metrics,
+		logger:  logger,
+		now:     time.Now,
+		pods:    make(map[kubernetesPodKey]kubernetesPodEntry),
+	}
+}
+
+// enrich adds the labels of the workload of the pod of the series, which it doesn't have yet.
+func (e *kubernetesEnricher) enrich(ls []*typesv1.LabelPair) []*typesv1.LabelPair {
+	if e == nil {
+		return ls
+	}
+	key := kubernetesPodKey{
+		namespace: phlaremodel.Labels(ls).Get(e.cfg.NamespaceLabel),
+		name:      phlaremodel.Labels(ls).Get(e.cfg.PodLabel),
+	}
+	if key.name == "" {
+		return ls
+	}
+	n := len(ls)
+	for _, l := range e.podLabels(key) {
+		if phlaremodel.Labels(ls).Get(l.Name) == "" {
+			ls = append(ls, &typesv1.LabelPair{Name: l.Name, Value: l.Value})
+		}
+	}
+	if len(ls) != n {
+		sort.Sort(phlaremodel.Labels(ls))
+	}
+	return ls
+}
+
+// podLabels returns the labels of the pod, from the cache or the Kubernetes API.
+func (e *kubernetesEnricher) podLabels(key kubernetesPodKey) []*typesv1.LabelPair {
+	e.mtx.Lock()
+	entry, ok := e.pods[key]
+	e.mtx.Unlock()
+	if ok && e.now().Before(entry.expires) {
+		return entry.labels
+	}
+	v, _, _ := e.lookups.Do(key.namespace+"/"+key.name, func() (interface{}, error) {
+		// the lookup isn't canceled with the push which started it, as others may wait for it.
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.LookupTimeout)
+		defer cancel()
+		ttl := e.cfg.CacheTTL
+		labels, err := e.lookup(ctx, key)
+		switch {
+		case err != nil:
+			level.Warn(e.logger).Log("msg", "failed to look up the workload of the pod", "namespace", key.namespace, "pod", key.name, "err", err)
+			e.metrics.kubernetesLookups.WithLabelValues("error").Inc()
+			if ttl > kubernetesErrorCacheTTL {
+				ttl = kubernetesErrorCacheTTL
+			}
+		case labels == nil:
+			e.metrics.kubernetesLookups.WithLabelValues("not_found").Inc()
+		default:
+			e.metrics.kubernetesLookups.WithLabelValues("found").Inc()
+		}
+		e.mtx.Lock()
+		defer e.mtx.Unlock()
+		if len(e.pods) >= maxKubernetesCacheEntries {
+			e.evictExpired()
+		}
+		e.pods[key] = kubernetesPodEntry{labels: labels, expires: e.now().Add(ttl)}
+		return labels, nil
+	})
+	return v.([]*typesv1.LabelPair)
+}
+
+// evictExpired removes the expired pods from the cache, or all of them when none expired.
+func (e *kubernetesEnricher) evictExpired() {
+	now := e.now()
+	for key, entry := range e.pods {
+		if !now.Before(entry.expires) {
+			delete(e.pods, key)
+		}
+	}
+	if len(e.pods) >= maxKubernetesCacheEntries {
+		e.pods = make(map[kubernetesPodKey]kubernetesPodEntry)
+	}
+}
+
+// lookup returns the labels of the pod and of its workload, nil if the pod isn't found. The pods
+// without namespace are looked up by name in all the namespaces, and must be unique.
+func (e *kubernetesEnricher) lookup(ctx context.Context, key kubernetesPodKey) ([]*typesv1.LabelPair, error) {
+	var pod *corev1.Pod
+	if key.namespace != "" {
+		p, err := e.client.CoreV1().Pods(key.namespace).Get(ctx, key.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pod = p
+	} else {
+		pods, err := e.client.CoreV1().Pods(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", key.name).String(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			if pods.Items[i].Name != key.name {
+				continue
+			}
+			if pod != nil {
+				// the pod isn't unique, its namespace can't be known.
+				return nil, nil
+			}
+			pod = &pods.Items[i]
+		}
+		if pod == nil {
+			return nil, nil
+		}
+	}
+
+	labels := []*typesv1.LabelPair{{Name: e.cfg.NamespaceLabel, Value: pod.Namespace}}
+	kind, name, err := e.workload(ctx, pod)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		labels = append(labels,
+			&typesv1.LabelPair{Name: LabelNameWorkload, Value: name},
+			&typesv1.LabelPair{Name: LabelNameWorkloadKind, Value: strings.ToLower(kind)},
+		)
+	}
+	for _, name := range e.cfg.PodLabels {
+		if value := pod.Labels[name]; value != "" {
+			labels = append(labels, &typesv1.LabelPair{Name: validation.SanitizeLabelName(name), Value: value})
+		}
+	}
+	return labels, nil
+}
+
+// workload returns the kind and the name of the workload controlling the pod: the deployment of
+// its replica set, the cron job of its job, or its controller otherwise. The name is empty when
+// the pod has no controller.
+func (e *kubernetesEnricher) workload(ctx context.Context, pod *corev1.Pod) (kind, name string, err error) {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return "", "", nil
+	}
+	var parent *metav1.OwnerReference
+	switch owner.Kind {
+	case "ReplicaSet":
+		rs, err := e.client.AppsV1().ReplicaSets(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", "", err
+		}
+		if err == nil {
+			parent = metav1.GetControllerOf(rs)
+		}
+	case "Job":
+		job, err := e.client.BatchV1().Jobs(pod.Namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return "", "", err
+		}
+		if err == nil {
+			parent = metav1.GetControllerOf(job)
+		}
+	}
+	if parent != nil {
+		return parent.Kind, parent.Name, nil
+	}
+	return owner.Kind, owner.Name, nil
+}
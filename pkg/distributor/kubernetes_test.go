@@ -0,0 +1,93 @@
+package distributor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+func controlledBy(kind, name string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, Controller: &controller}}
+}
+
+func Test_KubernetesEnricher(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "prod", Name: "checkout-5d8f7", OwnerReferences: controlledBy("Deployment", "checkout"),
+		}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "prod", Name: "checkout-5d8f7-x2k4p", OwnerReferences: controlledBy("ReplicaSet", "checkout-5d8f7"),
+			Labels: map[string]string{"app.kubernetes.io/version": "v1.2.3"},
+		}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "prod", Name: "db-0", OwnerReferences: controlledBy("StatefulSet", "db"),
+		}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "dev", Name: "debug"}},
+	)
+	cfg := KubernetesEnrichmentConfig{
+		Enabled:        true,
+		CacheTTL:       time.Minute,
+		LookupTimeout:  time.Second,
+		PodLabel:       "pod",
+		NamespaceLabel: "namespace",
+		PodLabels:      []string{"app.kubernetes.io/version"},
+	}
+	require.NoError(t, cfg.Validate())
+	m := newMetrics(nil)
+	e := newKubernetesEnricher(cfg, client, m, log.NewNopLogger())
+	now := time.Unix(0, 0)
+	e.now = func() time.Time { return now }
+
+	lbls := func(pairs ...string) []*typesv1.LabelPair {
+		ls := make([]*typesv1.LabelPair, 0, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			ls = append(ls, &typesv1.LabelPair{Name: pairs[i], Value: pairs[i+1]})
+		}
+		return ls
+	}
+
+	require.Equal(t, lbls(
+		"app_kubernetes_io_version", "v1.2.3",
+		"namespace", "prod",
+		"pod", "checkout-5d8f7-x2k4p",
+		"service_name", "checkout",
+		"workload", "checkout",
+		"workload_kind", "deployment",
+	), e.enrich(lbls("namespace", "prod", "pod", "checkout-5d8f7-x2k4p", "service_name", "checkout")))
+
+	// the namespace is found by the name of the pod, and the labels of the series are kept.
+	require.Equal(t, lbls(
+		"namespace", "prod",
+		"pod", "db-0",
+		"workload", "primary",
+		"workload_kind", "statefulset",
+	), e.enrich(lbls("pod", "db-0", "workload", "primary")))
+
+	// the pods without controller only have their namespace.
+	require.Equal(t, lbls("namespace", "dev", "pod", "debug"), e.enrich(lbls("pod", "debug")))
+
+	require.Equal(t, lbls("namespace", "prod", "pod", "unknown"), e.enrich(lbls("namespace", "prod", "pod", "unknown")))
+	require.Equal(t, lbls("service_name", "api"), e.enrich(lbls("service_name", "api")))
+	require.Equal(t, float64(3), testutil.ToFloat64(m.kubernetesLookups.WithLabelValues("found")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.kubernetesLookups.WithLabelValues("not_found")))
+
+	// the lookups are cached until the TTL.
+	e.enrich(lbls("namespace", "prod", "pod", "checkout-5d8f7-x2k4p"))
+	require.Equal(t, float64(3), testutil.ToFloat64(m.kubernetesLookups.WithLabelValues("found")))
+	now = now.Add(time.Minute)
+	e.enrich(lbls("namespace", "prod", "pod", "checkout-5d8f7-x2k4p"))
+	require.Equal(t, float64(4), testutil.ToFloat64(m.kubernetesLookups.WithLabelValues("found")))
+
+	var nilEnricher *kubernetesEnricher
+	require.Equal(t, lbls("pod", "a"), nilEnricher.enrich(lbls("pod", "a")))
+}
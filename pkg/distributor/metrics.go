@@ -8,6 +8,17 @@ type metrics struct {
 	receivedCompressedBytes   *prometheus.HistogramVec
 	receivedDecompressedBytes *prometheus.HistogramVec
 	receivedSamples           *prometheus.HistogramVec
+	deduplicatedPushes        *prometheus.CounterVec
+	forwardedPushes           *prometheus.CounterVec
+	exportedMetricsWrites     *prometheus.CounterVec
+	inflightPushes            prometheus.Gauge
+	batchedSeries             prometheus.Histogram
+	overflowedLabelValues     *prometheus.CounterVec
+	rewrittenLabelValues      *prometheus.CounterVec
+	repairedSymbols           *prometheus.CounterVec
+	truncatedFunctionNames    *prometheus.CounterVec
+	kubernetesLookups         *prometheus.CounterVec
+	clampedTimestamps         *prometheus.CounterVec
 }
 
 func newMetrics(reg prometheus.Registerer) *metrics {
@@ -39,12 +50,110 @@ func newMetrics(reg prometheus.Registerer) *metrics {
 			},
 			[]string{"type", "tenant"},
 		),
+		deduplicatedPushes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_deduplicated_pushes_total",
+				Help:      "The number of pushes acknowledged without being ingested because they were already ingested.",
+			},
+			[]string{"tenant"},
+		),
+		forwardedPushes: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_forwarded_pushes_total",
+				Help:      "The number of pushes forwarded to the forwarding endpoint, by result.",
+			},
+			[]string{"tenant", "result"},
+		),
+		exportedMetricsWrites: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_metrics_export_writes_total",
+				Help:      "The number of writes of the exported metrics to the remote write endpoint, by result.",
+			},
+			[]string{"result"},
+		),
+		inflightPushes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "phlare",
+				Name:      "distributor_inflight_push_requests",
+				Help:      "The number of push requests being processed by the distributor.",
+			},
+		),
+		batchedSeries: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "phlare",
+				Name:      "distributor_push_batch_series",
+				Help:      "The number of series per batch of pushes sent to an ingester.",
+				Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+			},
+		),
+		overflowedLabelValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_pprof_label_values_overflowed_total",
+				Help:      "The number of pprof label values replaced because their key exceeded the limit of distinct values, or the limit of distinct keys.",
+			},
+			[]string{"tenant"},
+		),
+		rewrittenLabelValues: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_label_values_rewritten_total",
+				Help:      "The number of series label values replaced because the label name exceeded the limit of distinct values.",
+			},
+			[]string{"tenant"},
+		),
+		repairedSymbols: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_repaired_symbols_total",
+				Help:      "The number of malformed or duplicate symbol records of the ingested profiles, repaired or rejected, by kind.",
+			},
+			[]string{"tenant", "kind"},
+		),
+		truncatedFunctionNames: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_truncated_function_names_total",
+				Help:      "The number of function names of the ingested profiles truncated because they exceeded the maximum length.",
+			},
+			[]string{"tenant"},
+		),
+		kubernetesLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_kubernetes_lookups_total",
+				Help:      "The number of lookups of the workloads of the pods in the Kubernetes API, by result.",
+			},
+			[]string{"result"},
+		),
+		clampedTimestamps: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "phlare",
+				Name:      "distributor_clamped_timestamps_total",
+				Help:      "The number of ingested profiles whose timestamps beyond the creation grace period were set to the time they were received.",
+			},
+			[]string{"tenant"},
+		),
 	}
 	if reg != nil {
 		reg.MustRegister(
 			m.receivedCompressedBytes,
 			m.receivedDecompressedBytes,
 			m.receivedSamples,
+			m.deduplicatedPushes,
+			m.forwardedPushes,
+			m.exportedMetricsWrites,
+			m.inflightPushes,
+			m.batchedSeries,
+			m.overflowedLabelValues,
+			m.rewrittenLabelValues,
+			m.repairedSymbols,
+			m.truncatedFunctionNames,
+			m.kubernetesLookups,
+			m.clampedTimestamps,
 		)
 	}
 	return m
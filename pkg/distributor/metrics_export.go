@@ -0,0 +1,350 @@
+package distributor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/grafana/dskit/flagext"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// MetricsExportConfig configures the export of counters derived from the ingested profiles to a
+// Prometheus remote write endpoint.
+type MetricsExportConfig struct {
+	RemoteWriteURL    string              `yaml:"remote_write_url" category:"advanced"`
+	BasicAuthUsername string              `yaml:"basic_auth_username" category:"advanced"`
+	BasicAuthPassword flagext.Secret      `yaml:"basic_auth_password" category:"advanced"`
+	BearerToken       flagext.Secret      `yaml:"bearer_token" category:"advanced"`
+	Interval          time.Duration       `yaml:"interval" category:"advanced"`
+	Timeout           time.Duration       `yaml:"timeout" category:"advanced"`
+	IdleTimeout       time.Duration       `yaml:"idle_timeout" category:"advanced"`
+	Rules             []MetricsExportRule `yaml:"rules" category:"advanced" doc:"description=Counters derived from the ingested profiles. Each counter is the sum of the sample values of the profiles of a profile type, by the labels of their series."`
+}
+
+// MetricsExportRule describes a counter derived from the ingested profiles.
+type MetricsExportRule struct {
+	Name        string   `yaml:"name" doc:"description=Name of the counter, e.g. phlare_profile_cpu_seconds_total."`
+	ProfileType string   `yaml:"profile_type" doc:"description=ID of the profile type counted, e.g. process_cpu:cpu:nanoseconds:cpu:nanoseconds."`
+	Selector    string   `yaml:"selector" doc:"description=Label selector of the series counted. All the series of the profile type are counted when empty."`
+	Labels      []string `yaml:"labels" doc:"description=Labels of the series kept on the counter, e.g. service_name. The counters also have the tenant and instance labels. Prefer labels with few values: the counters are kept in memory."`
+	Scale       float64  `yaml:"scale" doc:"description=Factor applied to the sample values, e.g. 1e-9 to count nanoseconds in seconds. 1 when unset."`
+}
+
+// RegisterFlags registers the metrics export flags.
+func (cfg *MetricsExportConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.RemoteWriteURL, "distributor.metrics-export.remote-write-url", "", "URL of the Prometheus remote write endpoint the counters derived from the ingested profiles are written to. The export is disabled when empty.")
+	f.StringVar(&cfg.BasicAuthUsername, "distributor.metrics-export.basic-auth-username", "", "Username used to authenticate to the remote write endpoint with basic auth.")
+	f.Var(&cfg.BasicAuthPassword, "distributor.metrics-export.basic-auth-password", "Password used to authenticate to the remote write endpoint with basic auth.")
+	f.Var(&cfg.BearerToken, "distributor.metrics-export.bearer-token", "Bearer token used to authenticate to the remote write endpoint.")
+	f.DurationVar(&cfg.Interval, "distributor.metrics-export.interval", 15*time.Second, "Interval at which the counters are written to the remote write endpoint.")
+	f.DurationVar(&cfg.Timeout, "distributor.metrics-export.timeout", 10*time.Second, "Timeout of a remote write request.")
+	f.DurationVar(&cfg.IdleTimeout, "distributor.metrics-export.idle-timeout", time.Hour, "Counters not incremented for this long are no longer written and are dropped from memory, e.g. the counters of the tenants and services gone. They start over if they are incremented again. 0 to keep them until the distributor restarts.")
+}
+
+// Validate validates the metrics export config.
+func (cfg *MetricsExportConfig) Validate() error {
+	if cfg.RemoteWriteURL == "" {
+		return nil
+	}
+	if _, err := url.Parse(cfg.RemoteWriteURL); err != nil {
+		return fmt.Errorf("invalid metrics export remote write url: %w", err)
+	}
+	if cfg.BasicAuthUsername != "" && cfg.BearerToken.String() != "" {
+		return errors.New("metrics export basic auth and bearer token are mutually exclusive")
+	}
+	if cfg.Interval <= 0 {
+		return errors.New("metrics export interval must be positive")
+	}
+	if cfg.IdleTimeout < 0 {
+		return errors.New("metrics export idle timeout must not be negative")
+	}
+	_, err := cfg.rules()
+	return err
+}
+
+type exportRule struct {
+	MetricsExportRule
+	matchers []*labels.Matcher
+}
+
+func (cfg *MetricsExportConfig) rules() ([]*exportRule, error) {
+	rules := make([]*exportRule, 0, len(cfg.Rules))
+	names := make(map[string]bool, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		if !model.IsValidMetricName(model.LabelValue(r.Name)) {
+			return nil, fmt.Errorf("invalid metrics export rule name %q", r.Name)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate metrics export rule %q", r.Name)
+		}
+		names[r.Name] = true
+		if _, err := phlaremodel.ParseProfileTypeSelector(r.ProfileType); err != nil {
+			return nil, fmt.Errorf("invalid profile type of metrics export rule %q: %w", r.Name, err)
+		}
+		for _, l := range r.Labels {
+			if !model.LabelName(l).IsValid() || l == labels.MetricName || l == "instance" || l == "tenant" {
+				return nil, fmt.Errorf("invalid label %q of metrics export rule %q", l, r.Name)
+			}
+		}
+		rule := &exportRule{MetricsExportRule: r}
+		if rule.Scale == 0 {
+			rule.Scale = 1
+		}
+		if r.Selector != "" {
+			matchers, err := parser.ParseMetricSelector(r.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid selector of metrics export rule %q: %w", r.Name, err)
+			}
+			rule.matchers = matchers
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (r *exportRule) matches(ls phlaremodel.Labels) bool {
+	for _, m := range r.matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// counterIncrement is an increment of an exported counter, identified by its labels.
+type counterIncrement struct {
+	labels []prompb.Label
+	value  float64
+}
+
+// exportedCounter is an exported counter and the time it was last incremented at.
+type exportedCounter struct {
+	counterIncrement
+	updated time.Time
+}
+
+// metricsExporter keeps the counters derived from the ingested profiles in memory and writes
+// them to the remote write endpoint at every interval. The counters are cumulative, so a failed
+// write is caught up by the next one. They start over when the distributor restarts, which
+// rate() and increase() handle as counter resets. Counters idle for longer than the idle
+// timeout are dropped once their last value is written.
+type metricsExporter struct {
+	services.Service
+
+	cfg        MetricsExportConfig
+	rules      []*exportRule
+	instanceID string
+	client     *http.Client
+	logger     log.Logger
+	metrics    *metrics
+
+	mtx      sync.Mutex
+	counters map[string]*exportedCounter
+}
+
+func newMetricsExporter(cfg MetricsExportConfig, instanceID string, client *http.Client, m *metrics, logger log.Logger) (*metricsExporter, error) {
+	rules, err := cfg.rules()
+	if err != nil {
+		return nil, err
+	}
+	e := &metricsExporter{
+		cfg:        cfg,
+		rules:      rules,
+		instanceID: instanceID,
+		client:     client,
+		logger:     log.With(logger, "component", "metrics-exporter"),
+		metrics:    m,
+		counters:   make(map[string]*exportedCounter),
+	}
+	e.Service = services.NewTimerService(cfg.Interval, nil, e.iteration, e.stopping)
+	return e, nil
+}
+
+// observe appends the increments of the counters of the rules matching the profile. They are
+// only added to the counters once the push succeeds.
+func (e *metricsExporter) observe(tenantID string, series []*typesv1.LabelPair, p *profilev1.Profile, increments []counterIncrement) []counterIncrement {
+	ls := phlaremodel.Labels(series)
+	var periodType, periodUnit string
+	if p.PeriodType != nil {
+		periodType, periodUnit = p.StringTable[p.PeriodType.Type], p.StringTable[p.PeriodType.Unit]
+	}
+	for i, st := range p.SampleType {
+		profileType := strings.Join([]string{
+			ls.Get(labels.MetricName),
+			p.StringTable[st.Type],
+			p.StringTable[st.Unit],
+			periodType,
+			periodUnit,
+		}, ":")
+		var (
+			total  int64
+			summed bool
+		)
+		for _, r := range e.rules {
+			if r.ProfileType != profileType || !r.matches(ls) {
+				continue
+			}
+			if !summed {
+				for _, s := range p.Sample {
+					total += s.Value[i]
+				}
+				summed = true
+			}
+			lbls := make([]prompb.Label, 0, len(r.Labels)+3)
+			lbls = append(lbls,
+				prompb.Label{Name: labels.MetricName, Value: r.Name},
+				prompb.Label{Name: "instance", Value: e.instanceID},
+				prompb.Label{Name: "tenant", Value: tenantID},
+			)
+			for _, name := range r.Labels {
+				if v := ls.Get(name); v != "" {
+					lbls = append(lbls, prompb.Label{Name: name, Value: v})
+				}
+			}
+			sort.Slice(lbls, func(i, j int) bool { return lbls[i].Name < lbls[j].Name })
+			increments = append(increments, counterIncrement{labels: lbls, value: float64(total) * r.Scale})
+		}
+	}
+	return increments
+}
+
+// add adds the increments to the counters.
+func (e *metricsExporter) add(increments []counterIncrement) {
+	if len(increments) == 0 {
+		return
+	}
+	now := time.Now()
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for _, inc := range increments {
+		key := counterKey(inc.labels)
+		c, ok := e.counters[key]
+		if !ok {
+			c = &exportedCounter{counterIncrement: counterIncrement{labels: inc.labels}}
+			e.counters[key] = c
+		}
+		c.value += inc.value
+		c.updated = now
+	}
+}
+
+func counterKey(ls []prompb.Label) string {
+	var sb strings.Builder
+	for _, l := range ls {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0xff)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+func (e *metricsExporter) iteration(ctx context.Context) error {
+	if err := e.write(ctx); err != nil {
+		e.metrics.exportedMetricsWrites.WithLabelValues("failure").Inc()
+		level.Warn(e.logger).Log("msg", "failed to write exported metrics", "err", err)
+		return nil
+	}
+	e.metrics.exportedMetricsWrites.WithLabelValues("success").Inc()
+	return nil
+}
+
+// stopping writes the counters a last time, so the increments since the last interval are not
+// lost.
+func (e *metricsExporter) stopping(_ error) error {
+	return e.iteration(context.Background())
+}
+
+// write sends the current value of the counters to the remote write endpoint, then drops the
+// idle counters.
+func (e *metricsExporter) write(ctx context.Context) error {
+	now := time.Now()
+	req := &prompb.WriteRequest{}
+	e.mtx.Lock()
+	for _, c := range e.counters {
+		req.Timeseries = append(req.Timeseries, prompb.TimeSeries{
+			Labels:  c.labels,
+			Samples: []prompb.Sample{{Value: c.value, Timestamp: now.UnixMilli()}},
+		})
+	}
+	e.mtx.Unlock()
+	if len(req.Timeseries) == 0 {
+		return nil
+	}
+	if err := e.send(ctx, req); err != nil {
+		return err
+	}
+	e.evictIdle(now)
+	return nil
+}
+
+// evictIdle drops the counters idle for longer than the idle timeout at the time of a successful
+// write: their last value was part of it.
+func (e *metricsExporter) evictIdle(written time.Time) {
+	if e.cfg.IdleTimeout <= 0 {
+		return
+	}
+	deadline := written.Add(-e.cfg.IdleTimeout)
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	for key, c := range e.counters {
+		if c.updated.Before(deadline) {
+			delete(e.counters, key)
+		}
+	}
+}
+
+// send sends a write request to the remote write endpoint.
+func (e *metricsExporter) send(ctx context.Context, req *prompb.WriteRequest) error {
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.RemoteWriteURL, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	switch {
+	case e.cfg.BearerToken.String() != "":
+		httpReq.Header.Set("Authorization", "Bearer "+e.cfg.BearerToken.String())
+	case e.cfg.BasicAuthUsername != "":
+		httpReq.SetBasicAuth(e.cfg.BasicAuthUsername, e.cfg.BasicAuthPassword.String())
+	}
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package distributor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// pprofLabelValuesPeriod is the period after which the values of the pprof labels of a tenant
+// are forgotten, so the values which are not used anymore stop counting against the limit. The
+// tenants whose values expired are forgotten too.
+const pprofLabelValuesPeriod = time.Hour
+
+// maxPprofLabelKeys is the maximum number of distinct keys of the pprof labels tracked per
+// tenant. All the values of the further keys are replaced, so the keys don't grow the memory of
+// the limiter without bound.
+const maxPprofLabelKeys = 1000
+
+// pprofLabelValuesLimiter bounds the number of distinct values per key of the pprof labels of
+// the samples, such as endpoints or user IDs, which would otherwise explode the cardinality of
+// the stored profiles. The values are tracked by each distributor: the limit applies to the pushes
+// a distributor receives, not to the cluster.
+type pprofLabelValuesLimiter struct {
+	limits  Limits
+	metrics *metrics
+	now     func() time.Time
+
+	mtx       sync.Mutex
+	tenants   map[string]*tenantLabelValues
+	nextSweep time.Time
+}
+
+type tenantLabelValues struct {
+	mtx    sync.Mutex
+	expiry time.Time
+	keys   map[string]map[string]struct{}
+}
+
+func newPprofLabelValuesLimiter(limits Limits, m *metrics) *pprofLabelValuesLimiter {
+	return &pprofLabelValuesLimiter{
+		limits:  limits,
+		metrics: m,
+		now:     time.Now,
+		tenants: map[string]*tenantLabelValues{},
+	}
+}
+
+// limit replaces the values of the pprof labels of the profile beyond the limit of the tenant by
+// validation.OverflowProfileLabelValue.
+func (l *pprofLabelValuesLimiter) limit(tenantID string, p *pprof.Profile) {
+	max := l.limits.MaxProfileLabelValues(tenantID)
+	if max <= 0 {
+		return
+	}
+	t := l.tenant(tenantID)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if now := l.now(); now.After(t.expiry) {
+		t.expiry = now.Add(pprofLabelValuesPeriod)
+		t.keys = map[string]map[string]struct{}{}
+	}
+	p.ReplaceLabelValues(func(key, value string) bool {
+		values, ok := t.keys[key]
+		if !ok {
+			if len(t.keys) >= maxPprofLabelKeys {
+				l.metrics.overflowedLabelValues.WithLabelValues(tenantID).Inc()
+				return true
+			}
+			values = map[string]struct{}{}
+			t.keys[key] = values
+		}
+		if _, ok := values[value]; ok {
+			return false
+		}
+		if len(values) < max {
+			values[value] = struct{}{}
+			return false
+		}
+		l.metrics.overflowedLabelValues.WithLabelValues(tenantID).Inc()
+		return true
+	}, validation.OverflowProfileLabelValue)
+}
+
+func (l *pprofLabelValuesLimiter) tenant(tenantID string) *tenantLabelValues {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.sweep(l.now())
+	t, ok := l.tenants[tenantID]
+	if !ok {
+		t = &tenantLabelValues{}
+		l.tenants[tenantID] = t
+	}
+	return t
+}
+
+// sweep forgets the tenants whose values expired, which would be reset anyway. It runs at most
+// once per period.
+func (l *pprofLabelValuesLimiter) sweep(now time.Time) {
+	if now.Before(l.nextSweep) {
+		return
+	}
+	l.nextSweep = now.Add(pprofLabelValuesPeriod)
+	for tenantID, t := range l.tenants {
+		t.mtx.Lock()
+		expired := now.After(t.expiry)
+		t.mtx.Unlock()
+		if expired {
+			delete(l.tenants, tenantID)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package distributor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+)
+
+const (
+	pushCaptureFilePrefix = "push-capture-"
+	pushCaptureFileSuffix = ".jsonl"
+	// pushCaptureFiles is the number of files the captured pushes are rotated over: the oldest
+	// file is removed when the total size exceeds the limit.
+	pushCaptureFiles = 8
+	// pushCaptureQueueLength bounds the captured pushes waiting to be written, the pushes captured
+	// while it is full are dropped.
+	pushCaptureQueueLength = 64
+)
+
+// PushCaptureConfig configures the capture of the raw push requests to the local disk, to
+// reproduce the issues of the ingested profiles exactly.
+type PushCaptureConfig struct {
+	Dir             string                 `yaml:"dir" category:"experimental"`
+	SampleRatio     float64                `yaml:"sample_ratio" category:"experimental"`
+	MaxSizeBytes    int64                  `yaml:"max_size_bytes" category:"experimental"`
+	Tenants         flagext.StringSliceCSV `yaml:"tenants" category:"experimental"`
+	RedactTenantIDs bool                   `yaml:"redact_tenant_ids" category:"experimental"`
+}
+
+// RegisterFlags registers the push capture flags.
+func (cfg *PushCaptureConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&cfg.Dir, "distributor.push-capture.dir", "", "Directory the sampled push requests are captured to, as received, for debugging. The captured pushes can be replayed with 'profilecli push-capture replay'. The capture is disabled when empty.")
+	f.Float64Var(&cfg.SampleRatio, "distributor.push-capture.sample-ratio", 0.01, "Fraction of the push requests captured, between 0 and 1.")
+	f.Int64Var(&cfg.MaxSizeBytes, "distributor.push-capture.max-size-bytes", 1<<30, "Maximum size of the captured pushes. The files of the oldest captures are removed once it is exceeded.")
+	f.Var(&cfg.Tenants, "distributor.push-capture.tenants", "Comma-separated list of the tenants whose pushes are captured. All the tenants when empty.")
+	f.BoolVar(&cfg.RedactTenantIDs, "distributor.push-capture.redact-tenant-ids", false, "Replace the tenant IDs of the captured pushes by their hash.")
+}
+
+// Validate validates the push capture config.
+func (cfg *PushCaptureConfig) Validate() error {
+	if cfg.Dir == "" {
+		return nil
+	}
+	if cfg.SampleRatio <= 0 || cfg.SampleRatio > 1 {
+		return fmt.Errorf("push capture sample ratio must be greater than 0 and at most 1, got %v", cfg.SampleRatio)
+	}
+	if cfg.MaxSizeBytes <= 0 {
+		return errors.New("push capture max size must be positive")
+	}
+	return nil
+}
+
+// CapturedPush is a push request captured as received, before the profiles are rewritten.
+type CapturedPush struct {
+	Time     time.Time `json:"time"`
+	TenantID string    `json:"tenantID"`
+	// Request is the push request, encoded in protobuf.
+	Request []byte `json:"request"`
+}
+
+// PushRequest decodes the captured push request.
+func (c *CapturedPush) PushRequest() (*pushv1.PushRequest, error) {
+	req := &pushv1.PushRequest{}
+	if err := req.UnmarshalVT(c.Request); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadPushCaptures calls fn for each push captured to the file read by r.
+func ReadPushCaptures(r io.Reader, fn func(*CapturedPush) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<30)
+	for scanner.Scan() {
+		var c CapturedPush
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return err
+		}
+		if err := fn(&c); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// pushCapturer appends a sample of the push requests to files of the capture directory, one JSON
+// document per line. The files are rotated, and the oldest ones are removed to bound the size of
+// the capture. The pushes are written in the background, so the disk doesn't slow them down.
+type pushCapturer struct {
+	cfg     PushCaptureConfig
+	tenants map[string]struct{}
+	logger  log.Logger
+	sample  func() float64
+	now     func() time.Time
+
+	// mtx orders the captures with the close of the queue.
+	mtx    sync.Mutex
+	closed bool
+	queue  chan capturedData
+	done   chan struct{}
+
+	// the files are only accessed by the goroutine writing the queue.
+	files    []string // the oldest first, the last one is written.
+	sizes    map[string]int64
+	size     int64
+	current  *os.File
+	fileSize int64
+	closeErr error
+}
+
+type capturedData struct {
+	time time.Time
+	data []byte
+}
+
+func newPushCapturer(cfg PushCaptureConfig, logger log.Logger) (*pushCapturer, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &pushCapturer{
+		cfg:    cfg,
+		logger: logger,
+		sample: rand.Float64,
+		now:    time.Now,
+		queue:  make(chan capturedData, pushCaptureQueueLength),
+		done:   make(chan struct{}),
+		sizes:  map[string]int64{},
+	}
+	if len(cfg.Tenants) > 0 {
+		c.tenants = make(map[string]struct{}, len(cfg.Tenants))
+		for _, t := range cfg.Tenants {
+			c.tenants[t] = struct{}{}
+		}
+	}
+	// the captures from before a restart count against the limit.
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), pushCaptureFilePrefix) || !strings.HasSuffix(e.Name(), pushCaptureFileSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(cfg.Dir, e.Name())
+		c.files = append(c.files, path)
+		c.sizes[path] = info.Size()
+		c.size += info.Size()
+	}
+	// the names of the files sort by creation time.
+	sort.Strings(c.files)
+	go c.run()
+	return c, nil
+}
+
+// run writes the captured pushes until the queue is closed.
+func (c *pushCapturer) run() {
+	defer close(c.done)
+	for captured := range c.queue {
+		if err := c.write(captured); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to write captured push", "err", err)
+		}
+	}
+	if c.current != nil {
+		c.closeErr = c.current.Close()
+		c.current = nil
+	}
+}
+
+// capture records the push request if it is sampled.
+func (c *pushCapturer) capture(tenantID string, req *pushv1.PushRequest) {
+	if c.tenants != nil {
+		if _, ok := c.tenants[tenantID]; !ok {
+			return
+		}
+	}
+	if c.sample() >= c.cfg.SampleRatio {
+		return
+	}
+	raw, err := req.MarshalVT()
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to encode captured push", "err", err)
+		return
+	}
+	if c.cfg.RedactTenantIDs {
+		tenantID = fmt.Sprintf("%016x", xxhash.Sum64String(tenantID))
+	}
+	now := c.now()
+	data, err := json.Marshal(&CapturedPush{Time: now, TenantID: tenantID, Request: raw})
+	if err != nil {
+		level.Warn(c.logger).Log("msg", "failed to encode captured push", "err", err)
+		return
+	}
+	data = append(data, '\n')
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- capturedData{time: now, data: data}:
+	default:
+		level.Warn(c.logger).Log("msg", "push capture queue full, dropping captured push", "tenant", tenantID)
+	}
+}
+
+func (c *pushCapturer) write(captured capturedData) error {
+	data := captured.data
+	if c.current == nil || c.fileSize+int64(len(data)) > c.cfg.MaxSizeBytes/pushCaptureFiles {
+		if err := c.rotate(captured.time); err != nil {
+			return err
+		}
+	}
+	n, err := c.current.Write(data)
+	c.fileSize += int64(n)
+	c.sizes[c.current.Name()] += int64(n)
+	c.size += int64(n)
+	c.removeOldest()
+	return err
+}
+
+// rotate closes the current file and creates a new one, named after the time of the first push
+// written to it.
+func (c *pushCapturer) rotate(now time.Time) error {
+	if c.current != nil {
+		if err := c.current.Close(); err != nil {
+			level.Warn(c.logger).Log("msg", "failed to close push capture file", "err", err)
+		}
+		c.current = nil
+	}
+	path := filepath.Join(c.cfg.Dir, fmt.Sprintf("%s%020d%s", pushCaptureFilePrefix, now.UnixNano(), pushCaptureFileSuffix))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	c.current, c.fileSize = f, 0
+	if _, ok := c.sizes[path]; !ok {
+		c.files = append(c.files, path)
+		c.sizes[path] = 0
+	}
+	return nil
+}
+
+// removeOldest removes the oldest files until the capture fits in its size. The file written is
+// kept.
+func (c *pushCapturer) removeOldest() {
+	for c.size > c.cfg.MaxSizeBytes && len(c.files) > 1 {
+		oldest := c.files[0]
+		c.files = c.files[1:]
+		c.size -= c.sizes[oldest]
+		delete(c.sizes, oldest)
+		if err := os.Remove(oldest); err != nil && !os.IsNotExist(err) {
+			level.Warn(c.logger).Log("msg", "failed to remove push capture file", "file", oldest, "err", err)
+		}
+	}
+}
+
+// close writes the pushes captured so far and closes the capture. The pushes captured afterwards
+// are ignored.
+func (c *pushCapturer) close() error {
+	c.mtx.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	c.mtx.Unlock()
+	<-c.done
+	return c.closeErr
+}
@@ -0,0 +1,32 @@
+package distributor
+
+import (
+	"sort"
+
+	"github.com/prometheus/common/model"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/pprof"
+)
+
+// addRuntimeLabels labels the series with the runtime detected from its profiles. The labels
+// already set by the client are kept.
+func addRuntimeLabels(ls []*typesv1.LabelPair, r pprof.Runtime) []*typesv1.LabelPair {
+	add := func(name, value string) {
+		if value == "" || !model.LabelName(name).IsValid() || phlaremodel.Labels(ls).Get(name) != "" {
+			return
+		}
+		ls = append(ls, &typesv1.LabelPair{Name: name, Value: value})
+	}
+	n := len(ls)
+	add(phlaremodel.LabelNameRuntime, r.Name)
+	if r.Name != "" {
+		add(r.Name+"_version", r.Version)
+	}
+	add(phlaremodel.LabelNameSpy, r.Spy)
+	if len(ls) != n {
+		sort.Sort(phlaremodel.Labels(ls))
+	}
+	return ls
+}
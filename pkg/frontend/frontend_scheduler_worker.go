@@ -25,6 +25,7 @@ import (
 	"github.com/grafana/phlare/pkg/frontend/frontendpb"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerdiscovery"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerpb"
+	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/util/httpgrpc"
 	"github.com/grafana/phlare/pkg/util/servicediscovery"
 )
@@ -202,6 +203,7 @@ func (f *frontendSchedulerWorkers) connectToScheduler(ctx context.Context, addre
 	if err != nil {
 		return nil, err
 	}
+	opts = append(opts, tenant.InternalSecretDialOption(f.cfg.InternalSecret))
 
 	conn, err := grpc.DialContext(ctx, address, opts...)
 	if err != nil {
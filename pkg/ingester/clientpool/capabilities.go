@@ -0,0 +1,171 @@
+package clientpool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/grafana/dskit/ring"
+	ring_client "github.com/grafana/dskit/ring/client"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+// The optional features of the ingester API. Older ingesters ignore the fields they don't know
+// and reject the endpoints they don't implement, so a client only uses a feature once all the
+// ingesters it queries advertise it, which lets it roll out without a flag-day.
+const (
+	// FeatureMergeSampling is the sampling of the row groups merged by MergeProfilesStacktraces.
+	FeatureMergeSampling = "merge_sampling"
+	// FeatureFunctionFilter is the filter of the profile values by function of MergeProfilesLabels.
+	FeatureFunctionFilter = "function_filter"
+	// FeatureStackFilter is the filter of the profile values by stack of MergeProfilesLabels.
+	FeatureStackFilter = "stack_filter"
+	// FeatureStorageUsage is the StorageUsage endpoint.
+	FeatureStorageUsage = "storage_usage"
+	// FeatureProfileIDs are the SelectProfileIDs and GetProfile endpoints.
+	FeatureProfileIDs = "profile_ids"
+	// FeatureHistograms is the SelectHistograms endpoint.
+	FeatureHistograms = "histograms"
+	// FeatureMultiSelect is the merge of several requests by MergeProfilesStacktraces.
+	FeatureMultiSelect = "multi_select"
+	// FeatureTargetMetadata is the SelectTargetMetadata endpoint.
+	FeatureTargetMetadata = "target_metadata"
+	// FeatureBlockMetadata is the BlockMetadata endpoint.
+	FeatureBlockMetadata = "block_metadata"
+)
+
+// Features are the features supported by this version of the ingester.
+var Features = []string{
+	FeatureMergeSampling,
+	FeatureFunctionFilter,
+	FeatureStackFilter,
+	FeatureStorageUsage,
+	FeatureProfileIDs,
+	FeatureHistograms,
+	FeatureMultiSelect,
+	FeatureTargetMetadata,
+	FeatureBlockMetadata,
+}
+
+// capabilitiesExpiry is how long the features of an ingester are kept once it's no longer
+// queried, typically because it left the ring.
+const capabilitiesExpiry = time.Hour
+
+type CapabilitiesClient interface {
+	Capabilities(context.Context, *connect.Request[ingestv1.CapabilitiesRequest]) (*connect.Response[ingestv1.CapabilitiesResponse], error)
+}
+
+// Capabilities negotiates the features used with the ingesters. The features of an ingester
+// are requested once per registration in the ring, so they are requested again when it restarts
+// with a new version.
+type Capabilities struct {
+	pool *ring_client.Pool
+
+	mtx       sync.Mutex
+	instances map[string]*instanceCapabilities
+}
+
+type instanceCapabilities struct {
+	registered int64
+	lastUsed   time.Time
+	features   map[string]struct{}
+}
+
+func NewCapabilities(pool *ring_client.Pool) *Capabilities {
+	return &Capabilities{
+		pool:      pool,
+		instances: make(map[string]*instanceCapabilities),
+	}
+}
+
+// Supported returns whether all the instances support the feature. The instances which don't
+// implement the Capabilities endpoint support none. The instances which can't be reached are
+// ignored, as the requests sent to them fail anyway.
+func (c *Capabilities) Supported(ctx context.Context, instances []ring.InstanceDesc, feature string) bool {
+	now := time.Now()
+	c.mtx.Lock()
+	var missing []ring.InstanceDesc
+	for _, instance := range instances {
+		ic, ok := c.instances[instance.Addr]
+		if !ok || ic.registered != instance.RegisteredTimestamp {
+			missing = append(missing, instance)
+			continue
+		}
+		ic.lastUsed = now
+	}
+	c.mtx.Unlock()
+
+	if len(missing) > 0 {
+		c.fetch(ctx, missing, now)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, instance := range instances {
+		ic, ok := c.instances[instance.Addr]
+		if !ok || ic.registered != instance.RegisteredTimestamp {
+			continue
+		}
+		if _, ok := ic.features[feature]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch requests the features of the instances concurrently.
+func (c *Capabilities) fetch(ctx context.Context, instances []ring.InstanceDesc, now time.Time) {
+	var wg sync.WaitGroup
+	for _, instance := range instances {
+		instance := instance
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			features, err := c.request(ctx, instance.Addr)
+			if err != nil {
+				return
+			}
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+			c.instances[instance.Addr] = &instanceCapabilities{
+				registered: instance.RegisteredTimestamp,
+				lastUsed:   now,
+				features:   features,
+			}
+		}()
+	}
+	wg.Wait()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for addr, ic := range c.instances {
+		if now.Sub(ic.lastUsed) > capabilitiesExpiry {
+			delete(c.instances, addr)
+		}
+	}
+}
+
+func (c *Capabilities) request(ctx context.Context, addr string) (map[string]struct{}, error) {
+	client, err := c.pool.GetClientFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	features := make(map[string]struct{})
+	cc, ok := client.(CapabilitiesClient)
+	if !ok {
+		return features, nil
+	}
+	resp, err := cc.Capabilities(ctx, connect.NewRequest(&ingestv1.CapabilitiesRequest{}))
+	if connect.CodeOf(err) == connect.CodeUnimplemented {
+		return features, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range resp.Msg.Features {
+		features[f] = struct{}{}
+	}
+	return features, nil
+}
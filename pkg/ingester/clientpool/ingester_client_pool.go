@@ -2,8 +2,10 @@ package clientpool
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"io"
+	"net/http"
 	"time"
 
 	"github.com/bufbuild/connect-go"
@@ -12,11 +14,14 @@ import (
 	ring_client "github.com/grafana/dskit/ring/client"
 	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	"github.com/grafana/phlare/api/gen/proto/go/ingester/v1/ingesterv1connect"
+	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/util"
 )
 
@@ -46,6 +51,15 @@ type PoolConfig struct {
 	ClientCleanupPeriod  time.Duration `yaml:"client_cleanup_period"`
 	HealthCheckIngesters bool          `yaml:"health_check_ingesters"`
 	RemoteTimeout        time.Duration `yaml:"remote_timeout"`
+
+	Timeout          time.Duration            `yaml:"timeout" category:"advanced"`
+	EndpointTimeouts map[string]time.Duration `yaml:"endpoint_timeouts" category:"advanced" doc:"description=Timeouts of the requests to the ingesters by endpoint, for example 'LabelValues: 10s', overriding the timeout of all the requests."`
+	MaxRetries       int                      `yaml:"max_retries" category:"advanced"`
+	RetryBackoff     time.Duration            `yaml:"retry_backoff" category:"advanced"`
+	CircuitBreaker   CircuitBreakerConfig     `yaml:"circuit_breaker"`
+
+	// InternalSecret is sent in the requests to the ingesters, see tenant.InternalSecretHeader.
+	InternalSecret string `yaml:"-"`
 }
 
 // RegisterFlagsWithPrefix adds the flags required to config this to the given FlagSet.
@@ -53,11 +67,22 @@ func (cfg *PoolConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	f.DurationVar(&cfg.ClientCleanupPeriod, prefix+".client-cleanup-period", 15*time.Second, "How frequently to clean up clients for ingesters that have gone away.")
 	f.BoolVar(&cfg.HealthCheckIngesters, prefix+".health-check-ingesters", true, "Run a health check on each ingester client during periodic cleanup.")
 	f.DurationVar(&cfg.RemoteTimeout, prefix+".health-check-timeout", 5*time.Second, "Timeout for ingester client healthcheck RPCs.")
+	f.DurationVar(&cfg.Timeout, prefix+".client-timeout", 0, "Timeout of the requests to the ingesters, 0 to only apply the deadline of the request being served.")
+	f.IntVar(&cfg.MaxRetries, prefix+".client-max-retries", 0, "Maximum number of retries of the read requests to an ingester which is unavailable or times out. Pushes are not retried.")
+	f.DurationVar(&cfg.RetryBackoff, prefix+".client-retry-backoff", 100*time.Millisecond, "Base of the exponential backoff between the retries, with full jitter.")
+	cfg.CircuitBreaker.RegisterFlagsWithPrefix(prefix+".client-circuit-breaker", f)
+}
+
+func (cfg *PoolConfig) Validate() error {
+	if cfg.MaxRetries < 0 {
+		return errors.New("the maximum number of retries of the ingester clients must not be negative")
+	}
+	return cfg.CircuitBreaker.Validate()
 }
 
 func NewPool(cfg PoolConfig, ring ring.ReadRing, factory ring_client.PoolFactory, clientsMetric prometheus.Gauge, logger log.Logger, options ...connect.ClientOption) *ring_client.Pool {
 	if factory == nil {
-		factory = PoolFactoryFn(options...)
+		factory = PoolFactoryFn(cfg, logger, options...)
 	}
 	poolCfg := ring_client.PoolConfig{
 		CheckInterval:      cfg.ClientCleanupPeriod,
@@ -68,20 +93,52 @@ func NewPool(cfg PoolConfig, ring ring.ReadRing, factory ring_client.PoolFactory
 	return ring_client.NewPool("ingester", poolCfg, ring_client.NewRingServiceDiscovery(ring), factory, clientsMetric, logger)
 }
 
-func PoolFactoryFn(options ...connect.ClientOption) ring_client.PoolFactory {
+// PoolFactoryFn returns the factory of the ingester clients. The requests of each client are
+// subject to the timeouts, retries and circuit breaker of the config.
+func PoolFactoryFn(cfg PoolConfig, logger log.Logger, options ...connect.ClientOption) ring_client.PoolFactory {
 	return func(addr string) (ring_client.PoolClient, error) {
-		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), tenant.InternalSecretDialOption(cfg.InternalSecret))
 		if err != nil {
 			return nil, err
 		}
 		return &ingesterPoolClient{
-			IngesterServiceClient: ingesterv1connect.NewIngesterServiceClient(util.InstrumentedHTTPClient(), "http://"+addr, options...),
+			IngesterServiceClient: ingesterv1connect.NewIngesterServiceClient(util.InstrumentedHTTPClient(), "http://"+addr, clientOptions(cfg, addr, logger, options)...),
 			HealthClient:          grpc_health_v1.NewHealthClient(conn),
 			Closer:                conn,
 		}, nil
 	}
 }
 
+// NewInProcessClient returns the client of the ingester running in the same process, its requests
+// are served by the handler without going through the network. The ingester is always healthy.
+func NewInProcessClient(cfg PoolConfig, addr string, handler http.Handler, logger log.Logger, options ...connect.ClientOption) ring_client.PoolClient {
+	return &ingesterPoolClient{
+		IngesterServiceClient: ingesterv1connect.NewIngesterServiceClient(util.InProcessHTTPClient(handler), "http://"+addr, clientOptions(cfg, addr, logger, options)...),
+		HealthClient:          inProcessHealthClient{},
+		Closer:                io.NopCloser(nil),
+	}
+}
+
+// clientOptions appends the interceptors sending the internal secret and applying the timeouts,
+// retries and circuit breaker of the config to the options of the client. The resilience
+// interceptor is the innermost one, so that the others run once per request rather than per retry.
+func clientOptions(cfg PoolConfig, addr string, logger log.Logger, options []connect.ClientOption) []connect.ClientOption {
+	return append(options[:len(options):len(options)], connect.WithInterceptors(
+		tenant.NewInternalSecretInterceptor(cfg.InternalSecret),
+		newResilienceInterceptor(cfg, addr, logger),
+	))
+}
+
+type inProcessHealthClient struct{}
+
+func (inProcessHealthClient) Check(context.Context, *grpc_health_v1.HealthCheckRequest, ...grpc.CallOption) (*grpc_health_v1.HealthCheckResponse, error) {
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (inProcessHealthClient) Watch(context.Context, *grpc_health_v1.HealthCheckRequest, ...grpc.CallOption) (grpc_health_v1.Health_WatchClient, error) {
+	return nil, status.Error(codes.Unimplemented, "watch is not supported by the in-process ingester client")
+}
+
 type ingesterPoolClient struct {
 	ingesterv1connect.IngesterServiceClient
 	grpc_health_v1.HealthClient
@@ -0,0 +1,352 @@
+package clientpool
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// CircuitBreakerConfig configures the circuit breaker of the requests sent to each ingester.
+type CircuitBreakerConfig struct {
+	Enabled      bool          `yaml:"enabled" category:"advanced"`
+	FailureRatio float64       `yaml:"failure_ratio" category:"advanced"`
+	MinRequests  int           `yaml:"min_requests" category:"advanced"`
+	Window       time.Duration `yaml:"window" category:"advanced"`
+	OpenDuration time.Duration `yaml:"open_duration" category:"advanced"`
+}
+
+func (cfg *CircuitBreakerConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.BoolVar(&cfg.Enabled, prefix+".enabled", false, "Stop sending requests to an ingester for a while when too many of them fail, instead of waiting for it on every request.")
+	f.Float64Var(&cfg.FailureRatio, prefix+".failure-ratio", 0.5, "Ratio of the requests failing during a window which opens the circuit breaker.")
+	f.IntVar(&cfg.MinRequests, prefix+".min-requests", 20, "Minimum number of requests during a window before the circuit breaker can open.")
+	f.DurationVar(&cfg.Window, prefix+".window", 10*time.Second, "Window over which the failure ratio is computed.")
+	f.DurationVar(&cfg.OpenDuration, prefix+".open-duration", 10*time.Second, "Time during which the requests fail immediately once the circuit breaker opens, before a single request probes the ingester again.")
+}
+
+func (cfg *CircuitBreakerConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.FailureRatio <= 0 || cfg.FailureRatio > 1 {
+		return fmt.Errorf("the circuit breaker failure ratio must be in (0, 1], got %v", cfg.FailureRatio)
+	}
+	if cfg.Window <= 0 || cfg.OpenDuration <= 0 {
+		return errors.New("the circuit breaker window and open duration must be positive")
+	}
+	return nil
+}
+
+// errCircuitOpen is returned for the requests not sent to an ingester while its circuit breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks the ratio of failed requests to an ingester over fixed windows.
+type circuitBreaker struct {
+	cfg    CircuitBreakerConfig
+	addr   string
+	logger log.Logger
+	now    func() time.Time
+
+	mtx         sync.Mutex
+	state       circuitState
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probing     bool
+	probedAt    time.Time
+}
+
+func newCircuitBreaker(cfg CircuitBreakerConfig, addr string, logger log.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		cfg:    cfg,
+		addr:   addr,
+		logger: logger,
+		now:    time.Now,
+	}
+}
+
+// allow returns whether a request can be sent. Once the open duration has elapsed, a single
+// request is allowed to probe the ingester, its result closes or opens the circuit again. A probe
+// without result after the open duration, such as a stream never closed, is replaced by a new one.
+func (b *circuitBreaker) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < b.cfg.OpenDuration {
+			return false
+		}
+		b.state = circuitHalfOpen
+	case circuitHalfOpen:
+		if b.probing && now.Sub(b.probedAt) < b.cfg.OpenDuration {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probing = true
+	b.probedAt = now
+	return true
+}
+
+// forget releases the probe of a request whose result is unknown, as the caller gave up on it.
+// The request is not counted otherwise.
+func (b *circuitBreaker) forget() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == circuitHalfOpen {
+		b.probing = false
+	}
+}
+
+// done records the result of a request sent with the context.
+func (b *circuitBreaker) done(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		b.forget()
+		return
+	}
+	b.record(isFailure(err))
+}
+
+// record records the result of a request.
+func (b *circuitBreaker) record(failed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := b.now()
+	switch b.state {
+	case circuitHalfOpen:
+		b.probing = false
+		if failed {
+			b.open(now)
+			return
+		}
+		b.state = circuitClosed
+		b.resetWindow(now)
+		level.Info(b.logger).Log("msg", "circuit breaker closed", "addr", b.addr)
+		return
+	case circuitOpen:
+		return
+	}
+	if now.Sub(b.windowStart) >= b.cfg.Window {
+		b.resetWindow(now)
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= b.cfg.MinRequests && float64(b.failures) >= b.cfg.FailureRatio*float64(b.requests) {
+		level.Warn(b.logger).Log("msg", "circuit breaker opened", "addr", b.addr, "requests", b.requests, "failures", b.failures)
+		b.open(now)
+	}
+}
+
+func (b *circuitBreaker) open(now time.Time) {
+	b.state = circuitOpen
+	b.openedAt = now
+}
+
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
+
+// isFailure returns whether the error of a request denotes an unhealthy ingester: it is
+// unavailable, times out or the connection to it fails. Errors caused by the request itself, or
+// returned by the ingester while serving it, are not failures.
+func isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch connect.CodeOf(err) {
+	case connect.CodeUnavailable, connect.CodeDeadlineExceeded:
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// resilienceInterceptor applies the timeouts, retries and circuit breaker of the pool to the
+// requests sent to one ingester.
+type resilienceInterceptor struct {
+	cfg     PoolConfig
+	breaker *circuitBreaker
+}
+
+func newResilienceInterceptor(cfg PoolConfig, addr string, logger log.Logger) *resilienceInterceptor {
+	i := &resilienceInterceptor{cfg: cfg}
+	if cfg.CircuitBreaker.Enabled {
+		i.breaker = newCircuitBreaker(cfg.CircuitBreaker, addr, logger)
+	}
+	return i
+}
+
+// timeout returns the timeout of the requests to the procedure, 0 if none.
+func (i *resilienceInterceptor) timeout(procedure string) time.Duration {
+	if t, ok := i.cfg.EndpointTimeouts[path.Base(procedure)]; ok {
+		return t
+	}
+	return i.cfg.Timeout
+}
+
+func (i *resilienceInterceptor) withTimeout(ctx context.Context, procedure string) (context.Context, context.CancelFunc) {
+	if t := i.timeout(procedure); t > 0 {
+		return context.WithTimeout(ctx, t)
+	}
+	return ctx, func() {}
+}
+
+// retryable returns whether the request can be sent again after the error. Pushes are never
+// retried here, as the ingester might have ingested them.
+func (i *resilienceInterceptor) retryable(ctx context.Context, procedure string, err error) bool {
+	if path.Base(procedure) == "Push" || ctx.Err() != nil || errors.Is(err, errCircuitOpen) {
+		return false
+	}
+	code := connect.CodeOf(err)
+	return code == connect.CodeUnavailable || code == connect.CodeDeadlineExceeded
+}
+
+// backoff returns the time to wait before the retry, with full jitter.
+func (i *resilienceInterceptor) backoff(attempt int) time.Duration {
+	if i.cfg.RetryBackoff <= 0 {
+		return 0
+	}
+	if attempt > 10 {
+		attempt = 10
+	}
+	return time.Duration(rand.Int63n(int64(i.cfg.RetryBackoff) << attempt))
+}
+
+func (i *resilienceInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		procedure := req.Spec().Procedure
+		for attempt := 0; ; attempt++ {
+			resp, err := i.call(ctx, procedure, func(ctx context.Context) (connect.AnyResponse, error) {
+				return next(ctx, req)
+			})
+			if err == nil || attempt >= i.cfg.MaxRetries || !i.retryable(ctx, procedure, err) {
+				return resp, err
+			}
+			select {
+			case <-time.After(i.backoff(attempt)):
+			case <-ctx.Done():
+				return nil, err
+			}
+		}
+	}
+}
+
+func (i *resilienceInterceptor) call(ctx context.Context, procedure string, f func(context.Context) (connect.AnyResponse, error)) (connect.AnyResponse, error) {
+	if i.breaker != nil && !i.breaker.allow() {
+		return nil, connect.NewError(connect.CodeUnavailable, errCircuitOpen)
+	}
+	callCtx, cancel := i.withTimeout(ctx, procedure)
+	defer cancel()
+	resp, err := f(callCtx)
+	if i.breaker != nil {
+		i.breaker.done(ctx, err)
+	}
+	return resp, err
+}
+
+func (i *resilienceInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		if i.breaker != nil && !i.breaker.allow() {
+			return &failedClientConn{spec: spec, err: connect.NewError(connect.CodeUnavailable, errCircuitOpen)}
+		}
+		streamCtx, cancel := i.withTimeout(ctx, spec.Procedure)
+		return &resilientClientConn{
+			StreamingClientConn: next(streamCtx, spec),
+			ctx:                 ctx,
+			cancel:              cancel,
+			breaker:             i.breaker,
+		}
+	}
+}
+
+func (i *resilienceInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
+
+// resilientClientConn records the result of a stream in the circuit breaker, and releases its
+// timeout once closed.
+type resilientClientConn struct {
+	connect.StreamingClientConn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	breaker *circuitBreaker
+
+	once sync.Once
+}
+
+func (c *resilientClientConn) Send(msg any) error {
+	err := c.StreamingClientConn.Send(msg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.record(err)
+	}
+	return err
+}
+
+func (c *resilientClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	if errors.Is(err, io.EOF) {
+		c.record(nil)
+	} else if err != nil {
+		c.record(err)
+	}
+	return err
+}
+
+func (c *resilientClientConn) CloseResponse() error {
+	err := c.StreamingClientConn.CloseResponse()
+	c.record(nil)
+	c.cancel()
+	return err
+}
+
+// record records the first result of the stream.
+func (c *resilientClientConn) record(err error) {
+	c.once.Do(func() {
+		if c.breaker != nil {
+			c.breaker.done(c.ctx, err)
+		}
+	})
+}
+
+// failedClientConn is the stream of a request not sent.
+type failedClientConn struct {
+	spec connect.Spec
+	err  error
+}
+
+func (c *failedClientConn) Spec() connect.Spec           { return c.spec }
+func (c *failedClientConn) Peer() connect.Peer           { return connect.Peer{} }
+func (c *failedClientConn) Send(any) error               { return c.err }
+func (c *failedClientConn) RequestHeader() http.Header   { return http.Header{} }
+func (c *failedClientConn) CloseRequest() error          { return nil }
+func (c *failedClientConn) Receive(any) error            { return c.err }
+func (c *failedClientConn) ResponseHeader() http.Header  { return http.Header{} }
+func (c *failedClientConn) ResponseTrailer() http.Header { return http.Header{} }
+func (c *failedClientConn) CloseResponse() error         { return nil }
@@ -0,0 +1,120 @@
+package clientpool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(CircuitBreakerConfig{
+		Enabled:      true,
+		FailureRatio: 0.5,
+		MinRequests:  4,
+		Window:       time.Minute,
+		OpenDuration: 10 * time.Second,
+	}, "ingester-1", log.NewNopLogger())
+	b.now = func() time.Time { return now }
+
+	for _, failed := range []bool{false, true, false} {
+		require.True(t, b.allow())
+		b.record(failed)
+	}
+	// The window is reset, the first failures are forgotten.
+	now = now.Add(time.Minute)
+	for _, failed := range []bool{true, false, true, true} {
+		require.True(t, b.allow())
+		b.record(failed)
+	}
+	require.False(t, b.allow())
+
+	// A single request probes the ingester once the open duration elapsed.
+	now = now.Add(10 * time.Second)
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+	b.record(true)
+	require.False(t, b.allow())
+
+	// A probe the caller gave up on is released, without closing the circuit.
+	now = now.Add(10 * time.Second)
+	require.True(t, b.allow())
+	b.forget()
+	require.True(t, b.allow())
+
+	// A probe without result is replaced once the open duration elapsed.
+	require.False(t, b.allow())
+	now = now.Add(10 * time.Second)
+	require.True(t, b.allow())
+	b.record(false)
+	require.True(t, b.allow())
+	require.True(t, b.allow())
+}
+
+func TestIsFailure(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		failure bool
+	}{
+		{nil, false},
+		{connect.NewError(connect.CodeUnavailable, errors.New("unavailable")), true},
+		{connect.NewError(connect.CodeDeadlineExceeded, errors.New("timeout")), true},
+		{connect.NewError(connect.CodeUnknown, &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), true},
+		{connect.NewError(connect.CodeUnknown, io.ErrUnexpectedEOF), true},
+		{connect.NewError(connect.CodeInternal, errors.New("query failed")), false},
+		{connect.NewError(connect.CodeResourceExhausted, errors.New("too many series")), false},
+		{connect.NewError(connect.CodeInvalidArgument, errors.New("invalid selector")), false},
+	} {
+		require.Equal(t, tc.failure, isFailure(tc.err), "%v", tc.err)
+	}
+}
+
+func TestResilienceInterceptor_Unary(t *testing.T) {
+	i := newResilienceInterceptor(PoolConfig{
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		CircuitBreaker: CircuitBreakerConfig{
+			Enabled:      true,
+			FailureRatio: 0.5,
+			MinRequests:  3,
+			Window:       time.Minute,
+			OpenDuration: time.Minute,
+		},
+	}, "ingester-1", log.NewNopLogger())
+
+	var calls int
+	call := i.WrapUnary(func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		calls++
+		_, ok := ctx.Deadline()
+		require.True(t, ok)
+		if calls == 2 {
+			return connect.NewResponse(&ingestv1.LabelValuesResponse{}), nil
+		}
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("unavailable"))
+	})
+
+	// The request is retried after a failure.
+	_, err := call(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// The retries stop once the circuit breaker opens.
+	_, err = call(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{}))
+	require.ErrorIs(t, err, errCircuitOpen)
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+	require.Equal(t, 3, calls)
+
+	_, err = call(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{}))
+	require.ErrorIs(t, err, errCircuitOpen)
+	require.Equal(t, 3, calls)
+}
@@ -0,0 +1,77 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/go-kit/log/level"
+
+	diskutil "github.com/grafana/phlare/pkg/util/disk"
+)
+
+const diskQuotaCheckInterval = 10 * time.Second
+
+var errDiskQuotaExceeded = errors.New("ingester disk utilization is above the quota, retry later")
+
+// newDiskQuotaChecker returns a volume checker reporting a high utilization once the fraction of
+// the volume in use reaches maxUtilization.
+func newDiskQuotaChecker(maxUtilization float64) diskutil.VolumeChecker {
+	return diskutil.NewVolumeChecker(math.MaxUint64, 1-maxUtilization)
+}
+
+// checkDiskQuota checks the utilization of the volume of the data path. When it goes above the
+// quota, the heads of all the tenants are flushed and their blocks uploaded, so no data is lost
+// if the volume fills up, and writes are rejected until the utilization is below the quota again.
+func (i *Ingester) checkDiskQuota(ctx context.Context) {
+	stats, err := i.volumeChecker.HasHighDiskUtilization(i.dbConfig.DataPath)
+	if err != nil {
+		level.Warn(i.logger).Log("msg", "failed to check disk utilization", "path", i.dbConfig.DataPath, "err", err)
+		return
+	}
+	if !stats.HighDiskUtilization {
+		if i.diskQuotaExceeded.Swap(false) {
+			i.diskQuotaExceededGauge.Set(0)
+			level.Info(i.logger).Log("msg", "disk utilization is below the quota, accepting writes again", "path", i.dbConfig.DataPath, "bytes_available", stats.BytesAvailable)
+		}
+		return
+	}
+	if i.diskQuotaExceeded.Swap(true) {
+		return
+	}
+	i.diskQuotaExceededGauge.Set(1)
+	level.Warn(i.logger).Log("msg", "disk utilization is above the quota, flushing heads and rejecting writes", "path", i.dbConfig.DataPath, "bytes_available", stats.BytesAvailable)
+	i.emergencyFlush(ctx)
+}
+
+// emergencyFlush flushes the heads of all the tenants and uploads their blocks. The local copy of
+// the blocks uploaded is deleted only when enabled, as their profiles can't be queried anymore.
+func (i *Ingester) emergencyFlush(ctx context.Context) {
+	i.emergencyFlushes.Inc()
+	i.instancesMtx.RLock()
+	instances := make([]*instance, 0, len(i.instances))
+	for _, inst := range i.instances {
+		instances = append(instances, inst)
+	}
+	i.instancesMtx.RUnlock()
+
+	for _, inst := range instances {
+		inst.evictMtx.RLock()
+		if !inst.evicted {
+			if err := inst.Flush(ctx); err != nil {
+				level.Error(i.logger).Log("msg", "emergency flush failed", "tenant", inst.tenantID, "err", err)
+			}
+			inst.runShipper(ctx)
+			var deleted int
+			if i.cfg.DeleteUploadedBlocksAboveDiskQuota {
+				var err error
+				if deleted, err = inst.DeleteUploadedBlocks(ctx); err != nil {
+					level.Error(i.logger).Log("msg", "failed to delete uploaded blocks", "tenant", inst.tenantID, "err", err)
+				}
+			}
+			level.Info(i.logger).Log("msg", "emergency flush done", "tenant", inst.tenantID, "deleted_blocks", deleted)
+		}
+		inst.evictMtx.RUnlock()
+	}
+}
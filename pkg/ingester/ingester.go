@@ -2,9 +2,12 @@ package ingester
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/bufbuild/connect-go"
 	"github.com/go-kit/log"
@@ -14,9 +17,12 @@ import (
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/atomic"
 
 	ingesterv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/pkg/blockevents"
 	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
@@ -24,21 +30,37 @@ import (
 	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/usagestats"
 	"github.com/grafana/phlare/pkg/util"
+	diskutil "github.com/grafana/phlare/pkg/util/disk"
 	"github.com/grafana/phlare/pkg/validation"
 )
 
 var activeTenantsStats = usagestats.NewInt("ingester_active_tenants")
 
 type Config struct {
-	LifecyclerConfig ring.LifecyclerConfig `yaml:"lifecycler,omitempty"`
+	LifecyclerConfig  ring.LifecyclerConfig `yaml:"lifecycler,omitempty"`
+	IdleTenantTimeout time.Duration         `yaml:"idle_tenant_timeout" category:"advanced"`
+	ReadOnly          bool                  `yaml:"read_only" category:"advanced"`
+
+	MaxDiskUtilization float64 `yaml:"max_disk_utilization" category:"advanced"`
+	MaxRestoreSize     int64   `yaml:"max_restore_size" category:"advanced"`
+
+	DeleteUploadedBlocksAboveDiskQuota bool `yaml:"delete_uploaded_blocks_above_disk_quota" category:"experimental"`
 }
 
 // RegisterFlags registers the flags.
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	cfg.LifecyclerConfig.RegisterFlags(f, util.Logger)
+	f.DurationVar(&cfg.IdleTenantTimeout, "ingester.idle-tenant-timeout", 0, "If set, the head of a tenant that has not received any profile for this long is flushed and its resources are released. 0 to disable.")
+	f.BoolVar(&cfg.ReadOnly, "ingester.read-only", false, "Start the ingester in read-only mode: it leaves the ring once joined and rejects writes, but keeps serving queries. Used to drain an ingester before scaling down.")
+	f.Float64Var(&cfg.MaxDiskUtilization, "ingester.max-disk-utilization", 0, "Fraction of the volume of the data path in use above which the ingester flushes the heads of all the tenants, uploads their blocks and rejects writes with a retryable error, until the utilization is below it again. 0 to disable.")
+	f.BoolVar(&cfg.DeleteUploadedBlocksAboveDiskQuota, "ingester.delete-uploaded-blocks-above-disk-quota", false, "Delete the local copy of the blocks uploaded by the flush triggered above -ingester.max-disk-utilization. The profiles of the deleted blocks are lost for the queries, as the queriers only read the blocks of the ingesters.")
+	f.Int64Var(&cfg.MaxRestoreSize, "ingester.max-restore-size", 16<<30, "Maximum size in bytes of a snapshot uploaded to the restore endpoint. Larger snapshots are rejected with 413. 0 to disable.")
 }
 
 func (cfg *Config) Validate() error {
+	if cfg.MaxDiskUtilization < 0 || cfg.MaxDiskUtilization >= 1 {
+		return errors.New("ingester max disk utilization must be between 0 and 1")
+	}
 	return nil
 }
 
@@ -52,14 +74,27 @@ type Ingester struct {
 
 	lifecycler        *ring.Lifecycler
 	lifecyclerWatcher *services.FailureWatcher
+	readOnly          *atomic.Bool
+	readOnlyCh        chan struct{}
+
+	volumeChecker     diskutil.VolumeChecker
+	diskQuotaExceeded *atomic.Bool
 
 	storageBucket phlareobjstore.Bucket
+	blockEvents   blockevents.Notifier
 
 	instances    map[string]*instance
 	instancesMtx sync.RWMutex
 
 	limits Limits
 	reg    prometheus.Registerer
+
+	activeTenants        prometheus.Gauge
+	idleTenantsEvicted   prometheus.Counter
+	idleTenantsEvictFail prometheus.Counter
+
+	diskQuotaExceededGauge prometheus.Gauge
+	emergencyFlushes       prometheus.Counter
 }
 
 type ingesterFlusherCompat struct {
@@ -73,7 +108,10 @@ func (i *ingesterFlusherCompat) Flush() {
 	}
 }
 
-func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storageBucket phlareobjstore.Bucket, limits Limits) (*Ingester, error) {
+func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storageBucket phlareobjstore.Bucket, limits Limits, blockEvents blockevents.Notifier) (*Ingester, error) {
+	if blockEvents == nil {
+		blockEvents = blockevents.Nop{}
+	}
 	i := &Ingester{
 		cfg:           cfg,
 		phlarectx:     phlarectx,
@@ -82,8 +120,39 @@ func New(phlarectx context.Context, cfg Config, dbConfig phlaredb.Config, storag
 		instances:     map[string]*instance{},
 		dbConfig:      dbConfig,
 		storageBucket: storageBucket,
+		blockEvents:   blockEvents,
 		limits:        limits,
+		readOnly:      atomic.NewBool(cfg.ReadOnly),
+		readOnlyCh:    make(chan struct{}, 1),
+
+		diskQuotaExceeded: atomic.NewBool(false),
 	}
+	if cfg.MaxDiskUtilization > 0 {
+		if err := os.MkdirAll(dbConfig.DataPath, 0o777); err != nil {
+			return nil, fmt.Errorf("mkdir %s: %w", dbConfig.DataPath, err)
+		}
+		i.volumeChecker = newDiskQuotaChecker(cfg.MaxDiskUtilization)
+	}
+	i.activeTenants = promauto.With(i.reg).NewGauge(prometheus.GaugeOpts{
+		Name: "phlare_ingester_active_tenants",
+		Help: "The current number of tenants with an open head in the ingester.",
+	})
+	i.idleTenantsEvicted = promauto.With(i.reg).NewCounter(prometheus.CounterOpts{
+		Name: "phlare_ingester_idle_tenants_evicted_total",
+		Help: "The total number of idle tenants whose head was flushed and released.",
+	})
+	i.idleTenantsEvictFail = promauto.With(i.reg).NewCounter(prometheus.CounterOpts{
+		Name: "phlare_ingester_idle_tenants_eviction_failures_total",
+		Help: "The total number of idle tenants which failed to be evicted.",
+	})
+	i.diskQuotaExceededGauge = promauto.With(i.reg).NewGauge(prometheus.GaugeOpts{
+		Name: "phlare_ingester_disk_quota_exceeded",
+		Help: "1 when the disk utilization is above the quota and writes are rejected, 0 otherwise.",
+	})
+	i.emergencyFlushes = promauto.With(i.reg).NewCounter(prometheus.CounterOpts{
+		Name: "phlare_ingester_emergency_flushes_total",
+		Help: "The total number of flushes of all the heads triggered by the disk utilization going above the quota.",
+	})
 
 	var err error
 	i.lifecycler, err = ring.NewLifecycler(
@@ -119,14 +188,117 @@ func (i *Ingester) starting(ctx context.Context) error {
 }
 
 func (i *Ingester) running(ctx context.Context) error {
-	select {
-	case <-ctx.Done():
-		return nil
-	case err := <-i.lifecyclerWatcher.Chan(): // handle lifecycler errors
-		return fmt.Errorf("lifecycler failed: %w", err)
+	var evictTicker <-chan time.Time
+	if i.cfg.IdleTenantTimeout > 0 {
+		interval := i.cfg.IdleTenantTimeout
+		if interval > time.Minute {
+			interval = time.Minute
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		evictTicker = t.C
+	}
+	var diskQuotaTicker <-chan time.Time
+	if i.volumeChecker != nil {
+		t := time.NewTicker(diskQuotaCheckInterval)
+		defer t.Stop()
+		diskQuotaTicker = t.C
+	}
+	// a read-only ingester leaves the ring once it has joined it: the state is checked
+	// periodically only until then.
+	var (
+		leaveTicker <-chan time.Time
+		stopLeave   = func() {}
+	)
+	defer func() { stopLeave() }()
+	startLeave := func() {
+		if leaveTicker != nil {
+			return
+		}
+		t := time.NewTicker(leaveCheckInterval)
+		leaveTicker, stopLeave = t.C, t.Stop
+	}
+	if i.readOnly.Load() {
+		startLeave()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-evictTicker:
+			i.evictIdleInstances(ctx)
+		case <-diskQuotaTicker:
+			i.checkDiskQuota(ctx)
+		case <-i.readOnlyCh:
+			startLeave()
+		case <-leaveTicker:
+			if err := i.leaveRing(ctx); err != nil {
+				level.Warn(i.logger).Log("msg", "failed to leave the ring", "err", err)
+				continue
+			}
+			if i.lifecycler.GetState() == ring.LEAVING {
+				stopLeave()
+				leaveTicker, stopLeave = nil, func() {}
+			}
+		case err := <-i.lifecyclerWatcher.Chan(): // handle lifecycler errors
+			return fmt.Errorf("lifecycler failed: %w", err)
+		}
 	}
 }
 
+// evictIdleInstances flushes and releases the instances of tenants that have
+// not received any profile within the idle tenant timeout. Instances in use
+// are skipped and retried at the next run.
+func (i *Ingester) evictIdleInstances(ctx context.Context) {
+	var idle []*instance
+	i.instancesMtx.RLock()
+	for _, inst := range i.instances {
+		if inst.idleFor() >= i.cfg.IdleTenantTimeout {
+			idle = append(idle, inst)
+		}
+	}
+	i.instancesMtx.RUnlock()
+
+	for _, inst := range idle {
+		if !inst.evictMtx.TryLock() {
+			continue
+		}
+		// the tenant might have received a profile in the meantime.
+		if idleFor := inst.idleFor(); idleFor >= i.cfg.IdleTenantTimeout {
+			level.Info(i.logger).Log("msg", "evicting idle tenant", "tenant", inst.tenantID, "idle_for", idleFor)
+			if err := i.evictInstance(ctx, inst); err != nil {
+				level.Error(i.logger).Log("msg", "failed to evict idle tenant", "tenant", inst.tenantID, "err", err)
+				i.idleTenantsEvictFail.Inc()
+			} else {
+				i.idleTenantsEvicted.Inc()
+			}
+		}
+		inst.evictMtx.Unlock()
+	}
+}
+
+// evictInstance flushes the head of the instance before removing and stopping it.
+// The caller must hold the instance's evictMtx.
+func (i *Ingester) evictInstance(ctx context.Context, inst *instance) error {
+	if err := inst.Flush(ctx); err != nil {
+		return err
+	}
+
+	i.instancesMtx.Lock()
+	delete(i.instances, inst.tenantID)
+	i.setActiveTenants(len(i.instances))
+	i.instancesMtx.Unlock()
+
+	inst.evicted = true
+	return inst.Stop()
+}
+
+func (i *Ingester) setActiveTenants(n int) {
+	activeTenantsStats.Set(int64(n))
+	i.activeTenants.Set(float64(n))
+}
+
 func (i *Ingester) GetOrCreateInstance(tenantID string) (*instance, error) { //nolint:revive
 	inst, ok := i.getInstanceByID(tenantID)
 	if ok {
@@ -139,12 +311,16 @@ func (i *Ingester) GetOrCreateInstance(tenantID string) (*instance, error) { //n
 	if !ok {
 		var err error
 
-		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket, NewLimiter(tenantID, i.limits, i.lifecycler, i.cfg.LifecyclerConfig.RingConfig.ReplicationFactor))
+		replicationFactor := i.cfg.LifecyclerConfig.RingConfig.ReplicationFactor
+		if rf := i.limits.IngestionReplicationFactor(tenantID); rf > 0 && rf < replicationFactor {
+			replicationFactor = rf
+		}
+		inst, err = newInstance(i.phlarectx, i.dbConfig, tenantID, i.storageBucket, NewLimiter(tenantID, i.limits, i.lifecycler, replicationFactor), i.blockEvents)
 		if err != nil {
 			return nil, err
 		}
 		i.instances[tenantID] = inst
-		activeTenantsStats.Set(int64(len(i.instances)))
+		i.setActiveTenants(len(i.instances))
 	}
 	return inst, nil
 }
@@ -176,16 +352,47 @@ func (i *Ingester) forInstance(ctx context.Context, f func(*instance) error) err
 	if err != nil {
 		return connect.NewError(connect.CodeInvalidArgument, err)
 	}
-	instance, err := i.GetOrCreateInstance(tenantID)
-	if err != nil {
-		return connect.NewError(connect.CodeInternal, err)
+	for {
+		instance, err := i.GetOrCreateInstance(tenantID)
+		if err != nil {
+			return connect.NewError(connect.CodeInternal, err)
+		}
+		instance.evictMtx.RLock()
+		if instance.evicted {
+			// The instance was evicted concurrently, retry with a new one.
+			instance.evictMtx.RUnlock()
+			continue
+		}
+		defer instance.evictMtx.RUnlock()
+		return f(instance)
 	}
-	return f(instance)
 }
 
 func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	resp, err := i.push(ctx, req)
+	if err != nil {
+		// the pushes rejected for a known reason are already counted by the discarded metrics.
+		tenantID, _ := tenant.ExtractTenantIDFromContext(ctx)
+		reason := validation.ReasonOf(err)
+		lvl := level.Warn
+		if reason != validation.Unknown {
+			lvl = level.Debug
+		}
+		lvl(util.LoggerWithTraceContext(ctx, i.logger)).Log("msg", "push failed", "tenant", tenantID, "reason", reason, "err", err)
+	}
+	return resp, err
+}
+
+func (i *Ingester) push(ctx context.Context, req *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	if i.readOnly.Load() {
+		return nil, connect.NewError(connect.CodeUnavailable, errReadOnly)
+	}
+	if i.diskQuotaExceeded.Load() {
+		return nil, connect.NewError(connect.CodeUnavailable, errDiskQuotaExceeded)
+	}
 	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[pushv1.PushResponse], error) {
-		level.Debug(instance.logger).Log("msg", "message received by ingester push")
+		level.Debug(util.LoggerWithTraceContext(ctx, instance.logger)).Log("msg", "message received by ingester push")
+		instance.lastPush.Store(time.Now().UnixNano())
 		for _, series := range req.Msg.Series {
 			for _, sample := range series.Samples {
 				p, size, err := pprof.FromBytes(sample.RawProfile)
@@ -196,7 +403,7 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 				if err != nil {
 					return nil, err
 				}
-				if err := instance.Head().Ingest(ctx, p, id, series.Labels...); err != nil {
+				if err := instance.Ingest(ctx, p, id, series.Labels...); err != nil {
 					reason := validation.ReasonOf(err)
 					if reason != validation.Unknown {
 						validation.DiscardedProfiles.WithLabelValues(string(reason), instance.tenantID).Add(float64(1))
@@ -210,6 +417,7 @@ func (i *Ingester) Push(ctx context.Context, req *connect.Request[pushv1.PushReq
 					}
 					return nil, err
 				}
+				instance.IngestTargetMetadata(p, series.Metadata, series.Labels...)
 				p.ReturnToVTPool()
 			}
 		}
@@ -245,6 +453,11 @@ func (i *Ingester) TransferOut(ctx context.Context) error {
 	return ring.ErrTransferDisabled
 }
 
+// Addr returns the address of the ingester in the ring.
+func (i *Ingester) Addr() string {
+	return i.lifecycler.Addr
+}
+
 // CheckReady is used to indicate to k8s when the ingesters are ready for
 // the addition removal of another ingester. Returns 204 when the ingester is
 // ready, 500 otherwise.
@@ -3,8 +3,13 @@ package ingester
 import (
 	"bytes"
 	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime/pprof"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,17 +20,22 @@ import (
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/services"
+	"github.com/oklog/ulid"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 
 	ingesterv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/pkg/blockevents"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	"github.com/grafana/phlare/pkg/objstore/client"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
 	"github.com/grafana/phlare/pkg/tenant"
+	diskutil "github.com/grafana/phlare/pkg/util/disk"
 )
 
 func defaultIngesterTestConfig(t testing.TB) Config {
@@ -69,10 +79,11 @@ func Test_MultitenantReadWrite(t *testing.T) {
 	fs, err := client.NewBucket(ctx, cfg, "storage")
 	require.NoError(t, err)
 
+	events := &fakeBlockEvents{}
 	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
 		DataPath:         dbPath,
 		MaxBlockDuration: 30 * time.Hour,
-	}, fs, &fakeLimits{})
+	}, fs, &fakeLimits{}, events)
 	require.NoError(t, err)
 	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
 
@@ -115,4 +126,237 @@ func Test_MultitenantReadWrite(t *testing.T) {
 	require.Equal(t, []string{"bazz"}, labelsValues.Msg.Names)
 
 	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+
+	// the heads are flushed and shipped on shutdown.
+	var tenants []string
+	for _, e := range events.events {
+		require.Equal(t, blockevents.BlockUploaded, e.Type)
+		require.Equal(t, block.IngesterSource, e.Source)
+		require.NotZero(t, e.SizeBytes)
+		tenants = append(tenants, e.TenantID)
+	}
+	require.ElementsMatch(t, []string{"foo", "buzz"}, tenants)
+}
+
+type fakeBlockEvents struct {
+	mtx    sync.Mutex
+	events []blockevents.Event
+}
+
+func (f *fakeBlockEvents) Notify(e blockevents.Event) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.events = append(f.events, e)
+}
+
+func Test_EvictIdleInstances(t *testing.T) {
+	dbPath := t.TempDir()
+	reg := prometheus.NewRegistry()
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, reg)
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.IdleTenantTimeout = time.Hour
+	ing, err := New(ctx, cfg, phlaredb.Config{
+		DataPath:         dbPath,
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, &fakeLimits{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+
+	req := connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels: phlaremodel.LabelsFromStrings("foo", "bar"),
+				Samples: []*pushv1.RawSample{
+					{
+						ID:         uuid.NewString(),
+						RawProfile: testProfile(t),
+					},
+				},
+			},
+		},
+	})
+	for _, tenantID := range []string{"idle", "active"} {
+		_, err = ing.Push(tenant.InjectTenantID(context.Background(), tenantID), req)
+		require.NoError(t, err)
+	}
+
+	idle, ok := ing.getInstanceByID("idle")
+	require.True(t, ok)
+	idle.lastPush.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+
+	ing.evictIdleInstances(context.Background())
+
+	_, ok = ing.getInstanceByID("idle")
+	require.False(t, ok)
+	require.True(t, idle.evicted)
+	_, ok = ing.getInstanceByID("active")
+	require.True(t, ok)
+	require.Equal(t, 1.0, testutil.ToFloat64(ing.idleTenantsEvicted))
+	require.Equal(t, 1.0, testutil.ToFloat64(ing.activeTenants))
+
+	// The head has been flushed into a local block.
+	blocks, err := os.ReadDir(filepath.Join(dbPath, "idle", "local"))
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+
+	// The tenant is recreated on the next push.
+	_, err = ing.Push(tenant.InjectTenantID(context.Background(), "idle"), req)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, testutil.ToFloat64(ing.activeTenants))
+
+	require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+}
+
+func Test_ReadOnly(t *testing.T) {
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+
+	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, &fakeLimits{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	}()
+	require.Eventually(t, func() bool {
+		return ing.lifecycler.GetState() == ring.ACTIVE
+	}, 5*time.Second, 10*time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	ing.UnregisterOnShutdownHandler(rec, httptest.NewRequest(http.MethodDelete, "/ingester/unregister-on-shutdown", nil))
+	require.JSONEq(t, `{"unregisterOnShutdown":false}`, rec.Body.String())
+	require.False(t, ing.lifecycler.ShouldUnregisterOnShutdown())
+
+	rec = httptest.NewRecorder()
+	ing.ReadOnlyHandler(rec, httptest.NewRequest(http.MethodPost, "/ingester/read-only", nil))
+	require.JSONEq(t, `{"readOnly":true,"state":"LEAVING"}`, rec.Body.String())
+
+	_, err = ing.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+		Series: []*pushv1.RawProfileSeries{
+			{
+				Labels:  phlaremodel.LabelsFromStrings("foo", "bar"),
+				Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: testProfile(t)}},
+			},
+		},
+	}))
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(err))
+}
+
+func Test_ReadOnlyAtStartup(t *testing.T) {
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.ReadOnly = true
+	ing, err := New(ctx, cfg, phlaredb.Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, &fakeLimits{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	}()
+	require.Eventually(t, func() bool {
+		return ing.lifecycler.GetState() == ring.LEAVING
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type fakeVolumeChecker struct {
+	high atomic.Bool
+}
+
+func (f *fakeVolumeChecker) HasHighDiskUtilization(string) (*diskutil.VolumeStats, error) {
+	return &diskutil.VolumeStats{HighDiskUtilization: f.high.Load()}, nil
+}
+
+func Test_DiskQuota(t *testing.T) {
+	dbPath := t.TempDir()
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+
+	bucket, err := client.NewBucket(ctx, client.Config{
+		StorageBackendConfig: client.StorageBackendConfig{
+			Backend:    client.Filesystem,
+			Filesystem: filesystem.Config{Directory: t.TempDir()},
+		},
+	}, "storage")
+	require.NoError(t, err)
+
+	cfg := defaultIngesterTestConfig(t)
+	cfg.MaxDiskUtilization = 0.9
+	cfg.DeleteUploadedBlocksAboveDiskQuota = true
+	ing, err := New(ctx, cfg, phlaredb.Config{
+		DataPath:         dbPath,
+		MaxBlockDuration: 30 * time.Hour,
+	}, bucket, &fakeLimits{}, nil)
+	require.NoError(t, err)
+	volume := &fakeVolumeChecker{}
+	ing.volumeChecker = volume
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	defer func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	}()
+
+	push := func() error {
+		_, err := ing.Push(tenant.InjectTenantID(context.Background(), "foo"), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  phlaremodel.LabelsFromStrings("foo", "bar"),
+					Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		return err
+	}
+	require.NoError(t, push())
+
+	localBlocks := func() []string {
+		entries, err := os.ReadDir(filepath.Join(dbPath, "foo", "local"))
+		require.NoError(t, err)
+		var ids []string
+		for _, e := range entries {
+			if _, err := ulid.Parse(e.Name()); err == nil {
+				ids = append(ids, e.Name())
+			}
+		}
+		return ids
+	}
+
+	// Above the quota, the head is flushed, its block uploaded and deleted from the disk, and
+	// writes are rejected.
+	volume.high.Store(true)
+	ing.checkDiskQuota(context.Background())
+	require.Equal(t, connect.CodeUnavailable, connect.CodeOf(push()))
+	require.Equal(t, 1.0, testutil.ToFloat64(ing.emergencyFlushes))
+	require.Equal(t, 1.0, testutil.ToFloat64(ing.diskQuotaExceededGauge))
+	require.Empty(t, localBlocks())
+	var uploaded []string
+	require.NoError(t, bucket.Iter(context.Background(), "foo/phlaredb/", func(name string) error {
+		uploaded = append(uploaded, name)
+		return nil
+	}))
+	require.Len(t, uploaded, 1)
+
+	// The heads are only flushed once while above the quota.
+	ing.checkDiskQuota(context.Background())
+	require.Equal(t, 1.0, testutil.ToFloat64(ing.emergencyFlushes))
+
+	// Once the utilization drops below the quota, writes are accepted again.
+	volume.high.Store(false)
+	ing.checkDiskQuota(context.Background())
+	require.Equal(t, 0.0, testutil.ToFloat64(ing.diskQuotaExceededGauge))
+	require.NoError(t, push())
+	require.NoError(t, push())
+
+	// The blocks uploaded are kept unless their deletion is enabled.
+	ing.cfg.DeleteUploadedBlocksAboveDiskQuota = false
+	volume.high.Store(true)
+	ing.checkDiskQuota(context.Background())
+	require.Equal(t, 2.0, testutil.ToFloat64(ing.emergencyFlushes))
+	require.Len(t, localBlocks(), 1)
 }
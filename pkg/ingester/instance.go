@@ -9,7 +9,9 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/atomic"
 
+	"github.com/grafana/phlare/pkg/blockevents"
 	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
@@ -22,17 +24,26 @@ type instance struct {
 	shipper     *shipper.Shipper
 	shipperLock sync.Mutex
 	logger      log.Logger
-	reg         prometheus.Registerer
+	reg         *instanceRegisterer
 
 	cancel   context.CancelFunc
 	wg       sync.WaitGroup
 	tenantID string
+
+	// lastPush is the unix time in nanoseconds of the last push received.
+	lastPush *atomic.Int64
+	// evictMtx prevents the instance from being evicted while it is in use.
+	evictMtx sync.RWMutex
+	evicted  bool
 }
 
-func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string, storageBucket phlareobjstore.Bucket, limiter Limiter) (*instance, error) {
+func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string, storageBucket phlareobjstore.Bucket, limiter Limiter, events blockevents.Notifier) (*instance, error) {
 	cfg.DataPath = path.Join(cfg.DataPath, tenantID)
+	cfg.UploadBlocks = storageBucket != nil
 
 	phlarectx = phlarecontext.WrapTenant(phlarectx, tenantID)
+	reg := &instanceRegisterer{Registerer: phlarecontext.Registry(phlarectx)}
+	phlarectx = phlarecontext.WithRegistry(phlarectx, reg)
 	db, err := phlaredb.New(phlarectx, cfg, limiter)
 	if err != nil {
 		return nil, err
@@ -41,9 +52,10 @@ func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string
 	inst := &instance{
 		PhlareDB: db,
 		logger:   phlarecontext.Logger(phlarectx),
-		reg:      phlarecontext.Registry(phlarectx),
+		reg:      reg,
 		cancel:   cancel,
 		tenantID: tenantID,
+		lastPush: atomic.NewInt64(time.Now().UnixNano()),
 	}
 	if storageBucket != nil {
 		inst.shipper = shipper.New(
@@ -54,6 +66,10 @@ func newInstance(phlarectx context.Context, cfg phlaredb.Config, tenantID string
 			block.IngesterSource,
 			false,
 			false,
+			func(meta *block.Meta) {
+				db.BlockUploaded(meta.ULID)
+				events.Notify(blockevents.NewEvent(blockevents.BlockUploaded, tenantID, meta))
+			},
 		)
 	}
 	go inst.loop(ctx)
@@ -97,9 +113,64 @@ func (i *instance) runShipper(ctx context.Context) {
 	}
 }
 
+// idleFor returns the time elapsed since the last push received.
+func (i *instance) idleFor() time.Duration {
+	return time.Since(time.Unix(0, i.lastPush.Load()))
+}
+
 func (i *instance) Stop() error {
 	err := i.PhlareDB.Close()
 	i.cancel()
 	i.wg.Wait()
+	// unregister the tenant metrics, so the instance can be created again after an eviction.
+	i.reg.unregisterAll()
 	return err
 }
+
+// instanceRegisterer keeps track of the collectors registered by an instance,
+// so they can all be unregistered when the instance is stopped.
+type instanceRegisterer struct {
+	prometheus.Registerer
+
+	mtx        sync.Mutex
+	collectors []prometheus.Collector
+}
+
+func (r *instanceRegisterer) Register(c prometheus.Collector) error {
+	if err := r.Registerer.Register(c); err != nil {
+		return err
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *instanceRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (r *instanceRegisterer) Unregister(c prometheus.Collector) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for idx := range r.collectors {
+		if r.collectors[idx] == c {
+			r.collectors = append(r.collectors[:idx], r.collectors[idx+1:]...)
+			break
+		}
+	}
+	return r.Registerer.Unregister(c)
+}
+
+func (r *instanceRegisterer) unregisterAll() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, c := range r.collectors {
+		r.Registerer.Unregister(c)
+	}
+	r.collectors = nil
+}
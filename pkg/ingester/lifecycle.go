@@ -0,0 +1,88 @@
+package ingester
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/ring"
+
+	"github.com/grafana/phlare/pkg/util"
+)
+
+var errReadOnly = errors.New("ingester is read-only")
+
+// leaveCheckInterval is how often a read-only ingester checks whether it can leave the ring.
+const leaveCheckInterval = time.Second
+
+// SetReadOnly stops the ingester from accepting writes. The ingester leaves the ring as soon as it
+// has joined it, so the distributors stop sending it profiles, but keeps serving queries. There is
+// no way back: a read-only ingester is meant to be drained and shut down.
+func (i *Ingester) SetReadOnly(ctx context.Context) error {
+	if i.readOnly.Swap(true) {
+		return nil
+	}
+	level.Info(i.logger).Log("msg", "ingester switched to read-only")
+	// wake up the running loop, which leaves the ring once the ingester has joined it.
+	select {
+	case i.readOnlyCh <- struct{}{}:
+	default:
+	}
+	return i.leaveRing(ctx)
+}
+
+// ReadOnly returns true if the ingester does not accept writes.
+func (i *Ingester) ReadOnly() bool {
+	return i.readOnly.Load()
+}
+
+// leaveRing moves a read-only ingester to the LEAVING state. Instances which have not joined the
+// ring yet are moved once they are ACTIVE.
+func (i *Ingester) leaveRing(ctx context.Context) error {
+	if !i.readOnly.Load() || i.lifecycler.GetState() != ring.ACTIVE {
+		return nil
+	}
+	return i.lifecycler.ChangeState(ctx, ring.LEAVING)
+}
+
+type readOnlyResponse struct {
+	ReadOnly bool   `json:"readOnly"`
+	State    string `json:"state"`
+}
+
+// ReadOnlyHandler returns whether the ingester is read-only on GET, and switches the ingester to
+// read-only on POST.
+func (i *Ingester) ReadOnlyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		if err := i.SetReadOnly(req.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("failed to switch to read-only: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+	util.WriteJSONResponse(w, readOnlyResponse{
+		ReadOnly: i.ReadOnly(),
+		State:    i.lifecycler.GetState().String(),
+	})
+}
+
+type unregisterOnShutdownResponse struct {
+	UnregisterOnShutdown bool `json:"unregisterOnShutdown"`
+}
+
+// UnregisterOnShutdownHandler returns whether the ingester unregisters from the ring on shutdown
+// on GET, enables it on PUT and disables it on DELETE. The setting is reset to the value of
+// -ingester.unregister-on-shutdown on restart.
+func (i *Ingester) UnregisterOnShutdownHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPut:
+		i.lifecycler.SetUnregisterOnShutdown(true)
+	case http.MethodDelete:
+		i.lifecycler.SetUnregisterOnShutdown(false)
+	}
+	util.WriteJSONResponse(w, unregisterOnShutdownResponse{
+		UnregisterOnShutdown: i.lifecycler.ShouldUnregisterOnShutdown(),
+	})
+}
@@ -23,6 +23,7 @@ type RingCount interface {
 type Limits interface {
 	MaxLocalSeriesPerTenant(tenantID string) int
 	MaxGlobalSeriesPerTenant(tenantID string) int
+	IngestionReplicationFactor(tenantID string) int
 }
 
 type Limiter interface {
@@ -24,6 +24,10 @@ func (f *fakeLimits) MaxGlobalSeriesPerTenant(userID string) int {
 	return f.maxGlobalSeriesPerTenant
 }
 
+func (f *fakeLimits) IngestionReplicationFactor(userID string) int {
+	return 0
+}
+
 type fakeRingCount struct {
 	healthyInstancesCount int
 }
@@ -6,6 +6,7 @@ import (
 	"github.com/bufbuild/connect-go"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
 )
 
 // LabelValues returns the possible label values for a given label name.
@@ -53,3 +54,50 @@ func (i *Ingester) MergeProfilesPprof(ctx context.Context, stream *connect.BidiS
 		return instance.MergeProfilesPprof(ctx, stream)
 	})
 }
+
+// StorageUsage estimates the bytes and the profiles of the local blocks per value of a label.
+func (i *Ingester) StorageUsage(ctx context.Context, req *connect.Request[ingestv1.StorageUsageRequest]) (*connect.Response[ingestv1.StorageUsageResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.StorageUsageResponse], error) {
+		return instance.StorageUsage(ctx, req)
+	})
+}
+
+// SelectProfileIDs returns the IDs of the profiles matching the request, the most recent first.
+func (i *Ingester) SelectProfileIDs(ctx context.Context, req *connect.Request[ingestv1.SelectProfileIDsRequest]) (*connect.Response[ingestv1.SelectProfileIDsResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.SelectProfileIDsResponse], error) {
+		return instance.SelectProfileIDs(ctx, req)
+	})
+}
+
+// GetProfile returns a single profile by its ID in the pprof format.
+func (i *Ingester) GetProfile(ctx context.Context, req *connect.Request[ingestv1.GetProfileRequest]) (*connect.Response[ingestv1.GetProfileResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.GetProfileResponse], error) {
+		return instance.GetProfile(ctx, req)
+	})
+}
+
+// BlockMetadata returns the stats of the head and of the local blocks of the tenant.
+func (i *Ingester) BlockMetadata(ctx context.Context, req *connect.Request[ingestv1.BlockMetadataRequest]) (*connect.Response[ingestv1.BlockMetadataResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.BlockMetadataResponse], error) {
+		return instance.BlockMetadata(ctx, req)
+	})
+}
+
+// Capabilities returns the optional features of the API supported by the ingester.
+func (i *Ingester) Capabilities(ctx context.Context, req *connect.Request[ingestv1.CapabilitiesRequest]) (*connect.Response[ingestv1.CapabilitiesResponse], error) {
+	return connect.NewResponse(&ingestv1.CapabilitiesResponse{Features: clientpool.Features}), nil
+}
+
+// SelectHistograms returns the histograms of the profile totals of the matching series.
+func (i *Ingester) SelectHistograms(ctx context.Context, req *connect.Request[ingestv1.SelectHistogramsRequest]) (*connect.Response[ingestv1.SelectHistogramsResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.SelectHistogramsResponse], error) {
+		return instance.SelectHistograms(ctx, req)
+	})
+}
+
+// SelectTargetMetadata returns the metadata of the targets of the matching series.
+func (i *Ingester) SelectTargetMetadata(ctx context.Context, req *connect.Request[ingestv1.SelectTargetMetadataRequest]) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error) {
+	return forInstanceUnary(ctx, i, func(instance *instance) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error) {
+		return instance.SelectTargetMetadata(ctx, req)
+	})
+}
@@ -0,0 +1,315 @@
+package ingester
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+const (
+	// localDir is the directory of the local blocks within the data path of a tenant.
+	localDir = "local"
+	// restoreDir is the directory used to extract a snapshot before moving its blocks into place.
+	restoreDir = ".restore"
+)
+
+// SnapshotHandler flushes the heads of all tenants and streams all local blocks of the ingester as
+// a gzipped tar archive. The archive can be restored on another ingester with RestoreHandler.
+func (i *Ingester) SnapshotHandler(w http.ResponseWriter, req *http.Request) {
+	// flush the heads, so the snapshot includes the data not written to a block yet. The flushes
+	// don't hold the lock of the instances, which would block the pushes of new tenants.
+	i.instancesMtx.RLock()
+	instances := make([]*instance, 0, len(i.instances))
+	for _, inst := range i.instances {
+		instances = append(instances, inst)
+	}
+	i.instancesMtx.RUnlock()
+
+	for _, inst := range instances {
+		inst.evictMtx.RLock()
+		var err error
+		// an evicted instance has already been flushed.
+		if !inst.evicted {
+			err = inst.Flush(req.Context())
+		}
+		inst.evictMtx.RUnlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to flush tenant %s: %v", inst.tenantID, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	blocks, err := i.listLocalBlocks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=phlare-ingester-snapshot-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z")))
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, b := range blocks {
+		if err := addBlockToArchive(tw, i.dbConfig.DataPath, b); err != nil {
+			level.Error(i.logger).Log("msg", "failed to snapshot block", "block", b, "err", err)
+			abortSnapshot()
+		}
+	}
+	if err := tw.Close(); err != nil {
+		level.Error(i.logger).Log("msg", "failed to close snapshot archive", "err", err)
+		abortSnapshot()
+	}
+	if err := gw.Close(); err != nil {
+		level.Error(i.logger).Log("msg", "failed to close snapshot archive", "err", err)
+		abortSnapshot()
+	}
+	level.Info(i.logger).Log("msg", "snapshot of local blocks completed", "blocks", len(blocks))
+}
+
+// abortSnapshot aborts the response of a snapshot which failed once its status has been sent. The
+// connection is closed without the end of the chunked body, so clients fail to read the snapshot
+// rather than getting a truncated archive.
+func abortSnapshot() {
+	panic(http.ErrAbortHandler)
+}
+
+// listLocalBlocks returns the path, relative to the data path, of all complete local blocks of all tenants.
+func (i *Ingester) listLocalBlocks() ([]string, error) {
+	tenants, err := os.ReadDir(i.dbConfig.DataPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var blocks []string
+	for _, tenant := range tenants {
+		if !tenant.IsDir() || tenant.Name() == restoreDir {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(i.dbConfig.DataPath, tenant.Name(), localDir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			if _, err := ulid.Parse(e.Name()); err != nil || !e.IsDir() {
+				continue
+			}
+			b := filepath.Join(tenant.Name(), localDir, e.Name())
+			// blocks are moved into the local directory once complete, the meta file is written last.
+			if _, err := os.Stat(filepath.Join(i.dbConfig.DataPath, b, block.MetaFilename)); err != nil {
+				continue
+			}
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
+}
+
+func addBlockToArchive(tw *tar.Writer, dataPath, blockPath string) error {
+	files, err := os.ReadDir(filepath.Join(dataPath, blockPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the block has been deleted by the retention in the meantime.
+			return nil
+		}
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := addFileToArchive(tw, dataPath, filepath.Join(blockPath, f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addFileToArchive(tw *tar.Writer, dataPath, name string) error {
+	f, err := os.Open(filepath.Join(dataPath, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// RestoreHandler restores the local blocks from a snapshot created by SnapshotHandler. Blocks
+// already present on the ingester are skipped. Restored blocks are queried and shipped like any
+// other local block right away: they are loaded by the instances of their tenants, which are
+// created when missing.
+func (i *Ingester) RestoreHandler(w http.ResponseWriter, req *http.Request) {
+	body := req.Body
+	if i.cfg.MaxRestoreSize > 0 {
+		body = http.MaxBytesReader(w, body, i.cfg.MaxRestoreSize)
+	}
+	restored, err := i.restoreSnapshot(body)
+	if err != nil {
+		code := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	level.Info(i.logger).Log("msg", "snapshot restored", "blocks", len(restored))
+	if err := i.syncRestoredBlocks(req.Context(), restored); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		RestoredBlocks []string `json:"restoredBlocks"`
+	}{RestoredBlocks: restored}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (i *Ingester) restoreSnapshot(r io.Reader) ([]string, error) {
+	tmpDir := filepath.Join(i.dbConfig.DataPath, restoreDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid snapshot")
+	}
+	defer gr.Close()
+
+	// extract all blocks first, so a truncated snapshot doesn't leave partial blocks behind.
+	var blocks []string
+	seen := map[string]struct{}{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid snapshot")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		blockPath, err := snapshotBlockPath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[blockPath]; !ok {
+			seen[blockPath] = struct{}{}
+			blocks = append(blocks, blockPath)
+		}
+		if err := extractFile(tr, filepath.Join(tmpDir, filepath.FromSlash(hdr.Name))); err != nil {
+			return nil, err
+		}
+	}
+
+	var restored []string
+	for _, b := range blocks {
+		src := filepath.Join(tmpDir, b)
+		if _, err := os.Stat(filepath.Join(src, block.MetaFilename)); err != nil {
+			level.Warn(i.logger).Log("msg", "skipping incomplete block from snapshot", "block", b)
+			continue
+		}
+		dst := filepath.Join(i.dbConfig.DataPath, b)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return restored, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return restored, err
+		}
+		restored = append(restored, filepath.ToSlash(b))
+	}
+	return restored, nil
+}
+
+// syncRestoredBlocks loads the restored blocks in the instances of their tenants, which are
+// created when missing.
+func (i *Ingester) syncRestoredBlocks(ctx context.Context, restored []string) error {
+	tenants := map[string]struct{}{}
+	for _, b := range restored {
+		tenants[strings.Split(b, "/")[0]] = struct{}{}
+	}
+	for tenantID := range tenants {
+		if err := i.forInstance(tenant.InjectTenantID(ctx, tenantID), func(inst *instance) error {
+			return inst.SyncBlocks(ctx)
+		}); err != nil {
+			return fmt.Errorf("failed to load the restored blocks of tenant %s: %w", tenantID, err)
+		}
+	}
+	return nil
+}
+
+// snapshotBlockPath validates the name of a file in a snapshot, which must be of the form
+// <tenant>/local/<block ulid>/<file>, and returns the path of its block.
+func snapshotBlockPath(name string) (string, error) {
+	parts := strings.Split(name, "/")
+	// the restore directory is not a tenant, the snapshot is extracted in it.
+	if len(parts) != 4 || parts[1] != localDir || parts[0] == restoreDir {
+		return "", fmt.Errorf("unexpected file in snapshot: %s", name)
+	}
+	for _, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			return "", fmt.Errorf("unexpected file in snapshot: %s", name)
+		}
+	}
+	if _, err := ulid.Parse(parts[2]); err != nil {
+		return "", fmt.Errorf("unexpected block in snapshot: %s", name)
+	}
+	return filepath.Join(parts[0], parts[1], parts[2]), nil
+}
+
+func extractFile(r io.Reader, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,160 @@
+package ingester
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/google/uuid"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/phlaredb"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+func newTestIngester(t *testing.T, dataPath string) *Ingester {
+	t.Helper()
+	ctx := phlarecontext.WithLogger(context.Background(), log.NewNopLogger())
+	ctx = phlarecontext.WithRegistry(ctx, prometheus.NewRegistry())
+	ing, err := New(ctx, defaultIngesterTestConfig(t), phlaredb.Config{
+		DataPath:         dataPath,
+		MaxBlockDuration: 30 * time.Hour,
+	}, nil, &fakeLimits{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), ing))
+	t.Cleanup(func() {
+		require.NoError(t, services.StopAndAwaitTerminated(context.Background(), ing))
+	})
+	return ing
+}
+
+func Test_SnapshotRestore(t *testing.T) {
+	srcPath, dstPath := t.TempDir(), t.TempDir()
+	src := newTestIngester(t, srcPath)
+	dst := newTestIngester(t, dstPath)
+
+	push := func(ing *Ingester, tenantID string) {
+		_, err := ing.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels: phlaremodel.LabelsFromStrings("foo", "bar"),
+					Samples: []*pushv1.RawSample{
+						{
+							ID:         uuid.NewString(),
+							RawProfile: testProfile(t),
+						},
+					},
+				},
+			},
+		}))
+		require.NoError(t, err)
+	}
+	for _, tenantID := range []string{"foo", "bar"} {
+		push(src, tenantID)
+	}
+	// the instance of foo exists already on the destination, the one of bar doesn't.
+	push(dst, "foo")
+	foo, ok := dst.getInstanceByID("foo")
+	require.True(t, ok)
+	fooQueriers := len(foo.Queriers())
+
+	// the snapshot flushes the heads of all tenants.
+	rec := httptest.NewRecorder()
+	src.SnapshotHandler(rec, httptest.NewRequest(http.MethodPost, "/ingester/snapshot", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	snapshot := rec.Body.Bytes()
+
+	rec = httptest.NewRecorder()
+	dst.RestoreHandler(rec, httptest.NewRequest(http.MethodPost, "/ingester/restore", bytes.NewReader(snapshot)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp struct {
+		RestoredBlocks []string `json:"restoredBlocks"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.RestoredBlocks, 2)
+
+	for _, b := range resp.RestoredBlocks {
+		srcFiles, err := os.ReadDir(filepath.Join(srcPath, b))
+		require.NoError(t, err)
+		dstFiles, err := os.ReadDir(filepath.Join(dstPath, b))
+		require.NoError(t, err)
+		require.Equal(t, len(srcFiles), len(dstFiles))
+	}
+	_, err := os.Stat(filepath.Join(dstPath, restoreDir))
+	require.True(t, os.IsNotExist(err))
+
+	// the restored blocks are queried right away.
+	require.Len(t, foo.Queriers(), fooQueriers+1)
+	bar, ok := dst.getInstanceByID("bar")
+	require.True(t, ok)
+	metas, err := bar.BlockMetas(context.Background())
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+
+	// restoring the same snapshot again is a no-op.
+	rec = httptest.NewRecorder()
+	dst.RestoreHandler(rec, httptest.NewRequest(http.MethodPost, "/ingester/restore", bytes.NewReader(snapshot)))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Empty(t, resp.RestoredBlocks)
+
+	// the snapshots larger than the limit are rejected.
+	dst.cfg.MaxRestoreSize = int64(len(snapshot) / 2)
+	rec = httptest.NewRecorder()
+	dst.RestoreHandler(rec, httptest.NewRequest(http.MethodPost, "/ingester/restore", bytes.NewReader(snapshot)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, rec.Body.String())
+}
+
+func Test_SnapshotAbort(t *testing.T) {
+	dataPath := t.TempDir()
+	ing := newTestIngester(t, dataPath)
+
+	// a block whose files can't be read fails the snapshot once the response has started.
+	blockPath := filepath.Join(dataPath, "foo", localDir, "01GPXFWCQ8VBXN1E3QV8JWJP6N")
+	require.NoError(t, os.MkdirAll(blockPath, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(blockPath, block.MetaFilename), []byte("{}"), 0o644))
+	require.NoError(t, os.Symlink(filepath.Join(dataPath, "missing"), filepath.Join(blockPath, "profiles.parquet")))
+
+	s := httptest.NewServer(http.HandlerFunc(ing.SnapshotHandler))
+	defer s.Close()
+	// the client fails to read the response, whether the status was sent or not.
+	resp, err := http.Post(s.URL, "", nil)
+	if err == nil {
+		defer resp.Body.Close()
+		_, err = io.ReadAll(resp.Body)
+	}
+	require.Error(t, err)
+}
+
+func Test_snapshotBlockPath(t *testing.T) {
+	p, err := snapshotBlockPath("foo/local/01GPXFWCQ8VBXN1E3QV8JWJP6N/meta.json")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join("foo", "local", "01GPXFWCQ8VBXN1E3QV8JWJP6N"), p)
+
+	for _, name := range []string{
+		"../local/01GPXFWCQ8VBXN1E3QV8JWJP6N/meta.json",
+		"foo/local/01GPXFWCQ8VBXN1E3QV8JWJP6N/../../../etc",
+		"foo/head/01GPXFWCQ8VBXN1E3QV8JWJP6N/meta.json",
+		"foo/local/not-a-block/meta.json",
+		"/foo/local/01GPXFWCQ8VBXN1E3QV8JWJP6N/meta.json",
+		".restore/local/01GPXFWCQ8VBXN1E3QV8JWJP6N/meta.json",
+	} {
+		_, err := snapshotBlockPath(name)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,103 @@
+package ingester
+
+import (
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/common/model"
+
+	"github.com/grafana/phlare/pkg/phlaredb"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+type tenantStats struct {
+	TenantID string             `json:"tenantId"`
+	LastPush time.Time          `json:"lastPush"`
+	Head     phlaredb.HeadStats `json:"head"`
+}
+
+type tenantsResponse struct {
+	Tenants []tenantStats `json:"tenants"`
+}
+
+var tenantsPageTemplate = template.Must(template.New("tenants").Funcs(template.FuncMap{
+	"bytes": humanize.Bytes,
+	"timestamp": func(t model.Time) string {
+		if t == 0 {
+			return "-"
+		}
+		return t.Time().UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Ingester Tenants</title>
+	</head>
+	<body>
+		<h1>Ingester Tenants</h1>
+		<p>The stats of the heads receiving the profiles of the tenants.</p>
+		<table border="1" cellpadding="5">
+			<thead>
+				<tr>
+					<th>Tenant</th>
+					<th>Head</th>
+					<th>Series</th>
+					<th>Profiles</th>
+					<th>Samples</th>
+					<th>Memory</th>
+					<th>Oldest Profile</th>
+					<th>Newest Profile</th>
+					<th>Last Push</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range .Tenants }}
+				<tr>
+					<td>{{ .TenantID }}</td>
+					<td>{{ .Head.ULID }}</td>
+					<td>{{ .Head.NumSeries }}</td>
+					<td>{{ .Head.NumProfiles }}</td>
+					<td>{{ .Head.NumSamples }}</td>
+					<td>{{ bytes .Head.MemoryBytes }}</td>
+					<td>{{ timestamp .Head.MinTime }}</td>
+					<td>{{ timestamp .Head.MaxTime }}</td>
+					<td>{{ .LastPush.UTC.Format "2006-01-02T15:04:05Z07:00" }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+	</body>
+</html>`))
+
+// TenantsHandler shows the stats of the head of each tenant of the ingester: its series, profiles
+// and memory, and the time range of its profiles. It responds with JSON when requested with
+// 'Accept: application/json' or '?format=json'.
+func (i *Ingester) TenantsHandler(w http.ResponseWriter, req *http.Request) {
+	i.instancesMtx.RLock()
+	instances := make([]*instance, 0, len(i.instances))
+	for _, inst := range i.instances {
+		instances = append(instances, inst)
+	}
+	i.instancesMtx.RUnlock()
+
+	res := tenantsResponse{Tenants: make([]tenantStats, 0, len(instances))}
+	for _, inst := range instances {
+		inst.evictMtx.RLock()
+		if !inst.evicted {
+			res.Tenants = append(res.Tenants, tenantStats{
+				TenantID: inst.tenantID,
+				LastPush: time.Unix(0, inst.lastPush.Load()),
+				Head:     inst.Head().Stats(),
+			})
+		}
+		inst.evictMtx.RUnlock()
+	}
+	sort.Slice(res.Tenants, func(a, b int) bool {
+		return res.Tenants[a].TenantID < res.Tenants[b].TenantID
+	})
+	util.RenderHTTPResponse(w, res, tenantsPageTemplate, req)
+}
@@ -0,0 +1,74 @@
+package ingester
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+func Test_TenantsHandler(t *testing.T) {
+	ing := newTestIngester(t, t.TempDir())
+	for _, tenantID := range []string{"foo", "bar"} {
+		_, err := ing.Push(tenant.InjectTenantID(context.Background(), tenantID), connect.NewRequest(&pushv1.PushRequest{
+			Series: []*pushv1.RawProfileSeries{
+				{
+					Labels:  phlaremodel.LabelsFromStrings("foo", "bar"),
+					Samples: []*pushv1.RawSample{{ID: uuid.NewString(), RawProfile: testProfile(t)}},
+				},
+			},
+		}))
+		require.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ingester/tenants", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	ing.TenantsHandler(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp tenantsResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Tenants, 2)
+	for i, tenantID := range []string{"bar", "foo"} {
+		stats := resp.Tenants[i]
+		require.Equal(t, tenantID, stats.TenantID)
+		// a heap profile is split into a series per sample type.
+		require.Equal(t, uint64(4), stats.Head.NumSeries)
+		require.Equal(t, uint64(4), stats.Head.NumProfiles)
+		require.NotZero(t, stats.Head.MemoryBytes)
+		require.NotZero(t, stats.Head.MinTime)
+		require.Equal(t, stats.Head.MinTime, stats.Head.MaxTime)
+	}
+
+	rec = httptest.NewRecorder()
+	ing.TenantsHandler(rec, httptest.NewRequest(http.MethodGet, "/ingester/tenants", nil))
+	require.Equal(t, "text/html", rec.Header().Get("Content-Type"))
+	require.Contains(t, rec.Body.String(), "<td>foo</td>")
+
+	// once flushed, the head is listed as a local block and a new head is empty.
+	ctx := tenant.InjectTenantID(context.Background(), "foo")
+	head := resp.Tenants[1].Head
+	_, err := ing.Flush(ctx, connect.NewRequest(&ingestv1.FlushRequest{}))
+	require.NoError(t, err)
+	blocks, err := ing.BlockMetadata(ctx, connect.NewRequest(&ingestv1.BlockMetadataRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, "head", blocks.Msg.Head.State)
+	require.Zero(t, blocks.Msg.Head.NumProfiles)
+	require.Zero(t, blocks.Msg.Head.MinTime)
+	require.Len(t, blocks.Msg.Blocks, 1)
+	require.Equal(t, head.ULID.String(), blocks.Msg.Blocks[0].Ulid)
+	require.Equal(t, "local", blocks.Msg.Blocks[0].State)
+	require.Equal(t, uint64(4), blocks.Msg.Blocks[0].NumProfiles)
+	require.Equal(t, int64(head.MinTime), blocks.Msg.Blocks[0].MinTime)
+	require.NotZero(t, blocks.Msg.Blocks[0].Size)
+}
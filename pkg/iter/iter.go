@@ -1,6 +1,7 @@
 package iter
 
 import (
+	"context"
 	"sort"
 
 	"github.com/samber/lo"
@@ -67,6 +68,48 @@ func (*errSeekIterator[A, B]) Seek(_ B) bool {
 	return false
 }
 
+// contextCheckInterval is the number of items between two checks of the context of the
+// iterators returned by WithContext.
+const contextCheckInterval = 128
+
+type contextIterator[A any] struct {
+	Iterator[A]
+	ctx context.Context
+	n   int
+	err error
+}
+
+// WithContext returns an iterator stopping once the context is done, with its error. The context is
+// checked every few items, so that the iteration of cancelled queries stops quickly without
+// slowing down the others.
+func WithContext[A any](ctx context.Context, it Iterator[A]) Iterator[A] {
+	return &contextIterator[A]{
+		Iterator: it,
+		ctx:      ctx,
+	}
+}
+
+func (i *contextIterator[A]) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	if i.n%contextCheckInterval == 0 {
+		if err := i.ctx.Err(); err != nil {
+			i.err = err
+			return false
+		}
+	}
+	i.n++
+	return i.Iterator.Next()
+}
+
+func (i *contextIterator[A]) Err() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iterator.Err()
+}
+
 type sliceIterator[A any] struct {
 	list []A
 	cur  A
@@ -0,0 +1,32 @@
+package iter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithContext(t *testing.T) {
+	it := WithContext(context.Background(), NewSliceIterator(lo.Range(10)))
+	var count int
+	for it.Next() {
+		count++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 10, count)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it = WithContext(ctx, NewSliceIterator(lo.Range(1000)))
+	count = 0
+	for it.Next() {
+		count++
+		if count == 10 {
+			cancel()
+		}
+	}
+	require.ErrorIs(t, it.Err(), context.Canceled)
+	require.Equal(t, contextCheckInterval, count)
+}
@@ -0,0 +1,141 @@
+package model
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+// HistogramSlot is the time slot of the histograms of the profile totals of a series. A
+// histogram holds the profiles after the start of its slot and until its end included.
+const HistogramSlot = 15 * time.Second
+
+// histogramSchema is the resolution of the buckets of the histograms, as in the native
+// histograms of Prometheus: each power of two is split in 2^histogramSchema buckets.
+const histogramSchema = 3
+
+// histogramBounds are the upper bounds of the buckets of a power of two, as the fractions
+// returned by math.Frexp.
+var histogramBounds = func() []float64 {
+	bounds := make([]float64, 1<<histogramSchema)
+	for i := range bounds {
+		bounds[i] = math.Exp2(float64(i)/float64(len(bounds))) / 2
+	}
+	return bounds
+}()
+
+// HistogramSlotEnd returns the end of the slot of the timestamp, in milliseconds.
+func HistogramSlotEnd(ts int64) int64 {
+	slot := HistogramSlot.Milliseconds()
+	end := ts / slot * slot
+	if end < ts {
+		end += slot
+	}
+	return end
+}
+
+// HistogramBucketIndex returns the index of the bucket of the positive value, the bucket i
+// holding the values in (2^((i-1)/8), 2^(i/8)].
+func HistogramBucketIndex(v float64) int32 {
+	frac, exp := math.Frexp(v)
+	return int32(sort.SearchFloat64s(histogramBounds, frac) + (exp-1)*len(histogramBounds))
+}
+
+// HistogramBucketUpperBound returns the upper bound of the bucket of the index, included.
+func HistogramBucketUpperBound(i int32) float64 {
+	frac := histogramBounds[int(i)&(len(histogramBounds)-1)]
+	exp := int(i)>>histogramSchema + 1
+	return math.Ldexp(frac, exp)
+}
+
+// IsHistogramBucketBound returns whether the value is the upper bound of a bucket, so that
+// the buckets below and above it are not split by it.
+func IsHistogramBucketBound(v float64) bool {
+	return v > 0 && HistogramBucketUpperBound(HistogramBucketIndex(v)) == v
+}
+
+// ObserveHistogram adds the total of a profile to the histogram.
+func ObserveHistogram(h *ingestv1.Histogram, total int64) {
+	if h.Count == 0 || total < h.Min {
+		h.Min = total
+	}
+	if h.Count == 0 || total > h.Max {
+		h.Max = total
+	}
+	h.Count++
+	h.Sum += total
+	if total <= 0 {
+		h.ZeroCount++
+		return
+	}
+	addHistogramBucket(h, HistogramBucketIndex(float64(total)), 1)
+}
+
+// MergeHistograms adds the profiles of the histogram src to the histogram dst.
+func MergeHistograms(dst, src *ingestv1.Histogram) {
+	if src.Count == 0 {
+		return
+	}
+	if dst.Count == 0 || src.Min < dst.Min {
+		dst.Min = src.Min
+	}
+	if dst.Count == 0 || src.Max > dst.Max {
+		dst.Max = src.Max
+	}
+	dst.Count += src.Count
+	dst.Sum += src.Sum
+	dst.ZeroCount += src.ZeroCount
+	for _, b := range src.Buckets {
+		addHistogramBucket(dst, b.Index, b.Count)
+	}
+}
+
+func addHistogramBucket(h *ingestv1.Histogram, index int32, count uint64) {
+	i := sort.Search(len(h.Buckets), func(i int) bool { return h.Buckets[i].Index >= index })
+	if i < len(h.Buckets) && h.Buckets[i].Index == index {
+		h.Buckets[i].Count += count
+		return
+	}
+	h.Buckets = append(h.Buckets, nil)
+	copy(h.Buckets[i+1:], h.Buckets[i:])
+	h.Buckets[i] = &ingestv1.HistogramBucket{Index: index, Count: count}
+}
+
+// MergeSeriesHistograms merges the histograms of the same series and slot of the different
+// sources, summing them. The series are sorted by fingerprint.
+func MergeSeriesHistograms(sources ...[]*ingestv1.SeriesHistograms) []*ingestv1.SeriesHistograms {
+	bySeries := make(map[uint64]map[int64]*ingestv1.Histogram)
+	for _, series := range sources {
+		for _, s := range series {
+			slots, ok := bySeries[s.Fingerprint]
+			if !ok {
+				slots = make(map[int64]*ingestv1.Histogram, len(s.Histograms))
+				bySeries[s.Fingerprint] = slots
+			}
+			for _, h := range s.Histograms {
+				m, ok := slots[h.Timestamp]
+				if !ok {
+					m = &ingestv1.Histogram{Timestamp: h.Timestamp}
+					slots[h.Timestamp] = m
+				}
+				MergeHistograms(m, h)
+			}
+		}
+	}
+	result := make([]*ingestv1.SeriesHistograms, 0, len(bySeries))
+	for fp, slots := range bySeries {
+		s := &ingestv1.SeriesHistograms{
+			Fingerprint: fp,
+			Histograms:  make([]*ingestv1.Histogram, 0, len(slots)),
+		}
+		for _, h := range slots {
+			s.Histograms = append(s.Histograms, h)
+		}
+		sort.Slice(s.Histograms, func(i, j int) bool { return s.Histograms[i].Timestamp < s.Histograms[j].Timestamp })
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Fingerprint < result[j].Fingerprint })
+	return result
+}
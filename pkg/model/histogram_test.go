@@ -0,0 +1,79 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	for _, v := range []float64{0.3, 1, 1.05, 2, 3, 1000, 1024, 123456789} {
+		i := HistogramBucketIndex(v)
+		require.LessOrEqual(t, v, HistogramBucketUpperBound(i), v)
+		require.Greater(t, v, HistogramBucketUpperBound(i-1), v)
+	}
+	require.Equal(t, int32(0), HistogramBucketIndex(1))
+	require.Equal(t, int32(8), HistogramBucketIndex(2))
+	require.Equal(t, int32(-8), HistogramBucketIndex(0.5))
+	require.Equal(t, 1024.0, HistogramBucketUpperBound(80))
+
+	require.True(t, IsHistogramBucketBound(1))
+	require.True(t, IsHistogramBucketBound(4096))
+	require.True(t, IsHistogramBucketBound(HistogramBucketUpperBound(3)))
+	require.False(t, IsHistogramBucketBound(3))
+	require.False(t, IsHistogramBucketBound(0))
+	require.False(t, IsHistogramBucketBound(-2))
+}
+
+func TestHistogramSlotEnd(t *testing.T) {
+	require.Equal(t, int64(0), HistogramSlotEnd(0))
+	require.Equal(t, int64(15000), HistogramSlotEnd(1))
+	require.Equal(t, int64(15000), HistogramSlotEnd(15000))
+	require.Equal(t, int64(30000), HistogramSlotEnd(15001))
+}
+
+func TestObserveHistogram(t *testing.T) {
+	h := &ingestv1.Histogram{}
+	for _, v := range []int64{5, 0, 5, 1000, -3} {
+		ObserveHistogram(h, v)
+	}
+	require.Equal(t, &ingestv1.Histogram{
+		Count:     5,
+		Sum:       1007,
+		Min:       -3,
+		Max:       1000,
+		ZeroCount: 2,
+		Buckets: []*ingestv1.HistogramBucket{
+			{Index: HistogramBucketIndex(5), Count: 2},
+			{Index: HistogramBucketIndex(1000), Count: 1},
+		},
+	}, h)
+}
+
+func TestMergeSeriesHistograms(t *testing.T) {
+	a := &ingestv1.Histogram{Timestamp: 15000}
+	ObserveHistogram(a, 3)
+	b := &ingestv1.Histogram{Timestamp: 15000}
+	ObserveHistogram(b, 10)
+	c := &ingestv1.Histogram{Timestamp: 30000}
+	ObserveHistogram(c, 3)
+
+	merged := MergeSeriesHistograms(
+		[]*ingestv1.SeriesHistograms{{Fingerprint: 2, Histograms: []*ingestv1.Histogram{a}}},
+		[]*ingestv1.SeriesHistograms{{Fingerprint: 2, Histograms: []*ingestv1.Histogram{c, b}}, {Fingerprint: 1, Histograms: []*ingestv1.Histogram{c}}},
+	)
+	require.Equal(t, []*ingestv1.SeriesHistograms{
+		{Fingerprint: 1, Histograms: []*ingestv1.Histogram{c}},
+		{Fingerprint: 2, Histograms: []*ingestv1.Histogram{
+			{
+				Timestamp: 15000, Count: 2, Sum: 13, Min: 3, Max: 10,
+				Buckets: []*ingestv1.HistogramBucket{{Index: HistogramBucketIndex(3), Count: 1}, {Index: HistogramBucketIndex(10), Count: 1}},
+			},
+			c,
+		}},
+	}, merged)
+	// the sources are not modified.
+	require.Equal(t, uint64(1), a.Count)
+}
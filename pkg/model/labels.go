@@ -21,6 +21,8 @@ const (
 	LabelNameUnit        = "__unit__"
 	LabelNamePeriodType  = "__period_type__"
 	LabelNamePeriodUnit  = "__period_unit__"
+	LabelNameRuntime     = "__runtime__"
+	LabelNameSpy         = "__spy__"
 
 	labelSep = '\xfe'
 )
@@ -203,6 +205,27 @@ func LabelPairsString(lbs []*typesv1.LabelPair) string {
 	return b.String()
 }
 
+// ParseSelector parses a label selector with the PromQL syntax and semantics. Like a metric name,
+// a profile type ID can prefix the selector as a shorthand for a __profile_type__ matcher:
+//
+//	process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}
+func ParseSelector(s string) ([]*labels.Matcher, error) {
+	matchers, err := parser.ParseMetricSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matchers {
+		if m.Name != labels.MetricName || m.Type != labels.MatchEqual {
+			continue
+		}
+		if _, err := ParseProfileTypeSelector(m.Value); err != nil {
+			continue
+		}
+		matchers[i] = labels.MustNewMatcher(labels.MatchEqual, LabelNameProfileType, m.Value)
+	}
+	return matchers, nil
+}
+
 // StringToLabelsPairs converts a string representation of label pairs to a slice of label pairs.
 func StringToLabelsPairs(s string) ([]*typesv1.LabelPair, error) {
 	matchers, err := parser.ParseMetricSelector(s)
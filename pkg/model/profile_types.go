@@ -0,0 +1,154 @@
+package model
+
+import "strings"
+
+const (
+	// UnitNanoseconds is the canonical unit of the sample types measuring time.
+	UnitNanoseconds = "nanoseconds"
+	// UnitCount is the canonical unit of the sample types counting events.
+	UnitCount = "count"
+)
+
+type unitKind int
+
+const (
+	unitUnknown unitKind = iota
+	unitTime
+	unitCount
+)
+
+type canonicalUnit struct {
+	kind   unitKind
+	name   string
+	factor int64
+}
+
+// units are the units reported by the profilers, with their canonical unit and the factor the
+// values are multiplied by to be expressed in it.
+var units = map[string]canonicalUnit{
+	"nanoseconds":  {unitTime, UnitNanoseconds, 1},
+	"nanosecond":   {unitTime, UnitNanoseconds, 1},
+	"ns":           {unitTime, UnitNanoseconds, 1},
+	"microseconds": {unitTime, UnitNanoseconds, 1e3},
+	"microsecond":  {unitTime, UnitNanoseconds, 1e3},
+	"us":           {unitTime, UnitNanoseconds, 1e3},
+	"µs":           {unitTime, UnitNanoseconds, 1e3},
+	"milliseconds": {unitTime, UnitNanoseconds, 1e6},
+	"millisecond":  {unitTime, UnitNanoseconds, 1e6},
+	"ms":           {unitTime, UnitNanoseconds, 1e6},
+	"seconds":      {unitTime, UnitNanoseconds, 1e9},
+	"second":       {unitTime, UnitNanoseconds, 1e9},
+	"s":            {unitTime, UnitNanoseconds, 1e9},
+	"count":        {unitCount, UnitCount, 1},
+	"counts":       {unitCount, UnitCount, 1},
+	"events":       {unitCount, UnitCount, 1},
+}
+
+// canonicalSampleType is the canonical name of a sample type, depending on whether it measures
+// time or counts events. It's empty when the kind doesn't apply.
+type canonicalSampleType struct {
+	time, count string
+}
+
+// sampleTypes are the names of the sample types of the common profilers, e.g. async-profiler,
+// py-spy or the Node.js and .NET profilers, which measure the same thing as the sample types of
+// another name. The names are looked up in lower case, with `-` and spaces replaced by `_`.
+//
+// The canonical names are those of the Go profiles where they exist: `cpu`, `delay` and
+// `contentions`.
+var sampleTypes = map[string]canonicalSampleType{
+	// the wall-clock time, on and off CPU.
+	"wall":       {time: "wall"},
+	"wall_clock": {time: "wall"},
+	"wallclock":  {time: "wall"},
+	"wall_time":  {time: "wall"},
+	"walltime":   {time: "wall"},
+	// the time spent off CPU, blocked or sleeping.
+	"off_cpu":      {time: "off_cpu"},
+	"offcpu":       {time: "off_cpu"},
+	"off_cpu_time": {time: "off_cpu"},
+	// the CPU time, sampled by a timer signal by async-profiler's itimer mode.
+	"itimer":   {time: "cpu"},
+	"cpu_time": {time: "cpu"},
+	// the time spent waiting for locks, and the number of contended lock acquisitions.
+	"lock":                 {time: "delay", count: "contentions"},
+	"lock_time":            {time: "delay"},
+	"lock_duration":        {time: "delay"},
+	"lock_contention":      {time: "delay", count: "contentions"},
+	"lock_contention_time": {time: "delay"},
+	"contention_time":      {time: "delay"},
+	"lock_count":           {count: "contentions"},
+	"lock_contentions":     {count: "contentions"},
+}
+
+// CanonicalUnit returns the canonical unit of the unit, and the factor the values are multiplied
+// by to be expressed in it. The unknown units are returned as is, with a factor of 1.
+func CanonicalUnit(unit string) (string, int64) {
+	u, ok := units[strings.ToLower(unit)]
+	if !ok {
+		return unit, 1
+	}
+	return u.name, u.factor
+}
+
+// CanonicalSampleType returns the canonical name and unit of the sample type, so that the same
+// measurement reported by the profilers of different languages, e.g. the wall-clock time in
+// microseconds of one and in nanoseconds of another, is queried with a single profile type. The
+// values of the samples are multiplied by the factor returned. The sample types unknown, or whose
+// unit doesn't fit their name, are returned with their unit canonicalized only.
+func CanonicalSampleType(sampleType, unit string) (string, string, int64) {
+	u, ok := units[strings.ToLower(unit)]
+	if !ok {
+		return sampleType, unit, 1
+	}
+	key := strings.NewReplacer("-", "_", " ", "_").Replace(strings.ToLower(sampleType))
+	if t, ok := sampleTypes[key]; ok {
+		switch {
+		case u.kind == unitTime && t.time != "":
+			sampleType = t.time
+		case u.kind == unitCount && t.count != "":
+			sampleType = t.count
+		}
+	}
+	return sampleType, u.name, u.factor
+}
+
+// ValidSampleTypeUnit returns whether the unit of the sample type fits it. The sample types of the
+// common profilers, e.g. `wall-clock` or `lock`, must be in a unit of time or a count they
+// measure, so they are canonicalized with the sample types of the other profilers. The other
+// sample types are always valid.
+func ValidSampleTypeUnit(sampleType, unit string) bool {
+	key := strings.NewReplacer("-", "_", " ", "_").Replace(strings.ToLower(sampleType))
+	t, ok := sampleTypes[key]
+	if !ok {
+		return true
+	}
+	switch units[strings.ToLower(unit)].kind {
+	case unitTime:
+		return t.time != ""
+	case unitCount:
+		return t.count != ""
+	default:
+		return false
+	}
+}
+
+// ProfileTypeEnabled returns whether the profiles of the name, e.g. process_cpu or memory, are
+// enabled by the lists of enabled and disabled names. All the names are enabled when the enabled
+// list is empty, and the disabled names never are.
+func ProfileTypeEnabled(name string, enabled, disabled []string) bool {
+	for _, n := range disabled {
+		if n == name {
+			return false
+		}
+	}
+	if len(enabled) == 0 {
+		return true
+	}
+	for _, n := range enabled {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalSampleType(t *testing.T) {
+	for _, tc := range []struct {
+		sampleType, unit   string
+		expectedSampleType string
+		expectedUnit       string
+		expectedFactor     int64
+	}{
+		{"cpu", "nanoseconds", "cpu", "nanoseconds", 1},
+		{"wall", "microseconds", "wall", "nanoseconds", 1000},
+		{"Wall-Clock", "ms", "wall", "nanoseconds", 1e6},
+		{"off-cpu", "seconds", "off_cpu", "nanoseconds", 1e9},
+		{"itimer", "ns", "cpu", "nanoseconds", 1},
+		{"lock", "nanoseconds", "delay", "nanoseconds", 1},
+		{"lock", "count", "contentions", "count", 1},
+		{"lock_count", "nanoseconds", "lock_count", "nanoseconds", 1},
+		{"wall", "samples", "wall", "samples", 1},
+		{"alloc_space", "bytes", "alloc_space", "bytes", 1},
+	} {
+		t.Run(tc.sampleType+":"+tc.unit, func(t *testing.T) {
+			sampleType, unit, factor := CanonicalSampleType(tc.sampleType, tc.unit)
+			require.Equal(t, tc.expectedSampleType, sampleType)
+			require.Equal(t, tc.expectedUnit, unit)
+			require.Equal(t, tc.expectedFactor, factor)
+		})
+	}
+}
+
+func TestValidSampleTypeUnit(t *testing.T) {
+	for _, tc := range []struct {
+		sampleType, unit string
+		expected         bool
+	}{
+		{"wall", "microseconds", true},
+		{"Wall-Clock", "ms", true},
+		{"lock", "count", true},
+		{"lock_count", "count", true},
+		{"lock_count", "nanoseconds", false},
+		{"off_cpu", "count", false},
+		{"wall", "bytes", false},
+		{"alloc_space", "bytes", true},
+		{"cpu", "whatever", true},
+	} {
+		require.Equal(t, tc.expected, ValidSampleTypeUnit(tc.sampleType, tc.unit), "%s:%s", tc.sampleType, tc.unit)
+	}
+}
+
+func TestProfileTypeEnabled(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		enabled, disabled []string
+		expected          bool
+	}{
+		{"process_cpu", nil, nil, true},
+		{"mutex", nil, []string{"mutex", "block"}, false},
+		{"memory", nil, []string{"mutex", "block"}, true},
+		{"memory", []string{"process_cpu", "memory"}, nil, true},
+		{"block", []string{"process_cpu", "memory"}, nil, false},
+		{"memory", []string{"process_cpu", "memory"}, []string{"memory"}, false},
+	} {
+		require.Equal(t, tc.expected, ProfileTypeEnabled(tc.name, tc.enabled, tc.disabled), "%s enabled=%v disabled=%v", tc.name, tc.enabled, tc.disabled)
+	}
+}
@@ -16,9 +16,14 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 		posByName   map[string]int32
 		hasher      StacktracesHasher
 		stacktraces = map[uint64]*ingestv1.StacktraceSample{}
+		// the variances of the estimated totals of sampled results add up.
+		variance float64
 	)
 
 	for _, resp := range responses {
+		if resp != nil {
+			variance += resp.TotalVariance
+		}
 		// skip empty results
 		if resp == nil || len(resp.Stacktraces) == 0 {
 			continue
@@ -91,6 +96,7 @@ func MergeBatchMergeStacktraces(responses ...*ingestv1.MergeProfilesStacktracesR
 	if result == nil {
 		result = &ingestv1.MergeProfilesStacktracesResult{}
 	}
+	result.TotalVariance = variance
 
 	// sort stacktraces by function name
 	sortStacktraces(result)
@@ -112,6 +112,44 @@ func TestMergeBatchResponse(t *testing.T) {
 				FunctionNames: []string{"my", "other", "stack", "foo", "bar"},
 			},
 		},
+		{
+			name: "variance",
+			in: []*ingestv1.MergeProfilesStacktracesResult{
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{0},
+							Value:       10,
+						},
+					},
+					FunctionNames: []string{"my"},
+					TotalVariance: 4,
+				},
+				{
+					TotalVariance: 1,
+				},
+				{
+					Stacktraces: []*ingestv1.StacktraceSample{
+						{
+							FunctionIds: []int32{0},
+							Value:       20,
+						},
+					},
+					FunctionNames: []string{"my"},
+					TotalVariance: 2,
+				},
+			},
+			expected: &ingestv1.MergeProfilesStacktracesResult{
+				Stacktraces: []*ingestv1.StacktraceSample{
+					{
+						FunctionIds: []int32{0},
+						Value:       30,
+					},
+				},
+				FunctionNames: []string{"my"},
+				TotalVariance: 7,
+			},
+		},
 	} {
 		tc := tc
 		t.Run(tc.name, func(t *testing.T) {
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"sort"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// MergeTargetMetadata merges the metadata of a target, sorted by name and first seen time. The
+// consecutive time ranges of the same value of a name are merged into one. The metadata passed
+// is not modified.
+func MergeTargetMetadata(metadata ...[]*typesv1.TargetMetadata) []*typesv1.TargetMetadata {
+	var all []*typesv1.TargetMetadata
+	for _, m := range metadata {
+		all = append(all, m...)
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].Name != all[j].Name {
+			return all[i].Name < all[j].Name
+		}
+		return all[i].FirstSeen < all[j].FirstSeen
+	})
+	result := make([]*typesv1.TargetMetadata, 0, len(all))
+	for _, m := range all {
+		if n := len(result); n > 0 && result[n-1].Name == m.Name && result[n-1].Value == m.Value {
+			if last := result[n-1]; m.LastSeen > last.LastSeen {
+				last.LastSeen = m.LastSeen
+			}
+			continue
+		}
+		result = append(result, &typesv1.TargetMetadata{
+			Name:      m.Name,
+			Value:     m.Value,
+			FirstSeen: m.FirstSeen,
+			LastSeen:  m.LastSeen,
+		})
+	}
+	return result
+}
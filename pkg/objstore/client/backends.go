@@ -0,0 +1,63 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/thanos-io/objstore"
+)
+
+// BackendFactory creates the bucket client of a custom storage backend. The logger and the
+// registerer can be retrieved from the context with the phlare/context package.
+//
+// The returned bucket must implement objstore.Bucket. If it also implements the Bucket interface
+// of the phlare objstore package, its ReaderAt method is used to read the blocks, otherwise they
+// are read with range requests.
+type BackendFactory func(ctx context.Context, name string) (objstore.Bucket, error)
+
+var (
+	customBackendsMtx sync.RWMutex
+	customBackends    = map[string]BackendFactory{}
+)
+
+// RegisterBackend registers a custom storage backend, selected by setting the storage backend to
+// the given name. The backend is responsible for its own configuration, as unknown fields are
+// rejected by the configuration file. It must be called before the flags are registered,
+// typically from an init function, and panics if the name is already used.
+func RegisterBackend(name string, factory BackendFactory) {
+	customBackendsMtx.Lock()
+	defer customBackendsMtx.Unlock()
+	if _, ok := customBackends[name]; ok || isBuiltinBackend(name) {
+		panic(fmt.Sprintf("storage backend %q already registered", name))
+	}
+	customBackends[name] = factory
+}
+
+func isBuiltinBackend(name string) bool {
+	for _, b := range SupportedBackends {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+func customBackend(name string) (BackendFactory, bool) {
+	customBackendsMtx.RLock()
+	defer customBackendsMtx.RUnlock()
+	factory, ok := customBackends[name]
+	return factory, ok
+}
+
+func customBackendNames() []string {
+	customBackendsMtx.RLock()
+	defer customBackendsMtx.RUnlock()
+	names := make([]string, 0, len(customBackends))
+	for name := range customBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -47,6 +47,7 @@ var (
 
 	ErrUnsupportedStorageBackend        = errors.New("unsupported storage backend")
 	ErrInvalidCharactersInStoragePrefix = errors.New("storage prefix contains invalid characters, it may only contain digits and English alphabet letters")
+	ErrSSEWithoutS3                     = errors.New("server side encryption is only supported by the s3 storage backend")
 )
 
 type StorageBackendConfig struct {
@@ -61,9 +62,9 @@ type StorageBackendConfig struct {
 	Filesystem filesystem.Config `yaml:"filesystem"`
 }
 
-// Returns the supportedBackends for the package and any custom backends injected into the config.
+// Returns the supportedBackends for the package and any custom backends registered with RegisterBackend.
 func (cfg *StorageBackendConfig) supportedBackends() []string {
-	return SupportedBackends
+	return append(append([]string{}, SupportedBackends...), customBackendNames()...)
 }
 
 // RegisterFlags registers the backend storage config.
@@ -89,10 +90,20 @@ func (cfg *StorageBackendConfig) Validate() error {
 	if !lo.Contains(cfg.supportedBackends(), cfg.Backend) {
 		return ErrUnsupportedStorageBackend
 	}
+	// the encryption would be silently ignored by the other backends.
+	if cfg.Backend != S3 && cfg.S3.SSE != (s3.SSEConfig{}) {
+		return ErrSSEWithoutS3
+	}
 
 	switch cfg.Backend {
 	case S3:
 		return cfg.S3.Validate()
+	case GCS:
+		return cfg.GCS.Validate()
+	case Azure:
+		return cfg.Azure.Validate()
+	case Swift:
+		return cfg.Swift.Validate()
 	case COS:
 		return cfg.COS.Validate()
 	default:
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"filesystem": {
+			config: `
+backend: filesystem
+`,
+		},
+		"unknown backend": {
+			config: `
+backend: unknown
+`,
+			wantErr: true,
+		},
+		"azure with account key": {
+			config: `
+backend: azure
+azure:
+  account_name: account
+  account_key: key
+  container_name: phlare
+`,
+		},
+		"azure with user assigned identity": {
+			config: `
+backend: azure
+azure:
+  account_name: account
+  container_name: phlare
+  user_assigned_id: id
+`,
+		},
+		"azure with account key and user assigned identity": {
+			config: `
+backend: azure
+azure:
+  account_name: account
+  account_key: key
+  container_name: phlare
+  user_assigned_id: id
+`,
+			wantErr: true,
+		},
+		"azure without container": {
+			config: `
+backend: azure
+azure:
+  account_name: account
+`,
+			wantErr: true,
+		},
+		"gcs with default credentials": {
+			config: `
+backend: gcs
+gcs:
+  bucket_name: phlare
+`,
+		},
+		"gcs with invalid service account": {
+			config: `
+backend: gcs
+gcs:
+  bucket_name: phlare
+  service_account: /path/to/credentials.json
+`,
+			wantErr: true,
+		},
+		"swift with application credentials": {
+			config: `
+backend: swift
+swift:
+  auth_url: http://localhost:5000/v3
+  auth_version: 3
+  container_name: phlare
+  application_credential_id: id
+  application_credential_secret: secret
+`,
+		},
+		"s3 with server side encryption": {
+			config: `
+backend: s3
+s3:
+  endpoint: localhost:9000
+  bucket_name: phlare
+  signature_version: v4
+  sse:
+    type: SSE-S3
+`,
+		},
+		"server side encryption without s3": {
+			config: `
+backend: filesystem
+s3:
+  sse:
+    type: SSE-S3
+`,
+			wantErr: true,
+		},
+		"swift without credentials": {
+			config: `
+backend: swift
+swift:
+  auth_url: http://localhost:5000/v3
+  container_name: phlare
+`,
+			wantErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var cfg Config
+			require.NoError(t, yaml.Unmarshal([]byte(tc.config), &cfg))
+			err := cfg.Validate()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
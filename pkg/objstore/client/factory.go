@@ -40,7 +40,11 @@ func NewBucket(ctx context.Context, cfg Config, name string) (phlareobjstore.Buc
 	case Filesystem:
 		backendClient, err = filesystem.NewBucket(cfg.Filesystem.Directory)
 	default:
-		return nil, ErrUnsupportedStorageBackend
+		factory, ok := customBackend(cfg.Backend)
+		if !ok {
+			return nil, ErrUnsupportedStorageBackend
+		}
+		backendClient, err = factory(ctx, name)
 	}
 
 	if err != nil {
@@ -17,6 +17,7 @@ import (
 	"github.com/grafana/dskit/flagext"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
 	"gopkg.in/yaml.v3"
 
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
@@ -236,3 +237,37 @@ func TestNewPrefixedBucketClient(t *testing.T) {
 		assert.Equal(t, "content", string(b))
 	})
 }
+
+func TestRegisterBackend(t *testing.T) {
+	var names []string
+	RegisterBackend("test-inmemory", func(_ context.Context, name string) (objstore.Bucket, error) {
+		names = append(names, name)
+		return objstore.NewInMemBucket(), nil
+	})
+	require.Panics(t, func() {
+		RegisterBackend("test-inmemory", nil)
+	})
+	require.Panics(t, func() {
+		RegisterBackend(S3, nil)
+	})
+
+	cfg := Config{
+		StorageBackendConfig: StorageBackendConfig{Backend: "test-inmemory"},
+		StoragePrefix:        "prefix",
+	}
+	require.NoError(t, cfg.Validate())
+
+	ctx := context.Background()
+	client, err := NewBucket(ctx, cfg, "test")
+	require.NoError(t, err)
+	require.Equal(t, []string{"test"}, names)
+
+	require.NoError(t, client.Upload(ctx, "file", bytes.NewBufferString("content")))
+	r, err := client.ReaderAt(ctx, "file")
+	require.NoError(t, err)
+	defer r.Close()
+	b := make([]byte, 4)
+	_, err = r.ReadAt(b, 3)
+	require.NoError(t, err)
+	require.Equal(t, "tent", string(b))
+}
@@ -9,12 +9,16 @@ import (
 	"github.com/thanos-io/objstore"
 )
 
+// ReaderAt reads an object at arbitrary offsets, as required to read the parquet files of the blocks.
 type ReaderAt interface {
 	io.ReaderAt
 	io.Closer
 	Size() int64
 }
 
+// Bucket is the interface of the block storage. Any objstore.Bucket can be used as storage, see
+// client.RegisterBackend, implementing ReaderAt allows a backend to read the objects more efficiently
+// than with a range request per read.
 type Bucket interface {
 	objstore.Bucket
 	ReaderAt(ctx context.Context, filename string) (ReaderAt, error)
@@ -7,11 +7,48 @@ package azure
 
 import (
 	"flag"
+	"net/http"
+	"time"
 
 	"github.com/go-kit/log"
 	"github.com/grafana/dskit/flagext"
+	"github.com/pkg/errors"
 )
 
+var (
+	errMissingAccountName   = errors.New("azure storage account name is required")
+	errMissingContainerName = errors.New("azure storage container name is required")
+	errKeyAndUserAssignedID = errors.New("azure user assigned identity cannot be set when using account key authentication")
+	errNegativeMaxRetries   = errors.New("azure max retries must be greater than or equal to 0")
+)
+
+// HTTPConfig stores the http.Transport configuration for the Azure client.
+type HTTPConfig struct {
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout" category:"advanced"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout" category:"advanced"`
+	InsecureSkipVerify    bool          `yaml:"insecure_skip_verify" category:"advanced"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout" category:"advanced"`
+	ExpectContinueTimeout time.Duration `yaml:"expect_continue_timeout" category:"advanced"`
+	MaxIdleConns          int           `yaml:"max_idle_connections" category:"advanced"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_connections_per_host" category:"advanced"`
+	MaxConnsPerHost       int           `yaml:"max_connections_per_host" category:"advanced"`
+
+	// Allow upstream callers to inject a round tripper
+	Transport http.RoundTripper `yaml:"-"`
+}
+
+// RegisterFlagsWithPrefix registers the flags for Azure storage with the provided prefix
+func (cfg *HTTPConfig) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
+	f.DurationVar(&cfg.IdleConnTimeout, prefix+"azure.http.idle-conn-timeout", 90*time.Second, "The time an idle connection will remain idle before closing.")
+	f.DurationVar(&cfg.ResponseHeaderTimeout, prefix+"azure.http.response-header-timeout", 2*time.Minute, "The amount of time the client will wait for a servers response headers.")
+	f.BoolVar(&cfg.InsecureSkipVerify, prefix+"azure.http.insecure-skip-verify", false, "If the client connects to Azure via HTTPS and this option is enabled, the client will accept any certificate and hostname.")
+	f.DurationVar(&cfg.TLSHandshakeTimeout, prefix+"azure.http.tls-handshake-timeout", 10*time.Second, "Maximum time to wait for a TLS handshake. 0 means no limit.")
+	f.DurationVar(&cfg.ExpectContinueTimeout, prefix+"azure.http.expect-continue-timeout", 1*time.Second, "The time to wait for a server's first response headers after fully writing the request headers if the request has an Expect header. 0 to send the request body immediately.")
+	f.IntVar(&cfg.MaxIdleConns, prefix+"azure.http.max-idle-connections", 100, "Maximum number of idle (keep-alive) connections across all hosts. 0 means no limit.")
+	f.IntVar(&cfg.MaxIdleConnsPerHost, prefix+"azure.http.max-idle-connections-per-host", 100, "Maximum number of idle (keep-alive) connections to keep per-host. If 0, a built-in default value is used.")
+	f.IntVar(&cfg.MaxConnsPerHost, prefix+"azure.http.max-connections-per-host", 0, "Maximum number of connections per host. 0 means no limit.")
+}
+
 // Config holds the config options for an Azure backend
 type Config struct {
 	StorageAccountName string         `yaml:"account_name"`
@@ -21,6 +58,8 @@ type Config struct {
 	MaxRetries         int            `yaml:"max_retries" category:"advanced"`
 	MSIResource        string         `yaml:"msi_resource" category:"advanced" doc:"hidden"` // TODO Remove in Mimir 2.7.
 	UserAssignedID     string         `yaml:"user_assigned_id" category:"advanced"`
+
+	HTTP HTTPConfig `yaml:"http"`
 }
 
 // RegisterFlags registers the flags for Azure storage
@@ -37,4 +76,22 @@ func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet, logge
 	f.IntVar(&cfg.MaxRetries, prefix+"azure.max-retries", 20, "Number of retries for recoverable errors")
 	flagext.DeprecatedFlag(f, prefix+"azure.msi-resource", "Deprecated: this setting was used for obtaining ServicePrincipalToken from MSI. The Azure SDK now chooses the address.", logger)
 	f.StringVar(&cfg.UserAssignedID, prefix+"azure.user-assigned-id", "", "User assigned identity. If empty, then System assigned identity is used.")
+	cfg.HTTP.RegisterFlagsWithPrefix(prefix, f)
+}
+
+// Validate validates the Azure config and returns an error on failure.
+func (cfg *Config) Validate() error {
+	if cfg.StorageAccountName == "" {
+		return errMissingAccountName
+	}
+	if cfg.ContainerName == "" {
+		return errMissingContainerName
+	}
+	if cfg.StorageAccountKey.String() != "" && cfg.UserAssignedID != "" {
+		return errKeyAndUserAssignedID
+	}
+	if cfg.MaxRetries < 0 {
+		return errNegativeMaxRetries
+	}
+	return nil
 }
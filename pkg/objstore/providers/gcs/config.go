@@ -6,9 +6,16 @@
 package gcs
 
 import (
+	"encoding/json"
 	"flag"
 
 	"github.com/grafana/dskit/flagext"
+	"github.com/pkg/errors"
+)
+
+var (
+	errMissingBucketName     = errors.New("gcs bucket name is required")
+	errInvalidServiceAccount = errors.New("gcs service account must be valid JSON")
 )
 
 // Config holds the config options for GCS backend
@@ -28,6 +35,19 @@ func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	f.Var(&cfg.ServiceAccount, prefix+"gcs.service-account", cfg.GCSServiceAccountShortDescription())
 }
 
+// Validate validates the GCS config and returns an error on failure.
+func (cfg *Config) Validate() error {
+	if cfg.BucketName == "" {
+		return errMissingBucketName
+	}
+	// An empty service account falls back to the Google default credentials
+	// chain, which includes workload identity.
+	if sa := cfg.ServiceAccount.String(); sa != "" && !json.Valid([]byte(sa)) {
+		return errInvalidServiceAccount
+	}
+	return nil
+}
+
 func (cfg *Config) GCSServiceAccountShortDescription() string {
 	return "JSON either from a Google Developers Console client_credentials.json file, or a Google Developers service account key. Needs to be valid JSON, not a filesystem path."
 }
@@ -16,15 +16,20 @@ import (
 // NewBucketClient creates a new Swift bucket client
 func NewBucketClient(cfg Config, name string, logger log.Logger) (objstore.Bucket, error) {
 	bucketConfig := swift.Config{
-		AuthVersion:       cfg.AuthVersion,
-		AuthUrl:           cfg.AuthURL,
-		Username:          cfg.Username,
-		UserDomainName:    cfg.UserDomainName,
-		UserDomainID:      cfg.UserDomainID,
-		UserId:            cfg.UserID,
-		Password:          cfg.Password.String(),
-		DomainId:          cfg.DomainID,
-		DomainName:        cfg.DomainName,
+		AuthVersion:    cfg.AuthVersion,
+		AuthUrl:        cfg.AuthURL,
+		Username:       cfg.Username,
+		UserDomainName: cfg.UserDomainName,
+		UserDomainID:   cfg.UserDomainID,
+		UserId:         cfg.UserID,
+		Password:       cfg.Password.String(),
+		DomainId:       cfg.DomainID,
+		DomainName:     cfg.DomainName,
+
+		ApplicationCredentialID:     cfg.ApplicationCredentialID,
+		ApplicationCredentialName:   cfg.ApplicationCredentialName,
+		ApplicationCredentialSecret: cfg.ApplicationCredentialSecret.String(),
+
 		ProjectID:         cfg.ProjectID,
 		ProjectName:       cfg.ProjectName,
 		ProjectDomainID:   cfg.ProjectDomainID,
@@ -10,28 +10,41 @@ import (
 	"time"
 
 	"github.com/grafana/dskit/flagext"
+	"github.com/pkg/errors"
+)
+
+var (
+	errMissingAuthURL       = errors.New("swift auth url is required")
+	errMissingContainerName = errors.New("swift container name is required")
+	errMissingCredentials   = errors.New("swift requires either a password or an application credential secret")
+	errUnsupportedVersion   = errors.New("swift auth version must be one of 0, 1, 2 or 3")
 )
 
 // Config holds the config options for Swift backend
 type Config struct {
-	AuthVersion       int            `yaml:"auth_version"`
-	AuthURL           string         `yaml:"auth_url"`
-	Username          string         `yaml:"username"`
-	UserDomainName    string         `yaml:"user_domain_name"`
-	UserDomainID      string         `yaml:"user_domain_id"`
-	UserID            string         `yaml:"user_id"`
-	Password          flagext.Secret `yaml:"password"`
-	DomainID          string         `yaml:"domain_id"`
-	DomainName        string         `yaml:"domain_name"`
-	ProjectID         string         `yaml:"project_id"`
-	ProjectName       string         `yaml:"project_name"`
-	ProjectDomainID   string         `yaml:"project_domain_id"`
-	ProjectDomainName string         `yaml:"project_domain_name"`
-	RegionName        string         `yaml:"region_name"`
-	ContainerName     string         `yaml:"container_name"`
-	MaxRetries        int            `yaml:"max_retries" category:"advanced"`
-	ConnectTimeout    time.Duration  `yaml:"connect_timeout" category:"advanced"`
-	RequestTimeout    time.Duration  `yaml:"request_timeout" category:"advanced"`
+	AuthVersion    int            `yaml:"auth_version"`
+	AuthURL        string         `yaml:"auth_url"`
+	Username       string         `yaml:"username"`
+	UserDomainName string         `yaml:"user_domain_name"`
+	UserDomainID   string         `yaml:"user_domain_id"`
+	UserID         string         `yaml:"user_id"`
+	Password       flagext.Secret `yaml:"password"`
+	DomainID       string         `yaml:"domain_id"`
+	DomainName     string         `yaml:"domain_name"`
+
+	ApplicationCredentialID     string         `yaml:"application_credential_id"`
+	ApplicationCredentialName   string         `yaml:"application_credential_name"`
+	ApplicationCredentialSecret flagext.Secret `yaml:"application_credential_secret"`
+
+	ProjectID         string        `yaml:"project_id"`
+	ProjectName       string        `yaml:"project_name"`
+	ProjectDomainID   string        `yaml:"project_domain_id"`
+	ProjectDomainName string        `yaml:"project_domain_name"`
+	RegionName        string        `yaml:"region_name"`
+	ContainerName     string        `yaml:"container_name"`
+	MaxRetries        int           `yaml:"max_retries" category:"advanced"`
+	ConnectTimeout    time.Duration `yaml:"connect_timeout" category:"advanced"`
+	RequestTimeout    time.Duration `yaml:"request_timeout" category:"advanced"`
 }
 
 // RegisterFlags registers the flags for Swift storage
@@ -50,6 +63,9 @@ func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	f.Var(&cfg.Password, prefix+"swift.password", "OpenStack Swift API key.")
 	f.StringVar(&cfg.DomainID, prefix+"swift.domain-id", "", "OpenStack Swift user's domain ID.")
 	f.StringVar(&cfg.DomainName, prefix+"swift.domain-name", "", "OpenStack Swift user's domain name.")
+	f.StringVar(&cfg.ApplicationCredentialID, prefix+"swift.application-credential-id", "", "OpenStack Swift application credential ID (v3 auth only).")
+	f.StringVar(&cfg.ApplicationCredentialName, prefix+"swift.application-credential-name", "", "OpenStack Swift application credential name (v3 auth only).")
+	f.Var(&cfg.ApplicationCredentialSecret, prefix+"swift.application-credential-secret", "OpenStack Swift application credential secret (v3 auth only).")
 	f.StringVar(&cfg.ProjectID, prefix+"swift.project-id", "", "OpenStack Swift project ID (v2,v3 auth only).")
 	f.StringVar(&cfg.ProjectName, prefix+"swift.project-name", "", "OpenStack Swift project name (v2,v3 auth only).")
 	f.StringVar(&cfg.ProjectDomainID, prefix+"swift.project-domain-id", "", "ID of the OpenStack Swift project's domain (v3 auth only), only needed if it differs the from user domain.")
@@ -60,3 +76,20 @@ func (cfg *Config) RegisterFlagsWithPrefix(prefix string, f *flag.FlagSet) {
 	f.DurationVar(&cfg.ConnectTimeout, prefix+"swift.connect-timeout", 10*time.Second, "Time after which a connection attempt is aborted.")
 	f.DurationVar(&cfg.RequestTimeout, prefix+"swift.request-timeout", 5*time.Second, "Time after which an idle request is aborted. The timeout watchdog is reset each time some data is received, so the timeout triggers after X time no data is received on a request.")
 }
+
+// Validate validates the Swift config and returns an error on failure.
+func (cfg *Config) Validate() error {
+	if cfg.AuthVersion < 0 || cfg.AuthVersion > 3 {
+		return errUnsupportedVersion
+	}
+	if cfg.AuthURL == "" {
+		return errMissingAuthURL
+	}
+	if cfg.ContainerName == "" {
+		return errMissingContainerName
+	}
+	if cfg.Password.String() == "" && cfg.ApplicationCredentialSecret.String() == "" {
+		return errMissingCredentials
+	}
+	return nil
+}
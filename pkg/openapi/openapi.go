@@ -0,0 +1,498 @@
+// Package openapi builds the OpenAPI 3 document of the HTTP API, from the descriptors of the
+// connect services and from the description of the other routes.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const Version = "3.0.3"
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Tags       []Tag                `json:"tags,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+
+	mtx sync.Mutex
+}
+
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type PathItem struct {
+	Get    *Operation `json:"get,omitempty"`
+	Put    *Operation `json:"put,omitempty"`
+	Post   *Operation `json:"post,omitempty"`
+	Delete *Operation `json:"delete,omitempty"`
+	Patch  *Operation `json:"patch,omitempty"`
+}
+
+type Operation struct {
+	OperationID string               `json:"operationId,omitempty"`
+	Summary     string               `json:"summary,omitempty"`
+	Description string               `json:"description,omitempty"`
+	Tags        []string             `json:"tags,omitempty"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+	Deprecated  bool                 `json:"deprecated,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// New returns an empty document.
+func New(title, version string) *Document {
+	return &Document{
+		OpenAPI:    Version,
+		Info:       Info{Title: title, Version: version},
+		Paths:      map[string]*PathItem{},
+		Components: Components{Schemas: map[string]*Schema{connectErrorSchema: connectError()}},
+	}
+}
+
+// connectErrorSchema is the name of the schema of the errors of the connect procedures.
+const connectErrorSchema = "connect.error"
+
+func connectError() *Schema {
+	return &Schema{
+		Type:        "object",
+		Description: "The error of a connect procedure, see https://connect.build/docs/protocol#error-end-stream.",
+		Properties: map[string]*Schema{
+			"code":    {Type: "string", Description: "The connect code of the error, for example invalid_argument."},
+			"message": {Type: "string"},
+			"details": {Type: "array", Items: &Schema{Type: "object"}},
+		},
+	}
+}
+
+// AddService documents the unary procedures of the connect service, called with a POST of their
+// request in JSON to /<service>/<method>, and the routes of their google.api.http annotations.
+// The streaming procedures are left out, they require a connect or a gRPC client.
+func (d *Document) AddService(sd protoreflect.ServiceDescriptor) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	service := string(sd.FullName())
+	d.Tags = append(d.Tags, Tag{Name: service, Description: comments(sd)})
+	methods := sd.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		md := methods.Get(i)
+		if md.IsStreamingClient() || md.IsStreamingServer() {
+			continue
+		}
+		op := &Operation{
+			OperationID: fmt.Sprintf("%s_%s", sd.Name(), md.Name()),
+			Summary:     comments(md),
+			Tags:        []string{service},
+			RequestBody: &RequestBody{
+				Required: true,
+				Content:  map[string]*MediaType{"application/json": {Schema: d.messageRef(md.Input())}},
+			},
+			Responses: d.responses(md.Output()),
+		}
+		d.setOperation(http.MethodPost, "/"+service+"/"+string(md.Name()), op)
+
+		rule, ok := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+		if ok && rule != nil {
+			d.addHTTPRule(md, rule, *op)
+		}
+	}
+}
+
+// addHTTPRule documents the route of the google.api.http annotation of the method.
+func (d *Document) addHTTPRule(md protoreflect.MethodDescriptor, rule *annotations.HttpRule, op Operation) {
+	var method, path string
+	switch p := rule.Pattern.(type) {
+	case *annotations.HttpRule_Get:
+		method, path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		method, path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		method, path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		method, path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		method, path = http.MethodPatch, p.Patch
+	default:
+		return
+	}
+	op.OperationID += "_HTTP"
+	op.RequestBody = nil
+	op.Parameters = nil
+	inPath := map[string]bool{}
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			name := strings.SplitN(strings.Trim(segment, "{}"), "=", 2)[0]
+			inPath[name] = true
+			op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+	if rule.Body == "*" {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]*MediaType{"application/json": {Schema: d.messageRef(md.Input())}},
+		}
+	} else {
+		// the scalar fields not bound to the path are query parameters.
+		fields := md.Input().Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			if inPath[string(fd.Name())] || fd.Kind() == protoreflect.MessageKind || fd.IsMap() {
+				continue
+			}
+			op.Parameters = append(op.Parameters, Parameter{Name: fd.JSONName(), In: "query", Description: comments(fd), Schema: d.fieldSchema(fd)})
+		}
+	}
+	d.setOperation(method, path, &op)
+}
+
+func (d *Document) responses(output protoreflect.MessageDescriptor) map[string]*Response {
+	ok := &Response{Description: "A successful response."}
+	if output.FullName() == "google.api.HttpBody" {
+		ok.Content = map[string]*MediaType{"*/*": {Schema: &Schema{Type: "string", Format: "binary"}}}
+	} else {
+		ok.Content = map[string]*MediaType{"application/json": {Schema: d.messageRef(output)}}
+	}
+	return map[string]*Response{
+		"200": ok,
+		"default": {
+			Description: "An error response.",
+			Content:     map[string]*MediaType{"application/json": {Schema: &Schema{Ref: schemaRef(connectErrorSchema)}}},
+		},
+	}
+}
+
+// Route describes a route which isn't a connect procedure.
+type Route struct {
+	Methods     []string
+	Path        string
+	Summary     string
+	Description string
+	Tag         string
+	Parameters  []Parameter
+	// RequestBody is the content type of the request body, with its schema if any.
+	RequestBody map[string]*Schema
+	// Response is the content type of the successful response, with its schema if any.
+	Response   map[string]*Schema
+	Deprecated bool
+}
+
+// AddRoute documents the route. Its schemas can be built with SchemaOf.
+func (d *Document) AddRoute(r Route) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	op := &Operation{
+		Summary:     r.Summary,
+		Description: r.Description,
+		Parameters:  r.Parameters,
+		Responses: map[string]*Response{
+			"200":     {Description: "A successful response.", Content: mediaTypes(r.Response)},
+			"default": {Description: "An error response, with the error as plain text.", Content: map[string]*MediaType{"text/plain": {Schema: &Schema{Type: "string"}}}},
+		},
+		Deprecated: r.Deprecated,
+	}
+	if r.Tag != "" {
+		op.Tags = []string{r.Tag}
+	}
+	if len(r.RequestBody) > 0 {
+		op.RequestBody = &RequestBody{Required: true, Content: mediaTypes(r.RequestBody)}
+	}
+	for _, method := range r.Methods {
+		methodOp := *op
+		methodOp.OperationID = operationID(method, r.Path)
+		// the bodies of the GET requests are ignored.
+		if method == http.MethodGet {
+			methodOp.RequestBody = nil
+		}
+		d.setOperation(method, r.Path, &methodOp)
+	}
+}
+
+func mediaTypes(m map[string]*Schema) map[string]*MediaType {
+	if len(m) == 0 {
+		return nil
+	}
+	content := make(map[string]*MediaType, len(m))
+	for contentType, schema := range m {
+		content[contentType] = &MediaType{Schema: schema}
+	}
+	return content
+}
+
+// operationID returns the ID of the operation of a route, for example get_api_v1_label_name_values.
+func operationID(method, path string) string {
+	id := strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_").Replace(path)
+	return strings.TrimSuffix(id, "_")
+}
+
+func (d *Document) setOperation(method, path string, op *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	switch method {
+	case http.MethodGet:
+		item.Get = op
+	case http.MethodPut:
+		item.Put = op
+	case http.MethodPost:
+		item.Post = op
+	case http.MethodDelete:
+		item.Delete = op
+	case http.MethodPatch:
+		item.Patch = op
+	}
+}
+
+func schemaRef(name string) string {
+	return "#/components/schemas/" + name
+}
+
+// messageRef returns the reference to the schema of the message, added to the components with
+// the schemas of its fields.
+func (d *Document) messageRef(md protoreflect.MessageDescriptor) *Schema {
+	if s := wellKnownSchema(md); s != nil {
+		return s
+	}
+	name := string(md.FullName())
+	if _, ok := d.Components.Schemas[name]; ok {
+		return &Schema{Ref: schemaRef(name)}
+	}
+	s := &Schema{Type: "object", Description: comments(md), Properties: map[string]*Schema{}}
+	// added before its fields, for the recursive messages.
+	d.Components.Schemas[name] = s
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		fs := d.fieldSchema(fd)
+		if c := comments(fd); c != "" && fs.Ref == "" {
+			fs.Description = c
+		}
+		s.Properties[fd.JSONName()] = fs
+	}
+	return &Schema{Ref: schemaRef(name)}
+}
+
+// fieldSchema returns the schema of the field in the JSON mapping of protobuf.
+func (d *Document) fieldSchema(fd protoreflect.FieldDescriptor) *Schema {
+	if fd.IsMap() {
+		return &Schema{Type: "object", AdditionalProperties: d.singularSchema(fd.MapValue())}
+	}
+	if fd.IsList() {
+		return &Schema{Type: "array", Items: d.singularSchema(fd)}
+	}
+	return d.singularSchema(fd)
+}
+
+func (d *Document) singularSchema(fd protoreflect.FieldDescriptor) *Schema {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return &Schema{Type: "boolean"}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return &Schema{Type: "integer", Format: "int32"}
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return &Schema{Type: "integer", Format: "int64"}
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		// the 64-bit integers are encoded as strings.
+		return &Schema{Type: "string", Format: "int64"}
+	case protoreflect.FloatKind:
+		return &Schema{Type: "number", Format: "float"}
+	case protoreflect.DoubleKind:
+		return &Schema{Type: "number", Format: "double"}
+	case protoreflect.StringKind:
+		return &Schema{Type: "string"}
+	case protoreflect.BytesKind:
+		return &Schema{Type: "string", Format: "byte"}
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		s := &Schema{Type: "string"}
+		for i := 0; i < values.Len(); i++ {
+			s.Enum = append(s.Enum, string(values.Get(i).Name()))
+		}
+		return s
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return d.messageRef(fd.Message())
+	}
+	return &Schema{}
+}
+
+// wellKnownSchema returns the schema of the well-known types with a special JSON mapping.
+func wellKnownSchema(md protoreflect.MessageDescriptor) *Schema {
+	switch md.FullName() {
+	case "google.protobuf.Timestamp":
+		return &Schema{Type: "string", Format: "date-time"}
+	case "google.protobuf.Duration":
+		return &Schema{Type: "string", Description: "A duration in seconds with the s suffix, for example 1.5s."}
+	case "google.protobuf.Struct", "google.protobuf.Any":
+		return &Schema{Type: "object"}
+	case "google.protobuf.Value":
+		return &Schema{}
+	case "google.protobuf.StringValue":
+		return &Schema{Type: "string"}
+	case "google.protobuf.BoolValue":
+		return &Schema{Type: "boolean"}
+	case "google.protobuf.Int64Value", "google.protobuf.UInt64Value":
+		return &Schema{Type: "string", Format: "int64"}
+	case "google.protobuf.Int32Value", "google.protobuf.UInt32Value":
+		return &Schema{Type: "integer"}
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue":
+		return &Schema{Type: "number"}
+	}
+	return nil
+}
+
+// comments returns the leading comments of the declaration in its proto file.
+func comments(desc protoreflect.Descriptor) string {
+	loc := desc.ParentFile().SourceLocations().ByDescriptor(desc)
+	return strings.TrimSpace(loc.LeadingComments)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaOf returns the schema of the JSON encoding of the value, from its Go type.
+func SchemaOf(v interface{}) *Schema {
+	return schemaOfType(reflect.TypeOf(v), map[reflect.Type]bool{})
+}
+
+// schemaOfType returns the schema of the type, the recursive structs being documented as objects
+// without properties when nested in themselves.
+func schemaOfType(t reflect.Type, seen map[reflect.Type]bool) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: schemaOfType(t.Elem(), seen)}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: schemaOfType(t.Elem(), seen)}
+	case reflect.Struct:
+		if t == timeType {
+			return &Schema{Type: "string", Format: "date-time"}
+		}
+		if seen[t] {
+			return &Schema{Type: "object"}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		addStructFields(s, t, seen)
+		return s
+	}
+	return &Schema{}
+}
+
+// addStructFields adds the fields of the struct to the properties of the schema, the fields of
+// the embedded structs being promoted as by encoding/json.
+func addStructFields(s *Schema, t reflect.Type, seen map[reflect.Type]bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			for ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(s, ft, seen)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = schemaOfType(f.Type, seen)
+	}
+}
+
+// Handler serves the document in JSON.
+func (d *Document) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		d.mtx.Lock()
+		sort.Slice(d.Tags, func(i, j int) bool { return d.Tags[i].Name < d.Tags[j].Name })
+		b, err := json.Marshal(d)
+		d.mtx.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	})
+}
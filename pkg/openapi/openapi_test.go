@@ -0,0 +1,94 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	statusv1 "github.com/grafana/phlare/api/gen/proto/go/status/v1"
+)
+
+func TestAddService(t *testing.T) {
+	doc := New("test", "1.0")
+	doc.AddService(querierv1.File_querier_v1_querier_proto.Services().Get(0))
+	doc.AddService(statusv1.File_status_v1_status_proto.Services().Get(0))
+
+	// the unary procedures are documented, with the schemas of their messages.
+	op := doc.Paths["/querier.v1.QuerierService/SelectMergeStacktraces"].Post
+	require.NotNil(t, op)
+	require.Equal(t, "#/components/schemas/querier.v1.SelectMergeStacktracesRequest", op.RequestBody.Content["application/json"].Schema.Ref)
+	request := doc.Components.Schemas["querier.v1.SelectMergeStacktracesRequest"]
+	require.Equal(t, &Schema{Type: "string", Format: "int64"}, request.Properties["start"])
+	require.Equal(t, &Schema{Type: "string"}, request.Properties["labelSelector"])
+	require.Equal(t, &Schema{Type: "boolean"}, request.Properties["approximate"])
+	response := doc.Components.Schemas["querier.v1.ProfileTypesResponse"]
+	require.Equal(t, "array", response.Properties["profileTypes"].Type)
+	require.Equal(t, "#/components/schemas/types.v1.ProfileType", response.Properties["profileTypes"].Items.Ref)
+	require.Contains(t, doc.Components.Schemas, "types.v1.ProfileType")
+
+	// the routes of the google.api.http annotations are documented.
+	get := doc.Paths["/api/v1/status/buildinfo"].Get
+	require.NotNil(t, get)
+	require.Nil(t, get.RequestBody)
+	require.Equal(t, "#/components/schemas/status.v1.GetBuildInfoResponse", get.Responses["200"].Content["application/json"].Schema.Ref)
+	config := doc.Paths["/api/v1/status/config"].Get
+	require.Equal(t, &Schema{Type: "string", Format: "binary"}, config.Responses["200"].Content["*/*"].Schema)
+}
+
+func TestAddRoute(t *testing.T) {
+	doc := New("test", "1.0")
+	doc.AddRoute(Route{
+		Methods:     []string{http.MethodGet, http.MethodPost},
+		Path:        "/api/v1/label/{name}/values",
+		Parameters:  []Parameter{{Name: "name", In: "path", Required: true, Schema: &Schema{Type: "string"}}},
+		RequestBody: map[string]*Schema{"application/x-www-form-urlencoded": {Type: "object"}},
+		Response:    map[string]*Schema{"application/json": SchemaOf(struct{ Values []string }{})},
+		Deprecated:  true,
+	})
+	item := doc.Paths["/api/v1/label/{name}/values"]
+	require.Equal(t, "get_api_v1_label_name_values", item.Get.OperationID)
+	require.Equal(t, "post_api_v1_label_name_values", item.Post.OperationID)
+	require.Nil(t, item.Get.RequestBody)
+	require.NotNil(t, item.Post.RequestBody)
+	require.True(t, item.Get.Deprecated)
+
+	rec := httptest.NewRecorder()
+	doc.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &decoded))
+	require.Equal(t, Version, decoded["openapi"])
+}
+
+func TestSchemaOf(t *testing.T) {
+	type node struct {
+		Name     string  `json:"name"`
+		Children []*node `json:"children,omitempty"`
+	}
+	type embedded struct {
+		Total int64 `json:"total"`
+	}
+	type response struct {
+		embedded
+		Root    node              `json:"root"`
+		Labels  map[string]string `json:"labels"`
+		Raw     []byte            `json:"raw"`
+		Ignored string            `json:"-"`
+	}
+	require.Equal(t, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"total": {Type: "integer", Format: "int64"},
+			"root": {Type: "object", Properties: map[string]*Schema{
+				"name":     {Type: "string"},
+				"children": {Type: "array", Items: &Schema{Type: "object"}},
+			}},
+			"labels": {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+			"raw":    {Type: "string", Format: "byte"},
+		},
+	}, SchemaOf(response{}))
+}
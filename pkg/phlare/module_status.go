@@ -0,0 +1,54 @@
+package phlare
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/grafana/dskit/services"
+)
+
+// ModuleStatus is the state of a module of the process.
+type ModuleStatus struct {
+	Name string `json:"name"`
+	// State is one of new, starting, running, stopping, terminated or failed.
+	State string `json:"state"`
+	// Error is the reason of the failure of a failed module.
+	Error string `json:"error,omitempty"`
+}
+
+// ModulesResponse is the response of the modules endpoint.
+type ModulesResponse struct {
+	// Healthy is whether all the modules are running.
+	Healthy bool           `json:"healthy"`
+	Modules []ModuleStatus `json:"modules"`
+}
+
+// modulesStatus returns the state of the modules, sorted by name.
+func modulesStatus(serviceMap map[string]services.Service) ModulesResponse {
+	resp := ModulesResponse{Healthy: true, Modules: make([]ModuleStatus, 0, len(serviceMap))}
+	for name, s := range serviceMap {
+		state := s.State()
+		status := ModuleStatus{Name: name, State: strings.ToLower(state.String())}
+		if state == services.Failed && s.FailureCase() != nil {
+			status.Error = s.FailureCase().Error()
+		}
+		if state != services.Running {
+			resp.Healthy = false
+		}
+		resp.Modules = append(resp.Modules, status)
+	}
+	sort.Slice(resp.Modules, func(i, j int) bool { return resp.Modules[i].Name < resp.Modules[j].Name })
+	return resp
+}
+
+// modulesHandler reports the state of each module of the process in JSON, so a degraded module
+// can be told apart from the whole process being down. Unlike /ready, it always responds with
+// 200 OK.
+func modulesHandler(serviceMap map[string]services.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(modulesStatus(serviceMap))
+	}
+}
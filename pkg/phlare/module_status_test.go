@@ -0,0 +1,39 @@
+package phlare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/dskit/services"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModulesHandler(t *testing.T) {
+	running := services.NewIdleService(nil, nil)
+	require.NoError(t, services.StartAndAwaitRunning(context.Background(), running))
+	t.Cleanup(func() { _ = services.StopAndAwaitTerminated(context.Background(), running) })
+	failed := services.NewIdleService(func(context.Context) error { return errors.New("boom") }, nil)
+	require.Error(t, services.StartAndAwaitRunning(context.Background(), failed))
+
+	rec := httptest.NewRecorder()
+	modulesHandler(map[string]services.Service{
+		"querier":  failed,
+		"ingester": running,
+		"store":    services.NewIdleService(nil, nil),
+	})(rec, httptest.NewRequest("GET", "/api/v1/modules", nil))
+
+	require.Equal(t, 200, rec.Code)
+	var resp ModulesResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, ModulesResponse{
+		Healthy: false,
+		Modules: []ModuleStatus{
+			{Name: "ingester", State: "running"},
+			{Name: "querier", State: "failed", Error: "boom"},
+			{Name: "store", State: "new"},
+		},
+	}, resp)
+}
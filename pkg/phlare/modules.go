@@ -3,15 +3,20 @@ package phlare
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/bufbuild/connect-go"
 	"github.com/felixge/fgprof"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/grafana/dskit/kv/codec"
 	"github.com/grafana/dskit/kv/memberlist"
 	"github.com/grafana/dskit/ring"
+	ring_client "github.com/grafana/dskit/ring/client"
 	"github.com/grafana/dskit/runtimeconfig"
 	"github.com/grafana/dskit/services"
 	grpcgw "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
@@ -21,7 +26,6 @@ import (
 	"github.com/thanos-io/thanos/pkg/discovery/dns"
 	"github.com/weaveworks/common/middleware"
 	"github.com/weaveworks/common/server"
-	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/genproto/googleapis/api/httpbody"
 	"google.golang.org/protobuf/encoding/protojson"
@@ -35,17 +39,24 @@ import (
 	statusv1 "github.com/grafana/phlare/api/gen/proto/go/status/v1"
 	"github.com/grafana/phlare/api/openapiv2"
 	"github.com/grafana/phlare/pkg/agent"
+	"github.com/grafana/phlare/pkg/blockevents"
+	"github.com/grafana/phlare/pkg/canary"
+	"github.com/grafana/phlare/pkg/chaos"
 	"github.com/grafana/phlare/pkg/distributor"
 	"github.com/grafana/phlare/pkg/frontend"
 	"github.com/grafana/phlare/pkg/frontend/frontendpb/frontendpbconnect"
 	"github.com/grafana/phlare/pkg/ingester"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/objstore"
 	objstoreclient "github.com/grafana/phlare/pkg/objstore/client"
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/openapi"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/querier"
 	"github.com/grafana/phlare/pkg/querier/worker"
 	"github.com/grafana/phlare/pkg/scheduler"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerpb/schedulerpbconnect"
+	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/usagestats"
 	"github.com/grafana/phlare/pkg/util"
 	"github.com/grafana/phlare/pkg/util/build"
@@ -71,6 +82,8 @@ const (
 	RuntimeConfig     string = "runtime-config"
 	Overrides         string = "overrides"
 	OverridesExporter string = "overrides-exporter"
+	Canary            string = "canary"
+	BlockEvents       string = "block-events"
 
 	// QueryFrontendTripperware string = "query-frontend-tripperware"
 	// Compactor                string = "compactor"
@@ -98,11 +111,122 @@ func (f *Phlare) initQueryFrontend() (services.Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	querierv1connect.RegisterQuerierServiceHandler(f.Server.HTTP, querier.NewGRPCRoundTripper(frontendSvc), f.auth)
+	roundTripper := querier.NewGRPCRoundTripper(frontendSvc)
+	querierv1connect.RegisterQuerierServiceHandler(f.Server.HTTP, roundTripper, f.querierHandlerOptions()...)
 	frontendpbconnect.RegisterFrontendForQuerierHandler(f.Server.HTTP, frontendSvc, f.auth)
+	if err := f.registerQueryHandlers(roundTripper); err != nil {
+		return nil, err
+	}
 	return frontendSvc, nil
 }
 
+// querierHandlerOptions are the options of the handlers of the querier API.
+func (f *Phlare) querierHandlerOptions() []connect.HandlerOption {
+	return append(
+		[]connect.HandlerOption{
+			f.auth,
+			// the look-back is enforced after the tenant is authenticated.
+			connect.WithInterceptors(querier.NewQueryLookbackInterceptor(f.Overrides)),
+			connect.WithSendMaxBytes(f.Cfg.Querier.MaxSendMsgSize),
+		},
+		util.CompressionHandlerOptions(f.Cfg.Querier.ResponseCompressionMinBytes)...,
+	)
+}
+
+// loopbackURL returns the URL of the HTTP server of this process, listening on the address of
+// -server.http-listen-address, or on all the interfaces when it is empty.
+func (f *Phlare) loopbackURL() string {
+	scheme, host := "http", "localhost"
+	if f.Cfg.Server.HTTPListenAddress != "" {
+		host = f.Cfg.Server.HTTPListenAddress
+	}
+	if f.Cfg.Server.HTTPTLSConfig.TLSCertPath != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(f.Cfg.Server.HTTPListenPort)))
+}
+
+// deprecatedRoutesSunset is the date after which the deprecated HTTP routes can be removed.
+var deprecatedRoutesSunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+// registerQueryHandlers exposes the stable v1 and the experimental HTTP APIs. Their queries are
+// sent to the local querier API, svc, which is the query frontend when it is enabled. The path
+// parameters of the routes are passed to the handlers as query parameters.
+func (f *Phlare) registerQueryHandlers(svc querierv1connect.QuerierServiceHandler) error {
+	httpClient := &http.Client{Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport)}
+	// the requests authenticated with an API key or whose tenant is resolved by rules are passed on
+	// in-process, as the loopback requests have neither the key nor what the rules resolve, and so
+	// are the requests to a TLS server, which the loopback client can't authenticate.
+	if f.Cfg.InProcessRequests || f.apiKeys != nil || len(f.Cfg.TenantResolution.Rules) > 0 || f.Cfg.Server.HTTPTLSConfig.TLSCertPath != "" {
+		_, handler := querierv1connect.NewQuerierServiceHandler(svc, f.querierHandlerOptions()...)
+		httpClient = util.InProcessHTTPClient(handler)
+	}
+	client := querierv1connect.NewQuerierServiceClient(
+		httpClient,
+		f.loopbackURL(),
+		connect.WithInterceptors(tenant.NewAuthInterceptor(true)),
+	)
+	api := querier.NewAPIv1(client)
+	// the baselines are shared by the replicas, so they are only stored in an object storage: the
+	// storage bucket is initialised before, as a dependency of the usage report.
+	baselines := querier.NewBaselinesHandler(client, f.storageBucket)
+	for _, h := range []struct {
+		methods []string
+		path    string
+		handler http.Handler
+		// successor is the route replacing a deprecated one.
+		successor string
+		// compressed is set for the routes whose responses are already compressed.
+		compressed bool
+		// doc documents the route in the OpenAPI document.
+		doc openapi.Route
+	}{
+		{methods: []string{http.MethodGet}, path: "/api/v1/profile_types", handler: http.HandlerFunc(api.ProfileTypes), doc: querier.ProfileTypesDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/labels", handler: http.HandlerFunc(api.Labels), doc: querier.LabelsDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/label/{name}/values", handler: http.HandlerFunc(api.LabelValues), doc: querier.LabelValuesDoc},
+		{methods: []string{http.MethodGet, http.MethodPost}, path: "/api/v1/query", handler: http.HandlerFunc(api.Query), doc: querier.QueryDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/flamegraph", handler: querier.NewFlamegraphHandler(client), doc: querier.FlamegraphDoc},
+		{methods: []string{http.MethodPost}, path: "/api/v1/flamegraph/multi", handler: querier.NewMultiFlamegraphHandler(client), doc: querier.MultiFlamegraphDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/pprof", handler: querier.NewPprofHandler(client), compressed: true, doc: querier.PprofDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/flamegraph/diff", handler: http.HandlerFunc(baselines.Diff), doc: querier.BaselineDiffDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/baselines", handler: http.HandlerFunc(baselines.List), doc: querier.ListBaselinesDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/baselines/{name}", handler: http.HandlerFunc(baselines.Get), doc: querier.GetBaselineDoc},
+		{methods: []string{http.MethodPut}, path: "/api/v1/baselines/{name}", handler: http.HandlerFunc(baselines.Create), doc: querier.CreateBaselineDoc},
+		{methods: []string{http.MethodDelete}, path: "/api/v1/baselines/{name}", handler: http.HandlerFunc(baselines.Delete), doc: querier.DeleteBaselineDoc},
+		{methods: []string{http.MethodGet}, path: "/api/v1/targets/metadata", handler: querier.NewTargetMetadataHandler(client), doc: querier.TargetMetadataDoc},
+		{methods: []string{http.MethodGet, http.MethodPost}, path: "/api/experimental/sql", handler: querier.NewSQLHandler(client), doc: querier.SQLDoc},
+		{methods: []string{http.MethodGet}, path: "/api/experimental/arrow", handler: querier.NewArrowHandler(client), doc: querier.ArrowDoc},
+		{methods: []string{http.MethodGet}, path: "/api/experimental/pprof", handler: querier.NewPprofHandler(client), successor: "/api/v1/pprof", compressed: true, doc: querier.PprofDoc},
+	} {
+		handler := f.HTTPAuthMiddleware.Wrap(h.handler)
+		if !h.compressed {
+			handler = util.CompressionHTTPMiddleware(f.Cfg.Querier.ResponseCompressionMinBytes).Wrap(handler)
+		}
+		h.doc.Methods, h.doc.Path = h.methods, h.path
+		if h.successor != "" {
+			handler = util.DeprecatedHTTPMiddleware(h.successor, deprecatedRoutesSunset).Wrap(handler)
+			h.doc.Deprecated = true
+			h.doc.Description = fmt.Sprintf("Deprecated in favor of %s.", h.successor)
+		}
+		f.apiDoc.AddRoute(h.doc)
+		for _, method := range h.methods {
+			if err := f.grpcGatewayMux.HandlePath(method, h.path, func(w http.ResponseWriter, r *http.Request, pathParams map[string]string) {
+				if len(pathParams) > 0 {
+					q := r.URL.Query()
+					for k, v := range pathParams {
+						q.Set(k, v)
+					}
+					r.URL.RawQuery = q.Encode()
+				}
+				handler.ServeHTTP(w, r)
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (f *Phlare) initRuntimeConfig() (services.Service, error) {
 	if len(f.Cfg.RuntimeConfig.LoadPath) == 0 {
 		// no need to initialize module if load path is empty
@@ -126,6 +250,10 @@ func (f *Phlare) initRuntimeConfig() (services.Service, error) {
 
 	f.Server.HTTP.Methods("GET").Path("/runtime_config").Handler(runtimeConfigHandler(f.RuntimeConfig, f.Cfg.LimitsConfig))
 	f.Server.HTTP.Methods("GET").Path("/api/v1/tenant_limits").Handler(middleware.AuthenticateUser.Wrap(validation.TenantLimitsHandler(f.Cfg.LimitsConfig, f.TenantLimits)))
+	// the captures are kept in memory: the agents must poll the instance they are requested from.
+	captures := agent.NewCaptureStore(agent.DefaultCaptureTTL)
+	f.Server.HTTP.Methods("GET").Path("/api/v1/agent/config").Handler(f.HTTPAuthMiddleware.Wrap(agent.NewConfigHandler(agentConfigRules(f.RuntimeConfig), captures)))
+	f.Server.HTTP.Methods("GET", "POST").Path("/api/v1/agent/captures").Handler(f.HTTPAuthMiddleware.Wrap(agent.NewCaptureHandler(captures)))
 	return serv, err
 }
 
@@ -185,12 +313,16 @@ func (f *Phlare) setupWorkerTimeout() {
 }
 
 func (f *Phlare) initQuerier() (services.Service, error) {
-	querierSvc, err := querier.New(f.Cfg.Querier, f.ring, nil, log.With(f.logger, "component", "querier"), f.auth)
+	querierSvc, err := querier.New(f.Cfg.Querier, f.ring, f.ingesterPoolFactory(f.Cfg.Querier.PoolConfig), f.Overrides, log.With(f.logger, "component", "querier"), f.auth)
 	if err != nil {
 		return nil, err
 	}
+	f.Server.HTTP.Path("/querier/blocks").Methods("GET").Handler(f.HTTPAuthMiddleware.Wrap(http.HandlerFunc(querierSvc.BlocksHandler)))
 	if !f.isModuleActive(QueryFrontend) {
-		querierv1connect.RegisterQuerierServiceHandler(f.Server.HTTP, querierSvc, f.auth)
+		querierv1connect.RegisterQuerierServiceHandler(f.Server.HTTP, querierSvc, f.querierHandlerOptions()...)
+		if err := f.registerQueryHandlers(querierSvc); err != nil {
+			return nil, err
+		}
 	}
 	worker, err := worker.NewQuerierWorker(f.Cfg.Worker, querier.NewGRPCHandler(querierSvc), log.With(f.logger, "component", "querier-worker"), f.reg)
 	if err != nil {
@@ -244,7 +376,7 @@ func (f *Phlare) initGRPCGateway() (services.Service, error) {
 
 func (f *Phlare) initDistributor() (services.Service, error) {
 	f.Cfg.Distributor.DistributorRing.ListenPort = f.Cfg.Server.HTTPListenPort
-	d, err := distributor.New(f.Cfg.Distributor, f.ring, nil, f.Overrides, f.reg, log.With(f.logger, "component", "distributor"), f.auth)
+	d, err := distributor.New(f.Cfg.Distributor, f.ring, f.ingesterPoolFactory(f.Cfg.Distributor.PoolConfig), f.Overrides, f.reg, log.With(f.logger, "component", "distributor"), f.auth)
 	if err != nil {
 		return nil, err
 	}
@@ -252,8 +384,53 @@ func (f *Phlare) initDistributor() (services.Service, error) {
 	// initialise direct pusher, this overwrites the default HTTP client
 	f.pusherClient = d
 
-	pushv1connect.RegisterPusherServiceHandler(f.Server.HTTP, d, f.auth)
+	// limit the push body size while it is being received, and answer the profiles too large with 413
+	pushPath, pushHandler := pushv1connect.NewPusherServiceHandler(d, f.auth)
+	f.Server.HTTP.PathPrefix(pushPath).Handler(middleware.Merge(
+		util.MaxBytesHTTPMiddleware(int64(f.Cfg.Distributor.MaxRecvMsgSize)),
+		distributor.PushHTTPStatusMiddleware(),
+	).Wrap(pushHandler))
+	// expose a raw pprof push endpoint for plain HTTP clients like curl
+	pprofHandler := middleware.Merge(
+		f.HTTPAuthMiddleware,
+		util.MaxBytesHTTPMiddleware(int64(f.Cfg.Distributor.MaxRecvMsgSize)),
+	).Wrap(http.HandlerFunc(d.PushPprofHandler))
+	if err := f.grpcGatewayMux.HandlePath(http.MethodPost, "/api/v1/push/pprof", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		pprofHandler.ServeHTTP(w, r)
+	}); err != nil {
+		return nil, err
+	}
+	pprofDoc := distributor.PushPprofDoc
+	pprofDoc.Methods, pprofDoc.Path = []string{http.MethodPost}, "/api/v1/push/pprof"
+	f.apiDoc.AddRoute(pprofDoc)
+	// the traces of the JS Self-Profiling API of the browsers
+	jsSelfProfileHandler := middleware.Merge(
+		f.HTTPAuthMiddleware,
+		util.MaxBytesHTTPMiddleware(int64(f.Cfg.Distributor.MaxRecvMsgSize)),
+	).Wrap(http.HandlerFunc(d.PushJSSelfProfileHandler))
+	if err := f.grpcGatewayMux.HandlePath(http.MethodPost, "/api/v1/push/js-self-profile", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		jsSelfProfileHandler.ServeHTTP(w, r)
+	}); err != nil {
+		return nil, err
+	}
+	jsSelfProfileDoc := distributor.PushJSSelfProfileDoc
+	jsSelfProfileDoc.Methods, jsSelfProfileDoc.Path = []string{http.MethodPost}, "/api/v1/push/js-self-profile"
+	f.apiDoc.AddRoute(jsSelfProfileDoc)
+	// the stable JSON push endpoint of the v1 API
+	jsonPushHandler := middleware.Merge(
+		f.HTTPAuthMiddleware,
+		util.MaxBytesHTTPMiddleware(int64(f.Cfg.Distributor.MaxRecvMsgSize)),
+	).Wrap(http.HandlerFunc(d.PushJSONHandler))
+	if err := f.grpcGatewayMux.HandlePath(http.MethodPost, "/api/v1/push", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		jsonPushHandler.ServeHTTP(w, r)
+	}); err != nil {
+		return nil, err
+	}
+	jsonDoc := distributor.PushJSONDoc
+	jsonDoc.Methods, jsonDoc.Path = []string{http.MethodPost}, "/api/v1/push"
+	f.apiDoc.AddRoute(jsonDoc)
 	f.Server.HTTP.Path("/distributor/ring").Methods("GET", "POST").Handler(d)
+	f.Server.HTTP.Path("/distributor/label_cardinality").Methods("GET").Handler(f.HTTPAuthMiddleware.Wrap(http.HandlerFunc(d.LabelCardinalityHandler)))
 
 	return d, nil
 }
@@ -275,6 +452,12 @@ func (f *Phlare) initAgent() (services.Service, error) {
 }
 
 func (f *Phlare) initMemberlistKV() (services.Service, error) {
+	if f.Cfg.inMemoryRing() {
+		f.Cfg.Frontend.QuerySchedulerDiscovery = f.Cfg.QueryScheduler.ServiceDiscovery
+		f.Cfg.Worker.QuerySchedulerDiscovery = f.Cfg.QueryScheduler.ServiceDiscovery
+		return nil, nil
+	}
+
 	f.Cfg.MemberlistKV.MetricsRegisterer = f.reg
 	f.Cfg.MemberlistKV.Codecs = []codec.Codec{
 		ring.GetCodec(),
@@ -323,16 +506,32 @@ func (f *Phlare) initStorage() (_ services.Service, err error) {
 		if err != nil {
 			return nil, errors.Wrap(err, "unable to initialise bucket")
 		}
-		f.storageBucket = b
+		if f.chaos.Targets(chaos.TargetObjstore) {
+			level.Warn(f.logger).Log("msg", "failures are injected in the object storage, this must only be enabled for testing")
+		}
+		f.storageBucket = chaos.WrapBucket(b, f.chaos)
 	}
 
-	if f.Cfg.Target.String() != All && f.storageBucket == nil {
+	if !f.isModuleActive(All) && f.storageBucket == nil {
 		return nil, errors.New("storage bucket configuration is required when running in microservices mode")
 	}
 
 	return nil, nil
 }
 
+// initBlockEvents posts the block events to the configured webhooks. Without webhooks, the events
+// are ignored.
+func (f *Phlare) initBlockEvents() (services.Service, error) {
+	if len(f.Cfg.BlockEvents.WebhookURLs) == 0 {
+		f.blockEvents = blockevents.Nop{}
+		return nil, nil
+	}
+	client := &http.Client{Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport)}
+	webhooks := blockevents.NewWebhooks(f.Cfg.BlockEvents, client, log.With(f.logger, "component", "block-events"), f.reg)
+	f.blockEvents = webhooks
+	return webhooks, nil
+}
+
 // TODO: This should be passed to all other services and could also be used to signal shutdown
 func (f *Phlare) context() context.Context {
 	phlarectx := phlarecontext.WithLogger(context.Background(), f.logger)
@@ -342,14 +541,51 @@ func (f *Phlare) context() context.Context {
 func (f *Phlare) initIngester() (_ services.Service, err error) {
 	f.Cfg.Ingester.LifecyclerConfig.ListenPort = f.Cfg.Server.HTTPListenPort
 
-	ingester, err := ingester.New(f.context(), f.Cfg.Ingester, f.Cfg.PhlareDB, f.storageBucket, f.Overrides)
+	phlarectx := phlarecontext.WithLogger(f.context(), log.With(f.logger, "component", "ingester"))
+	ingester, err := ingester.New(phlarectx, f.Cfg.Ingester, f.Cfg.PhlareDB, f.storageBucket, f.Overrides, f.blockEvents)
 	if err != nil {
 		return nil, err
 	}
+	f.ingester = ingester
+	_, f.ingesterHandler = ingesterv1connect.NewIngesterServiceHandler(ingester, f.auth)
 	ingesterv1connect.RegisterIngesterServiceHandler(f.Server.HTTP, ingester, f.auth)
+	f.Server.HTTP.Path("/ingester/snapshot").Methods("GET", "POST").HandlerFunc(ingester.SnapshotHandler)
+	f.Server.HTTP.Path("/ingester/restore").Methods("POST").HandlerFunc(ingester.RestoreHandler)
+	f.Server.HTTP.Path("/ingester/read-only").Methods("GET", "POST").HandlerFunc(ingester.ReadOnlyHandler)
+	f.Server.HTTP.Path("/ingester/unregister-on-shutdown").Methods("GET", "PUT", "DELETE").HandlerFunc(ingester.UnregisterOnShutdownHandler)
+	f.Server.HTTP.Path("/ingester/tenants").Methods("GET").HandlerFunc(ingester.TenantsHandler)
 	return ingester, nil
 }
 
+// ingesterPoolFactory returns the factory of the ingester clients of the distributor and the
+// querier, nil for the default one. When the ingester runs in the same process, its client calls
+// the connect handlers of the ingester directly, while the other ingesters of the ring are still
+// reached through the network.
+func (f *Phlare) ingesterPoolFactory(cfg clientpool.PoolConfig) ring_client.PoolFactory {
+	if !f.Cfg.InProcessRequests || !f.isModuleActive(Ingester) {
+		return nil
+	}
+	logger := log.With(f.logger, "component", "ingester-client")
+	remote := clientpool.PoolFactoryFn(cfg, logger, f.auth)
+	return func(addr string) (ring_client.PoolClient, error) {
+		// the ingester is initialised before the clients are created, once the ring is running.
+		if f.ingester == nil || addr != f.ingester.Addr() {
+			return remote(addr)
+		}
+		return clientpool.NewInProcessClient(cfg, addr, f.ingesterHandler, logger, f.auth), nil
+	}
+}
+
+func (f *Phlare) initCanary() (services.Service, error) {
+	if f.Cfg.Canary.URL == "" {
+		f.Cfg.Canary.URL = f.loopbackURL()
+	}
+	client := &http.Client{Transport: util.WrapWithInstrumentedHTTPTransport(http.DefaultTransport)}
+	c := canary.New(f.Cfg.Canary, client, log.With(f.logger, "component", "canary"), f.reg)
+	f.Server.HTTP.Path("/canary/check").Methods("GET", "POST").HandlerFunc(c.CheckHandler)
+	return c, nil
+}
+
 func (f *Phlare) initServer() (services.Service, error) {
 	prometheus.MustRegister(version.NewCollector("phlare"))
 	DisableSignalHandling(&f.Cfg.Server)
@@ -396,11 +632,15 @@ func (f *Phlare) initServer() (services.Service, error) {
 		},
 		httpMetric,
 	}
+	if f.Cfg.MultitenancyEnabled {
+		defaultHTTPMiddleware = append(defaultHTTPMiddleware, tenant.NewResolutionMiddleware(f.Cfg.TenantResolution, f.Cfg.APIKeys.InternalSecret.String()))
+	}
+	// the tenant ID of the API keys takes precedence over the resolution rules.
+	defaultHTTPMiddleware = append(defaultHTTPMiddleware, tenant.NewAPIKeyMiddleware(f.apiKeys, f.Cfg.APIKeys.InternalSecret.String()))
 	f.Server.HTTPServer.Handler = middleware.Merge(defaultHTTPMiddleware...).Wrap(f.Server.HTTP)
 
 	s := NewServerService(f.Server, servicesToWaitFor, f.logger)
-	// todo configure http2
-	f.Server.HTTPServer.Handler = h2c.NewHandler(f.Server.HTTPServer.Handler, &http2.Server{})
+	f.Server.HTTPServer.Handler = h2c.NewHandler(f.Server.HTTPServer.Handler, f.Cfg.HTTP2Server.Server(f.Cfg.Server.HTTPServerIdleTimeout))
 	f.Server.HTTPServer.Handler = util.RecoveryHTTPMiddleware.Wrap(f.Server.HTTPServer.Handler)
 
 	// expose openapiv2 definition
@@ -409,6 +649,16 @@ func (f *Phlare) initServer() (services.Service, error) {
 		return nil, fmt.Errorf("unable to initialize openapiv2 handler: %w", err)
 	}
 	f.Server.HTTP.Handle("/api/swagger.json", openapiv2Handler)
+	// expose the OpenAPI 3 document of all the routes
+	f.Server.HTTP.Handle("/api/openapi.json", f.apiDoc.Handler())
+
+	// register grpc reflection and the api descriptors
+	RegisterReflectionServer(f.Server.HTTP)
+	descriptorsHandler, err := DescriptorsHandler()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize descriptors handler: %w", err)
+	}
+	f.Server.HTTP.Handle("/api/v1/descriptors", descriptorsHandler)
 
 	// register grpc-gateway api
 	f.Server.HTTP.NewRoute().PathPrefix("/api").Handler(f.grpcGatewayMux)
@@ -424,6 +674,16 @@ func (f *Phlare) initServer() (services.Service, error) {
 }
 
 func (f *Phlare) initUsageReport() (services.Service, error) {
+	usagestats.Feature("multitenancy", f.Cfg.MultitenancyEnabled)
+	usagestats.Feature("tenant_resolution_rules", len(f.Cfg.TenantResolution.Rules) > 0)
+	usagestats.Feature("agent_remote_config", f.Cfg.AgentConfig.RemoteConfig.URL.String() != "")
+	usagestats.Feature("runtime_config", len(f.Cfg.RuntimeConfig.LoadPath) > 0)
+	usagestats.Feature("block_events", len(f.Cfg.BlockEvents.WebhookURLs) > 0)
+	// the report can be inspected even when it is not sent, before opting in.
+	defer func() {
+		f.Server.HTTP.Methods("GET").Path("/api/v1/usage-stats/report").Handler(usagestats.NewReportHandler(f.Cfg.Analytics, f.usageReport))
+	}()
+
 	if !f.Cfg.Analytics.Enabled {
 		return nil, nil
 	}
@@ -435,16 +695,9 @@ func (f *Phlare) initUsageReport() (services.Service, error) {
 
 	usagestats.Target(f.Cfg.Target.String())
 
-	b := f.storageBucket
-	if f.storageBucket == nil {
-		if err := os.MkdirAll(f.Cfg.PhlareDB.DataPath, 0o777); err != nil {
-			return nil, fmt.Errorf("mkdir %s: %w", f.Cfg.PhlareDB.DataPath, err)
-		}
-		fs, err := filesystem.NewBucket(f.Cfg.PhlareDB.DataPath)
-		if err != nil {
-			return nil, err
-		}
-		b = fs
+	b, err := f.bucket()
+	if err != nil {
+		return nil, err
 	}
 
 	if b == nil {
@@ -461,6 +714,17 @@ func (f *Phlare) initUsageReport() (services.Service, error) {
 	return ur, nil
 }
 
+// bucket returns the storage bucket, or a bucket of the data path with the filesystem backend.
+func (f *Phlare) bucket() (objstore.Bucket, error) {
+	if f.storageBucket != nil {
+		return f.storageBucket, nil
+	}
+	if err := os.MkdirAll(f.Cfg.PhlareDB.DataPath, 0o777); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", f.Cfg.PhlareDB.DataPath, err)
+	}
+	return filesystem.NewBucket(f.Cfg.PhlareDB.DataPath)
+}
+
 type statusService struct {
 	statusv1.UnimplementedStatusServiceServer
 	defaultConfig *Config
@@ -0,0 +1,30 @@
+package phlare
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/version"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/grafana/phlare/pkg/openapi"
+)
+
+// newAPIDocument returns the OpenAPI document of the HTTP API, served at /api/openapi.json. It
+// documents the unary procedures of the reflected services, the other routes are added to it as
+// they are registered by the modules.
+func newAPIDocument(files *protoregistry.Files) (*openapi.Document, error) {
+	doc := openapi.New("Grafana Phlare", version.Version)
+	for _, name := range reflectedServices {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, err
+		}
+		sd, ok := desc.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a service", name)
+		}
+		doc.AddService(sd)
+	}
+	return doc, nil
+}
@@ -0,0 +1,22 @@
+package phlare
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func TestAPIDocument(t *testing.T) {
+	doc, err := newAPIDocument(protoregistry.GlobalFiles)
+	require.NoError(t, err)
+	for _, path := range []string{
+		"/push.v1.PusherService/Push",
+		"/querier.v1.QuerierService/LabelNames",
+		"/api/v1/status/buildinfo",
+	} {
+		require.Contains(t, doc.Paths, path)
+	}
+	// the streaming procedures are not documented.
+	require.NotContains(t, doc.Paths, "/ingester.v1.IngesterService/MergeProfilesStacktraces")
+}
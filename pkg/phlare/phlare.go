@@ -29,15 +29,20 @@ import (
 	"github.com/weaveworks/common/server"
 	"github.com/weaveworks/common/signals"
 	wwtracing "github.com/weaveworks/common/tracing"
+	"google.golang.org/protobuf/reflect/protoregistry"
 
 	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
 	"github.com/grafana/phlare/pkg/agent"
+	"github.com/grafana/phlare/pkg/blockevents"
+	"github.com/grafana/phlare/pkg/canary"
 	"github.com/grafana/phlare/pkg/cfg"
+	"github.com/grafana/phlare/pkg/chaos"
 	"github.com/grafana/phlare/pkg/distributor"
 	"github.com/grafana/phlare/pkg/frontend"
 	"github.com/grafana/phlare/pkg/ingester"
 	"github.com/grafana/phlare/pkg/objstore"
 	objstoreclient "github.com/grafana/phlare/pkg/objstore/client"
+	"github.com/grafana/phlare/pkg/openapi"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb"
 	"github.com/grafana/phlare/pkg/querier"
@@ -56,6 +61,8 @@ type Config struct {
 	Target            flagext.StringSliceCSV `yaml:"target,omitempty"`
 	AgentConfig       agent.Config           `yaml:",inline"`
 	Server            server.Config          `yaml:"server,omitempty"`
+	HTTP2Server       util.HTTP2ServerConfig `yaml:"http2_server"`
+	Log               util.LogConfig         `yaml:"log"`
 	Distributor       distributor.Config     `yaml:"distributor,omitempty"`
 	Querier           querier.Config         `yaml:"querier,omitempty"`
 	Frontend          frontend.Config        `yaml:"frontend,omitempty"`
@@ -68,11 +75,17 @@ type Config struct {
 	Tracing           tracing.Config         `yaml:"tracing"`
 	OverridesExporter exporter.Config        `yaml:"overrides_exporter" doc:"hidden"`
 	RuntimeConfig     runtimeconfig.Config   `yaml:"runtime_config"`
+	Canary            canary.Config          `yaml:"canary"`
+	BlockEvents       blockevents.Config     `yaml:"block_events"`
 
 	Storage StorageConfig `yaml:"storage"`
 
-	MultitenancyEnabled bool              `yaml:"multitenancy_enabled,omitempty"`
-	Analytics           usagestats.Config `yaml:"analytics"`
+	MultitenancyEnabled bool                    `yaml:"multitenancy_enabled,omitempty"`
+	InProcessRequests   bool                    `yaml:"in_process_requests" category:"advanced"`
+	TenantResolution    tenant.ResolutionConfig `yaml:"tenant_resolution"`
+	APIKeys             tenant.APIKeysConfig    `yaml:"api_keys"`
+	Analytics           usagestats.Config       `yaml:"analytics"`
+	Chaos               chaos.Config            `yaml:"chaos" doc:"hidden"`
 
 	ConfigFile      string `yaml:"-"`
 	ConfigExpandEnv bool   `yaml:"-"`
@@ -105,9 +118,13 @@ func (c *Config) RegisterFlagsWithContext(ctx context.Context, f *flag.FlagSet)
 	f.Var(&c.Target, "target", "Comma-separated list of Phlare modules to load. "+
 		"The alias 'all' can be used in the list to load a number of core modules and will enable single-binary mode. ")
 	f.BoolVar(&c.MultitenancyEnabled, "auth.multitenancy-enabled", false, "When set to true, incoming HTTP requests must specify tenant ID in HTTP X-Scope-OrgId header. When set to false, tenant ID anonymous is used instead.")
+	f.BoolVar(&c.InProcessRequests, "in-process-requests", true, "When the modules run in the same process, the requests between them call the connect handlers of the other module directly rather than going through the network and the HTTP router.")
 	f.BoolVar(&c.ConfigExpandEnv, "config.expand-env", false, "Expands ${var} in config according to the values of the environment variables.")
 
 	c.registerServerFlagsWithChangedDefaultValues(f)
+	c.APIKeys.RegisterFlags(f)
+	c.HTTP2Server.RegisterFlags(f)
+	c.Log.RegisterFlags(f)
 	c.AgentConfig.RegisterFlags(f)
 	c.MemberlistKV.RegisterFlags(f)
 	c.Querier.RegisterFlags(f)
@@ -117,6 +134,9 @@ func (c *Config) RegisterFlagsWithContext(ctx context.Context, f *flag.FlagSet)
 	c.RuntimeConfig.RegisterFlags(f)
 	c.Analytics.RegisterFlags(f)
 	c.LimitsConfig.RegisterFlags(f)
+	c.Canary.RegisterFlags(f)
+	c.BlockEvents.RegisterFlags(f)
+	c.Chaos.RegisterFlags(f)
 }
 
 // registerServerFlagsWithChangedDefaultValues registers *Config.Server flags, but overrides some defaults set by the weaveworks package.
@@ -157,12 +177,72 @@ func (c *Config) Validate() error {
 	if len(c.Target) == 0 {
 		return errors.New("no modules specified")
 	}
+	if err := c.Log.Validate(); err != nil {
+		return err
+	}
+	if err := c.Distributor.Validate(); err != nil {
+		return err
+	}
+	if err := c.Querier.Validate(); err != nil {
+		return err
+	}
+	if err := c.PhlareDB.Validate(); err != nil {
+		return err
+	}
 	if err := c.Ingester.Validate(); err != nil {
 		return err
 	}
+	if c.inMemoryRing() && !util.StringsContain(c.Target, All) {
+		return errors.New("the inmemory ring store is only supported when running the target 'all'")
+	}
+	if err := c.Storage.Bucket.Validate(); err != nil {
+		return fmt.Errorf("invalid storage config: %w", err)
+	}
+	if err := c.BlockEvents.Validate(); err != nil {
+		return err
+	}
+	if err := c.LimitsConfig.Validate(); err != nil {
+		return fmt.Errorf("invalid limits: %w", err)
+	}
+	if err := c.TenantResolution.Validate(); err != nil {
+		return err
+	}
+	if err := c.Chaos.Validate(); err != nil {
+		return err
+	}
 	return c.AgentConfig.Validate()
 }
 
+// inMemoryRingStore is the ring store keeping the rings in memory.
+const inMemoryRingStore = "inmemory"
+
+// inMemoryRing returns true when the rings are stored in memory instead of memberlist. This is only
+// possible when all the modules run in the same process.
+func (c *Config) inMemoryRing() bool {
+	return c.Ingester.LifecyclerConfig.RingConfig.KVStore.Store == inMemoryRingStore
+}
+
+// useInternalSecret sends the internal secret in the requests of the clients between the components.
+func (c *Config) useInternalSecret() {
+	secret := c.APIKeys.InternalSecret.String()
+	c.Distributor.PoolConfig.InternalSecret = secret
+	c.Querier.PoolConfig.InternalSecret = secret
+	c.Frontend.InternalSecret = secret
+	c.QueryScheduler.InternalSecret = secret
+	c.Worker.InternalSecret = secret
+}
+
+// useInMemoryRing stores all the rings in memory, so the single binary neither gossips nor waits
+// for the ring changes to propagate.
+func (c *Config) useInMemoryRing() {
+	c.Distributor.DistributorRing.KVStore.Store = inMemoryRingStore
+	c.OverridesExporter.Ring.KVStore.Store = inMemoryRingStore
+	c.Frontend.QuerySchedulerDiscovery.SchedulerRing.KVStore.Store = inMemoryRingStore
+	c.Worker.QuerySchedulerDiscovery.SchedulerRing.KVStore.Store = inMemoryRingStore
+	c.QueryScheduler.ServiceDiscovery.SchedulerRing.KVStore.Store = inMemoryRingStore
+	c.Ingester.LifecyclerConfig.MinReadyDuration = 0
+}
+
 type phlareConfigGetter interface {
 	PhlareConfig() *Config
 }
@@ -226,27 +306,84 @@ type Phlare struct {
 	TenantLimits validation.TenantLimits
 
 	storageBucket objstore.Bucket
+	ingester      *ingester.Ingester
+	// ingesterHandler serves the connect API of the ingester to the in-process clients.
+	ingesterHandler http.Handler
+	blockEvents     blockevents.Notifier
 
 	grpcGatewayMux *grpcgw.ServeMux
+	// apiDoc is the OpenAPI document of the HTTP API.
+	apiDoc *openapi.Document
+
+	// auth holds the tenant authentication and the user interceptors.
+	auth         connect.Option
+	interceptors []connect.Interceptor
+
+	// chaos injects failures, in testing environments only.
+	chaos *chaos.Injector
+	// apiKeys resolves the API keys of the requests, nil when they aren't required.
+	apiKeys tenant.APIKeyResolver
+}
+
+// Option customizes Phlare when it is embedded into another program.
+type Option func(*Phlare)
 
-	auth connect.Option
+// WithAPIKeyResolver requires the requests to authenticate with an API key resolved by the given
+// resolver, e.g. backed by an external store of keys, in place of the keys of -auth.api-keys.file.
+func WithAPIKeyResolver(resolver tenant.APIKeyResolver) Option {
+	return func(f *Phlare) {
+		f.apiKeys = resolver
+	}
 }
 
-func New(cfg Config) (*Phlare, error) {
-	logger := initLogger(&cfg.Server)
+// WithInterceptors registers connect interceptors on the API servers and on the clients used
+// between the components, e.g. to add custom authentication, quotas or header propagation. They
+// run after the tenant authentication, so the tenant ID is available from their context.
+func WithInterceptors(interceptors ...connect.Interceptor) Option {
+	return func(f *Phlare) {
+		f.interceptors = append(f.interceptors, interceptors...)
+	}
+}
+
+func New(cfg Config, opts ...Option) (*Phlare, error) {
+	logger := initLogger(&cfg.Server, cfg.Log)
 	usagestats.Edition("oss")
+	if cfg.inMemoryRing() {
+		cfg.useInMemoryRing()
+	}
 
 	phlare := &Phlare{
 		Cfg:    cfg,
 		logger: logger,
 		reg:    prometheus.DefaultRegisterer,
 	}
-	if err := cfg.Validate(); err != nil {
+	for _, opt := range opts {
+		opt(phlare)
+	}
+	// the limits of the modules are validated, and compiled, in place.
+	if err := phlare.Cfg.Validate(); err != nil {
 		return nil, err
 	}
 	if err := phlare.setupModuleManager(); err != nil {
 		return nil, err
 	}
+	apiDoc, err := newAPIDocument(protoregistry.GlobalFiles)
+	if err != nil {
+		return nil, err
+	}
+	phlare.apiDoc = apiDoc
+	if phlare.apiKeys == nil {
+		if phlare.apiKeys, err = tenant.NewFileAPIKeyResolver(cfg.APIKeys); err != nil {
+			return nil, err
+		}
+	}
+	if phlare.apiKeys != nil && cfg.APIKeys.InternalSecret.String() == "" {
+		return nil, errors.New("the internal secret of -auth.internal-secret is required with the API keys")
+	}
+	if cfg.MultitenancyEnabled && len(cfg.TenantResolution.Rules) > 0 && cfg.APIKeys.InternalSecret.String() == "" {
+		return nil, errors.New("the internal secret of -auth.internal-secret is required with the tenant resolution rules")
+	}
+	phlare.Cfg.useInternalSecret()
 
 	if cfg.Tracing.Enabled {
 		// Setting the environment variable JAEGER_AGENT_HOST enables tracing
@@ -262,7 +399,13 @@ func New(cfg Config) (*Phlare, error) {
 	if err != nil {
 		return nil, err
 	}
-	phlare.auth = connect.WithInterceptors(tenant.NewAuthInterceptor(cfg.MultitenancyEnabled))
+	phlare.chaos = chaos.NewInjector(cfg.Chaos, phlare.reg)
+	if i := chaos.NewInterceptor(phlare.chaos); i != nil {
+		level.Warn(logger).Log("msg", "failures are injected in the RPCs, this must only be enabled for testing")
+		phlare.interceptors = append(phlare.interceptors, i)
+	}
+	phlare.auth = connect.WithInterceptors(append([]connect.Interceptor{tenant.NewAuthInterceptor(cfg.MultitenancyEnabled)}, phlare.interceptors...)...)
+	phlare.HTTPAuthMiddleware = tenant.NewHTTPAuthMiddleware(cfg.MultitenancyEnabled)
 
 	pusherHTTPClient.Transport = util.WrapWithInstrumentedHTTPTransport(pusherHTTPClient.Transport)
 	phlare.pusherClient = pushv1connect.NewPusherServiceClient(pusherHTTPClient,
@@ -276,6 +419,7 @@ func (f *Phlare) setupModuleManager() error {
 	mm := modules.NewManager(f.logger)
 
 	mm.RegisterModule(Storage, f.initStorage, modules.UserInvisibleModule)
+	mm.RegisterModule(BlockEvents, f.initBlockEvents, modules.UserInvisibleModule)
 	mm.RegisterModule(GRPCGateway, f.initGRPCGateway, modules.UserInvisibleModule)
 	mm.RegisterModule(MemberlistKV, f.initMemberlistKV, modules.UserInvisibleModule)
 	mm.RegisterModule(Ring, f.initRing, modules.UserInvisibleModule)
@@ -290,6 +434,7 @@ func (f *Phlare) setupModuleManager() error {
 	mm.RegisterModule(UsageReport, f.initUsageReport)
 	mm.RegisterModule(QueryFrontend, f.initQueryFrontend)
 	mm.RegisterModule(QueryScheduler, f.initQueryScheduler)
+	mm.RegisterModule(Canary, f.initCanary)
 	mm.RegisterModule(All, nil)
 
 	// Add dependencies
@@ -298,10 +443,11 @@ func (f *Phlare) setupModuleManager() error {
 
 		Agent:          {Server},
 		Distributor:    {Overrides, Ring, Server, UsageReport},
-		Querier:        {Server, MemberlistKV, Ring, UsageReport},
-		QueryFrontend:  {OverridesExporter, Server, MemberlistKV, UsageReport},
+		Querier:        {Overrides, Server, MemberlistKV, Ring, UsageReport},
+		QueryFrontend:  {Overrides, OverridesExporter, Server, MemberlistKV, UsageReport},
 		QueryScheduler: {Overrides, Server, MemberlistKV, UsageReport},
-		Ingester:       {Overrides, Server, MemberlistKV, Storage, UsageReport},
+		Ingester:       {Overrides, Server, MemberlistKV, Storage, BlockEvents, UsageReport},
+		Canary:         {Server},
 
 		UsageReport:       {Storage, MemberlistKV},
 		Overrides:         {RuntimeConfig},
@@ -341,6 +487,9 @@ func (f *Phlare) Run() error {
 		return err
 	}
 	f.Server.HTTP.Path("/ready").Methods("GET").Handler(f.readyHandler(sm))
+	if err := f.registerModulesHandler(serviceMap); err != nil {
+		return err
+	}
 
 	RegisterHealthServer(f.Server.HTTP, grpcutil.WithManager(sm))
 	healthy := func() { level.Info(f.logger).Log("msg", "Phlare started", "version", version.Info()) }
@@ -399,6 +548,19 @@ func (f *Phlare) Run() error {
 	return err
 }
 
+// registerModulesHandler registers the modules endpoint. The routes under /api are served by the
+// gRPC gateway once it's initialized.
+func (f *Phlare) registerModulesHandler(serviceMap map[string]services.Service) error {
+	h := modulesHandler(serviceMap)
+	if f.grpcGatewayMux == nil {
+		f.Server.HTTP.Path("/api/v1/modules").Methods("GET").Handler(h)
+		return nil
+	}
+	return f.grpcGatewayMux.HandlePath(http.MethodGet, "/api/v1/modules", func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		h(w, r)
+	})
+}
+
 func (f *Phlare) readyHandler(sm *services.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !sm.IsHealthy() {
@@ -427,12 +589,12 @@ func (f *Phlare) stopped() {
 	}
 }
 
-func initLogger(cfg *server.Config) log.Logger {
+func initLogger(cfg *server.Config, logCfg util.LogConfig) log.Logger {
 	logger := log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
 	if cfg.LogFormat.String() == "json" {
 		logger = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
 	}
-	logger = level.NewFilter(logger, levelFilter(cfg.LogLevel.String()))
+	logger = util.NewLogFilter(logger, cfg.LogLevel.String(), logCfg)
 
 	// when use util_log.Logger, skip 3 stack frames.
 	logger = log.With(logger, "caller", log.Caller(3))
@@ -446,18 +608,3 @@ func initLogger(cfg *server.Config) log.Logger {
 	util.Logger = logger
 	return logger
 }
-
-func levelFilter(l string) level.Option {
-	switch l {
-	case "debug":
-		return level.AllowDebug()
-	case "info":
-		return level.AllowInfo()
-	case "warn":
-		return level.AllowWarn()
-	case "error":
-		return level.AllowError()
-	default:
-		return level.AllowAll()
-	}
-}
@@ -2,12 +2,23 @@ package phlare
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/bufbuild/connect-go"
 	"github.com/stretchr/testify/require"
+
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func TestFlagDefaults(t *testing.T) {
@@ -53,3 +64,109 @@ func TestFlagDefaults(t *testing.T) {
 	require.Equal(t, c.Server.HTTPListenPort, 4100)
 	require.Contains(t, gotFlags[flagToCheck], "(default 4100)")
 }
+
+type fakePusher struct {
+	pushv1connect.UnimplementedPusherServiceHandler
+}
+
+func (fakePusher) Push(context.Context, *connect.Request[pushv1.PushRequest]) (*connect.Response[pushv1.PushResponse], error) {
+	return connect.NewResponse(&pushv1.PushResponse{}), nil
+}
+
+func TestWithInterceptors(t *testing.T) {
+	cfg := newDefaultConfig()
+	cfg.MultitenancyEnabled = true
+
+	var (
+		serverTenants []string
+		clientCalls   int
+	)
+	f, err := New(*cfg, WithInterceptors(connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+			if req.Spec().IsClient {
+				clientCalls++
+			} else {
+				tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+				require.NoError(t, err)
+				serverTenants = append(serverTenants, tenantID)
+			}
+			return next(ctx, req)
+		}
+	})))
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	mux.Handle(pushv1connect.NewPusherServiceHandler(fakePusher{}, f.auth))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	client := pushv1connect.NewPusherServiceClient(srv.Client(), srv.URL, f.auth)
+	_, err = client.Push(tenant.InjectTenantID(context.Background(), "tenant-a"), connect.NewRequest(&pushv1.PushRequest{}))
+	require.NoError(t, err)
+	require.Equal(t, 1, clientCalls)
+	require.Equal(t, []string{"tenant-a"}, serverTenants)
+}
+
+type fakeQuerier struct {
+	querierv1connect.UnimplementedQuerierServiceHandler
+	tenants []string
+}
+
+func (q *fakeQuerier) SelectSeries(ctx context.Context, _ *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeUnauthenticated, err)
+	}
+	q.tenants = append(q.tenants, tenantID)
+	return connect.NewResponse(&querierv1.SelectSeriesResponse{}), nil
+}
+
+func TestQueryHandlers_TenantResolution(t *testing.T) {
+	cfg := newDefaultConfig()
+	cfg.MultitenancyEnabled = true
+	cfg.InProcessRequests = false
+	cfg.Tracing.Enabled = false
+	require.NoError(t, cfg.APIKeys.InternalSecret.Set("secret"))
+	cfg.TenantResolution.Rules = []*tenant.ResolutionRule{{Source: tenant.SourceHeader, Header: "X-Team"}}
+	require.NoError(t, cfg.TenantResolution.Validate())
+
+	f, err := New(*cfg)
+	require.NoError(t, err)
+	f.Overrides, err = validation.NewOverrides(cfg.LimitsConfig, nil)
+	require.NoError(t, err)
+	_, err = f.initGRPCGateway()
+	require.NoError(t, err)
+	querier := &fakeQuerier{}
+	require.NoError(t, f.registerQueryHandlers(querier))
+
+	// the tenant resolved by the rules reaches the querier, without the loopback requests going
+	// through the rules again.
+	srv := httptest.NewServer(tenant.NewResolutionMiddleware(cfg.TenantResolution, "secret").Wrap(f.grpcGatewayMux))
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+`/api/v1/query?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{}`, nil)
+	require.NoError(t, err)
+	req.Header.Set("X-Team", "team-a")
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	require.Equal(t, []string{"team-a"}, querier.tenants)
+}
+
+func TestLoopbackURL(t *testing.T) {
+	for _, tc := range []struct {
+		address, certPath string
+		expected          string
+	}{
+		{expected: "http://localhost:4100"},
+		{address: "10.0.0.1", expected: "http://10.0.0.1:4100"},
+		{address: "::1", expected: "http://[::1]:4100"},
+		{address: "10.0.0.1", certPath: "server.crt", expected: "https://10.0.0.1:4100"},
+	} {
+		f := &Phlare{Cfg: *newDefaultConfig()}
+		f.Cfg.Server.HTTPListenAddress = tc.address
+		f.Cfg.Server.HTTPTLSConfig.TLSCertPath = tc.certPath
+		require.Equal(t, tc.expected, f.loopbackURL())
+	}
+}
@@ -0,0 +1,100 @@
+package phlare
+
+import (
+	"fmt"
+	"net/http"
+
+	grpcreflect "github.com/bufbuild/connect-grpcreflect-go"
+	"github.com/gorilla/mux"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	"github.com/grafana/phlare/api/gen/proto/go/agent/v1/agentv1connect"
+	"github.com/grafana/phlare/api/gen/proto/go/ingester/v1/ingesterv1connect"
+	"github.com/grafana/phlare/api/gen/proto/go/push/v1/pushv1connect"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/api/gen/proto/go/status/v1/statusv1connect"
+)
+
+// reflectedServices are the services exposed through gRPC server reflection
+// and the API descriptors endpoint.
+var reflectedServices = []string{
+	pushv1connect.PusherServiceName,
+	querierv1connect.QuerierServiceName,
+	ingesterv1connect.IngesterServiceName,
+	agentv1connect.AgentServiceName,
+	statusv1connect.StatusServiceName,
+}
+
+// RegisterReflectionServer registers the gRPC server reflection services, so
+// tools like grpcurl or buf curl can explore the API without its proto files.
+func RegisterReflectionServer(mux *mux.Router) {
+	reflector := grpcreflect.NewStaticReflector(reflectedServices...)
+	prefix, handler := grpcreflect.NewHandlerV1(reflector)
+	mux.NewRoute().PathPrefix(prefix).Handler(handler)
+	// Many tools still only support the v1alpha version of the reflection API.
+	prefix, handler = grpcreflect.NewHandlerV1Alpha(reflector)
+	mux.NewRoute().PathPrefix(prefix).Handler(handler)
+}
+
+// DescriptorsHandler serves the file descriptor set of the API services and
+// all their dependencies. The binary form can be passed to grpcurl -protoset,
+// the JSON form is returned when requested with ?format=json.
+func DescriptorsHandler() (http.Handler, error) {
+	set, err := fileDescriptorSet(protoregistry.GlobalFiles, reflectedServices...)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := proto.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	json, err := protojson.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write(json)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(binary)
+	}), nil
+}
+
+// fileDescriptorSet returns the files declaring the given services, preceded
+// by their transitive dependencies.
+func fileDescriptorSet(files *protoregistry.Files, services ...string) (*descriptorpb.FileDescriptorSet, error) {
+	var (
+		set  = &descriptorpb.FileDescriptorSet{}
+		seen = map[string]struct{}{}
+		add  func(fd protoreflect.FileDescriptor)
+	)
+	add = func(fd protoreflect.FileDescriptor) {
+		if _, ok := seen[fd.Path()]; ok {
+			return
+		}
+		seen[fd.Path()] = struct{}{}
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+
+	for _, name := range services {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			return nil, fmt.Errorf("unable to find descriptor for service %s: %w", name, err)
+		}
+		add(desc.ParentFile())
+	}
+	return set, nil
+}
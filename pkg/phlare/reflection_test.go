@@ -0,0 +1,27 @@
+package phlare
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func TestFileDescriptorSet(t *testing.T) {
+	set, err := fileDescriptorSet(protoregistry.GlobalFiles, reflectedServices...)
+	require.NoError(t, err)
+
+	// The set must contain all dependencies to be usable on its own.
+	files, err := protodesc.NewFiles(set)
+	require.NoError(t, err)
+	for _, name := range reflectedServices {
+		desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+		require.NoError(t, err)
+		require.Implements(t, (*protoreflect.ServiceDescriptor)(nil), desc)
+	}
+
+	_, err = fileDescriptorSet(protoregistry.GlobalFiles, "unknown.v1.UnknownService")
+	require.Error(t, err)
+}
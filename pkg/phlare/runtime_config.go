@@ -9,12 +9,14 @@ import (
 	"github.com/grafana/dskit/runtimeconfig"
 	"gopkg.in/yaml.v2"
 
+	"github.com/grafana/phlare/pkg/agent"
 	"github.com/grafana/phlare/pkg/util"
 	"github.com/grafana/phlare/pkg/validation"
 )
 
 type runtimeConfigValues struct {
 	TenantLimits map[string]*validation.Limits `yaml:"overrides"`
+	AgentConfigs []*agent.ConfigRule           `yaml:"agent_configs"`
 }
 
 func (r runtimeConfigValues) validate() error {
@@ -28,6 +30,14 @@ func (r runtimeConfigValues) validate() error {
 			return fmt.Errorf("invalid override for tenant %s: %w", t, err)
 		}
 	}
+	for i, rule := range r.AgentConfigs {
+		if rule == nil {
+			return fmt.Errorf("invalid agent config %d: empty rule", i)
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("invalid agent config %d: %w", i, err)
+		}
+	}
 	return nil
 }
 
@@ -71,6 +81,17 @@ func (t *tenantLimitsFromRuntimeConfig) TenantLimits(userID string) *validation.
 	return allByUserID[userID]
 }
 
+// agentConfigRules returns the agent config rules of the runtime config.
+func agentConfigRules(c *runtimeconfig.Manager) func() []*agent.ConfigRule {
+	return func() []*agent.ConfigRule {
+		cfg, ok := c.GetConfig().(*runtimeConfigValues)
+		if !ok || cfg == nil {
+			return nil
+		}
+		return cfg.AgentConfigs
+	}
+}
+
 func newTenantLimits(c *runtimeconfig.Manager) validation.TenantLimits {
 	return &tenantLimitsFromRuntimeConfig{c: c}
 }
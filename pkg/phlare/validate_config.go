@@ -0,0 +1,62 @@
+package phlare
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+
+	objstoreclient "github.com/grafana/phlare/pkg/objstore/client"
+	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+// storageCheckTimeout bounds the storage connectivity check of ValidateConfig.
+const storageCheckTimeout = 30 * time.Second
+
+// ValidateConfig validates the configuration without starting any module: the configuration itself,
+// the default limits and the runtime configuration files holding the per-tenant overrides. Unknown
+// fields are rejected when the YAML files are parsed. When online is true, the connectivity to the
+// storage bucket is checked as well.
+func ValidateConfig(ctx context.Context, cfg Config, logger log.Logger, online bool) error {
+	// the default limits are validated with the configuration.
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// the per-tenant overrides default to the limits of the configuration.
+	validation.SetDefaultLimitsForYAMLUnmarshalling(cfg.LimitsConfig)
+	for _, path := range cfg.RuntimeConfig.LoadPath {
+		if err := validateRuntimeConfigFile(path); err != nil {
+			return fmt.Errorf("invalid runtime config %s: %w", path, err)
+		}
+	}
+
+	if !online || cfg.Storage.Bucket.Backend == objstoreclient.Filesystem {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(phlarecontext.WithLogger(ctx, logger), storageCheckTimeout)
+	defer cancel()
+	bucket, err := objstoreclient.NewBucket(ctx, cfg.Storage.Bucket, "storage")
+	if err != nil {
+		return fmt.Errorf("unable to initialise bucket: %w", err)
+	}
+	defer bucket.Close()
+	// a missing object is not an error, only an unreachable or forbidden bucket is.
+	if _, err := bucket.Exists(ctx, "phlare-config-validate"); err != nil {
+		return fmt.Errorf("unable to access bucket: %w", err)
+	}
+	return nil
+}
+
+func validateRuntimeConfigFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = loadRuntimeConfig(f)
+	return err
+}
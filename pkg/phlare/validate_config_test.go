@@ -0,0 +1,90 @@
+package phlare
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateConfig(t *testing.T) {
+	writeRuntimeConfig := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "overrides.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+
+	for _, tc := range []struct {
+		name          string
+		cfg           func(t *testing.T, cfg *Config)
+		expectedError string
+	}{
+		{
+			name: "default config",
+			cfg:  func(t *testing.T, cfg *Config) {},
+		},
+		{
+			name: "valid overrides",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.RuntimeConfig.LoadPath = []string{writeRuntimeConfig(t, "overrides:\n  tenant-a:\n    ingestion_rate_mb: 8\n")}
+			},
+		},
+		{
+			name: "unknown field in overrides",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.RuntimeConfig.LoadPath = []string{writeRuntimeConfig(t, "overrides:\n  tenant-a:\n    ingestion_rate: 8\n")}
+			},
+			expectedError: "field ingestion_rate not found",
+		},
+		{
+			name: "invalid override",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.RuntimeConfig.LoadPath = []string{writeRuntimeConfig(t, "overrides:\n  tenant-a:\n    ingestion_drop_frames: \"runtime\\\\.(\"\n")}
+			},
+			expectedError: "invalid override for tenant tenant-a",
+		},
+		{
+			name: "invalid limits",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.LimitsConfig.IngestionDropFrames = "("
+			},
+			expectedError: "invalid limits",
+		},
+		{
+			name: "inmemory ring in single binary",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.Store = "inmemory"
+				cfg.Target = []string{All, Canary}
+			},
+		},
+		{
+			name: "inmemory ring in microservices",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.Ingester.LifecyclerConfig.RingConfig.KVStore.Store = "inmemory"
+				cfg.Target = []string{Ingester}
+			},
+			expectedError: "the inmemory ring store is only supported",
+		},
+		{
+			name: "missing runtime config",
+			cfg: func(t *testing.T, cfg *Config) {
+				cfg.RuntimeConfig.LoadPath = []string{filepath.Join(t.TempDir(), "missing.yaml")}
+			},
+			expectedError: "no such file or directory",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := newDefaultConfig()
+			tc.cfg(t, cfg)
+			err := ValidateConfig(context.Background(), *cfg, log.NewNopLogger(), true)
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tc.expectedError)
+		})
+	}
+}
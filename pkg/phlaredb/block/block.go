@@ -20,6 +20,7 @@ import (
 const (
 	IndexFilename        = "index.tsdb"
 	ParquetSuffix        = ".parquet"
+	ProfilesFilename     = "profiles" + ParquetSuffix
 	DeletionMarkFilename = "deletion-mark.json"
 
 	HostnameLabel = "__hostname__"
@@ -88,6 +89,22 @@ func upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 		meta.Labels[HostnameLabel] = hostname
 	}
 
+	// The index is checksummed, or verified against its checksums before it is uploaded, so that
+	// the readers detect the partial or corrupted downloads.
+	for i, file := range meta.Files {
+		if file.RelPath != IndexFilename {
+			continue
+		}
+		checksums, err := FileChecksums(path.Join(bdir, file.RelPath))
+		if err != nil {
+			return errors.Wrap(err, "checksum of the index")
+		}
+		if file.Checksums != nil && checksums.Hash() != file.Checksums.Hash() {
+			return errors.Errorf("the index of block %s doesn't match its checksums: the local copy is corrupted", id)
+		}
+		meta.Files[i].Checksums = checksums
+	}
+
 	metaEncoded := strings.Builder{}
 	if err != nil {
 		return errors.Wrap(err, "gather meta file stats")
@@ -0,0 +1,301 @@
+package block
+
+import (
+	"container/list"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+)
+
+const fileCacheTmpSuffix = ".tmp"
+
+// FileCache keeps verified local copies of the files of the blocks read from a remote bucket, so
+// that they are downloaded once rather than after every restart. The copies are keyed by the ULID
+// of the block, the name of the file and the hash of its checksums: a file rewritten in the
+// bucket has a different key, and its stale copy is evicted eventually.
+//
+// The total size of the copies is bounded: the least recently used copies are evicted first. The
+// modification time of a copy is updated when it's used, so that the order is kept across restarts.
+type FileCache struct {
+	dir      string
+	maxBytes int64
+
+	mtx   sync.Mutex
+	size  int64
+	lru   *list.List // of *cachedFile, the most recently used first.
+	files map[string]*list.Element
+}
+
+type cachedFile struct {
+	name string
+	size int64
+}
+
+// NewFileCache returns a cache of the files of the blocks in dir, holding up to maxBytes. The
+// copies already in dir, e.g. from before a restart, are used. A maxBytes of 0 doesn't bound the
+// size of the cache.
+func NewFileCache(dir string, maxBytes int64) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := &FileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		files:    make(map[string]*list.Element),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		cachedFile
+		modTime time.Time
+	}
+	files := make([]existing, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		// the leftovers of the downloads interrupted.
+		if strings.HasSuffix(e.Name(), fileCacheTmpSuffix) {
+			_ = os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, existing{cachedFile: cachedFile{name: e.Name(), size: info.Size()}, modTime: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for _, f := range files {
+		f := f.cachedFile
+		c.files[f.name] = c.lru.PushBack(&f)
+		c.size += f.size
+	}
+	c.mtx.Lock()
+	c.evict()
+	c.mtx.Unlock()
+	return c, nil
+}
+
+func cacheKey(id ulid.ULID, f *File) string {
+	return id.String() + "-" + strings.ReplaceAll(f.RelPath, "/", "_") + "-" + f.Checksums.Hash()
+}
+
+// Size returns the total size of the copies in the cache.
+func (c *FileCache) Size() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.size
+}
+
+// ReadFile returns the content of the file of the block from the cache, or downloads it from the
+// bucket and caches it. Only the files with checksums are cached, and they are verified again when
+// read from the cache.
+func (c *FileCache) ReadFile(ctx context.Context, bkt phlareobjstore.BucketReader, id ulid.ULID, f *File) ([]byte, error) {
+	if c == nil || f.Checksums == nil {
+		return ReadFile(ctx, bkt, f)
+	}
+	path, ok, err := c.fetch(ctx, bkt, id, f)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return ReadFile(ctx, bkt, f)
+	}
+	if cached, err := os.Open(path); err == nil {
+		data, err := verify(path, f, cached)
+		_ = cached.Close()
+		if err == nil {
+			return data, nil
+		}
+	}
+	// the corrupted copy is downloaded again.
+	c.remove(filepath.Base(path))
+	return ReadFile(ctx, bkt, f)
+}
+
+// ReaderAt returns a reader of the file of the block from the cache, or downloads it from the
+// bucket and caches it. The copies are verified while they are downloaded. The files without
+// checksums, or larger than the cache, are read from the bucket.
+func (c *FileCache) ReaderAt(ctx context.Context, bkt phlareobjstore.BucketReader, id ulid.ULID, f *File) (phlareobjstore.ReaderAt, error) {
+	if c == nil || f.Checksums == nil {
+		return bkt.ReaderAt(ctx, f.RelPath)
+	}
+	path, ok, err := c.fetch(ctx, bkt, id, f)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return bkt.ReaderAt(ctx, f.RelPath)
+	}
+	// An evicted copy remains readable until it is closed.
+	file, err := os.Open(path)
+	if err != nil {
+		return bkt.ReaderAt(ctx, f.RelPath)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &fileReaderAt{File: file, size: info.Size()}, nil
+}
+
+type fileReaderAt struct {
+	*os.File
+	size int64
+}
+
+func (f *fileReaderAt) Size() int64 { return f.size }
+
+// BucketReader returns a reader of the bucket of the block reading its files with checksums
+// through the cache.
+func (c *FileCache) BucketReader(bkt phlareobjstore.BucketReader, meta *Meta) phlareobjstore.BucketReader {
+	if c == nil {
+		return bkt
+	}
+	return &cachedBucketReader{BucketReader: bkt, cache: c, meta: meta}
+}
+
+type cachedBucketReader struct {
+	phlareobjstore.BucketReader
+	cache *FileCache
+	meta  *Meta
+}
+
+func (b *cachedBucketReader) ReaderAt(ctx context.Context, name string) (phlareobjstore.ReaderAt, error) {
+	f := b.meta.FileByRelPath(name)
+	if f == nil {
+		return b.BucketReader.ReaderAt(ctx, name)
+	}
+	return b.cache.ReaderAt(ctx, b.BucketReader, b.meta.ULID, f)
+}
+
+// fetch returns the path of the copy of the file, downloading it if it isn't cached yet. It
+// returns false when the file can't be cached.
+func (c *FileCache) fetch(ctx context.Context, bkt phlareobjstore.BucketReader, id ulid.ULID, f *File) (string, bool, error) {
+	name := cacheKey(id, f)
+	path := filepath.Join(c.dir, name)
+
+	c.mtx.Lock()
+	e, ok := c.files[name]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mtx.Unlock()
+	if ok {
+		now := time.Now()
+		_ = os.Chtimes(path, now, now)
+		return path, true, nil
+	}
+	if c.maxBytes > 0 && int64(f.SizeBytes) > c.maxBytes {
+		return "", false, nil
+	}
+
+	var (
+		size int64
+		err  error
+	)
+	for attempt := 0; attempt < 2; attempt++ {
+		if size, err = c.download(ctx, bkt, f, path); err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	// the file downloaded concurrently by another query is already accounted.
+	if e, ok := c.files[name]; ok {
+		c.lru.MoveToFront(e)
+		return path, true, nil
+	}
+	c.files[name] = c.lru.PushFront(&cachedFile{name: name, size: size})
+	c.size += size
+	c.evict()
+	return path, true, nil
+}
+
+// download writes the file to a temporary file first, so that the cache never has partial files.
+func (c *FileCache) download(ctx context.Context, bkt phlareobjstore.BucketReader, f *File, path string) (int64, error) {
+	rc, err := bkt.Get(ctx, f.RelPath)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(c.dir, filepath.Base(path)+".*"+fileCacheTmpSuffix)
+	if err != nil {
+		return 0, err
+	}
+	size, err := verifyTo(f.RelPath, f, rc, tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fileutil.Replace(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return 0, err
+	}
+	return size, nil
+}
+
+// evict removes the least recently used copies until the cache fits in its size. It must be called
+// with the lock held.
+func (c *FileCache) evict() {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		e := c.lru.Back()
+		if e == nil {
+			return
+		}
+		c.removeElement(e)
+	}
+}
+
+func (c *FileCache) removeElement(e *list.Element) {
+	f := c.lru.Remove(e).(*cachedFile)
+	delete(c.files, f.name)
+	c.size -= f.size
+	_ = os.Remove(filepath.Join(c.dir, f.name))
+}
+
+func (c *FileCache) remove(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if e, ok := c.files[name]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Remove removes the cached copies of the files of the block.
+func (c *FileCache) Remove(id ulid.ULID) {
+	if c == nil {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	prefix := id.String() + "-"
+	for name, e := range c.files {
+		if strings.HasPrefix(name, prefix) {
+			c.removeElement(e)
+		}
+	}
+}
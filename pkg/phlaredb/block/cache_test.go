@@ -0,0 +1,95 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+)
+
+func uploadFile(t *testing.T, bkt *filesystem.Bucket, name string, data []byte) *File {
+	t.Helper()
+	checksums, err := ComputeChecksums(bytes.NewReader(data), 8)
+	require.NoError(t, err)
+	require.NoError(t, bkt.Upload(context.Background(), name, bytes.NewReader(data)))
+	return &File{RelPath: name, SizeBytes: uint64(len(data)), Checksums: checksums}
+}
+
+func TestFileCache(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("0123456789abcdefghij")
+	bkt, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+	f := uploadFile(t, bkt, IndexFilename, data)
+	id := ulid.MustNew(1, nil)
+
+	cache, err := NewFileCache(t.TempDir(), 0)
+	require.NoError(t, err)
+	read, err := cache.ReadFile(ctx, bkt, id, f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	// the file is read from the cache.
+	require.NoError(t, bkt.Delete(ctx, IndexFilename))
+	read, err = cache.ReadFile(ctx, bkt, id, f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	cache.Remove(id)
+	require.Equal(t, int64(0), cache.Size())
+	_, err = cache.ReadFile(ctx, bkt, id, f)
+	require.Error(t, err)
+}
+
+func TestFileCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	bkt, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+	var (
+		dir   = t.TempDir()
+		id    = ulid.MustNew(1, nil)
+		files = []*File{
+			uploadFile(t, bkt, "a.parquet", bytes.Repeat([]byte("a"), 20)),
+			uploadFile(t, bkt, "b.parquet", bytes.Repeat([]byte("b"), 20)),
+			uploadFile(t, bkt, "c.parquet", bytes.Repeat([]byte("c"), 20)),
+		}
+	)
+	cache, err := NewFileCache(dir, 50)
+	require.NoError(t, err)
+
+	readAt := func(c *FileCache, f *File) []byte {
+		r, err := c.ReaderAt(ctx, bkt, id, f)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+		require.NoError(t, err)
+		return data
+	}
+	readAt(cache, files[0])
+	readAt(cache, files[1])
+	// a is used again, so b is the least recently used.
+	readAt(cache, files[0])
+	readAt(cache, files[2])
+	require.Equal(t, int64(40), cache.Size())
+
+	// the cache is kept across restarts.
+	for _, f := range files {
+		require.NoError(t, bkt.Delete(ctx, f.RelPath))
+	}
+	cache, err = NewFileCache(dir, 50)
+	require.NoError(t, err)
+	require.Equal(t, int64(40), cache.Size())
+	require.Equal(t, bytes.Repeat([]byte("a"), 20), readAt(cache, files[0]))
+	require.Equal(t, bytes.Repeat([]byte("c"), 20), readAt(cache, files[2]))
+	_, err = cache.ReaderAt(ctx, bkt, id, files[1])
+	require.Error(t, err)
+
+	// a file rewritten in the bucket has a different hash, its stale copy isn't used.
+	rewritten := uploadFile(t, bkt, "a.parquet", bytes.Repeat([]byte("A"), 20))
+	require.Equal(t, bytes.Repeat([]byte("A"), 20), readAt(cache, rewritten))
+}
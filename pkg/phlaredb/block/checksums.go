@@ -0,0 +1,154 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/objstore"
+)
+
+// DefaultChecksumChunkSize is the size of the chunks of the files checksummed.
+const DefaultChecksumChunkSize = 1 << 20
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Checksums are the CRC32 (Castagnoli) checksums of the consecutive chunks of a file, verified
+// while the file is downloaded, so that a corrupted or partial download fails with an explicit
+// error rather than when the file is decoded.
+type Checksums struct {
+	ChunkSize uint64   `json:"chunkSize"`
+	CRC32C    []uint32 `json:"crc32c"`
+}
+
+// ComputeChecksums returns the checksums of the chunks of the content read.
+func ComputeChecksums(r io.Reader, chunkSize int) (*Checksums, error) {
+	c := &Checksums{ChunkSize: uint64(chunkSize)}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			c.CRC32C = append(c.CRC32C, crc32.Checksum(buf[:n], castagnoliTable))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// FileChecksums returns the checksums of the file.
+func FileChecksums(path string) (*Checksums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ComputeChecksums(f, DefaultChecksumChunkSize)
+}
+
+// Hash identifies the content of the file, from its checksums.
+func (c *Checksums) Hash() string {
+	h := crc32.New(castagnoliTable)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], c.ChunkSize)
+	_, _ = h.Write(b[:])
+	for _, crc := range c.CRC32C {
+		binary.BigEndian.PutUint32(b[:4], crc)
+		_, _ = h.Write(b[:4])
+	}
+	return fmt.Sprintf("%d-%s", len(c.CRC32C), hex.EncodeToString(h.Sum(nil)))
+}
+
+// ChecksumError is returned when a chunk of a file doesn't match its checksum.
+type ChecksumError struct {
+	File  string
+	Chunk int
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch of chunk %d of %s: the file is corrupted", e.Chunk, e.File)
+}
+
+// verify reads the content of the file, checking its size and the checksums of its chunks, if
+// known, as they are read.
+func verify(name string, f *File, r io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if f.SizeBytes > 0 {
+		buf.Grow(int(f.SizeBytes))
+	}
+	if _, err := verifyTo(name, f, r, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// verifyTo copies the content of the file to w, checking its size and the checksums of its chunks,
+// if known, as they are read.
+func verifyTo(name string, f *File, r io.Reader, w io.Writer) (int64, error) {
+	var written int64
+	if f.Checksums == nil || f.Checksums.ChunkSize == 0 {
+		n, err := io.Copy(w, r)
+		if err != nil {
+			return n, err
+		}
+		written = n
+	} else {
+		chunk := make([]byte, f.Checksums.ChunkSize)
+		for i := 0; ; i++ {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if i >= len(f.Checksums.CRC32C) || crc32.Checksum(chunk[:n], castagnoliTable) != f.Checksums.CRC32C[i] {
+					return written, &ChecksumError{File: name, Chunk: i}
+				}
+				if _, err := w.Write(chunk[:n]); err != nil {
+					return written, err
+				}
+				written += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	if f.SizeBytes > 0 && uint64(written) != f.SizeBytes {
+		return written, errors.Errorf("incomplete download of %s: got %d bytes out of %d", name, written, f.SizeBytes)
+	}
+	return written, nil
+}
+
+// ReadFile downloads the file of the block in chunks, each verified against its checksum while it
+// is received. The download is retried once when it is corrupted or incomplete.
+func ReadFile(ctx context.Context, bkt objstore.BucketReader, f *File) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var data []byte
+		if data, err = readFile(ctx, bkt, f); err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func readFile(ctx context.Context, bkt objstore.BucketReader, f *File) ([]byte, error) {
+	rc, err := bkt.Get(ctx, f.RelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return verify(f.RelPath, f, rc)
+}
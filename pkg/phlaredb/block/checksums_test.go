@@ -0,0 +1,39 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thanos-io/objstore"
+)
+
+func TestReadFile(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("0123456789abcdefghij")
+	checksums, err := ComputeChecksums(bytes.NewReader(data), 8)
+	require.NoError(t, err)
+	require.Len(t, checksums.CRC32C, 3)
+	f := &File{RelPath: IndexFilename, SizeBytes: uint64(len(data)), Checksums: checksums}
+
+	bkt := objstore.NewInMemBucket()
+	require.NoError(t, bkt.Upload(ctx, IndexFilename, bytes.NewReader(data)))
+	read, err := ReadFile(ctx, bkt, f)
+	require.NoError(t, err)
+	require.Equal(t, data, read)
+
+	// corrupted second chunk.
+	corrupted := append([]byte(nil), data...)
+	corrupted[10] = 'X'
+	require.NoError(t, bkt.Upload(ctx, IndexFilename, bytes.NewReader(corrupted)))
+	_, err = ReadFile(ctx, bkt, f)
+	var checksumErr *ChecksumError
+	require.ErrorAs(t, err, &checksumErr)
+	require.Equal(t, 1, checksumErr.Chunk)
+
+	// partial download.
+	require.NoError(t, bkt.Upload(ctx, IndexFilename, bytes.NewReader(data[:16])))
+	_, err = ReadFile(ctx, bkt, f)
+	require.ErrorContains(t, err, "incomplete download")
+}
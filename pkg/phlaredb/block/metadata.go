@@ -35,15 +35,43 @@ type SourceType string
 
 type MetaVersion int
 
+// The version of the meta is the format of the block. A component reads the blocks up to its
+// MaxSupportedVersion, so a new format is rolled out by upgrading the readers before the writers
+// start writing it.
 const (
-	// Version1 is a enumeration of Phlare section of TSDB meta supported by Phlare.
+	// MetaVersion1 is the format of the blocks storing each stacktrace as the list of its locations.
 	MetaVersion1 = MetaVersion(1)
+	// MetaVersion2 is the format of the blocks storing the stacktraces as a tree of stacktrace
+	// nodes, each node referencing its parent.
+	MetaVersion2 = MetaVersion(2)
+
+	// MaxSupportedVersion is the most recent block format supported.
+	MaxSupportedVersion = MetaVersion2
 )
 
+// UnsupportedVersionError is returned for a block written in a format more recent than the
+// supported ones.
+type UnsupportedVersionError struct {
+	ULID    ulid.ULID
+	Version MetaVersion
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("block %s has format version %d, but this component reads versions up to %d: "+
+		"upgrade it, or write the blocks with a supported version until all the components are upgraded",
+		e.ULID, e.Version, MaxSupportedVersion)
+}
+
 type BlockStats struct {
 	NumSamples  uint64 `json:"numSamples,omitempty"`
 	NumSeries   uint64 `json:"numSeries,omitempty"`
 	NumProfiles uint64 `json:"numProfiles,omitempty"`
+
+	// AvgSamplesPerProfile is the average number of samples of the profiles of the block.
+	AvgSamplesPerProfile float64 `json:"avgSamplesPerProfile,omitempty"`
+	// SymbolsBytes is the size of the symbols of the block, the files other than the index and
+	// the profiles, which are read to resolve the stacktraces of a query.
+	SymbolsBytes uint64 `json:"symbolsBytes,omitempty"`
 }
 
 type File struct {
@@ -55,6 +83,8 @@ type File struct {
 	Parquet *ParquetFile `json:"parquet,omitempty"`
 	// TSDB can contain some optional TSDB file info
 	TSDB *TSDBFile `json:"tsdb,omitempty"`
+	// Checksums are the checksums of the chunks of the file, verified when it is downloaded.
+	Checksums *Checksums `json:"checksums,omitempty"`
 }
 
 type ParquetFile struct {
@@ -85,7 +115,7 @@ type Meta struct {
 	// Information on compactions the block was created from.
 	Compaction tsdb.BlockMetaCompaction `json:"compaction"`
 
-	// Version of the index format.
+	// Version of the block format.
 	Version MetaVersion `json:"version"`
 
 	// Labels are the external labels identifying the producer as well as tenant.
@@ -104,6 +134,30 @@ func (m *Meta) FileByRelPath(name string) *File {
 	return nil
 }
 
+// CheckVersion returns an UnsupportedVersionError if the format of the block is not supported.
+func (m *Meta) CheckVersion() error {
+	if m.Version > MaxSupportedVersion {
+		return &UnsupportedVersionError{ULID: m.ULID, Version: m.Version}
+	}
+	return nil
+}
+
+// SetQueryStats sets the stats used to plan the queries of the block, from its profile counts
+// and its files.
+func (m *Meta) SetQueryStats() {
+	m.Stats.AvgSamplesPerProfile = 0
+	if m.Stats.NumProfiles > 0 {
+		m.Stats.AvgSamplesPerProfile = float64(m.Stats.NumSamples) / float64(m.Stats.NumProfiles)
+	}
+	m.Stats.SymbolsBytes = 0
+	for _, f := range m.Files {
+		if f.RelPath == IndexFilename || f.RelPath == ProfilesFilename {
+			continue
+		}
+		m.Stats.SymbolsBytes += f.SizeBytes
+	}
+}
+
 func (m *Meta) InRange(start, end model.Time) bool {
 	return InRange(m.MinTime, m.MaxTime, start, end)
 }
@@ -143,7 +197,8 @@ func MetaFromDir(dir string) (*Meta, int64, error) {
 	if err := json.Unmarshal(b, &m); err != nil {
 		return nil, 0, err
 	}
-	if m.Version != MetaVersion1 {
+	// the blocks of unsupported versions are still listed, and refused when they are read.
+	if m.Version < MetaVersion1 {
 		return nil, 0, errors.Errorf("unexpected meta file version %d", m.Version)
 	}
 
@@ -174,7 +229,9 @@ func (meta *Meta) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (meta *Meta) WriteToFile(logger log.Logger, dir string) (int64, error) {
-	meta.Version = MetaVersion1
+	if meta.Version == 0 {
+		meta.Version = MetaVersion1
+	}
 
 	// Make any changes to the file appear atomic.
 	path := filepath.Join(dir, MetaFilename)
@@ -249,7 +306,7 @@ func Read(rc io.ReadCloser) (_ *Meta, err error) {
 		return nil, err
 	}
 
-	if m.Version != MetaVersion1 {
+	if m.Version < MetaVersion1 {
 		return nil, errors.Errorf("unexpected meta file version %d", m.Version)
 	}
 
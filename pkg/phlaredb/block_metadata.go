@@ -0,0 +1,114 @@
+package phlaredb
+
+import (
+	"context"
+	"sort"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/common/model"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+// HeadStats are the stats of the profiles received by a head.
+type HeadStats struct {
+	ULID ulid.ULID `json:"ulid"`
+	// MinTime and MaxTime are the timestamps of the oldest and of the newest profile, zero when
+	// the head is empty.
+	MinTime     model.Time `json:"minTime"`
+	MaxTime     model.Time `json:"maxTime"`
+	NumSeries   uint64     `json:"numSeries"`
+	NumProfiles uint64     `json:"numProfiles"`
+	NumSamples  uint64     `json:"numSamples"`
+	MemoryBytes uint64     `json:"memoryBytes"`
+}
+
+// Stats returns the stats of the profiles received by the head.
+func (h *Head) Stats() HeadStats {
+	h.metaLock.RLock()
+	s := HeadStats{ULID: h.meta.ULID}
+	if h.meta.MinTime <= h.meta.MaxTime {
+		s.MinTime, s.MaxTime = h.meta.MinTime, h.meta.MaxTime
+	}
+	h.metaLock.RUnlock()
+	s.NumSeries = uint64(h.profiles.index.totalSeries.Load())
+	s.NumProfiles = uint64(h.profiles.index.totalProfiles.Load())
+	s.NumSamples = h.totalSamples.Load()
+	s.MemoryBytes = h.MemorySize()
+	return s
+}
+
+func (s HeadStats) blockInfo(state string) *ingestv1.BlockInfo {
+	return &ingestv1.BlockInfo{
+		Ulid:        s.ULID.String(),
+		MinTime:     int64(s.MinTime),
+		MaxTime:     int64(s.MaxTime),
+		NumSeries:   s.NumSeries,
+		NumProfiles: s.NumProfiles,
+		NumSamples:  s.NumSamples,
+		Size:        s.MemoryBytes,
+		State:       state,
+	}
+}
+
+// BlockMetadata returns the stats of the head, of the cut heads being flushed and of the local
+// blocks with their state.
+func (f *PhlareDB) BlockMetadata(ctx context.Context, _ *connect.Request[ingestv1.BlockMetadataRequest]) (*connect.Response[ingestv1.BlockMetadataResponse], error) {
+	f.headLock.RLock()
+	head := f.head.Stats()
+	flushing := make([]HeadStats, 0, len(f.flushing))
+	for _, h := range f.flushing {
+		flushing = append(flushing, h.Stats())
+	}
+	f.headLock.RUnlock()
+
+	metas, err := f.BlockMetas(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &ingestv1.BlockMetadataResponse{
+		Head:   head.blockInfo("head"),
+		Blocks: make([]*ingestv1.BlockInfo, 0, len(metas)+len(flushing)),
+	}
+	written := make(map[ulid.ULID]struct{}, len(metas))
+	for _, m := range metas {
+		written[m.ULID] = struct{}{}
+		state, ok := f.BlockState(m.ULID)
+		if !ok {
+			state = BlockStateLocal
+		}
+		res.Blocks = append(res.Blocks, metaBlockInfo(m, state.String()))
+	}
+	// a cut head is listed once, as a block as soon as it has been written.
+	for _, s := range flushing {
+		if _, ok := written[s.ULID]; !ok {
+			res.Blocks = append(res.Blocks, s.blockInfo(BlockStateFlushing.String()))
+		}
+	}
+	sort.Slice(res.Blocks, func(i, j int) bool {
+		if res.Blocks[i].MinTime != res.Blocks[j].MinTime {
+			return res.Blocks[i].MinTime < res.Blocks[j].MinTime
+		}
+		return res.Blocks[i].Ulid < res.Blocks[j].Ulid
+	})
+	return connect.NewResponse(res), nil
+}
+
+func metaBlockInfo(m *block.Meta, state string) *ingestv1.BlockInfo {
+	var size uint64
+	for _, f := range m.Files {
+		size += f.SizeBytes
+	}
+	return &ingestv1.BlockInfo{
+		Ulid:        m.ULID.String(),
+		MinTime:     int64(m.MinTime),
+		MaxTime:     int64(m.MaxTime),
+		NumSeries:   m.Stats.NumSeries,
+		NumProfiles: m.Stats.NumProfiles,
+		NumSamples:  m.Stats.NumSamples,
+		Size:        size,
+		State:       state,
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -16,15 +17,16 @@ import (
 	"github.com/go-kit/log/level"
 	"github.com/gogo/status"
 	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/multierror"
 	"github.com/oklog/ulid"
 	"github.com/opentracing/opentracing-go"
 	otlog "github.com/opentracing/opentracing-go/log"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
-	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/samber/lo"
 	"github.com/segmentio/parquet-go"
+	"go.uber.org/atomic"
 	"golang.org/x/exp/constraints"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
@@ -52,6 +54,7 @@ type BlockQuerier struct {
 	logger    log.Logger
 
 	bucketReader phlareobjstore.BucketReader
+	fileCache    *block.FileCache
 
 	queriers     []*singleBlockQuerier
 	queriersLock sync.RWMutex
@@ -69,12 +72,18 @@ func NewBlockQuerier(phlarectx context.Context, bucketReader phlareobjstore.Buck
 	}
 }
 
+// SetFileCache sets the local cache of the files of the blocks, for the blocks read from a remote
+// bucket. It must be set before the blocks are synced.
+func (b *BlockQuerier) SetFileCache(c *block.FileCache) {
+	b.fileCache = c
+}
+
 // generates meta.json by opening block
 func (b *BlockQuerier) reconstructMetaFromBlock(ctx context.Context, ulid ulid.ULID) (metas *block.Meta, err error) {
 	fakeMeta := block.NewMeta()
 	fakeMeta.ULID = ulid
 
-	q := newSingleBlockQuerierFromMeta(b.phlarectx, b.bucketReader, fakeMeta)
+	q := newSingleBlockQuerierFromMeta(b.phlarectx, b.bucketReader, b.fileCache, fakeMeta)
 	defer q.Close()
 
 	meta, err := q.reconstructMeta(ctx)
@@ -95,6 +104,30 @@ func (b *BlockQuerier) Queriers() Queriers {
 	return res
 }
 
+// acquireQueriers returns the queriers of the blocks, which are not closed until the returned
+// function releases them, so a running query doesn't lose its blocks to the eviction.
+func (b *BlockQuerier) acquireQueriers() (Queriers, func()) {
+	b.queriersLock.RLock()
+	acquired := make([]*singleBlockQuerier, 0, len(b.queriers))
+	for _, q := range b.queriers {
+		q.acquire()
+		acquired = append(acquired, q)
+	}
+	b.queriersLock.RUnlock()
+
+	res := make([]Querier, 0, len(acquired))
+	for _, q := range acquired {
+		res = append(res, q)
+	}
+	return res, func() { releaseQueriers(acquired) }
+}
+
+func releaseQueriers(queriers []*singleBlockQuerier) {
+	for _, q := range queriers {
+		q.release()
+	}
+}
+
 func (b *BlockQuerier) BlockMetas(ctx context.Context) (metas []*block.Meta, _ error) {
 	var names []ulid.ULID
 	if err := b.bucketReader.Iter(ctx, "", func(n string) error {
@@ -206,7 +239,10 @@ func (b *BlockQuerier) Sync(ctx context.Context) error {
 			continue
 		}
 
-		b.queriers[pos] = newSingleBlockQuerierFromMeta(b.phlarectx, b.bucketReader, m)
+		if err := m.CheckVersion(); err != nil {
+			level.Warn(b.logger).Log("msg", "the queries of the block will fail", "block", m.ULID, "err", err)
+		}
+		b.queriers[pos] = newSingleBlockQuerierFromMeta(b.phlarectx, b.bucketReader, b.fileCache, m)
 	}
 	// ensure queriers are in ascending order.
 	sort.Slice(b.queriers, func(i, j int) bool {
@@ -215,7 +251,8 @@ func (b *BlockQuerier) Sync(ctx context.Context) error {
 	b.queriersLock.Unlock()
 
 	// now close no longer available queries
-	for _, q := range querierByULID {
+	for id, q := range querierByULID {
+		b.fileCache.Remove(id)
 		if err := q.Close(); err != nil {
 			return err
 		}
@@ -224,6 +261,72 @@ func (b *BlockQuerier) Sync(ctx context.Context) error {
 	return nil
 }
 
+// forget closes and removes the querier of the block, so the next Sync opens
+// the block again.
+func (b *BlockQuerier) forget(id ulid.ULID) error {
+	b.queriersLock.Lock()
+	var q *singleBlockQuerier
+	for pos := range b.queriers {
+		if b.queriers[pos].meta.ULID == id {
+			q = b.queriers[pos]
+			b.queriers = append(b.queriers[:pos], b.queriers[pos+1:]...)
+			break
+		}
+	}
+	b.queriersLock.Unlock()
+	if q == nil {
+		return nil
+	}
+	return q.Close()
+}
+
+// minBlockIdleBeforeEviction protects blocks from being closed by the memory
+// budget while they might still be used by a query.
+const minBlockIdleBeforeEviction = 5 * time.Minute
+
+// evictBlocks closes the opened blocks which have not been queried within the
+// idle timeout. If the opened blocks still exceed the memory budget, the least
+// recently queried ones are closed too. Closed blocks are opened again on
+// their next query.
+func (b *BlockQuerier) evictBlocks(now time.Time, idleTimeout time.Duration, maxOpenBytes int64) {
+	b.queriersLock.RLock()
+	defer b.queriersLock.RUnlock()
+
+	var (
+		opened    []*singleBlockQuerier
+		openBytes int64
+	)
+	for _, q := range b.queriers {
+		if !q.isOpened() {
+			continue
+		}
+		if idleTimeout > 0 && now.Sub(q.lastUsedAt()) >= idleTimeout && q.closeIfIdle(now, idleTimeout) {
+			continue
+		}
+		opened = append(opened, q)
+		openBytes += q.openSize()
+	}
+
+	if maxOpenBytes > 0 && openBytes > maxOpenBytes {
+		sort.Slice(opened, func(i, j int) bool {
+			return opened[i].lastUsedAt().Before(opened[j].lastUsedAt())
+		})
+		for _, q := range opened {
+			if openBytes <= maxOpenBytes {
+				break
+			}
+			if q.closeIfIdle(now, minBlockIdleBeforeEviction) {
+				openBytes -= q.openSize()
+			}
+		}
+	}
+	b.metrics().openBlocksBytes.Set(float64(openBytes))
+}
+
+func (b *BlockQuerier) metrics() *blocksMetrics {
+	return contextBlockMetrics(b.phlarectx)
+}
+
 func (b *BlockQuerier) Close() error {
 	b.queriersLock.Lock()
 	defer b.queriersLock.Unlock()
@@ -274,28 +377,54 @@ type singleBlockQuerier struct {
 	metrics *blocksMetrics
 
 	bucketReader phlareobjstore.BucketReader
+	fileCache    *block.FileCache
 	meta         *block.Meta
 
 	tables []tableReader
 
-	openLock    sync.Mutex
-	opened      bool
+	openLock sync.Mutex
+	opened   bool
+	lastUsed *atomic.Int64
+	// refs is the number of running queries using the block, which is not closed until they are
+	// done. closeOnRelease closes it once they are, when it was closed while in use.
+	refs           int
+	closeOnRelease bool
+
 	index       *index.Reader
+	postings    *postingsCache
 	strings     inMemoryparquetReader[*schemav1.StoredString, *schemav1.StringPersister]
 	functions   inMemoryparquetReader[*profilev1.Function, *schemav1.FunctionPersister]
 	locations   inMemoryparquetReader[*profilev1.Location, *schemav1.LocationPersister]
 	mappings    inMemoryparquetReader[*profilev1.Mapping, *schemav1.MappingPersister]
 	stacktraces parquetReader[*schemav1.Stacktrace, *schemav1.StacktracePersister]
 	profiles    parquetReader[*schemav1.Profile, *schemav1.ProfilePersister]
+
+	// stacktraceNodes caches the chunks of the stacktrace nodes read since the block was opened.
+	stacktraceChunksOnce sync.Once
+	stacktraceNodes      *stacktraceChunks
+
+	// histograms caches the histograms of the series read since the block was opened. They are
+	// read again after a failure, e.g. when the context of the query was canceled.
+	histogramsMtx sync.Mutex
+	histograms    map[model.Fingerprint][]*ingestv1.Histogram
+
+	// targetMetadata caches the metadata of the targets of the series read since the block was
+	// opened.
+	targetMetadataOnce sync.Once
+	targetMetadata     map[model.Fingerprint][]*typesv1.TargetMetadata
+	targetMetadataErr  error
 }
 
-func newSingleBlockQuerierFromMeta(phlarectx context.Context, bucketReader phlareobjstore.BucketReader, meta *block.Meta) *singleBlockQuerier {
+func newSingleBlockQuerierFromMeta(phlarectx context.Context, bucketReader phlareobjstore.BucketReader, fileCache *block.FileCache, meta *block.Meta) *singleBlockQuerier {
 	q := &singleBlockQuerier{
 		logger:  phlarecontext.Logger(phlarectx),
 		metrics: contextBlockMetrics(phlarectx),
 
-		bucketReader: phlareobjstore.BucketReaderWithPrefix(bucketReader, meta.ULID.String()),
+		bucketReader: fileCache.BucketReader(phlareobjstore.BucketReaderWithPrefix(bucketReader, meta.ULID.String()), meta),
+		fileCache:    fileCache,
 		meta:         meta,
+		lastUsed:     atomic.NewInt64(0),
+		postings:     newPostingsCache(),
 	}
 	q.tables = []tableReader{
 		&q.strings,
@@ -308,9 +437,47 @@ func newSingleBlockQuerierFromMeta(phlarectx context.Context, bucketReader phlar
 	return q
 }
 
+// Close closes the block, or once the running queries using it are done.
 func (b *singleBlockQuerier) Close() error {
 	b.openLock.Lock()
 	defer b.openLock.Unlock()
+	if b.refs > 0 {
+		b.closeOnRelease = true
+		return nil
+	}
+	return b.close()
+}
+
+// acquire marks the block as used by a query until release is called.
+func (b *singleBlockQuerier) acquire() {
+	b.openLock.Lock()
+	defer b.openLock.Unlock()
+	b.refs++
+}
+
+func (b *singleBlockQuerier) release() {
+	b.openLock.Lock()
+	defer b.openLock.Unlock()
+	b.refs--
+	if b.refs > 0 || !b.closeOnRelease {
+		return
+	}
+	b.closeOnRelease = false
+	if err := b.close(); err != nil {
+		level.Warn(b.logger).Log("msg", "failed to close block", "block", b.meta.ULID, "err", err)
+	}
+}
+
+func (b *singleBlockQuerier) close() error {
+	b.opened = false
+	b.stacktraceChunksOnce = sync.Once{}
+	b.stacktraceNodes = nil
+	b.histogramsMtx.Lock()
+	b.histograms = nil
+	b.histogramsMtx.Unlock()
+	b.targetMetadataOnce = sync.Once{}
+	b.targetMetadata, b.targetMetadataErr = nil, nil
+	b.postings = newPostingsCache()
 	errs := multierror.New()
 	if b.index != nil {
 		err := b.index.Close()
@@ -355,16 +522,18 @@ func (b *singleBlockQuerier) reconstructMeta(ctx context.Context) (*block.Meta,
 		return files[i].RelPath < files[j].RelPath
 	})
 
-	return &block.Meta{
+	meta := &block.Meta{
 		ULID:    b.meta.ULID,
 		MinTime: tsBoundary.min,
 		MaxTime: tsBoundary.max,
-		Version: block.MetaVersion1,
+		Version: b.stacktracesVersion(),
 		Stats: block.BlockStats{
 			NumProfiles: profilesInfo.Parquet.NumRows,
 		},
 		Files: files,
-	}, nil
+	}
+	meta.SetQueryStats()
+	return meta, nil
 }
 
 type mapPredicate[K constraints.Integer, V any] struct {
@@ -434,8 +603,24 @@ type Querier interface {
 	InRange(start, end model.Time) bool
 	SelectMatchingProfiles(ctx context.Context, params *ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], error)
 	MergeByStacktraces(ctx context.Context, rows iter.Iterator[Profile]) (*ingestv1.MergeProfilesStacktracesResult, error)
+	// MergeByStacktracesGroups is like MergeByStacktraces but merges the profiles of each of the n
+	// groups, reading their samples and resolving their symbols once.
+	MergeByStacktracesGroups(ctx context.Context, rows iter.Iterator[Profile], groups profileGroups, n int) ([]*ingestv1.MergeProfilesStacktracesResult, error)
 	MergeByLabels(ctx context.Context, rows iter.Iterator[Profile], by ...string) ([]*typesv1.Series, error)
+	// MergeFunctionByLabels is like MergeByLabels but only sums the samples selected by the function selector.
+	MergeFunctionByLabels(ctx context.Context, rows iter.Iterator[Profile], fn FunctionSelector, by ...string) ([]*typesv1.Series, error)
 	MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error)
+	// SelectHistograms returns the histograms of the profile totals of the matching series, and
+	// false when the querier doesn't store them.
+	SelectHistograms(ctx context.Context, params *ingestv1.SelectHistogramsRequest) ([]*ingestv1.SeriesHistograms, bool, error)
+	// SelectTargetMetadata returns the metadata of the targets of the matching series seen in the
+	// time range.
+	SelectTargetMetadata(ctx context.Context, params *ingestv1.SelectTargetMetadataRequest) ([]*ingestv1.SeriesTargetMetadata, error)
+	// ProfileIDs returns the IDs of the profiles, in the order of the rows.
+	ProfileIDs(ctx context.Context, rows iter.Iterator[Profile]) ([]uuid.UUID, error)
+	// SelectProfileByID returns the rows of the profile with the ID, one per sample type, among
+	// the series of the profile name in the time range.
+	SelectProfileByID(ctx context.Context, name string, id uuid.UUID, start, end model.Time) ([]Profile, error)
 
 	// Sorts profiles for retrieval.
 	Sort([]Profile) []Profile
@@ -470,6 +655,9 @@ func (queriers Queriers) ForTimeRange(start, end model.Time) Queriers {
 func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeProfilesStacktraces")
 	defer sp.Finish()
+	reads := &query.ReadStats{}
+	ctx = query.AddReadStatsToContext(ctx, reads)
+	defer reads.SetSpanTags(sp)
 
 	r, err := stream.Receive()
 	if err != nil {
@@ -479,6 +667,9 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		return err
 	}
 
+	if len(r.Requests) > 0 {
+		return q.mergeProfilesStacktracesGroups(ctx, stream, r.Requests)
+	}
 	if r.Request == nil {
 		return connect.NewError(connect.CodeInvalidArgument, errors.New("missing initial select request"))
 	}
@@ -489,12 +680,20 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		otlog.String("selector", request.LabelSelector),
 		otlog.String("profile_id", request.Type.ID),
 	)
+	capture := queryCaptureFromContext(ctx)
+	capture.setRequest(QueryCaptureMergeStacktraces, request, nil, false)
 
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
 
 	result := make([]*ingestv1.MergeProfilesStacktracesResult, 0, len(queriers))
-	var lock sync.Mutex
+	var (
+		lock sync.Mutex
+		// units holds the profiles to sample once they are all selected.
+		units    []samplingUnit
+		sampling = r.SamplingFraction > 0 && r.SamplingFraction < 1
+	)
 	g, ctx := errgroup.WithContext(ctx)
+	merges := newMergeScheduler(g, mergeBudget)
 
 	// Start streaming profiles from all stores in order.
 	// This allows the client to dedupe in order.
@@ -514,9 +713,14 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 		}
 		// Sort profiles for better read locality.
 		selectedProfiles = q.Sort(selectedProfiles)
+		capture.addBlock(q, selectedProfiles)
+		if sampling {
+			units = append(units, samplingUnits(q, selectedProfiles)...)
+			continue
+		}
 		// Merge async the result so we can continue streaming profiles.
-		g.Go(func() error {
-			merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(selectedProfiles))
+		merges.schedule(q, selectedProfiles, func(profiles []Profile) error {
+			merge, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(profiles))
 			if err != nil {
 				return err
 			}
@@ -526,6 +730,23 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 			return nil
 		})
 	}
+	if sampling {
+		for _, u := range sampleUnits(units, r.SamplingFraction, newSamplingRand(request)) {
+			u := u
+			// the units are not sharded, the variance is estimated from their whole merge.
+			merges.add(estimateMergeCost(u.querier, len(u.profiles)).total(), func() error {
+				merge, err := u.querier.MergeByStacktraces(ctx, iter.NewSliceIterator(u.profiles))
+				if err != nil {
+					return err
+				}
+				merge.TotalVariance = scaleStacktraces(merge, u.probability)
+				lock.Lock()
+				defer lock.Unlock()
+				result = append(result, merge)
+				return nil
+			})
+		}
+	}
 
 	// Signals the end of the profile streaming by sending an empty response.
 	// This allows the client to not block other streaming ingesters.
@@ -554,6 +775,9 @@ func (q Queriers) MergeProfilesStacktraces(ctx context.Context, stream *connect.
 func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeProfilesLabels")
 	defer sp.Finish()
+	reads := &query.ReadStats{}
+	ctx = query.AddReadStatsToContext(ctx, reads)
+	defer reads.SetSpanTags(sp)
 
 	r, err := stream.Receive()
 	if err != nil {
@@ -575,11 +799,23 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 		otlog.String("selector", request.LabelSelector),
 		otlog.String("profile_id", request.Type.ID),
 		otlog.String("by", strings.Join(by, ",")),
+		otlog.String("function", r.Function),
+		otlog.String("stack", strings.Join(r.Stack, ";")),
 	)
+	fn := FunctionSelector{Stack: r.Stack}
+	if r.Function != "" {
+		if fn.Name, err = regexp.Compile("^(?:" + r.Function + ")$"); err != nil {
+			return connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		fn.Total = r.FunctionTotal
+	}
+	capture := queryCaptureFromContext(ctx)
+	capture.setRequest(QueryCaptureMergeLabels, request, by, fn.selects())
 
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
 	result := make([][]*typesv1.Series, 0, len(queriers))
 	g, ctx := errgroup.WithContext(ctx)
+	merges := newMergeScheduler(g, mergeBudget)
 	s := lo.Synchronize()
 	// Start streaming profiles from all stores in order.
 	// This allows the client to dedupe in order.
@@ -599,9 +835,18 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 		}
 		// Sort profiles for better read locality.
 		selectedProfiles = q.Sort(selectedProfiles)
+		capture.addBlock(q, selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
-		g.Go(func() error {
-			merge, err := q.MergeByLabels(ctx, iter.NewSliceIterator(selectedProfiles), by...)
+		merges.schedule(q, selectedProfiles, func(profiles []Profile) error {
+			var (
+				merge []*typesv1.Series
+				err   error
+			)
+			if fn.selects() {
+				merge, err = q.MergeFunctionByLabels(ctx, iter.NewSliceIterator(profiles), fn, by...)
+			} else {
+				merge, err = q.MergeByLabels(ctx, iter.NewSliceIterator(profiles), by...)
+			}
 			if err != nil {
 				return err
 			}
@@ -640,6 +885,9 @@ func (q Queriers) MergeProfilesLabels(ctx context.Context, stream *connect.BidiS
 func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesPprofRequest, ingestv1.MergeProfilesPprofResponse]) error {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeProfilesPprof")
 	defer sp.Finish()
+	reads := &query.ReadStats{}
+	ctx = query.AddReadStatsToContext(ctx, reads)
+	defer reads.SetSpanTags(sp)
 
 	r, err := stream.Receive()
 	if err != nil {
@@ -659,12 +907,15 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 		otlog.String("selector", request.LabelSelector),
 		otlog.String("profile_id", request.Type.ID),
 	)
+	capture := queryCaptureFromContext(ctx)
+	capture.setRequest(QueryCaptureMergePprof, request, nil, false)
 
 	queriers := q.ForTimeRange(model.Time(request.Start), model.Time(request.End))
 
 	result := make([]*profile.Profile, 0, len(queriers))
 	var lock sync.Mutex
 	g, ctx := errgroup.WithContext(ctx)
+	merges := newMergeScheduler(g, mergeBudget)
 
 	// Start streaming profiles from all stores in order.
 	// This allows the client to dedupe in order.
@@ -684,9 +935,10 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 		}
 		// Sort profiles for better read locality.
 		selectedProfiles = q.Sort(selectedProfiles)
+		capture.addBlock(q, selectedProfiles)
 		// Merge async the result so we can continue streaming profiles.
-		g.Go(func() error {
-			merge, err := q.MergePprof(ctx, iter.NewSliceIterator(selectedProfiles))
+		merges.schedule(q, selectedProfiles, func(profiles []Profile) error {
+			merge, err := q.MergePprof(ctx, iter.NewSliceIterator(profiles))
 			if err != nil {
 				return err
 			}
@@ -707,18 +959,7 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 		return err
 	}
 	for _, p := range result {
-		p.SampleType = []*profile.ValueType{{Type: r.Request.Type.SampleType, Unit: r.Request.Type.SampleUnit}}
-		p.DefaultSampleType = r.Request.Type.SampleType
-		p.PeriodType = &profile.ValueType{Type: r.Request.Type.PeriodType, Unit: r.Request.Type.PeriodUnit}
-		p.TimeNanos = model.Time(r.Request.Start).UnixNano()
-		switch r.Request.Type.Name {
-		case "process_cpu":
-			p.Period = 1000000000
-		case "memory":
-			p.Period = 512 * 1024
-		default:
-			p.Period = 1
-		}
+		setPprofType(p, r.Request.Type, model.Time(r.Request.Start))
 	}
 	p, err := profile.Merge(result)
 	if err != nil {
@@ -744,6 +985,22 @@ func (q Queriers) MergeProfilesPprof(ctx context.Context, stream *connect.BidiSt
 	return nil
 }
 
+// setPprofType sets the sample and period types of a profile rebuilt from the stored samples.
+func setPprofType(p *profile.Profile, t *typesv1.ProfileType, ts model.Time) {
+	p.SampleType = []*profile.ValueType{{Type: t.SampleType, Unit: t.SampleUnit}}
+	p.DefaultSampleType = t.SampleType
+	p.PeriodType = &profile.ValueType{Type: t.PeriodType, Unit: t.PeriodUnit}
+	p.TimeNanos = ts.UnixNano()
+	switch t.Name {
+	case "process_cpu":
+		p.Period = 1000000000
+	case "memory":
+		p.Period = 512 * 1024
+	default:
+		p.Period = 1
+	}
+}
+
 type BlockProfile struct {
 	labels phlaremodel.Labels
 	fp     model.Fingerprint
@@ -773,13 +1030,13 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 	if err := b.open(ctx); err != nil {
 		return nil, err
 	}
-	matchers, err := parser.ParseMetricSelector(params.LabelSelector)
+	matchers, err := phlaremodel.ParseSelector(params.LabelSelector)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
 	}
 	matchers = append(matchers, phlaremodel.SelectorFromProfileType(params.Type))
 
-	postings, err := PostingsForMatchers(b.index, nil, matchers...)
+	postings, err := b.postings.postingsForMatchers(b.index, b.metrics, matchers...)
 	if err != nil {
 		return nil, err
 	}
@@ -844,6 +1101,9 @@ func (b *singleBlockQuerier) SelectMatchingProfiles(ctx context.Context, params
 	if len(currentSeriesSlice) > 0 {
 		iters = append(iters, iter.NewSliceIterator(currentSeriesSlice))
 	}
+	if err := pIt.Err(); err != nil {
+		return nil, err
+	}
 
 	return iter.NewSortProfileIterator(iters), nil
 }
@@ -923,28 +1183,19 @@ func (q *singleBlockQuerier) readTSBoundaries(ctx context.Context) (minMax, []mi
 	return tsBoundary, tsBoundaryPerRowGroup, nil
 }
 
-func newByteSliceFromBucketReader(ctx context.Context, bucketReader phlareobjstore.BucketReader, path string) (index.RealByteSlice, error) {
-	f, err := bucketReader.Get(ctx, path)
-	if err != nil {
-		return nil, err
-	}
-
-	data, err := io.ReadAll(f)
-	if err != nil {
-		return nil, err
-	}
-
-	return index.RealByteSlice(data), nil
-}
-
 func (q *singleBlockQuerier) open(ctx context.Context) error {
 	q.openLock.Lock()
 	defer q.openLock.Unlock()
+	q.lastUsed.Store(time.Now().UnixNano())
 
 	// already open
 	if q.opened {
 		return nil
 	}
+	// the blocks of unsupported formats are listed, but refused when they are queried.
+	if err := q.meta.CheckVersion(); err != nil {
+		return connect.NewError(connect.CodeFailedPrecondition, err)
+	}
 	if err := q.openFiles(ctx); err != nil {
 		return err
 	}
@@ -952,6 +1203,43 @@ func (q *singleBlockQuerier) open(ctx context.Context) error {
 	return nil
 }
 
+func (q *singleBlockQuerier) isOpened() bool {
+	q.openLock.Lock()
+	defer q.openLock.Unlock()
+	return q.opened
+}
+
+func (q *singleBlockQuerier) lastUsedAt() time.Time {
+	return time.Unix(0, q.lastUsed.Load())
+}
+
+// closeIfIdle closes the block if it is opened, not used by a running query, and has not been
+// used for the given duration.
+func (q *singleBlockQuerier) closeIfIdle(now time.Time, idle time.Duration) bool {
+	q.openLock.Lock()
+	defer q.openLock.Unlock()
+	if !q.opened || q.refs > 0 || now.Sub(q.lastUsedAt()) < idle {
+		return false
+	}
+	if err := q.close(); err != nil {
+		level.Warn(q.logger).Log("msg", "failed to close idle block", "block", q.meta.ULID, "err", err)
+	}
+	q.metrics.blockEvictions.Inc()
+	return true
+}
+
+// openSize returns the size of the files kept in memory once the block is opened.
+func (q *singleBlockQuerier) openSize() int64 {
+	var size uint64
+	for _, f := range q.meta.Files {
+		switch f.RelPath {
+		case block.IndexFilename, q.strings.relPath(), q.functions.relPath(), q.locations.relPath(), q.mappings.relPath():
+			size += f.SizeBytes
+		}
+	}
+	return int64(size)
+}
+
 // openFiles opens the parquet and tsdb files so they are ready for usage.
 func (q *singleBlockQuerier) openFiles(ctx context.Context) error {
 	start := time.Now()
@@ -965,13 +1253,17 @@ func (q *singleBlockQuerier) openFiles(ctx context.Context) error {
 	}()
 	g, ctx := errgroup.WithContext(ctx)
 	g.Go(func() error {
-		// open tsdb index
-		indexBytes, err := newByteSliceFromBucketReader(ctx, q.bucketReader, block.IndexFilename)
+		// open tsdb index, verified against its checksums while it is downloaded.
+		indexFile := q.meta.FileByRelPath(block.IndexFilename)
+		if indexFile == nil {
+			indexFile = &block.File{RelPath: block.IndexFilename}
+		}
+		indexBytes, err := q.fileCache.ReadFile(ctx, q.bucketReader, q.meta.ULID, indexFile)
 		if err != nil {
 			return errors.Wrap(err, "error reading tsdb index")
 		}
 
-		q.index, err = index.NewReader(indexBytes)
+		q.index, err = index.NewReader(index.RealByteSlice(indexBytes))
 		if err != nil {
 			return errors.Wrap(err, "opening tsdb index")
 		}
@@ -1129,6 +1421,7 @@ func (r *inMemoryparquetReader[M, P]) NumRows() int64 {
 }
 
 func (r *inMemoryparquetReader[M, P]) Close() error {
+	r.cache = nil
 	if r.reader != nil {
 		return r.reader.Close()
 	}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/require"
@@ -55,3 +56,64 @@ func TestInMemoryReader(t *testing.T) {
 		j++
 	}
 }
+
+func TestBlockQuerier_evictBlocks(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		testDir = t.TempDir()
+		end     = time.Unix(0, int64(time.Hour))
+		start   = end.Add(-time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         testDir,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 15*time.Second)
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	q := db.blockQuerier.queriers[0]
+	require.False(t, q.isOpened())
+	require.Greater(t, q.openSize(), int64(0))
+
+	open := func() {
+		_, _, err := q.readTSBoundaries(ctx)
+		require.NoError(t, err)
+		require.True(t, q.isOpened())
+	}
+
+	// idle timeout
+	open()
+	db.blockQuerier.evictBlocks(time.Now(), time.Hour, 0)
+	require.True(t, q.isOpened())
+	db.blockQuerier.evictBlocks(time.Now().Add(2*time.Hour), time.Hour, 0)
+	require.False(t, q.isOpened())
+
+	// memory budget, recently used blocks are kept open
+	open()
+	db.blockQuerier.evictBlocks(time.Now(), 0, 1)
+	require.True(t, q.isOpened())
+	db.blockQuerier.evictBlocks(time.Now().Add(minBlockIdleBeforeEviction), 0, q.openSize())
+	require.True(t, q.isOpened())
+	db.blockQuerier.evictBlocks(time.Now().Add(minBlockIdleBeforeEviction), 0, 1)
+	require.False(t, q.isOpened())
+
+	// blocks used by a running query are kept open, and closed once released if they were closed
+	// meanwhile.
+	open()
+	_, release := db.blockQuerier.acquireQueriers()
+	db.blockQuerier.evictBlocks(time.Now().Add(2*time.Hour), time.Hour, 1)
+	require.True(t, q.isOpened())
+	require.NoError(t, q.Close())
+	require.True(t, q.isOpened())
+	release()
+	require.False(t, q.isOpened())
+
+	// closed blocks are opened again on the next query
+	open()
+}
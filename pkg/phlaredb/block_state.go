@@ -0,0 +1,186 @@
+package phlaredb
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/grafana/phlare/pkg/phlaredb/shipper"
+)
+
+// BlockState is the state of a block written by the ingester, from the cut of its head until its
+// local copy is no longer needed to answer the queries.
+type BlockState int
+
+const (
+	// BlockStateFlushing is a cut head being written to disk. It is queried as a head until its
+	// block is loaded.
+	BlockStateFlushing BlockState = iota
+	// BlockStateLocal is a block written to the local disk and not uploaded yet.
+	BlockStateLocal
+	// BlockStateUploaded is a block uploaded to the bucket, which might not be visible to the
+	// readers of the bucket yet.
+	BlockStateUploaded
+	// BlockStateRemote is a block visible to the readers of the bucket. Its local copy can be
+	// deleted.
+	BlockStateRemote
+)
+
+func (s BlockState) String() string {
+	switch s {
+	case BlockStateFlushing:
+		return "flushing"
+	case BlockStateLocal:
+		return "local"
+	case BlockStateUploaded:
+		return "uploaded"
+	case BlockStateRemote:
+		return "remote"
+	default:
+		return "unknown"
+	}
+}
+
+var blockStates = []BlockState{BlockStateFlushing, BlockStateLocal, BlockStateUploaded, BlockStateRemote}
+
+type blockStateEntry struct {
+	state BlockState
+	since time.Time
+}
+
+// blockStateTracker tracks the state transitions of the blocks. Without uploads, the local blocks
+// are the only copy and their state ends at local.
+type blockStateTracker struct {
+	logger log.Logger
+	// uploads is whether the blocks are uploaded to a bucket.
+	uploads bool
+	// visibilityDelay is how long an uploaded block takes to be visible to the readers of the bucket.
+	visibilityDelay time.Duration
+	blocks          *prometheus.GaugeVec
+
+	mtx    sync.Mutex
+	states map[ulid.ULID]blockStateEntry
+}
+
+func newBlockStateTracker(logger log.Logger, reg prometheus.Registerer, uploads bool, visibilityDelay time.Duration) *blockStateTracker {
+	t := &blockStateTracker{
+		logger:          logger,
+		uploads:         uploads,
+		visibilityDelay: visibilityDelay,
+		blocks: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Name: "phlaredb_blocks",
+			Help: "Number of blocks of the ingester by state: flushing, local, uploaded or remote.",
+		}, []string{"state"}),
+		states: make(map[ulid.ULID]blockStateEntry),
+	}
+	for _, s := range blockStates {
+		t.blocks.WithLabelValues(s.String())
+	}
+	return t
+}
+
+// get returns the state of the block, with the time it has been in that state.
+func (t *blockStateTracker) get(id ulid.ULID, now time.Time) (BlockState, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.promoteLocked(id, now)
+	e, ok := t.states[id]
+	return e.state, ok
+}
+
+// set moves the block to the state. The blocks never move back to a previous state.
+func (t *blockStateTracker) set(id ulid.ULID, state BlockState, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.setLocked(id, state, now)
+}
+
+func (t *blockStateTracker) setLocked(id ulid.ULID, state BlockState, now time.Time) {
+	e, ok := t.states[id]
+	if ok {
+		if e.state >= state {
+			return
+		}
+		t.blocks.WithLabelValues(e.state.String()).Dec()
+	}
+	t.states[id] = blockStateEntry{state: state, since: now}
+	t.blocks.WithLabelValues(state.String()).Inc()
+	level.Debug(t.logger).Log("msg", "block state changed", "block", id, "state", state)
+}
+
+// remove forgets the block, once deleted or when its head could not be written.
+func (t *blockStateTracker) remove(id ulid.ULID) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if e, ok := t.states[id]; ok {
+		t.blocks.WithLabelValues(e.state.String()).Dec()
+		delete(t.states, id)
+	}
+}
+
+// promoteLocked moves an uploaded block to remote once the visibility delay has elapsed.
+func (t *blockStateTracker) promoteLocked(id ulid.ULID, now time.Time) {
+	e, ok := t.states[id]
+	if ok && e.state == BlockStateUploaded && now.Sub(e.since) >= t.visibilityDelay {
+		t.setLocked(id, BlockStateRemote, now)
+	}
+}
+
+// sync reconciles the states with the local blocks and the blocks recorded as uploaded by the
+// shipper in the local directory, which are not notified after a restart. The upload time of
+// those is unknown, so they wait for the visibility delay again.
+func (t *blockStateTracker) sync(localPath string, ids []ulid.ULID, now time.Time) {
+	var uploaded map[ulid.ULID]struct{}
+	if t.uploads {
+		meta, err := shipper.ReadMetaFile(localPath)
+		if err != nil && !os.IsNotExist(err) {
+			level.Warn(t.logger).Log("msg", "unable to read the uploaded blocks", "err", err)
+		}
+		if meta != nil {
+			uploaded = make(map[ulid.ULID]struct{}, len(meta.Uploaded))
+			for _, id := range meta.Uploaded {
+				uploaded[id] = struct{}{}
+			}
+		}
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	local := make(map[ulid.ULID]struct{}, len(ids))
+	for _, id := range ids {
+		local[id] = struct{}{}
+		t.setLocked(id, BlockStateLocal, now)
+		if _, ok := uploaded[id]; ok {
+			t.setLocked(id, BlockStateUploaded, now)
+		}
+		t.promoteLocked(id, now)
+	}
+	for id, e := range t.states {
+		if _, ok := local[id]; !ok && e.state != BlockStateFlushing {
+			t.blocks.WithLabelValues(e.state.String()).Dec()
+			delete(t.states, id)
+		}
+	}
+}
+
+// deletable returns whether the local copy of the block can be deleted without losing data for
+// the queries: once it is visible in the bucket, or at any time when the blocks aren't uploaded.
+func (t *blockStateTracker) deletable(id ulid.ULID, now time.Time) bool {
+	if !t.uploads {
+		return true
+	}
+	state, ok := t.get(id, now)
+	return ok && state == BlockStateRemote
+}
+
+// uploaded returns whether the block has been uploaded to the bucket, visible or not yet.
+func (t *blockStateTracker) uploaded(id ulid.ULID, now time.Time) bool {
+	state, ok := t.get(id, now)
+	return ok && (state == BlockStateUploaded || state == BlockStateRemote)
+}
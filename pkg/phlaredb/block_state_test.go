@@ -0,0 +1,127 @@
+package phlaredb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/oklog/ulid"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/phlaredb/shipper"
+)
+
+func TestBlockStateTracker(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		now     = time.Now()
+		tracker = newBlockStateTracker(log.NewNopLogger(), nil, true, time.Minute)
+		a       = ulid.MustNew(1, nil)
+		b       = ulid.MustNew(2, nil)
+		c       = ulid.MustNew(3, nil)
+	)
+
+	tracker.set(a, BlockStateFlushing, now)
+	tracker.set(a, BlockStateLocal, now)
+	require.False(t, tracker.deletable(a, now))
+	tracker.set(a, BlockStateUploaded, now)
+	// the blocks never move back.
+	tracker.set(a, BlockStateLocal, now)
+	state, ok := tracker.get(a, now)
+	require.True(t, ok)
+	require.Equal(t, BlockStateUploaded, state)
+	require.False(t, tracker.deletable(a, now.Add(30*time.Second)))
+	require.True(t, tracker.deletable(a, now.Add(time.Minute)))
+
+	// the blocks uploaded before a restart are read from the shipper meta.
+	require.NoError(t, shipper.WriteMetaFile(log.NewNopLogger(), dir, &shipper.Meta{Version: shipper.MetaVersion1, Uploaded: []ulid.ULID{b}}))
+	tracker.set(c, BlockStateFlushing, now)
+	tracker.sync(dir, []ulid.ULID{b}, now)
+	_, ok = tracker.get(a, now)
+	require.False(t, ok, "deleted blocks are forgotten")
+	state, _ = tracker.get(b, now)
+	require.Equal(t, BlockStateUploaded, state)
+	state, _ = tracker.get(c, now)
+	require.Equal(t, BlockStateFlushing, state, "flushing heads are not listed yet")
+	state, _ = tracker.get(b, now.Add(time.Minute))
+	require.Equal(t, BlockStateRemote, state)
+
+	// without uploads, the local blocks are the only copy and can always be deleted.
+	tracker = newBlockStateTracker(log.NewNopLogger(), nil, false, time.Minute)
+	tracker.sync(dir, []ulid.ULID{b}, now)
+	state, _ = tracker.get(b, now)
+	require.Equal(t, BlockStateLocal, state)
+	require.True(t, tracker.deletable(b, now))
+}
+
+func TestPhlareDB_QueryWhileFlushing(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		end   = time.Unix(0, int64(time.Hour))
+		start = end.Add(-time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:              t.TempDir(),
+		MaxBlockDuration:      time.Duration(100000) * time.Minute, // we will manually flush
+		UploadBlocks:          true,
+		RemoteVisibilityDelay: time.Hour,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 15*time.Second)
+	id := db.Head().meta.ULID
+
+	countProfiles := func(queriers Queriers) int {
+		profiles, err := queriers.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         start.UnixMilli(),
+			End:           end.UnixMilli(),
+		})
+		require.NoError(t, err)
+		selected, err := iter.Slice(profiles)
+		require.NoError(t, err)
+		return len(selected)
+	}
+
+	// a query running while the head is cut.
+	queriers, release := db.queriers()
+	expected := countProfiles(queriers)
+	require.Equal(t, 5, expected)
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- db.Flush(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		state, _ := db.BlockState(id)
+		return state == BlockStateFlushing
+	}, time.Second, 10*time.Millisecond)
+
+	// the cut head is still queried, and not flushed under the running query.
+	select {
+	case err := <-flushed:
+		t.Fatalf("head flushed while queried: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.Equal(t, expected, countProfiles(queriers))
+	release()
+	require.NoError(t, <-flushed)
+
+	// once flushed, only its block is queried.
+	queriers, release = db.queriers()
+	defer release()
+	require.Equal(t, expected, countProfiles(queriers))
+	state, ok := db.BlockState(id)
+	require.True(t, ok)
+	require.Equal(t, BlockStateLocal, state)
+
+	db.BlockUploaded(id)
+	state, _ = db.BlockState(id)
+	require.Equal(t, BlockStateUploaded, state)
+}
@@ -0,0 +1,162 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/go-kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/segmentio/parquet-go"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+// RewriteBlockVersion rewrites the local block in the given format version, so the blocks of a
+// new format can be read by the components not upgraded yet, or the blocks of an old format
+// benefit from the new one. Only the stacktraces differ between the versions, the other files
+// are linked into the rewritten block. It returns false if the block is already in the version.
+func RewriteBlockVersion(ctx context.Context, logger log.Logger, blockPath string, version block.MetaVersion) (changed bool, err error) {
+	if version < block.MetaVersion1 || version > block.MaxSupportedVersion {
+		return false, fmt.Errorf("block format version must be between 1 and %d", block.MaxSupportedVersion)
+	}
+	meta, err := block.ReadFromDir(blockPath)
+	if err != nil {
+		return false, err
+	}
+	if err := meta.CheckVersion(); err != nil {
+		return false, err
+	}
+
+	stacktracesFile := (&schemav1.StacktracePersister{}).Name() + block.ParquetSuffix
+	stacktraces, current, err := readStacktraces(filepath.Join(blockPath, stacktracesFile))
+	if err != nil {
+		return false, errors.Wrap(err, "read stacktraces")
+	}
+	if current == version && meta.Version == version {
+		return false, nil
+	}
+
+	tmpPath := blockPath + ".rewrite"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(tmpPath, defaultFolderMode); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpPath)
+		}
+	}()
+
+	entries, err := os.ReadDir(blockPath)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case stacktracesFile, block.MetaFilename:
+			continue
+		}
+		if err := os.Link(filepath.Join(blockPath, e.Name()), filepath.Join(tmpPath, e.Name())); err != nil {
+			return false, err
+		}
+	}
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	numRows, numRowGroups, err := writeStacktraces(filepath.Join(tmpPath, stacktracesFile), stacktraces, version)
+	if err != nil {
+		return false, errors.Wrap(err, "write stacktraces")
+	}
+
+	newMeta := *meta
+	newMeta.Version = version
+	newMeta.Files = append([]block.File(nil), meta.Files...)
+	for i, f := range newMeta.Files {
+		if f.RelPath != stacktracesFile {
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(tmpPath, f.RelPath))
+		if err != nil {
+			return false, err
+		}
+		newMeta.Files[i].SizeBytes = uint64(stat.Size())
+		newMeta.Files[i].Parquet = &block.ParquetFile{NumRows: numRows, NumRowGroups: numRowGroups}
+	}
+	newMeta.SetQueryStats()
+	if _, err := newMeta.WriteToFile(logger, tmpPath); err != nil {
+		return false, err
+	}
+	if err := fileutil.Replace(tmpPath, blockPath); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readStacktraces reads the locations of the stacktraces of the file, indexed by their ID, and
+// the format version they are stored in. The nodes of version 2 are all read as stacktraces,
+// those only referenced as the callers of other stacktraces included.
+func readStacktraces(path string) ([]*schemav1.Stacktrace, block.MetaVersion, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := parquet.OpenFile(f, stat.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	chunks := newStacktraceChunks(file)
+	if chunks == nil {
+		stacktraces, err := (&schemav1.ReadWriter[*schemav1.Stacktrace, *schemav1.StacktracePersister]{}).ReadParquetFile(f)
+		return stacktraces, block.MetaVersion1, err
+	}
+	stacktraces := make([]*schemav1.Stacktrace, file.NumRows())
+	for id := range stacktraces {
+		locations, err := chunks.locations(int64(id))
+		if err != nil {
+			return nil, 0, err
+		}
+		stacktraces[id] = &schemav1.Stacktrace{LocationIDs: locations}
+	}
+	return stacktraces, block.MetaVersion2, nil
+}
+
+func writeStacktraces(path string, stacktraces []*schemav1.Stacktrace, version block.MetaVersion) (numRows, numRowGroups uint64, err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	if version == block.MetaVersion1 {
+		if err := (&schemav1.ReadWriter[*schemav1.Stacktrace, *schemav1.StacktracePersister]{}).WriteParquetFile(f, stacktraces); err != nil {
+			return 0, 0, err
+		}
+		return uint64(len(stacktraces)), 1, nil
+	}
+
+	nodes := schemav1.NewStacktraceNodes(stacktraces)
+	w := parquet.NewWriter(f, (&schemav1.StacktraceNodePersister{}).Schema())
+	if numRowGroups, err = writeStacktraceNodes(w, nodes, defaultParquetConfig.MaxBufferRowCount); err != nil {
+		return 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(nodes)), numRowGroups, nil
+}
@@ -0,0 +1,144 @@
+package phlaredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+func TestRewriteBlockVersion(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		end   = time.Unix(0, int64(time.Hour))
+		start = end.Add(-time.Minute)
+	)
+	for _, version := range []block.MetaVersion{block.MetaVersion1, block.MetaVersion2} {
+		version := version
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			db, err := New(ctx, Config{
+				DataPath:           t.TempDir(),
+				MaxBlockDuration:   time.Duration(100000) * time.Minute, // we will manually flush
+				BlockFormatVersion: int(version),
+			}, NoLimit)
+			require.NoError(t, err)
+			defer func() {
+				require.NoError(t, db.Close())
+			}()
+			ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 15*time.Second)
+			require.NoError(t, db.Flush(ctx))
+
+			merge := func() (*ingestv1.MergeProfilesStacktracesResult, block.MetaVersion) {
+				require.NoError(t, db.blockQuerier.Sync(ctx))
+				require.Len(t, db.blockQuerier.queriers, 1)
+				q := db.blockQuerier.queriers[0]
+				profiles, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+					LabelSelector: `{}`,
+					Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+					Start:         start.UnixMilli(),
+					End:           end.UnixMilli(),
+				})
+				require.NoError(t, err)
+				selected, err := iter.Slice(profiles)
+				require.NoError(t, err)
+				result, err := q.MergeByStacktraces(ctx, iter.NewSliceIterator(q.Sort(selected)))
+				require.NoError(t, err)
+				require.NotEmpty(t, result.Stacktraces)
+				require.Equal(t, q.meta.Version, q.stacktracesVersion())
+				return result, q.meta.Version
+			}
+			expected, written := merge()
+			require.Equal(t, version, written)
+
+			blockPath := filepath.Join(db.LocalDataPath(), db.blockQuerier.queriers[0].meta.ULID.String())
+			other := block.MetaVersion2
+			if version == block.MetaVersion2 {
+				other = block.MetaVersion1
+			}
+			for _, v := range []block.MetaVersion{other, version} {
+				changed, err := RewriteBlockVersion(ctx, db.logger, blockPath, v)
+				require.NoError(t, err)
+				require.True(t, changed)
+				db.forgetBlock(db.blockQuerier.queriers[0].meta.ULID)
+
+				actual, rewritten := merge()
+				require.Equal(t, v, rewritten)
+				// the stacktraces are renumbered, only their order differs.
+				require.Equal(t, stacktraceValues(expected), stacktraceValues(actual))
+			}
+
+			changed, err := RewriteBlockVersion(ctx, db.logger, blockPath, version)
+			require.NoError(t, err)
+			require.False(t, changed)
+		})
+	}
+}
+
+// stacktraceValues returns the values of the merge by their function names.
+func stacktraceValues(merge *ingestv1.MergeProfilesStacktracesResult) map[string]int64 {
+	values := make(map[string]int64, len(merge.Stacktraces))
+	for _, st := range merge.Stacktraces {
+		names := make([]string, len(st.FunctionIds))
+		for i, id := range st.FunctionIds {
+			names[i] = merge.FunctionNames[id]
+		}
+		values[strings.Join(names, ";")] += st.Value
+	}
+	return values
+}
+
+func TestBlockQuerier_UnsupportedVersion(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		end   = time.Unix(0, int64(time.Hour))
+		start = end.Add(-time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 15*time.Second)
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	id := db.blockQuerier.queriers[0].meta.ULID
+
+	// a block written by a more recent version.
+	blockPath := filepath.Join(db.LocalDataPath(), id.String())
+	meta, err := block.ReadFromDir(blockPath)
+	require.NoError(t, err)
+	meta.Version = block.MaxSupportedVersion + 1
+	_, err = meta.WriteToFile(db.logger, blockPath)
+	require.NoError(t, err)
+	db.forgetBlock(id)
+
+	// the block is still listed, but refused when it is queried.
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	_, err = db.blockQuerier.queriers[0].SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         start.UnixMilli(),
+		End:           end.UnixMilli(),
+	})
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	var versionErr *block.UnsupportedVersionError
+	require.True(t, errors.As(err, &versionErr))
+	require.Equal(t, id, versionErr.ULID)
+
+	_, err = RewriteBlockVersion(ctx, db.logger, blockPath, block.MetaVersion1)
+	require.True(t, errors.As(err, &versionErr))
+}
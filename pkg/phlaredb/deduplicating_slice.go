@@ -58,6 +58,11 @@ func (s *deduplicatingSlice[M, K, H, P]) Size() uint64 {
 }
 
 func (s *deduplicatingSlice[M, K, H, P]) Init(path string, cfg *ParquetConfig) error {
+	return s.init(path, cfg, s.persister.Schema())
+}
+
+// init creates the file of the table, written with the given schema.
+func (s *deduplicatingSlice[M, K, H, P]) init(path string, cfg *ParquetConfig, schema *parquet.Schema) error {
 	s.cfg = cfg
 	file, err := os.OpenFile(filepath.Join(path, s.persister.Name()+block.ParquetSuffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
@@ -66,7 +71,7 @@ func (s *deduplicatingSlice[M, K, H, P]) Init(path string, cfg *ParquetConfig) e
 	s.file = file
 
 	// TODO: Reuse parquet.Writer beyond life time of the head.
-	s.writer = parquet.NewGenericWriter[P](file, s.persister.Schema(),
+	s.writer = parquet.NewGenericWriter[P](file, schema,
 		parquet.ColumnPageBuffers(parquet.NewFileBufferPool(os.TempDir(), "phlaredb-parquet-buffers*")),
 		parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
 	)
@@ -0,0 +1,83 @@
+package phlaredb
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// ExternalLabels are labels identifying the producer of the blocks, e.g. the cluster or the zone.
+// They are added to the meta of the blocks and to the series which do not have them already.
+type ExternalLabels map[string]string
+
+// String implements flag.Value.
+func (l ExternalLabels) String() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set implements flag.Value, the labels are given as a comma-separated list of name=value pairs.
+func (l *ExternalLabels) Set(s string) error {
+	labels := ExternalLabels{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid external label %q, expected <name>=<value>", pair)
+		}
+		labels[name] = value
+	}
+	*l = labels
+	return l.Validate()
+}
+
+// Validate validates the label names.
+func (l ExternalLabels) Validate() error {
+	for name := range l {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid external label name %q", name)
+		}
+	}
+	return nil
+}
+
+// merge returns the given labels with the external labels they do not have already.
+func (l ExternalLabels) merge(ls []*typesv1.LabelPair) []*typesv1.LabelPair {
+	if len(l) == 0 {
+		return ls
+	}
+	result := make([]*typesv1.LabelPair, len(ls), len(ls)+len(l))
+	copy(result, ls)
+	for _, name := range l.names() {
+		found := false
+		for _, lbl := range ls {
+			if lbl.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, &typesv1.LabelPair{Name: name, Value: l[name]})
+		}
+	}
+	return result
+}
+
+func (l ExternalLabels) names() []string {
+	names := make([]string, 0, len(l))
+	for name := range l {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
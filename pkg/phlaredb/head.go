@@ -22,7 +22,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb/fileutil"
 	"github.com/samber/lo"
 	"go.uber.org/atomic"
@@ -132,19 +131,30 @@ type Head struct {
 	metaLock sync.RWMutex
 	meta     *block.Meta
 
+	// queryLock is held for reading by the queries of a head, and for writing while its last
+	// profiles are written to a row group and while its block replaces it in the queries, so its
+	// profiles are neither missed nor counted twice and its row groups are never closed under a
+	// query.
+	queryLock sync.RWMutex
+	// flushed is set once the block written from the head replaces it in the queries.
+	flushed bool
+
 	parquetConfig   *ParquetConfig
 	strings         deduplicatingSlice[string, string, *stringsHelper, *schemav1.StringPersister]
 	mappings        deduplicatingSlice[*profilev1.Mapping, mappingsKey, *mappingsHelper, *schemav1.MappingPersister]
 	functions       deduplicatingSlice[*profilev1.Function, functionsKey, *functionsHelper, *schemav1.FunctionPersister]
 	locations       deduplicatingSlice[*profilev1.Location, locationsKey, *locationsHelper, *schemav1.LocationPersister]
-	stacktraces     deduplicatingSlice[*schemav1.Stacktrace, stacktracesKey, *stacktracesHelper, *schemav1.StacktracePersister] // a stacktrace is a slice of location ids
+	stacktraces     stacktraceStore // a stacktrace is a slice of location ids
 	profiles        *profileStore
+	histograms      *histogramStore
+	targetMetadata  *targetMetadataStore
 	totalSamples    *atomic.Uint64
 	tables          []Table
 	delta           *deltaProfiles
 	pprofLabelCache labelCache
 
-	limiter TenantLimiter
+	limiter        TenantLimiter
+	externalLabels ExternalLabels
 }
 
 const (
@@ -168,9 +178,18 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 		flushCh:          make(chan struct{}),
 		flushForcedTimer: time.NewTimer(cfg.MaxBlockDuration),
 
-		parquetConfig: &parquetConfig,
-		limiter:       limiter,
+		parquetConfig:  &parquetConfig,
+		limiter:        limiter,
+		externalLabels: cfg.ExternalLabels,
+	}
+	for name, value := range cfg.ExternalLabels {
+		h.meta.Labels[name] = value
 	}
+	h.meta.Version = block.MetaVersion1
+	if cfg.BlockFormatVersion > 0 {
+		h.meta.Version = block.MetaVersion(cfg.BlockFormatVersion)
+	}
+	h.stacktraces.locationLists = h.meta.Version < block.MetaVersion2
 	h.headPath = filepath.Join(cfg.DataPath, pathHead, h.meta.ULID.String())
 	h.localPath = filepath.Join(cfg.DataPath, pathLocal, h.meta.ULID.String())
 	h.metrics.setHead(h)
@@ -189,6 +208,8 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 
 	// create profile store
 	h.profiles = newProfileStore(phlarectx)
+	h.histograms = newHistogramStore()
+	h.targetMetadata = newTargetMetadataStore()
 
 	h.tables = []Table{
 		&h.strings,
@@ -197,6 +218,8 @@ func NewHead(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*Hea
 		&h.locations,
 		&h.stacktraces,
 		h.profiles,
+		h.histograms,
+		h.targetMetadata,
 	}
 	for _, t := range h.tables {
 		if err := t.Init(h.headPath, h.parquetConfig); err != nil {
@@ -246,13 +269,14 @@ func (h *Head) loop() {
 	for {
 		select {
 		case <-h.flushForcedTimer.C:
-			level.Debug(h.logger).Log("msg", "max block duration reached, flush to disk")
+			level.Debug(h.logger).Log("msg", "max block duration reached, flush to disk", "block", h.meta.ULID)
 			close(h.flushCh)
 			return
 		case <-tick.C:
 			if currentSize := h.Size(); currentSize > h.parquetConfig.MaxBlockBytes {
 				level.Debug(h.logger).Log(
 					"msg", "max block bytes reached, flush to disk",
+					"block", h.meta.ULID,
 					"max_size", humanize.Bytes(h.parquetConfig.MaxBlockBytes),
 					"current_head_size", humanize.Bytes(currentSize),
 				)
@@ -313,6 +337,7 @@ func (h *Head) convertSamples(ctx context.Context, r *rewriter, in []*profilev1.
 }
 
 func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, externalLabels ...*typesv1.LabelPair) error {
+	externalLabels = h.externalLabels.merge(externalLabels)
 	labels, seriesFingerprints := labelsForProfile(p, externalLabels...)
 
 	for i, fp := range seriesFingerprints {
@@ -367,9 +392,11 @@ func (h *Head) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, e
 			continue
 		}
 
+		total := profile.Total()
 		if err := h.profiles.ingest(ctx, []*schemav1.Profile{profile}, labels[idxType], metricName, rewrites); err != nil {
 			return err
 		}
+		h.histograms.observe(profile.SeriesFingerprint, profile.TimeNanos, total)
 
 		profileIngested = true
 	}
@@ -715,7 +742,7 @@ func (it *ProfileSelectorIterator) Err() error {
 func (h *Head) Series(ctx context.Context, req *connect.Request[ingestv1.SeriesRequest]) (*connect.Response[ingestv1.SeriesResponse], error) {
 	selectors := make([][]*labels.Matcher, 0, len(req.Msg.Matchers))
 	for _, m := range req.Msg.Matchers {
-		s, err := parser.ParseMetricSelector(m)
+		s, err := phlaremodel.ParseSelector(m)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, "failed to label selector")
 		}
@@ -757,7 +784,7 @@ func (h *Head) Close() error {
 // Flush closes the head and writes data to disk
 func (h *Head) Flush(ctx context.Context) error {
 	if h.profiles.empty() {
-		level.Info(h.logger).Log("msg", "head empty - no block written")
+		level.Info(h.logger).Log("msg", "head empty - no block written", "block", h.meta.ULID)
 		return os.RemoveAll(h.headPath)
 	}
 
@@ -787,6 +814,11 @@ func (h *Head) Flush(ctx context.Context) error {
 	if stat, err := os.Stat(indexPath); err == nil {
 		files[0].SizeBytes = uint64(stat.Size())
 	}
+	checksums, err := block.FileChecksums(indexPath)
+	if err != nil {
+		return errors.Wrap(err, "checksum of the index")
+	}
+	files[0].Checksums = checksums
 
 	for idx, t := range h.tables {
 		if err := t.Close(); err != nil {
@@ -800,12 +832,22 @@ func (h *Head) Flush(ctx context.Context) error {
 		}
 	}
 
+	// the tables without rows, such as the metadata of the targets, may not write a file.
+	files = lo.Filter(files, func(f block.File, _ int) bool {
+		if f.Parquet == nil || f.Parquet.NumRows > 0 {
+			return true
+		}
+		_, err := os.Stat(filepath.Join(h.headPath, f.RelPath))
+		return err == nil
+	})
+
 	sort.Slice(files, func(i, j int) bool {
 		return files[i].RelPath < files[j].RelPath
 	})
 	h.meta.Files = files
 	h.meta.Stats.NumProfiles = uint64(h.profiles.index.totalProfiles.Load())
 	h.meta.Stats.NumSamples = h.totalSamples.Load()
+	h.meta.SetQueryStats()
 
 	if _, err := h.meta.WriteToFile(h.logger, h.headPath); err != nil {
 		return err
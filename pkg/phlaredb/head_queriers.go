@@ -113,13 +113,26 @@ func (q *headOnDiskQuerier) MergeByStacktraces(ctx context.Context, rows iter.It
 	return q.head.resolveStacktraces(ctx, stacktraceSamples), nil
 }
 
+func (q *headOnDiskQuerier) MergeByStacktracesGroups(ctx context.Context, rows iter.Iterator[Profile], groups profileGroups, n int) ([]*ingestv1.MergeProfilesStacktracesResult, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktracesGroups - HeadOnDisk")
+	defer sp.Finish()
+
+	profiles, err := selectProfileSamples(ctx, q.rowGroup(), rows)
+	if err != nil {
+		return nil, err
+	}
+	return mergeByStacktracesGroups(profiles, groups, n, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return q.head.resolveStacktraces(ctx, samples), nil
+	})
+}
+
 func (q *headOnDiskQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByPprof - HeadOnDisk")
 	defer sp.Finish()
 
 	stacktraceSamples := profileSampleMap{}
 
-	if err := mergeByStacktraces(ctx, q.head.profiles.rowGroups[q.rowGroupIdx], rows, stacktraceSamples); err != nil {
+	if err := mergeByStacktraces(ctx, q.rowGroup(), rows, stacktraceSamples); err != nil {
 		return nil, err
 	}
 
@@ -132,7 +145,25 @@ func (q *headOnDiskQuerier) MergeByLabels(ctx context.Context, rows iter.Iterato
 
 	seriesByLabels := make(seriesByLabels)
 
-	if err := mergeByLabels(ctx, q.head.profiles.rowGroups[q.rowGroupIdx], rows, seriesByLabels, by...); err != nil {
+	if err := mergeByLabels(ctx, q.rowGroup(), rows, seriesByLabels, by...); err != nil {
+		return nil, err
+	}
+
+	return seriesByLabels.normalize(), nil
+}
+
+func (q *headOnDiskQuerier) MergeFunctionByLabels(ctx context.Context, rows iter.Iterator[Profile], fn FunctionSelector, by ...string) ([]*typesv1.Series, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeFunctionByLabels - HeadOnDisk")
+	defer sp.Finish()
+
+	profiles, err := selectProfileSamples(ctx, q.rowGroup(), rows)
+	if err != nil {
+		return nil, err
+	}
+	seriesByLabels := make(seriesByLabels)
+	if err := mergeFunctionByLabels(profiles, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return q.head.resolveStacktraces(ctx, samples), nil
+	}, fn, seriesByLabels, by...); err != nil {
 		return nil, err
 	}
 
@@ -175,11 +206,13 @@ func (q *headInMemoryQuerier) SelectMatchingProfiles(ctx context.Context, params
 	)
 
 	iters := make([]iter.Iterator[Profile], 0, len(ids))
-	index.mutex.RLock()
-	defer index.mutex.RUnlock()
+	// the profiles in memory are copied under the locks of all the shards, so that they are a
+	// consistent snapshot with regards to the row groups cut.
+	index.rLockAll()
+	defer index.rUnlockAll()
 
 	for _, fp := range ids {
-		profileSeries, ok := index.profilesPerFP[fp]
+		profileSeries, ok := index.shard(fp).profilesPerFP[fp]
 		if !ok {
 			continue
 		}
@@ -210,10 +243,12 @@ func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.
 
 	stacktraceSamples := stacktraceSampleMap{}
 
+	rows = iter.WithContext(ctx, rows)
 	q.head.stacktraces.lock.RLock()
 	for rows.Next() {
 		p, ok := rows.At().(ProfileWithLabels)
 		if !ok {
+			q.head.stacktraces.lock.RUnlock()
 			return nil, errors.New("expected ProfileWithLabels")
 		}
 
@@ -227,10 +262,10 @@ func (q *headInMemoryQuerier) MergeByStacktraces(ctx context.Context, rows iter.
 			stacktraceSamples[int64(s.StacktraceID)].Value += s.Value
 		}
 	}
+	q.head.stacktraces.lock.RUnlock()
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
-	q.head.stacktraces.lock.RUnlock()
 
 	return q.head.resolveStacktraces(ctx, stacktraceSamples), nil
 }
@@ -241,6 +276,7 @@ func (q *headInMemoryQuerier) MergePprof(ctx context.Context, rows iter.Iterator
 
 	stacktraceSamples := profileSampleMap{}
 
+	rows = iter.WithContext(ctx, rows)
 	for rows.Next() {
 		p, ok := rows.At().(ProfileWithLabels)
 		if !ok {
@@ -257,6 +293,9 @@ func (q *headInMemoryQuerier) MergePprof(ctx context.Context, rows iter.Iterator
 			stacktraceSamples[int64(s.StacktraceID)].Value[0] += s.Value
 		}
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return q.head.resolvePprof(ctx, stacktraceSamples), nil
 
@@ -270,6 +309,7 @@ func (q *headInMemoryQuerier) MergeByLabels(ctx context.Context, rows iter.Itera
 	seriesByLabels := make(seriesByLabels)
 	labelBuf := make([]byte, 0, 1024)
 
+	rows = iter.WithContext(ctx, rows)
 	for rows.Next() {
 		p, ok := rows.At().(ProfileWithLabels)
 		if !ok {
@@ -308,6 +348,61 @@ func (q *headInMemoryQuerier) MergeByLabels(ctx context.Context, rows iter.Itera
 	return seriesByLabels.normalize(), nil
 }
 
+func (q *headInMemoryQuerier) MergeFunctionByLabels(ctx context.Context, rows iter.Iterator[Profile], fn FunctionSelector, by ...string) ([]*typesv1.Series, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeFunctionByLabels - HeadInMemory")
+	defer sp.Finish()
+
+	profiles, err := inMemoryProfileSamples(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	seriesByLabels := make(seriesByLabels)
+	if err := mergeFunctionByLabels(profiles, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return q.head.resolveStacktraces(ctx, samples), nil
+	}, fn, seriesByLabels, by...); err != nil {
+		return nil, err
+	}
+
+	return seriesByLabels.normalize(), nil
+}
+
+func (q *headInMemoryQuerier) MergeByStacktracesGroups(ctx context.Context, rows iter.Iterator[Profile], groups profileGroups, n int) ([]*ingestv1.MergeProfilesStacktracesResult, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktracesGroups - HeadInMemory")
+	defer sp.Finish()
+
+	profiles, err := inMemoryProfileSamples(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	return mergeByStacktracesGroups(profiles, groups, n, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return q.head.resolveStacktraces(ctx, samples), nil
+	})
+}
+
+// inMemoryProfileSamples returns the samples of the profiles of the head kept in memory.
+func inMemoryProfileSamples(ctx context.Context, rows iter.Iterator[Profile]) ([]profileSamples, error) {
+	var profiles []profileSamples
+	rows = iter.WithContext(ctx, rows)
+	for rows.Next() {
+		p, ok := rows.At().(ProfileWithLabels)
+		if !ok {
+			return nil, errors.New("expected ProfileWithLabels")
+		}
+		samples := profileSamples{
+			profile:       p,
+			stacktraceIDs: make([]int64, len(p.Samples())),
+			values:        make([]int64, len(p.Samples())),
+		}
+		for i, s := range p.Samples() {
+			samples.stacktraceIDs[i] = int64(s.StacktraceID)
+			samples.values[i] = s.Value
+		}
+		profiles = append(profiles, samples)
+	}
+	return profiles, rows.Err()
+}
+
 func (q *headInMemoryQuerier) Sort(in []Profile) []Profile {
 	return in
 }
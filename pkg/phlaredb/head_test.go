@@ -3,6 +3,7 @@ package phlaredb
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -21,6 +22,7 @@ import (
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
 	"github.com/grafana/phlare/pkg/pprof"
 )
 
@@ -200,11 +202,13 @@ phlare_head_received_sample_values_total{profile_name=""} 3
 # HELP phlare_head_size_bytes Size of a particular in memory store within the head phlaredb block.
 # TYPE phlare_head_size_bytes gauge
 phlare_head_size_bytes{type="functions"} 240
+phlare_head_size_bytes{type="histograms"} 96
 phlare_head_size_bytes{type="locations"} 344
 phlare_head_size_bytes{type="mappings"} 192
 phlare_head_size_bytes{type="profiles"} 416
 phlare_head_size_bytes{type="stacktraces"} 104
 phlare_head_size_bytes{type="strings"} 52
+phlare_head_size_bytes{type="target_metadata"} 0
 
 `),
 		"phlare_head_received_sample_values_total",
@@ -301,6 +305,64 @@ func TestHeadLabelNames(t *testing.T) {
 	require.Equal(t, []string{"__period_type__", "__period_unit__", "__profile_type__", "__type__", "__unit__", "job", "namespace"}, res.Msg.Names)
 }
 
+func TestHeadExternalLabels(t *testing.T) {
+	ctx := testContext(t)
+	head, err := NewHead(ctx, Config{
+		DataPath:       t.TempDir(),
+		ExternalLabels: ExternalLabels{"cluster": "eu-west", "zone": "a"},
+	}, NoLimit)
+	require.NoError(t, err)
+	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), &typesv1.LabelPair{Name: "job", Value: "foo"}))
+	// the labels of the series take precedence.
+	require.NoError(t, head.Ingest(context.Background(), newProfileBar(), uuid.New(), &typesv1.LabelPair{Name: "job", Value: "bar"}, &typesv1.LabelPair{Name: "zone", Value: "b"}))
+
+	res, err := head.LabelValues(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{Name: "cluster"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"eu-west"}, res.Msg.Names)
+	res, err = head.LabelValues(context.Background(), connect.NewRequest(&ingestv1.LabelValuesRequest{Name: "zone"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, res.Msg.Names)
+
+	require.NoError(t, head.Flush(context.Background()))
+	meta, err := block.ReadFromDir(head.localPath)
+	require.NoError(t, err)
+	require.Equal(t, "eu-west", meta.Labels["cluster"])
+	require.Equal(t, "a", meta.Labels["zone"])
+}
+
+func TestHeadFlushQueryStats(t *testing.T) {
+	head := newTestHead(t)
+	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), &typesv1.LabelPair{Name: "job", Value: "foo"}))
+	require.NoError(t, head.Ingest(context.Background(), newProfileBar(), uuid.New(), &typesv1.LabelPair{Name: "job", Value: "bar"}))
+	stats := head.stats()
+
+	require.NoError(t, head.Flush(context.Background()))
+	meta, err := block.ReadFromDir(head.localPath)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), meta.Stats.NumSeries)
+	require.Equal(t, uint64(2), meta.Stats.NumProfiles)
+	require.Equal(t, stats.AvgSamplesPerProfile, meta.Stats.AvgSamplesPerProfile)
+	require.Equal(t, float64(meta.Stats.NumSamples)/2, meta.Stats.AvgSamplesPerProfile)
+
+	var symbolsBytes uint64
+	for _, f := range meta.Files {
+		if f.RelPath != block.IndexFilename && f.RelPath != block.ProfilesFilename {
+			symbolsBytes += f.SizeBytes
+		}
+	}
+	require.NotZero(t, symbolsBytes)
+	require.Equal(t, symbolsBytes, meta.Stats.SymbolsBytes)
+}
+
+func TestExternalLabelsFlag(t *testing.T) {
+	var l ExternalLabels
+	require.NoError(t, l.Set("zone=a,cluster=eu-west"))
+	require.Equal(t, ExternalLabels{"cluster": "eu-west", "zone": "a"}, l)
+	require.Equal(t, "cluster=eu-west,zone=a", l.String())
+	require.Error(t, l.Set("cluster"))
+	require.Error(t, l.Set("__cluster__=eu-west"))
+}
+
 func TestHeadSeries(t *testing.T) {
 	head := newTestHead(t)
 	fooLabels := phlaremodel.NewLabelsBuilder(nil).Set("namespace", "phlare").Set("job", "foo").Labels()
@@ -322,6 +384,42 @@ func TestHeadSeries(t *testing.T) {
 	require.Equal(t, []*typesv1.Labels{{Labels: expected}}, res.Msg.LabelsSet)
 }
 
+func TestHeadSeriesMatchers(t *testing.T) {
+	head := newTestHead(t)
+	fooLabels := phlaremodel.NewLabelsBuilder(nil).Set("namespace", "phlare").Set("job", "foo").Labels()
+	barLabels := phlaremodel.NewLabelsBuilder(nil).Set("job", "bar").Labels()
+	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), fooLabels...))
+	require.NoError(t, head.Ingest(context.Background(), newProfileBar(), uuid.New(), barLabels...))
+
+	for _, tc := range []struct {
+		matcher  string
+		expected []string
+	}{
+		{`{namespace=""}`, []string{"bar"}},
+		{`{namespace!="phlare"}`, []string{"bar"}},
+		{`{namespace!=""}`, []string{"foo"}},
+		{`{job=~"fo"}`, nil},
+		{`{job=~"fo.*"}`, []string{"foo"}},
+		{`{job=~"foo|baz"}`, []string{"foo"}},
+		{`{job!~"f.*"}`, []string{"bar"}},
+		{`{job=~"foo|"}`, []string{"foo"}},
+		{`{namespace=~"phlare|"}`, []string{"bar", "foo"}},
+		{`:type:unit:type:unit{job="foo"}`, []string{"foo"}},
+		{`{__name__=":type:unit:type:unit"}`, []string{"bar", "foo"}},
+	} {
+		t.Run(tc.matcher, func(t *testing.T) {
+			res, err := head.Series(context.Background(), connect.NewRequest(&ingestv1.SeriesRequest{Matchers: []string{tc.matcher}}))
+			require.NoError(t, err)
+			var jobs []string
+			for _, ls := range res.Msg.LabelsSet {
+				jobs = append(jobs, phlaremodel.Labels(ls.Labels).Get("job"))
+			}
+			sort.Strings(jobs)
+			require.Equal(t, tc.expected, jobs)
+		})
+	}
+}
+
 func TestHeadProfileTypes(t *testing.T) {
 	head := newTestHead(t)
 	require.NoError(t, head.Ingest(context.Background(), newProfileFoo(), uuid.New(), &typesv1.LabelPair{Name: "__name__", Value: "foo"}, &typesv1.LabelPair{Name: "job", Value: "foo"}, &typesv1.LabelPair{Name: "namespace", Value: "phlare"}))
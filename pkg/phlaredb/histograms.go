@@ -0,0 +1,359 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"go.uber.org/atomic"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// SelectHistograms returns the histograms of the profile totals of the matching series, so that
+// their distribution is known without reading the samples of the profiles.
+func (f *PhlareDB) SelectHistograms(ctx context.Context, req *connect.Request[ingestv1.SelectHistogramsRequest]) (*connect.Response[ingestv1.SelectHistogramsResponse], error) {
+	if req.Msg.Type == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing profile type"))
+	}
+	queriers, release := f.queriers()
+	defer release()
+	series, complete, err := queriers.selectHistograms(f.queryContext(ctx), req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&ingestv1.SelectHistogramsResponse{
+		Series:   series,
+		Complete: complete,
+	}), nil
+}
+
+// selectHistograms merges the histograms of the queriers, and returns whether they all store
+// them. The histograms of the slots ending in the time range are returned, so the queriers
+// holding profiles up to a slot before it are queried.
+func (q Queriers) selectHistograms(ctx context.Context, params *ingestv1.SelectHistogramsRequest) ([]*ingestv1.SeriesHistograms, bool, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectHistograms")
+	defer sp.Finish()
+	sp.LogFields(
+		otlog.String("start", model.Time(params.Start).Time().String()),
+		otlog.String("end", model.Time(params.End).Time().String()),
+		otlog.String("selector", params.LabelSelector),
+		otlog.String("profile_id", params.Type.ID),
+	)
+
+	var (
+		start    = model.Time(params.Start - phlaremodel.HistogramSlot.Milliseconds())
+		sources  [][]*ingestv1.SeriesHistograms
+		complete = true
+	)
+	for _, querier := range q.ForTimeRange(start, model.Time(params.End)) {
+		series, ok, err := querier.SelectHistograms(ctx, params)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			complete = false
+			continue
+		}
+		sources = append(sources, series)
+	}
+	return phlaremodel.MergeSeriesHistograms(sources...), complete, nil
+}
+
+// histogramStore keeps the histograms of the profile totals of the series of the head, by time
+// slot, and writes them to the block.
+type histogramStore struct {
+	lock   sync.RWMutex
+	series map[model.Fingerprint][]*ingestv1.Histogram
+
+	size atomic.Uint64
+	path string
+}
+
+func newHistogramStore() *histogramStore {
+	return &histogramStore{
+		series: make(map[model.Fingerprint][]*ingestv1.Histogram),
+	}
+}
+
+func (s *histogramStore) Name() string {
+	return (&schemav1.HistogramPersister{}).Name()
+}
+
+func (s *histogramStore) Size() uint64 {
+	return s.size.Load()
+}
+
+func (s *histogramStore) MemorySize() uint64 {
+	return s.size.Load()
+}
+
+func (s *histogramStore) Init(path string, _ *ParquetConfig) error {
+	s.path = path
+	return nil
+}
+
+// observe adds the total of a profile of the series to the histogram of its slot.
+func (s *histogramStore) observe(fp model.Fingerprint, timeNanos int64, total int64) {
+	ts := phlaremodel.HistogramSlotEnd(int64(model.TimeFromUnixNano(timeNanos)))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	histograms := s.series[fp]
+	// the profiles mostly come in order, the last slot is checked first.
+	i := len(histograms)
+	if i == 0 || histograms[i-1].Timestamp != ts {
+		i = sort.Search(len(histograms), func(i int) bool { return histograms[i].Timestamp >= ts })
+	} else {
+		i--
+	}
+	if i == len(histograms) || histograms[i].Timestamp != ts {
+		histograms = append(histograms, nil)
+		copy(histograms[i+1:], histograms[i:])
+		histograms[i] = &ingestv1.Histogram{Timestamp: ts}
+		s.series[fp] = histograms
+		s.size.Add(histogramSize)
+	}
+	buckets := len(histograms[i].Buckets)
+	phlaremodel.ObserveHistogram(histograms[i], total)
+	if len(histograms[i].Buckets) > buckets {
+		s.size.Add(histogramBucketSize)
+	}
+}
+
+const (
+	// histogramSize is the estimated size of a histogram without its buckets.
+	histogramSize = 64
+	// histogramBucketSize is the estimated size of a bucket of a histogram.
+	histogramBucketSize = 16
+)
+
+// selectHistograms returns the histograms of the series with a slot ending in the time range.
+func (s *histogramStore) selectHistograms(fps []model.Fingerprint, start, end int64) []*ingestv1.SeriesHistograms {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]*ingestv1.SeriesHistograms, 0, len(fps))
+	for _, fp := range fps {
+		histograms := selectSlots(s.series[fp], start, end)
+		if len(histograms) == 0 {
+			continue
+		}
+		series := &ingestv1.SeriesHistograms{
+			Fingerprint: uint64(fp),
+			Histograms:  make([]*ingestv1.Histogram, len(histograms)),
+		}
+		// the histograms are copied, as they keep being updated.
+		for i, h := range histograms {
+			c := &ingestv1.Histogram{Timestamp: h.Timestamp}
+			phlaremodel.MergeHistograms(c, h)
+			series.Histograms[i] = c
+		}
+		result = append(result, series)
+	}
+	return result
+}
+
+// selectSlots returns the histograms, sorted by timestamp, of the slots ending in the time range.
+func selectSlots(histograms []*ingestv1.Histogram, start, end int64) []*ingestv1.Histogram {
+	first := sort.Search(len(histograms), func(i int) bool { return histograms[i].Timestamp >= start })
+	last := sort.Search(len(histograms), func(i int) bool { return histograms[i].Timestamp > end })
+	if first >= last {
+		return nil
+	}
+	return histograms[first:last]
+}
+
+// Flush writes the histograms to the block.
+func (s *histogramStore) Flush(context.Context) (numRows uint64, numRowGroups uint64, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	rows := make([]*schemav1.SeriesHistogram, 0, len(s.series))
+	for fp, histograms := range s.series {
+		for _, h := range histograms {
+			rows = append(rows, seriesHistogramRow(fp, h))
+		}
+	}
+	if err := writeHistograms(filepath.Join(s.path, s.Name()+block.ParquetSuffix), rows); err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(rows)), 1, nil
+}
+
+func (s *histogramStore) Close() error {
+	return nil
+}
+
+func writeHistograms(path string, rows []*schemav1.SeriesHistogram) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	var w schemav1.ReadWriter[*schemav1.SeriesHistogram, *schemav1.HistogramPersister]
+	return w.WriteParquetFile(f, rows)
+}
+
+func seriesHistogramRow(fp model.Fingerprint, h *ingestv1.Histogram) *schemav1.SeriesHistogram {
+	row := &schemav1.SeriesHistogram{
+		SeriesFingerprint: uint64(fp),
+		Timestamp:         h.Timestamp,
+		Count:             h.Count,
+		Sum:               h.Sum,
+		Min:               h.Min,
+		Max:               h.Max,
+		ZeroCount:         h.ZeroCount,
+		Buckets:           make([]schemav1.HistogramBucket, len(h.Buckets)),
+	}
+	for i, b := range h.Buckets {
+		row.Buckets[i] = schemav1.HistogramBucket{Index: b.Index, Count: b.Count}
+	}
+	return row
+}
+
+func histogramFromRow(row *schemav1.SeriesHistogram) *ingestv1.Histogram {
+	h := &ingestv1.Histogram{
+		Timestamp: row.Timestamp,
+		Count:     row.Count,
+		Sum:       row.Sum,
+		Min:       row.Min,
+		Max:       row.Max,
+		ZeroCount: row.ZeroCount,
+		Buckets:   make([]*ingestv1.HistogramBucket, len(row.Buckets)),
+	}
+	for i, b := range row.Buckets {
+		h.Buckets[i] = &ingestv1.HistogramBucket{Index: b.Index, Count: b.Count}
+	}
+	return h
+}
+
+// SelectHistograms returns the histograms of the matching series of the head.
+func (q *headInMemoryQuerier) SelectHistograms(ctx context.Context, params *ingestv1.SelectHistogramsRequest) ([]*ingestv1.SeriesHistograms, bool, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectHistograms - HeadInMemory")
+	defer sp.Finish()
+	fps, err := q.head.profiles.index.selectMatchingFPs(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: params.LabelSelector,
+		Type:          params.Type,
+		Start:         params.Start,
+		End:           params.End,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return q.head.histograms.selectHistograms(fps, params.Start, params.End), true, nil
+}
+
+// SelectHistograms returns no histograms, as the histograms of the whole head, including its row
+// groups written to disk, are returned by its in-memory querier.
+func (q *headOnDiskQuerier) SelectHistograms(context.Context, *ingestv1.SelectHistogramsRequest) ([]*ingestv1.SeriesHistograms, bool, error) {
+	return nil, true, nil
+}
+
+// SelectHistograms returns the histograms of the matching series of the block, and false when the
+// block was written before the histograms were stored.
+func (b *singleBlockQuerier) SelectHistograms(ctx context.Context, params *ingestv1.SelectHistogramsRequest) ([]*ingestv1.SeriesHistograms, bool, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectHistograms - Block")
+	defer sp.Finish()
+	if b.meta.FileByRelPath(b.histogramsRelPath()) == nil {
+		return nil, false, nil
+	}
+	if err := b.open(ctx); err != nil {
+		return nil, false, err
+	}
+	histograms, err := b.seriesHistograms(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	matchers, err := phlaremodel.ParseSelector(params.LabelSelector)
+	if err != nil {
+		return nil, false, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "failed to parse label selectors"))
+	}
+	matchers = append(matchers, phlaremodel.SelectorFromProfileType(params.Type))
+	postings, err := b.postings.postingsForMatchers(b.index, b.metrics, matchers...)
+	if err != nil {
+		return nil, false, err
+	}
+	var (
+		result []*ingestv1.SeriesHistograms
+		lbls   = make(phlaremodel.Labels, 0, 6)
+		chks   = make([]index.ChunkMeta, 1)
+	)
+	for postings.Next() {
+		fp, err := b.index.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return nil, false, err
+		}
+		slots := selectSlots(histograms[model.Fingerprint(fp)], params.Start, params.End)
+		if len(slots) == 0 {
+			continue
+		}
+		result = append(result, &ingestv1.SeriesHistograms{
+			Fingerprint: fp,
+			Histograms:  slots,
+		})
+	}
+	if err := postings.Err(); err != nil {
+		return nil, false, err
+	}
+	return result, true, nil
+}
+
+func (b *singleBlockQuerier) histogramsRelPath() string {
+	return (&schemav1.HistogramPersister{}).Name() + block.ParquetSuffix
+}
+
+// seriesHistograms returns the histograms of the block by series, read once it is opened. They
+// are small enough to be kept in memory, at most one per series and slot. The errors aren't
+// cached, so the next query reads them again.
+func (b *singleBlockQuerier) seriesHistograms(ctx context.Context) (map[model.Fingerprint][]*ingestv1.Histogram, error) {
+	b.histogramsMtx.Lock()
+	defer b.histogramsMtx.Unlock()
+	if b.histograms != nil {
+		return b.histograms, nil
+	}
+	histograms, err := b.readHistograms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b.histograms = histograms
+	return histograms, nil
+}
+
+func (b *singleBlockQuerier) readHistograms(ctx context.Context) (map[model.Fingerprint][]*ingestv1.Histogram, error) {
+	path := b.histogramsRelPath()
+	ra, err := b.bucketReader.ReaderAt(ctx, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening file '%s'", path)
+	}
+	defer ra.Close()
+	var r schemav1.ReadWriter[*schemav1.SeriesHistogram, *schemav1.HistogramPersister]
+	rows, err := r.ReadParquetFile(ra)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading parquet file '%s'", path)
+	}
+	histograms := make(map[model.Fingerprint][]*ingestv1.Histogram)
+	for _, row := range rows {
+		fp := model.Fingerprint(row.SeriesFingerprint)
+		histograms[fp] = append(histograms[fp], histogramFromRow(row))
+	}
+	// the slots of a series are searched by timestamp.
+	for _, h := range histograms {
+		sort.Slice(h, func(i, j int) bool { return h[i].Timestamp < h[j].Timestamp })
+	}
+	return histograms, nil
+}
@@ -0,0 +1,189 @@
+package phlaredb
+
+import (
+	"container/heap"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+const (
+	// mergeBudget is the sum of the estimated costs of the merges of a query running at once. A
+	// merge exceeding the budget runs alone.
+	mergeBudget = 16 << 20
+	// mergeShardSamples is the estimated number of samples merged by each shard of a block, the
+	// profiles selected in a block being split when they are expected to hold more.
+	mergeShardSamples = 1 << 20
+	maxMergeShards    = 8
+	// symbolBytesPerSample converts the size of the symbols of a block into a cost comparable to
+	// the number of samples merged, as resolving the stacktraces of a merge reads the symbols.
+	symbolBytesPerSample = 16
+)
+
+// blockStatsQuerier is implemented by the queriers which have the stats of the profiles they
+// read, to estimate the cost of their merges.
+type blockStatsQuerier interface {
+	BlockStats() block.BlockStats
+}
+
+func (b *singleBlockQuerier) BlockStats() block.BlockStats {
+	return b.meta.Stats
+}
+
+func (q *headOnDiskQuerier) BlockStats() block.BlockStats {
+	return q.head.stats()
+}
+
+func (q *headInMemoryQuerier) BlockStats() block.BlockStats {
+	return q.head.stats()
+}
+
+// stats returns the stats of the profiles ingested by the head. The symbols are held in memory
+// and have no size.
+func (h *Head) stats() block.BlockStats {
+	stats := block.BlockStats{
+		NumSamples:  h.totalSamples.Load(),
+		NumSeries:   uint64(h.profiles.index.totalSeries.Load()),
+		NumProfiles: uint64(h.profiles.index.totalProfiles.Load()),
+	}
+	if stats.NumProfiles > 0 {
+		stats.AvgSamplesPerProfile = float64(stats.NumSamples) / float64(stats.NumProfiles)
+	}
+	return stats
+}
+
+// mergeCost is the estimated cost of merging profiles of a block.
+type mergeCost struct {
+	samples uint64
+	symbols uint64
+}
+
+func estimateMergeCost(q Querier, profiles int) mergeCost {
+	sq, ok := q.(blockStatsQuerier)
+	if !ok {
+		return mergeCost{samples: uint64(profiles)}
+	}
+	stats := sq.BlockStats()
+	avg := stats.AvgSamplesPerProfile
+	if avg == 0 && stats.NumProfiles > 0 {
+		// blocks written before the average was recorded.
+		avg = float64(stats.NumSamples) / float64(stats.NumProfiles)
+	}
+	return mergeCost{
+		samples: uint64(float64(profiles) * avg),
+		symbols: stats.SymbolsBytes / symbolBytesPerSample,
+	}
+}
+
+func (c mergeCost) total() uint64 {
+	return c.samples + c.symbols
+}
+
+// shards returns the number of shards the merge is split into. Each shard resolves the
+// stacktraces of its samples, so the larger the symbols of the block, the more samples a shard
+// must merge.
+func (c mergeCost) shards() int {
+	n := c.samples / (mergeShardSamples + c.symbols)
+	if n > maxMergeShards {
+		n = maxMergeShards
+	}
+	if n < 1 {
+		return 1
+	}
+	return int(n)
+}
+
+// mergeScheduler runs the merges of the blocks of a query in the errgroup, the most expensive
+// first, while the sum of their estimated costs fits the budget. The merges are scheduled while
+// the profiles of the blocks are streamed in time order, and start as the budget frees up.
+type mergeScheduler struct {
+	g      *errgroup.Group
+	budget uint64
+
+	lock    sync.Mutex
+	running uint64
+	pending mergeJobs
+}
+
+type mergeJob struct {
+	cost uint64
+	fn   func() error
+}
+
+func newMergeScheduler(g *errgroup.Group, budget uint64) *mergeScheduler {
+	return &mergeScheduler{g: g, budget: budget}
+}
+
+// schedule merges the profiles selected in the block of the querier, split in shards when the
+// stats of the block estimate them expensive enough.
+func (s *mergeScheduler) schedule(q Querier, profiles []Profile, merge func([]Profile) error) {
+	cost := estimateMergeCost(q, len(profiles))
+	shards := cost.shards()
+	if shards > len(profiles) {
+		shards = len(profiles)
+	}
+	if shards <= 1 {
+		s.add(cost.total(), func() error { return merge(profiles) })
+		return
+	}
+	shardCost := cost.samples/uint64(shards) + cost.symbols
+	size := (len(profiles) + shards - 1) / shards
+	for start := 0; start < len(profiles); start += size {
+		end := start + size
+		if end > len(profiles) {
+			end = len(profiles)
+		}
+		shard := profiles[start:end]
+		s.add(shardCost, func() error { return merge(shard) })
+	}
+}
+
+func (s *mergeScheduler) add(cost uint64, fn func() error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	heap.Push(&s.pending, mergeJob{cost: cost, fn: fn})
+	s.dispatch()
+}
+
+// dispatch starts the pending merges fitting the budget. A merge is always started when none
+// is running. It must be called with the lock held.
+func (s *mergeScheduler) dispatch() {
+	for s.pending.Len() > 0 {
+		next := s.pending[0]
+		if s.running > 0 && s.running+next.cost > s.budget {
+			return
+		}
+		heap.Pop(&s.pending)
+		s.running += next.cost
+		s.g.Go(func() error {
+			err := next.fn()
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			s.running -= next.cost
+			// the pending merges are started before this one returns, so the errgroup waits for them.
+			s.dispatch()
+			return err
+		})
+	}
+}
+
+// mergeJobs is a heap of the pending merges, the most expensive at the top.
+type mergeJobs []mergeJob
+
+func (h mergeJobs) Len() int           { return len(h) }
+func (h mergeJobs) Less(i, j int) bool { return h[i].cost > h[j].cost }
+func (h mergeJobs) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeJobs) Push(x interface{}) {
+	*h = append(*h, x.(mergeJob))
+}
+
+func (h *mergeJobs) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
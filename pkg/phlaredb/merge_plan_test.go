@@ -0,0 +1,98 @@
+package phlaredb
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+func TestMergeScheduler_Shards(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		stats  block.BlockStats
+		shards []int
+	}{
+		{
+			name:   "small block",
+			stats:  block.BlockStats{AvgSamplesPerProfile: 100},
+			shards: []int{10},
+		},
+		{
+			name:   "many samples",
+			stats:  block.BlockStats{AvgSamplesPerProfile: 1 << 18},
+			shards: []int{5, 5},
+		},
+		{
+			name:   "average from the counts",
+			stats:  block.BlockStats{NumProfiles: 1, NumSamples: 1 << 20},
+			shards: []int{2, 2, 2, 2, 2},
+		},
+		{
+			name:   "large symbols",
+			stats:  block.BlockStats{AvgSamplesPerProfile: 1 << 18, SymbolsBytes: 64 << 20},
+			shards: []int{10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				g, _   = errgroup.WithContext(context.Background())
+				merges = newMergeScheduler(g, mergeBudget)
+				q      = &singleBlockQuerier{meta: &block.Meta{Stats: tc.stats}}
+				lock   sync.Mutex
+				shards []int
+			)
+			merges.schedule(q, make([]Profile, 10), func(profiles []Profile) error {
+				lock.Lock()
+				defer lock.Unlock()
+				shards = append(shards, len(profiles))
+				return nil
+			})
+			require.NoError(t, g.Wait())
+			require.ElementsMatch(t, tc.shards, shards)
+		})
+	}
+}
+
+func TestMergeScheduler_Budget(t *testing.T) {
+	var (
+		g, _    = errgroup.WithContext(context.Background())
+		merges  = newMergeScheduler(g, 10)
+		lock    sync.Mutex
+		started []string
+		running = make(chan struct{})
+		release = make(chan struct{})
+	)
+	job := func(name string, wait bool) func() error {
+		return func() error {
+			lock.Lock()
+			started = append(started, name)
+			lock.Unlock()
+			if wait {
+				close(running)
+				<-release
+			}
+			return nil
+		}
+	}
+	merges.add(5, job("a", true))
+	// none of the pending merges fit the budget while the first one runs.
+	merges.add(6, job("b", false))
+	merges.add(8, job("c", false))
+	merges.add(3, job("d", false))
+	<-running
+	lock.Lock()
+	require.Equal(t, []string{"a"}, started)
+	lock.Unlock()
+
+	close(release)
+	require.NoError(t, g.Wait())
+	require.Len(t, started, 4)
+	// the most expensive merge starts first, and the others once it is done.
+	require.Equal(t, []string{"a", "c"}, started[:2])
+	require.ElementsMatch(t, []string{"b", "d"}, started[2:])
+}
@@ -133,6 +133,10 @@ type blocksMetrics struct {
 	query *query.Metrics
 
 	blockOpeningLatency prometheus.Histogram
+	blockEvictions      prometheus.Counter
+	openBlocksBytes     prometheus.Gauge
+
+	postingsCacheLookups *prometheus.CounterVec
 }
 
 func newBlocksMetrics(reg prometheus.Registerer) *blocksMetrics {
@@ -142,6 +146,18 @@ func newBlocksMetrics(reg prometheus.Registerer) *blocksMetrics {
 			Name: "phlaredb_block_opening_duration",
 			Help: "Latency of opening a block in seconds",
 		}),
+		blockEvictions: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "phlaredb_block_evictions_total",
+			Help: "Total number of opened blocks closed because they were idle or exceeded the memory budget.",
+		}),
+		openBlocksBytes: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "phlaredb_open_blocks_bytes",
+			Help: "Size of the index and symbols of the opened blocks.",
+		}),
+		postingsCacheLookups: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_block_postings_cache_lookups_total",
+			Help: "Total number of lookups of the postings of selectors in the cache of the opened blocks, by result.",
+		}, []string{"result"}),
 	}
 }
 
@@ -15,6 +15,7 @@ import (
 	"github.com/bufbuild/connect-go"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/services"
 	"github.com/oklog/ulid"
@@ -23,7 +24,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/samber/lo"
 
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
@@ -32,6 +35,7 @@ import (
 	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
 	phlarecontext "github.com/grafana/phlare/pkg/phlare/context"
 	"github.com/grafana/phlare/pkg/phlaredb/block"
+	"github.com/grafana/phlare/pkg/phlaredb/query"
 	diskutil "github.com/grafana/phlare/pkg/util/disk"
 )
 
@@ -44,10 +48,34 @@ type Config struct {
 	DataPath string `yaml:"data_path,omitempty"`
 	// Blocks are generally cut once they reach 1000M of memory size, this will setup an upper limit to the duration of data that a block has that is cut by the ingester.
 	MaxBlockDuration time.Duration `yaml:"max_block_duration,omitempty"`
+	// HeadFlushConcurrency bounds the number of cut heads flushed in the background at the same time.
+	HeadFlushConcurrency int `yaml:"head_flush_concurrency" category:"advanced"`
 
 	// TODO: docs
 	RowGroupTargetSize uint64 `yaml:"row_group_target_size"`
 
+	// RetentionPeriod is the maximum age of local blocks, measured from their most recent sample. This is mainly useful when running in monolithic mode with the filesystem storage backend, where local blocks are the only copy of the data.
+	RetentionPeriod time.Duration `yaml:"retention_period"`
+	// RetentionRules override the retention period of the series matching their selector, so environments sharing a tenant can be kept for different periods.
+	RetentionRules []RetentionRule `yaml:"retention_rules" category:"advanced" doc:"description=Retention periods of the series matching label selectors, overriding the retention period. The first rule matching a series applies. Local blocks mixing series of different periods are rewritten without the expired profiles."`
+
+	// BlockIdleTimeout and MaxOpenBlocksBytes bound the memory used by the index and symbols of opened local blocks, which are otherwise kept in memory once queried.
+	BlockIdleTimeout   time.Duration `yaml:"block_idle_timeout" category:"advanced"`
+	MaxOpenBlocksBytes int64         `yaml:"max_open_blocks_bytes" category:"advanced"`
+
+	ExternalLabels ExternalLabels `yaml:"external_labels" category:"advanced"`
+
+	// BlockFormatVersion is the format of the blocks written, 1 by default so that all the readers support it.
+	BlockFormatVersion int `yaml:"block_format_version" category:"advanced"`
+
+	// RemoteVisibilityDelay is how long an uploaded block takes to be visible to the readers of the bucket, until when its local copy is kept to answer the queries.
+	RemoteVisibilityDelay time.Duration `yaml:"remote_visibility_delay" category:"advanced"`
+	// UploadBlocks is set when the blocks are uploaded to a bucket, so their local copy is only deleted once visible there.
+	UploadBlocks bool `yaml:"-"`
+
+	// QueryCapture records the queries of the local blocks, to replay them offline with profilecli.
+	QueryCapture bool `yaml:"query_capture" category:"experimental"`
+
 	Parquet *ParquetConfig `yaml:"-"` // Those configs should not be exposed to the user, rather they should be determined by phlare itself. Currently, they are solely used for test cases.
 }
 
@@ -60,7 +88,26 @@ type ParquetConfig struct {
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.StringVar(&cfg.DataPath, "phlaredb.data-path", "./data", "Directory used for local storage.")
 	f.DurationVar(&cfg.MaxBlockDuration, "phlaredb.max-block-duration", 3*time.Hour, "Upper limit to the duration of a Phlare block.")
+	f.IntVar(&cfg.HeadFlushConcurrency, "phlaredb.head-flush-concurrency", 1, "Maximum number of cut heads of a tenant written to disk concurrently. A new head receives the profiles as soon as the previous one is cut, and the cut heads are written in the background. At most twice as many cut heads are kept in memory, waiting or being written.")
 	f.Uint64Var(&cfg.RowGroupTargetSize, "phlaredb.row-group-target-size", 10*128*1024*1024, "How big should a single row group be uncompressed") // This should roughly be 128MiB compressed
+	f.DurationVar(&cfg.RetentionPeriod, "phlaredb.retention-period", 0, "Delete local blocks once their most recent profile is older than this period. 0 to disable.")
+	f.DurationVar(&cfg.BlockIdleTimeout, "phlaredb.block-idle-timeout", 0, "Close local blocks which have not been queried for this long, releasing the memory used by their index and symbols. They are opened again on the next query. 0 to disable.")
+	f.Int64Var(&cfg.MaxOpenBlocksBytes, "phlaredb.max-open-blocks-bytes", 0, "Per-tenant budget for the size of the index and symbols of opened local blocks. When exceeded, the least recently queried blocks are closed, except those queried within the last 5 minutes. 0 to disable.")
+	f.BoolVar(&cfg.QueryCapture, "phlaredb.query-capture", false, "Record the queries of the local blocks, with their anonymized selector and the rows they read, to the "+queryCaptureFilename+" file of the data path. The captured queries can be replayed against a copy of the blocks with 'profilecli blocks replay'. The file is rotated to "+queryCaptureFilename+".1 when it reaches 256MiB.")
+	f.IntVar(&cfg.BlockFormatVersion, "phlaredb.block-format-version", int(block.MetaVersion1), fmt.Sprintf("Format version of the blocks written, between 1 and %d. Only switch to a more recent format once all the components reading the blocks are upgraded.", block.MaxSupportedVersion))
+	f.DurationVar(&cfg.RemoteVisibilityDelay, "phlaredb.remote-visibility-delay", 15*time.Minute, "Time for an uploaded block to be visible to the readers of the bucket. Until then, the local copy of the block is not deleted when the disk utilization is high, so the queries keep reading it.")
+	f.Var(&cfg.ExternalLabels, "phlaredb.external-labels", "Comma-separated list of name=value labels identifying this instance, e.g. 'cluster=eu-west,zone=a'. They are added to the meta of the blocks and to the series which do not have them already, so blocks from different clusters stay distinguishable in the same bucket.")
+}
+
+// Validate validates the config.
+func (cfg *Config) Validate() error {
+	if _, err := parseRetentionRules(cfg.RetentionRules); err != nil {
+		return err
+	}
+	if cfg.BlockFormatVersion < 0 || block.MetaVersion(cfg.BlockFormatVersion) > block.MaxSupportedVersion {
+		return fmt.Errorf("block format version must be between 1 and %d", block.MaxSupportedVersion)
+	}
+	return cfg.ExternalLabels.Validate()
 }
 
 type fileSystem interface {
@@ -89,14 +136,32 @@ type PhlareDB struct {
 	stopCh chan struct{}
 	wg     sync.WaitGroup
 
+	// headLock is held for reading while a profile is appended to the head, so no profile is
+	// appended to a head once it has been cut.
 	headLock sync.RWMutex
 	head     *Head
+	// flushing are the cut heads which are still queried, until their block is loaded.
+	flushing []*Head
+	states   *blockStateTracker
+
+	// flushWG tracks the cut heads being flushed in the background, flushQueue bounds their
+	// number, flushSem the concurrency of their writes, and flushedCh notifies the loop once a
+	// block has been written. flushMtx orders the flushes started with their wait and with the
+	// shutdown, after which flushClosed is set and no flush is started anymore.
+	flushMtx    sync.Mutex
+	flushClosed bool
+	flushWG     sync.WaitGroup
+	flushQueue  chan struct{}
+	flushSem    chan struct{}
+	flushedCh   chan struct{}
 
 	volumeChecker diskutil.VolumeChecker
 	fs            fileSystem
 
 	blockQuerier *BlockQuerier
 	limiter      TenantLimiter
+
+	queryCaptures *queryCaptureWriter
 }
 
 func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareDB, error) {
@@ -104,6 +169,12 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 	if err != nil {
 		return nil, err
 	}
+	phlarectx = phlarecontext.WithLogger(phlarectx, log.With(phlarecontext.Logger(phlarectx), "component", "phlaredb"))
+
+	headFlushConcurrency := cfg.HeadFlushConcurrency
+	if headFlushConcurrency <= 0 {
+		headFlushConcurrency = 1
+	}
 
 	f := &PhlareDB{
 		cfg:    cfg,
@@ -113,8 +184,11 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 			minFreeDisk,
 			minDiskAvailablePercentage,
 		),
-		fs:      &realFileSystem{},
-		limiter: limiter,
+		fs:         &realFileSystem{},
+		limiter:    limiter,
+		flushQueue: make(chan struct{}, 2*headFlushConcurrency),
+		flushSem:   make(chan struct{}, headFlushConcurrency),
+		flushedCh:  make(chan struct{}, 1),
 	}
 	if err := os.MkdirAll(f.LocalDataPath(), 0o777); err != nil {
 		return nil, fmt.Errorf("mkdir %s: %w", f.LocalDataPath(), err)
@@ -124,6 +198,7 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 	// ensure head metrics are registered early so they are reused for the new head
 	phlarectx = contextWithHeadMetrics(phlarectx, newHeadMetrics(reg))
 	f.phlarectx = phlarectx
+	f.states = newBlockStateTracker(f.logger, reg, cfg.UploadBlocks, cfg.RemoteVisibilityDelay)
 	if _, err := f.initHead(); err != nil {
 		return nil, err
 	}
@@ -134,11 +209,18 @@ func New(phlarectx context.Context, cfg Config, limiter TenantLimiter) (*PhlareD
 
 	f.blockQuerier = NewBlockQuerier(phlarectx, bucketReader)
 
+	if cfg.QueryCapture {
+		if f.queryCaptures, err = openQueryCaptureWriter(filepath.Join(cfg.DataPath, queryCaptureFilename), f.logger); err != nil {
+			return nil, err
+		}
+	}
+
 	// do an initial querier sync
 	ctx := context.Background()
 	if err := f.blockQuerier.Sync(ctx); err != nil {
 		return nil, err
 	}
+	f.syncBlockStates()
 	return f, nil
 }
 
@@ -214,8 +296,16 @@ func (f *PhlareDB) cleanupBlocksWhenHighDiskUtilization(ctx context.Context) err
 			return err
 		}
 
+		// only the blocks visible in the bucket can be deleted, the others are still the only
+		// copy the queries read.
+		now := time.Now()
+		ulids = lo.Filter(ulids, func(id ulid.ULID, _ int) bool {
+			return f.states.deletable(id, now)
+		})
+
 		// nothing to delete, when there are no ulids
 		if len(ulids) == 0 {
+			level.Warn(f.logger).Log("msg", "disk utilization is high, but no block is visible in the bucket yet", "path", path)
 			break
 		}
 
@@ -234,6 +324,7 @@ func (f *PhlareDB) cleanupBlocksWhenHighDiskUtilization(ctx context.Context) err
 		if err := f.fs.RemoveAll(deletePath); err != nil {
 			return fmt.Errorf("failed to delete oldest block %s: %w", deletePath, err)
 		}
+		f.states.remove(ulids[0])
 		level.Warn(f.logger).Log("msg", "disk utilization is high, deleted oldest block", "path", deletePath)
 		lastStats = current
 		lastULID = ulids[0]
@@ -242,7 +333,123 @@ func (f *PhlareDB) cleanupBlocksWhenHighDiskUtilization(ctx context.Context) err
 	return nil
 }
 
+// DeleteUploadedBlocks deletes the local copy of the blocks uploaded to the bucket, and returns how
+// many were deleted. It frees the disk when there is no room left for the heads, at the cost of
+// losing the profiles of those blocks for the queries, which don't read the bucket.
+func (f *PhlareDB) DeleteUploadedBlocks(ctx context.Context) (int, error) {
+	ids, err := f.listLocalULID()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		path    = f.LocalDataPath()
+		now     = time.Now()
+		deleted int
+	)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return deleted, ctx.Err()
+		}
+		if !f.states.uploaded(id, now) {
+			continue
+		}
+		f.forgetBlock(id)
+		if err := f.fs.RemoveAll(filepath.Join(path, id.String())); err != nil {
+			return deleted, fmt.Errorf("failed to delete uploaded block %s: %w", id, err)
+		}
+		f.states.remove(id)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// cleanupBlocksExceedingRetention deletes local blocks whose most recent
+// profile is older than the configured retention period. With retention
+// rules, the expired profiles of the blocks which are still partially retained
+// are deleted by rewriting the blocks.
+func (f *PhlareDB) cleanupBlocksExceedingRetention(ctx context.Context) error {
+	if f.cfg.RetentionPeriod <= 0 && len(f.cfg.RetentionRules) == 0 {
+		return nil
+	}
+	rules, err := parseRetentionRules(f.cfg.RetentionRules)
+	if err != nil {
+		return err
+	}
+
+	path := f.LocalDataPath()
+	ulids, err := f.listLocalULID()
+	if err != nil {
+		return err
+	}
+
+	cutoffs := newRetentionCutoffs(rules, f.cfg.RetentionPeriod, time.Now())
+	minCutoff, maxCutoff := cutoffs.bounds()
+	for _, id := range ulids {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		blockPath := filepath.Join(path, id.String())
+		meta, err := f.readLocalMeta(blockPath)
+		if err != nil {
+			level.Warn(f.logger).Log("msg", "unable to read block meta, skipping retention check", "path", blockPath, "err", err)
+			continue
+		}
+		if meta.MaxTime >= model.TimeFromUnixNano(minCutoff) {
+			if len(rules) == 0 || meta.MinTime >= model.TimeFromUnixNano(maxCutoff) {
+				continue
+			}
+			if err := meta.CheckVersion(); err != nil {
+				level.Warn(f.logger).Log("msg", "unable to apply retention rules to block", "path", blockPath, "err", err)
+				continue
+			}
+			changed, empty, err := applyRetentionRules(ctx, f.logger, blockPath, meta, cutoffs)
+			if err != nil {
+				level.Error(f.logger).Log("msg", "failed to apply retention rules to block", "path", blockPath, "err", err)
+				continue
+			}
+			if !empty {
+				if changed {
+					f.forgetBlock(id)
+					level.Info(f.logger).Log("msg", "rewrote block without the profiles exceeding retention", "path", blockPath, "profiles", meta.Stats.NumProfiles)
+				}
+				continue
+			}
+		}
+
+		if err := f.fs.RemoveAll(blockPath); err != nil {
+			return fmt.Errorf("failed to delete block %s: %w", blockPath, err)
+		}
+		level.Info(f.logger).Log("msg", "deleted block exceeding retention period", "path", blockPath, "max_time", meta.MaxTime.Time().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// forgetBlock closes the querier of a block whose files have been rewritten.
+// The block is queried again with its new meta after the next sync.
+func (f *PhlareDB) forgetBlock(id ulid.ULID) {
+	if f.blockQuerier == nil {
+		return
+	}
+	if err := f.blockQuerier.forget(id); err != nil {
+		level.Warn(f.logger).Log("msg", "failed to close rewritten block", "block", id, "err", err)
+	}
+}
+
+func (f *PhlareDB) readLocalMeta(blockPath string) (*block.Meta, error) {
+	file, err := f.fs.Open(filepath.Join(blockPath, block.MetaFilename))
+	if err != nil {
+		return nil, err
+	}
+	return block.Read(file)
+}
+
 func (f *PhlareDB) runBlockQuerierSync(ctx context.Context) {
+	if err := f.cleanupBlocksExceedingRetention(ctx); err != nil {
+		level.Error(f.logger).Log("msg", "cleanup of blocks exceeding retention failed", "err", err)
+	}
+
 	if err := f.cleanupBlocksWhenHighDiskUtilization(ctx); err != nil {
 		level.Error(f.logger).Log("msg", "cleanup block check failed", "err", err)
 	}
@@ -250,10 +457,47 @@ func (f *PhlareDB) runBlockQuerierSync(ctx context.Context) {
 	if err := f.blockQuerier.Sync(ctx); err != nil {
 		level.Error(f.logger).Log("msg", "sync of blocks failed", "err", err)
 	}
+	f.syncBlockStates()
+}
+
+// SyncBlocks loads the local blocks added by others, such as the blocks restored from a snapshot,
+// without waiting for the next periodic sync.
+func (f *PhlareDB) SyncBlocks(ctx context.Context) error {
+	if err := f.blockQuerier.Sync(ctx); err != nil {
+		return err
+	}
+	f.syncBlockStates()
+	return nil
+}
+
+// syncBlockStates reconciles the states of the blocks with the local blocks.
+func (f *PhlareDB) syncBlockStates() {
+	ids, err := f.listLocalULID()
+	if err != nil {
+		level.Warn(f.logger).Log("msg", "unable to list the local blocks", "err", err)
+		return
+	}
+	f.states.sync(f.LocalDataPath(), ids, time.Now())
+}
+
+// BlockUploaded records the upload of the block to the bucket.
+func (f *PhlareDB) BlockUploaded(id ulid.ULID) {
+	f.states.set(id, BlockStateUploaded, time.Now())
+}
+
+// BlockState returns the state of the block, if it is known.
+func (f *PhlareDB) BlockState(id ulid.ULID) (BlockState, bool) {
+	return f.states.get(id, time.Now())
 }
 
 func (f *PhlareDB) loop() {
 	blockScanTicker := time.NewTicker(5 * time.Minute)
+	var blockEvictTicker <-chan time.Time
+	if f.cfg.BlockIdleTimeout > 0 || f.cfg.MaxOpenBlocksBytes > 0 {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		blockEvictTicker = t.C
+	}
 	defer func() {
 		blockScanTicker.Stop()
 		f.wg.Done()
@@ -266,13 +510,15 @@ func (f *PhlareDB) loop() {
 		case <-f.stopCh:
 			return
 		case <-f.Head().flushCh:
-			if err := f.Flush(ctx); err != nil {
-				level.Error(f.logger).Log("msg", "flushing head block failed", "err", err)
-				continue
+			if err := f.cutHead(ctx); err != nil {
+				level.Error(f.logger).Log("msg", "cutting head block failed", "err", err)
 			}
+		case <-f.flushedCh:
 			f.runBlockQuerierSync(ctx)
 		case <-blockScanTicker.C:
 			f.runBlockQuerierSync(ctx)
+		case <-blockEvictTicker:
+			f.blockQuerier.evictBlocks(time.Now(), f.cfg.BlockIdleTimeout, f.cfg.MaxOpenBlocksBytes)
 		}
 	}
 }
@@ -284,10 +530,17 @@ func (f *PhlareDB) Close() error {
 	}
 	close(f.stopCh)
 	f.wg.Wait()
+	f.flushMtx.Lock()
+	f.flushClosed = true
+	f.flushWG.Wait()
+	f.flushMtx.Unlock()
 	if err := f.blockQuerier.Close(); err != nil {
 		errs.Add(err)
 	}
 	f.limiter.Stop()
+	if f.queryCaptures != nil {
+		errs.Add(f.queryCaptures.Close())
+	}
 	return errs.Err()
 }
 
@@ -297,27 +550,90 @@ func (f *PhlareDB) Head() *Head {
 	return f.head
 }
 
+// Ingest appends the profile to the current head.
+func (f *PhlareDB) Ingest(ctx context.Context, p *profilev1.Profile, id uuid.UUID, externalLabels ...*typesv1.LabelPair) error {
+	f.headLock.RLock()
+	defer f.headLock.RUnlock()
+	return f.head.Ingest(ctx, p, id, externalLabels...)
+}
+
 func (f *PhlareDB) Queriers() Queriers {
-	block := f.blockQuerier.Queriers()
-	head := f.Head().Queriers()
+	queriers, release := f.queriers()
+	release()
+	return queriers
+}
+
+// queriers returns the queriers of the local blocks, of the cut heads not loaded as blocks yet and
+// of the head. The blocks are kept open and the heads are not flushed until the returned function
+// is called at the end of the query.
+//
+// A cut head is replaced by its block atomically: a query started while the head is being flushed
+// waits for its block to be loaded, so its profiles are neither missed nor counted twice.
+func (f *PhlareDB) queriers() (Queriers, func()) {
+	for {
+		f.headLock.RLock()
+		heads := make([]*Head, 0, len(f.flushing)+1)
+		heads = append(heads, f.flushing...)
+		heads = append(heads, f.head)
+		block, release := f.blockQuerier.acquireQueriers()
+		f.headLock.RUnlock()
+
+		acquired := make([]*Head, 0, len(heads))
+		for _, h := range heads {
+			h.queryLock.RLock()
+			acquired = append(acquired, h)
+			if h.flushed {
+				break
+			}
+		}
+		releaseAll := func() {
+			for _, h := range acquired {
+				h.queryLock.RUnlock()
+			}
+			release()
+		}
+		if last := acquired[len(acquired)-1]; last.flushed {
+			// the head has been replaced by its block since the queriers were listed.
+			releaseAll()
+			continue
+		}
 
-	res := make(Queriers, 0, len(block)+len(head))
-	res = append(res, block...)
-	res = append(res, head...)
+		res := make(Queriers, 0, len(block)+len(heads))
+		res = append(res, block...)
+		for _, h := range heads {
+			res = append(res, h.Queriers()...)
+		}
+		return res, releaseAll
+	}
+}
 
-	return res
+// queryContext returns the context of a query, recording the pages it reads to the metrics.
+func (f *PhlareDB) queryContext(ctx context.Context) context.Context {
+	return query.AddMetricsToContext(ctx, f.blockQuerier.metrics().query)
 }
 
 func (f *PhlareDB) MergeProfilesStacktraces(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse]) error {
-	return f.Queriers().MergeProfilesStacktraces(ctx, stream)
+	queriers, release := f.queriers()
+	defer release()
+	return f.captureQuery(f.queryContext(ctx), func(ctx context.Context) error {
+		return queriers.MergeProfilesStacktraces(ctx, stream)
+	})
 }
 
 func (f *PhlareDB) MergeProfilesLabels(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
-	return f.Queriers().MergeProfilesLabels(ctx, stream)
+	queriers, release := f.queriers()
+	defer release()
+	return f.captureQuery(f.queryContext(ctx), func(ctx context.Context) error {
+		return queriers.MergeProfilesLabels(ctx, stream)
+	})
 }
 
 func (f *PhlareDB) MergeProfilesPprof(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesPprofRequest, ingestv1.MergeProfilesPprofResponse]) error {
-	return f.Queriers().MergeProfilesPprof(ctx, stream)
+	queriers, release := f.queriers()
+	defer release()
+	return f.captureQuery(f.queryContext(ctx), func(ctx context.Context) error {
+		return queriers.MergeProfilesPprof(ctx, stream)
+	})
 }
 
 type BidiServerMerge[Res any, Req any] interface {
@@ -440,22 +756,128 @@ func filterProfiles[B BidiServerMerge[Res, Req],
 func (f *PhlareDB) initHead() (oldHead *Head, err error) {
 	f.headLock.Lock()
 	defer f.headLock.Unlock()
-	oldHead = f.head
-	f.head, err = NewHead(f.phlarectx, f.cfg, f.limiter)
+	head, err := NewHead(f.phlarectx, f.cfg, f.limiter)
 	if err != nil {
-		return oldHead, err
+		return nil, err
+	}
+	oldHead, f.head = f.head, head
+	if oldHead != nil {
+		f.flushing = append(f.flushing, oldHead)
+		f.states.set(oldHead.meta.ULID, BlockStateFlushing, time.Now())
 	}
 	return oldHead, nil
 }
 
+// Flush cuts the head and writes it to disk, and waits for the heads cut before to be written.
 func (f *PhlareDB) Flush(ctx context.Context) error {
 	oldHead, err := f.initHead()
 	if err != nil {
 		return err
 	}
+	defer f.waitFlushes()
 
 	if oldHead == nil {
 		return nil
 	}
-	return oldHead.Flush(ctx)
+	return f.flushHead(ctx, oldHead)
+}
+
+// waitFlushes waits for the cut heads being flushed in the background.
+func (f *PhlareDB) waitFlushes() {
+	f.flushMtx.Lock()
+	defer f.flushMtx.Unlock()
+	f.flushWG.Wait()
+}
+
+// cutHead replaces the head by a new one, and writes the cut head to disk in the background, so
+// the profiles pushed in the meantime are appended to the new head without waiting. When
+// 2*HeadFlushConcurrency cut heads are already waiting or being written, it waits for one of
+// them to be written first, and the current head keeps receiving the profiles meanwhile.
+func (f *PhlareDB) cutHead(ctx context.Context) error {
+	select {
+	case f.flushQueue <- struct{}{}:
+	case <-f.stopCh:
+		return nil
+	}
+	f.flushMtx.Lock()
+	defer f.flushMtx.Unlock()
+	if f.flushClosed {
+		<-f.flushQueue
+		return nil
+	}
+	oldHead, err := f.initHead()
+	if err != nil || oldHead == nil {
+		<-f.flushQueue
+		return err
+	}
+	f.flushWG.Add(1)
+	go func() {
+		defer func() {
+			<-f.flushQueue
+			f.flushWG.Done()
+		}()
+		if err := f.flushHead(ctx, oldHead); err != nil {
+			level.Error(f.logger).Log("msg", "flushing head block failed", "block", oldHead.meta.ULID, "err", err)
+			return
+		}
+		select {
+		case f.flushedCh <- struct{}{}:
+		default:
+		}
+	}()
+	return nil
+}
+
+// flushHead writes the cut head to disk, once fewer than HeadFlushConcurrency heads are being
+// written, and replaces it by its block in the queries.
+func (f *PhlareDB) flushHead(ctx context.Context, h *Head) error {
+	select {
+	case f.flushSem <- struct{}{}:
+	case <-ctx.Done():
+		f.handOver(h, false)
+		return ctx.Err()
+	}
+	defer func() { <-f.flushSem }()
+
+	// the profiles left in memory are written to a row group first, once the queries of the head
+	// are done: they would miss them. The head is queried while its block is written.
+	h.queryLock.Lock()
+	err := h.profiles.cut()
+	h.queryLock.Unlock()
+	if err != nil {
+		f.handOver(h, false)
+		return err
+	}
+	empty := h.profiles.empty()
+	if err := h.Flush(ctx); err != nil {
+		f.handOver(h, false)
+		return err
+	}
+	f.handOver(h, !empty)
+	return nil
+}
+
+// handOver removes the cut head from the queries, once its block is loaded if it has been written.
+// The queries of the head are waited for, and the new ones wait until its block is loaded.
+func (f *PhlareDB) handOver(h *Head, written bool) {
+	h.queryLock.Lock()
+	defer h.queryLock.Unlock()
+	if written {
+		// the block is loaded even when the flush is canceled, the head is not queried anymore.
+		if err := f.blockQuerier.Sync(context.Background()); err != nil {
+			level.Error(f.logger).Log("msg", "sync of blocks failed", "block", h.meta.ULID, "err", err)
+		}
+		f.states.set(h.meta.ULID, BlockStateLocal, time.Now())
+	} else {
+		f.states.remove(h.meta.ULID)
+	}
+
+	f.headLock.Lock()
+	h.flushed = true
+	f.flushing = lo.Without(f.flushing, h)
+	f.headLock.Unlock()
+
+	if err := h.profiles.releaseRowGroups(); err != nil {
+		level.Warn(f.logger).Log("msg", "failed to release the row groups of the head", "block", h.meta.ULID, "err", err)
+	}
 }
@@ -7,7 +7,9 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,9 +17,12 @@ import (
 	"github.com/go-kit/log"
 	"github.com/google/pprof/profile"
 	"github.com/google/uuid"
+	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
@@ -29,6 +34,7 @@ import (
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 	"github.com/grafana/phlare/pkg/testhelper"
 	diskutil "github.com/grafana/phlare/pkg/util/disk"
@@ -128,6 +134,34 @@ func (i *ingesterHandlerPhlareDB) Flush(context.Context, *connect.Request[ingest
 	return nil, errors.New("not implemented")
 }
 
+func (i *ingesterHandlerPhlareDB) StorageUsage(context.Context, *connect.Request[ingestv1.StorageUsageRequest]) (*connect.Response[ingestv1.StorageUsageResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) SelectProfileIDs(context.Context, *connect.Request[ingestv1.SelectProfileIDsRequest]) (*connect.Response[ingestv1.SelectProfileIDsResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) GetProfile(context.Context, *connect.Request[ingestv1.GetProfileRequest]) (*connect.Response[ingestv1.GetProfileResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) SelectHistograms(context.Context, *connect.Request[ingestv1.SelectHistogramsRequest]) (*connect.Response[ingestv1.SelectHistogramsResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) SelectTargetMetadata(context.Context, *connect.Request[ingestv1.SelectTargetMetadataRequest]) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) BlockMetadata(context.Context, *connect.Request[ingestv1.BlockMetadataRequest]) (*connect.Response[ingestv1.BlockMetadataResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
+func (i *ingesterHandlerPhlareDB) Capabilities(context.Context, *connect.Request[ingestv1.CapabilitiesRequest]) (*connect.Response[ingestv1.CapabilitiesResponse], error) {
+	return nil, errors.New("not implemented")
+}
+
 func TestMergeProfilesStacktraces(t *testing.T) {
 	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
 
@@ -219,6 +253,63 @@ func TestMergeProfilesStacktraces(t *testing.T) {
 		require.Nil(t, resp.SelectedProfiles)
 	})
 
+	t.Run("merge several requests at once", func(t *testing.T) {
+		bidi := client.MergeProfilesStacktraces(ctx)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Requests: []*ingestv1.SelectProfilesRequest{
+				{
+					LabelSelector: `{pod="my-pod"}`,
+					Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+					Start:         start.UnixMilli(),
+					End:           end.UnixMilli(),
+				},
+				{
+					LabelSelector: `{namespace="my-namespace"}`,
+					Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+					Start:         start.UnixMilli(),
+					End:           start.UnixMilli() + 1,
+				},
+				{
+					LabelSelector: `{pod="not-my-pod"}`,
+					Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+					Start:         start.UnixMilli(),
+					End:           end.UnixMilli(),
+				},
+			},
+		}))
+
+		// the profiles matching several requests are selected once.
+		resp, err := bidi.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.SelectedProfiles.LabelsSets, 1)
+		require.Len(t, resp.SelectedProfiles.Profiles, 5)
+
+		require.NoError(t, bidi.Send(&ingestv1.MergeProfilesStacktracesRequest{
+			Profiles: []bool{true, true, true, true, true},
+		}))
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Results)
+
+		resp, err = bidi.Receive()
+		require.NoError(t, err)
+		require.Nil(t, resp.Result)
+		require.Len(t, resp.Results, 3)
+		total := func(r *ingestv1.MergeProfilesStacktracesResult) (total int64) {
+			for _, s := range r.Stacktraces {
+				total += s.Value
+			}
+			return total
+		}
+		require.Len(t, resp.Results[0].Stacktraces, 48)
+		require.Len(t, resp.Results[1].Stacktraces, 48)
+		// the profiles are identical: the second request selects one of the five.
+		require.Equal(t, total(resp.Results[0]), 5*total(resp.Results[1]))
+		require.Empty(t, resp.Results[2].Stacktraces)
+	})
+
 	t.Run("empty request fails", func(t *testing.T) {
 		bidi := client.MergeProfilesStacktraces(ctx)
 
@@ -492,6 +583,8 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 		mock     func(fs *fakeVolumeFS)
 		logLines []string
 		err      string
+		// remote are the blocks visible in the bucket, when the blocks are uploaded.
+		remote []string
 	}{
 		{
 			name: "no-high-disk-utilization",
@@ -588,6 +681,28 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 				`{"level":"warn", "msg":"disk utilization is high, deleted oldest block", "path":"local/01AA0000000000000000000000"}`,
 			},
 		},
+		{
+			name:   "high-disk-utilization-delete-only-remote-blocks",
+			remote: []string{"01AB" + suffix},
+			mock: func(fakeFS *fakeVolumeFS) {
+				fakeFS.On("HasHighDiskUtilization", "local").Return(&diskutil.VolumeStats{HighDiskUtilization: true, BytesAvailable: 10}, nil).Once()
+				fakeFS.On("ReadDir", mock.Anything).Return([]fs.DirEntry{
+					&fakeFile{"01AC" + suffix, true},
+					&fakeFile{"01AB" + suffix, true},
+					&fakeFile{"01AA" + suffix, true},
+				}, nil).Once()
+				fakeFS.On("RemoveAll", "local/01AB"+suffix).Return(nil).Once()
+				fakeFS.On("HasHighDiskUtilization", "local").Return(&diskutil.VolumeStats{HighDiskUtilization: true, BytesAvailable: 11}, nil).Once()
+				fakeFS.On("ReadDir", mock.Anything).Return([]fs.DirEntry{
+					&fakeFile{"01AC" + suffix, true},
+					&fakeFile{"01AA" + suffix, true},
+				}, nil).Once()
+			},
+			logLines: []string{
+				`{"level":"warn", "msg":"disk utilization is high, deleted oldest block", "path":"local/01AB0000000000000000000000"}`,
+				`{"level":"warn", "msg":"disk utilization is high, but no block is visible in the bucket yet", "path":"local"}`,
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			var (
@@ -601,6 +716,10 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 				logger:        logger,
 				volumeChecker: fakeFS,
 				fs:            fakeFS,
+				states:        newBlockStateTracker(log.NewNopLogger(), nil, tc.remote != nil, 0),
+			}
+			for _, id := range tc.remote {
+				db.states.set(ulid.MustParse(id), BlockStateUploaded, time.Now())
 			}
 
 			tc.mock(fakeFS)
@@ -622,3 +741,533 @@ func TestPhlareDB_cleanupBlocksWhenHighDiskUtilization(t *testing.T) {
 		})
 	}
 }
+
+func TestPhlareDB_cleanupBlocksExceedingRetention(t *testing.T) {
+	var (
+		dataPath = t.TempDir()
+		now      = time.Now()
+		db       = &PhlareDB{
+			logger: log.NewNopLogger(),
+			fs:     &realFileSystem{},
+			cfg: Config{
+				DataPath:        dataPath,
+				RetentionPeriod: 24 * time.Hour,
+			},
+		}
+	)
+
+	writeBlock := func(maxTime time.Time) string {
+		meta := block.NewMeta()
+		meta.MinTime = model.TimeFromUnixNano(maxTime.Add(-time.Hour).UnixNano())
+		meta.MaxTime = model.TimeFromUnixNano(maxTime.UnixNano())
+		dir := filepath.Join(db.LocalDataPath(), meta.ULID.String())
+		require.NoError(t, os.MkdirAll(dir, 0o777))
+		_, err := meta.WriteToFile(db.logger, dir)
+		require.NoError(t, err)
+		return dir
+	}
+
+	expired := writeBlock(now.Add(-48 * time.Hour))
+	retained := writeBlock(now.Add(-time.Hour))
+
+	require.NoError(t, db.cleanupBlocksExceedingRetention(context.Background()))
+
+	require.NoDirExists(t, expired)
+	require.DirExists(t, retained)
+}
+
+func TestPhlareDB_retentionRules(t *testing.T) {
+	var (
+		ctx = context.Background()
+		now = time.Now()
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+		RetentionRules: []RetentionRule{
+			{Selector: `{env="dev"}`, Period: 3 * 24 * time.Hour},
+			{Selector: `{env="prod"}`, Period: 30 * 24 * time.Hour},
+		},
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+	require.NoError(t, db.cfg.Validate())
+
+	from, to := now.Add(-108*time.Hour).UnixNano(), now.Add(-12*time.Hour).UnixNano()
+	for _, env := range []string{"dev", "prod", "staging"} {
+		ingestProfiles(t, db, cpuProfileGenerator, from, to, 24*time.Hour, &typesv1.LabelPair{Name: "env", Value: env})
+	}
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	id := db.blockQuerier.queriers[0].meta.ULID
+
+	require.NoError(t, db.cleanupBlocksExceedingRetention(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	q := db.blockQuerier.queriers[0]
+	require.Equal(t, id, q.meta.ULID)
+	require.Equal(t, uint64(26), q.meta.Stats.NumProfiles) // the profiles have two sample types.
+	require.Equal(t, uint64(6), q.meta.Stats.NumSeries)
+
+	selectProfiles := func() iter.Iterator[Profile] {
+		it, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+			LabelSelector: `{}`,
+			Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+			Start:         int64(model.TimeFromUnixNano(from)),
+			End:           int64(model.TimeFromUnixNano(to)) + 1,
+		})
+		require.NoError(t, err)
+		return it
+	}
+	profilesPerEnv := map[string]int{}
+	it := selectProfiles()
+	for it.Next() {
+		p := it.At()
+		env := p.Labels().Get("env")
+		profilesPerEnv[env]++
+		if env == "dev" {
+			require.GreaterOrEqual(t, p.Timestamp(), model.TimeFromUnixNano(now.Add(-3*24*time.Hour).UnixNano()))
+		}
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, map[string]int{"dev": 3, "prod": 5, "staging": 5}, profilesPerEnv)
+
+	// the histograms are rebuilt from the kept profiles.
+	histograms, complete, err := Queriers{q}.selectHistograms(ctx, &ingestv1.SelectHistogramsRequest{
+		LabelSelector: `{env="dev"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         int64(model.TimeFromUnixNano(from)),
+		End:           int64(model.TimeFromUnixNano(to)) + phlaremodel.HistogramSlot.Milliseconds(),
+	})
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Len(t, histograms, 1)
+	require.Len(t, histograms[0].Histograms, 3)
+
+	// the symbols of the rewritten block are still resolved.
+	stacktraces, err := q.MergeByStacktraces(ctx, selectProfiles())
+	require.NoError(t, err)
+	require.NotEmpty(t, stacktraces.Stacktraces)
+
+	// the block is not rewritten again.
+	meta, err := db.readLocalMeta(filepath.Join(db.LocalDataPath(), id.String()))
+	require.NoError(t, err)
+	changed, _, err := applyRetentionRules(ctx, db.logger, filepath.Join(db.LocalDataPath(), id.String()), meta, newRetentionCutoffs([]retentionRule{{
+		matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "dev")},
+		period:   3 * 24 * time.Hour,
+	}}, 0, now))
+	require.NoError(t, err)
+	require.False(t, changed)
+}
+
+func TestPhlareDB_StorageUsage(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, int64(time.Hour))
+		end   = start.Add(4 * time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), time.Minute, &typesv1.LabelPair{Name: "service_name", Value: "api"})
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 2*time.Minute, &typesv1.LabelPair{Name: "service_name", Value: "db"})
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 4*time.Minute)
+
+	storageUsage := func(start, end time.Time) map[string]*ingestv1.LabelValueUsage {
+		resp, err := db.StorageUsage(ctx, connect.NewRequest(&ingestv1.StorageUsageRequest{
+			LabelName: "service_name",
+			Start:     start.UnixMilli(),
+			End:       end.UnixMilli(),
+		}))
+		require.NoError(t, err)
+		usage := make(map[string]*ingestv1.LabelValueUsage)
+		for _, u := range resp.Msg.Usage {
+			usage[u.Value] = u
+		}
+		return usage
+	}
+
+	// the head is not accounted for.
+	require.Empty(t, storageUsage(start, end))
+
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	meta := db.blockQuerier.queriers[0].meta
+	var blockBytes uint64
+	for _, f := range meta.Files {
+		blockBytes += f.SizeBytes
+	}
+
+	// the profiles have two sample types.
+	usage := storageUsage(start, end)
+	require.Len(t, usage, 3)
+	require.Equal(t, uint64(10), usage["api"].Profiles)
+	require.Equal(t, uint64(6), usage["db"].Profiles)
+	require.Equal(t, uint64(4), usage[""].Profiles)
+	require.Equal(t, blockBytes*10/20, usage["api"].Bytes)
+	require.Equal(t, blockBytes*6/20, usage["db"].Bytes)
+	require.Equal(t, blockBytes*4/20, usage[""].Bytes)
+
+	usage = storageUsage(start.Add(time.Minute), start.Add(3*time.Minute))
+	require.Len(t, usage, 2)
+	require.Equal(t, uint64(6), usage["api"].Profiles)
+	require.Equal(t, uint64(2), usage["db"].Profiles)
+
+	require.Empty(t, storageUsage(end.Add(time.Hour), end.Add(2*time.Hour)))
+}
+
+func TestPhlareDB_ProfileIDs(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, int64(time.Hour))
+		ids   = []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	for i, id := range ids {
+		p, name := cpuProfileGenerator(start.Add(time.Duration(i)*time.Minute).UnixNano(), t)
+		require.NoError(t, db.Head().Ingest(ctx, p, id, &typesv1.LabelPair{Name: model.MetricNameLabel, Value: name}))
+	}
+	profileType, err := phlaremodel.ParseProfileTypeSelector("process_cpu:cpu:nanoseconds:cpu:nanoseconds")
+	require.NoError(t, err)
+
+	assertProfiles := func(t *testing.T) {
+		t.Helper()
+		resp, err := db.SelectProfileIDs(ctx, connect.NewRequest(&ingestv1.SelectProfileIDsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          profileType,
+				Start:         start.UnixMilli(),
+				End:           start.Add(time.Hour).UnixMilli(),
+			},
+			Limit: 2,
+		}))
+		require.NoError(t, err)
+		require.Len(t, resp.Msg.Profiles, 2)
+		require.Equal(t, ids[2].String(), resp.Msg.Profiles[0].ID)
+		require.Equal(t, ids[1].String(), resp.Msg.Profiles[1].ID)
+		require.Equal(t, start.Add(2*time.Minute).UnixMilli(), resp.Msg.Profiles[0].Timestamp)
+
+		get, err := db.GetProfile(ctx, connect.NewRequest(&ingestv1.GetProfileRequest{
+			Type:  profileType,
+			ID:    ids[1].String(),
+			Start: start.UnixMilli(),
+			End:   start.Add(time.Hour).UnixMilli(),
+		}))
+		require.NoError(t, err)
+		p, err := profile.ParseUncompressed(get.Msg.Result)
+		require.NoError(t, err)
+		types := make([]string, 0, len(p.SampleType))
+		for _, st := range p.SampleType {
+			types = append(types, st.Type)
+		}
+		require.ElementsMatch(t, []string{"samples", "cpu"}, types)
+		require.Equal(t, "cpu", p.DefaultSampleType)
+		for _, s := range p.Sample {
+			require.Len(t, s.Value, len(p.SampleType))
+		}
+		require.Equal(t, start.Add(time.Minute).UnixNano(), p.TimeNanos)
+		require.NotEmpty(t, p.Sample)
+
+		get, err = db.GetProfile(ctx, connect.NewRequest(&ingestv1.GetProfileRequest{
+			Type:  profileType,
+			ID:    uuid.New().String(),
+			Start: start.UnixMilli(),
+			End:   start.Add(time.Hour).UnixMilli(),
+		}))
+		require.NoError(t, err)
+		require.Empty(t, get.Msg.Result)
+	}
+
+	t.Run("head", assertProfiles)
+
+	profiles := db.Head().profiles
+	profiles.lock.Lock()
+	require.NoError(t, profiles.cutRowGroup())
+	profiles.lock.Unlock()
+	t.Run("head on disk", assertProfiles)
+
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	t.Run("block", assertProfiles)
+}
+
+func TestPhlareDB_Histograms(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, int64(time.Hour))
+		end   = start.Add(4 * time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 20*time.Second, &typesv1.LabelPair{Name: "service_name", Value: "api"})
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), time.Minute, &typesv1.LabelPair{Name: "service_name", Value: "db"})
+	profileType, err := phlaremodel.ParseProfileTypeSelector("process_cpu:cpu:nanoseconds:cpu:nanoseconds")
+	require.NoError(t, err)
+	p, _ := cpuProfileGenerator(0, t)
+	var total int64
+	for _, s := range p.Sample {
+		total += s.Value[1]
+	}
+
+	selectHistograms := func(selector string, start, end time.Time) *ingestv1.SelectHistogramsResponse {
+		resp, err := db.SelectHistograms(ctx, connect.NewRequest(&ingestv1.SelectHistogramsRequest{
+			LabelSelector: selector,
+			Type:          profileType,
+			Start:         start.UnixMilli(),
+			End:           end.UnixMilli(),
+		}))
+		require.NoError(t, err)
+		return resp.Msg
+	}
+	assertHistograms := func(t *testing.T) {
+		resp := selectHistograms(`{service_name="api"}`, start, end)
+		require.True(t, resp.Complete)
+		require.Len(t, resp.Series, 1)
+		// a profile every 20s, in the slots of 15s ending at them or after them.
+		var (
+			timestamps []int64
+			count      uint64
+		)
+		for _, h := range resp.Series[0].Histograms {
+			timestamps = append(timestamps, h.Timestamp-start.UnixMilli())
+			count += h.Count
+			require.Equal(t, total*int64(h.Count), h.Sum)
+			require.Equal(t, total, h.Min)
+			require.Equal(t, total, h.Max)
+			require.Equal(t, []*ingestv1.HistogramBucket{{Index: phlaremodel.HistogramBucketIndex(float64(total)), Count: h.Count}}, h.Buckets)
+		}
+		require.Equal(t, []int64{0, 30000, 45000, 60000, 90000, 105000, 120000, 150000, 165000, 180000, 210000, 225000, 240000}, timestamps)
+		require.Equal(t, uint64(13), count)
+
+		resp = selectHistograms(`{}`, start.Add(time.Minute), start.Add(2*time.Minute))
+		require.True(t, resp.Complete)
+		require.Len(t, resp.Series, 2)
+
+		require.Empty(t, selectHistograms(`{}`, end.Add(time.Hour), end.Add(2*time.Hour)).Series)
+	}
+
+	t.Run("head", assertHistograms)
+
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	require.NotNil(t, db.blockQuerier.queriers[0].meta.FileByRelPath("histograms.parquet"))
+	t.Run("block", assertHistograms)
+
+	// the blocks without histograms don't cover the time range.
+	db.blockQuerier.queriers[0].meta.Files = nil
+	require.False(t, selectHistograms(`{}`, start, end).Complete)
+}
+
+func TestPhlareDB_TargetMetadata(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, int64(time.Hour))
+		end   = start.Add(4 * time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	// the api is upgraded to v2 after 2 minutes, then rolled back to v1 after 3 minutes.
+	for ts := start; !ts.After(end); ts = ts.Add(30 * time.Second) {
+		version := "v1"
+		if ts.Sub(start) >= 2*time.Minute && ts.Sub(start) < 3*time.Minute {
+			version = "v2"
+		}
+		p, name := cpuProfileGenerator(ts.UnixNano(), t)
+		lbls := []*typesv1.LabelPair{{Name: "service_name", Value: "api"}, {Name: model.MetricNameLabel, Value: name}}
+		require.NoError(t, db.Ingest(ctx, p, uuid.New(), lbls...))
+		db.IngestTargetMetadata(p, []*typesv1.LabelPair{
+			{Name: "build_version", Value: version},
+			{Name: "go_version", Value: "go1.19"},
+		}, lbls...)
+	}
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), time.Minute, &typesv1.LabelPair{Name: "service_name", Value: "db"})
+
+	selectTargetMetadata := func(selector string, start, end time.Time) []*ingestv1.SeriesTargetMetadata {
+		resp, err := db.SelectTargetMetadata(ctx, connect.NewRequest(&ingestv1.SelectTargetMetadataRequest{
+			LabelSelector: selector,
+			Start:         start.UnixMilli(),
+			End:           end.UnixMilli(),
+		}))
+		require.NoError(t, err)
+		return resp.Msg.Series
+	}
+	assertTargetMetadata := func(t *testing.T) {
+		series := selectTargetMetadata(`{service_name="api"}`, start, end)
+		// a series per sample type of the profiles.
+		require.Len(t, series, 2)
+		for _, s := range series {
+			require.Equal(t, "api", phlaremodel.Labels(s.Labels).Get("service_name"))
+			ms := start.UnixMilli()
+			require.Equal(t, []*typesv1.TargetMetadata{
+				{Name: "build_version", Value: "v1", FirstSeen: ms, LastSeen: ms + 90000},
+				{Name: "build_version", Value: "v2", FirstSeen: ms + 120000, LastSeen: ms + 150000},
+				{Name: "build_version", Value: "v1", FirstSeen: ms + 180000, LastSeen: ms + 240000},
+				{Name: "go_version", Value: "go1.19", FirstSeen: ms, LastSeen: ms + 240000},
+			}, phlaremodel.MergeTargetMetadata(s.Metadata))
+		}
+
+		series = selectTargetMetadata(`{}`, start.Add(2*time.Minute), start.Add(150*time.Second))
+		require.Len(t, series, 2)
+		for _, s := range series {
+			require.Len(t, s.Metadata, 2)
+		}
+
+		require.Empty(t, selectTargetMetadata(`{service_name="db"}`, start, end))
+		require.Empty(t, selectTargetMetadata(`{}`, end.Add(time.Hour), end.Add(2*time.Hour)))
+	}
+
+	t.Run("head", assertTargetMetadata)
+
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Len(t, db.blockQuerier.queriers, 1)
+	require.NotNil(t, db.blockQuerier.queriers[0].meta.FileByRelPath("target_metadata.parquet"))
+	t.Run("block", assertTargetMetadata)
+}
+
+func TestPhlareDB_CutHeadWhileIngesting(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		start = time.Unix(0, int64(time.Hour))
+	)
+	db, err := New(ctx, Config{
+		DataPath:             t.TempDir(),
+		MaxBlockDuration:     time.Duration(100000) * time.Minute, // we will manually cut
+		HeadFlushConcurrency: 2,
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	profileType, err := phlaremodel.ParseProfileTypeSelector("process_cpu:cpu:nanoseconds:cpu:nanoseconds")
+	require.NoError(t, err)
+	countProfiles := func() int {
+		resp, err := db.SelectProfileIDs(ctx, connect.NewRequest(&ingestv1.SelectProfileIDsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: `{}`,
+				Type:          profileType,
+				Start:         start.UnixMilli(),
+				End:           start.Add(time.Hour).UnixMilli(),
+			},
+		}))
+		require.NoError(t, err)
+		return len(resp.Msg.Profiles)
+	}
+
+	const workers, profilesPerWorker = 4, 25
+	// the queries run while the heads are cut and written: the profiles are neither missed nor
+	// counted twice.
+	stopQueries := make(chan struct{})
+	queriesDone := make(chan struct{})
+	go func() {
+		defer close(queriesDone)
+		var last int
+		for {
+			select {
+			case <-stopQueries:
+				return
+			default:
+			}
+			n := countProfiles()
+			assert.GreaterOrEqual(t, n, last)
+			assert.LessOrEqual(t, n, workers*profilesPerWorker)
+			last = n
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < profilesPerWorker; i++ {
+				p, name := cpuProfileGenerator(start.Add(time.Duration(w*profilesPerWorker+i)*time.Second).UnixNano(), t)
+				require.NoError(t, db.Ingest(ctx, p, uuid.New(), &typesv1.LabelPair{Name: model.MetricNameLabel, Value: name}))
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.cutHead(ctx))
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	// flushing waits for the heads cut before.
+	require.NoError(t, db.Flush(ctx))
+	close(stopQueries)
+	<-queriesDone
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+	require.Equal(t, workers*profilesPerWorker, countProfiles())
+}
+
+func TestPhlareDB_CutHeadQueueFull(t *testing.T) {
+	ctx := context.Background()
+	db, err := New(ctx, Config{
+		DataPath:             t.TempDir(),
+		MaxBlockDuration:     time.Duration(100000) * time.Minute, // we will manually cut
+		HeadFlushConcurrency: 1,
+	}, NoLimit)
+	require.NoError(t, err)
+
+	// the queue is full, as if two cut heads were waiting to be written.
+	db.flushQueue <- struct{}{}
+	db.flushQueue <- struct{}{}
+	head := db.Head()
+	done := make(chan error)
+	go func() { done <- db.cutHead(ctx) }()
+	select {
+	case <-done:
+		t.Fatal("the head was cut while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.Equal(t, head, db.Head())
+
+	<-db.flushQueue
+	require.NoError(t, <-done)
+	require.NotEqual(t, head, db.Head())
+
+	// the shutdown doesn't wait for the queue.
+	db.waitFlushes()
+	db.flushQueue <- struct{}{}
+	head = db.Head()
+	go func() { done <- db.cutHead(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, db.Close())
+	require.NoError(t, <-done)
+	require.Equal(t, head, db.Head())
+}
@@ -0,0 +1,83 @@
+package phlaredb
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// maxCachedPostings is the number of selectors whose postings are cached per block.
+const maxCachedPostings = 128
+
+// postingsCache caches the postings of the recent selectors of a block, so that the same
+// dashboard queries don't evaluate their regular expressions against the label values of the
+// block again. The index of a block is immutable, so the postings never change while it's open.
+type postingsCache struct {
+	mtx     sync.Mutex
+	lru     *list.List // of *cachedPostings, the most recently used first.
+	entries map[string]*list.Element
+}
+
+type cachedPostings struct {
+	key  string
+	refs []storage.SeriesRef
+}
+
+func newPostingsCache() *postingsCache {
+	return &postingsCache{
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// postingsForMatchers returns the postings of the matchers from the cache, or reads them from
+// the index and caches them.
+func (c *postingsCache) postingsForMatchers(ix IndexReader, metrics *blocksMetrics, matchers ...*labels.Matcher) (index.Postings, error) {
+	key := matchersKey(matchers)
+	c.mtx.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		refs := e.Value.(*cachedPostings).refs
+		c.mtx.Unlock()
+		metrics.postingsCacheLookups.WithLabelValues("hit").Inc()
+		return iter.NewSliceSeekIterator(refs), nil
+	}
+	c.mtx.Unlock()
+	metrics.postingsCacheLookups.WithLabelValues("miss").Inc()
+
+	postings, err := PostingsForMatchers(ix, nil, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	refs, err := index.ExpandPostings(postings)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.entries[key] = c.lru.PushFront(&cachedPostings{key: key, refs: refs})
+		if c.lru.Len() > maxCachedPostings {
+			delete(c.entries, c.lru.Remove(c.lru.Back()).(*cachedPostings).key)
+		}
+	}
+	return iter.NewSliceSeekIterator(refs), nil
+}
+
+func matchersKey(matchers []*labels.Matcher) string {
+	var b strings.Builder
+	for i, m := range matchers {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(m.String())
+	}
+	return b.String()
+}
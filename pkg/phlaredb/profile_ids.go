@@ -0,0 +1,379 @@
+package phlaredb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/segmentio/parquet-go"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/query"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// SelectProfileIDs returns the IDs of the profiles matching the request, the most recent first.
+func (f *PhlareDB) SelectProfileIDs(ctx context.Context, req *connect.Request[ingestv1.SelectProfileIDsRequest]) (*connect.Response[ingestv1.SelectProfileIDsResponse], error) {
+	if req.Msg.Request == nil || req.Msg.Request.Type == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing select request"))
+	}
+	queriers, release := f.queriers()
+	defer release()
+	profiles, err := queriers.selectProfileIDs(f.queryContext(ctx), req.Msg.Request, req.Msg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&ingestv1.SelectProfileIDsResponse{Profiles: profiles}), nil
+}
+
+// GetProfile returns the profile with the requested ID in the pprof format, or an empty result
+// when the profile is not found.
+func (f *PhlareDB) GetProfile(ctx context.Context, req *connect.Request[ingestv1.GetProfileRequest]) (*connect.Response[ingestv1.GetProfileResponse], error) {
+	if req.Msg.Type == nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("missing profile type"))
+	}
+	id, err := uuid.Parse(req.Msg.ID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "invalid profile ID"))
+	}
+	queriers, release := f.queriers()
+	defer release()
+	p, err := queriers.getProfile(f.queryContext(ctx), id, req.Msg.Type, model.Time(req.Msg.Start), model.Time(req.Msg.End))
+	if err != nil || p == nil {
+		return connect.NewResponse(&ingestv1.GetProfileResponse{}), err
+	}
+	// connect go already handles compression.
+	var buf bytes.Buffer
+	if err := p.WriteUncompressed(&buf); err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&ingestv1.GetProfileResponse{Result: buf.Bytes()}), nil
+}
+
+// selectProfileIDs returns the profiles matching the request with their IDs, but without their
+// stacktraces, the most recent first. At most limit profiles are returned when limit is positive.
+func (q Queriers) selectProfileIDs(ctx context.Context, params *ingestv1.SelectProfilesRequest, limit int64) ([]*ingestv1.Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectProfileIDs")
+	defer sp.Finish()
+	sp.LogFields(
+		otlog.String("start", model.Time(params.Start).Time().String()),
+		otlog.String("end", model.Time(params.End).Time().String()),
+		otlog.String("selector", params.LabelSelector),
+		otlog.String("profile_id", params.Type.ID),
+	)
+
+	var result []*ingestv1.Profile
+	for _, querier := range q.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		it, err := querier.SelectMatchingProfiles(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && int64(len(profiles)) > limit {
+			sortMostRecentFirst(profiles)
+			profiles = profiles[:limit]
+		}
+		profiles = querier.Sort(profiles)
+		ids, err := querier.ProfileIDs(ctx, iter.NewSliceIterator(profiles))
+		if err != nil {
+			return nil, err
+		}
+		for i, p := range profiles {
+			result = append(result, &ingestv1.Profile{
+				ID:        ids[i].String(),
+				Type:      params.Type,
+				Labels:    p.Labels(),
+				Timestamp: int64(p.Timestamp()),
+			})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Timestamp != result[j].Timestamp {
+			return result[i].Timestamp > result[j].Timestamp
+		}
+		return result[i].ID < result[j].ID
+	})
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+// getProfile rebuilds the profile with the given ID from the queriers in the time range, with all
+// the sample types of the profile ingested, the requested one being the default. It returns nil
+// when no querier stores the profile.
+func (q Queriers) getProfile(ctx context.Context, id uuid.UUID, profileType *typesv1.ProfileType, start, end model.Time) (*profile.Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "GetProfile")
+	defer sp.Finish()
+	sp.LogFields(otlog.String("id", id.String()))
+
+	var (
+		parts []*profile.Profile
+		types = make(map[string]struct{})
+	)
+	for _, querier := range q.ForTimeRange(start, end) {
+		rows, err := querier.SelectProfileByID(ctx, profileType.Name, id, start, end)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			typeID := row.Labels().Get(phlaremodel.LabelNameProfileType)
+			if _, ok := types[typeID]; ok {
+				continue
+			}
+			types[typeID] = struct{}{}
+			t, err := phlaremodel.ParseProfileTypeSelector(typeID)
+			if err != nil {
+				return nil, err
+			}
+			p, err := querier.MergePprof(ctx, iter.NewSliceIterator([]Profile{row}))
+			if err != nil {
+				return nil, err
+			}
+			setPprofType(p, t, row.Timestamp())
+			parts = append(parts, p)
+		}
+	}
+	if len(parts) == 0 {
+		return nil, nil
+	}
+	p, err := mergeSampleTypes(parts)
+	if err != nil {
+		return nil, err
+	}
+	p.DefaultSampleType = profileType.SampleType
+	return p, nil
+}
+
+// mergeSampleTypes merges profiles of a single sample type each into a profile of all their
+// sample types, sorted by type.
+func mergeSampleTypes(parts []*profile.Profile) (*profile.Profile, error) {
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].SampleType[0].Type < parts[j].SampleType[0].Type
+	})
+	sampleTypes := make([]*profile.ValueType, len(parts))
+	for i, p := range parts {
+		sampleTypes[i] = p.SampleType[0]
+	}
+	for i, p := range parts {
+		p.SampleType = sampleTypes
+		for _, s := range p.Sample {
+			values := make([]int64, len(parts))
+			values[i] = s.Value[0]
+			s.Value = values
+		}
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return profile.Merge(parts)
+}
+
+// columnSource reads the columns of the profiles, from a block or a row group of the head.
+type columnSource interface {
+	columnIter(ctx context.Context, columnName string, predicate query.Predicate, alias string) query.Iterator
+}
+
+// selectProfileByID returns the rows of the profile with the ID among the rows of the series in
+// the time range. The ID column is read first, so the other columns are only read for its rows,
+// and the column chunks and pages outside of the time range are skipped.
+func selectProfileByID(ctx context.Context, source columnSource, rows query.Iterator, id uuid.UUID, start, end model.Time, series func(query.IteratorResult) (labelsInfo, bool)) ([]Profile, error) {
+	it := query.NewJoinIterator(
+		0,
+		[]query.Iterator{
+			source.columnIter(ctx, "ID", query.NewStringInPredicate([]string{string(id[:])}), "ID"),
+			rows,
+			source.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(start.UnixNano(), end.UnixNano()), "TimeNanos"),
+		},
+		nil,
+	)
+	defer it.Close()
+
+	var (
+		profiles []Profile
+		buf      = make([][]parquet.Value, 1)
+	)
+	for it.Next() {
+		res := it.At()
+		s, ok := series(*res)
+		if !ok {
+			continue
+		}
+		buf = res.Columns(buf, "TimeNanos")
+		profiles = append(profiles, BlockProfile{
+			labels: s.lbs,
+			fp:     s.fp,
+			ts:     model.TimeFromUnixNano(buf[0][0].Int64()),
+			RowNum: res.RowNumber[0],
+		})
+	}
+	return profiles, it.Err()
+}
+
+// profileNameMatcher selects the series of all the sample types of a profile name.
+func profileNameMatcher(name string) *labels.Matcher {
+	return labels.MustNewMatcher(labels.MatchEqual, labels.MetricName, name)
+}
+
+func (b *singleBlockQuerier) SelectProfileByID(ctx context.Context, name string, id uuid.UUID, start, end model.Time) ([]Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectProfileByID - Block")
+	defer sp.Finish()
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+	postings, err := b.postings.postingsForMatchers(b.index, b.metrics, profileNameMatcher(name))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		lbls   = make(phlaremodel.Labels, 0, 6)
+		chks   = make([]index.ChunkMeta, 1)
+		series = make(map[int64]labelsInfo)
+	)
+	for postings.Next() {
+		fp, err := b.index.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return nil, err
+		}
+		series[int64(chks[0].SeriesIndex)] = labelsInfo{fp: model.Fingerprint(fp), lbs: lbls}
+		lbls = make(phlaremodel.Labels, 0, 6)
+	}
+	if err := postings.Err(); err != nil {
+		return nil, err
+	}
+	if len(series) == 0 {
+		return nil, nil
+	}
+	buf := make([][]parquet.Value, 1)
+	return selectProfileByID(ctx, &b.profiles, b.profiles.columnIter(ctx, "SeriesIndex", newMapPredicate(series), "SeriesIndex"), id, start, end,
+		func(res query.IteratorResult) (labelsInfo, bool) {
+			buf = res.Columns(buf, "SeriesIndex")
+			s, ok := series[buf[0][0].Int64()]
+			return s, ok
+		})
+}
+
+func (q *headOnDiskQuerier) SelectProfileByID(ctx context.Context, name string, id uuid.UUID, start, end model.Time) ([]Profile, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectProfileByID - HeadOnDisk")
+	defer sp.Finish()
+	index := q.head.profiles.index
+	fps, err := index.fingerprintsForMatchers(profileNameMatcher(name))
+	if err != nil || len(fps) == 0 {
+		return nil, err
+	}
+	rowRanges, labelsPerFP := index.rowRangesOf(fps, q.rowGroupIdx)
+	if len(rowRanges) == 0 {
+		return nil, nil
+	}
+	return selectProfileByID(ctx, q.rowGroup(), rowRanges.fingerprintsWithRowNum(), id, start, end,
+		func(res query.IteratorResult) (labelsInfo, bool) {
+			for _, e := range res.Entries {
+				if v, ok := e.RowValue.(fingerprintWithRowNum); ok {
+					lbs, ok := labelsPerFP[v.fp]
+					return labelsInfo{fp: v.fp, lbs: lbs}, ok
+				}
+			}
+			return labelsInfo{}, false
+		})
+}
+
+func (q *headInMemoryQuerier) SelectProfileByID(ctx context.Context, name string, id uuid.UUID, start, end model.Time) ([]Profile, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "SelectProfileByID - HeadInMemory")
+	defer sp.Finish()
+	index := q.head.profiles.index
+	fps, err := index.fingerprintsForMatchers(profileNameMatcher(name))
+	if err != nil {
+		return nil, err
+	}
+	index.rLockAll()
+	defer index.rUnlockAll()
+	var profiles []Profile
+	for _, fp := range fps {
+		s, ok := index.shard(fp).profilesPerFP[fp]
+		if !ok {
+			continue
+		}
+		for _, p := range s.profiles {
+			if p.ID != id {
+				continue
+			}
+			if ts := model.TimeFromUnixNano(p.TimeNanos); ts < start || ts > end {
+				continue
+			}
+			profiles = append(profiles, ProfileWithLabels{Profile: p, lbs: s.lbs, fp: s.fp})
+		}
+	}
+	return profiles, nil
+}
+
+func sortMostRecentFirst(profiles []Profile) {
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Timestamp() > profiles[j].Timestamp()
+	})
+}
+
+// profileIDs reads the IDs of the profiles from the ID column of the source. The rows must be
+// sorted by row number.
+func profileIDs(ctx context.Context, source Source, rows iter.Iterator[Profile]) ([]uuid.UUID, error) {
+	it := repeatedColumnIter(ctx, source, "ID", rows)
+	defer it.Close()
+
+	var ids []uuid.UUID
+	for it.Next() {
+		values := it.At().Values
+		if len(values) != 1 {
+			return nil, fmt.Errorf("expected a single profile ID per row, got %d", len(values))
+		}
+		id, err := uuid.FromBytes(values[0].ByteArray())
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, it.Err()
+}
+
+func (b *singleBlockQuerier) ProfileIDs(ctx context.Context, rows iter.Iterator[Profile]) ([]uuid.UUID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "ProfileIDs - Block")
+	defer sp.Finish()
+
+	return profileIDs(ctx, b.profiles.file, rows)
+}
+
+func (q *headOnDiskQuerier) ProfileIDs(ctx context.Context, rows iter.Iterator[Profile]) ([]uuid.UUID, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "ProfileIDs - HeadOnDisk")
+	defer sp.Finish()
+
+	return profileIDs(ctx, q.rowGroup(), rows)
+}
+
+func (q *headInMemoryQuerier) ProfileIDs(ctx context.Context, rows iter.Iterator[Profile]) ([]uuid.UUID, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "ProfileIDs - HeadInMemory")
+	defer sp.Finish()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		p, ok := rows.At().(ProfileWithLabels)
+		if !ok {
+			return nil, errors.New("expected ProfileWithLabels")
+		}
+		ids = append(ids, p.ID)
+	}
+	return ids, rows.Err()
+}
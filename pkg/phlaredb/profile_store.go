@@ -12,9 +12,12 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/runutil"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
 	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/encoding"
 	"go.uber.org/atomic"
 
 	phlaremodel "github.com/grafana/phlare/pkg/model"
@@ -46,6 +49,10 @@ type profileStore struct {
 	path        string
 	rowsFlushed uint64
 
+	// values collects the distribution of the sample values, to select their encoding when the
+	// block is flushed.
+	values sampleValueStats
+
 	rowGroups []*rowGroupOnDisk
 }
 
@@ -59,12 +66,16 @@ func newProfileStore(phlarectx context.Context) *profileStore {
 
 	// Initialize writer on /dev/null
 	// TODO: Reuse parquet.Writer beyond life time of the head.
-	s.writer = parquet.NewGenericWriter[*schemav1.Profile](io.Discard, s.persister.Schema(),
+	s.writer = newProfileWriter(io.Discard, s.persister.Schema())
+
+	return s
+}
+
+func newProfileWriter(w io.Writer, schema *parquet.Schema) *parquet.GenericWriter[*schemav1.Profile] {
+	return parquet.NewGenericWriter[*schemav1.Profile](w, schema,
 		parquet.ColumnPageBuffers(parquet.NewFileBufferPool(os.TempDir(), "phlaredb-parquet-buffers*")),
 		parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
 	)
-
-	return s
 }
 
 func (s *profileStore) Name() string {
@@ -85,6 +96,9 @@ func (s *profileStore) Init(path string, cfg *ParquetConfig) (err error) {
 	if err := s.Close(); err != nil {
 		return err
 	}
+	if err := s.releaseRowGroups(); err != nil {
+		return err
+	}
 
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -101,6 +115,7 @@ func (s *profileStore) Init(path string, cfg *ParquetConfig) (err error) {
 	s.slice = s.slice[:0]
 
 	s.rowsFlushed = 0
+	s.values.reset()
 
 	return nil
 }
@@ -117,13 +132,26 @@ func (s *profileStore) RowGroups() (rowGroups []parquet.RowGroup) {
 	return rowGroups
 }
 
-func (s *profileStore) profileSort(i, j int) bool {
+// profileSort returns the ordering of the profiles of the slice, by the labels of their series,
+// looked up once per series, and their timestamp.
+func (s *profileStore) profileSort() func(i, j int) bool {
+	fps := make([]model.Fingerprint, len(s.slice))
+	for i, p := range s.slice {
+		fps[i] = p.SeriesFingerprint
+	}
+	lbsPerFP := s.index.seriesLabels(fps)
+	return func(i, j int) bool {
+		return s.lessProfile(lbsPerFP, i, j)
+	}
+}
+
+func (s *profileStore) lessProfile(lbsPerFP map[model.Fingerprint]phlaremodel.Labels, i, j int) bool {
 	// first compare the labels, if they don't match return
 	var (
 		pI   = s.slice[i]
 		pJ   = s.slice[j]
-		lbsI = s.index.profilesPerFP[pI.SeriesFingerprint].lbs
-		lbsJ = s.index.profilesPerFP[pJ.SeriesFingerprint].lbs
+		lbsI = lbsPerFP[pI.SeriesFingerprint]
+		lbsJ = lbsPerFP[pJ.SeriesFingerprint]
 	)
 	if cmp := phlaremodel.CompareLabelPairs(lbsI, lbsJ); cmp != 0 {
 		return cmp < 0
@@ -162,8 +190,15 @@ func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups
 		return 0, 0, err
 	}
 
-	for idx, ranges := range rowRangerPerRG {
-		s.rowGroups[idx].seriesIndexes = ranges
+	// the row groups are rewritten with the series indexes of the block, leaving the ones queried
+	// from the head untouched.
+	rowGroups := make([]parquet.RowGroup, len(s.rowGroups))
+	for idx, rg := range s.rowGroups {
+		rewritten := &rowGroupOnDisk{RowGroup: rg.RowGroup, file: rg.file}
+		if idx < len(rowRangerPerRG) {
+			rewritten.seriesIndexes = rowRangerPerRG[idx]
+		}
+		rowGroups[idx] = rewritten
 	}
 
 	parquetPath := filepath.Join(
@@ -171,22 +206,41 @@ func (s *profileStore) Flush(ctx context.Context) (numRows uint64, numRowGroups
 		s.persister.Name()+block.ParquetSuffix,
 	)
 
-	numRows, numRowGroups, err = s.writeRowGroups(parquetPath, s.RowGroups())
+	numRows, numRowGroups, err = s.writeRowGroups(parquetPath, rowGroups)
 	if err != nil {
 		return 0, 0, err
 	}
 
-	// cleanup row groups, which need cleaning
+	// the segment files are removed, but stay open for the queries of the head until they are
+	// released.
 	for _, rg := range s.rowGroups {
-		if err := rg.Close(); err != nil {
+		if err := rg.remove(); err != nil {
 			return 0, 0, err
 		}
 	}
-	s.rowGroups = s.rowGroups[:0]
 
 	return numRows, numRowGroups, nil
 }
 
+// cut writes the profiles in memory to a row group.
+func (s *profileStore) cut() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cutRowGroup()
+}
+
+// releaseRowGroups closes the row groups flushed, once the head is not queried anymore.
+func (s *profileStore) releaseRowGroups() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var merr multierror.MultiError
+	for _, rg := range s.rowGroups {
+		merr.Add(rg.file.Close())
+	}
+	s.rowGroups = s.rowGroups[:0]
+	return merr.Err()
+}
+
 func (s *profileStore) prepareFile(path string) (closer io.Closer, err error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
@@ -200,7 +254,7 @@ func (s *profileStore) prepareFile(path string) (closer io.Closer, err error) {
 func (s *profileStore) empty() bool {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	return len(s.slice) == 0
+	return len(s.slice) == 0 && s.rowsFlushed == 0
 }
 
 // cutRowGroups gets called, when a patrticular row group has been finished and it will flush it to disk. The caller of cutRowGroups should be holding the write lock.
@@ -223,7 +277,7 @@ func (s *profileStore) cutRowGroup() (err error) {
 	}
 
 	// order profiles properly
-	sort.Slice(s.slice, s.profileSort)
+	sort.Slice(s.slice, s.profileSort())
 
 	n, err := s.writer.Write(s.slice)
 	if err != nil {
@@ -260,17 +314,23 @@ func (s *profileStore) cutRowGroup() (err error) {
 	return nil
 }
 
+// writeRowGroups writes the row groups to the block, with the sample values encoded according
+// to their distribution.
 func (s *profileStore) writeRowGroups(path string, rowGroups []parquet.RowGroup) (n uint64, numRowGroups uint64, err error) {
-	fileCloser, err := s.prepareFile(path)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
 	if err != nil {
 		return 0, 0, err
 	}
-	defer runutil.CloseWithErrCapture(&err, fileCloser, "closing parquet file")
+	defer runutil.CloseWithErrCapture(&err, file, "closing parquet file")
+
+	valueEncoding := s.values.encoding()
+	level.Debug(s.logger).Log("msg", "selected sample values encoding", "path", path, "encoding", valueEncoding.Encoding(), "values", s.values.count())
+	writer := newProfileWriter(file, schemav1.NewProfilesSchema(valueEncoding))
 
 	for rgN, rg := range rowGroups {
 		level.Debug(s.logger).Log("msg", "writing row group", "path", path, "row_group_number", rgN, "rows", rg.NumRows())
 
-		nInt64, err := s.writer.WriteRowGroup(rg)
+		nInt64, err := writer.WriteRowGroup(rg)
 		if err != nil {
 			return 0, 0, err
 		}
@@ -278,7 +338,7 @@ func (s *profileStore) writeRowGroups(path string, rowGroups []parquet.RowGroup)
 		numRowGroups += 1
 	}
 
-	if err := s.writer.Close(); err != nil {
+	if err := writer.Close(); err != nil {
 		return 0, 0, err
 	}
 
@@ -295,6 +355,11 @@ func (s *profileStore) ingest(_ context.Context, profiles []*schemav1.Profile, l
 		}
 	}
 
+	// the series are added to the index before the lock of the store is taken.
+	for _, p := range profiles {
+		s.index.ensureSeries(lbs, p.SeriesFingerprint, profileName)
+	}
+
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -317,6 +382,10 @@ func (s *profileStore) ingest(_ context.Context, profiles []*schemav1.Profile, l
 
 		// add to slice
 		s.slice = append(s.slice, p)
+		profileType := lbs.Get(phlaremodel.LabelNameProfileType)
+		for _, sample := range p.Samples {
+			s.values.add(profileType, sample.Value)
+		}
 
 	}
 
@@ -381,15 +450,11 @@ func (r *rowGroupOnDisk) Rows() parquet.Rows {
 	}
 }
 
-func (r *rowGroupOnDisk) Close() error {
-	if err := r.file.Close(); err != nil {
-		return err
-	}
-
+// remove deletes the segment file of the row group, which stays readable until it is closed.
+func (r *rowGroupOnDisk) remove() error {
 	if err := os.Remove(r.file.Name()); err != nil {
 		return errors.Wrap(err, "deleting row group segment file")
 	}
-
 	return nil
 }
 
@@ -440,3 +505,81 @@ func (r *seriesIDRowsRewriter) ReadRows(rows []parquet.Row) (int, error) {
 
 	return n, nil
 }
+
+const (
+	// maxDictionarySampleValues is the maximum number of distinct sample values of a block stored
+	// with a dictionary.
+	maxDictionarySampleValues = 1 << 16
+	// minDictionarySampleValuesRatio is the minimum number of sample values per distinct value for
+	// the dictionary to be smaller than the delta encoding.
+	minDictionarySampleValuesRatio = 8
+)
+
+// sampleValueStats tracks the distribution of the sample values of a block, per sample type. The
+// profile rows of the different sample types share the column of the sample values, e.g. counts
+// of allocations which repeat a few values and durations which vary widely, while a single
+// dictionary would hold the values of all of them. The dictionary is therefore only selected when
+// the values of each sample type suit it.
+type sampleValueStats struct {
+	types map[string]*sampleTypeValueStats
+}
+
+// sampleTypeValueStats tracks the distribution of the sample values of a sample type.
+type sampleTypeValueStats struct {
+	count int
+	// distinct holds the distinct values, until there are too many of them for a dictionary.
+	distinct map[int64]struct{}
+	overflow bool
+}
+
+func (s *sampleValueStats) reset() {
+	s.types = nil
+}
+
+func (s *sampleValueStats) add(profileType string, v int64) {
+	if s.types == nil {
+		s.types = make(map[string]*sampleTypeValueStats)
+	}
+	t, ok := s.types[profileType]
+	if !ok {
+		t = &sampleTypeValueStats{distinct: make(map[int64]struct{})}
+		s.types[profileType] = t
+	}
+	t.count++
+	if t.overflow {
+		return
+	}
+	t.distinct[v] = struct{}{}
+	if len(t.distinct) > maxDictionarySampleValues {
+		t.distinct = nil
+		t.overflow = true
+	}
+}
+
+// count returns the number of sample values of all the sample types.
+func (s *sampleValueStats) count() (n int) {
+	for _, t := range s.types {
+		n += t.count
+	}
+	return n
+}
+
+// encoding returns the dictionary encoding when the values of each sample type have a low
+// cardinality, and there are few enough of them for a single dictionary. It returns the delta
+// encoding otherwise.
+func (s *sampleValueStats) encoding() encoding.Encoding {
+	if len(s.types) == 0 {
+		return &parquet.DeltaBinaryPacked
+	}
+	distinct := 0
+	for _, t := range s.types {
+		if t.overflow || len(t.distinct)*minDictionarySampleValuesRatio > t.count {
+			return &parquet.DeltaBinaryPacked
+		}
+		distinct += len(t.distinct)
+	}
+	if distinct > maxDictionarySampleValues {
+		return &parquet.DeltaBinaryPacked
+	}
+	return &parquet.RLEDictionary
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/samber/lo"
 	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/format"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -218,6 +219,78 @@ func TestProfileStore_Ingestion_SeriesIndexes(t *testing.T) {
 	}
 }
 
+// TestProfileStore_SampleValuesEncoding ensures the encoding of the sample values is selected
+// according to their cardinality.
+func TestProfileStore_SampleValuesEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value func(i int) int64
+		// otherType reports whether the profile of the row is of another sample type.
+		otherType func(i int) bool
+		encoding  format.Encoding
+	}{
+		{name: "low cardinality", value: func(i int) int64 { return int64(i % 4) }, encoding: format.RLEDictionary},
+		{name: "high cardinality", value: func(i int) int64 { return int64(i) * 7919 }, encoding: format.DeltaBinaryPacked},
+		{
+			// the values of most rows have a low cardinality, those of another sample type in
+			// every tenth row don't.
+			name: "mixed sample types",
+			value: func(i int) int64 {
+				if i%10 != 9 {
+					return int64(i % 4)
+				}
+				return int64(i) * 7919
+			},
+			otherType: func(i int) bool { return i%10 == 9 },
+			encoding:  format.DeltaBinaryPacked,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				ctx   = testContext(t)
+				store = newProfileStore(ctx)
+				path  = t.TempDir()
+			)
+			require.NoError(t, store.Init(path, defaultParquetConfig))
+			for i := 0; i < 200; i++ {
+				p := sameProfileStream(i)
+				p.p.Samples[0].Value = tc.value(i)
+				if tc.otherType != nil && tc.otherType(i) {
+					p.profileName = "process_cpu:samples:count:cpu:nanoseconds"
+					p.lbls = phlaremodel.LabelsFromStrings(
+						phlaremodel.LabelNameProfileType, p.profileName,
+						"job", "test",
+					)
+					p.populateFingerprint()
+				}
+				require.NoError(t, store.ingest(ctx, []*schemav1.Profile{&p.p}, p.lbls, p.profileName, emptyRewriter()))
+			}
+			_, _, err := store.Flush(context.Background())
+			require.NoError(t, err)
+
+			rows, _ := readFullParquetFile[*schemav1.Profile](t, path+"/profiles.parquet")
+			require.Len(t, rows, 200)
+			var expected, actual []int64
+			for i, row := range rows {
+				expected = append(expected, tc.value(i))
+				actual = append(actual, row.Samples[0].Value)
+			}
+			require.ElementsMatch(t, expected, actual)
+
+			f, err := os.Open(path + "/profiles.parquet")
+			require.NoError(t, err)
+			defer f.Close()
+			stat, err := f.Stat()
+			require.NoError(t, err)
+			pf, err := parquet.OpenFile(f, stat.Size())
+			require.NoError(t, err)
+			column, ok := pf.Schema().Lookup("Samples", "list", "element", "Value")
+			require.True(t, ok)
+			require.Contains(t, pf.Metadata().RowGroups[0].Columns[column.ColumnIndex].MetaData.Encoding, tc.encoding)
+		})
+	}
+}
+
 func ingestThreeProfileStreams(ctx context.Context, i int, ingest func(context.Context, *profilev1.Profile, uuid.UUID, ...*typesv1.LabelPair) error) error {
 	p := testhelper.NewProfileBuilder(time.Second.Nanoseconds() * int64(i))
 	p.CPUProfile()
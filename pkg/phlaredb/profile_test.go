@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/uuid"
@@ -245,3 +246,69 @@ func Test_rowRangesIter(t *testing.T) {
 		})
 	}
 }
+
+func benchmarkSeriesLabels(n int) []phlaremodel.Labels {
+	series := make([]phlaremodel.Labels, n)
+	for i := range series {
+		series[i] = phlaremodel.Labels([]*typesv1.LabelPair{
+			{Name: "__name__", Value: "memory"},
+			{Name: "__sample__type__", Value: "bytes"},
+			{Name: "__profile_type__", Value: "::::"},
+			{Name: "pod", Value: fmt.Sprintf("pod-%d", i)},
+			{Name: "namespace", Value: fmt.Sprintf("ns-%d", i%16)},
+		})
+		sort.Sort(series[i])
+	}
+	return series
+}
+
+// BenchmarkProfileIndex_Add measures the throughput of the concurrent ingestion of profiles into
+// the head index, run with -cpu to compare the levels of parallelism.
+func BenchmarkProfileIndex_Add(b *testing.B) {
+	series := benchmarkSeriesLabels(10000)
+	a, err := newProfileIndex(32, newHeadMetrics(prometheus.NewRegistry()))
+	require.NoError(b, err)
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := next.Add(1)
+			lbs := series[int(i)%len(series)]
+			a.Add(&v1.Profile{TimeNanos: i, SeriesFingerprint: model.Fingerprint(lbs.Hash())}, lbs, "memory")
+		}
+	})
+}
+
+// BenchmarkProfileIndex_AddAndSelect measures the throughput of the ingestion of profiles while
+// the head index is queried.
+func BenchmarkProfileIndex_AddAndSelect(b *testing.B) {
+	series := benchmarkSeriesLabels(10000)
+	a, err := newProfileIndex(32, newHeadMetrics(prometheus.NewRegistry()))
+	require.NoError(b, err)
+	for i, lbs := range series {
+		a.Add(&v1.Profile{TimeNanos: int64(i), SeriesFingerprint: model.Fingerprint(lbs.Hash())}, lbs, "memory")
+	}
+	ctx := context.Background()
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := next.Add(1)
+			// one query for 100 profiles ingested.
+			if i%100 == 0 {
+				_, err := a.selectMatchingFPs(ctx, &ingestv1.SelectProfilesRequest{
+					LabelSelector: fmt.Sprintf(`{namespace="ns-%d"}`, i%16),
+					Type:          &typesv1.ProfileType{Name: "memory"},
+				})
+				if err != nil {
+					b.Error(err)
+				}
+				continue
+			}
+			lbs := series[int(i)%len(series)]
+			a.Add(&v1.Profile{TimeNanos: i, SeriesFingerprint: model.Fingerprint(lbs.Hash())}, lbs, "memory")
+		}
+	})
+}
@@ -3,6 +3,8 @@ package phlaredb
 import (
 	"context"
 	"fmt"
+	"math"
+	"math/bits"
 	"sort"
 	"sync"
 	"unsafe"
@@ -11,7 +13,6 @@ import (
 	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
-	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/samber/lo"
 	"go.uber.org/atomic"
@@ -136,13 +137,26 @@ type profileSeries struct {
 	profilesOnDisk []*rowRange
 }
 
+// profilesIndexShard holds the series of the fingerprints of a shard of the head index, so that
+// the ingestion and the queries of series of different shards don't contend on the same lock.
+type profilesIndexShard struct {
+	mutex         sync.RWMutex
+	profilesPerFP map[model.Fingerprint]*profileSeries
+	// pad avoids the false sharing of the locks of adjacent shards.
+	pad [cacheLineSize - (unsafe.Sizeof(sync.RWMutex{})+unsafe.Sizeof(map[model.Fingerprint]*profileSeries(nil)))%cacheLineSize]byte
+}
+
+const cacheLineSize = 64
+
 type profilesIndex struct {
 	ix *tsdb.BitPrefixInvertedIndex
-	// todo: like the inverted index we might want to shard fingerprint to avoid contentions.
-	profilesPerFP   map[model.Fingerprint]*profileSeries
-	mutex           sync.RWMutex
-	totalProfiles   *atomic.Int64
-	totalSeries     *atomic.Int64
+	// shards are the series, sharded by the prefix of their fingerprint like the inverted index,
+	// so that the sorted fingerprints of a shard are contiguous.
+	shards        []profilesIndexShard
+	shardShift    uint
+	totalProfiles *atomic.Int64
+	totalSeries   *atomic.Int64
+	// rowGroupsOnDisk is written with the locks of all the shards held.
 	rowGroupsOnDisk int
 
 	metrics *headMetrics
@@ -153,34 +167,136 @@ func newProfileIndex(totalShards uint32, metrics *headMetrics) (*profilesIndex,
 	if err != nil {
 		return nil, err
 	}
+	shards := make([]profilesIndexShard, totalShards)
+	for i := range shards {
+		shards[i].profilesPerFP = make(map[model.Fingerprint]*profileSeries)
+	}
 	return &profilesIndex{
 		ix:            ix,
-		profilesPerFP: make(map[model.Fingerprint]*profileSeries),
+		shards:        shards,
+		shardShift:    uint(64 - bits.TrailingZeros32(totalShards)),
 		totalProfiles: atomic.NewInt64(0),
 		totalSeries:   atomic.NewInt64(0),
 		metrics:       metrics,
 	}, nil
 }
 
+func (pi *profilesIndex) shard(fp model.Fingerprint) *profilesIndexShard {
+	return &pi.shards[uint64(fp)>>pi.shardShift]
+}
+
+// lockAll locks all the shards, in order.
+func (pi *profilesIndex) lockAll() {
+	for i := range pi.shards {
+		pi.shards[i].mutex.Lock()
+	}
+}
+
+func (pi *profilesIndex) unlockAll() {
+	for i := range pi.shards {
+		pi.shards[i].mutex.Unlock()
+	}
+}
+
+func (pi *profilesIndex) rLockAll() {
+	for i := range pi.shards {
+		pi.shards[i].mutex.RLock()
+	}
+}
+
+func (pi *profilesIndex) rUnlockAll() {
+	for i := range pi.shards {
+		pi.shards[i].mutex.RUnlock()
+	}
+}
+
+// forSeries calls fn with the series of the fingerprint, under the read lock of its shard. It
+// returns false when the series isn't in the index.
+func (pi *profilesIndex) forSeries(fp model.Fingerprint, fn func(*profileSeries)) bool {
+	shard := pi.shard(fp)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	series, ok := shard.profilesPerFP[fp]
+	if ok {
+		fn(series)
+	}
+	return ok
+}
+
+// forEachSeries calls fn with the series of the fingerprints in the index, under the read lock of
+// their shard, taken once per run of fingerprints of the same shard.
+func (pi *profilesIndex) forEachSeries(fps []model.Fingerprint, fn func(*profileSeries)) {
+	for len(fps) > 0 {
+		shard := pi.shard(fps[0])
+		n := 1
+		for n < len(fps) && pi.shard(fps[n]) == shard {
+			n++
+		}
+		shard.mutex.RLock()
+		for _, fp := range fps[:n] {
+			if series, ok := shard.profilesPerFP[fp]; ok {
+				fn(series)
+			}
+		}
+		shard.mutex.RUnlock()
+		fps = fps[n:]
+	}
+}
+
+// seriesLabels returns the labels of the series of the fingerprints in the index.
+func (pi *profilesIndex) seriesLabels(fps []model.Fingerprint) map[model.Fingerprint]phlaremodel.Labels {
+	lbs := make(map[model.Fingerprint]phlaremodel.Labels, len(fps))
+	for _, fp := range fps {
+		if _, ok := lbs[fp]; ok {
+			continue
+		}
+		pi.forSeries(fp, func(s *profileSeries) { lbs[fp] = s.lbs })
+	}
+	return lbs
+}
+
+// ensureSeries adds the series to the index if it isn't in it yet. It is called before the
+// profiles of the series are added, outside of the lock of the profile store, so that the
+// insertion of the labels in the inverted index doesn't hold the ingestion of other series.
+func (pi *profilesIndex) ensureSeries(lbs phlaremodel.Labels, fp model.Fingerprint, profileName string) {
+	shard := pi.shard(fp)
+	shard.mutex.RLock()
+	_, ok := shard.profilesPerFP[fp]
+	shard.mutex.RUnlock()
+	if ok {
+		return
+	}
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	pi.getOrCreateSeries(shard, lbs, fp, profileName)
+}
+
+// getOrCreateSeries must be called with the lock of the shard held.
+func (pi *profilesIndex) getOrCreateSeries(shard *profilesIndexShard, lbs phlaremodel.Labels, fp model.Fingerprint, profileName string) *profileSeries {
+	series, ok := shard.profilesPerFP[fp]
+	if ok {
+		return series
+	}
+	series = &profileSeries{
+		lbs:            pi.ix.Add(lbs, fp),
+		fp:             fp,
+		minTime:        math.MaxInt64,
+		maxTime:        math.MinInt64,
+		profilesOnDisk: make([]*rowRange, pi.rowGroupsOnDisk),
+	}
+	shard.profilesPerFP[fp] = series
+	pi.totalSeries.Inc()
+	pi.metrics.seriesCreated.WithLabelValues(profileName).Inc()
+	return series
+}
+
 // Add a new set of profile to the index.
 // The seriesRef are expected to match the profile labels passed in.
 func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profileName string) {
-	pi.mutex.Lock()
-	defer pi.mutex.Unlock()
-	profiles, ok := pi.profilesPerFP[ps.SeriesFingerprint]
-	if !ok {
-		lbs := pi.ix.Add(lbs, ps.SeriesFingerprint)
-		profiles = &profileSeries{
-			lbs:            lbs,
-			fp:             ps.SeriesFingerprint,
-			minTime:        ps.TimeNanos,
-			maxTime:        ps.TimeNanos,
-			profilesOnDisk: make([]*rowRange, pi.rowGroupsOnDisk),
-		}
-		pi.profilesPerFP[ps.SeriesFingerprint] = profiles
-		pi.totalSeries.Inc()
-		pi.metrics.seriesCreated.WithLabelValues(profileName).Inc()
-	}
+	shard := pi.shard(ps.SeriesFingerprint)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	profiles := pi.getOrCreateSeries(shard, lbs, ps.SeriesFingerprint, profileName)
 
 	profiles.profiles = append(profiles.profiles, ps)
 	if ps.TimeNanos < profiles.minTime {
@@ -197,7 +313,7 @@ func (pi *profilesIndex) Add(ps *schemav1.Profile, lbs phlaremodel.Labels, profi
 func (pi *profilesIndex) selectMatchingFPs(ctx context.Context, params *ingestv1.SelectProfilesRequest) ([]model.Fingerprint, error) {
 	sp, _ := opentracing.StartSpanFromContext(ctx, "selectMatchingFPs - Index")
 	defer sp.Finish()
-	selectors, err := parser.ParseMetricSelector(params.LabelSelector)
+	selectors, err := phlaremodel.ParseSelector(params.LabelSelector)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "failed to parse label selectors: "+err.Error())
 	}
@@ -209,29 +325,21 @@ func (pi *profilesIndex) selectMatchingFPs(ctx context.Context, params *ingestv1
 		return nil, err
 	}
 
-	pi.mutex.RLock()
-	defer pi.mutex.RUnlock()
-
-	// filter fingerprints that no longer exist or don't match the filters
+	// filter fingerprints that no longer exist or don't match the filters.
+	// If a profile labels is missing here, it has already been flushed
+	// and is supposed to be picked up from storage by querier
 	var idx int
-outer:
-	for _, fp := range ids {
-		profile, ok := pi.profilesPerFP[fp]
-		if !ok {
-			// If a profile labels is missing here, it has already been flushed
-			// and is supposed to be picked up from storage by querier
-			continue
-		}
+	pi.forEachSeries(ids, func(s *profileSeries) {
 		for _, filter := range filters {
-			if !filter.Matches(profile.lbs.Get(filter.Name)) {
-				continue outer
+			if !filter.Matches(s.lbs.Get(filter.Name)) {
+				return
 			}
 		}
 
-		// keep this one
-		ids[idx] = fp
+		// keep this one, the series are visited in order.
+		ids[idx] = s.fp
 		idx++
-	}
+	})
 
 	sp.SetTag("matchedSeries", idx)
 
@@ -250,38 +358,33 @@ func (pi *profilesIndex) selectMatchingRowRanges(ctx context.Context, params *in
 	if err != nil {
 		return nil, nil, err
 	}
+	rowRanges, labelsPerFP := pi.rowRangesOf(ids, rowGroupIdx)
+	sp.SetTag("rowGroupSegment", rowGroupIdx)
+	sp.SetTag("matchedRowRangesCount", len(rowRanges))
+	return rowRanges.fingerprintsWithRowNum(), labelsPerFP, nil
+}
 
-	// gather rowRanges and labels from matching series under read lock of the index
+// rowRangesOf returns the rows of the series in the row group, with the labels of the series.
+func (pi *profilesIndex) rowRangesOf(ids []model.Fingerprint, rowGroupIdx int) (rowRanges, map[model.Fingerprint]phlaremodel.Labels) {
+	// gather rowRanges and labels from matching series under read lock of their shard
 	var (
 		rowRanges   = make(rowRanges, len(ids))
 		labelsPerFP = make(map[model.Fingerprint]phlaremodel.Labels, len(ids))
 	)
 
-	pi.mutex.RLock()
-	defer pi.mutex.RUnlock()
-
-	for _, fp := range ids {
-		// skip if series no longer in index
-		profileSeries, ok := pi.profilesPerFP[fp]
-		if !ok {
-			continue
-		}
-
-		labelsPerFP[fp] = profileSeries.lbs
+	// the series no longer in index are skipped
+	pi.forEachSeries(ids, func(profileSeries *profileSeries) {
+		labelsPerFP[profileSeries.fp] = profileSeries.lbs
 
 		// skip if rowRange empty
 		rR := profileSeries.profilesOnDisk[rowGroupIdx]
 		if rR == nil {
-			continue
+			return
 		}
 
-		rowRanges[*rR] = fp
-	}
-
-	sp.SetTag("rowGroupSegment", rowGroupIdx)
-	sp.SetTag("matchedRowRangesCount", len(rowRanges))
-
-	return rowRanges.fingerprintsWithRowNum(), labelsPerFP, nil
+		rowRanges[*rR] = profileSeries.fp
+	})
+	return rowRanges, labelsPerFP
 }
 
 type ProfileWithLabels struct {
@@ -337,6 +440,16 @@ func (it *SeriesIterator) At() Profile {
 	return it.curr
 }
 
+// fingerprintsForMatchers returns the fingerprints of the series matching the matchers.
+func (pi *profilesIndex) fingerprintsForMatchers(matchers ...*labels.Matcher) ([]model.Fingerprint, error) {
+	var fps []model.Fingerprint
+	err := pi.forMatchingLabels(matchers, func(_ phlaremodel.Labels, fp model.Fingerprint) error {
+		fps = append(fps, fp)
+		return nil
+	})
+	return fps, err
+}
+
 // forMatchingLabels iterates through all matching label sets and calls f for each labels set.
 func (pi *profilesIndex) forMatchingLabels(matchers []*labels.Matcher,
 	fn func(lbs phlaremodel.Labels, fp model.Fingerprint) error,
@@ -347,27 +460,20 @@ func (pi *profilesIndex) forMatchingLabels(matchers []*labels.Matcher,
 		return err
 	}
 
-	pi.mutex.RLock()
-	defer pi.mutex.RUnlock()
-
-outer:
-	for _, fp := range ids {
-		profile, ok := pi.profilesPerFP[fp]
-		if !ok {
-			// If a profile labels is missing here, it has already been flushed
-			// and is supposed to be picked up from storage by querier
-			continue
+	// If a profile labels is missing here, it has already been flushed
+	// and is supposed to be picked up from storage by querier
+	pi.forEachSeries(ids, func(s *profileSeries) {
+		if err != nil {
+			return
 		}
 		for _, filter := range filters {
-			if !filter.Matches(profile.lbs.Get(filter.Name)) {
-				continue outer
+			if !filter.Matches(s.lbs.Get(filter.Name)) {
+				return
 			}
 		}
-		if err := fn(profile.lbs, fp); err != nil {
-			return err
-		}
-	}
-	return nil
+		err = fn(s.lbs, s.fp)
+	})
+	return err
 }
 
 // WriteTo writes the profiles tsdb index to the specified filepath.
@@ -376,13 +482,15 @@ func (pi *profilesIndex) writeTo(ctx context.Context, path string) ([][]rowRange
 	if err != nil {
 		return nil, err
 	}
-	pi.mutex.RLock()
-	defer pi.mutex.RUnlock()
+	pi.rLockAll()
+	defer pi.rUnlockAll()
 
-	pfs := make([]*profileSeries, 0, len(pi.profilesPerFP))
+	pfs := make([]*profileSeries, 0, pi.totalSeries.Load())
 
-	for _, p := range pi.profilesPerFP {
-		pfs = append(pfs, p)
+	for i := range pi.shards {
+		for _, p := range pi.shards[i].profilesPerFP {
+			pfs = append(pfs, p)
+		}
 	}
 
 	// sort by fp
@@ -436,7 +544,7 @@ func (pi *profilesIndex) writeTo(ctx context.Context, path string) ([][]rowRange
 
 func (pl *profilesIndex) cutRowGroup(rgProfiles []*schemav1.Profile) error {
 	// adding rowGroup and rowNum information per fingerprint
-	rowRangePerFP := make(map[model.Fingerprint]*rowRange, len(pl.profilesPerFP))
+	rowRangePerFP := make(map[model.Fingerprint]*rowRange, pl.totalSeries.Load())
 	for rowNum, p := range rgProfiles {
 		if _, ok := rowRangePerFP[p.SeriesFingerprint]; !ok {
 			rowRangePerFP[p.SeriesFingerprint] = &rowRange{
@@ -453,22 +561,24 @@ func (pl *profilesIndex) cutRowGroup(rgProfiles []*schemav1.Profile) error {
 		}
 	}
 
-	pl.mutex.Lock()
-	defer pl.mutex.Unlock()
+	pl.lockAll()
+	defer pl.unlockAll()
 
 	pl.rowGroupsOnDisk += 1
 
-	for _, ps := range pl.profilesPerFP {
-		// empty all in memory profiles
-		ps.profiles = ps.profiles[:0]
+	for i := range pl.shards {
+		for _, ps := range pl.shards[i].profilesPerFP {
+			// empty all in memory profiles
+			ps.profiles = ps.profiles[:0]
 
-		// attach rowGroup and rowNum information
-		rowRange := rowRangePerFP[ps.fp]
+			// attach rowGroup and rowNum information
+			rowRange := rowRangePerFP[ps.fp]
 
-		ps.profilesOnDisk = append(
-			ps.profilesOnDisk,
-			rowRange,
-		)
+			ps.profilesOnDisk = append(
+				ps.profilesOnDisk,
+				rowRange,
+			)
+		}
 	}
 
 	return nil
@@ -247,10 +247,9 @@ type ColumnIterator struct {
 	selectAs string
 	seekTo   atomic.Value
 
-	metrics *Metrics
-	table   string
-	quit    chan struct{}
-	ch      chan *columnIteratorBuffer
+	reads *readRecorder
+	quit  chan struct{}
+	ch    chan *columnIteratorBuffer
 
 	curr  *columnIteratorBuffer
 	currN int
@@ -269,8 +268,7 @@ type columnIteratorBuffer struct {
 
 func NewColumnIterator(ctx context.Context, rgs []parquet.RowGroup, column int, columnName string, readSize int, filter Predicate, selectAs string) *ColumnIterator {
 	c := &ColumnIterator{
-		metrics:  getMetricsFromContext(ctx),
-		table:    strings.ToLower(rgs[0].Schema().Name()) + "s",
+		reads:    newReadRecorder(ctx, strings.ToLower(rgs[0].Schema().Name())+"s", columnName),
 		rgs:      rgs,
 		col:      column,
 		colName:  columnName,
@@ -299,6 +297,8 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 		span.SetTag("keptColumnChunks", c.filter.KeptColumnChunks.Load())
 		span.SetTag("keptPages", c.filter.KeptPages.Load())
 		span.SetTag("keptValues", c.filter.KeptValues.Load())
+		c.reads.setSpanTags(span)
+		c.reads.predicate(c.filter)
 		span.Finish()
 	}()
 
@@ -319,12 +319,20 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 		return CompareRowNumbers(0, rnNext, seekToRN) == -1
 	}
 
+	sendErr := func(err error) {
+		select {
+		case c.ch <- &columnIteratorBuffer{err: err}:
+		case <-c.quit:
+		}
+	}
+
 	for _, rg := range c.rgs {
 		col := rg.ColumnChunks()[c.col]
 
 		if checkSkip(rg.NumRows()) {
 			// Skip column chunk
 			rn.Skip(rg.NumRows())
+			c.reads.chunkSkipped(col)
 			continue
 		}
 
@@ -332,11 +340,12 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 			if !c.filter.KeepColumnChunk(col) {
 				// Skip column chunk
 				rn.Skip(rg.NumRows())
+				c.reads.chunkSkipped(col)
 				continue
 			}
 		}
 
-		func(col parquet.ColumnChunk) {
+		ok := func(col parquet.ColumnChunk) bool {
 			pgs := col.Pages()
 			defer func() {
 				if err := pgs.Close(); err != nil {
@@ -344,18 +353,24 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 				}
 			}()
 			for {
+				// stop before reading from the object store when the query is cancelled.
+				if err := ctx.Err(); err != nil {
+					sendErr(err)
+					return false
+				}
 				pg, err := pgs.ReadPage()
 				if pg == nil || err == io.EOF {
 					break
 				}
-				c.metrics.pageReadsTotal.WithLabelValues(c.table, c.colName).Add(1)
+				c.reads.pageRead(pg)
 				span.LogFields(
 					log.String("msg", "reading page"),
 					log.Int64("page_num_values", pg.NumValues()),
 					log.Int64("page_size", pg.Size()),
 				)
 				if err != nil {
-					return
+					sendErr(err)
+					return false
 				}
 
 				if checkSkip(pg.NumRows()) {
@@ -402,7 +417,7 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 							select {
 							case c.ch <- newBuffer:
 							case <-c.quit:
-								return
+								return false
 							}
 						} else {
 							// All values excluded, we go ahead and immediately
@@ -417,13 +432,17 @@ func (c *ColumnIterator) iterate(ctx context.Context, readSize int) {
 						break
 					}
 					if err != nil {
-						c.ch <- &columnIteratorBuffer{err: err}
-						return
+						sendErr(err)
+						return false
 					}
 				}
 
 			}
+			return true
 		}(col)
+		if !ok {
+			return
+		}
 	}
 }
 
@@ -3,18 +3,27 @@ package query
 import (
 	"context"
 
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/parquet-go"
+	"go.uber.org/atomic"
 )
 
 type contextKey uint8
 
 const (
 	metricsContextKey contextKey = iota
+	readStatsContextKey
 )
 
 type Metrics struct {
-	pageReadsTotal *prometheus.CounterVec
+	pageReadsTotal           *prometheus.CounterVec
+	pageSkipsTotal           *prometheus.CounterVec
+	dictionaryPageReadsTotal *prometheus.CounterVec
+	pageReadBytesTotal       *prometheus.CounterVec
+	predicateInspectedTotal  *prometheus.CounterVec
+	predicateKeptTotal       *prometheus.CounterVec
 }
 
 func NewMetrics(reg prometheus.Registerer) *Metrics {
@@ -23,6 +32,26 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			Name: "phlaredb_page_reads_total",
 			Help: "Total number of pages read while querying",
 		}, []string{"table", "column"}),
+		pageSkipsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_page_skips_total",
+			Help: "Total number of pages of the row groups visited while querying which were not read, because of a seek or a predicate.",
+		}, []string{"table", "column"}),
+		dictionaryPageReadsTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_dictionary_page_reads_total",
+			Help: "Total number of pages read while querying whose values are dictionary encoded.",
+		}, []string{"table", "column"}),
+		pageReadBytesTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_page_read_bytes_total",
+			Help: "Total number of bytes of the pages read while querying, once decompressed.",
+		}, []string{"table", "column"}),
+		predicateInspectedTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_predicate_inspected_total",
+			Help: "Total number of column chunks, pages and values a query predicate was evaluated on.",
+		}, []string{"table", "column", "level"}),
+		predicateKeptTotal: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "phlaredb_predicate_kept_total",
+			Help: "Total number of column chunks, pages and values kept by a query predicate.",
+		}, []string{"table", "column", "level"}),
 	}
 }
 
@@ -37,3 +66,118 @@ func getMetricsFromContext(ctx context.Context) *Metrics {
 	}
 	return m
 }
+
+// ReadStats accumulates the pages read by all the column iterators of a query.
+type ReadStats struct {
+	PagesRead           atomic.Int64
+	PagesSkipped        atomic.Int64
+	DictionaryPagesRead atomic.Int64
+	BytesRead           atomic.Int64
+}
+
+// AddReadStatsToContext returns a context the reads of the iterators created with are
+// accumulated in the stats.
+func AddReadStatsToContext(ctx context.Context, s *ReadStats) context.Context {
+	return context.WithValue(ctx, readStatsContextKey, s)
+}
+
+// SetSpanTags adds the stats to the span of the query.
+func (s *ReadStats) SetSpanTags(span opentracing.Span) {
+	span.SetTag("pagesRead", s.PagesRead.Load())
+	span.SetTag("pagesSkipped", s.PagesSkipped.Load())
+	span.SetTag("dictionaryPagesRead", s.DictionaryPagesRead.Load())
+	span.SetTag("bytesRead", s.BytesRead.Load())
+}
+
+// readRecorder records the pages read and skipped by an iterator of a column, to the metrics,
+// the stats of the query and the span of the iterator.
+type readRecorder struct {
+	metrics       *Metrics
+	stats         *ReadStats
+	table, column string
+
+	pagesRead           prometheus.Counter
+	pagesSkipped        prometheus.Counter
+	dictionaryPagesRead prometheus.Counter
+	bytesRead           prometheus.Counter
+
+	local ReadStats
+}
+
+func newReadRecorder(ctx context.Context, table, column string) *readRecorder {
+	m := getMetricsFromContext(ctx)
+	stats, _ := ctx.Value(readStatsContextKey).(*ReadStats)
+	if stats == nil {
+		stats = &ReadStats{}
+	}
+	return &readRecorder{
+		metrics:             m,
+		stats:               stats,
+		table:               table,
+		column:              column,
+		pagesRead:           m.pageReadsTotal.WithLabelValues(table, column),
+		pagesSkipped:        m.pageSkipsTotal.WithLabelValues(table, column),
+		dictionaryPagesRead: m.dictionaryPageReadsTotal.WithLabelValues(table, column),
+		bytesRead:           m.pageReadBytesTotal.WithLabelValues(table, column),
+	}
+}
+
+func (r *readRecorder) pageRead(pg parquet.Page) {
+	size := pg.Size()
+	r.pagesRead.Inc()
+	r.bytesRead.Add(float64(size))
+	r.stats.PagesRead.Inc()
+	r.stats.BytesRead.Add(size)
+	r.local.PagesRead.Inc()
+	r.local.BytesRead.Add(size)
+	if pg.Dictionary() != nil {
+		r.dictionaryPagesRead.Inc()
+		r.stats.DictionaryPagesRead.Inc()
+		r.local.DictionaryPagesRead.Inc()
+	}
+}
+
+func (r *readRecorder) pagesSkippedN(n int64) {
+	if n <= 0 {
+		return
+	}
+	r.pagesSkipped.Add(float64(n))
+	r.stats.PagesSkipped.Add(n)
+	r.local.PagesSkipped.Add(n)
+}
+
+// chunkSkipped records the pages of a column chunk which wasn't read, when its offset index
+// tells their number.
+func (r *readRecorder) chunkSkipped(col parquet.ColumnChunk) {
+	r.pagesSkippedN(numPages(col))
+}
+
+// predicate records the chunks, pages and values inspected and kept by the predicate.
+func (r *readRecorder) predicate(p *InstrumentedPredicate) {
+	if p == nil || p.pred == nil {
+		return
+	}
+	for _, l := range []struct {
+		level           string
+		inspected, kept *atomic.Int64
+	}{
+		{"column_chunk", &p.InspectedColumnChunks, &p.KeptColumnChunks},
+		{"page", &p.InspectedPages, &p.KeptPages},
+		{"value", &p.InspectedValues, &p.KeptValues},
+	} {
+		r.metrics.predicateInspectedTotal.WithLabelValues(r.table, r.column, l.level).Add(float64(l.inspected.Load()))
+		r.metrics.predicateKeptTotal.WithLabelValues(r.table, r.column, l.level).Add(float64(l.kept.Load()))
+	}
+}
+
+func (r *readRecorder) setSpanTags(span opentracing.Span) {
+	r.local.SetSpanTags(span)
+}
+
+func numPages(col parquet.ColumnChunk) int64 {
+	index := col.OffsetIndex()
+	if index == nil {
+		return 0
+	}
+	return int64(index.NumPages())
+}
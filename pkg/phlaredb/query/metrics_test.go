@@ -0,0 +1,59 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnIterator_ReadStats(t *testing.T) {
+	var buf bytes.Buffer
+	w := parquet.NewGenericWriter[testData](&buf, parquet.PageBufferSize(256))
+	// 3 row groups of ids in distinct ranges, each of several pages.
+	for rg := 0; rg < 3; rg++ {
+		rows := make([]testData, 1000)
+		for i := range rows {
+			rows[i] = testData{ID: int64(rg*1000 + i), Name: "name"}
+		}
+		_, err := w.Write(rows)
+		require.NoError(t, err)
+		require.NoError(t, w.Flush())
+	}
+	require.NoError(t, w.Close())
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	require.Len(t, file.RowGroups(), 3)
+
+	var pages []int64
+	for _, rg := range file.RowGroups() {
+		pages = append(pages, numPages(rg.ColumnChunks()[0]))
+	}
+	require.Greater(t, pages[0], int64(1))
+
+	var (
+		reg   = prometheus.NewRegistry()
+		m     = NewMetrics(reg)
+		stats = &ReadStats{}
+		ctx   = AddReadStatsToContext(AddMetricsToContext(context.Background(), m), stats)
+	)
+	it := NewColumnIterator(ctx, file.RowGroups(), 0, "id", 1000, NewEqualInt64Predicate(1500), "id")
+	require.True(t, it.Next())
+	require.Equal(t, int64(1500), it.At().Entries[0].V.Int64())
+	require.False(t, it.Next())
+	require.NoError(t, it.Close())
+
+	// only the pages of the row group holding the value are read.
+	require.Equal(t, pages[1], stats.PagesRead.Load())
+	require.Equal(t, pages[0]+pages[2], stats.PagesSkipped.Load())
+	require.Greater(t, stats.BytesRead.Load(), int64(0))
+	require.Equal(t, float64(pages[1]), testutil.ToFloat64(m.pageReadsTotal.WithLabelValues("testdatas", "id")))
+	require.Equal(t, float64(pages[0]+pages[2]), testutil.ToFloat64(m.pageSkipsTotal.WithLabelValues("testdatas", "id")))
+	require.Equal(t, float64(3), testutil.ToFloat64(m.predicateInspectedTotal.WithLabelValues("testdatas", "id", "column_chunk")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.predicateKeptTotal.WithLabelValues("testdatas", "id", "column_chunk")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.predicateKeptTotal.WithLabelValues("testdatas", "id", "value")))
+}
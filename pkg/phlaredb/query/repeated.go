@@ -3,6 +3,7 @@ package query
 import (
 	"context"
 	"io"
+	"strings"
 
 	"github.com/grafana/dskit/multierror"
 	"github.com/opentracing/opentracing-go"
@@ -24,6 +25,9 @@ type repeatedPageIterator[T any] struct {
 	readSize int
 	ctx      context.Context
 	span     opentracing.Span
+	reads    *readRecorder
+	// chunkPagesRead is the number of pages read from the column chunk of the current row group.
+	chunkPagesRead int64
 
 	rgs                 []parquet.RowGroup
 	startRowGroupRowNum int64
@@ -60,9 +64,16 @@ func NewRepeatedPageIterator[T any](
 	buffer := make([]parquet.Value, readSize)
 	done := !rows.Next()
 	span, ctx := opentracing.StartSpanFromContext(ctx, "NewRepeatedPageIterator")
+	var table, columnName string
+	if len(rgs) > 0 {
+		schema := rgs[0].Schema()
+		table = strings.ToLower(schema.Name()) + "s"
+		columnName = strings.Join(schema.Columns()[column], ".")
+	}
 	return &repeatedPageIterator[T]{
 		ctx:            ctx,
 		span:           span,
+		reads:          newReadRecorder(ctx, table, columnName),
 		rows:           rows,
 		rgs:            rgs,
 		column:         column,
@@ -98,6 +109,7 @@ Outer:
 			if !it.closeCurrentPages() {
 				return false
 			}
+			it.chunkDone()
 			it.startRowGroupRowNum += it.rgs[0].NumRows()
 			it.rgs = it.rgs[1:]
 		}
@@ -109,6 +121,11 @@ Outer:
 		}
 		// read a new page.
 		if it.currentPage == nil {
+			// stop before reading from the object store when the query is cancelled.
+			if err := it.ctx.Err(); err != nil {
+				it.err = err
+				return false
+			}
 			// SeekToRow seek across and within pages. So the next position in the page will the be the row.
 			seekTo := it.seekRowNum() - it.startRowGroupRowNum
 			if err := it.currentPages.SeekToRow(seekTo); err != nil {
@@ -130,6 +147,8 @@ Outer:
 				it.err = err
 				return false
 			}
+			it.reads.pageRead(it.currentPage)
+			it.chunkPagesRead++
 			it.span.LogFields(
 				otlog.String("msg", "Page read"),
 				otlog.Int64("startRowGroupRowNum", it.startRowGroupRowNum),
@@ -237,6 +256,12 @@ func (it *repeatedPageIterator[T]) readNextRow() (int, int, bool) {
 	return start, len(it.buffer), false
 }
 
+// chunkDone records the pages of the column chunk of the current row group which were not read.
+func (it *repeatedPageIterator[T]) chunkDone() {
+	it.reads.pagesSkippedN(numPages(it.rgs[0].ColumnChunks()[it.column]) - it.chunkPagesRead)
+	it.chunkPagesRead = 0
+}
+
 func (it *repeatedPageIterator[T]) closeCurrentPages() bool {
 	if it.currentPages != nil {
 		if err := it.currentPages.Close(); err != nil {
@@ -263,11 +288,13 @@ func (it *repeatedPageIterator[T]) Err() error {
 func (it *repeatedPageIterator[T]) Close() error {
 	defer it.span.Finish()
 	if it.currentPages != nil {
+		it.chunkDone()
 		if err := it.currentPages.Close(); err != nil {
 			return err
 		}
 		it.currentPages = nil
 	}
+	it.reads.setSpanTags(it.span)
 	return nil
 }
 
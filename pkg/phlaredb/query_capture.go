@@ -0,0 +1,320 @@
+package phlaredb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+)
+
+const (
+	queryCaptureFilename = "query_capture.jsonl"
+	// maxQueryCaptureBytes bounds the size of the capture file. Once it is reached, the file is
+	// rotated to queryCaptureFilename.1, replacing the previous one.
+	maxQueryCaptureBytes = 256 << 20
+)
+
+// The operations of the captured queries.
+const (
+	QueryCaptureMergeStacktraces = "MergeProfilesStacktraces"
+	QueryCaptureMergeLabels      = "MergeProfilesLabels"
+	QueryCaptureMergePprof       = "MergeProfilesPprof"
+)
+
+// QueryCapture records a query of the local blocks: its plan, with the label values of the
+// selector anonymized, and the rows it read from each block. It can be replayed against a copy
+// of the blocks to reproduce the performance of the read path offline.
+type QueryCapture struct {
+	Time        time.Time     `json:"time"`
+	Duration    time.Duration `json:"duration"`
+	Operation   string        `json:"operation"`
+	ProfileType string        `json:"profileType"`
+	Selector    string        `json:"selector"`
+	Start       int64         `json:"start"`
+	End         int64         `json:"end"`
+	By          []string      `json:"by,omitempty"`
+	// Function is set when the samples were selected by a function or a stack.
+	Function bool            `json:"function,omitempty"`
+	Blocks   []CapturedBlock `json:"blocks"`
+
+	lock sync.Mutex
+}
+
+// CapturedBlock lists the rows of the profiles read from a block.
+type CapturedBlock struct {
+	ULID      string     `json:"ulid"`
+	RowGroups []int      `json:"rowGroups"`
+	Rows      []RowRange `json:"rows"`
+}
+
+// RowRange is a range of consecutive rows, from Start included to End excluded.
+type RowRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type queryCaptureKey struct{}
+
+func contextWithQueryCapture(ctx context.Context, c *QueryCapture) context.Context {
+	return context.WithValue(ctx, queryCaptureKey{}, c)
+}
+
+// queryCaptureFromContext returns the capture of the query, or nil when it is not captured.
+func queryCaptureFromContext(ctx context.Context) *QueryCapture {
+	c, _ := ctx.Value(queryCaptureKey{}).(*QueryCapture)
+	return c
+}
+
+func (c *QueryCapture) setRequest(operation string, r *ingestv1.SelectProfilesRequest, by []string, function bool) {
+	if c == nil {
+		return
+	}
+	c.Operation = operation
+	c.ProfileType = r.Type.ID
+	c.Selector = anonymizeSelector(r.LabelSelector)
+	c.Start = r.Start
+	c.End = r.End
+	c.By = by
+	c.Function = function
+}
+
+// addBlock records the rows read by the querier. Only the local blocks are recorded, the rows of
+// the head can't be replayed.
+func (c *QueryCapture) addBlock(q Querier, rows []Profile) {
+	b, ok := q.(*singleBlockQuerier)
+	if c == nil || !ok || len(rows) == 0 {
+		return
+	}
+	captured := CapturedBlock{ULID: b.meta.ULID.String()}
+	for _, p := range rows {
+		rowNum := p.(BlockProfile).RowNum
+		if n := len(captured.Rows); n > 0 && captured.Rows[n-1].End == rowNum {
+			captured.Rows[n-1].End++
+			continue
+		}
+		captured.Rows = append(captured.Rows, RowRange{Start: rowNum, End: rowNum + 1})
+	}
+	var first int64
+	for i, rg := range b.profiles.file.RowGroups() {
+		last := first + rg.NumRows()
+		for _, r := range captured.Rows {
+			if r.Start < last && r.End > first {
+				captured.RowGroups = append(captured.RowGroups, i)
+				break
+			}
+		}
+		first = last
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Blocks = append(c.Blocks, captured)
+}
+
+// anonymizeSelector replaces the values of the matchers by their hash, keeping the label names
+// and the matcher types.
+func anonymizeSelector(selector string) string {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return ""
+	}
+	result := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		value := m.Value
+		if m.Name != labels.MetricName {
+			value = fmt.Sprintf("%016x", xxhash.Sum64String(value))
+		}
+		result = append(result, (&labels.Matcher{Type: m.Type, Name: m.Name, Value: value}).String())
+	}
+	return "{" + strings.Join(result, ",") + "}"
+}
+
+// queryCaptureWriter appends the captured queries to a file, one JSON document per line.
+type queryCaptureWriter struct {
+	logger   log.Logger
+	path     string
+	maxBytes int64
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openQueryCaptureWriter(path string, logger log.Logger) (*queryCaptureWriter, error) {
+	w := &queryCaptureWriter{logger: logger, path: path, maxBytes: maxQueryCaptureBytes}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *queryCaptureWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file, w.size = file, stat.Size()
+	return nil
+}
+
+// rotate moves the capture file to its .1 backup, replacing the previous one, and starts a new
+// file.
+func (w *queryCaptureWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *queryCaptureWriter) write(c *QueryCapture) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		level.Warn(w.logger).Log("msg", "failed to encode query capture", "err", err)
+		return
+	}
+	data = append(data, '\n')
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		// the rotation failed.
+		return
+	}
+	if w.size > 0 && w.size+int64(len(data)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			level.Error(w.logger).Log("msg", "failed to rotate the query capture file, queries are not captured anymore", "path", w.path, "err", err)
+			if w.file != nil {
+				// the backup could not be replaced, keep the file from growing.
+				_ = w.file.Close()
+				w.file = nil
+			}
+			return
+		}
+		level.Info(w.logger).Log("msg", "rotated the query capture file", "path", w.path)
+	}
+	n, err := w.file.Write(data)
+	w.size += int64(n)
+	if err != nil {
+		level.Warn(w.logger).Log("msg", "failed to write query capture", "err", err)
+	}
+}
+
+func (w *queryCaptureWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// captureQuery runs the query, recording it when the query capture is enabled.
+func (f *PhlareDB) captureQuery(ctx context.Context, query func(context.Context) error) error {
+	if f.queryCaptures == nil {
+		return query(ctx)
+	}
+	c := &QueryCapture{Time: time.Now()}
+	err := query(contextWithQueryCapture(ctx, c))
+	c.Duration = time.Since(c.Time)
+	if err == nil && len(c.Blocks) > 0 {
+		sort.Slice(c.Blocks, func(i, j int) bool { return c.Blocks[i].ULID < c.Blocks[j].ULID })
+		f.queryCaptures.write(c)
+	}
+	return err
+}
+
+// ReplayedBlock is the outcome of the replay of a captured query on a block.
+type ReplayedBlock struct {
+	ULID     string
+	Rows     int64
+	Duration time.Duration
+	Err      error
+}
+
+// ReplayQueryCapture runs the merge of a captured query on the rows it read from each block.
+// The labels of the captured profiles are not recorded, so the merges by labels group all the
+// profiles in a single series, and the function selectors, which are not recorded either, are
+// replayed with a selector of the functions without name.
+func (b *BlockQuerier) ReplayQueryCapture(ctx context.Context, c *QueryCapture) ([]ReplayedBlock, error) {
+	result := make([]ReplayedBlock, 0, len(c.Blocks))
+	for _, captured := range c.Blocks {
+		replayed := ReplayedBlock{ULID: captured.ULID}
+		var rows []Profile
+		for _, r := range captured.Rows {
+			for rowNum := r.Start; rowNum < r.End; rowNum++ {
+				rows = append(rows, BlockProfile{RowNum: rowNum})
+			}
+		}
+		replayed.Rows = int64(len(rows))
+
+		q := b.querierByULID(captured.ULID)
+		if q == nil {
+			replayed.Err = fmt.Errorf("block %s not found", captured.ULID)
+			result = append(result, replayed)
+			continue
+		}
+		if err := q.open(ctx); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		replayed.Err = replayMerge(ctx, q, c, rows)
+		replayed.Duration = time.Since(start)
+		result = append(result, replayed)
+	}
+	return result, nil
+}
+
+func replayMerge(ctx context.Context, q *singleBlockQuerier, c *QueryCapture, rows []Profile) error {
+	var err error
+	switch c.Operation {
+	case QueryCaptureMergeStacktraces:
+		_, err = q.MergeByStacktraces(ctx, iter.NewSliceIterator(rows))
+	case QueryCaptureMergePprof:
+		_, err = q.MergePprof(ctx, iter.NewSliceIterator(rows))
+	case QueryCaptureMergeLabels:
+		if c.Function {
+			_, err = q.MergeFunctionByLabels(ctx, iter.NewSliceIterator(rows), FunctionSelector{Name: regexp.MustCompile("^$")}, c.By...)
+		} else {
+			_, err = q.MergeByLabels(ctx, iter.NewSliceIterator(rows), c.By...)
+		}
+	default:
+		err = fmt.Errorf("unknown operation %q", c.Operation)
+	}
+	return err
+}
+
+func (b *BlockQuerier) querierByULID(id string) *singleBlockQuerier {
+	b.queriersLock.RLock()
+	defer b.queriersLock.RUnlock()
+	for _, q := range b.queriers {
+		if q.meta.ULID.String() == id {
+			return q
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package phlaredb
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
+)
+
+func TestAnonymizeSelector(t *testing.T) {
+	require.Equal(t,
+		`{namespace="e7425506c9bb3628",pod=~"bbe7d54908da4614",__name__="process_cpu"}`,
+		anonymizeSelector(`{namespace="prod",pod=~"api-.*",__name__="process_cpu"}`),
+	)
+	require.Equal(t, "", anonymizeSelector(`{namespace=`))
+}
+
+func TestQueryCapture(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		end   = time.Unix(0, int64(time.Hour))
+		start = end.Add(-time.Minute)
+	)
+	db, err := New(ctx, Config{
+		DataPath:         t.TempDir(),
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, db.Close())
+	}()
+
+	ingestProfiles(t, db, cpuProfileGenerator, start.UnixNano(), end.UnixNano(), 15*time.Second,
+		&typesv1.LabelPair{Name: "pod", Value: "my-pod"},
+	)
+	require.NoError(t, db.Flush(ctx))
+	require.NoError(t, db.blockQuerier.Sync(ctx))
+
+	// capture the rows of a query of the block, skipping the first profile.
+	request := &ingestv1.SelectProfilesRequest{
+		LabelSelector: `{pod="my-pod"}`,
+		Type:          mustParseProfileSelector(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds"),
+		Start:         start.UnixMilli(),
+		End:           end.UnixMilli(),
+	}
+	capture := &QueryCapture{Time: time.Now()}
+	capture.setRequest(QueryCaptureMergeStacktraces, request, nil, false)
+	for _, q := range db.blockQuerier.Queriers() {
+		it, err := q.SelectMatchingProfiles(ctx, request)
+		require.NoError(t, err)
+		profiles, err := iter.Slice(it)
+		require.NoError(t, err)
+		require.Len(t, profiles, 5)
+		capture.addBlock(q, q.Sort(profiles)[1:])
+	}
+	require.Len(t, capture.Blocks, 1)
+	require.Equal(t, []int{0}, capture.Blocks[0].RowGroups)
+	require.Equal(t, []RowRange{{Start: 1, End: 5}}, capture.Blocks[0].Rows)
+	require.Equal(t, anonymizeSelector(`{pod="my-pod"}`), capture.Selector)
+
+	// write and read back the capture.
+	path := filepath.Join(t.TempDir(), queryCaptureFilename)
+	w, err := openQueryCaptureWriter(path, log.NewNopLogger())
+	require.NoError(t, err)
+	w.write(capture)
+	require.NoError(t, w.Close())
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	require.True(t, scanner.Scan())
+	var read QueryCapture
+	require.NoError(t, json.Unmarshal(scanner.Bytes(), &read))
+
+	for _, tc := range []struct {
+		operation string
+		function  bool
+	}{
+		{operation: QueryCaptureMergeStacktraces},
+		{operation: QueryCaptureMergePprof},
+		{operation: QueryCaptureMergeLabels},
+		{operation: QueryCaptureMergeLabels, function: true},
+	} {
+		read.Operation, read.Function = tc.operation, tc.function
+		replayed, err := db.blockQuerier.ReplayQueryCapture(ctx, &read)
+		require.NoError(t, err)
+		require.Len(t, replayed, 1)
+		require.NoError(t, replayed[0].Err)
+		require.Equal(t, capture.Blocks[0].ULID, replayed[0].ULID)
+		require.Equal(t, int64(4), replayed[0].Rows)
+	}
+
+	read.Blocks[0].ULID = "01GQ6PDZ6DZBK8YSW6D4JQZ2W0"
+	replayed, err := db.blockQuerier.ReplayQueryCapture(ctx, &read)
+	require.NoError(t, err)
+	require.Error(t, replayed[0].Err)
+}
+
+func TestQueryCaptureWriter_Rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), queryCaptureFilename)
+	w, err := openQueryCaptureWriter(path, log.NewNopLogger())
+	require.NoError(t, err)
+	w.maxBytes = 150
+
+	lines := func(path string) []string {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+	w.write(&QueryCapture{Operation: "first"})
+	w.write(&QueryCapture{Operation: "second"})
+	require.Len(t, lines(path), 1, "rotated")
+	require.Contains(t, lines(path)[0], "second")
+	require.Contains(t, lines(path + ".1")[0], "first")
+
+	w.write(&QueryCapture{Operation: "third"})
+	require.Contains(t, lines(path)[0], "third")
+	require.Contains(t, lines(path + ".1")[0], "second", "the previous backup is replaced")
+	require.NoError(t, w.Close())
+	w.write(&QueryCapture{Operation: "closed"})
+	require.Contains(t, lines(path)[0], "third")
+}
@@ -0,0 +1,414 @@
+package phlaredb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/runutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/fileutil"
+	"github.com/segmentio/parquet-go"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+	"github.com/grafana/phlare/pkg/util/build"
+)
+
+// RetentionRule overrides the retention period of the series matching its selector.
+type RetentionRule struct {
+	Selector string        `yaml:"selector" doc:"description=Label selector of the series the rule applies to, e.g. '{env=\"dev\"}'."`
+	Period   time.Duration `yaml:"period" doc:"description=Period the profiles of the matching series are kept for, measured from their timestamp."`
+}
+
+type retentionRule struct {
+	matchers []*labels.Matcher
+	period   time.Duration
+}
+
+func parseRetentionRules(rules []RetentionRule) ([]retentionRule, error) {
+	result := make([]retentionRule, 0, len(rules))
+	for _, r := range rules {
+		matchers, err := parser.ParseMetricSelector(r.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention rule selector %q: %w", r.Selector, err)
+		}
+		if r.Period <= 0 {
+			return nil, fmt.Errorf("retention rule %q: period must be positive", r.Selector)
+		}
+		result = append(result, retentionRule{matchers: matchers, period: r.Period})
+	}
+	return result, nil
+}
+
+func (r retentionRule) matches(ls phlaremodel.Labels) bool {
+	for _, m := range r.matchers {
+		if !m.Matches(ls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// retentionCutoffs computes the time before which the profiles of a series are deleted: the
+// first rule matching the series applies, the retention period otherwise.
+type retentionCutoffs struct {
+	rules   []retentionRule
+	cutoffs []int64
+	// fallback is math.MinInt64 when the retention period is disabled.
+	fallback int64
+}
+
+func newRetentionCutoffs(rules []retentionRule, period time.Duration, now time.Time) *retentionCutoffs {
+	c := &retentionCutoffs{
+		rules:    rules,
+		cutoffs:  make([]int64, len(rules)),
+		fallback: math.MinInt64,
+	}
+	for i, r := range rules {
+		c.cutoffs[i] = now.Add(-r.period).UnixNano()
+	}
+	if period > 0 {
+		c.fallback = now.Add(-period).UnixNano()
+	}
+	return c
+}
+
+func (c *retentionCutoffs) forSeries(ls phlaremodel.Labels) int64 {
+	for i, r := range c.rules {
+		if r.matches(ls) {
+			return c.cutoffs[i]
+		}
+	}
+	return c.fallback
+}
+
+// bounds returns the earliest and the latest cutoffs of any series.
+func (c *retentionCutoffs) bounds() (int64, int64) {
+	min, max := c.fallback, c.fallback
+	for _, cutoff := range c.cutoffs {
+		if cutoff < min {
+			min = cutoff
+		}
+		if cutoff > max {
+			max = cutoff
+		}
+	}
+	return min, max
+}
+
+type retentionSeries struct {
+	lbls             phlaremodel.Labels
+	fp               model.Fingerprint
+	cutoff           int64
+	minTime, maxTime int64
+	// newIndex is the series index in the rewritten block, -1 if the series is deleted.
+	newIndex int
+}
+
+// applyRetentionRules deletes the profiles of the local block older than the cutoffs of their
+// series. The index and the profiles table are rewritten, while the symbols tables are kept as
+// they are. It returns whether the block changed, and whether it has no profiles left, in
+// which case it is not rewritten.
+func applyRetentionRules(ctx context.Context, logger log.Logger, blockPath string, meta *block.Meta, cutoffs *retentionCutoffs) (changed, empty bool, err error) {
+	reader, err := index.NewFileReader(filepath.Join(blockPath, block.IndexFilename))
+	if err != nil {
+		return false, false, errors.Wrap(err, "open index")
+	}
+	defer runutil.CloseWithErrCapture(&err, reader, "closing index")
+
+	k, v := index.AllPostingsKey()
+	postings, err := reader.Postings(k, nil, v)
+	if err != nil {
+		return false, false, err
+	}
+	var (
+		series      []*retentionSeries
+		bySeriesIdx = map[uint32]*retentionSeries{}
+		chks        = make([]index.ChunkMeta, 1)
+		kept        int
+	)
+	for postings.Next() {
+		var lbls phlaremodel.Labels
+		fp, err := reader.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return false, false, err
+		}
+		if len(chks) == 0 {
+			continue
+		}
+		s := &retentionSeries{
+			lbls:     lbls,
+			fp:       model.Fingerprint(fp),
+			cutoff:   cutoffs.forSeries(lbls),
+			minTime:  math.MaxInt64,
+			maxTime:  math.MinInt64,
+			newIndex: -1,
+		}
+		if chks[0].MinTime < s.cutoff {
+			changed = true
+		}
+		if chks[0].MaxTime >= s.cutoff {
+			s.newIndex = kept
+			kept++
+		}
+		series = append(series, s)
+		bySeriesIdx[chks[0].SeriesIndex] = s
+	}
+	if err := postings.Err(); err != nil {
+		return false, false, err
+	}
+	if !changed {
+		return false, false, nil
+	}
+	if kept == 0 {
+		return true, true, nil
+	}
+
+	tmpPath := blockPath + ".retention"
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return false, false, err
+	}
+	if err := os.MkdirAll(tmpPath, defaultFolderMode); err != nil {
+		return false, false, err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(tmpPath)
+		}
+	}()
+
+	newMeta := *meta
+	newMeta.Files = append([]block.File(nil), meta.Files...)
+	newMeta.Stats = block.BlockStats{NumSeries: uint64(kept)}
+	profilesFile := (&schemav1.ProfilePersister{}).Name() + block.ParquetSuffix
+	histogramsFile := (&schemav1.HistogramPersister{}).Name() + block.ParquetSuffix
+	var histograms *histogramStore
+	if meta.FileByRelPath(histogramsFile) != nil {
+		// the histograms are rebuilt from the kept profiles, as the slots of the cutoffs are split.
+		histograms = newHistogramStore()
+		if err := histograms.Init(tmpPath, nil); err != nil {
+			return false, false, err
+		}
+	}
+	numRows, numRowGroups, err := rewriteProfiles(ctx, filepath.Join(blockPath, profilesFile), filepath.Join(tmpPath, profilesFile), bySeriesIdx, &newMeta, histograms)
+	if err != nil {
+		return false, false, errors.Wrap(err, "rewrite profiles")
+	}
+	var histogramRows uint64
+	if histograms != nil {
+		if histogramRows, _, err = histograms.Flush(ctx); err != nil {
+			return false, false, errors.Wrap(err, "rewrite histograms")
+		}
+	}
+	if err := writeRetentionIndex(ctx, filepath.Join(tmpPath, block.IndexFilename), series); err != nil {
+		return false, false, errors.Wrap(err, "rewrite index")
+	}
+
+	// link the unchanged files into the new block.
+	entries, err := os.ReadDir(blockPath)
+	if err != nil {
+		return false, false, err
+	}
+	for _, e := range entries {
+		switch e.Name() {
+		case block.IndexFilename, profilesFile, block.MetaFilename:
+			continue
+		case histogramsFile:
+			if histograms != nil {
+				continue
+			}
+		}
+		if err := os.Link(filepath.Join(blockPath, e.Name()), filepath.Join(tmpPath, e.Name())); err != nil {
+			return false, false, err
+		}
+	}
+
+	var minTime, maxTime int64 = math.MaxInt64, math.MinInt64
+	for _, s := range series {
+		if s.newIndex < 0 {
+			continue
+		}
+		if s.minTime < minTime {
+			minTime = s.minTime
+		}
+		if s.maxTime > maxTime {
+			maxTime = s.maxTime
+		}
+	}
+	newMeta.MinTime = model.TimeFromUnixNano(minTime)
+	newMeta.MaxTime = model.TimeFromUnixNano(maxTime)
+	for i, f := range newMeta.Files {
+		stat, err := os.Stat(filepath.Join(tmpPath, f.RelPath))
+		if err != nil {
+			continue
+		}
+		newMeta.Files[i].SizeBytes = uint64(stat.Size())
+		switch f.RelPath {
+		case block.IndexFilename:
+			newMeta.Files[i].TSDB = &block.TSDBFile{NumSeries: uint64(kept)}
+			if newMeta.Files[i].Checksums, err = block.FileChecksums(filepath.Join(tmpPath, f.RelPath)); err != nil {
+				return false, false, err
+			}
+		case profilesFile:
+			newMeta.Files[i].Parquet = &block.ParquetFile{NumRows: numRows, NumRowGroups: numRowGroups}
+		case histogramsFile:
+			newMeta.Files[i].Parquet = &block.ParquetFile{NumRows: histogramRows, NumRowGroups: 1}
+		}
+	}
+	newMeta.SetQueryStats()
+	if _, err := newMeta.WriteToFile(logger, tmpPath); err != nil {
+		return false, false, err
+	}
+	if err := fileutil.Replace(tmpPath, blockPath); err != nil {
+		return false, false, err
+	}
+	*meta = newMeta
+	return true, false, nil
+}
+
+// rewriteProfiles copies the profiles newer than the cutoff of their series, row group by row
+// group, adding their totals to the histograms when given, and updates the time range of the
+// series and the stats of the meta.
+func rewriteProfiles(ctx context.Context, src, dst string, bySeriesIdx map[uint32]*retentionSeries, meta *block.Meta, histograms *histogramStore) (numRows, numRowGroups uint64, err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer runutil.CloseWithErrCapture(&err, in, "closing profiles")
+	stat, err := in.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	file, err := parquet.OpenFile(in, stat.Size())
+	if err != nil {
+		return 0, 0, err
+	}
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer runutil.CloseWithErrCapture(&err, out, "closing rewritten profiles")
+
+	var (
+		persister = &schemav1.ProfilePersister{}
+		writer    = parquet.NewGenericWriter[*schemav1.Profile](out, persister.Schema(),
+			parquet.CreatedBy("github.com/grafana/phlare/", build.Version, build.Revision),
+		)
+		rows     = make([]parquet.Row, 256)
+		profiles = make([]*schemav1.Profile, 0, len(rows))
+	)
+	for _, rg := range file.RowGroups() {
+		var rgRows uint64
+		reader := rg.Rows()
+		for {
+			if ctx.Err() != nil {
+				_ = reader.Close()
+				return 0, 0, ctx.Err()
+			}
+			n, readErr := reader.ReadRows(rows)
+			profiles = profiles[:0]
+			for _, row := range rows[:n] {
+				_, p, err := persister.Reconstruct(row)
+				if err != nil {
+					_ = reader.Close()
+					return 0, 0, err
+				}
+				s, ok := bySeriesIdx[p.SeriesIndex]
+				if !ok || s.newIndex < 0 || p.TimeNanos < s.cutoff {
+					continue
+				}
+				p.SeriesIndex = uint32(s.newIndex)
+				if p.TimeNanos < s.minTime {
+					s.minTime = p.TimeNanos
+				}
+				if p.TimeNanos > s.maxTime {
+					s.maxTime = p.TimeNanos
+				}
+				if histograms != nil {
+					histograms.observe(s.fp, p.TimeNanos, p.Total())
+				}
+				meta.Stats.NumProfiles++
+				meta.Stats.NumSamples += uint64(len(p.Samples))
+				profiles = append(profiles, p)
+			}
+			if _, err := writer.Write(profiles); err != nil {
+				_ = reader.Close()
+				return 0, 0, err
+			}
+			rgRows += uint64(len(profiles))
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				_ = reader.Close()
+				return 0, 0, readErr
+			}
+		}
+		if err := reader.Close(); err != nil {
+			return 0, 0, err
+		}
+		if rgRows == 0 {
+			continue
+		}
+		if err := writer.Flush(); err != nil {
+			return 0, 0, err
+		}
+		numRows += rgRows
+		numRowGroups++
+	}
+	return numRows, numRowGroups, writer.Close()
+}
+
+// writeRetentionIndex writes the index of the series kept, in the order of the original index.
+func writeRetentionIndex(ctx context.Context, path string, series []*retentionSeries) error {
+	writer, err := index.NewWriter(ctx, path)
+	if err != nil {
+		return err
+	}
+	symbolsMap := make(map[string]struct{})
+	for _, s := range series {
+		if s.newIndex < 0 {
+			continue
+		}
+		for _, l := range s.lbls {
+			symbolsMap[l.Name] = struct{}{}
+			symbolsMap[l.Value] = struct{}{}
+		}
+	}
+	symbols := make([]string, 0, len(symbolsMap))
+	for s := range symbolsMap {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	for _, symbol := range symbols {
+		if err := writer.AddSymbol(symbol); err != nil {
+			return err
+		}
+	}
+	for _, s := range series {
+		if s.newIndex < 0 {
+			continue
+		}
+		if err := writer.AddSeries(storage.SeriesRef(s.newIndex), s.lbls, s.fp, index.ChunkMeta{
+			MinTime:     s.minTime,
+			MaxTime:     s.maxTime,
+			SeriesIndex: uint32(s.newIndex),
+		}); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -2,6 +2,7 @@ package phlaredb
 
 import (
 	"context"
+	"regexp"
 	"sort"
 
 	"github.com/google/pprof/profile"
@@ -31,6 +32,19 @@ func (b *singleBlockQuerier) MergeByStacktraces(ctx context.Context, rows iter.I
 	return b.resolveSymbols(ctx, stacktraceAggrValues)
 }
 
+func (b *singleBlockQuerier) MergeByStacktracesGroups(ctx context.Context, rows iter.Iterator[Profile], groups profileGroups, n int) ([]*ingestv1.MergeProfilesStacktracesResult, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktracesGroups - Block")
+	defer sp.Finish()
+
+	profiles, err := selectProfileSamples(ctx, b.profiles.file, rows)
+	if err != nil {
+		return nil, err
+	}
+	return mergeByStacktracesGroups(profiles, groups, n, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return b.resolveSymbols(ctx, samples)
+	})
+}
+
 func (b *singleBlockQuerier) MergePprof(ctx context.Context, rows iter.Iterator[Profile]) (*profile.Profile, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeByStacktraces - Block")
 	defer sp.Finish()
@@ -49,29 +63,19 @@ func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktrace
 
 	// gather stacktraces
 	stacktraceIDs := lo.Keys(stacktraceAggrByID)
-	locationsIdsByStacktraceID := map[int64][]uint64{}
-
 	sort.Slice(stacktraceIDs, func(i, j int) bool {
 		return stacktraceIDs[i] < stacktraceIDs[j]
 	})
 
-	var (
-		locationIDs = newUniqueIDs[struct{}]()
-		stacktraces = repeatedColumnIter(ctx, b.stacktraces.file, "LocationIDs.list.element", iter.NewSliceIterator(stacktraceIDs))
-	)
-
-	for stacktraces.Next() {
-		s := stacktraces.At()
-		locationsIdsByStacktraceID[s.Row] = make([]uint64, len(s.Values))
-		for i, locationID := range s.Values {
-			locID := locationID.Uint64()
+	locationsIdsByStacktraceID, err := b.stacktraceLocations(ctx, stacktraceIDs)
+	if err != nil {
+		return nil, err
+	}
+	locationIDs := newUniqueIDs[struct{}]()
+	for _, locations := range locationsIdsByStacktraceID {
+		for _, locID := range locations {
 			locationIDs[int64(locID)] = struct{}{}
-			locationsIdsByStacktraceID[s.Row][i] = locID
 		}
-
-	}
-	if err := stacktraces.Err(); err != nil {
-		return nil, err
 	}
 	sp.LogFields(otlog.Int("stacktraces", len(stacktraceIDs)))
 
@@ -217,41 +221,22 @@ func (b *singleBlockQuerier) resolvePprofSymbols(ctx context.Context, stacktrace
 func (b *singleBlockQuerier) resolveSymbols(ctx context.Context, stacktraceAggrByID map[int64]*ingestv1.StacktraceSample) (*ingestv1.MergeProfilesStacktracesResult, error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "ResolveSymbols - Block")
 	defer sp.Finish()
-	locationsByStacktraceID := map[int64][]uint64{}
-
 	// gather stacktraces
 	stacktraceIDs := lo.Keys(stacktraceAggrByID)
 	sort.Slice(stacktraceIDs, func(i, j int) bool {
 		return stacktraceIDs[i] < stacktraceIDs[j]
 	})
 
-	var (
-		locationIDs = newUniqueIDs[struct{}]()
-		stacktraces = repeatedColumnIter(ctx, b.stacktraces.file, "LocationIDs.list.element", iter.NewSliceIterator(stacktraceIDs))
-	)
-
-	for stacktraces.Next() {
-		s := stacktraces.At()
-
-		_, ok := locationsByStacktraceID[s.Row]
-		if !ok {
-			locationsByStacktraceID[s.Row] = make([]uint64, len(s.Values))
-			for i, locationID := range s.Values {
-				locID := locationID.Uint64()
-				locationIDs[int64(locID)] = struct{}{}
-				locationsByStacktraceID[s.Row][i] = locID
-			}
-			continue
-		}
-		for _, locationID := range s.Values {
-			locID := locationID.Uint64()
+	locationsByStacktraceID, err := b.stacktraceLocations(ctx, stacktraceIDs)
+	if err != nil {
+		return nil, err
+	}
+	locationIDs := newUniqueIDs[struct{}]()
+	for _, locations := range locationsByStacktraceID {
+		for _, locID := range locations {
 			locationIDs[int64(locID)] = struct{}{}
-			locationsByStacktraceID[s.Row] = append(locationsByStacktraceID[s.Row], locID)
 		}
 	}
-	if err := stacktraces.Err(); err != nil {
-		return nil, err
-	}
 	sp.LogFields(otlog.Int("stacktraces", len(stacktraceIDs)))
 	// gather locations
 	var (
@@ -354,6 +339,23 @@ func (b *singleBlockQuerier) MergeByLabels(ctx context.Context, rows iter.Iterat
 	return m.normalize(), nil
 }
 
+func (b *singleBlockQuerier) MergeFunctionByLabels(ctx context.Context, rows iter.Iterator[Profile], fn FunctionSelector, by ...string) ([]*typesv1.Series, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeFunctionByLabels - Block")
+	defer sp.Finish()
+
+	profiles, err := selectProfileSamples(ctx, b.profiles.file, rows)
+	if err != nil {
+		return nil, err
+	}
+	m := make(seriesByLabels)
+	if err := mergeFunctionByLabels(profiles, func(samples stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error) {
+		return b.resolveSymbols(ctx, samples)
+	}, fn, m, by...); err != nil {
+		return nil, err
+	}
+	return m.normalize(), nil
+}
+
 type Source interface {
 	Schema() *parquet.Schema
 	RowGroups() []parquet.RowGroup
@@ -407,7 +409,7 @@ func mergeByStacktraces(ctx context.Context, profileSource Source, rows iter.Ite
 			m.add(values[0][i].Int64(), values[1][i].Int64())
 		}
 	}
-	return nil
+	return it.Err()
 }
 
 type seriesByLabels map[string]*typesv1.Series
@@ -467,3 +469,145 @@ func mergeByLabels(ctx context.Context, profileSource Source, rows iter.Iterator
 	}
 	return it.Err()
 }
+
+// FunctionSelector selects the samples of a profile by the functions of their stacktrace.
+type FunctionSelector struct {
+	// Name matches the names of the functions.
+	Name *regexp.Regexp
+	// Total selects the samples with a matching function anywhere in the stacktrace, instead of
+	// only the samples with a matching leaf function.
+	Total bool
+	// Stack selects the samples under a node of the flamegraph: the stacktrace must start with
+	// these function names, from the root.
+	Stack []string
+}
+
+// selects reports whether the function selector selects a subset of the samples.
+func (fn FunctionSelector) selects() bool {
+	return fn.Name != nil || len(fn.Stack) > 0
+}
+
+// matchingStacktraces returns the IDs of the resolved stacktraces selected by the function selector.
+func (fn FunctionSelector) matchingStacktraces(samples stacktraceSampleMap, functionNames []string) map[int64]struct{} {
+	var matches []bool
+	if fn.Name != nil {
+		matches = make([]bool, len(functionNames))
+		for i, name := range functionNames {
+			matches[i] = fn.Name.MatchString(name)
+		}
+	}
+	result := make(map[int64]struct{})
+	for id, sample := range samples {
+		if !fn.matchesStack(sample.FunctionIds, functionNames) {
+			continue
+		}
+		if matches == nil {
+			result[id] = struct{}{}
+			continue
+		}
+		functionIDs := sample.FunctionIds
+		if !fn.Total && len(functionIDs) > 0 {
+			// the first function is the leaf of the stacktrace.
+			functionIDs = functionIDs[:1]
+		}
+		for _, functionID := range functionIDs {
+			if matches[functionID] {
+				result[id] = struct{}{}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// matchesStack reports whether the stacktrace starts with the stack of the selector. The
+// functions of the stacktrace are ordered from the leaf to the root.
+func (fn FunctionSelector) matchesStack(functionIDs []int32, functionNames []string) bool {
+	if len(functionIDs) < len(fn.Stack) {
+		return false
+	}
+	for i, name := range fn.Stack {
+		if functionNames[functionIDs[len(functionIDs)-1-i]] != name {
+			return false
+		}
+	}
+	return true
+}
+
+type profileSamples struct {
+	profile       Profile
+	stacktraceIDs []int64
+	values        []int64
+}
+
+func selectProfileSamples(ctx context.Context, profileSource Source, rows iter.Iterator[Profile]) ([]profileSamples, error) {
+	// clone the rows to be able to iterate over them twice
+	multiRows, err := iter.CloneN(rows, 2)
+	if err != nil {
+		return nil, err
+	}
+	it := query.NewMultiRepeatedPageIterator(
+		repeatedColumnIter(ctx, profileSource, "Samples.list.element.StacktraceID", multiRows[0]),
+		repeatedColumnIter(ctx, profileSource, "Samples.list.element.Value", multiRows[1]),
+	)
+	defer it.Close()
+
+	var result []profileSamples
+	for it.Next() {
+		values := it.At().Values
+		p := profileSamples{
+			profile:       it.At().Row,
+			stacktraceIDs: make([]int64, len(values[0])),
+			values:        make([]int64, len(values[0])),
+		}
+		for i := range values[0] {
+			p.stacktraceIDs[i] = values[0][i].Int64()
+			p.values[i] = values[1][i].Int64()
+		}
+		result = append(result, p)
+	}
+	return result, it.Err()
+}
+
+// mergeFunctionByLabels adds a point per profile with the value of its samples selected by the
+// function selector. Profiles without matching samples have a zero point.
+func mergeFunctionByLabels(profiles []profileSamples, resolve func(stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error), fn FunctionSelector, m seriesByLabels, by ...string) error {
+	samples := make(stacktraceSampleMap)
+	for _, p := range profiles {
+		for i, id := range p.stacktraceIDs {
+			samples.add(id, p.values[i])
+		}
+	}
+	resolved, err := resolve(samples)
+	if err != nil {
+		return err
+	}
+	matching := fn.matchingStacktraces(samples, resolved.FunctionNames)
+
+	labelsByFingerprint := map[model.Fingerprint]string{}
+	labelBuf := make([]byte, 0, 1024)
+	for _, p := range profiles {
+		var total int64
+		for i, id := range p.stacktraceIDs {
+			if _, ok := matching[id]; ok {
+				total += p.values[i]
+			}
+		}
+		labelsByString, ok := labelsByFingerprint[p.profile.Fingerprint()]
+		if !ok {
+			labelBuf = p.profile.Labels().BytesWithLabels(labelBuf, by...)
+			labelsByString = string(labelBuf)
+			labelsByFingerprint[p.profile.Fingerprint()] = labelsByString
+		}
+		series, ok := m[labelsByString]
+		if !ok {
+			series = &typesv1.Series{Labels: p.profile.Labels().WithLabels(by...)}
+			m[labelsByString] = series
+		}
+		series.Points = append(series.Points, &typesv1.Point{
+			Timestamp: int64(p.profile.Timestamp()),
+			Value:     float64(total),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package phlaredb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/errgroup"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// MaxMergeGroups is the maximum number of requests merged in a single pass.
+const MaxMergeGroups = 64
+
+type profileKey struct {
+	fingerprint model.Fingerprint
+	timestamp   model.Time
+}
+
+// profileGroups are the groups of the profiles merged in a single pass, as a bitmask of the
+// indices of the requests they match.
+type profileGroups map[profileKey]uint64
+
+func (g profileGroups) of(p Profile) uint64 {
+	return g[profileKey{fingerprint: p.Fingerprint(), timestamp: p.Timestamp()}]
+}
+
+// mergeByStacktracesGroups merges the samples of the profiles per group. The symbols of the
+// stacktraces of all the groups are resolved at once.
+func mergeByStacktracesGroups(profiles []profileSamples, groups profileGroups, n int, resolve func(stacktraceSampleMap) (*ingestv1.MergeProfilesStacktracesResult, error)) ([]*ingestv1.MergeProfilesStacktracesResult, error) {
+	all := make(stacktraceSampleMap)
+	values := make([]map[int64]int64, n)
+	for i := range values {
+		values[i] = map[int64]int64{}
+	}
+	for _, p := range profiles {
+		mask := groups.of(p.profile)
+		for i, id := range p.stacktraceIDs {
+			all.add(id, p.values[i])
+			for g := 0; g < n; g++ {
+				if mask&(1<<g) != 0 {
+					values[g][id] += p.values[i]
+				}
+			}
+		}
+	}
+	// the function IDs are set on the samples as they are resolved.
+	resolved, err := resolve(all)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*ingestv1.MergeProfilesStacktracesResult, n)
+	for g := range results {
+		// the results are merged per group, which rewrites their function IDs and names: they
+		// can't be shared.
+		result := &ingestv1.MergeProfilesStacktracesResult{
+			Stacktraces:   make([]*ingestv1.StacktraceSample, 0, len(values[g])),
+			FunctionNames: append([]string(nil), resolved.FunctionNames...),
+		}
+		for id, v := range values[g] {
+			result.Stacktraces = append(result.Stacktraces, &ingestv1.StacktraceSample{
+				FunctionIds: append([]int32(nil), all[id].FunctionIds...),
+				Value:       v,
+			})
+		}
+		results[g] = result
+	}
+	return results, nil
+}
+
+// selectProfileGroups selects the profiles of the querier matching any of the requests, sorted
+// by timestamp then labels, with the requests each of them matches.
+func selectProfileGroups(ctx context.Context, q Querier, requests []*ingestv1.SelectProfilesRequest) (iter.Iterator[Profile], profileGroups, error) {
+	var (
+		iters  = make([]iter.Iterator[Profile], 0, len(requests))
+		groups = profileGroups{}
+	)
+	for i, req := range requests {
+		if !q.InRange(model.Time(req.Start), model.Time(req.End)) {
+			continue
+		}
+		it, err := q.SelectMatchingProfiles(ctx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the profiles are collected to record their groups, as they would be to be merged.
+		profiles, err := iter.Slice(it)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range profiles {
+			groups[profileKey{fingerprint: p.Fingerprint(), timestamp: p.Timestamp()}] |= 1 << i
+		}
+		iters = append(iters, iter.NewSliceIterator(profiles))
+	}
+	var (
+		sorted = iter.NewSortProfileIterator(iters)
+		result = make([]Profile, 0, len(groups))
+		seen   = make(map[profileKey]struct{}, len(groups))
+	)
+	for sorted.Next() {
+		p := sorted.At()
+		// the profiles matching several requests are selected once.
+		key := profileKey{fingerprint: p.Fingerprint(), timestamp: p.Timestamp()}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, p)
+	}
+	if err := sorted.Err(); err != nil {
+		return nil, nil, err
+	}
+	return iter.NewSliceIterator(result), groups, nil
+}
+
+// mergeProfilesStacktracesGroups merges the profiles matching each of the requests in a single
+// pass over the queriers: the profiles matching several requests are streamed to the client and
+// read once. The result has a merge per request, in their order.
+func (q Queriers) mergeProfilesStacktracesGroups(ctx context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesStacktracesRequest, ingestv1.MergeProfilesStacktracesResponse], requests []*ingestv1.SelectProfilesRequest) error {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "MergeProfilesStacktracesGroups")
+	defer sp.Finish()
+	if len(requests) > MaxMergeGroups {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d requests can be merged at once, got %d", MaxMergeGroups, len(requests)))
+	}
+	start, end := model.Time(requests[0].Start), model.Time(requests[0].End)
+	for _, req := range requests {
+		if model.Time(req.Start) < start {
+			start = model.Time(req.Start)
+		}
+		if model.Time(req.End) > end {
+			end = model.Time(req.End)
+		}
+	}
+	sp.LogFields(
+		otlog.Int("requests", len(requests)),
+		otlog.String("start", start.Time().String()),
+		otlog.String("end", end.Time().String()),
+	)
+
+	var (
+		lock    sync.Mutex
+		results = make([][]*ingestv1.MergeProfilesStacktracesResult, len(requests))
+	)
+	g, ctx := errgroup.WithContext(ctx)
+	merges := newMergeScheduler(g, mergeBudget)
+	for _, q := range q.ForTimeRange(start, end) {
+		q := q
+		profiles, groups, err := selectProfileGroups(ctx, q, requests)
+		if err != nil {
+			return err
+		}
+		selectedProfiles, err := filterProfiles[
+			BidiServerMerge[*ingestv1.MergeProfilesStacktracesResponse, *ingestv1.MergeProfilesStacktracesRequest],
+			*ingestv1.MergeProfilesStacktracesResponse,
+			*ingestv1.MergeProfilesStacktracesRequest](ctx, profiles, 2048, stream)
+		if err != nil {
+			return err
+		}
+		selectedProfiles = q.Sort(selectedProfiles)
+		merges.schedule(q, selectedProfiles, func(profiles []Profile) error {
+			merge, err := q.MergeByStacktracesGroups(ctx, iter.NewSliceIterator(profiles), groups, len(requests))
+			if err != nil {
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for i := range merge {
+				results[i] = append(results[i], merge[i])
+			}
+			return nil
+		})
+	}
+
+	// Signals the end of the profile streaming by sending an empty response.
+	if err := stream.Send(&ingestv1.MergeProfilesStacktracesResponse{}); err != nil {
+		return err
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	res := &ingestv1.MergeProfilesStacktracesResponse{
+		Results: make([]*ingestv1.MergeProfilesStacktracesResult, len(requests)),
+	}
+	for i := range results {
+		res.Results[i] = phlaremodel.MergeBatchMergeStacktraces(results[i]...)
+	}
+	if err := stream.Send(res); err != nil {
+		if errors.Is(err, io.EOF) {
+			return connect.NewError(connect.CodeCanceled, errors.New("client closed stream"))
+		}
+		return err
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"testing"
 	"time"
@@ -543,6 +544,84 @@ func TestHeadMergeSampleByLabels(t *testing.T) {
 	}
 }
 
+func TestMergeFunctionByLabels(t *testing.T) {
+	testPath := t.TempDir()
+	db, err := New(context.Background(), Config{
+		DataPath:         testPath,
+		MaxBlockDuration: time.Duration(100000) * time.Minute, // we will manually flush
+	}, NoLimit)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	p := pprofth.NewProfileBuilder(int64(15*time.Second)).CPUProfile().WithLabels("foo", "bar")
+	p.ForStacktraceString("gcBgMarkWorker", "main").AddSamples(2)
+	p.ForStacktraceString("work", "gcBgMarkWorker", "main").AddSamples(3)
+	p.ForStacktraceString("work", "main").AddSamples(5)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+	p = pprofth.NewProfileBuilder(int64(30*time.Second)).CPUProfile().WithLabels("foo", "bar")
+	p.ForStacktraceString("work", "main").AddSamples(7)
+	require.NoError(t, db.Head().Ingest(ctx, p.Profile, p.UUID, p.Labels...))
+
+	series := func(v1, v2 float64) []*typesv1.Series {
+		return []*typesv1.Series{{
+			Labels: []*typesv1.LabelPair{{Name: "foo", Value: "bar"}},
+			Points: []*typesv1.Point{{Timestamp: 15000, Value: v1}, {Timestamp: 30000, Value: v2}},
+		}}
+	}
+	tests := []struct {
+		name     string
+		fn       FunctionSelector
+		expected []*typesv1.Series
+	}{
+		{"self", FunctionSelector{Name: regexp.MustCompile("^(?:gcBgMarkWorker)$")}, series(2, 0)},
+		{"total", FunctionSelector{Name: regexp.MustCompile("^(?:gcBgMarkWorker)$"), Total: true}, series(5, 0)},
+		{"regex", FunctionSelector{Name: regexp.MustCompile("^(?:gc.*|work)$")}, series(10, 7)},
+		{"root total", FunctionSelector{Name: regexp.MustCompile("^(?:main)$"), Total: true}, series(10, 7)},
+		{"stack", FunctionSelector{Stack: []string{"main", "gcBgMarkWorker"}}, series(5, 0)},
+		{"stack root", FunctionSelector{Stack: []string{"main"}}, series(10, 7)},
+		{"stack and function", FunctionSelector{Name: regexp.MustCompile("^(?:work)$"), Stack: []string{"main", "gcBgMarkWorker"}}, series(3, 0)},
+	}
+	run := func(t *testing.T, q Querier) {
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				profileIt, err := q.SelectMatchingProfiles(ctx, &ingestv1.SelectProfilesRequest{
+					LabelSelector: `{}`,
+					Type: &typesv1.ProfileType{
+						Name:       "process_cpu",
+						SampleType: "cpu",
+						SampleUnit: "nanoseconds",
+						PeriodType: "cpu",
+						PeriodUnit: "nanoseconds",
+					},
+					Start: int64(model.TimeFromUnixNano(0)),
+					End:   int64(model.TimeFromUnixNano(int64(1 * time.Minute))),
+				})
+				require.NoError(t, err)
+				profiles, err := iter.Slice(profileIt)
+				require.NoError(t, err)
+
+				series, err := q.MergeFunctionByLabels(ctx, iter.NewSliceIterator(q.Sort(profiles)), tc.fn, "foo")
+				require.NoError(t, err)
+				testhelper.EqualProto(t, tc.expected, series)
+			})
+		}
+	}
+
+	t.Run("head", func(t *testing.T) {
+		run(t, db.Head().Queriers()[0])
+	})
+
+	require.NoError(t, db.Flush(context.Background()))
+	b, err := filesystem.NewBucket(filepath.Join(testPath, pathLocal))
+	require.NoError(t, err)
+	q := NewBlockQuerier(context.Background(), b)
+	require.NoError(t, q.Sync(context.Background()))
+
+	t.Run("block", func(t *testing.T) {
+		run(t, q.queriers[0])
+	})
+}
+
 func TestMergePprof(t *testing.T) {
 	testPath := t.TempDir()
 	db, err := New(context.Background(), Config{
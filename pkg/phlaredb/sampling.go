@@ -0,0 +1,144 @@
+package phlaredb
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+// samplingUnit holds the profiles sampled together: the profiles of a row group of a block, or
+// of a querier of the head.
+type samplingUnit struct {
+	querier  Querier
+	profiles []Profile
+	// size is the estimated number of samples of the profiles.
+	size float64
+	// probability is the probability of the unit to be merged.
+	probability float64
+}
+
+// rowGroupsQuerier is implemented by the queriers reading profiles from multiple row groups,
+// which are sampled separately.
+type rowGroupsQuerier interface {
+	// splitByRowGroup splits profiles sorted by the querier by row group.
+	splitByRowGroup(profiles []Profile) [][]Profile
+}
+
+func (b *singleBlockQuerier) splitByRowGroup(profiles []Profile) [][]Profile {
+	var (
+		result [][]Profile
+		end    int64
+		i      int
+	)
+	for _, rg := range b.profiles.file.RowGroups() {
+		end += rg.NumRows()
+		start := i
+		for i < len(profiles) && profiles[i].(BlockProfile).RowNum < end {
+			i++
+		}
+		if i > start {
+			result = append(result, profiles[start:i])
+		}
+	}
+	if i < len(profiles) {
+		result = append(result, profiles[i:])
+	}
+	return result
+}
+
+// samplingUnits splits the profiles selected in the querier in sampling units, sized from the
+// stats of their block.
+func samplingUnits(q Querier, profiles []Profile) []samplingUnit {
+	if len(profiles) == 0 {
+		return nil
+	}
+	groups := [][]Profile{profiles}
+	if rq, ok := q.(rowGroupsQuerier); ok {
+		groups = rq.splitByRowGroup(profiles)
+	}
+	units := make([]samplingUnit, 0, len(groups))
+	for _, g := range groups {
+		size := float64(estimateMergeCost(q, len(g)).samples)
+		if size < float64(len(g)) {
+			size = float64(len(g))
+		}
+		units = append(units, samplingUnit{querier: q, profiles: g, size: size})
+	}
+	return units
+}
+
+// sampleUnits picks the units to merge. Each unit is picked with a probability proportional to
+// its size, so that the expected number of units picked is the fraction of the units. The units
+// whose probability would exceed one are always picked, and the others share the rest.
+func sampleUnits(units []samplingUnit, fraction float64, rnd *rand.Rand) []samplingUnit {
+	expected := fraction * float64(len(units))
+	capped := make([]bool, len(units))
+	for {
+		var (
+			total     float64
+			remaining = expected
+		)
+		for i, u := range units {
+			if capped[i] {
+				remaining--
+			} else {
+				total += u.size
+			}
+		}
+		changed := false
+		for i := range units {
+			if capped[i] {
+				units[i].probability = 1
+				continue
+			}
+			p := 1.0
+			if total > 0 && remaining > 0 {
+				p = remaining * units[i].size / total
+			}
+			if p >= 1 {
+				p = 1
+				capped[i] = true
+				changed = true
+			}
+			units[i].probability = p
+		}
+		if !changed {
+			break
+		}
+	}
+
+	var sampled []samplingUnit
+	for _, u := range units {
+		if u.probability >= 1 || rnd.Float64() < u.probability {
+			sampled = append(sampled, u)
+		}
+	}
+	return sampled
+}
+
+// newSamplingRand returns the source of the sampling of a query. It is seeded by the query, so
+// repeating the query samples the same row groups.
+func newSamplingRand(request *ingestv1.SelectProfilesRequest) *rand.Rand {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(request.LabelSelector))
+	if request.Type != nil {
+		_, _ = h.Write([]byte(request.Type.ID))
+	}
+	return rand.New(rand.NewSource(int64(h.Sum64()) ^ request.Start ^ request.End<<1))
+}
+
+// scaleStacktraces scales the values of the merge of a unit by the inverse of its probability,
+// and returns the contribution of the unit to the variance of the estimated total.
+func scaleStacktraces(merge *ingestv1.MergeProfilesStacktracesResult, probability float64) float64 {
+	if probability >= 1 {
+		return 0
+	}
+	var total float64
+	for _, st := range merge.Stacktraces {
+		total += float64(st.Value)
+		st.Value = int64(math.Round(float64(st.Value) / probability))
+	}
+	return (1 - probability) * total * total / (probability * probability)
+}
@@ -0,0 +1,82 @@
+package phlaredb
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+)
+
+func TestSampleUnits(t *testing.T) {
+	newUnits := func(sizes ...float64) []samplingUnit {
+		units := make([]samplingUnit, len(sizes))
+		for i, s := range sizes {
+			units[i].size = s
+		}
+		return units
+	}
+	probabilities := func(units []samplingUnit) []float64 {
+		result := make([]float64, len(units))
+		for i, u := range units {
+			result[i] = u.probability
+		}
+		return result
+	}
+
+	units := newUnits(1, 1, 1, 1, 3)
+	sampleUnits(units, 0.2, rand.New(rand.NewSource(0)))
+	require.InDeltaSlice(t, []float64{1. / 7, 1. / 7, 1. / 7, 1. / 7, 3. / 7}, probabilities(units), 1e-9)
+
+	// the large unit is always merged, the others share the rest of the fraction.
+	units = newUnits(100, 1, 1, 1, 1)
+	sampled := sampleUnits(units, 0.4, rand.New(rand.NewSource(0)))
+	require.InDeltaSlice(t, []float64{1, 0.25, 0.25, 0.25, 0.25}, probabilities(units), 1e-9)
+	require.Equal(t, float64(100), sampled[0].size)
+
+	units = newUnits(1, 2, 3)
+	require.Len(t, sampleUnits(units, 1, rand.New(rand.NewSource(0))), 3)
+	require.Equal(t, []float64{1, 1, 1}, probabilities(units))
+}
+
+func TestSampleUnits_Unbiased(t *testing.T) {
+	sizes := []int64{10, 20, 30, 40, 50, 60, 70, 80, 90, 1000}
+	var exact int64
+	for _, s := range sizes {
+		exact += s
+	}
+	rnd := rand.New(rand.NewSource(1))
+	var (
+		estimates float64
+		runs      = 2000
+	)
+	for i := 0; i < runs; i++ {
+		units := make([]samplingUnit, len(sizes))
+		for j, s := range sizes {
+			units[j].size = float64(s)
+		}
+		var total int64
+		for _, u := range sampleUnits(units, 0.3, rnd) {
+			merge := &ingestv1.MergeProfilesStacktracesResult{
+				Stacktraces: []*ingestv1.StacktraceSample{{Value: int64(u.size)}},
+			}
+			scaleStacktraces(merge, u.probability)
+			total += merge.Stacktraces[0].Value
+		}
+		estimates += float64(total)
+	}
+	require.InEpsilon(t, float64(exact), estimates/float64(runs), 0.02)
+}
+
+func TestScaleStacktraces(t *testing.T) {
+	merge := &ingestv1.MergeProfilesStacktracesResult{
+		Stacktraces: []*ingestv1.StacktraceSample{{Value: 10}, {Value: 30}},
+	}
+	require.Equal(t, float64(19200), scaleStacktraces(merge, 0.25))
+	require.Equal(t, int64(40), merge.Stacktraces[0].Value)
+	require.Equal(t, int64(120), merge.Stacktraces[1].Value)
+
+	require.Zero(t, scaleStacktraces(merge, 1))
+	require.Equal(t, int64(40), merge.Stacktraces[0].Value)
+}
@@ -0,0 +1,59 @@
+package v1
+
+import (
+	"github.com/segmentio/parquet-go"
+)
+
+var histogramsSchema = parquet.SchemaOf(new(SeriesHistogram))
+
+// SeriesHistogram is the distribution of the totals of the profiles of a series in a time slot.
+type SeriesHistogram struct {
+	// SeriesFingerprint is the fingerprint of the labels of the series, consistent between
+	// blocks.
+	SeriesFingerprint uint64 `parquet:",delta"`
+	// Timestamp is the end of the slot, in milliseconds.
+	Timestamp int64 `parquet:",delta"`
+	Count     uint64
+	Sum       int64
+	Min       int64
+	Max       int64
+	// ZeroCount is the number of totals lower than or equal to zero.
+	ZeroCount uint64
+	// Buckets are the buckets of the positive totals, by increasing index.
+	Buckets []HistogramBucket `parquet:",list"`
+}
+
+type HistogramBucket struct {
+	Index int32
+	Count uint64
+}
+
+type HistogramPersister struct{}
+
+func (*HistogramPersister) Name() string {
+	return "histograms"
+}
+
+func (*HistogramPersister) Schema() *parquet.Schema {
+	return histogramsSchema
+}
+
+func (*HistogramPersister) SortingColumns() parquet.SortingOption {
+	return parquet.SortingColumns(
+		parquet.Ascending("SeriesFingerprint"),
+		parquet.Ascending("Timestamp"),
+	)
+}
+
+func (*HistogramPersister) Deconstruct(row parquet.Row, _ uint64, h *SeriesHistogram) parquet.Row {
+	row = histogramsSchema.Deconstruct(row, h)
+	return row
+}
+
+func (*HistogramPersister) Reconstruct(row parquet.Row) (id uint64, h *SeriesHistogram, err error) {
+	var histogram SeriesHistogram
+	if err := histogramsSchema.Reconstruct(&histogram, row); err != nil {
+		return 0, nil, err
+	}
+	return 0, &histogram, nil
+}
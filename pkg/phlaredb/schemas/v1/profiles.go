@@ -4,6 +4,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/prometheus/common/model"
 	"github.com/segmentio/parquet-go"
+	"github.com/segmentio/parquet-go/encoding"
 
 	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	phlareparquet "github.com/grafana/phlare/pkg/parquet"
@@ -17,12 +18,19 @@ var (
 		phlareparquet.NewGroupField("Num", parquet.Optional(parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked))),
 		phlareparquet.NewGroupField("NumUnit", parquet.Optional(stringRef)),
 	})
-	sampleField = phlareparquet.Group{
+	profilesSchema = NewProfilesSchema(&parquet.DeltaBinaryPacked)
+)
+
+// NewProfilesSchema returns the schema of the profiles, with the sample values stored with the
+// given encoding. The encoding doesn't change the layout of the rows, so the files written with
+// different encodings are read the same way.
+func NewProfilesSchema(valueEncoding encoding.Encoding) *parquet.Schema {
+	sampleField := phlareparquet.Group{
 		phlareparquet.NewGroupField("StacktraceID", parquet.Encoded(parquet.Uint(64), &parquet.DeltaBinaryPacked)),
-		phlareparquet.NewGroupField("Value", parquet.Encoded(parquet.Int(64), &parquet.DeltaBinaryPacked)),
+		phlareparquet.NewGroupField("Value", parquet.Encoded(parquet.Int(64), valueEncoding)),
 		phlareparquet.NewGroupField("Labels", pprofLabels),
 	}
-	profilesSchema = parquet.NewSchema("Profile", phlareparquet.Group{
+	return parquet.NewSchema("Profile", phlareparquet.Group{
 		phlareparquet.NewGroupField("ID", parquet.UUID()),
 		phlareparquet.NewGroupField("SeriesIndex", parquet.Encoded(parquet.Uint(32), &parquet.DeltaBinaryPacked)),
 		phlareparquet.NewGroupField("Samples", parquet.List(sampleField)),
@@ -34,7 +42,7 @@ var (
 		phlareparquet.NewGroupField("Comments", parquet.List(stringRef)),
 		phlareparquet.NewGroupField("DefaultSampleType", parquet.Optional(parquet.Int(64))),
 	})
-)
+}
 
 type Sample struct {
 	StacktraceID uint64             `parquet:",delta"`
@@ -53,9 +53,17 @@ func (*ReadWriter[T, P]) ReadParquetFile(file io.ReaderAt) ([]T, error) {
 	)
 	defer reader.Close()
 
+	// the rows are read in batches.
 	rows := make([]parquet.Row, reader.NumRows())
-	if _, err := reader.ReadRows(rows); err != nil {
-		return nil, err
+	for read := 0; read < len(rows); {
+		n, err := reader.ReadRows(rows[read:])
+		read += n
+		if err == io.EOF && read == len(rows) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	var (
@@ -58,6 +58,44 @@ func TestStacktracesRoundTrip(t *testing.T) {
 	assert.Equal(t, newStacktraces(), sRead)
 }
 
+func TestStacktraceNodes(t *testing.T) {
+	stacktraces := []*Stacktrace{
+		{LocationIDs: []uint64{3, 2, 1}},
+		{LocationIDs: []uint64{1}},
+		{LocationIDs: []uint64{}},
+		{LocationIDs: []uint64{4, 2, 1}},
+		{LocationIDs: []uint64{5, 4, 2, 1}},
+	}
+	nodes := NewStacktraceNodes(stacktraces)
+	// a single node is added, for the caller [2, 1] shared by the stacktraces 0 and 3.
+	require.Len(t, nodes, len(stacktraces)+1)
+	require.Equal(t, &StacktraceNode{ID: 5, LocationID: 2, ParentID: 2, Depth: 2}, nodes[5])
+
+	for id, s := range stacktraces {
+		node := nodes[id]
+		require.Equal(t, uint64(id), node.ID)
+		require.Equal(t, uint32(len(s.LocationIDs)), node.Depth)
+		locations := []uint64{}
+		for node.Depth > 0 {
+			locations = append(locations, node.LocationID)
+			if node.ParentID == 0 {
+				break
+			}
+			node = nodes[node.ParentID-1]
+		}
+		require.Equal(t, s.LocationIDs, locations)
+	}
+
+	var (
+		w   = &ReadWriter[*StacktraceNode, *StacktraceNodePersister]{}
+		buf bytes.Buffer
+	)
+	require.NoError(t, w.WriteParquetFile(&buf, nodes))
+	nodesRead, err := w.ReadParquetFile(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, nodes, nodesRead)
+}
+
 func newStrings() []string {
 	return []string{
 		"",
@@ -166,3 +204,42 @@ func TestProfilesRoundTrip(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, newProfiles(), sRead)
 }
+
+func TestHistogramsRoundTrip(t *testing.T) {
+	var (
+		h = []*SeriesHistogram{
+			{SeriesFingerprint: 2, Timestamp: 15000, Count: 1, Sum: 3, Min: 3, Max: 3, Buckets: []HistogramBucket{{Index: 13, Count: 1}}},
+			{SeriesFingerprint: 1, Timestamp: 30000, Count: 3, Sum: 4, Min: -1, Max: 5, ZeroCount: 1, Buckets: []HistogramBucket{{Index: -2, Count: 1}, {Index: 19, Count: 1}}},
+			{SeriesFingerprint: 1, Timestamp: 15000, Count: 1, Sum: 0, ZeroCount: 1, Buckets: []HistogramBucket{}},
+		}
+		w   = &ReadWriter[*SeriesHistogram, *HistogramPersister]{}
+		buf bytes.Buffer
+	)
+
+	require.NoError(t, w.WriteParquetFile(&buf, h))
+
+	hRead, err := w.ReadParquetFile(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	// the histograms are sorted by series and timestamp.
+	assert.Equal(t, []*SeriesHistogram{h[2], h[1], h[0]}, hRead)
+}
+
+func TestTargetMetadataRoundTrip(t *testing.T) {
+	var (
+		m = []*TargetMetadata{
+			{SeriesFingerprint: 2, Name: "go_version", Value: "go1.20", FirstSeen: 1000, LastSeen: 2000},
+			{SeriesFingerprint: 1, Name: "go_version", Value: "go1.20", FirstSeen: 3000, LastSeen: 4000},
+			{SeriesFingerprint: 1, Name: "build_version", Value: "v1.2.3", FirstSeen: 1000, LastSeen: 4000},
+			{SeriesFingerprint: 1, Name: "go_version", Value: "go1.19", FirstSeen: 1000, LastSeen: 2000},
+		}
+		w   = &ReadWriter[*TargetMetadata, *TargetMetadataPersister]{}
+		buf bytes.Buffer
+	)
+
+	require.NoError(t, w.WriteParquetFile(&buf, m))
+
+	mRead, err := w.ReadParquetFile(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	// the metadata is sorted by series, name and first seen.
+	assert.Equal(t, []*TargetMetadata{m[2], m[3], m[1], m[0]}, mRead)
+}
@@ -1,6 +1,8 @@
 package v1
 
 import (
+	"sort"
+
 	"github.com/segmentio/parquet-go"
 
 	phlareparquet "github.com/grafana/phlare/pkg/parquet"
@@ -52,3 +54,103 @@ func (*StacktracePersister) Reconstruct(row parquet.Row) (id uint64, s *Stacktra
 	}
 	return stored.ID, &Stacktrace{LocationIDs: stored.LocationIDs}, nil
 }
+
+var stacktraceNodesSchema = parquet.NewSchema("StacktraceNode", phlareparquet.Group{
+	phlareparquet.NewGroupField("ID", parquet.Encoded(parquet.Uint(64), &parquet.DeltaBinaryPacked)),
+	phlareparquet.NewGroupField("LocationID", parquet.Encoded(parquet.Uint(64), &parquet.DeltaBinaryPacked)),
+	phlareparquet.NewGroupField("ParentID", parquet.Encoded(parquet.Uint(64), &parquet.DeltaBinaryPacked)),
+	phlareparquet.NewGroupField("Depth", parquet.Encoded(parquet.Uint(32), &parquet.DeltaBinaryPacked)),
+})
+
+// StacktraceNode stores a stacktrace as its leaf location and a pointer to the stacktrace of its
+// caller, so the stacktraces sharing callers share their nodes.
+type StacktraceNode struct {
+	ID         uint64 `parquet:",delta"`
+	LocationID uint64 `parquet:",delta"`
+	// ParentID is the ID of the node of the caller plus one, 0 for the root of the stacktrace.
+	ParentID uint64 `parquet:",delta"`
+	// Depth is the number of locations of the stacktrace, 0 for an empty stacktrace.
+	Depth uint32 `parquet:",delta"`
+}
+
+// NewStacktraceNodes encodes the stacktraces as a tree of nodes. The node of the stacktrace at
+// index i has the ID i, the nodes added for the callers which are not a stacktrace themselves
+// follow them.
+func NewStacktraceNodes(stacktraces []*Stacktrace) []*StacktraceNode {
+	type nodeKey struct {
+		parentID   uint64
+		locationID uint64
+	}
+	var (
+		nodes  = make([]*StacktraceNode, len(stacktraces))
+		lookup = make(map[nodeKey]uint64, len(stacktraces))
+		order  = make([]int, len(stacktraces))
+	)
+	// the shortest stacktraces are added first, so a stacktrace which is the caller of another
+	// one is its parent node rather than a new node.
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return len(stacktraces[order[i]].LocationIDs) < len(stacktraces[order[j]].LocationIDs)
+	})
+	for _, i := range order {
+		locations := stacktraces[i].LocationIDs
+		if len(locations) == 0 {
+			nodes[i] = &StacktraceNode{ID: uint64(i)}
+			continue
+		}
+		var parentID uint64
+		for depth := len(locations) - 1; depth > 0; depth-- {
+			key := nodeKey{parentID: parentID, locationID: locations[depth]}
+			id, ok := lookup[key]
+			if !ok {
+				id = uint64(len(nodes))
+				lookup[key] = id
+				nodes = append(nodes, &StacktraceNode{
+					ID:         id,
+					LocationID: locations[depth],
+					ParentID:   parentID,
+					Depth:      uint32(len(locations) - depth),
+				})
+			}
+			parentID = id + 1
+		}
+		lookup[nodeKey{parentID: parentID, locationID: locations[0]}] = uint64(i)
+		nodes[i] = &StacktraceNode{
+			ID:         uint64(i),
+			LocationID: locations[0],
+			ParentID:   parentID,
+			Depth:      uint32(len(locations)),
+		}
+	}
+	return nodes
+}
+
+type StacktraceNodePersister struct{}
+
+func (*StacktraceNodePersister) Name() string {
+	return "stacktraces"
+}
+
+func (*StacktraceNodePersister) Schema() *parquet.Schema {
+	return stacktraceNodesSchema
+}
+
+func (*StacktraceNodePersister) SortingColumns() parquet.SortingOption {
+	return parquet.SortingColumns(parquet.Ascending("ID"))
+}
+
+func (*StacktraceNodePersister) Deconstruct(row parquet.Row, id uint64, n *StacktraceNode) parquet.Row {
+	stored := *n
+	stored.ID = id
+	return stacktraceNodesSchema.Deconstruct(row, &stored)
+}
+
+func (*StacktraceNodePersister) Reconstruct(row parquet.Row) (id uint64, n *StacktraceNode, err error) {
+	var node StacktraceNode
+	if err := stacktraceNodesSchema.Reconstruct(&node, row); err != nil {
+		return 0, nil, err
+	}
+	return node.ID, &node, nil
+}
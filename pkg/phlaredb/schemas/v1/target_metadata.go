@@ -0,0 +1,51 @@
+package v1
+
+import (
+	"github.com/segmentio/parquet-go"
+)
+
+var targetMetadataSchema = parquet.SchemaOf(new(TargetMetadata))
+
+// TargetMetadata is a metadata of the target a series was scraped from, such as its build
+// version, with the time range it was seen in.
+type TargetMetadata struct {
+	// SeriesFingerprint is the fingerprint of the labels of the series, consistent between
+	// blocks.
+	SeriesFingerprint uint64 `parquet:",delta"`
+	Name              string `parquet:",dict"`
+	Value             string `parquet:",dict"`
+	// FirstSeen and LastSeen are in milliseconds.
+	FirstSeen int64 `parquet:",delta"`
+	LastSeen  int64 `parquet:",delta"`
+}
+
+type TargetMetadataPersister struct{}
+
+func (*TargetMetadataPersister) Name() string {
+	return "target_metadata"
+}
+
+func (*TargetMetadataPersister) Schema() *parquet.Schema {
+	return targetMetadataSchema
+}
+
+func (*TargetMetadataPersister) SortingColumns() parquet.SortingOption {
+	return parquet.SortingColumns(
+		parquet.Ascending("SeriesFingerprint"),
+		parquet.Ascending("Name"),
+		parquet.Ascending("FirstSeen"),
+	)
+}
+
+func (*TargetMetadataPersister) Deconstruct(row parquet.Row, _ uint64, m *TargetMetadata) parquet.Row {
+	row = targetMetadataSchema.Deconstruct(row, m)
+	return row
+}
+
+func (*TargetMetadataPersister) Reconstruct(row parquet.Row) (id uint64, m *TargetMetadata, err error) {
+	var metadata TargetMetadata
+	if err := targetMetadataSchema.Reconstruct(&metadata, row); err != nil {
+		return 0, nil, err
+	}
+	return 0, &metadata, nil
+}
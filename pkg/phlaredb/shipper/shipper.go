@@ -82,11 +82,14 @@ type Shipper struct {
 
 	uploadCompacted        bool
 	allowOutOfOrderUploads bool
+
+	onUploaded func(*block.Meta)
 }
 
 // New creates a new shipper that detects new TSDB blocks in dir and uploads them to
 // remote if necessary. It attaches the Thanos metadata section in each meta JSON file.
 // If uploadCompacted is enabled, it also uploads compacted blocks which are already in filesystem.
+// The optional onUploaded function is called with the meta of every block uploaded.
 func New(
 	logger log.Logger,
 	r prometheus.Registerer,
@@ -95,6 +98,7 @@ func New(
 	source block.SourceType,
 	uploadCompacted bool,
 	allowOutOfOrderUploads bool,
+	onUploaded func(*block.Meta),
 ) *Shipper {
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -108,6 +112,7 @@ func New(
 		source:                 source,
 		allowOutOfOrderUploads: allowOutOfOrderUploads,
 		uploadCompacted:        uploadCompacted,
+		onUploaded:             onUploaded,
 	}
 }
 
@@ -297,6 +302,9 @@ func (s *Shipper) Sync(ctx context.Context) (uploaded int, err error) {
 		meta.Uploaded = append(meta.Uploaded, m.ULID)
 		uploaded++
 		s.metrics.uploads.Inc()
+		if s.onUploaded != nil {
+			s.onUploaded(m)
+		}
 	}
 	if err := WriteMetaFile(s.logger, s.blockLister.LocalDataPath(), meta); err != nil {
 		level.Warn(s.logger).Log("msg", "updating meta file failed", "err", err)
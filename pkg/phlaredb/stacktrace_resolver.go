@@ -0,0 +1,204 @@
+package phlaredb
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/pkg/errors"
+	"github.com/segmentio/parquet-go"
+
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+)
+
+// stacktraceChunks resolves the locations of the stacktraces of a block stored as stacktrace
+// nodes. The nodes are loaded by chunk, a row group of the stacktraces table, when a stacktrace
+// or one of its callers is first resolved, and kept until the block is closed.
+type stacktraceChunks struct {
+	file *parquet.File
+	// offsets holds the ID of the first node of each chunk.
+	offsets                                   []int64
+	locationColumn, parentColumn, depthColumn int
+
+	lock   sync.Mutex
+	chunks []*stacktraceChunk
+}
+
+type stacktraceChunk struct {
+	locations []uint64
+	parents   []uint64
+	depths    []uint32
+}
+
+// newStacktraceChunks returns nil when the stacktraces of the file are stored as location lists,
+// by blocks written before the stacktrace nodes.
+func newStacktraceChunks(file *parquet.File) *stacktraceChunks {
+	schema := file.Schema()
+	location, ok := schema.Lookup("LocationID")
+	if !ok {
+		return nil
+	}
+	parent, _ := schema.Lookup("ParentID")
+	depth, _ := schema.Lookup("Depth")
+	c := &stacktraceChunks{
+		file:           file,
+		locationColumn: location.ColumnIndex,
+		parentColumn:   parent.ColumnIndex,
+		depthColumn:    depth.ColumnIndex,
+		chunks:         make([]*stacktraceChunk, len(file.RowGroups())),
+	}
+	var offset int64
+	for _, rg := range file.RowGroups() {
+		c.offsets = append(c.offsets, offset)
+		offset += rg.NumRows()
+	}
+	return c
+}
+
+// node returns the location, the parent and the depth of the node.
+func (c *stacktraceChunks) node(id int64) (location, parent uint64, depth uint32, err error) {
+	idx := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > id }) - 1
+	if idx < 0 {
+		return 0, 0, 0, errors.Errorf("stacktrace %d not found", id)
+	}
+	chunk, err := c.chunk(idx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	row := id - c.offsets[idx]
+	if row >= int64(len(chunk.locations)) {
+		return 0, 0, 0, errors.Errorf("stacktrace %d not found", id)
+	}
+	return chunk.locations[row], chunk.parents[row], chunk.depths[row], nil
+}
+
+func (c *stacktraceChunks) chunk(idx int) (*stacktraceChunk, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if chunk := c.chunks[idx]; chunk != nil {
+		return chunk, nil
+	}
+	var (
+		rg    = c.file.RowGroups()[idx]
+		chunk = &stacktraceChunk{
+			locations: make([]uint64, 0, rg.NumRows()),
+			parents:   make([]uint64, 0, rg.NumRows()),
+			depths:    make([]uint32, 0, rg.NumRows()),
+		}
+	)
+	err := readColumnChunk(rg.ColumnChunks()[c.locationColumn], func(v parquet.Value) {
+		chunk.locations = append(chunk.locations, v.Uint64())
+	})
+	if err == nil {
+		err = readColumnChunk(rg.ColumnChunks()[c.parentColumn], func(v parquet.Value) {
+			chunk.parents = append(chunk.parents, v.Uint64())
+		})
+	}
+	if err == nil {
+		err = readColumnChunk(rg.ColumnChunks()[c.depthColumn], func(v parquet.Value) {
+			chunk.depths = append(chunk.depths, v.Uint32())
+		})
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading stacktrace nodes")
+	}
+	c.chunks[idx] = chunk
+	return chunk, nil
+}
+
+func readColumnChunk(column parquet.ColumnChunk, fn func(parquet.Value)) error {
+	pages := column.Pages()
+	defer pages.Close()
+
+	buf := make([]parquet.Value, 1024)
+	for {
+		page, err := pages.ReadPage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		values := page.Values()
+		for {
+			n, err := values.ReadValues(buf)
+			for _, v := range buf[:n] {
+				fn(v)
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// locations returns the location IDs of the stacktrace, from the leaf to the root.
+func (c *stacktraceChunks) locations(id int64) ([]uint64, error) {
+	location, parent, depth, err := c.node(id)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0, depth)
+	for depth > 0 {
+		result = append(result, location)
+		if parent == 0 {
+			break
+		}
+		if location, parent, depth, err = c.node(int64(parent - 1)); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// stacktraceLocations returns the location IDs of the stacktraces, from the leaf to the root. The
+// IDs of the stacktraces must be sorted.
+func (b *singleBlockQuerier) stacktraceLocations(ctx context.Context, stacktraceIDs []int64) (map[int64][]uint64, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "stacktraceLocations - Block")
+	defer sp.Finish()
+
+	result := make(map[int64][]uint64, len(stacktraceIDs))
+	if chunks := b.stacktraceChunks(); chunks != nil {
+		for _, id := range stacktraceIDs {
+			locations, err := chunks.locations(id)
+			if err != nil {
+				return nil, err
+			}
+			result[id] = locations
+		}
+		return result, nil
+	}
+
+	stacktraces := repeatedColumnIter(ctx, b.stacktraces.file, "LocationIDs.list.element", iter.NewSliceIterator(stacktraceIDs))
+	defer stacktraces.Close()
+	for stacktraces.Next() {
+		s := stacktraces.At()
+		locations := result[s.Row]
+		for _, locationID := range s.Values {
+			locations = append(locations, locationID.Uint64())
+		}
+		result[s.Row] = locations
+	}
+	return result, stacktraces.Err()
+}
+
+func (b *singleBlockQuerier) stacktraceChunks() *stacktraceChunks {
+	b.stacktraceChunksOnce.Do(func() {
+		b.stacktraceNodes = newStacktraceChunks(b.stacktraces.file)
+	})
+	return b.stacktraceNodes
+}
+
+// stacktracesVersion returns the block format of the stacktraces.
+func (b *singleBlockQuerier) stacktracesVersion() block.MetaVersion {
+	if b.stacktraceChunks() != nil {
+		return block.MetaVersion2
+	}
+	return block.MetaVersion1
+}
@@ -0,0 +1,86 @@
+package phlaredb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/segmentio/parquet-go"
+	"github.com/stretchr/testify/require"
+
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+)
+
+func TestSingleBlockQuerier_StacktraceLocations(t *testing.T) {
+	stacktraces := []*schemav1.Stacktrace{
+		{LocationIDs: []uint64{3, 2, 1}},
+		{LocationIDs: []uint64{1}},
+		{LocationIDs: []uint64{}},
+		{LocationIDs: []uint64{4, 2, 1}},
+		{LocationIDs: []uint64{5, 4, 2, 1}},
+	}
+	expected := map[int64][]uint64{
+		0: {3, 2, 1},
+		1: {1},
+		2: {},
+		3: {4, 2, 1},
+		4: {5, 4, 2, 1},
+	}
+
+	openFile := func(t *testing.T, data []byte) *parquet.File {
+		f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+		require.NoError(t, err)
+		return f
+	}
+
+	t.Run("location lists", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, (&schemav1.ReadWriter[*schemav1.Stacktrace, *schemav1.StacktracePersister]{}).WriteParquetFile(&buf, stacktraces))
+		q := &singleBlockQuerier{}
+		q.stacktraces.file = openFile(t, buf.Bytes())
+
+		locations, err := q.stacktraceLocations(context.Background(), []int64{0, 1, 3, 4})
+		require.NoError(t, err)
+		require.Equal(t, map[int64][]uint64{
+			0: {3, 2, 1},
+			1: {1},
+			3: {4, 2, 1},
+			4: {5, 4, 2, 1},
+		}, locations)
+	})
+
+	t.Run("stacktrace nodes", func(t *testing.T) {
+		// write the nodes in chunks of 2 rows.
+		var (
+			buf       bytes.Buffer
+			persister = &schemav1.StacktraceNodePersister{}
+			writer    = parquet.NewWriter(&buf, persister.Schema())
+			nodes     = schemav1.NewStacktraceNodes(stacktraces)
+		)
+		for start := 0; start < len(nodes); start += 2 {
+			for id := start; id < start+2 && id < len(nodes); id++ {
+				_, err := writer.WriteRows([]parquet.Row{persister.Deconstruct(nil, uint64(id), nodes[id])})
+				require.NoError(t, err)
+			}
+			require.NoError(t, writer.Flush())
+		}
+		require.NoError(t, writer.Close())
+		q := &singleBlockQuerier{}
+		q.stacktraces.file = openFile(t, buf.Bytes())
+		require.Len(t, q.stacktraces.file.RowGroups(), 3)
+
+		locations, err := q.stacktraceLocations(context.Background(), []int64{0, 1, 2, 3, 4})
+		require.NoError(t, err)
+		require.Equal(t, expected, locations)
+
+		// only the chunks of the resolved stacktraces and their callers are loaded.
+		q = &singleBlockQuerier{}
+		q.stacktraces.file = openFile(t, buf.Bytes())
+		locations, err = q.stacktraceLocations(context.Background(), []int64{1})
+		require.NoError(t, err)
+		require.Equal(t, []uint64{1}, locations[1])
+		require.NotNil(t, q.stacktraceNodes.chunks[0])
+		require.Nil(t, q.stacktraceNodes.chunks[1])
+		require.Nil(t, q.stacktraceNodes.chunks[2])
+	})
+}
@@ -2,10 +2,12 @@
 package phlaredb
 
 import (
+	"context"
 	"encoding/binary"
 	"unsafe"
 
 	"github.com/cespare/xxhash/v2"
+	"github.com/segmentio/parquet-go"
 
 	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
 )
@@ -58,3 +60,69 @@ func (*stacktracesHelper) clone(s *schemav1.Stacktrace) *schemav1.Stacktrace {
 	s.LocationIDs = copySlice(s.LocationIDs)
 	return s
 }
+
+// stacktraceStore deduplicates the stacktraces of the head, and writes them as a tree of
+// stacktrace nodes to the block.
+type stacktraceStore struct {
+	deduplicatingSlice[*schemav1.Stacktrace, stacktracesKey, *stacktracesHelper, *schemav1.StacktracePersister]
+	// locationLists writes the stacktraces as lists of locations instead, for blocks of the
+	// format version 1.
+	locationLists bool
+}
+
+func (s *stacktraceStore) Init(path string, cfg *ParquetConfig) error {
+	if s.locationLists {
+		return s.deduplicatingSlice.Init(path, cfg)
+	}
+	return s.init(path, cfg, (&schemav1.StacktraceNodePersister{}).Schema())
+}
+
+// Flush writes the nodes of the stacktraces in chunks of at most MaxBufferRowCount rows, each
+// chunk being a row group.
+func (s *stacktraceStore) Flush(ctx context.Context) (numRows uint64, numRowGroups uint64, err error) {
+	if s.locationLists {
+		return s.deduplicatingSlice.Flush(ctx)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	nodes := schemav1.NewStacktraceNodes(s.slice)
+	numRowGroups, err = writeStacktraceNodes(s.writer, nodes, s.cfg.MaxBufferRowCount)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(nodes)), numRowGroups, nil
+}
+
+type rowGroupWriter interface {
+	WriteRows([]parquet.Row) (int, error)
+	// Flush cuts a row group.
+	Flush() error
+}
+
+// writeStacktraceNodes writes the nodes in chunks of at most chunkSize rows, each chunk being a
+// row group.
+func writeStacktraceNodes(w rowGroupWriter, nodes []*schemav1.StacktraceNode, chunkSize int) (numRowGroups uint64, err error) {
+	persister := &schemav1.StacktraceNodePersister{}
+	if chunkSize <= 0 {
+		chunkSize = len(nodes)
+	}
+	for start := 0; start < len(nodes); start += chunkSize {
+		end := start + chunkSize
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		rows := make([]parquet.Row, 0, end-start)
+		for id := start; id < end; id++ {
+			rows = append(rows, persister.Deconstruct(nil, uint64(id), nodes[id]))
+		}
+		if _, err := w.WriteRows(rows); err != nil {
+			return 0, err
+		}
+		if err := w.Flush(); err != nil {
+			return 0, err
+		}
+		numRowGroups++
+	}
+	return numRowGroups, nil
+}
@@ -0,0 +1,123 @@
+package phlaredb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/common/model"
+	"github.com/segmentio/parquet-go"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/query"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+// StorageUsage estimates the bytes and the profiles of the local blocks per value of a label,
+// over a time range. The head is not accounted for, as it is not stored yet.
+func (f *PhlareDB) StorageUsage(ctx context.Context, req *connect.Request[ingestv1.StorageUsageRequest]) (*connect.Response[ingestv1.StorageUsageResponse], error) {
+	if req.Msg.LabelName == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("label name is required"))
+	}
+	usage, err := f.blockQuerier.storageUsage(ctx, req.Msg.LabelName, model.Time(req.Msg.Start), model.Time(req.Msg.End))
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&ingestv1.StorageUsageResponse{Usage: usage}), nil
+}
+
+func (b *BlockQuerier) storageUsage(ctx context.Context, labelName string, start, end model.Time) ([]*ingestv1.LabelValueUsage, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "StorageUsage - Blocks")
+	defer sp.Finish()
+
+	b.queriersLock.RLock()
+	queriers := make([]*singleBlockQuerier, 0, len(b.queriers))
+	for _, q := range b.queriers {
+		if q.InRange(start, end) {
+			q.acquire()
+			queriers = append(queriers, q)
+		}
+	}
+	b.queriersLock.RUnlock()
+	defer releaseQueriers(queriers)
+
+	usage := make(map[string]*ingestv1.LabelValueUsage)
+	for _, q := range queriers {
+		if err := q.storageUsage(ctx, labelName, start, end, usage); err != nil {
+			return nil, err
+		}
+	}
+	result := make([]*ingestv1.LabelValueUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, u)
+	}
+	return result, nil
+}
+
+// storageUsage adds the profiles of the block in the time range to the usage of the value of
+// their series for the label. The files of a block are not split by series, so the bytes of the
+// block are attributed to the values in proportion of their profiles.
+func (b *singleBlockQuerier) storageUsage(ctx context.Context, labelName string, start, end model.Time, usage map[string]*ingestv1.LabelValueUsage) error {
+	if err := b.open(ctx); err != nil {
+		return err
+	}
+
+	k, v := index.AllPostingsKey()
+	postings, err := b.index.Postings(k, nil, v)
+	if err != nil {
+		return err
+	}
+	var (
+		lbls   = make(phlaremodel.Labels, 0, 6)
+		chks   = make([]index.ChunkMeta, 1)
+		values = make(map[int64]string)
+	)
+	for postings.Next() {
+		if _, err := b.index.Series(postings.At(), &lbls, &chks); err != nil {
+			return err
+		}
+		values[int64(chks[0].SeriesIndex)] = lbls.Get(labelName)
+	}
+	if err := postings.Err(); err != nil {
+		return err
+	}
+
+	it := query.NewJoinIterator(
+		0,
+		[]query.Iterator{
+			b.profiles.columnIter(ctx, "SeriesIndex", nil, "SeriesIndex"),
+			b.profiles.columnIter(ctx, "TimeNanos", query.NewIntBetweenPredicate(start.UnixNano(), end.UnixNano()), "TimeNanos"),
+		},
+		nil,
+	)
+	defer it.Close()
+
+	profiles := make(map[string]uint64)
+	buf := make([][]parquet.Value, 1)
+	for it.Next() {
+		buf = it.At().Columns(buf, "SeriesIndex")
+		profiles[values[buf[0][0].Int64()]]++
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	var blockBytes uint64
+	for _, f := range b.meta.Files {
+		blockBytes += f.SizeBytes
+	}
+	for value, n := range profiles {
+		u, ok := usage[value]
+		if !ok {
+			u = &ingestv1.LabelValueUsage{Value: value}
+			usage[value] = u
+		}
+		u.Profiles += n
+		if total := b.meta.Stats.NumProfiles; total > 0 {
+			u.Bytes += uint64(float64(blockBytes) * float64(n) / float64(total))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package phlaredb
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"go.uber.org/atomic"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/phlaredb/block"
+	schemav1 "github.com/grafana/phlare/pkg/phlaredb/schemas/v1"
+	"github.com/grafana/phlare/pkg/phlaredb/tsdb/index"
+)
+
+const (
+	// maxTargetMetadataPerSeries is the maximum number of metadata values kept per series in a
+	// block. The values seen once it is reached are dropped.
+	maxTargetMetadataPerSeries = 64
+	// maxTargetMetadataValueLength is the length the metadata values are truncated to.
+	maxTargetMetadataValueLength = 1024
+	// targetMetadataSize is the estimated size of a metadata without its name and value.
+	targetMetadataSize = 48
+)
+
+// IngestTargetMetadata records the metadata of the target the profile was scraped from, such as
+// its build version, for each of the series of the profile.
+func (f *PhlareDB) IngestTargetMetadata(p *profilev1.Profile, metadata []*typesv1.LabelPair, externalLabels ...*typesv1.LabelPair) {
+	f.headLock.RLock()
+	defer f.headLock.RUnlock()
+	f.head.IngestTargetMetadata(p, metadata, externalLabels...)
+}
+
+// IngestTargetMetadata records the metadata of the target for each of the series of the profile,
+// at the time of the profile.
+func (h *Head) IngestTargetMetadata(p *profilev1.Profile, metadata []*typesv1.LabelPair, externalLabels ...*typesv1.LabelPair) {
+	if len(metadata) == 0 {
+		return
+	}
+	_, seriesFingerprints := labelsForProfile(p, h.externalLabels.merge(externalLabels)...)
+	for _, fp := range seriesFingerprints {
+		h.targetMetadata.observe(fp, p.TimeNanos, metadata)
+	}
+}
+
+// SelectTargetMetadata returns the metadata of the targets of the matching series seen in the
+// time range.
+func (f *PhlareDB) SelectTargetMetadata(ctx context.Context, req *connect.Request[ingestv1.SelectTargetMetadataRequest]) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error) {
+	queriers, release := f.queriers()
+	defer release()
+	series, err := queriers.selectTargetMetadata(f.queryContext(ctx), req.Msg)
+	if err != nil {
+		return nil, err
+	}
+	return connect.NewResponse(&ingestv1.SelectTargetMetadataResponse{Series: series}), nil
+}
+
+// selectTargetMetadata merges the metadata of the series of the queriers.
+func (q Queriers) selectTargetMetadata(ctx context.Context, params *ingestv1.SelectTargetMetadataRequest) ([]*ingestv1.SeriesTargetMetadata, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectTargetMetadata")
+	defer sp.Finish()
+	sp.LogFields(
+		otlog.String("start", model.Time(params.Start).Time().String()),
+		otlog.String("end", model.Time(params.End).Time().String()),
+		otlog.String("selector", params.LabelSelector),
+	)
+
+	var (
+		bySeries = make(map[uint64]*ingestv1.SeriesTargetMetadata)
+		result   []*ingestv1.SeriesTargetMetadata
+	)
+	for _, querier := range q.ForTimeRange(model.Time(params.Start), model.Time(params.End)) {
+		series, err := querier.SelectTargetMetadata(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			existing, ok := bySeries[s.Fingerprint]
+			if !ok {
+				bySeries[s.Fingerprint] = s
+				result = append(result, s)
+				continue
+			}
+			existing.Metadata = phlaremodel.MergeTargetMetadata(existing.Metadata, s.Metadata)
+		}
+	}
+	return result, nil
+}
+
+// targetMetadataStore keeps the metadata of the targets of the series of the head, with the time
+// range each value was seen in, and writes it to the block.
+type targetMetadataStore struct {
+	lock   sync.RWMutex
+	series map[model.Fingerprint][]*typesv1.TargetMetadata
+
+	size atomic.Uint64
+	path string
+}
+
+func newTargetMetadataStore() *targetMetadataStore {
+	return &targetMetadataStore{
+		series: make(map[model.Fingerprint][]*typesv1.TargetMetadata),
+	}
+}
+
+func (s *targetMetadataStore) Name() string {
+	return (&schemav1.TargetMetadataPersister{}).Name()
+}
+
+func (s *targetMetadataStore) Size() uint64 {
+	return s.size.Load()
+}
+
+func (s *targetMetadataStore) MemorySize() uint64 {
+	return s.size.Load()
+}
+
+func (s *targetMetadataStore) Init(path string, _ *ParquetConfig) error {
+	s.path = path
+	return nil
+}
+
+// observe records the metadata of the series seen at the time of a profile. The time range of the
+// last value of a name is extended while it doesn't change, so that a value seen again after
+// another one has its own time range.
+func (s *targetMetadataStore) observe(fp model.Fingerprint, timeNanos int64, metadata []*typesv1.LabelPair) {
+	ts := int64(model.TimeFromUnixNano(timeNanos))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entries := s.series[fp]
+	for _, m := range metadata {
+		value := m.Value
+		if len(value) > maxTargetMetadataValueLength {
+			value = value[:maxTargetMetadataValueLength]
+		}
+		var last *typesv1.TargetMetadata
+		for _, e := range entries {
+			if e.Name == m.Name && (last == nil || e.LastSeen > last.LastSeen) {
+				last = e
+			}
+		}
+		if last != nil && last.Value == value {
+			if ts < last.FirstSeen {
+				last.FirstSeen = ts
+			}
+			if ts > last.LastSeen {
+				last.LastSeen = ts
+			}
+			continue
+		}
+		if len(entries) >= maxTargetMetadataPerSeries {
+			continue
+		}
+		entries = append(entries, &typesv1.TargetMetadata{
+			Name:      m.Name,
+			Value:     value,
+			FirstSeen: ts,
+			LastSeen:  ts,
+		})
+		s.size.Add(uint64(targetMetadataSize + len(m.Name) + len(value)))
+	}
+	s.series[fp] = entries
+}
+
+// selectTargetMetadata returns the metadata of the series seen in the time range.
+func (s *targetMetadataStore) selectTargetMetadata(series []*ingestv1.SeriesTargetMetadata, start, end int64) []*ingestv1.SeriesTargetMetadata {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := series[:0]
+	for _, ser := range series {
+		metadata := selectTargetMetadataInRange(s.series[model.Fingerprint(ser.Fingerprint)], start, end)
+		if len(metadata) == 0 {
+			continue
+		}
+		// the metadata is copied, as it keeps being updated.
+		ser.Metadata = make([]*typesv1.TargetMetadata, len(metadata))
+		for i, m := range metadata {
+			ser.Metadata[i] = &typesv1.TargetMetadata{
+				Name:      m.Name,
+				Value:     m.Value,
+				FirstSeen: m.FirstSeen,
+				LastSeen:  m.LastSeen,
+			}
+		}
+		result = append(result, ser)
+	}
+	return result
+}
+
+// selectTargetMetadataInRange returns the metadata seen in the time range.
+func selectTargetMetadataInRange(metadata []*typesv1.TargetMetadata, start, end int64) []*typesv1.TargetMetadata {
+	var result []*typesv1.TargetMetadata
+	for _, m := range metadata {
+		if m.LastSeen >= start && m.FirstSeen <= end {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Flush writes the metadata to the block. No file is written without metadata, as for the
+// profiles not scraped by the agent.
+func (s *targetMetadataStore) Flush(context.Context) (numRows uint64, numRowGroups uint64, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.series) == 0 {
+		return 0, 0, nil
+	}
+	rows := make([]*schemav1.TargetMetadata, 0, len(s.series))
+	for fp, metadata := range s.series {
+		for _, m := range metadata {
+			rows = append(rows, &schemav1.TargetMetadata{
+				SeriesFingerprint: uint64(fp),
+				Name:              m.Name,
+				Value:             m.Value,
+				FirstSeen:         m.FirstSeen,
+				LastSeen:          m.LastSeen,
+			})
+		}
+	}
+	if err := writeTargetMetadata(filepath.Join(s.path, s.Name()+block.ParquetSuffix), rows); err != nil {
+		return 0, 0, err
+	}
+	return uint64(len(rows)), 1, nil
+}
+
+func (s *targetMetadataStore) Close() error {
+	return nil
+}
+
+func writeTargetMetadata(path string, rows []*schemav1.TargetMetadata) (err error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	var w schemav1.ReadWriter[*schemav1.TargetMetadata, *schemav1.TargetMetadataPersister]
+	return w.WriteParquetFile(f, rows)
+}
+
+// SelectTargetMetadata returns the metadata of the matching series of the head.
+func (q *headInMemoryQuerier) SelectTargetMetadata(ctx context.Context, params *ingestv1.SelectTargetMetadataRequest) ([]*ingestv1.SeriesTargetMetadata, error) {
+	sp, _ := opentracing.StartSpanFromContext(ctx, "SelectTargetMetadata - HeadInMemory")
+	defer sp.Finish()
+	matchers, err := parseTargetMetadataSelector(params.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	var series []*ingestv1.SeriesTargetMetadata
+	err = q.head.profiles.index.forMatchingLabels(matchers, func(lbs phlaremodel.Labels, fp model.Fingerprint) error {
+		series = append(series, &ingestv1.SeriesTargetMetadata{
+			Labels:      lbs,
+			Fingerprint: uint64(fp),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q.head.targetMetadata.selectTargetMetadata(series, params.Start, params.End), nil
+}
+
+// SelectTargetMetadata returns no metadata, as the metadata of the whole head, including its row
+// groups written to disk, is returned by its in-memory querier.
+func (q *headOnDiskQuerier) SelectTargetMetadata(context.Context, *ingestv1.SelectTargetMetadataRequest) ([]*ingestv1.SeriesTargetMetadata, error) {
+	return nil, nil
+}
+
+// SelectTargetMetadata returns the metadata of the matching series of the block, if it was
+// written with the metadata of its targets.
+func (b *singleBlockQuerier) SelectTargetMetadata(ctx context.Context, params *ingestv1.SelectTargetMetadataRequest) ([]*ingestv1.SeriesTargetMetadata, error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectTargetMetadata - Block")
+	defer sp.Finish()
+	if b.meta.FileByRelPath(b.targetMetadataRelPath()) == nil {
+		return nil, nil
+	}
+	if err := b.open(ctx); err != nil {
+		return nil, err
+	}
+	metadata, err := b.seriesTargetMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	matchers, err := parseTargetMetadataSelector(params.LabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	postings, err := b.postings.postingsForMatchers(b.index, b.metrics, matchers...)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		result []*ingestv1.SeriesTargetMetadata
+		lbls   = make(phlaremodel.Labels, 0, 6)
+		chks   = make([]index.ChunkMeta, 1)
+	)
+	for postings.Next() {
+		fp, err := b.index.Series(postings.At(), &lbls, &chks)
+		if err != nil {
+			return nil, err
+		}
+		selected := selectTargetMetadataInRange(metadata[model.Fingerprint(fp)], params.Start, params.End)
+		if len(selected) == 0 {
+			continue
+		}
+		result = append(result, &ingestv1.SeriesTargetMetadata{
+			Labels:      lbls.Clone(),
+			Fingerprint: fp,
+			Metadata:    selected,
+		})
+	}
+	if err := postings.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (b *singleBlockQuerier) targetMetadataRelPath() string {
+	return (&schemav1.TargetMetadataPersister{}).Name() + block.ParquetSuffix
+}
+
+// seriesTargetMetadata returns the metadata of the block by series, read once it is opened. It is
+// small enough to be kept in memory, bounded per series.
+func (b *singleBlockQuerier) seriesTargetMetadata(ctx context.Context) (map[model.Fingerprint][]*typesv1.TargetMetadata, error) {
+	b.targetMetadataOnce.Do(func() {
+		b.targetMetadata, b.targetMetadataErr = b.readTargetMetadata(ctx)
+	})
+	return b.targetMetadata, b.targetMetadataErr
+}
+
+func (b *singleBlockQuerier) readTargetMetadata(ctx context.Context) (map[model.Fingerprint][]*typesv1.TargetMetadata, error) {
+	path := b.targetMetadataRelPath()
+	ra, err := b.bucketReader.ReaderAt(ctx, path)
+	if b.bucketReader.IsObjNotFoundErr(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening file '%s'", path)
+	}
+	defer ra.Close()
+	var r schemav1.ReadWriter[*schemav1.TargetMetadata, *schemav1.TargetMetadataPersister]
+	rows, err := r.ReadParquetFile(ra)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading parquet file '%s'", path)
+	}
+	metadata := make(map[model.Fingerprint][]*typesv1.TargetMetadata)
+	for _, row := range rows {
+		fp := model.Fingerprint(row.SeriesFingerprint)
+		metadata[fp] = append(metadata[fp], &typesv1.TargetMetadata{
+			Name:      row.Name,
+			Value:     row.Value,
+			FirstSeen: row.FirstSeen,
+			LastSeen:  row.LastSeen,
+		})
+	}
+	return metadata, nil
+}
+
+// parseTargetMetadataSelector parses the label selector of the series, which may not select a
+// profile type, as the metadata is the same for all the profile types of a target.
+func parseTargetMetadataSelector(selector string) ([]*labels.Matcher, error) {
+	matchers, err := phlaremodel.ParseSelector(selector)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "failed to parse label selectors"))
+	}
+	if len(matchers) == 0 {
+		// all the series have a profile type.
+		matchers = append(matchers, labels.MustNewMatcher(labels.MatchRegexp, phlaremodel.LabelNameProfileType, ".+"))
+	}
+	return matchers, nil
+}
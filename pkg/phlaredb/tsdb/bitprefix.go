@@ -138,8 +138,9 @@ func (ii *BitPrefixInvertedIndex) Lookup(matchers []*labels.Matcher, shard *shar
 			result = append(result, fps...)
 		}
 	} else {
+		key := lookupCacheKey(matchers)
 		for i := range shards {
-			fps := shards[i].lookup(matchers)
+			fps := shards[i].lookup(matchers, key)
 			result = append(result, fps...)
 		}
 	}
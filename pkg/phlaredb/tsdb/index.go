@@ -43,6 +43,9 @@ func init() {
 
 const DefaultIndexShards = 32
 
+// maxCachedLookups is the number of lookups cached per shard of the index.
+const maxCachedLookups = 64
+
 type Interface interface {
 	Add(labels []*typesv1.LabelPair, fp model.Fingerprint) labels.Labels
 	Lookup(matchers []*labels.Matcher, shard *shard.Annotation) ([]model.Fingerprint, error)
@@ -189,13 +192,37 @@ func (ii *InvertedIndex) Lookup(matchers []*labels.Matcher, shard *shard.Annotat
 		return result, nil
 	}
 
+	key := lookupCacheKey(matchers)
 	for i := range shards {
-		fps := shards[i].lookup(matchers)
+		fps := shards[i].lookup(matchers, key)
 		result = append(result, fps...)
 	}
 	return result, nil
 }
 
+// lookupCacheKey returns the key of the cached lookups of the matchers, or an empty string when
+// the lookup isn't worth caching: the equality matchers are resolved by a map access, while the
+// others are evaluated against all the values of their label.
+func lookupCacheKey(matchers []*labels.Matcher) string {
+	var (
+		b      strings.Builder
+		cached bool
+	)
+	for i, m := range matchers {
+		if m.Type != labels.MatchEqual {
+			cached = true
+		}
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(m.String())
+	}
+	if !cached {
+		return ""
+	}
+	return b.String()
+}
+
 // LabelNames returns all label names.
 func (ii *InvertedIndex) LabelNames(shard *shard.Annotation) ([]string, error) {
 	if err := ii.validateShard(shard); err != nil {
@@ -256,6 +283,11 @@ type indexShard struct {
 	shard uint32
 	mtx   sync.RWMutex
 	idx   unlockIndex
+
+	// lookups caches the fingerprints matched by the recent lookups, until the series of the
+	// shard change.
+	lookupsMtx sync.Mutex
+	lookups    map[string][]model.Fingerprint
 	//nolint structcheck,unused
 	pad [cacheLineSize - unsafe.Sizeof(sync.Mutex{}) - unsafe.Sizeof(unlockIndex{})]byte
 }
@@ -270,6 +302,7 @@ func copyString(s string) string {
 func (shard *indexShard) add(metric []*typesv1.LabelPair, fp model.Fingerprint) phlaremodel.Labels {
 	shard.mtx.Lock()
 	defer shard.mtx.Unlock()
+	shard.resetLookups()
 
 	internedLabels := make(phlaremodel.Labels, len(metric))
 
@@ -302,12 +335,41 @@ func (shard *indexShard) add(metric []*typesv1.LabelPair, fp model.Fingerprint)
 	return internedLabels
 }
 
-func (shard *indexShard) lookup(matchers []*labels.Matcher) []model.Fingerprint {
+func (shard *indexShard) lookup(matchers []*labels.Matcher, key string) []model.Fingerprint {
 	// index slice values must only be accessed under lock, so all
 	// code paths must take a copy before returning
 	shard.mtx.RLock()
 	defer shard.mtx.RUnlock()
 
+	if key == "" {
+		return shard.lookupUncached(matchers)
+	}
+	// the series can't change while the read lock is held: the cached fingerprints are current.
+	shard.lookupsMtx.Lock()
+	fps, ok := shard.lookups[key]
+	shard.lookupsMtx.Unlock()
+	if ok {
+		return fps
+	}
+	fps = shard.lookupUncached(matchers)
+	shard.lookupsMtx.Lock()
+	if shard.lookups == nil || len(shard.lookups) >= maxCachedLookups {
+		shard.lookups = make(map[string][]model.Fingerprint)
+	}
+	shard.lookups[key] = fps
+	shard.lookupsMtx.Unlock()
+	return fps
+}
+
+// resetLookups drops the cached lookups. It must be called with the write lock held.
+func (shard *indexShard) resetLookups() {
+	shard.lookupsMtx.Lock()
+	shard.lookups = nil
+	shard.lookupsMtx.Unlock()
+}
+
+func (shard *indexShard) lookupUncached(matchers []*labels.Matcher) []model.Fingerprint {
+
 	// per-shard intersection is initially nil, which is a special case
 	// meaning "everything" when passed to intersect()
 	// loop invariant: result is sorted
@@ -321,9 +383,8 @@ func (shard *indexShard) lookup(matchers []*labels.Matcher) []model.Fingerprint
 		if matcher.Type == labels.MatchEqual {
 			fps := values.fps[matcher.Value]
 			toIntersect = append(toIntersect, fps.fps...) // deliberate copy
-		} else if matcher.Type == labels.MatchRegexp && len(FindSetMatches(matcher.Value)) > 0 {
+		} else if set := setMatches(matcher); len(set) > 0 {
 			// The lookup is of the form `=~"a|b|c|d"`
-			set := FindSetMatches(matcher.Value)
 			for _, value := range set {
 				toIntersect = append(toIntersect, values.fps[value].fps...)
 			}
@@ -416,6 +477,7 @@ func (shard *indexShard) labelValues(
 func (shard *indexShard) delete(labels []*typesv1.LabelPair, fp model.Fingerprint) {
 	shard.mtx.Lock()
 	defer shard.mtx.Unlock()
+	shard.resetLookups()
 
 	for _, pair := range labels {
 		name, value := pair.Name, pair.Value
@@ -510,6 +572,15 @@ func mergeTwoStringSlices(a, b []string) []string {
 	return result
 }
 
+// setMatches returns the values matched by a regexp matcher of the form `=~"a|b|c|d"`. The
+// pattern of the matcher is anchored like in PromQL.
+func setMatches(matcher *labels.Matcher) []string {
+	if matcher.Type != labels.MatchRegexp {
+		return nil
+	}
+	return FindSetMatches(matcher.GetRegexString())
+}
+
 func FindSetMatches(pattern string) []string {
 	// Return empty matches if the wrapper from Prometheus is missing.
 	if len(pattern) < 6 || pattern[:4] != "^(?:" || pattern[len(pattern)-2:] != ")$" {
@@ -71,6 +71,37 @@ func TestDeleteAddLoopkup(t *testing.T) {
 	require.Len(t, ids, 0)
 }
 
+func TestLookupCacheInvalidation(t *testing.T) {
+	index := NewWithShards(1)
+	add := func(pod string) model.Fingerprint {
+		lbs := phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", pod)
+		fp := model.Fingerprint(lbs.Hash())
+		index.Add(lbs, fp)
+		return fp
+	}
+	lookup := func() []model.Fingerprint {
+		ids, err := index.Lookup([]*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu"),
+			labels.MustNewMatcher(labels.MatchRegexp, "pod", "api-.*"),
+		}, nil)
+		require.NoError(t, err)
+		return ids
+	}
+	a := add("api-1")
+	add("db-1")
+	require.Equal(t, []model.Fingerprint{a}, lookup())
+	require.Len(t, index.shards[0].lookups, 1)
+	// cached
+	require.Equal(t, []model.Fingerprint{a}, lookup())
+
+	b := add("api-2")
+	require.Len(t, index.shards[0].lookups, 0)
+	require.ElementsMatch(t, []model.Fingerprint{a, b}, lookup())
+
+	index.Delete(phlaremodel.LabelsFromStrings("__name__", "cpu", "pod", "api-1"), a)
+	require.Equal(t, []model.Fingerprint{b}, lookup())
+}
+
 func Test_hash_mapping(t *testing.T) {
 	lbs := []*typesv1.LabelPair{
 		{Name: "compose_project", Value: "loki-boltdb-storage-s3"},
@@ -0,0 +1,212 @@
+package pprof
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+)
+
+// JSSelfProfile is a trace of the JS Self-Profiling API of the browsers, as returned by
+// Profiler.stop(): https://wicg.github.io/js-self-profiling/#the-profilertrace-dictionary.
+type JSSelfProfile struct {
+	Resources []string              `json:"resources"`
+	Frames    []JSSelfProfileFrame  `json:"frames"`
+	Stacks    []JSSelfProfileStack  `json:"stacks"`
+	Samples   []JSSelfProfileSample `json:"samples"`
+}
+
+type JSSelfProfileFrame struct {
+	Name       string `json:"name"`
+	ResourceID *int   `json:"resourceId,omitempty"`
+	Line       int64  `json:"line,omitempty"`
+	Column     int64  `json:"column,omitempty"`
+}
+
+type JSSelfProfileStack struct {
+	ParentID *int `json:"parentId,omitempty"`
+	FrameID  int  `json:"frameId"`
+}
+
+type JSSelfProfileSample struct {
+	// Timestamp is the time of the sample in milliseconds, relative to the time origin of the page.
+	Timestamp float64 `json:"timestamp"`
+	// StackID is absent when no script was running.
+	StackID *int `json:"stackId,omitempty"`
+}
+
+// FromJSSelfProfile converts a trace of the JS Self-Profiling API to pprof, with the number of
+// samples and the wall-clock time of the stacks. A sample accounts for the time until the next
+// one, and the last one for the average interval. The samples taken while no script was running
+// are left out. The timestamps of the trace are relative to the time origin of the page.
+//
+// The stacks are rejected with ErrDecompressedSizeLimitExceeded before they are converted when
+// they have too many frames, or when their estimated size alone exceeds maxSize bytes, if maxSize
+// is positive.
+func FromJSSelfProfile(trace *JSSelfProfile, timeOrigin time.Time, maxSize int64) (*profilev1.Profile, error) {
+	if len(trace.Samples) == 0 {
+		return nil, errors.New("js self profile: no samples")
+	}
+	for i, f := range trace.Frames {
+		if f.ResourceID != nil && (*f.ResourceID < 0 || *f.ResourceID >= len(trace.Resources)) {
+			return nil, errors.Errorf("js self profile: frame %d: resource %d out of range", i, *f.ResourceID)
+		}
+	}
+	for i, s := range trace.Stacks {
+		if s.FrameID < 0 || s.FrameID >= len(trace.Frames) {
+			return nil, errors.Errorf("js self profile: stack %d: frame %d out of range", i, s.FrameID)
+		}
+		if s.ParentID != nil && (*s.ParentID < 0 || *s.ParentID >= len(trace.Stacks)) {
+			return nil, errors.Errorf("js self profile: stack %d: parent %d out of range", i, *s.ParentID)
+		}
+	}
+
+	start, end := trace.Samples[0].Timestamp, trace.Samples[len(trace.Samples)-1].Timestamp
+	if end < start {
+		return nil, errors.New("js self profile: the samples are not sorted by timestamp")
+	}
+	var interval int64
+	if len(trace.Samples) > 1 {
+		interval = int64((end - start) * float64(time.Millisecond) / float64(len(trace.Samples)-1))
+	}
+
+	// the samples of the same stack are aggregated.
+	type stackValues struct{ count, wall int64 }
+	values := make(map[int]*stackValues)
+	var order []int
+	for i, s := range trace.Samples {
+		if s.StackID == nil {
+			continue
+		}
+		if *s.StackID < 0 || *s.StackID >= len(trace.Stacks) {
+			return nil, errors.Errorf("js self profile: sample %d: stack %d out of range", i, *s.StackID)
+		}
+		wall := interval
+		if i+1 < len(trace.Samples) {
+			next := trace.Samples[i+1].Timestamp
+			if next < s.Timestamp {
+				return nil, errors.New("js self profile: the samples are not sorted by timestamp")
+			}
+			wall = int64((next - s.Timestamp) * float64(time.Millisecond))
+		}
+		v, ok := values[*s.StackID]
+		if !ok {
+			v = &stackValues{}
+			values[*s.StackID] = v
+			order = append(order, *s.StackID)
+		}
+		v.count++
+		v.wall += wall
+	}
+
+	// the depths of the stacks of the samples, memoized as the stacks share their parents. The
+	// stacks are not required to come after their parent, so a stack met again while its depth is
+	// computed has a cycle.
+	const visiting = -1
+	depths := make([]int, len(trace.Stacks))
+	var frames int64
+	var path []int
+	for _, id := range order {
+		depth := 0
+		path = path[:0]
+		for s := &id; s != nil; s = trace.Stacks[*s].ParentID {
+			if depths[*s] == visiting {
+				return nil, errors.Errorf("js self profile: stack %d has a cycle", id)
+			}
+			if depths[*s] > 0 {
+				depth = depths[*s]
+				break
+			}
+			depths[*s] = visiting
+			path = append(path, *s)
+		}
+		for i := len(path) - 1; i >= 0; i-- {
+			depth++
+			depths[path[i]] = depth
+		}
+		frames += int64(depth)
+		if err := checkConvertedFrames(frames, maxSize); err != nil {
+			return nil, err
+		}
+	}
+	// the stacks of the samples, from their leaf.
+	stacks := make(map[int][]int, len(order))
+	for _, id := range order {
+		stack := make([]int, 0, depths[id])
+		for s := &id; s != nil; s = trace.Stacks[*s].ParentID {
+			stack = append(stack, trace.Stacks[*s].FrameID)
+		}
+		stacks[id] = stack
+	}
+
+	strings := map[string]int{"": 0}
+	p := &profilev1.Profile{
+		StringTable: []string{""},
+		TimeNanos:   timeOrigin.Add(time.Duration(start * float64(time.Millisecond))).UnixNano(),
+		Period:      interval,
+	}
+	p.DurationNanos = int64((end-start)*float64(time.Millisecond)) + interval
+	p.SampleType = []*profilev1.ValueType{
+		{Type: addString(strings, "samples"), Unit: addString(strings, "count")},
+		{Type: addString(strings, "wall"), Unit: addString(strings, "nanoseconds")},
+	}
+	p.PeriodType = &profilev1.ValueType{Type: addString(strings, "wall"), Unit: addString(strings, "nanoseconds")}
+
+	// a location per frame, and the functions are shared by the frames of the same name and script.
+	type functionKey struct {
+		name     string
+		resource int
+	}
+	functions := make(map[functionKey]uint64)
+	locationIDs := make([]uint64, len(trace.Frames))
+	for _, id := range order {
+		for _, frameID := range stacks[id] {
+			if locationIDs[frameID] != 0 {
+				continue
+			}
+			f := trace.Frames[frameID]
+			key := functionKey{name: f.Name, resource: -1}
+			if f.ResourceID != nil {
+				key.resource = *f.ResourceID
+			}
+			fnID, ok := functions[key]
+			if !ok {
+				name := f.Name
+				if name == "" {
+					name = "(anonymous)"
+				}
+				fn := &profilev1.Function{Id: uint64(len(p.Function) + 1), Name: addString(strings, name)}
+				fn.SystemName = fn.Name
+				if key.resource >= 0 {
+					fn.Filename = addString(strings, trace.Resources[key.resource])
+				}
+				p.Function = append(p.Function, fn)
+				fnID = fn.Id
+				functions[key] = fnID
+			}
+			loc := &profilev1.Location{
+				Id:   uint64(len(p.Location) + 1),
+				Line: []*profilev1.Line{{FunctionId: fnID, Line: f.Line}},
+			}
+			p.Location = append(p.Location, loc)
+			locationIDs[frameID] = loc.Id
+		}
+	}
+	for _, id := range order {
+		stack := make([]uint64, len(stacks[id]))
+		for i, frameID := range stacks[id] {
+			stack[i] = locationIDs[frameID]
+		}
+		p.Sample = append(p.Sample, &profilev1.Sample{
+			LocationId: stack,
+			Value:      []int64{values[id].count, values[id].wall},
+		})
+	}
+
+	p.StringTable = make([]string, len(strings))
+	for s, i := range strings {
+		p.StringTable[i] = s
+	}
+	return p, nil
+}
@@ -0,0 +1,121 @@
+package pprof
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testJSSelfProfile = `{
+  "resources": ["https://example.com/app.js"],
+  "frames": [
+    {"name": "main", "resourceId": 0, "line": 1, "column": 10},
+    {"name": "render", "resourceId": 0, "line": 20, "column": 4},
+    {"name": ""},
+    {"name": "fetch"}
+  ],
+  "stacks": [
+    {"frameId": 0},
+    {"parentId": 0, "frameId": 1},
+    {"parentId": 1, "frameId": 2},
+    {"parentId": 0, "frameId": 3}
+  ],
+  "samples": [
+    {"timestamp": 100, "stackId": 1},
+    {"timestamp": 110, "stackId": 2},
+    {"timestamp": 120},
+    {"timestamp": 130, "stackId": 1},
+    {"timestamp": 140, "stackId": 3}
+  ]
+}`
+
+func TestFromJSSelfProfile(t *testing.T) {
+	var trace JSSelfProfile
+	require.NoError(t, json.Unmarshal([]byte(testJSSelfProfile), &trace))
+	origin := time.Unix(1672531200, 0)
+	p, err := FromJSSelfProfile(&trace, origin, 0)
+	require.NoError(t, err)
+
+	require.Equal(t, origin.Add(100*time.Millisecond).UnixNano(), p.TimeNanos)
+	require.Equal(t, int64(10*time.Millisecond), p.Period)
+	require.Equal(t, int64(50*time.Millisecond), p.DurationNanos)
+	require.Equal(t, "samples", p.StringTable[p.SampleType[0].Type])
+	require.Equal(t, "wall", p.StringTable[p.SampleType[1].Type])
+	require.Equal(t, "nanoseconds", p.StringTable[p.SampleType[1].Unit])
+
+	stacks := make(map[string][]int64)
+	for _, s := range p.Sample {
+		var stack string
+		for _, id := range s.LocationId {
+			fn := p.Function[p.Location[id-1].Line[0].FunctionId-1]
+			stack += p.StringTable[fn.Name] + ";"
+		}
+		stacks[stack] = s.Value
+	}
+	ms := int64(time.Millisecond)
+	require.Equal(t, map[string][]int64{
+		"render;main;":             {2, 20 * ms},
+		"(anonymous);render;main;": {1, 10 * ms},
+		// the last sample accounts for the average interval.
+		"fetch;main;": {1, 10 * ms},
+	}, stacks)
+
+	render := p.Function[p.Location[p.Sample[0].LocationId[0]-1].Line[0].FunctionId-1]
+	require.Equal(t, "https://example.com/app.js", p.StringTable[render.Filename])
+	require.Equal(t, int64(20), p.Location[p.Sample[0].LocationId[0]-1].Line[0].Line)
+
+	// the profile converted is read like any pprof profile.
+	b, err := p.MarshalVT()
+	require.NoError(t, err)
+	_, err = RawFromBytes(b)
+	require.NoError(t, err)
+
+	// 2 + 3 + 2 frames in total, of 2 bytes each.
+	_, err = FromJSSelfProfile(&trace, origin, 13)
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+	_, err = FromJSSelfProfile(&trace, origin, 14)
+	require.NoError(t, err)
+}
+
+func TestFromJSSelfProfileMaxFrames(t *testing.T) {
+	// a sample per stack of a chain has a quadratic number of frames.
+	trace := JSSelfProfile{Frames: []JSSelfProfileFrame{{Name: "f"}}}
+	for i := 0; i < 3000; i++ {
+		stack := JSSelfProfileStack{}
+		if i > 0 {
+			parent := i - 1
+			stack.ParentID = &parent
+		}
+		id := i
+		trace.Stacks = append(trace.Stacks, stack)
+		trace.Samples = append(trace.Samples, JSSelfProfileSample{Timestamp: float64(i), StackID: &id})
+	}
+	_, err := FromJSSelfProfile(&trace, time.Now(), 0)
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+
+	trace.Samples = trace.Samples[:2000]
+	_, err = FromJSSelfProfile(&trace, time.Now(), 0)
+	require.NoError(t, err)
+}
+
+func TestFromJSSelfProfileInvalid(t *testing.T) {
+	for name, trace := range map[string]string{
+		"no samples":      `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0}], "samples": []}`,
+		"frame resource":  `{"frames": [{"name": "main", "resourceId": 1}], "stacks": [{"frameId": 0}], "samples": [{"timestamp": 1, "stackId": 0}]}`,
+		"stack frame":     `{"frames": [{"name": "main"}], "stacks": [{"frameId": 1}], "samples": [{"timestamp": 1, "stackId": 0}]}`,
+		"stack parent":    `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0, "parentId": 1}], "samples": [{"timestamp": 1, "stackId": 0}]}`,
+		"sample stack":    `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0}], "samples": [{"timestamp": 1, "stackId": 1}]}`,
+		"cycle":           `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0, "parentId": 1}, {"frameId": 0, "parentId": 0}], "samples": [{"timestamp": 1, "stackId": 0}]}`,
+		"unsorted":        `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0}], "samples": [{"timestamp": 2, "stackId": 0}, {"timestamp": 1, "stackId": 0}, {"timestamp": 3, "stackId": 0}]}`,
+		"unsorted bounds": `{"frames": [{"name": "main"}], "stacks": [{"frameId": 0}], "samples": [{"timestamp": 2, "stackId": 0}, {"timestamp": 1, "stackId": 0}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			var p JSSelfProfile
+			require.NoError(t, json.Unmarshal([]byte(trace), &p))
+			_, err := FromJSSelfProfile(&p, time.Now(), 0)
+			require.Error(t, err)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"io"
 	"os"
+	"regexp"
 	"sort"
 	"sync"
 	"time"
@@ -39,6 +40,10 @@ var (
 	}
 )
 
+// ErrDecompressedSizeLimitExceeded is returned when a profile exceeds the
+// maximum decompressed size while it is being read.
+var ErrDecompressedSizeLimitExceeded = errors.New("decompressed profile size limit exceeded")
+
 type gzipReader struct {
 	gzip   *gzip.Reader
 	reader *bytes.Reader
@@ -69,13 +74,23 @@ func (r *gzipReader) openBytes(input []byte) (io.Reader, error) {
 	return r.gzip, nil
 }
 
-func fromUncompressedReader(r io.Reader) (*Profile, error) {
+func fromUncompressedReader(r io.Reader, maxSize int64) (*Profile, error) {
 	buf := bufPool.Get().(*bytes.Buffer)
 
-	_, err := io.Copy(buf, r)
+	if maxSize > 0 {
+		// Read at most one byte more than allowed, so we can stop
+		// decompressing as soon as the limit is exceeded.
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(buf, r)
 	if err != nil {
 		return nil, errors.Wrap(err, "copy to buffer")
 	}
+	if maxSize > 0 && n > maxSize {
+		buf.Reset()
+		bufPool.Put(buf)
+		return nil, ErrDecompressedSizeLimitExceeded
+	}
 
 	p := profilev1.ProfileFromVTPool()
 	if err := p.UnmarshalVT(buf.Bytes()); err != nil {
@@ -87,6 +102,13 @@ func fromUncompressedReader(r io.Reader) (*Profile, error) {
 
 // Read RawProfile from bytes
 func RawFromBytes(input []byte) (*Profile, error) {
+	return RawFromBytesWithLimit(input, 0)
+}
+
+// RawFromBytesWithLimit reads a RawProfile from bytes. Decompression stops
+// with ErrDecompressedSizeLimitExceeded once the profile exceeds maxSize
+// bytes. A maxSize of 0 disables the limit.
+func RawFromBytesWithLimit(input []byte, maxSize int64) (*Profile, error) {
 	gzipReader := gzipReaderPool.Get().(*gzipReader)
 	defer gzipReaderPool.Put(gzipReader)
 
@@ -95,7 +117,7 @@ func RawFromBytes(input []byte) (*Profile, error) {
 		return nil, err
 	}
 
-	return fromUncompressedReader(r)
+	return fromUncompressedReader(r, maxSize)
 }
 
 // Read Profile from Bytes
@@ -396,6 +418,100 @@ func (p *Profile) Normalize() {
 	p.clearSampleReferences(removedSamples)
 }
 
+// ReplaceLabelValues replaces the values of the string labels of the samples for which replace
+// returns true by the replacement. Normalize should be called afterwards, to aggregate the
+// samples which became identical.
+func (p *Profile) ReplaceLabelValues(replace func(key, value string) bool, replacement string) {
+	idx := int64(-1)
+	for _, s := range p.Sample {
+		for _, l := range s.Label {
+			if l.Str == 0 || !replace(p.StringTable[l.Key], p.StringTable[l.Str]) {
+				continue
+			}
+			if idx < 0 {
+				idx = p.stringIndex(replacement)
+			}
+			l.Str = idx
+		}
+	}
+}
+
+// stringIndex returns the index of the string in the string table, adding it if missing.
+func (p *Profile) stringIndex(s string) int64 {
+	for i, str := range p.StringTable {
+		if str == s {
+			return int64(i)
+		}
+	}
+	p.StringTable = append(p.StringTable, s)
+	return int64(len(p.StringTable) - 1)
+}
+
+// TruncateStacktraces truncates the stacktraces deeper than maxDepth, keeping
+// their maxDepth leaf-most frames. Normalize should be called afterwards, to
+// aggregate the samples which became identical.
+func (p *Profile) TruncateStacktraces(maxDepth int) {
+	if maxDepth <= 0 {
+		return
+	}
+	var removed []uint64
+	for _, s := range p.Sample {
+		if len(s.LocationId) > maxDepth {
+			removed = append(removed, s.LocationId[maxDepth:]...)
+			s.LocationId = s.LocationId[:maxDepth]
+		}
+	}
+	p.clearSampleReferences([]*profilev1.Sample{{LocationId: removed}})
+}
+
+// RemoveFrames removes the frames whose function names all match the given
+// regular expression from the stacktraces. Samples left without any frame are
+// removed. Normalize should be called afterwards, to aggregate the samples
+// which became identical.
+func (p *Profile) RemoveFrames(re *regexp.Regexp) {
+	if re == nil {
+		return
+	}
+	functionNames := make(map[uint64]string, len(p.Function))
+	for _, fn := range p.Function {
+		functionNames[fn.Id] = p.StringTable[fn.Name]
+	}
+	dropped := map[uint64]struct{}{}
+	for _, loc := range p.Location {
+		if len(loc.Line) == 0 {
+			continue
+		}
+		match := true
+		for _, line := range loc.Line {
+			if !re.MatchString(functionNames[line.FunctionId]) {
+				match = false
+				break
+			}
+		}
+		if match {
+			dropped[loc.Id] = struct{}{}
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	var removedSamples []*profilev1.Sample
+	p.Sample = slices.RemoveInPlace(p.Sample, func(s *profilev1.Sample, _ int) bool {
+		s.LocationId = slices.RemoveInPlace(s.LocationId, func(id uint64, _ int) bool {
+			_, ok := dropped[id]
+			return ok
+		})
+		if len(s.LocationId) == 0 {
+			removedSamples = append(removedSamples, s)
+			return true
+		}
+		return false
+	})
+	removed := &profilev1.Sample{LocationId: lo.Keys(dropped)}
+	p.clearSampleReferences(append(removedSamples, removed))
+}
+
 // ensureHasMapping ensures all locations have at least a mapping.
 func (p *Profile) ensureHasMapping() {
 	var mId uint64
@@ -474,7 +590,12 @@ func (p *Profile) clearSampleReferences(samples []*profilev1.Sample) {
 		}
 		return false
 	})
+	p.removeUnusedNames(removedNamesMap)
+}
 
+// removeUnusedNames removes the strings of the indexes given which are not referenced anymore from
+// the string table, and shifts the references to the strings after them.
+func (p *Profile) removeUnusedNames(removedNamesMap map[int64]struct{}) {
 	if len(removedNamesMap) == 0 {
 		return
 	}
@@ -482,6 +603,8 @@ func (p *Profile) clearSampleReferences(samples []*profilev1.Sample) {
 	p.visitAllNameReferences(func(idx *int64) {
 		delete(removedNamesMap, *idx)
 	})
+	// the empty string is always kept first.
+	delete(removedNamesMap, 0)
 	if len(removedNamesMap) == 0 {
 		return
 	}
@@ -513,8 +636,10 @@ func (p *Profile) clearSampleReferences(samples []*profilev1.Sample) {
 func (p *Profile) visitAllNameReferences(fn func(*int64)) {
 	fn(&p.DropFrames)
 	fn(&p.KeepFrames)
-	fn(&p.PeriodType.Type)
-	fn(&p.PeriodType.Unit)
+	if p.PeriodType != nil {
+		fn(&p.PeriodType.Type)
+		fn(&p.PeriodType.Unit)
+	}
 	for _, st := range p.SampleType {
 		fn(&st.Type)
 		fn(&st.Unit)
@@ -526,7 +651,7 @@ func (p *Profile) visitAllNameReferences(fn func(*int64)) {
 	for _, s := range p.Sample {
 		for _, l := range s.Label {
 			fn(&l.Key)
-			fn(&l.Num)
+			fn(&l.Str)
 			fn(&l.NumUnit)
 		}
 	}
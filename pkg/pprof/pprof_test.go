@@ -1,7 +1,10 @@
 package pprof
 
 import (
+	"fmt"
 	"math/rand"
+	"os"
+	"regexp"
 	"testing"
 	"time"
 
@@ -153,6 +156,135 @@ func TestRemoveDuplicateSampleStacktraces(t *testing.T) {
 	require.Equal(t, total-duplicate, len(p.Sample), "unexpected total samples")
 }
 
+func newFramesTestProfile() *Profile {
+	return &Profile{Profile: &profilev1.Profile{
+		SampleType: []*profilev1.ValueType{{Type: 1, Unit: 2}},
+		Sample: []*profilev1.Sample{
+			{LocationId: []uint64{1, 2, 3}, Value: []int64{1}},
+			{LocationId: []uint64{1, 4, 3}, Value: []int64{2}},
+			{LocationId: []uint64{1, 3}, Value: []int64{4}},
+			{LocationId: []uint64{2}, Value: []int64{8}},
+		},
+		Mapping: []*profilev1.Mapping{{Id: 1}},
+		Location: []*profilev1.Location{
+			{Id: 1, MappingId: 1, Line: []*profilev1.Line{{FunctionId: 1}}},
+			{Id: 2, MappingId: 1, Line: []*profilev1.Line{{FunctionId: 2}}},
+			{Id: 3, MappingId: 1, Line: []*profilev1.Line{{FunctionId: 3}}},
+			{Id: 4, MappingId: 1, Line: []*profilev1.Line{{FunctionId: 2}, {FunctionId: 4}}},
+		},
+		Function: []*profilev1.Function{
+			{Id: 1, Name: 3},
+			{Id: 2, Name: 4},
+			{Id: 3, Name: 5},
+			{Id: 4, Name: 6},
+		},
+		StringTable: []string{"", "cpu", "nanoseconds", "main.work", "runtime.goexit", "main.main", "main.inlined"},
+		PeriodType:  &profilev1.ValueType{Type: 1, Unit: 2},
+	}}
+}
+
+// sampleValues returns the first value of the samples by stacktrace.
+func sampleValues(p *Profile) map[string]int64 {
+	values := make(map[string]int64, len(p.Sample))
+	for _, s := range p.Sample {
+		values[fmt.Sprint(s.LocationId)] += s.Value[0]
+	}
+	return values
+}
+
+func TestTruncateStacktraces(t *testing.T) {
+	p := newFramesTestProfile()
+	p.TruncateStacktraces(1)
+	p.Normalize()
+
+	require.Len(t, p.Sample, 2)
+	require.Equal(t, map[string]int64{"[1]": 7, "[2]": 8}, sampleValues(p))
+	require.Len(t, p.Location, 2)
+	require.Len(t, p.Function, 2)
+	require.Equal(t, []string{"", "cpu", "nanoseconds", "main.work", "runtime.goexit"}, p.StringTable)
+}
+
+func TestRemoveFrames(t *testing.T) {
+	p := newFramesTestProfile()
+	p.RemoveFrames(regexp.MustCompile(`^runtime\..*$`))
+	p.Normalize()
+
+	// the location 4 is kept, since main.inlined is not matched.
+	require.Len(t, p.Sample, 2)
+	require.Equal(t, map[string]int64{"[1 3]": 5, "[1 4 3]": 2}, sampleValues(p))
+	require.Len(t, p.Location, 3)
+	for _, loc := range p.Location {
+		require.NotEqual(t, uint64(2), loc.Id)
+	}
+}
+
+func TestRepairSymbols(t *testing.T) {
+	p := newFramesTestProfile()
+	require.Zero(t, p.RepairSymbols().Total())
+
+	p.Function = append(p.Function, &profilev1.Function{Id: 2, Name: 3})
+	p.Location = append(p.Location,
+		&profilev1.Location{Id: 3, MappingId: 1, Line: []*profilev1.Line{{FunctionId: 1}}},
+		&profilev1.Location{Id: 5, MappingId: 7, Line: []*profilev1.Line{{FunctionId: 1}, {FunctionId: 9}}},
+	)
+	p.Location[0].Line = append(p.Location[0].Line, &profilev1.Line{FunctionId: 9})
+	p.Sample = append(p.Sample,
+		&profilev1.Sample{LocationId: []uint64{5, 6}, Value: []int64{16}},
+		&profilev1.Sample{LocationId: []uint64{6}, Value: []int64{32}},
+	)
+	p.Function[0].Filename = 42
+
+	repairs := p.RepairSymbols()
+	require.Equal(t, SymbolRepairs{
+		DuplicateFunctions: 1,
+		DuplicateLocations: 1,
+		DanglingMappings:   1,
+		DanglingFunctions:  2,
+		DanglingLocations:  2,
+		InvalidStrings:     1,
+	}, repairs)
+	require.Equal(t, 8, repairs.Total())
+
+	// the first records are kept, and the sample left without location is removed.
+	require.Len(t, p.Function, 4)
+	require.Equal(t, "runtime.goexit", p.StringTable[p.Function[1].Name])
+	require.Len(t, p.Location, 5)
+	require.Equal(t, uint64(3), p.Location[2].Line[0].FunctionId)
+	require.Len(t, p.Location[0].Line, 1)
+	require.Len(t, p.Location[4].Line, 1)
+	require.Equal(t, uint64(2), p.Location[4].MappingId)
+	require.Len(t, p.Mapping, 2)
+	require.Zero(t, p.Function[0].Filename)
+	require.Equal(t, map[string]int64{"[1 2 3]": 1, "[1 4 3]": 2, "[1 3]": 4, "[2]": 8, "[5]": 16}, sampleValues(p))
+	require.Zero(t, p.RepairSymbols().Total())
+}
+
+func TestReplaceLabelValues(t *testing.T) {
+	p := newFramesTestProfile()
+	p.StringTable = append(p.StringTable, "endpoint", "/a", "/b")
+	for _, s := range p.Sample {
+		value := int64(9)
+		if s.LocationId[0] == 2 {
+			value = 8
+		}
+		s.Label = []*profilev1.Label{{Key: 7, Str: value}}
+	}
+	p.ReplaceLabelValues(func(key, value string) bool {
+		return key == "endpoint" && value == "/b"
+	}, "other")
+	// the names of the removed functions are removed from the string table.
+	p.TruncateStacktraces(1)
+	p.Normalize()
+
+	labels := map[string]string{}
+	for _, s := range p.Sample {
+		require.Len(t, s.Label, 1)
+		require.Equal(t, "endpoint", p.StringTable[s.Label[0].Key])
+		labels[fmt.Sprint(s.LocationId)] = p.StringTable[s.Label[0].Str]
+	}
+	require.Equal(t, map[string]string{"[1]": "other", "[2]": "/a"}, labels)
+}
+
 func TestEmptyMappingJava(t *testing.T) {
 	p, err := OpenFile("testdata/profile_java")
 	require.NoError(t, err)
@@ -183,3 +315,20 @@ func countSampleDuplicates(p *Profile) int {
 	}
 	return totalDupe
 }
+
+func TestRawFromBytesWithLimit(t *testing.T) {
+	data, err := os.ReadFile("testdata/heap")
+	require.NoError(t, err)
+
+	p, err := RawFromBytesWithLimit(data, 0)
+	require.NoError(t, err)
+	size := p.SizeBytes()
+	p.Close()
+
+	p, err = RawFromBytesWithLimit(data, int64(size))
+	require.NoError(t, err)
+	p.Close()
+
+	_, err = RawFromBytesWithLimit(data, int64(size-1))
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+}
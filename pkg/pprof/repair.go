@@ -0,0 +1,124 @@
+package pprof
+
+import (
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	"github.com/grafana/phlare/pkg/slices"
+)
+
+// SymbolRepairs counts the inconsistencies of the symbol tables of a profile fixed by
+// RepairSymbols.
+type SymbolRepairs struct {
+	// DuplicateMappings, DuplicateFunctions and DuplicateLocations are the records whose ID is
+	// already used by a previous record of the profile. The first record is kept.
+	DuplicateMappings  int
+	DuplicateFunctions int
+	DuplicateLocations int
+	// DanglingMappings are the locations referencing a missing mapping, which are given a fake one.
+	DanglingMappings int
+	// DanglingFunctions are the lines of the locations referencing a missing function, which are
+	// removed.
+	DanglingFunctions int
+	// DanglingLocations are the frames of the samples referencing a missing location, which are
+	// removed.
+	DanglingLocations int
+	// InvalidStrings are the references out of the string table, replaced by the empty string.
+	InvalidStrings int
+}
+
+// Total returns the number of inconsistencies repaired.
+func (r SymbolRepairs) Total() int {
+	total := 0
+	r.Each(func(_ string, n int) { total += n })
+	return total
+}
+
+// Each calls fn with the number of inconsistencies repaired of each kind.
+func (r SymbolRepairs) Each(fn func(kind string, n int)) {
+	fn("duplicate_mapping", r.DuplicateMappings)
+	fn("duplicate_function", r.DuplicateFunctions)
+	fn("duplicate_location", r.DuplicateLocations)
+	fn("dangling_mapping", r.DanglingMappings)
+	fn("dangling_function", r.DanglingFunctions)
+	fn("dangling_location", r.DanglingLocations)
+	fn("invalid_string", r.InvalidStrings)
+}
+
+// RepairSymbols fixes the symbol tables of profiles sent by SDKs which duplicate IDs or reference
+// missing records, which would otherwise be stored as they are and break the merges reading them.
+// The samples left without any location by the repair are removed.
+func (p *Profile) RepairSymbols() SymbolRepairs {
+	var r SymbolRepairs
+
+	if len(p.StringTable) == 0 {
+		p.StringTable = []string{""}
+	}
+	if p.PeriodType == nil {
+		p.PeriodType = &profilev1.ValueType{}
+	}
+	size := int64(len(p.StringTable))
+	p.visitAllNameReferences(func(idx *int64) {
+		if *idx < 0 || *idx >= size {
+			*idx = 0
+			r.InvalidStrings++
+		}
+	})
+
+	mappings := make(map[uint64]struct{}, len(p.Mapping))
+	p.Mapping = slices.RemoveInPlace(p.Mapping, func(m *profilev1.Mapping, _ int) bool {
+		if _, ok := mappings[m.Id]; ok {
+			r.DuplicateMappings++
+			return true
+		}
+		mappings[m.Id] = struct{}{}
+		return false
+	})
+
+	functions := make(map[uint64]struct{}, len(p.Function))
+	p.Function = slices.RemoveInPlace(p.Function, func(fn *profilev1.Function, _ int) bool {
+		if _, ok := functions[fn.Id]; ok {
+			r.DuplicateFunctions++
+			return true
+		}
+		functions[fn.Id] = struct{}{}
+		return false
+	})
+
+	locations := make(map[uint64]struct{}, len(p.Location))
+	p.Location = slices.RemoveInPlace(p.Location, func(loc *profilev1.Location, _ int) bool {
+		if _, ok := locations[loc.Id]; ok {
+			r.DuplicateLocations++
+			return true
+		}
+		locations[loc.Id] = struct{}{}
+		if _, ok := mappings[loc.MappingId]; !ok && loc.MappingId != 0 {
+			// ensureHasMapping gives the location a fake mapping.
+			loc.MappingId = 0
+			r.DanglingMappings++
+		}
+		loc.Line = slices.RemoveInPlace(loc.Line, func(l *profilev1.Line, _ int) bool {
+			if _, ok := functions[l.FunctionId]; !ok {
+				r.DanglingFunctions++
+				return true
+			}
+			return false
+		})
+		return false
+	})
+	if r.DanglingMappings > 0 {
+		p.ensureHasMapping()
+	}
+
+	p.Sample = slices.RemoveInPlace(p.Sample, func(s *profilev1.Sample, _ int) bool {
+		n := len(s.LocationId)
+		s.LocationId = slices.RemoveInPlace(s.LocationId, func(id uint64, _ int) bool {
+			if _, ok := locations[id]; !ok {
+				r.DanglingLocations++
+				return true
+			}
+			return false
+		})
+		return n > 0 && len(s.LocationId) == 0
+	})
+
+	return r
+}
@@ -0,0 +1,170 @@
+package pprof
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Runtime describes the runtime and the profiler which produced a profile, as far as they can
+// be told from its metadata. The fields are empty when unknown.
+type Runtime struct {
+	// Name is the runtime, e.g. go, jvm or python.
+	Name string
+	// Version is the version of the runtime, e.g. go1.20.3.
+	Version string
+	// Spy is the profiler or SDK which produced the profile, e.g. py-spy.
+	Spy string
+}
+
+// runtimes are the runtimes known, by the names they are reported with. Only these are detected,
+// as the runtime names the label of its version.
+var runtimes = map[string]string{
+	"go":     "go",
+	"golang": "go",
+	"jvm":    "jvm",
+	"java":   "jvm",
+	"python": "python",
+	"ruby":   "ruby",
+	"nodejs": "nodejs",
+	"node":   "nodejs",
+	"php":    "php",
+	"dotnet": "dotnet",
+	".net":   "dotnet",
+	"rust":   "rust",
+}
+
+// goVersion matches the version of Go in the path of the sources of the Go runtime, e.g.
+// /usr/local/go1.20.3/src/runtime/proc.go or the toolchains of the module cache, and in the paths
+// of the binaries built by a versioned toolchain.
+var goVersion = regexp.MustCompile(`\bgo1\.\d+(?:\.\d+|(?:rc|beta)\d+)?\b`)
+
+// runtimeFileExtensions are the extensions of the source files of the interpreted runtimes.
+var runtimeFileExtensions = map[string]string{
+	".py":   "python",
+	".rb":   "ruby",
+	".js":   "nodejs",
+	".mjs":  "nodejs",
+	".cjs":  "nodejs",
+	".ts":   "nodejs",
+	".php":  "php",
+	".java": "jvm",
+	".kt":   "jvm",
+	".cs":   "dotnet",
+	".rs":   "rust",
+	".go":   "go",
+}
+
+// DetectRuntime detects the runtime of the profile:
+//
+//   - from its comments of the form `key=value` or `key: value`, with the keys `runtime`,
+//     `<runtime>_version` or `runtime_version`, and `spy` or `sdk`. Comments take precedence.
+//   - otherwise from the names of its functions, e.g. `runtime.main` for Go or `java.lang.Thread.run`
+//     for the JVM, and from the extensions of their source files.
+//
+// The runtimes unknown are ignored. The version of Go is otherwise read from the paths of the
+// sources of the Go runtime or of the mappings, when they include it.
+func (p *Profile) DetectRuntime() Runtime {
+	var r Runtime
+	for _, idx := range p.Comment {
+		key, value, ok := commentKeyValue(p.stringAt(idx))
+		if !ok {
+			continue
+		}
+		switch {
+		case key == "runtime":
+			if name, ok := runtimes[strings.ToLower(value)]; ok {
+				r.Name = name
+			}
+		case key == "spy" || key == "spy_name" || key == "sdk":
+			r.Spy = value
+		case key == "runtime_version":
+			r.Version = value
+		case strings.HasSuffix(key, "_version"):
+			name, ok := runtimes[strings.TrimSuffix(key, "_version")]
+			if !ok {
+				continue
+			}
+			r.Version = value
+			if r.Name == "" {
+				r.Name = name
+			}
+		}
+	}
+	if r.Name == "" {
+		r.Name = p.runtimeFromFunctions()
+	}
+	if r.Name == "go" && r.Version == "" {
+		r.Version = p.goVersion()
+	}
+	return r
+}
+
+// goVersion returns the version of Go found in the paths of the sources of the Go runtime, or of
+// the mappings.
+func (p *Profile) goVersion() string {
+	for _, fn := range p.Function {
+		filename := p.stringAt(fn.Filename)
+		if !strings.Contains(filename, "/src/runtime/") {
+			continue
+		}
+		if v := goVersion.FindString(filename); v != "" {
+			return v
+		}
+	}
+	for _, m := range p.Mapping {
+		if v := goVersion.FindString(p.stringAt(m.Filename)); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func commentKeyValue(comment string) (key, value string, ok bool) {
+	i := strings.IndexAny(comment, "=:")
+	if i <= 0 {
+		return "", "", false
+	}
+	key = strings.ToLower(strings.TrimSpace(comment[:i]))
+	value = strings.TrimSpace(comment[i+1:])
+	if value == "" || strings.ContainsAny(key, " \t") {
+		return "", "", false
+	}
+	return key, value, true
+}
+
+// runtimeFromFunctions returns the runtime of the functions of the profile, or an empty string
+// when they don't agree on a single runtime.
+func (p *Profile) runtimeFromFunctions() string {
+	var runtime string
+	for _, fn := range p.Function {
+		name, filename := p.stringAt(fn.Name), p.stringAt(fn.Filename)
+		r := functionRuntime(name, filename)
+		if r == "" {
+			continue
+		}
+		if runtime != "" && runtime != r {
+			return ""
+		}
+		runtime = r
+		// the Go scheduler frames are conclusive: cgo or assembly frames don't change the runtime.
+		if r == "go" && (name == "runtime.main" || name == "runtime.goexit") {
+			return r
+		}
+	}
+	return runtime
+}
+
+func functionRuntime(name, filename string) string {
+	switch {
+	case name == "runtime.main", name == "runtime.goexit", name == "runtime.mcall", name == "runtime.mstart":
+		return "go"
+	case strings.HasPrefix(name, "java.lang."), strings.HasPrefix(name, "java/lang/"):
+		return "jvm"
+	case strings.HasPrefix(filename, "node:"):
+		return "nodejs"
+	}
+	if i := strings.LastIndexByte(filename, '.'); i >= 0 {
+		return runtimeFileExtensions[filename[i:]]
+	}
+	return ""
+}
@@ -0,0 +1,96 @@
+package pprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+)
+
+func TestDetectRuntime(t *testing.T) {
+	profile := func(comments []string, functions ...[2]string) *Profile {
+		p := &Profile{Profile: &profilev1.Profile{StringTable: []string{""}}}
+		add := func(s string) int64 {
+			p.StringTable = append(p.StringTable, s)
+			return int64(len(p.StringTable) - 1)
+		}
+		for _, c := range comments {
+			p.Comment = append(p.Comment, add(c))
+		}
+		for i, fn := range functions {
+			p.Function = append(p.Function, &profilev1.Function{Id: uint64(i + 1), Name: add(fn[0]), Filename: add(fn[1])})
+		}
+		return p
+	}
+
+	for _, tc := range []struct {
+		name     string
+		profile  *Profile
+		expected Runtime
+	}{
+		{
+			name:     "go scheduler",
+			profile:  profile(nil, [2]string{"main.main", "main.go"}, [2]string{"_cgo_thread_start", "gcc_linux_amd64.c"}, [2]string{"runtime.goexit", "asm_amd64.s"}),
+			expected: Runtime{Name: "go"},
+		},
+		{
+			name:     "python sources",
+			profile:  profile(nil, [2]string{"<module>", "app.py"}, [2]string{"run", "/usr/lib/python3/threading.py"}),
+			expected: Runtime{Name: "python"},
+		},
+		{
+			name:     "jvm",
+			profile:  profile(nil, [2]string{"java.lang.Thread.run", ""}, [2]string{"com.example.App.main", ""}),
+			expected: Runtime{Name: "jvm"},
+		},
+		{
+			name:     "mixed sources",
+			profile:  profile(nil, [2]string{"handler", "app.rb"}, [2]string{"run", "app.py"}),
+			expected: Runtime{},
+		},
+		{
+			name:     "comments",
+			profile:  profile([]string{"go_version=go1.20.3", "spy: pyroscope-go", "not a key value"}, [2]string{"<module>", "app.py"}),
+			expected: Runtime{Name: "go", Version: "go1.20.3", Spy: "pyroscope-go"},
+		},
+		{
+			name:     "runtime comment",
+			profile:  profile([]string{"runtime=nodejs", "runtime_version=v18.12.0"}),
+			expected: Runtime{Name: "nodejs", Version: "v18.12.0"},
+		},
+		{
+			name:     "unknown",
+			profile:  profile(nil, [2]string{"main", "main.c"}),
+			expected: Runtime{},
+		},
+		{
+			name:     "unknown runtime comments",
+			profile:  profile([]string{"runtime=cobol", "build_version=1.2.3"}),
+			expected: Runtime{},
+		},
+		{
+			name:     "runtime alias",
+			profile:  profile([]string{"runtime=Java", "java_version=17.0.2"}),
+			expected: Runtime{Name: "jvm", Version: "17.0.2"},
+		},
+		{
+			name:     "go version of the runtime sources",
+			profile:  profile(nil, [2]string{"main.main", "/app/main.go"}, [2]string{"runtime.main", "/usr/local/go1.20.3/src/runtime/proc.go"}),
+			expected: Runtime{Name: "go", Version: "go1.20.3"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expected, tc.profile.DetectRuntime())
+		})
+	}
+}
+
+func TestDetectRuntime_GoVersionOfMappings(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		StringTable: []string{"", "runtime.goexit", "asm_amd64.s", "/root/go/pkg/mod/golang.org/toolchain@v0.0.1-go1.21.0.linux-amd64/bin/app"},
+		Function:    []*profilev1.Function{{Id: 1, Name: 1, Filename: 2}},
+		Mapping:     []*profilev1.Mapping{{Id: 1, Filename: 3}},
+	}}
+	require.Equal(t, Runtime{Name: "go", Version: "go1.21.0"}, p.DetectRuntime())
+}
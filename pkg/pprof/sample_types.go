@@ -0,0 +1,72 @@
+package pprof
+
+import (
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// CanonicalizeSampleTypes renames the sample types of the profile to their canonical names and
+// units, e.g. the `wall-clock` time in microseconds of a profiler becomes the `wall` time in
+// nanoseconds, and rescales the values of the samples and the period accordingly.
+//
+// The sample types whose canonical name and unit would collide with another sample type of the
+// profile, e.g. a `wall` and a `wall-clock` time, are kept as they are.
+func (p *Profile) CanonicalizeSampleTypes() {
+	type sampleType struct{ name, unit string }
+	var (
+		original  = make([]sampleType, len(p.SampleType))
+		canonical = make([]sampleType, len(p.SampleType))
+		factors   = make([]int64, len(p.SampleType))
+	)
+	for i, st := range p.SampleType {
+		original[i] = sampleType{p.stringAt(st.Type), p.stringAt(st.Unit)}
+		name, unit, factor := phlaremodel.CanonicalSampleType(original[i].name, original[i].unit)
+		canonical[i], factors[i] = sampleType{name, unit}, factor
+	}
+	// revert the renamed sample types colliding with another one, until none does.
+	for collided := true; collided; {
+		collided = false
+		seen := make(map[sampleType]int, len(canonical))
+		for i, st := range canonical {
+			j, ok := seen[st]
+			if !ok {
+				seen[st] = i
+				continue
+			}
+			for _, k := range []int{i, j} {
+				if canonical[k] != original[k] {
+					canonical[k], factors[k] = original[k], 1
+					collided = true
+				}
+			}
+		}
+	}
+	for i, st := range p.SampleType {
+		if canonical[i].name != original[i].name {
+			st.Type = p.stringIndex(canonical[i].name)
+		}
+		if canonical[i].unit != original[i].unit {
+			st.Unit = p.stringIndex(canonical[i].unit)
+		}
+	}
+	for i, factor := range factors {
+		if factor == 1 {
+			continue
+		}
+		for _, s := range p.Sample {
+			if i < len(s.Value) {
+				s.Value[i] *= factor
+			}
+		}
+	}
+	if p.PeriodType != nil {
+		periodType, periodUnit := p.stringAt(p.PeriodType.Type), p.stringAt(p.PeriodType.Unit)
+		name, unit, factor := phlaremodel.CanonicalSampleType(periodType, periodUnit)
+		if name != periodType {
+			p.PeriodType.Type = p.stringIndex(name)
+		}
+		if unit != periodUnit {
+			p.PeriodType.Unit = p.stringIndex(unit)
+			p.Period *= factor
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package pprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+)
+
+func TestCanonicalizeSampleTypes(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		SampleType: []*profilev1.ValueType{{Type: 1, Unit: 2}, {Type: 3, Unit: 4}},
+		Sample: []*profilev1.Sample{
+			{LocationId: []uint64{1}, Value: []int64{2, 3}},
+		},
+		PeriodType:  &profilev1.ValueType{Type: 1, Unit: 2},
+		Period:      10,
+		StringTable: []string{"", "wall-clock", "microseconds", "samples", "count"},
+	}}
+	p.CanonicalizeSampleTypes()
+
+	require.Equal(t, "wall", p.StringTable[p.SampleType[0].Type])
+	require.Equal(t, "nanoseconds", p.StringTable[p.SampleType[0].Unit])
+	require.Equal(t, "samples", p.StringTable[p.SampleType[1].Type])
+	require.Equal(t, "count", p.StringTable[p.SampleType[1].Unit])
+	require.Equal(t, []int64{2000, 3}, p.Sample[0].Value)
+	require.Equal(t, "wall", p.StringTable[p.PeriodType.Type])
+	require.Equal(t, "nanoseconds", p.StringTable[p.PeriodType.Unit])
+	require.Equal(t, int64(10000), p.Period)
+}
+
+func TestCanonicalizeSampleTypes_Collision(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		SampleType: []*profilev1.ValueType{{Type: 1, Unit: 2}, {Type: 3, Unit: 4}, {Type: 5, Unit: 2}},
+		Sample: []*profilev1.Sample{
+			{LocationId: []uint64{1}, Value: []int64{1, 2, 3}},
+		},
+		StringTable: []string{"", "wall", "nanoseconds", "wall-clock", "microseconds", "itimer"},
+	}}
+	p.CanonicalizeSampleTypes()
+
+	// wall-clock would collide with wall, so it's kept as is.
+	require.Equal(t, "wall", p.StringTable[p.SampleType[0].Type])
+	require.Equal(t, "nanoseconds", p.StringTable[p.SampleType[0].Unit])
+	require.Equal(t, "wall-clock", p.StringTable[p.SampleType[1].Type])
+	require.Equal(t, "microseconds", p.StringTable[p.SampleType[1].Unit])
+	require.Equal(t, "cpu", p.StringTable[p.SampleType[2].Type])
+	require.Equal(t, "nanoseconds", p.StringTable[p.SampleType[2].Unit])
+	require.Equal(t, []int64{1, 2, 3}, p.Sample[0].Value)
+}
@@ -0,0 +1,247 @@
+package pprof
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const goShapePrefix = "go.shape."
+
+// NormalizeGoSymbols canonicalizes the names of the Go generic functions and merges
+// the frames which become identical, so profiles of different builds compare cleanly:
+//
+//   - the shape type arguments of generic instantiations, e.g. `pkg.Map[go.shape.int_0]`,
+//     depend on the compiler version and are replaced by `[...]`.
+//   - functions which become identical are merged.
+//   - consecutive inline-expanded frames of the same function within a location,
+//     e.g. a generic wrapper and its shape instantiation, are merged into one.
+func (p *Profile) NormalizeGoSymbols() {
+	// the normalized names are appended to the string table: the original strings may be
+	// referenced elsewhere, such as by the labels or the file names.
+	var (
+		normalizedIdx = map[int64]int64{}
+		appended      = map[string]int64{}
+	)
+	normalize := func(idx int64) int64 {
+		if newIdx, ok := normalizedIdx[idx]; ok {
+			return newIdx
+		}
+		if idx <= 0 || int(idx) >= len(p.StringTable) {
+			return idx
+		}
+		name := NormalizeGoSymbol(p.StringTable[idx])
+		if name == p.StringTable[idx] {
+			return idx
+		}
+		newIdx, ok := appended[name]
+		if !ok {
+			newIdx = int64(len(p.StringTable))
+			p.StringTable = append(p.StringTable, name)
+			appended[name] = newIdx
+		}
+		normalizedIdx[idx] = newIdx
+		return newIdx
+	}
+	for _, fn := range p.Function {
+		fn.Name = normalize(fn.Name)
+		fn.SystemName = normalize(fn.SystemName)
+	}
+	if len(normalizedIdx) == 0 {
+		return
+	}
+	unused := make(map[int64]struct{}, len(normalizedIdx))
+	for idx := range normalizedIdx {
+		unused[idx] = struct{}{}
+	}
+	p.removeUnusedNames(unused)
+
+	functionIDs := p.mergeIdenticalFunctions()
+	for _, loc := range p.Location {
+		lines := loc.Line[:0]
+		for _, line := range loc.Line {
+			if id, ok := functionIDs[line.FunctionId]; ok {
+				line.FunctionId = id
+			}
+			// lines are ordered from the innermost inlined function to the caller.
+			if len(lines) > 0 && lines[len(lines)-1].FunctionId == line.FunctionId {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		loc.Line = lines
+	}
+}
+
+// mergeIdenticalFunctions removes the functions identical to another one. It returns the IDs of the
+// functions removed, mapped to the ID of the function kept; the lines of the locations are left to
+// the caller to rewrite.
+func (p *Profile) mergeIdenticalFunctions() map[uint64]uint64 {
+	type functionKey struct {
+		name, systemName, filename string
+		startLine                  int64
+	}
+	var (
+		functions   = make(map[functionKey]uint64, len(p.Function))
+		functionIDs = make(map[uint64]uint64)
+	)
+	kept := p.Function[:0]
+	for _, fn := range p.Function {
+		k := functionKey{
+			name:       p.stringAt(fn.Name),
+			systemName: p.stringAt(fn.SystemName),
+			filename:   p.stringAt(fn.Filename),
+			startLine:  fn.StartLine,
+		}
+		if id, ok := functions[k]; ok {
+			functionIDs[fn.Id] = id
+			continue
+		}
+		functions[k] = fn.Id
+		kept = append(kept, fn)
+	}
+	p.Function = kept
+	return functionIDs
+}
+
+// TruncatedSymbolMarker replaces the middle of the function names truncated by
+// TruncateFunctionNames.
+const TruncatedSymbolMarker = "..."
+
+// TruncateFunctionNames truncates the function names longer than maxLength bytes, e.g. the names
+// of C++ template instantiations of tens of KB, by replacing their middle by
+// TruncatedSymbolMarker: their beginning and their end, which usually tell the namespace and the
+// method, are kept. The functions which become identical are merged. It returns the number of
+// names truncated.
+func (p *Profile) TruncateFunctionNames(maxLength int) int {
+	if maxLength <= 0 {
+		return 0
+	}
+	// the truncated names are appended to the string table: the original strings may be
+	// referenced elsewhere, such as by the labels or the file names.
+	var (
+		truncatedIdx = map[int64]int64{}
+		appended     = map[string]int64{}
+		truncated    int
+	)
+	truncate := func(idx int64) int64 {
+		if newIdx, ok := truncatedIdx[idx]; ok {
+			return newIdx
+		}
+		if idx <= 0 || int(idx) >= len(p.StringTable) || len(p.StringTable[idx]) <= maxLength {
+			return idx
+		}
+		truncated++
+		name := TruncateSymbol(p.StringTable[idx], maxLength)
+		newIdx, ok := appended[name]
+		if !ok {
+			newIdx = int64(len(p.StringTable))
+			p.StringTable = append(p.StringTable, name)
+			appended[name] = newIdx
+		}
+		truncatedIdx[idx] = newIdx
+		return newIdx
+	}
+	for _, fn := range p.Function {
+		fn.Name = truncate(fn.Name)
+		fn.SystemName = truncate(fn.SystemName)
+	}
+	if truncated == 0 {
+		return 0
+	}
+	unused := make(map[int64]struct{}, len(truncatedIdx))
+	for idx := range truncatedIdx {
+		unused[idx] = struct{}{}
+	}
+	p.removeUnusedNames(unused)
+
+	functionIDs := p.mergeIdenticalFunctions()
+	if len(functionIDs) == 0 {
+		return truncated
+	}
+	for _, loc := range p.Location {
+		for _, line := range loc.Line {
+			if id, ok := functionIDs[line.FunctionId]; ok {
+				line.FunctionId = id
+			}
+		}
+	}
+	return truncated
+}
+
+// TruncateSymbol truncates the name to maxLength bytes by replacing its middle by
+// TruncatedSymbolMarker, keeping the runes at its beginning and end whole.
+func TruncateSymbol(name string, maxLength int) string {
+	if maxLength <= 0 || len(name) <= maxLength {
+		return name
+	}
+	keep := maxLength - len(TruncatedSymbolMarker)
+	if keep <= 0 {
+		return validUTF8Prefix(name, maxLength)
+	}
+	head := validUTF8Prefix(name, keep-keep/2)
+	tail := len(name) - keep/2
+	for tail < len(name) && !utf8.RuneStart(name[tail]) {
+		tail++
+	}
+	return head + TruncatedSymbolMarker + name[tail:]
+}
+
+// validUTF8Prefix returns the longest prefix of s of at most n bytes which doesn't split a rune.
+func validUTF8Prefix(s string, n int) string {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (p *Profile) stringAt(idx int64) string {
+	if idx < 0 || int(idx) >= len(p.StringTable) {
+		return ""
+	}
+	return p.StringTable[idx]
+}
+
+// NormalizeGoSymbol replaces the shape type arguments of a Go generic function name by `[...]`.
+// For example `pkg.(*List[go.shape.int_0]).Push` becomes `pkg.(*List[...]).Push`.
+func NormalizeGoSymbol(name string) string {
+	if !strings.Contains(name, goShapePrefix) {
+		return name
+	}
+	var b strings.Builder
+	b.Grow(len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '[' {
+			b.WriteByte(name[i])
+			continue
+		}
+		end := matchingBracket(name, i)
+		if end < 0 {
+			b.WriteString(name[i:])
+			break
+		}
+		if strings.HasPrefix(name[i+1:end], goShapePrefix) {
+			b.WriteString("[...]")
+		} else {
+			b.WriteString(name[i : end+1])
+		}
+		i = end
+	}
+	return b.String()
+}
+
+// matchingBracket returns the position of the bracket closing the one at the given position, or -1.
+func matchingBracket(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,134 @@
+package pprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+)
+
+func TestNormalizeGoSymbol(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"main.main", "main.main"},
+		{"main.Map[...]", "main.Map[...]"},
+		{"main.Map[go.shape.int_0,go.shape.string_1]", "main.Map[...]"},
+		{"main.(*List[go.shape.int_0]).Push", "main.(*List[...]).Push"},
+		{"main.Sum[go.shape.[]int_0]", "main.Sum[...]"},
+		{"main.Keys[go.shape.map[string]int_0].func1", "main.Keys[...].func1"},
+		{"main.Index[go.shape.int_0", "main.Index[go.shape.int_0"},
+		{"main.(*Array[5]).Len", "main.(*Array[5]).Len"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			require.Equal(t, tc.out, NormalizeGoSymbol(tc.in))
+		})
+	}
+}
+
+func TestNormalizeGoSymbols(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		Sample: []*profilev1.Sample{
+			{LocationId: []uint64{1, 3}, Value: []int64{1}},
+			{LocationId: []uint64{2, 3}, Value: []int64{2}},
+		},
+		Location: []*profilev1.Location{
+			// a generic wrapper with its inlined shape instantiation.
+			{Id: 1, Line: []*profilev1.Line{{FunctionId: 1, Line: 12}, {FunctionId: 2, Line: 10}}},
+			{Id: 2, Line: []*profilev1.Line{{FunctionId: 2, Line: 11}}},
+			{Id: 3, Line: []*profilev1.Line{{FunctionId: 3, Line: 5}}},
+		},
+		Function: []*profilev1.Function{
+			{Id: 1, Name: 1, SystemName: 1, Filename: 3},
+			{Id: 2, Name: 2, SystemName: 2, Filename: 3},
+			{Id: 3, Name: 4, SystemName: 4, Filename: 3},
+		},
+		StringTable: []string{"", "main.Map[go.shape.int_0]", "main.Map[...]", "main.go", "main.main"},
+	}}
+	// the label value is the same string as the name of the first function.
+	p.Sample[0].Label = []*profilev1.Label{{Key: 3, Str: 1}}
+	p.NormalizeGoSymbols()
+
+	require.Equal(t, []string{"", "main.Map[go.shape.int_0]", "main.Map[...]", "main.go", "main.main", "main.Map[...]"}, p.StringTable)
+	require.Equal(t, "main.Map[go.shape.int_0]", p.StringTable[p.Sample[0].Label[0].Str], "the strings referenced elsewhere are kept")
+	require.Len(t, p.Function, 2)
+	require.Equal(t, uint64(1), p.Function[0].Id)
+	require.Equal(t, uint64(3), p.Function[1].Id)
+	require.Len(t, p.Location[0].Line, 1)
+	require.Equal(t, uint64(1), p.Location[0].Line[0].FunctionId)
+	require.Equal(t, int64(12), p.Location[0].Line[0].Line)
+	require.Equal(t, uint64(1), p.Location[1].Line[0].FunctionId)
+}
+
+func TestNormalizeGoSymbols_NothingNormalized(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		Function: []*profilev1.Function{
+			{Id: 1, Name: 1, SystemName: 1},
+			{Id: 2, Name: 1, SystemName: 1},
+		},
+		StringTable: []string{"", "main.main"},
+	}}
+	p.NormalizeGoSymbols()
+
+	// the functions are only merged when names are normalized.
+	require.Len(t, p.Function, 2)
+	require.Equal(t, []string{"", "main.main"}, p.StringTable)
+}
+
+func TestTruncateSymbol(t *testing.T) {
+	for _, tc := range []struct {
+		in        string
+		maxLength int
+		out       string
+	}{
+		{"main.main", 0, "main.main"},
+		{"main.main", 9, "main.main"},
+		{"std::vector<std::pair<int, int>>::push_back", 20, "std::vect...ush_back"},
+		{"std::vector<int>::push_back", 2, "st"},
+		{"héllo_wörld", 9, "hé...rld"},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			out := TruncateSymbol(tc.in, tc.maxLength)
+			require.Equal(t, tc.out, out)
+			if tc.maxLength > 0 {
+				require.LessOrEqual(t, len(out), tc.maxLength)
+			}
+		})
+	}
+}
+
+func TestTruncateFunctionNames(t *testing.T) {
+	p := &Profile{Profile: &profilev1.Profile{
+		Sample: []*profilev1.Sample{
+			{LocationId: []uint64{1, 3}, Value: []int64{1}},
+			{LocationId: []uint64{2, 3}, Value: []int64{2}},
+		},
+		Location: []*profilev1.Location{
+			{Id: 1, Line: []*profilev1.Line{{FunctionId: 1, Line: 12}}},
+			{Id: 2, Line: []*profilev1.Line{{FunctionId: 2, Line: 11}}},
+			{Id: 3, Line: []*profilev1.Line{{FunctionId: 3, Line: 5}}},
+		},
+		Function: []*profilev1.Function{
+			{Id: 1, Name: 1, SystemName: 1, Filename: 3},
+			{Id: 2, Name: 2, SystemName: 2, Filename: 3},
+			{Id: 3, Name: 4, SystemName: 4, Filename: 3},
+		},
+		StringTable: []string{"", "ns::f<ns::a, ns::b>::call", "ns::f<ns::c, ns::d>::call", "a_very_long_file_name.cc", "main"},
+		// the file name of the mapping is the same string as the name of the first function.
+		Mapping: []*profilev1.Mapping{{Id: 1, Filename: 1}},
+	}}
+	require.Equal(t, 2, p.TruncateFunctionNames(16))
+
+	// the name of the second function is not referenced anymore.
+	require.Equal(t, []string{"", "ns::f<ns::a, ns::b>::call", "a_very_long_file_name.cc", "main", "ns::f<n...::call"}, p.StringTable)
+	require.Equal(t, "ns::f<ns::a, ns::b>::call", p.StringTable[p.Mapping[0].Filename], "the strings referenced elsewhere are kept")
+	require.Len(t, p.Function, 2)
+	require.Equal(t, "ns::f<n...::call", p.StringTable[p.Function[0].Name])
+	require.Equal(t, "ns::f<n...::call", p.StringTable[p.Function[0].SystemName])
+	require.Equal(t, "main", p.StringTable[p.Function[1].Name])
+	require.Equal(t, "a_very_long_file_name.cc", p.StringTable[p.Function[1].Filename])
+	require.Equal(t, uint64(1), p.Location[0].Line[0].FunctionId)
+	require.Equal(t, uint64(1), p.Location[1].Line[0].FunctionId)
+	require.Equal(t, uint64(3), p.Location[2].Line[0].FunctionId)
+}
@@ -0,0 +1,101 @@
+package pprof
+
+import (
+	"github.com/pkg/errors"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+)
+
+const (
+	// maxConvertedFrames bounds the frames of the stacks of a profile converted to pprof, whatever
+	// the size limit of the tenant: the stacks of a small push can expand to a huge profile.
+	maxConvertedFrames = 1 << 22
+	// convertedFrameSize is the estimated size of a frame once encoded, as the location ID of a
+	// sample.
+	convertedFrameSize = 2
+)
+
+// checkConvertedFrames returns ErrDecompressedSizeLimitExceeded when the frames of the stacks of a
+// profile converted to pprof exceed maxConvertedFrames, or when their estimated size exceeds
+// maxSize bytes, if maxSize is positive.
+func checkConvertedFrames(frames, maxSize int64) error {
+	if frames > maxConvertedFrames || (maxSize > 0 && frames*convertedFrameSize > maxSize) {
+		return ErrDecompressedSizeLimitExceeded
+	}
+	return nil
+}
+
+// FromTree converts a profile pushed in the tree format to pprof. Each frame is a location of its
+// own function, and each node with a value is a sample of the stack ending at the node.
+//
+// The stacks of the tree share their common frames, unlike the ones of pprof, so the pprof profile
+// can be much larger: the profile is rejected with ErrDecompressedSizeLimitExceeded before it is
+// converted when its stacks have too many frames, or when their estimated size alone exceeds
+// maxSize bytes, if maxSize is positive.
+func FromTree(t *pushv1.TreeProfile, maxSize int64) (*profilev1.Profile, error) {
+	if len(t.StringTable) == 0 || t.StringTable[0] != "" {
+		return nil, errors.New("tree: the first string of the string table must be empty")
+	}
+	for _, idx := range []int64{t.SampleType, t.SampleUnit, t.PeriodType, t.PeriodUnit} {
+		if idx < 0 || idx >= int64(len(t.StringTable)) {
+			return nil, errors.Errorf("tree: string index %d out of range", idx)
+		}
+	}
+
+	// the depth of the nodes, and the number of frames of the samples.
+	depths := make([]int, len(t.Nodes))
+	var frames int64
+	for i, n := range t.Nodes {
+		if n.Parent > uint32(i) {
+			return nil, errors.Errorf("tree: node %d comes before its parent %d", i+1, n.Parent)
+		}
+		if n.Name < 0 || n.Name >= int64(len(t.StringTable)) {
+			return nil, errors.Errorf("tree: node %d: string index %d out of range", i+1, n.Name)
+		}
+		depths[i] = 1
+		if n.Parent > 0 {
+			depths[i] += depths[n.Parent-1]
+		}
+		if n.Self != 0 {
+			frames += int64(depths[i])
+			if err := checkConvertedFrames(frames, maxSize); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	p := &profilev1.Profile{
+		SampleType:    []*profilev1.ValueType{{Type: t.SampleType, Unit: t.SampleUnit}},
+		PeriodType:    &profilev1.ValueType{Type: t.PeriodType, Unit: t.PeriodUnit},
+		Period:        t.Period,
+		TimeNanos:     t.TimeNanos,
+		DurationNanos: t.DurationNanos,
+		StringTable:   t.StringTable,
+	}
+	// the locations are shared by the frames of the same function.
+	locations := make(map[int64]uint64)
+	locationIDs := make([]uint64, len(t.Nodes))
+	for i, n := range t.Nodes {
+		id, ok := locations[n.Name]
+		if !ok {
+			id = uint64(len(p.Location) + 1)
+			locations[n.Name] = id
+			p.Function = append(p.Function, &profilev1.Function{Id: id, Name: n.Name})
+			p.Location = append(p.Location, &profilev1.Location{Id: id, Line: []*profilev1.Line{{FunctionId: id}}})
+		}
+		locationIDs[i] = id
+	}
+	for i, n := range t.Nodes {
+		if n.Self == 0 {
+			continue
+		}
+		// the stack of a sample starts from its leaf.
+		stack := make([]uint64, 0, depths[i])
+		for j := uint32(i + 1); j > 0; j = t.Nodes[j-1].Parent {
+			stack = append(stack, locationIDs[j-1])
+		}
+		p.Sample = append(p.Sample, &profilev1.Sample{LocationId: stack, Value: []int64{n.Self}})
+	}
+	return p, nil
+}
@@ -0,0 +1,98 @@
+package pprof
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	pushv1 "github.com/grafana/phlare/api/gen/proto/go/push/v1"
+)
+
+func TestFromTree(t *testing.T) {
+	// main -> (a -> c, b -> c), with c sampled in both stacks.
+	tree := &pushv1.TreeProfile{
+		StringTable:   []string{"", "cpu", "nanoseconds", "main", "a", "b", "c"},
+		SampleType:    1,
+		SampleUnit:    2,
+		PeriodType:    1,
+		PeriodUnit:    2,
+		Period:        10000000,
+		TimeNanos:     1000,
+		DurationNanos: 10,
+		Nodes: []*pushv1.TreeNode{
+			{Parent: 0, Name: 3, Self: 1},
+			{Parent: 1, Name: 4},
+			{Parent: 1, Name: 5, Self: 2},
+			{Parent: 2, Name: 6, Self: 3},
+			{Parent: 3, Name: 6, Self: 4},
+		},
+	}
+	p, err := FromTree(tree, 0)
+	require.NoError(t, err)
+	require.Equal(t, []*profilev1.ValueType{{Type: 1, Unit: 2}}, p.SampleType)
+	require.Equal(t, int64(10000000), p.Period)
+	require.Equal(t, int64(1000), p.TimeNanos)
+	require.Len(t, p.Function, 4)
+	require.Len(t, p.Location, 4)
+
+	stacks := make(map[string]int64)
+	for _, s := range p.Sample {
+		var stack string
+		for _, id := range s.LocationId {
+			fn := p.Function[p.Location[id-1].Line[0].FunctionId-1]
+			stack += p.StringTable[fn.Name] + ";"
+		}
+		stacks[stack] = s.Value[0]
+	}
+	require.Equal(t, map[string]int64{
+		"main;":     1,
+		"b;main;":   2,
+		"c;a;main;": 3,
+		"c;b;main;": 4,
+	}, stacks)
+
+	// the profile converted is read like any pprof profile.
+	b, err := p.MarshalVT()
+	require.NoError(t, err)
+	raw, err := RawFromBytes(b)
+	require.NoError(t, err)
+	require.Len(t, raw.Sample, 4)
+
+	// 9 frames in total, of 2 bytes each.
+	_, err = FromTree(tree, 17)
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+	_, err = FromTree(tree, 18)
+	require.NoError(t, err)
+}
+
+func TestFromTreeMaxFrames(t *testing.T) {
+	// a chain of nodes with a value each has a quadratic number of frames.
+	tree := &pushv1.TreeProfile{StringTable: []string{"", "f"}}
+	for i := 0; i < 3000; i++ {
+		tree.Nodes = append(tree.Nodes, &pushv1.TreeNode{Parent: uint32(i), Name: 1, Self: 1})
+	}
+	_, err := FromTree(tree, 0)
+	require.ErrorIs(t, err, ErrDecompressedSizeLimitExceeded)
+
+	tree.Nodes = tree.Nodes[:2000]
+	_, err = FromTree(tree, 0)
+	require.NoError(t, err)
+}
+
+func TestFromTreeInvalid(t *testing.T) {
+	for name, tree := range map[string]*pushv1.TreeProfile{
+		"no string table":   {},
+		"first string":      {StringTable: []string{"main"}},
+		"sample type":       {StringTable: []string{""}, SampleType: 1},
+		"parent after":      {StringTable: []string{"", "main"}, Nodes: []*pushv1.TreeNode{{Parent: 2, Name: 1}, {Name: 1}}},
+		"parent itself":     {StringTable: []string{"", "main"}, Nodes: []*pushv1.TreeNode{{Parent: 1, Name: 1}}},
+		"name out of range": {StringTable: []string{"", "main"}, Nodes: []*pushv1.TreeNode{{Name: 2}}},
+		"negative name":     {StringTable: []string{"", "main"}, Nodes: []*pushv1.TreeNode{{Name: -1}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := FromTree(tree, 0)
+			require.Error(t, err)
+		})
+	}
+}
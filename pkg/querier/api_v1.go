@@ -0,0 +1,182 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+)
+
+// defaultQueryStep is the step of the series of /api/v1/query without the step parameter.
+const defaultQueryStep = 15 * time.Second
+
+// APIv1 serves the stable JSON endpoints of the v1 HTTP API, along with /api/v1/flamegraph and
+// /api/v1/pprof. Their parameters and responses are frozen: fields may be added to the responses,
+// but none is renamed or removed until a v2 of the API.
+//
+//	/api/v1/profile_types
+//	/api/v1/labels
+//	/api/v1/label/<name>/values
+//	/api/v1/query?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&from=now-1h&step=1m&group_by=pod
+//
+// The queries are sent through the given client.
+type APIv1 struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewAPIv1(client querierv1connect.QuerierServiceClient) *APIv1 {
+	return &APIv1{client: client}
+}
+
+type apiProfileType struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	SampleType string `json:"sampleType"`
+	SampleUnit string `json:"sampleUnit"`
+	PeriodType string `json:"periodType"`
+	PeriodUnit string `json:"periodUnit"`
+}
+
+type apiProfileTypesResponse struct {
+	ProfileTypes []apiProfileType `json:"profileTypes"`
+}
+
+// ProfileTypes lists the profile types ingested.
+func (a *APIv1) ProfileTypes(w http.ResponseWriter, req *http.Request) {
+	res, err := a.client.ProfileTypes(req.Context(), connect.NewRequest(&querierv1.ProfileTypesRequest{}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	resp := apiProfileTypesResponse{ProfileTypes: make([]apiProfileType, 0, len(res.Msg.ProfileTypes))}
+	for _, t := range res.Msg.ProfileTypes {
+		resp.ProfileTypes = append(resp.ProfileTypes, apiProfileType{
+			ID:         t.ID,
+			Name:       t.Name,
+			SampleType: t.SampleType,
+			SampleUnit: t.SampleUnit,
+			PeriodType: t.PeriodType,
+			PeriodUnit: t.PeriodUnit,
+		})
+	}
+	writeJSON(w, resp)
+}
+
+type apiNamesResponse struct {
+	Names []string `json:"names"`
+}
+
+// Labels lists the label names.
+func (a *APIv1) Labels(w http.ResponseWriter, req *http.Request) {
+	res, err := a.client.LabelNames(req.Context(), connect.NewRequest(&querierv1.LabelNamesRequest{}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	writeJSON(w, apiNamesResponse{Names: nonNil(res.Msg.Names)})
+}
+
+type apiValuesResponse struct {
+	Values []string `json:"values"`
+}
+
+// LabelValues lists the values of the label of the name parameter.
+func (a *APIv1) LabelValues(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "the label name is required", http.StatusBadRequest)
+		return
+	}
+	res, err := a.client.LabelValues(req.Context(), connect.NewRequest(&querierv1.LabelValuesRequest{Name: name}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	writeJSON(w, apiValuesResponse{Values: nonNil(res.Msg.Names)})
+}
+
+type apiPoint struct {
+	// Timestamp is in milliseconds since epoch.
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+type apiSeries struct {
+	Labels map[string]string `json:"labels"`
+	Points []apiPoint        `json:"points"`
+}
+
+type apiQueryResponse struct {
+	Series []apiSeries `json:"series"`
+}
+
+// Query returns the time series of the totals of the profiles matching the query, aggregated by
+// the labels of the group_by parameters.
+func (a *APIv1) Query(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectParams, _, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	step := defaultQueryStep
+	if s := req.Form.Get("step"); s != "" {
+		d, err := model.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid step %q", s), http.StatusBadRequest)
+			return
+		}
+		step = time.Duration(d)
+	}
+	res, err := a.client.SelectSeries(req.Context(), connect.NewRequest(&querierv1.SelectSeriesRequest{
+		ProfileTypeID: selectParams.ProfileTypeID,
+		LabelSelector: selectParams.LabelSelector,
+		Start:         selectParams.Start,
+		End:           selectParams.End,
+		GroupBy:       req.Form["group_by"],
+		Step:          step.Seconds(),
+	}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	resp := apiQueryResponse{Series: make([]apiSeries, 0, len(res.Msg.Series))}
+	for _, s := range res.Msg.Series {
+		series := apiSeries{
+			Labels: make(map[string]string, len(s.Labels)),
+			Points: make([]apiPoint, 0, len(s.Points)),
+		}
+		for _, l := range s.Labels {
+			series.Labels[l.Name] = l.Value
+		}
+		for _, p := range s.Points {
+			series.Points = append(series.Points, apiPoint{Timestamp: p.Timestamp, Value: p.Value})
+		}
+		resp.Series = append(resp.Series, series)
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// nonNil returns an empty slice rather than nil, so that it is encoded as an empty JSON array.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
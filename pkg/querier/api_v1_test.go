@@ -0,0 +1,106 @@
+package querier
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+type fakeAPIClient struct {
+	querierv1connect.QuerierServiceClient
+	seriesReq *querierv1.SelectSeriesRequest
+}
+
+func (c *fakeAPIClient) LabelValues(_ context.Context, req *connect.Request[querierv1.LabelValuesRequest]) (*connect.Response[querierv1.LabelValuesResponse], error) {
+	if req.Msg.Name != "pod" {
+		return connect.NewResponse(&querierv1.LabelValuesResponse{}), nil
+	}
+	return connect.NewResponse(&querierv1.LabelValuesResponse{Names: []string{"pod-a", "pod-b"}}), nil
+}
+
+func (c *fakeAPIClient) SelectSeries(_ context.Context, req *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
+	if req.Msg.LabelSelector == `{namespace="unavailable"}` {
+		return nil, connect.NewError(connect.CodeUnavailable, errors.New("unavailable"))
+	}
+	c.seriesReq = req.Msg
+	return connect.NewResponse(&querierv1.SelectSeriesResponse{Series: []*typesv1.Series{{
+		Labels: []*typesv1.LabelPair{{Name: "pod", Value: "pod-a"}},
+		Points: []*typesv1.Point{{Timestamp: 1000, Value: 1.5}, {Timestamp: 61000, Value: 2}},
+	}}}), nil
+}
+
+// The responses of the v1 API are frozen.
+func Test_APIv1(t *testing.T) {
+	client := &fakeAPIClient{}
+	api := NewAPIv1(client)
+
+	for _, tc := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		url      string
+		code     int
+		expected string
+	}{
+		{
+			name:     "label values",
+			handler:  api.LabelValues,
+			url:      "/api/v1/label/pod/values?name=pod",
+			code:     http.StatusOK,
+			expected: `{"values":["pod-a","pod-b"]}`,
+		},
+		{
+			name:     "no label values",
+			handler:  api.LabelValues,
+			url:      "/api/v1/label/foo/values?name=foo",
+			code:     http.StatusOK,
+			expected: `{"values":[]}`,
+		},
+		{
+			name:    "label values without name",
+			handler: api.LabelValues,
+			url:     "/api/v1/label//values",
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:     "query",
+			handler:  api.Query,
+			url:      `/api/v1/query?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&step=1m&group_by=pod`,
+			code:     http.StatusOK,
+			expected: `{"series":[{"labels":{"pod":"pod-a"},"points":[{"timestamp":1000,"value":1.5},{"timestamp":61000,"value":2}]}]}`,
+		},
+		{
+			name:    "query with invalid step",
+			handler: api.Query,
+			url:     `/api/v1/query?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{}&step=0s`,
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "query unavailable",
+			handler: api.Query,
+			url:     `/api/v1/query?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="unavailable"}`,
+			code:    http.StatusServiceUnavailable,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tc.handler(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			require.Equal(t, tc.code, rec.Code)
+			if tc.expected != "" {
+				require.JSONEq(t, tc.expected, rec.Body.String())
+			}
+		})
+	}
+
+	require.Equal(t, "process_cpu:cpu:nanoseconds:cpu:nanoseconds", client.seriesReq.ProfileTypeID)
+	require.Equal(t, []string{"pod"}, client.seriesReq.GroupBy)
+	require.Equal(t, 60., client.seriesReq.Step)
+}
@@ -0,0 +1,141 @@
+package querier
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+
+	googlev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/pkg/arrow"
+)
+
+// maxArrowSteps is the maximum number of steps of the time range of an Arrow stream, each step
+// being merged with its own query.
+const maxArrowSteps = 1000
+
+// ArrowHandler streams the samples of the profiles matching the query as Apache Arrow record
+// batches, for bulk extraction into data frames:
+//
+//	/api/experimental/arrow?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&from=now-24h&step=1h
+//
+// The time range is split in steps, and the profiles of each step are merged with one query,
+// sent through the given client, and written as one record batch timestamped at the start of the
+// step. Without step, the whole time range is merged. The time range is split in at most
+// maxArrowSteps steps.
+type ArrowHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewArrowHandler(client querierv1connect.QuerierServiceClient) *ArrowHandler {
+	return &ArrowHandler{client: client}
+}
+
+func (h *ArrowHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectParams, _, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end := model.Time(selectParams.Start), model.Time(selectParams.End)
+	step := end.Sub(start)
+	if s := req.Form.Get("step"); s != "" {
+		d, err := model.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "step must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		step = time.Duration(d)
+	}
+	if steps := int64((end.Sub(start) + step - 1) / step); steps > maxArrowSteps {
+		http.Error(w, fmt.Sprintf("the time range would be split in %d steps, more than the maximum of %d: increase the step", steps, maxArrowSteps), http.StatusBadRequest)
+		return
+	}
+
+	// errors can't be reported once the stream started, so the first step is queried before.
+	first, err := h.selectSamples(req.Context(), selectParams.ProfileTypeID, selectParams.LabelSelector, start, step)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	w.Header().Add("Content-Type", arrow.ContentType)
+	sw := arrow.NewSampleWriter(w)
+	for t := start; t < end; t = t.Add(step) {
+		samples := first
+		if t != start {
+			samples, err = h.selectSamples(req.Context(), selectParams.ProfileTypeID, selectParams.LabelSelector, t, step)
+			if err != nil {
+				// closing the connection without the end of the stream marks it as truncated.
+				panic(http.ErrAbortHandler)
+			}
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		if err := sw.WriteBatch(samples); err != nil {
+			return
+		}
+	}
+	_ = sw.Close()
+}
+
+// selectSamples merges the profiles of the step starting at t, and returns their samples.
+func (h *ArrowHandler) selectSamples(ctx context.Context, profileType, selector string, t model.Time, step time.Duration) ([]arrow.Sample, error) {
+	res, err := h.client.SelectMergeProfile(ctx, connect.NewRequest(&querierv1.SelectMergeProfileRequest{
+		ProfileTypeID: profileType,
+		LabelSelector: selector,
+		Start:         int64(t),
+		// the end of the range is inclusive.
+		End: int64(t.Add(step)) - 1,
+	}))
+	if err != nil {
+		return nil, err
+	}
+	return profileSamples(res.Msg, int64(t))
+}
+
+// profileSamples returns the samples of the profile, with the names of the functions of the
+// lines of their locations as stacktraces.
+func profileSamples(p *googlev1.Profile, timestamp int64) ([]arrow.Sample, error) {
+	functions := make(map[uint64]string, len(p.Function))
+	for _, fn := range p.Function {
+		if fn.Name < 0 || fn.Name >= int64(len(p.StringTable)) {
+			return nil, connect.NewError(connect.CodeInternal, fmt.Errorf("invalid function name %d", fn.Name))
+		}
+		functions[fn.Id] = p.StringTable[fn.Name]
+	}
+	locations := make(map[uint64][]string, len(p.Location))
+	for _, loc := range p.Location {
+		names := make([]string, 0, len(loc.Line))
+		for _, line := range loc.Line {
+			names = append(names, functions[line.FunctionId])
+		}
+		locations[loc.Id] = names
+	}
+
+	samples := make([]arrow.Sample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		if len(s.Value) == 0 || s.Value[0] == 0 {
+			continue
+		}
+		sample := arrow.Sample{
+			Timestamp:  timestamp,
+			Stacktrace: make([]string, 0, len(s.LocationId)),
+			Value:      s.Value[0],
+		}
+		for _, id := range s.LocationId {
+			sample.Stacktrace = append(sample.Stacktrace, locations[id]...)
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
@@ -0,0 +1,88 @@
+package querier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	googlev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/pkg/arrow"
+)
+
+type fakeArrowClient struct {
+	querierv1connect.QuerierServiceClient
+	requests []*querierv1.SelectMergeProfileRequest
+}
+
+// SelectMergeProfile returns a profile with main calling a, with b inlined in a, only for the
+// first request.
+func (c *fakeArrowClient) SelectMergeProfile(_ context.Context, req *connect.Request[querierv1.SelectMergeProfileRequest]) (*connect.Response[googlev1.Profile], error) {
+	c.requests = append(c.requests, req.Msg)
+	if len(c.requests) > 1 {
+		return connect.NewResponse(&googlev1.Profile{}), nil
+	}
+	return connect.NewResponse(&googlev1.Profile{
+		Sample: []*googlev1.Sample{
+			{LocationId: []uint64{2, 1}, Value: []int64{3}},
+			{LocationId: []uint64{1}, Value: []int64{1}},
+			{LocationId: []uint64{1}, Value: []int64{0}},
+		},
+		Location: []*googlev1.Location{
+			{Id: 1, Line: []*googlev1.Line{{FunctionId: 1}}},
+			{Id: 2, Line: []*googlev1.Line{{FunctionId: 3}, {FunctionId: 2}}},
+		},
+		Function: []*googlev1.Function{
+			{Id: 1, Name: 1},
+			{Id: 2, Name: 2},
+			{Id: 3, Name: 3},
+		},
+		StringTable: []string{"", "main", "a", "b"},
+	}), nil
+}
+
+func Test_ProfileSamples(t *testing.T) {
+	res, err := (&fakeArrowClient{}).SelectMergeProfile(context.Background(), connect.NewRequest(&querierv1.SelectMergeProfileRequest{}))
+	require.NoError(t, err)
+	samples, err := profileSamples(res.Msg, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []arrow.Sample{
+		{Timestamp: 1000, Stacktrace: []string{"b", "a", "main"}, Value: 3},
+		{Timestamp: 1000, Stacktrace: []string{"main"}, Value: 1},
+	}, samples)
+}
+
+func Test_ArrowHandler(t *testing.T) {
+	client := &fakeArrowClient{}
+	rec := httptest.NewRecorder()
+	NewArrowHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/experimental/arrow?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&from=now-1h&step=15m`, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, arrow.ContentType, rec.Header().Get("Content-Type"))
+
+	require.Len(t, client.requests, 4)
+	for i, req := range client.requests {
+		require.Equal(t, `{namespace="prod"}`, req.LabelSelector)
+		require.Equal(t, int64(15*60*1000-1), req.End-req.Start)
+		if i > 0 {
+			require.Equal(t, client.requests[i-1].End+1, req.Start)
+		}
+	}
+	// the stream ends with the end of stream marker.
+	require.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, rec.Body.Bytes()[rec.Body.Len()-8:])
+
+	rec = httptest.NewRecorder()
+	NewArrowHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/experimental/arrow?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{}&step=-1m`, nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// a step splitting the time range in too many steps is rejected before any query.
+	client = &fakeArrowClient{}
+	rec = httptest.NewRecorder()
+	NewArrowHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/experimental/arrow?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{}&from=now-24h&step=1s`, nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, client.requests)
+}
@@ -0,0 +1,379 @@
+package querier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/flamebearer"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+const (
+	// baselinesDir is the directory of the baselines of a tenant in the storage bucket.
+	baselinesDir          = "baselines"
+	baselineMetaSuffix    = ".json"
+	baselineProfileSuffix = ".pb"
+	maxBaselineNameLength = 128
+	// defaultDiffMaxNodes is the default number of nodes of the diff flamegraphs.
+	defaultDiffMaxNodes = 1024
+)
+
+var baselineNameRE = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// Baseline is a merged profile stored under a name, e.g. the profile of a release, so that the
+// later profiles can be compared to it once its time range is not retained anymore.
+type Baseline struct {
+	Name          string `json:"name"`
+	Query         string `json:"query"`
+	ProfileTypeID string `json:"profileTypeID"`
+	// Start and End are the time range merged, in milliseconds.
+	Start     int64     `json:"start"`
+	End       int64     `json:"end"`
+	Total     int64     `json:"total"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type baselinesResponse struct {
+	Baselines []Baseline `json:"baselines"`
+}
+
+type baselineResponse struct {
+	Baseline
+	Flamebearer *flamebearer.FlamebearerProfile `json:"flamebearer"`
+}
+
+type baselineDiffResponse struct {
+	Baseline    Baseline                        `json:"baseline"`
+	Flamebearer *flamebearer.FlamebearerProfile `json:"flamebearer"`
+}
+
+// BaselinesHandler stores the merge of the profiles matching a query as a named baseline, in the
+// storage bucket under the directory of the tenant, and diffs the profiles against it:
+//
+//	PUT /api/v1/baselines/checkout-v1.2?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{service="checkout"}&from=now-24h
+//	GET /api/v1/flamegraph/diff?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{service="checkout"}&from=now-1h&baseline=checkout-v1.2
+//
+// Each baseline is stored as two objects: its flamegraph, then its metadata which is listed.
+// Without bucket, e.g. with the filesystem backend, the baselines of a replica wouldn't be seen by
+// the others, so all the requests are rejected with 501.
+type BaselinesHandler struct {
+	client querierv1connect.QuerierServiceClient
+	bucket phlareobjstore.Bucket
+	now    func() time.Time
+}
+
+func NewBaselinesHandler(client querierv1connect.QuerierServiceClient, bucket phlareobjstore.Bucket) *BaselinesHandler {
+	return &BaselinesHandler{client: client, bucket: bucket, now: time.Now}
+}
+
+// available writes the error of the requests when no bucket is configured.
+func (h *BaselinesHandler) available(w http.ResponseWriter) bool {
+	if h.bucket == nil {
+		http.Error(w, "the baselines require an object storage, configured with -storage.backend", http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// List lists the baselines of the tenant, by name.
+func (h *BaselinesHandler) List(w http.ResponseWriter, req *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	tenantID, err := tenant.ExtractTenantIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	resp := baselinesResponse{Baselines: []Baseline{}}
+	err = h.bucket.Iter(req.Context(), path.Join(tenantID, baselinesDir)+"/", func(name string) error {
+		if !strings.HasSuffix(name, baselineMetaSuffix) {
+			return nil
+		}
+		b, err := h.readMeta(req.Context(), name)
+		if h.bucket.IsObjNotFoundErr(err) {
+			// deleted since listed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp.Baselines = append(resp.Baselines, *b)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(resp.Baselines, func(i, j int) bool { return resp.Baselines[i].Name < resp.Baselines[j].Name })
+	writeJSON(w, resp)
+}
+
+// Create merges the profiles matching the query and stores them under the name of the baseline,
+// replacing the baseline of the same name if any.
+func (h *BaselinesHandler) Create(w http.ResponseWriter, req *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	tenantID, name, ok := h.parseName(w, req)
+	if !ok {
+		return
+	}
+	selectParams, profileType, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.client.SelectMergeStacktraces(req.Context(), connect.NewRequest(selectParams))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	fg := res.Msg.Flamegraph
+	if fg == nil || fg.Total == 0 {
+		http.Error(w, "no profiles match the query in the time range", http.StatusBadRequest)
+		return
+	}
+	profile, err := fg.MarshalVT()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b := Baseline{
+		Name:          name,
+		Query:         req.Form.Get("query"),
+		ProfileTypeID: profileType.ID,
+		Start:         selectParams.Start,
+		End:           selectParams.End,
+		Total:         fg.Total,
+		CreatedAt:     h.now().UTC(),
+	}
+	meta, err := json.Marshal(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the metadata is written last: the baselines are listed from it.
+	prefix := baselinePath(tenantID, name)
+	if err := h.bucket.Upload(req.Context(), prefix+baselineProfileSuffix, bytes.NewReader(profile)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := h.bucket.Upload(req.Context(), prefix+baselineMetaSuffix, bytes.NewReader(meta)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, b)
+}
+
+// Get returns the baseline, with its flamegraph.
+func (h *BaselinesHandler) Get(w http.ResponseWriter, req *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	tenantID, name, ok := h.parseName(w, req)
+	if !ok {
+		return
+	}
+	b, fg, err := h.read(req.Context(), tenantID, name)
+	if err != nil {
+		h.writeError(w, name, err)
+		return
+	}
+	profileType, err := phlaremodel.ParseProfileTypeSelector(b.ProfileTypeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, baselineResponse{
+		Baseline:    *b,
+		Flamebearer: ExportToFlamebearer(fg, profileType),
+	})
+}
+
+// Delete removes the baseline.
+func (h *BaselinesHandler) Delete(w http.ResponseWriter, req *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	tenantID, name, ok := h.parseName(w, req)
+	if !ok {
+		return
+	}
+	prefix := baselinePath(tenantID, name)
+	// some backends don't fail to delete the objects which don't exist.
+	exists, err := h.bucket.Exists(req.Context(), prefix+baselineMetaSuffix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("baseline %s not found", name), http.StatusNotFound)
+		return
+	}
+	if err := h.bucket.Delete(req.Context(), prefix+baselineMetaSuffix); err != nil {
+		h.writeError(w, name, err)
+		return
+	}
+	if err := h.bucket.Delete(req.Context(), prefix+baselineProfileSuffix); err != nil && !h.bucket.IsObjNotFoundErr(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Diff compares the merge of the profiles matching the query to the baseline, in the diff
+// format of the flamebearer, the baseline being the left side.
+func (h *BaselinesHandler) Diff(w http.ResponseWriter, req *http.Request) {
+	if !h.available(w) {
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tenantID, err := tenant.ExtractTenantIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := req.Form.Get("baseline")
+	if err := validateBaselineName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxNodes := defaultDiffMaxNodes
+	if s := req.Form.Get("max_nodes"); s != "" {
+		if maxNodes, err = strconv.Atoi(s); err != nil || maxNodes <= 0 {
+			http.Error(w, "max_nodes must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	selectParams, profileType, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, baseline, err := h.read(req.Context(), tenantID, name)
+	if err != nil {
+		h.writeError(w, name, err)
+		return
+	}
+	if b.ProfileTypeID != profileType.ID {
+		http.Error(w, fmt.Sprintf("the profile type of the query %s differs from the profile type of the baseline %s", profileType.ID, b.ProfileTypeID), http.StatusBadRequest)
+		return
+	}
+	res, err := h.client.SelectMergeStacktraces(req.Context(), connect.NewRequest(selectParams))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	current := res.Msg.Flamegraph
+	if current == nil {
+		current = &querierv1.FlameGraph{}
+	}
+	diff, err := flamebearer.Diff(name, ExportToFlamebearer(baseline, profileType), ExportToFlamebearer(current, profileType), maxNodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, baselineDiffResponse{Baseline: *b, Flamebearer: &diff})
+}
+
+// parseName returns the tenant and the validated name of the baseline of the request, or writes
+// the error.
+func (h *BaselinesHandler) parseName(w http.ResponseWriter, req *http.Request) (string, string, bool) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	tenantID, err := tenant.ExtractTenantIDFromContext(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return "", "", false
+	}
+	name := req.Form.Get("name")
+	if err := validateBaselineName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+	return tenantID, name, true
+}
+
+func validateBaselineName(name string) error {
+	if name == "" {
+		return fmt.Errorf("baseline name is required")
+	}
+	if len(name) > maxBaselineNameLength || !baselineNameRE.MatchString(name) {
+		return fmt.Errorf("invalid baseline name %q: it must be at most %d letters, digits, '.', '_' or '-', starting with a letter or a digit", name, maxBaselineNameLength)
+	}
+	return nil
+}
+
+func baselinePath(tenantID, name string) string {
+	return path.Join(tenantID, baselinesDir, name)
+}
+
+// read returns the metadata and the flamegraph of the baseline.
+func (h *BaselinesHandler) read(ctx context.Context, tenantID, name string) (*Baseline, *querierv1.FlameGraph, error) {
+	prefix := baselinePath(tenantID, name)
+	b, err := h.readMeta(ctx, prefix+baselineMetaSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := h.readObject(ctx, prefix+baselineProfileSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+	fg := &querierv1.FlameGraph{}
+	if err := fg.UnmarshalVT(data); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode baseline %s: %w", name, err)
+	}
+	return b, fg, nil
+}
+
+func (h *BaselinesHandler) readMeta(ctx context.Context, name string) (*Baseline, error) {
+	data, err := h.readObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var b Baseline
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("failed to decode baseline %s: %w", name, err)
+	}
+	return &b, nil
+}
+
+func (h *BaselinesHandler) readObject(ctx context.Context, name string) ([]byte, error) {
+	r, err := h.bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// writeError writes the error of reading or removing the baseline.
+func (h *BaselinesHandler) writeError(w http.ResponseWriter, name string, err error) {
+	if h.bucket.IsObjNotFoundErr(err) {
+		http.Error(w, fmt.Sprintf("baseline %s not found", name), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,140 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/pkg/objstore/providers/filesystem"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+type fakeBaselineClient struct {
+	querierv1connect.QuerierServiceClient
+}
+
+// SelectMergeStacktraces returns a flamegraph of a single function, with a value of 10 for the
+// version v1 and 15 otherwise.
+func (c *fakeBaselineClient) SelectMergeStacktraces(_ context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error) {
+	total := int64(15)
+	if strings.Contains(req.Msg.LabelSelector, `version="v1"`) {
+		total = 10
+	}
+	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
+		Flamegraph: &querierv1.FlameGraph{
+			Names: []string{"total", "main"},
+			Levels: []*querierv1.Level{
+				{Values: []int64{0, total, 0, 0}},
+				{Values: []int64{0, total, total, 1}},
+			},
+			Total:   total,
+			MaxSelf: total,
+		},
+	}), nil
+}
+
+func Test_BaselinesHandler(t *testing.T) {
+	bucket, err := filesystem.NewBucket(t.TempDir())
+	require.NoError(t, err)
+	h := NewBaselinesHandler(&fakeBaselineClient{}, bucket)
+
+	do := func(t *testing.T, handler http.HandlerFunc, method, tenantID string, params url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/?"+params.Encode(), nil)
+		handler(rec, req.WithContext(tenant.InjectTenantID(req.Context(), tenantID)))
+		return rec
+	}
+	list := func(t *testing.T, tenantID string) []Baseline {
+		t.Helper()
+		rec := do(t, h.List, http.MethodGet, tenantID, url.Values{})
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp baselinesResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		return resp.Baselines
+	}
+	const profileType = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+
+	require.Empty(t, list(t, "foo"))
+
+	rec := do(t, h.Create, http.MethodPut, "foo", url.Values{
+		"name":  []string{"checkout-v1"},
+		"query": []string{profileType + `{version="v1"}`},
+		"from":  []string{"now-1h"},
+	})
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	baselines := list(t, "foo")
+	require.Len(t, baselines, 1)
+	require.Equal(t, "checkout-v1", baselines[0].Name)
+	require.Equal(t, profileType, baselines[0].ProfileTypeID)
+	require.Equal(t, int64(10), baselines[0].Total)
+	// the baselines are stored per tenant.
+	require.Empty(t, list(t, "bar"))
+
+	t.Run("get", func(t *testing.T) {
+		rec := do(t, h.Get, http.MethodGet, "foo", url.Values{"name": []string{"checkout-v1"}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp baselineResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(t, 10, resp.Flamebearer.Flamebearer.NumTicks)
+
+		rec = do(t, h.Get, http.MethodGet, "bar", url.Values{"name": []string{"checkout-v1"}})
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		rec := do(t, h.Diff, http.MethodGet, "foo", url.Values{
+			"baseline": []string{"checkout-v1"},
+			"query":    []string{profileType + `{version="v2"}`},
+		})
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var resp baselineDiffResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.Equal(t, "checkout-v1", resp.Baseline.Name)
+		require.Equal(t, "double", resp.Flamebearer.Metadata.Format)
+		require.Equal(t, uint64(10), resp.Flamebearer.LeftTicks)
+		require.Equal(t, uint64(15), resp.Flamebearer.RightTicks)
+
+		rec = do(t, h.Diff, http.MethodGet, "foo", url.Values{
+			"baseline": []string{"checkout-v1"},
+			"query":    []string{`memory:alloc_space:bytes:space:bytes{version="v2"}`},
+		})
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("invalid name", func(t *testing.T) {
+		for _, name := range []string{"", "../bar", ".hidden", strings.Repeat("a", maxBaselineNameLength+1)} {
+			rec := do(t, h.Create, http.MethodPut, "foo", url.Values{"name": []string{name}, "query": []string{profileType + "{}"}})
+			require.Equal(t, http.StatusBadRequest, rec.Code, name)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		rec := do(t, h.Delete, http.MethodDelete, "foo", url.Values{"name": []string{"checkout-v1"}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Empty(t, list(t, "foo"))
+
+		rec = do(t, h.Delete, http.MethodDelete, "foo", url.Values{"name": []string{"checkout-v1"}})
+		require.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
+
+func Test_BaselinesHandler_NoBucket(t *testing.T) {
+	h := NewBaselinesHandler(&fakeBaselineClient{}, nil)
+	for _, handler := range []http.HandlerFunc{h.List, h.Get, h.Create, h.Delete, h.Diff} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/?name=checkout-v1", nil)
+		handler(rec, req.WithContext(tenant.InjectTenantID(req.Context(), "foo")))
+		require.Equal(t, http.StatusNotImplemented, rec.Code)
+	}
+}
@@ -0,0 +1,140 @@
+package querier
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/dustin/go-humanize"
+	"github.com/prometheus/common/model"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+type ingesterBlocks struct {
+	Addr   string                `json:"addr"`
+	Head   *ingestv1.BlockInfo   `json:"head"`
+	Blocks []*ingestv1.BlockInfo `json:"blocks"`
+}
+
+type blocksResponse struct {
+	TenantID  string           `json:"tenantId"`
+	Ingesters []ingesterBlocks `json:"ingesters"`
+}
+
+var blocksPageTemplate = template.Must(template.New("blocks").Funcs(template.FuncMap{
+	"bytes": humanize.Bytes,
+	"timestamp": func(ms int64) string {
+		if ms == 0 {
+			return "-"
+		}
+		return model.Time(ms).Time().UTC().Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+	<head>
+		<meta charset="UTF-8">
+		<title>Querier Blocks</title>
+	</head>
+	<body>
+		<h1>Querier Blocks</h1>
+		<p>The heads and the blocks queried for the tenant {{ .TenantID }}, by ingester.</p>
+		{{ range .Ingesters }}
+		<h2>{{ .Addr }}</h2>
+		<table border="1" cellpadding="5">
+			<thead>
+				<tr>
+					<th>Block</th>
+					<th>State</th>
+					<th>Min Time</th>
+					<th>Max Time</th>
+					<th>Series</th>
+					<th>Profiles</th>
+					<th>Samples</th>
+					<th>Size</th>
+				</tr>
+			</thead>
+			<tbody>
+				{{ range .Blocks }}
+				<tr>
+					<td>{{ .Ulid }}</td>
+					<td>{{ .State }}</td>
+					<td>{{ timestamp .MinTime }}</td>
+					<td>{{ timestamp .MaxTime }}</td>
+					<td>{{ .NumSeries }}</td>
+					<td>{{ .NumProfiles }}</td>
+					<td>{{ .NumSamples }}</td>
+					<td>{{ bytes .Size }}</td>
+				</tr>
+				{{ end }}
+				{{ with .Head }}
+				<tr>
+					<td>{{ .Ulid }}</td>
+					<td>{{ .State }}</td>
+					<td>{{ timestamp .MinTime }}</td>
+					<td>{{ timestamp .MaxTime }}</td>
+					<td>{{ .NumSeries }}</td>
+					<td>{{ .NumProfiles }}</td>
+					<td>{{ .NumSamples }}</td>
+					<td>{{ bytes .Size }}</td>
+				</tr>
+				{{ end }}
+			</tbody>
+		</table>
+		{{ end }}
+	</body>
+</html>`))
+
+// BlocksHandler shows the blocks queried for the tenant: the head and the local blocks of each
+// ingester, with their state and stats. It responds with JSON when requested with
+// 'Accept: application/json' or '?format=json'.
+func (q *Querier) BlocksHandler(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureBlockMetadata); err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	// the blocks of an ingester can't be inferred from the others, so all of them must answer.
+	replicationSet, err := q.ingesterQuerier.readReplicationSet(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replicationSet.MaxErrors = 0
+	replicationSet.MaxUnavailableZones = 0
+	responses, err := forGivenIngesters(ctx, q.ingesterQuerier, replicationSet, func(childCtx context.Context, ic IngesterQueryClient) (*ingestv1.BlockMetadataResponse, error) {
+		res, err := ic.BlockMetadata(childCtx, connect.NewRequest(&ingestv1.BlockMetadataRequest{}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg, nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := blocksResponse{TenantID: tenantID, Ingesters: make([]ingesterBlocks, 0, len(responses))}
+	for _, r := range responses {
+		res.Ingesters = append(res.Ingesters, ingesterBlocks{
+			Addr:   r.addr,
+			Head:   r.response.Head,
+			Blocks: r.response.Blocks,
+		})
+	}
+	sort.Slice(res.Ingesters, func(i, j int) bool {
+		return res.Ingesters[i].Addr < res.Ingesters[j].Addr
+	})
+	util.RenderHTTPResponse(w, res, blocksPageTemplate, req)
+}
@@ -0,0 +1,70 @@
+package querier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/grafana/dskit/ring"
+	"github.com/grafana/dskit/ring/client"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func Test_BlocksHandler(t *testing.T) {
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "2"},
+		{Addr: "1"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		q.On("BlockMetadata", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.BlockMetadataResponse{
+			Head: &ingestv1.BlockInfo{Ulid: "head-" + addr, State: "head", NumProfiles: 1},
+			Blocks: []*ingestv1.BlockInfo{
+				{Ulid: "block-" + addr, State: "uploaded", MinTime: 1000, MaxTime: 2000, NumProfiles: 10, Size: 1024},
+			},
+		}), nil)
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/querier/blocks?format=json", nil)
+	rec := httptest.NewRecorder()
+	querier.BlocksHandler(rec, req.WithContext(tenant.InjectTenantID(req.Context(), "foo")))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp blocksResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Equal(t, "foo", resp.TenantID)
+	require.Len(t, resp.Ingesters, 2)
+	for i, addr := range []string{"1", "2"} {
+		require.Equal(t, addr, resp.Ingesters[i].Addr)
+		require.Equal(t, "head-"+addr, resp.Ingesters[i].Head.Ulid)
+		require.Len(t, resp.Ingesters[i].Blocks, 1)
+		require.Equal(t, "block-"+addr, resp.Ingesters[i].Blocks[0].Ulid)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/querier/blocks", nil)
+	querier.BlocksHandler(rec, req.WithContext(tenant.InjectTenantID(req.Context(), "foo")))
+	require.Equal(t, "text/html", rec.Header().Get("Content-Type"))
+	require.Contains(t, rec.Body.String(), "<td>block-1</td>")
+	require.Contains(t, rec.Body.String(), "<td>1970-01-01T00:00:01Z</td>")
+	require.Contains(t, rec.Body.String(), "<td>1.0 kB</td>")
+
+	// the tenant is required.
+	rec = httptest.NewRecorder()
+	querier.BlocksHandler(rec, httptest.NewRequest(http.MethodGet, "/querier/blocks", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
@@ -111,10 +111,13 @@ func ExportToFlamebearer(fg *querierv1.FlameGraph, profileType *typesv1.ProfileT
 	switch profileType.SampleType {
 	case "inuse_objects", "alloc_objects", "goroutine", "samples":
 		unit = metadata.ObjectsUnits
-	case "cpu":
+	case "cpu", "wall", "off_cpu":
 		unit = metadata.SamplesUnits
 		sampleRate = uint32(100000000)
-
+	case "delay":
+		unit = metadata.LockNanosecondsUnits
+	case "contentions":
+		unit = metadata.LockSamplesUnits
 	}
 	levels := make([][]int, len(fg.Levels))
 	for i := range levels {
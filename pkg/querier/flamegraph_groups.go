@@ -0,0 +1,207 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/flamebearer"
+	"golang.org/x/sync/errgroup"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/util/connectgrpc"
+)
+
+const (
+	defaultGroupByLimit = 10
+	maxGroupByLimit     = 100
+	// groupByConcurrency bounds the number of merge queries of a group by request run in parallel.
+	groupByConcurrency = 8
+	// maxGroupByValuesQueried bounds the number of values queried to find the ones with profiles.
+	maxGroupByValuesQueried = 1000
+)
+
+type flamegraphGroup struct {
+	Labels        map[string]string               `json:"labels"`
+	Flamebearer   *flamebearer.FlamebearerProfile `json:"flamebearer"`
+	Approximation *flamebearerApproximation       `json:"approximation,omitempty"`
+}
+
+type flamegraphGroupsResponse struct {
+	Groups []flamegraphGroup `json:"groups"`
+	// Truncated is true when values with profiles were left out by the limit, or when some values
+	// were not queried.
+	Truncated bool `json:"truncated"`
+}
+
+// FlamegraphHandler merges the profiles matching the query into flamegraphs. With the group_by
+// parameter, it returns one flamegraph per value of the label, up to limit values:
+//
+//	/api/v1/flamegraph?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&from=now-1h&group_by=pod&limit=10
+//
+// The flamegraphs are truncated with the strategy selected by the truncate parameter.
+// The groups are merged with one query each, sent through the given client.
+type FlamegraphHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewFlamegraphHandler(client querierv1connect.QuerierServiceClient) *FlamegraphHandler {
+	return &FlamegraphHandler{client: client}
+}
+
+func (h *FlamegraphHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectParams, profileType, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	truncation, err := parseTruncation(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultGroupByLimit
+	if s := req.Form.Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxGroupByLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxGroupByLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		groupBy = req.Form.Get("group_by")
+		values  = []string{""}
+		resp    = flamegraphGroupsResponse{Groups: []flamegraphGroup{}}
+	)
+	if groupBy != "" {
+		if values, err = h.labelValues(req.Context(), selectParams, groupBy); err != nil {
+			http.Error(w, err.Error(), httpStatusFromConnectError(err))
+			return
+		}
+	}
+
+	// the values are queried in batches, until limit of them have profiles in the time range: the
+	// values without profiles are skipped before the limit applies.
+	var queried int
+	for queried < len(values) && queried < maxGroupByValuesQueried && len(resp.Groups) < limit {
+		n := limit - len(resp.Groups)
+		if n < groupByConcurrency {
+			n = groupByConcurrency
+		}
+		batch := values[queried:]
+		if len(batch) > n {
+			batch = batch[:n]
+		}
+		queried += len(batch)
+		groups, err := h.mergeGroups(req.Context(), selectParams, groupBy, batch)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatusFromConnectError(err))
+			return
+		}
+		for i, res := range groups {
+			fg := res.Flamegraph
+			if groupBy != "" && (fg == nil || fg.Total == 0) {
+				continue
+			}
+			group := flamegraphGroup{
+				Labels:        map[string]string{},
+				Flamebearer:   ExportToFlamebearer(truncation.Truncate(fg), profileType),
+				Approximation: newFlamebearerApproximation(res.Approximation),
+			}
+			if groupBy != "" {
+				group.Labels[groupBy] = batch[i]
+			}
+			resp.Groups = append(resp.Groups, group)
+		}
+	}
+	resp.Truncated = queried < len(values) || len(resp.Groups) > limit
+	if len(resp.Groups) > limit {
+		resp.Groups = resp.Groups[:limit]
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// mergeGroups merges the profiles of each value of the label, with one query each.
+func (h *FlamegraphHandler) mergeGroups(ctx context.Context, selectParams *querierv1.SelectMergeStacktracesRequest, groupBy string, values []string) ([]*querierv1.SelectMergeStacktracesResponse, error) {
+	groups := make([]*querierv1.SelectMergeStacktracesResponse, len(values))
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(groupByConcurrency)
+	for i, value := range values {
+		i, value := i, value
+		g.Go(func() error {
+			params := &querierv1.SelectMergeStacktracesRequest{
+				ProfileTypeID: selectParams.ProfileTypeID,
+				LabelSelector: selectParams.LabelSelector,
+				Start:         selectParams.Start,
+				End:           selectParams.End,
+				Approximate:   selectParams.Approximate,
+			}
+			if groupBy != "" {
+				params.LabelSelector = withMatcher(params.LabelSelector, labels.MustNewMatcher(labels.MatchEqual, groupBy, value))
+			}
+			res, err := h.client.SelectMergeStacktraces(ctx, connect.NewRequest(params))
+			if err != nil {
+				return err
+			}
+			groups[i] = res.Msg
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// labelValues returns the sorted values of the label in the series matching the request.
+// Series without the label are grouped under the empty value.
+func (h *FlamegraphHandler) labelValues(ctx context.Context, params *querierv1.SelectMergeStacktracesRequest, name string) ([]string, error) {
+	selector := withMatcher(params.LabelSelector, labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, params.ProfileTypeID))
+	res, err := h.client.Series(ctx, connect.NewRequest(&querierv1.SeriesRequest{Matchers: []string{selector}}))
+	if err != nil {
+		return nil, err
+	}
+	unique := map[string]struct{}{}
+	for _, ls := range res.Msg.LabelsSet {
+		unique[phlaremodel.Labels(ls.Labels).Get(name)] = struct{}{}
+	}
+	values := make([]string, 0, len(unique))
+	for v := range unique {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// withMatcher adds the matcher to the selector, which has been validated already. The only
+// selector failing to parse is the empty one.
+func withMatcher(selector string, m *labels.Matcher) string {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		matchers = nil
+	}
+	return convertMatchersToString(append(matchers, m))
+}
+
+func httpStatusFromConnectError(err error) int {
+	if code := connect.CodeOf(err); code != connect.CodeUnknown {
+		return int(connectgrpc.CodeToHTTP(code))
+	}
+	return http.StatusInternalServerError
+}
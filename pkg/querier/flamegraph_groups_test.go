@@ -0,0 +1,122 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+type fakeFlamegraphClient struct {
+	querierv1connect.QuerierServiceClient
+	series []*typesv1.Labels
+}
+
+func (c *fakeFlamegraphClient) Series(_ context.Context, _ *connect.Request[querierv1.SeriesRequest]) (*connect.Response[querierv1.SeriesResponse], error) {
+	return connect.NewResponse(&querierv1.SeriesResponse{LabelsSet: c.series}), nil
+}
+
+// SelectMergeStacktraces returns a flamegraph with a total of the length of the pod label value,
+// and no profiles for the pod "empty".
+func (c *fakeFlamegraphClient) SelectMergeStacktraces(_ context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error) {
+	var total int64
+	for _, pod := range []string{"pod-a", "pod-bb", "pod-ccc"} {
+		if strings.Contains(req.Msg.LabelSelector, `pod="`+pod+`"`) {
+			total = int64(len(pod))
+		}
+	}
+	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
+		Flamegraph: &querierv1.FlameGraph{
+			Names:  []string{"total"},
+			Levels: []*querierv1.Level{{Values: []int64{0, total, 0, 0}}},
+			Total:  total,
+		},
+	}), nil
+}
+
+func Test_FlamegraphHandler_GroupBy(t *testing.T) {
+	var series []*typesv1.Labels
+	for _, pod := range []string{"pod-ccc", "pod-a", "empty", "pod-bb"} {
+		series = append(series, &typesv1.Labels{Labels: []*typesv1.LabelPair{{Name: "pod", Value: pod}}})
+	}
+	h := NewFlamegraphHandler(&fakeFlamegraphClient{series: series})
+
+	query := func(t *testing.T, params url.Values) (int, flamegraphGroupsResponse) {
+		t.Helper()
+		params.Set("query", `process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}`)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/flamegraph?"+params.Encode(), nil))
+		var resp flamegraphGroupsResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return rec.Code, resp
+	}
+
+	t.Run("group by pod", func(t *testing.T) {
+		code, resp := query(t, url.Values{"group_by": []string{"pod"}})
+		require.Equal(t, http.StatusOK, code)
+		require.False(t, resp.Truncated)
+		require.Len(t, resp.Groups, 3)
+		for i, pod := range []string{"pod-a", "pod-bb", "pod-ccc"} {
+			require.Equal(t, map[string]string{"pod": pod}, resp.Groups[i].Labels)
+			require.Equal(t, len(pod), resp.Groups[i].Flamebearer.Flamebearer.NumTicks)
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		code, resp := query(t, url.Values{"group_by": []string{"pod"}, "limit": []string{"2"}})
+		require.Equal(t, http.StatusOK, code)
+		require.True(t, resp.Truncated)
+		// "empty" is the first value but has no profiles: it doesn't count against the limit.
+		require.Len(t, resp.Groups, 2)
+		require.Equal(t, map[string]string{"pod": "pod-a"}, resp.Groups[0].Labels)
+		require.Equal(t, map[string]string{"pod": "pod-bb"}, resp.Groups[1].Labels)
+
+		code, resp = query(t, url.Values{"group_by": []string{"pod"}, "limit": []string{"3"}})
+		require.Equal(t, http.StatusOK, code)
+		require.False(t, resp.Truncated)
+		require.Len(t, resp.Groups, 3)
+	})
+
+	t.Run("limit after many values without profiles", func(t *testing.T) {
+		many := append([]*typesv1.Labels{}, series...)
+		for i := 0; i < 3*groupByConcurrency; i++ {
+			many = append(many, &typesv1.Labels{Labels: []*typesv1.LabelPair{{Name: "pod", Value: fmt.Sprintf("empty-%02d", i)}}})
+		}
+		h := NewFlamegraphHandler(&fakeFlamegraphClient{series: many})
+		params := url.Values{"group_by": []string{"pod"}, "limit": []string{"1"}}
+		params.Set("query", `process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}`)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/flamegraph?"+params.Encode(), nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp flamegraphGroupsResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		require.True(t, resp.Truncated)
+		require.Len(t, resp.Groups, 1)
+		require.Equal(t, map[string]string{"pod": "pod-a"}, resp.Groups[0].Labels)
+	})
+
+	t.Run("invalid limit", func(t *testing.T) {
+		code, _ := query(t, url.Values{"group_by": []string{"pod"}, "limit": []string{"0"}})
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("without group by", func(t *testing.T) {
+		code, resp := query(t, url.Values{})
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, resp.Groups, 1)
+		require.Empty(t, resp.Groups[0].Labels)
+	})
+}
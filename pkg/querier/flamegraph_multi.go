@@ -0,0 +1,117 @@
+package querier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/bufbuild/connect-go"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+// maxMultiRequestBytes bounds the size of the body of a multi flamegraph request.
+const maxMultiRequestBytes = 1 << 20
+
+type multiFlamegraphQuery struct {
+	Query       string `json:"query"`
+	From        string `json:"from"`
+	Until       string `json:"until"`
+	Approximate bool   `json:"approx"`
+}
+
+type multiFlamegraphRequest struct {
+	Queries map[string]multiFlamegraphQuery `json:"queries"`
+}
+
+type multiFlamegraphResponse struct {
+	Results map[string]renderResponse `json:"results"`
+}
+
+// MultiFlamegraphHandler merges the profiles of several named queries, each with its own
+// selector and time range, into one flamegraph per query. The queries are sent in the body:
+//
+//	POST /api/v1/flamegraph/multi
+//	{"queries": {"before": {"query": "process_cpu:cpu:nanoseconds:cpu:nanoseconds{}", "from": "now-2h", "until": "now-1h"},
+//	             "after": {"query": "process_cpu:cpu:nanoseconds:cpu:nanoseconds{}", "from": "now-1h"}}}
+//
+// The profiles of all the queries are read once by the ingesters. The flamegraphs are truncated
+// with the strategy selected by the truncate parameter of the URL.
+type MultiFlamegraphHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewMultiFlamegraphHandler(client querierv1connect.QuerierServiceClient) *MultiFlamegraphHandler {
+	return &MultiFlamegraphHandler{client: client}
+}
+
+func (h *MultiFlamegraphHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// the body is decoded before the form is parsed, which would read it with a form content type.
+	var body multiFlamegraphRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxMultiRequestBytes)).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode the request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	truncation, err := parseTruncation(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Queries) == 0 {
+		http.Error(w, "at least one query is required", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		params       = &querierv1.SelectMergeStacktracesMultiRequest{Queries: make(map[string]*querierv1.SelectMergeStacktracesRequest, len(body.Queries))}
+		profileTypes = make(map[string]*typesv1.ProfileType, len(body.Queries))
+	)
+	for name, query := range body.Queries {
+		form := url.Values{"query": []string{query.Query}}
+		if query.From != "" {
+			form.Set("from", query.From)
+		}
+		if query.Until != "" {
+			form.Set("until", query.Until)
+		}
+		if query.Approximate {
+			form.Set("approx", "true")
+		}
+		selectParams, profileType, err := parseSelectProfilesParams(form)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("query %q: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		params.Queries[name] = selectParams
+		profileTypes[name] = profileType
+	}
+
+	res, err := h.client.SelectMergeStacktracesMulti(req.Context(), connect.NewRequest(params))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	resp := multiFlamegraphResponse{Results: make(map[string]renderResponse, len(res.Msg.Results))}
+	for name, result := range res.Msg.Results {
+		fg := result.Flamegraph
+		if fg == nil {
+			fg = &querierv1.FlameGraph{}
+		}
+		resp.Results[name] = renderResponse{
+			FlamebearerProfile: ExportToFlamebearer(truncation.Truncate(fg), profileTypes[name]),
+			Approximation:      newFlamebearerApproximation(result.Approximation),
+		}
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,77 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+)
+
+type fakeMultiFlamegraphClient struct {
+	querierv1connect.QuerierServiceClient
+	req *querierv1.SelectMergeStacktracesMultiRequest
+}
+
+// SelectMergeStacktracesMulti returns a flamegraph per query with a total of the length of its
+// selector.
+func (c *fakeMultiFlamegraphClient) SelectMergeStacktracesMulti(_ context.Context, req *connect.Request[querierv1.SelectMergeStacktracesMultiRequest]) (*connect.Response[querierv1.SelectMergeStacktracesMultiResponse], error) {
+	c.req = req.Msg
+	res := &querierv1.SelectMergeStacktracesMultiResponse{Results: map[string]*querierv1.SelectMergeStacktracesResponse{}}
+	for name, query := range req.Msg.Queries {
+		total := int64(len(query.LabelSelector))
+		res.Results[name] = &querierv1.SelectMergeStacktracesResponse{
+			Flamegraph: &querierv1.FlameGraph{
+				Names:  []string{"total"},
+				Levels: []*querierv1.Level{{Values: []int64{0, total, 0, 0}}},
+				Total:  total,
+			},
+		}
+	}
+	return connect.NewResponse(res), nil
+}
+
+func Test_MultiFlamegraphHandler(t *testing.T) {
+	client := &fakeMultiFlamegraphClient{}
+	h := NewMultiFlamegraphHandler(client)
+
+	query := func(t *testing.T, body string) (int, multiFlamegraphResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/flamegraph/multi", strings.NewReader(body)))
+		var resp multiFlamegraphResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return rec.Code, resp
+	}
+
+	code, resp := query(t, `{"queries": {
+		"before": {"query": "process_cpu:cpu:nanoseconds:cpu:nanoseconds{pod=\"a\"}", "from": "1000", "until": "2000"},
+		"after": {"query": "process_cpu:cpu:nanoseconds:cpu:nanoseconds{pod=\"bb\"}", "from": "now-1h"}
+	}}`)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Results, 2)
+	require.Equal(t, len(`{pod="a"}`), resp.Results["before"].Flamebearer.NumTicks)
+	require.Equal(t, len(`{pod="bb"}`), resp.Results["after"].Flamebearer.NumTicks)
+	// each query has its own time range.
+	require.Equal(t, int64(1000000), client.req.Queries["before"].Start)
+	require.Equal(t, int64(2000000), client.req.Queries["before"].End)
+
+	for _, body := range []string{
+		`{"queries": {}}`,
+		`{"queries": {"a": {"query": "{}"}}}`,
+		`{"queries": {"a": {"query": "process_cpu:cpu:nanoseconds:cpu:nanoseconds{}", "from": "now", "until": "now-1h"}}}`,
+		`not json`,
+	} {
+		code, _ := query(t, body)
+		require.Equal(t, http.StatusBadRequest, code, body)
+	}
+}
@@ -34,6 +34,10 @@ func (q *grpcHandler) Handle(ctx context.Context, req *httpgrpc.HTTPRequest) (*h
 		return connectgrpc.HandleUnary(ctx, req, q.SelectMergeProfile)
 	case "/querier.v1.QuerierService/SelectSeries":
 		return connectgrpc.HandleUnary(ctx, req, q.SelectSeries)
+	case "/querier.v1.QuerierService/SelectMergeStacktracesMulti":
+		return connectgrpc.HandleUnary(ctx, req, q.SelectMergeStacktracesMulti)
+	case "/querier.v1.QuerierService/SelectTargetMetadata":
+		return connectgrpc.HandleUnary(ctx, req, q.SelectTargetMetadata)
 	default:
 		return nil, httpgrpc.Errorf(http.StatusNotFound, "url %s not found", req.Url)
 	}
@@ -47,3 +47,35 @@ func (f *grpcRoundTripper) SelectMergeProfile(ctx context.Context, in *connect.R
 func (f *grpcRoundTripper) SelectSeries(ctx context.Context, in *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
 	return connectgrpc.RoundTripUnary[querierv1.SelectSeriesRequest, querierv1.SelectSeriesResponse](f, ctx, in)
 }
+
+func (f *grpcRoundTripper) SelectHeatmap(ctx context.Context, in *connect.Request[querierv1.SelectHeatmapRequest]) (*connect.Response[querierv1.SelectHeatmapResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectHeatmapRequest, querierv1.SelectHeatmapResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) StorageUsage(ctx context.Context, in *connect.Request[querierv1.StorageUsageRequest]) (*connect.Response[querierv1.StorageUsageResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.StorageUsageRequest, querierv1.StorageUsageResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) SelectProfileIDs(ctx context.Context, in *connect.Request[querierv1.SelectProfileIDsRequest]) (*connect.Response[querierv1.SelectProfileIDsResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectProfileIDsRequest, querierv1.SelectProfileIDsResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) GetProfile(ctx context.Context, in *connect.Request[querierv1.GetProfileRequest]) (*connect.Response[googlev1.Profile], error) {
+	return connectgrpc.RoundTripUnary[querierv1.GetProfileRequest, googlev1.Profile](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) SelectStackSeries(ctx context.Context, in *connect.Request[querierv1.SelectStackSeriesRequest]) (*connect.Response[querierv1.SelectStackSeriesResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectStackSeriesRequest, querierv1.SelectStackSeriesResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) SelectOffCPU(ctx context.Context, in *connect.Request[querierv1.SelectOffCPURequest]) (*connect.Response[querierv1.SelectOffCPUResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectOffCPURequest, querierv1.SelectOffCPUResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) SelectTargetMetadata(ctx context.Context, in *connect.Request[querierv1.SelectTargetMetadataRequest]) (*connect.Response[querierv1.SelectTargetMetadataResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectTargetMetadataRequest, querierv1.SelectTargetMetadataResponse](f, ctx, in)
+}
+
+func (f *grpcRoundTripper) SelectMergeStacktracesMulti(ctx context.Context, in *connect.Request[querierv1.SelectMergeStacktracesMultiRequest]) (*connect.Response[querierv1.SelectMergeStacktracesMultiResponse], error) {
+	return connectgrpc.RoundTripUnary[querierv1.SelectMergeStacktracesMultiRequest, querierv1.SelectMergeStacktracesMultiResponse](f, ctx, in)
+}
@@ -0,0 +1,206 @@
+package querier
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+const bucketLabel = "le"
+
+type stepValue struct {
+	ts    int64
+	value float64
+}
+
+// heatmapStep returns the step of the timestamp: the first step at or after it.
+func heatmapStep(ts, start, step int64) int64 {
+	if d := ts - start; d > 0 {
+		return start + (d+step-1)/step*step
+	}
+	return start
+}
+
+// heatmapSeries counts the profiles of each step, from start to end, by bucket of their total.
+// A profile belongs to the first step at or after its timestamp. When no bounds are given, the
+// bounds are the powers of two between the lowest and the highest totals.
+func heatmapSeries(it iter.Iterator[ProfileValue], start, end, step int64, bounds []float64) []*typesv1.Series {
+	defer it.Close()
+	var values []stepValue
+	for it.Next() {
+		ts := heatmapStep(it.At().Ts, start, step)
+		if ts > end {
+			continue
+		}
+		values = append(values, stepValue{ts: ts, value: it.At().Value})
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if len(bounds) == 0 {
+		lowest, highest := values[0].value, values[0].value
+		for _, v := range values[1:] {
+			lowest = math.Min(lowest, v.value)
+			highest = math.Max(highest, v.value)
+		}
+		bounds = powerOfTwoBounds(lowest, highest)
+	}
+
+	buckets := newHeatmapBuckets(bounds)
+	for _, v := range values {
+		buckets.add(v.ts, v.value, 1)
+	}
+	return buckets.series()
+}
+
+// histogramsHeatmapExact returns whether the heatmap computed from the histograms of the
+// profile totals is the one computed from the profiles: the steps must be made of whole slots
+// of the histograms, and the bounds must not split their buckets.
+func histogramsHeatmapExact(start, step int64, bounds []float64) bool {
+	slot := phlaremodel.HistogramSlot.Milliseconds()
+	if start%slot != 0 || step%slot != 0 {
+		return false
+	}
+	for _, b := range bounds {
+		if !phlaremodel.IsHistogramBucketBound(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// heatmapHistograms is heatmapSeries over the histograms of the profile totals, which must make
+// the heatmap exact.
+func heatmapHistograms(histograms []*ingestv1.Histogram, start, end, step int64, bounds []float64) []*typesv1.Series {
+	kept := histograms[:0]
+	for _, h := range histograms {
+		if h.Count > 0 && heatmapStep(h.Timestamp, start, step) <= end {
+			kept = append(kept, h)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Timestamp < kept[j].Timestamp })
+	if len(bounds) == 0 {
+		lowest, highest := kept[0].Min, kept[0].Max
+		for _, h := range kept[1:] {
+			if h.Min < lowest {
+				lowest = h.Min
+			}
+			if h.Max > highest {
+				highest = h.Max
+			}
+		}
+		bounds = powerOfTwoBounds(float64(lowest), float64(highest))
+	}
+
+	buckets := newHeatmapBuckets(bounds)
+	for _, h := range kept {
+		ts := heatmapStep(h.Timestamp, start, step)
+		// the bounds are positive, the totals lower than or equal to zero are in the first bucket.
+		if h.ZeroCount > 0 {
+			buckets.add(ts, 0, float64(h.ZeroCount))
+		}
+		for _, b := range h.Buckets {
+			buckets.add(ts, phlaremodel.HistogramBucketUpperBound(b.Index), float64(b.Count))
+		}
+	}
+	return buckets.series()
+}
+
+// dedupeHistograms returns the histograms of the ingesters. Each profile is stored by as many
+// ingesters as the replication factor: the replicas of a series holding the same profiles, the
+// histogram of the replica with the most profiles is kept for each series and slot.
+func dedupeHistograms(responses []responseFromIngesters[*ingestv1.SelectHistogramsResponse], replicationFactor int) []*ingestv1.Histogram {
+	var histograms []*ingestv1.Histogram
+	if replicationFactor <= 1 {
+		for _, r := range responses {
+			for _, s := range r.response.Series {
+				histograms = append(histograms, s.Histograms...)
+			}
+		}
+		return histograms
+	}
+	type key struct {
+		fp uint64
+		ts int64
+	}
+	replicas := make(map[key]*ingestv1.Histogram)
+	for _, r := range responses {
+		for _, s := range r.response.Series {
+			for _, h := range s.Histograms {
+				k := key{fp: s.Fingerprint, ts: h.Timestamp}
+				if kept, ok := replicas[k]; !ok || h.Count > kept.Count {
+					replicas[k] = h
+				}
+			}
+		}
+	}
+	histograms = make([]*ingestv1.Histogram, 0, len(replicas))
+	for _, h := range replicas {
+		histograms = append(histograms, h)
+	}
+	return histograms
+}
+
+// heatmapBuckets are the series of the buckets of a heatmap, the last one counting the totals
+// above the highest bound. The counts must be added by increasing timestamp.
+type heatmapBuckets struct {
+	bounds  []float64
+	buckets []*typesv1.Series
+}
+
+func newHeatmapBuckets(bounds []float64) *heatmapBuckets {
+	return &heatmapBuckets{
+		bounds:  bounds,
+		buckets: make([]*typesv1.Series, len(bounds)+1),
+	}
+}
+
+// add counts the totals with the value at the timestamp.
+func (h *heatmapBuckets) add(ts int64, value float64, count float64) {
+	i := sort.SearchFloat64s(h.bounds, value)
+	if h.buckets[i] == nil {
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+		}
+		h.buckets[i] = &typesv1.Series{Labels: []*typesv1.LabelPair{{Name: bucketLabel, Value: le}}}
+	}
+	points := h.buckets[i].Points
+	if len(points) > 0 && points[len(points)-1].Timestamp == ts {
+		points[len(points)-1].Value += count
+		return
+	}
+	h.buckets[i].Points = append(points, &typesv1.Point{Timestamp: ts, Value: count})
+}
+
+func (h *heatmapBuckets) series() []*typesv1.Series {
+	result := make([]*typesv1.Series, 0, len(h.buckets))
+	for _, s := range h.buckets {
+		if s != nil {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// powerOfTwoBounds returns the powers of two from the highest one below the lowest value to the
+// lowest one above the highest value.
+func powerOfTwoBounds(lowest, highest float64) []float64 {
+	var (
+		bound  = math.Exp2(math.Floor(math.Log2(math.Max(lowest, 1))))
+		last   = math.Exp2(math.Ceil(math.Log2(math.Max(highest, 1))))
+		bounds []float64
+	)
+	for ; bound <= last; bound *= 2 {
+		bounds = append(bounds, bound)
+	}
+	return bounds
+}
@@ -0,0 +1,133 @@
+package querier
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/testhelper"
+)
+
+func TestHeatmapSeries(t *testing.T) {
+	in := []ProfileValue{
+		{Ts: 5, Value: 3},
+		{Ts: 10, Value: 1},
+		{Ts: 15, Value: 5},
+		{Ts: 20, Value: 6},
+		{Ts: 31, Value: 100},
+	}
+	bucket := func(le string, points ...*typesv1.Point) *typesv1.Series {
+		return &typesv1.Series{Labels: []*typesv1.LabelPair{{Name: "le", Value: le}}, Points: points}
+	}
+	for _, tc := range []struct {
+		name    string
+		buckets []float64
+		out     []*typesv1.Series
+	}{
+		{
+			name: "power of two buckets",
+			out: []*typesv1.Series{
+				bucket("1", &typesv1.Point{Timestamp: 10, Value: 1}),
+				bucket("4", &typesv1.Point{Timestamp: 10, Value: 1}),
+				bucket("8", &typesv1.Point{Timestamp: 20, Value: 2}),
+			},
+		},
+		{
+			name:    "explicit buckets",
+			buckets: []float64{2, 4},
+			out: []*typesv1.Series{
+				bucket("2", &typesv1.Point{Timestamp: 10, Value: 1}),
+				bucket("4", &typesv1.Point{Timestamp: 10, Value: 1}),
+				bucket("+Inf", &typesv1.Point{Timestamp: 20, Value: 2}),
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := heatmapSeries(iter.NewSliceIterator(in), 10, 30, 10, tc.buckets)
+			testhelper.EqualProto(t, tc.out, out)
+		})
+	}
+}
+
+func TestHeatmapHistograms(t *testing.T) {
+	var (
+		rnd        = rand.New(rand.NewSource(1))
+		slot       = phlaremodel.HistogramSlot.Milliseconds()
+		profiles   []ProfileValue
+		histograms = map[int64]*ingestv1.Histogram{}
+	)
+	for ts := int64(0); ts < 100*slot; ts += 1 + rnd.Int63n(slot/2) {
+		total := rnd.Int63n(1 << uint(rnd.Intn(20)))
+		profiles = append(profiles, ProfileValue{Ts: ts, Value: float64(total)})
+		end := phlaremodel.HistogramSlotEnd(ts)
+		if histograms[end] == nil {
+			histograms[end] = &ingestv1.Histogram{Timestamp: end}
+		}
+		phlaremodel.ObserveHistogram(histograms[end], total)
+	}
+	for _, tc := range []struct {
+		name             string
+		start, end, step int64
+		bounds           []float64
+	}{
+		{name: "power of two buckets", start: 10 * slot, end: 90 * slot, step: 4 * slot},
+		{name: "explicit buckets", start: 0, end: 95 * slot, step: slot, bounds: []float64{1, 64, phlaremodel.HistogramBucketUpperBound(100), 4096}},
+		{name: "unaligned end", start: 2 * slot, end: 61*slot + 7, step: 3 * slot},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.True(t, histogramsHeatmapExact(tc.start, tc.step, tc.bounds))
+			var (
+				selected []ProfileValue
+				hs       []*ingestv1.Histogram
+			)
+			for _, p := range profiles {
+				if p.Ts > tc.start-tc.step && p.Ts <= tc.end {
+					selected = append(selected, p)
+				}
+			}
+			for _, h := range histograms {
+				if h.Timestamp > tc.start-tc.step && h.Timestamp <= tc.end {
+					hs = append(hs, h)
+				}
+			}
+			expected := heatmapSeries(iter.NewSliceIterator(selected), tc.start, tc.end, tc.step, tc.bounds)
+			require.NotEmpty(t, expected)
+			testhelper.EqualProto(t, expected, heatmapHistograms(hs, tc.start, tc.end, tc.step, tc.bounds))
+		})
+	}
+
+	require.False(t, histogramsHeatmapExact(7, slot, nil))
+	require.False(t, histogramsHeatmapExact(0, slot+1, nil))
+	require.False(t, histogramsHeatmapExact(0, slot, []float64{3}))
+}
+
+func TestDedupeHistograms(t *testing.T) {
+	histogram := func(ts int64, count uint64) *ingestv1.Histogram {
+		return &ingestv1.Histogram{Timestamp: ts, Count: count}
+	}
+	responses := []responseFromIngesters[*ingestv1.SelectHistogramsResponse]{
+		{response: &ingestv1.SelectHistogramsResponse{Series: []*ingestv1.SeriesHistograms{
+			{Fingerprint: 1, Histograms: []*ingestv1.Histogram{histogram(15000, 2), histogram(30000, 1)}},
+		}}},
+		// the replica missed a profile, and stores another series.
+		{response: &ingestv1.SelectHistogramsResponse{Series: []*ingestv1.SeriesHistograms{
+			{Fingerprint: 1, Histograms: []*ingestv1.Histogram{histogram(15000, 1), histogram(30000, 1)}},
+			{Fingerprint: 2, Histograms: []*ingestv1.Histogram{histogram(15000, 1)}},
+		}}},
+	}
+	count := func(histograms []*ingestv1.Histogram) (n uint64) {
+		for _, h := range histograms {
+			n += h.Count
+		}
+		return n
+	}
+	require.Equal(t, uint64(6), count(dedupeHistograms(responses, 1)))
+	deduped := dedupeHistograms(responses, 2)
+	require.Len(t, deduped, 3)
+	require.Equal(t, uint64(4), count(deduped))
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/pyroscope-io/pyroscope/pkg/structs/flamebearer"
 	"google.golang.org/grpc/codes"
 
 	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
@@ -79,40 +82,92 @@ func (q *Querier) RenderHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	w.Header().Add("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(ExportToFlamebearer(res.Msg.Flamegraph, profileType)); err != nil {
+	if err := json.NewEncoder(w).Encode(renderResponse{
+		FlamebearerProfile: ExportToFlamebearer(res.Msg.Flamegraph, profileType),
+		Approximation:      newFlamebearerApproximation(res.Msg.Approximation),
+	}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
 
+type renderResponse struct {
+	*flamebearer.FlamebearerProfile
+	Approximation *flamebearerApproximation `json:"approximation,omitempty"`
+}
+
+// flamebearerApproximation is the error bound of a flamegraph of an approximate query.
+type flamebearerApproximation struct {
+	SamplingFraction float64 `json:"samplingFraction"`
+	// ErrorBound is the half-width of the 95% confidence interval of the total, in the units of
+	// the profile.
+	ErrorBound int64 `json:"errorBound"`
+}
+
+func newFlamebearerApproximation(a *querierv1.Approximation) *flamebearerApproximation {
+	if a == nil {
+		return nil
+	}
+	return &flamebearerApproximation{
+		SamplingFraction: a.SamplingFraction,
+		ErrorBound:       a.ErrorBound,
+	}
+}
+
 // render/render?format=json&from=now-12h&until=now&query=pyroscope.server.cpu
 func parseSelectProfilesRequest(req *http.Request) (*querierv1.SelectMergeStacktracesRequest, *typesv1.ProfileType, error) {
-	selector, ptype, err := parseQuery(req)
+	return parseSelectProfilesParams(req.Form)
+}
+
+// parseSelectProfilesParams parses the query, from, until and approx parameters.
+func parseSelectProfilesParams(form url.Values) (*querierv1.SelectMergeStacktracesRequest, *typesv1.ProfileType, error) {
+	selector, ptype, err := parseQuery(form)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// default start and end to now-1h
-	start := model.TimeFromUnixNano(time.Now().Add(-1 * time.Hour).UnixNano())
-	end := model.TimeFromUnixNano(time.Now().UnixNano())
-
-	if from := req.Form.Get("from"); from != "" {
-		from, err := parseRelativeTime(from)
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse from: %w", err)
+	start, end, err := parseTimeRange(form)
+	if err != nil {
+		return nil, nil, err
+	}
+	var approximate bool
+	if approx := form.Get("approx"); approx != "" {
+		if approximate, err = strconv.ParseBool(approx); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse approx: %w", err)
 		}
-		start = end.Add(-from)
 	}
 	return &querierv1.SelectMergeStacktracesRequest{
 		Start:         int64(start),
 		End:           int64(end),
 		LabelSelector: selector,
 		ProfileTypeID: ptype.ID,
+		Approximate:   approximate,
 	}, ptype, nil
 }
 
-func parseQuery(req *http.Request) (string, *typesv1.ProfileType, error) {
-	q := req.Form.Get("query")
+// parseTimeRange parses the from and until parameters, which default to the last hour.
+func parseTimeRange(form url.Values) (start, end model.Time, err error) {
+	now := model.TimeFromUnixNano(time.Now().UnixNano())
+	end = now
+	if until := form.Get("until"); until != "" {
+		if end, err = parseTime(until, now); err != nil {
+			return 0, 0, fmt.Errorf("failed to parse until: %w", err)
+		}
+	}
+	start = end.Add(-1 * time.Hour)
+	if from := form.Get("from"); from != "" {
+		if start, err = parseTime(from, now); err != nil {
+			return 0, 0, fmt.Errorf("failed to parse from: %w", err)
+		}
+	}
+	if start >= end {
+		return 0, 0, fmt.Errorf("from must be before until")
+	}
+	return start, end, nil
+}
+
+func parseQuery(form url.Values) (string, *typesv1.ProfileType, error) {
+	q := form.Get("query")
 	if q == "" {
 		return "", nil, fmt.Errorf("query is required")
 	}
@@ -142,6 +197,26 @@ func parseQuery(req *http.Request) (string, *typesv1.ProfileType, error) {
 	return convertMatchersToString(sel), profileSelector, nil
 }
 
+// parseTime parses the from and until parameters: a time relative to now, e.g. now-1h or 1h, now,
+// or an absolute time in RFC3339 or in Unix seconds.
+func parseTime(s string, now model.Time) (model.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return model.TimeFromUnixNano(t.UnixNano()), nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return model.TimeFromUnix(sec), nil
+	}
+	d, err := parseRelativeTime(s)
+	if err != nil {
+		return 0, err
+	}
+	return now.Add(-d), nil
+}
+
 func parseRelativeTime(s string) (time.Duration, error) {
 	s = strings.TrimSpace(s)
 	s = strings.TrimPrefix(s, "now-")
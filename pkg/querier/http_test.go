@@ -40,3 +40,60 @@ func Test_ParseQuery(t *testing.T) {
 
 	require.Equal(t, `{foo="bar",bar=~"buzz"}`, queryRequest.LabelSelector)
 }
+
+func Test_ParseQueryTimeRange(t *testing.T) {
+	parse := func(t *testing.T, from, until string) (model.Time, model.Time, error) {
+		t.Helper()
+		q := url.Values{"query": []string{`memory:alloc_space:bytes:space:bytes{}`}}
+		if from != "" {
+			q.Set("from", from)
+		}
+		if until != "" {
+			q.Set("until", until)
+		}
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost/render/render?%s", q.Encode()), nil)
+		require.NoError(t, err)
+		require.NoError(t, req.ParseForm())
+		queryRequest, _, err := parseSelectProfilesRequest(req)
+		if err != nil {
+			return 0, 0, err
+		}
+		return model.Time(queryRequest.Start), model.Time(queryRequest.End), nil
+	}
+
+	start, end, err := parse(t, "2023-03-01T10:00:00Z", "1677668400")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2023, 3, 1, 10, 0, 0, 0, time.UTC), start.Time().UTC())
+	require.Equal(t, time.Date(2023, 3, 1, 11, 0, 0, 0, time.UTC), end.Time().UTC())
+
+	// the start defaults to an hour before the end.
+	start, end, err = parse(t, "", "now-2h")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(-2*time.Hour), end.Time(), time.Minute)
+	require.Equal(t, time.Hour, end.Time().Sub(start.Time()))
+
+	_, _, err = parse(t, "now-1h", "now-2h")
+	require.Error(t, err)
+	_, _, err = parse(t, "yesterday", "")
+	require.Error(t, err)
+}
+
+func Test_ParseQueryApproximate(t *testing.T) {
+	q := url.Values{
+		"query":  []string{`memory:alloc_space:bytes:space:bytes{foo="bar"}`},
+		"approx": []string{"true"},
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://localhost/render/render?%s", q.Encode()), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.ParseForm())
+	queryRequest, _, err := parseSelectProfilesRequest(req)
+	require.NoError(t, err)
+	require.True(t, queryRequest.Approximate)
+
+	q.Set("approx", "maybe")
+	req, err = http.NewRequest("GET", fmt.Sprintf("http://localhost/render/render?%s", q.Encode()), nil)
+	require.NoError(t, err)
+	require.NoError(t, req.ParseForm())
+	_, _, err = parseSelectProfilesRequest(req)
+	require.Error(t, err)
+}
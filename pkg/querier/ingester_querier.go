@@ -2,6 +2,9 @@ package querier
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/bufbuild/connect-go"
@@ -10,6 +13,8 @@ import (
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/util"
 )
 
 type IngesterQueryClient interface {
@@ -20,6 +25,13 @@ type IngesterQueryClient interface {
 	MergeProfilesStacktraces(context.Context) clientpool.BidiClientMergeProfilesStacktraces
 	MergeProfilesLabels(ctx context.Context) clientpool.BidiClientMergeProfilesLabels
 	MergeProfilesPprof(ctx context.Context) clientpool.BidiClientMergeProfilesPprof
+	StorageUsage(context.Context, *connect.Request[ingestv1.StorageUsageRequest]) (*connect.Response[ingestv1.StorageUsageResponse], error)
+	SelectProfileIDs(context.Context, *connect.Request[ingestv1.SelectProfileIDsRequest]) (*connect.Response[ingestv1.SelectProfileIDsResponse], error)
+	SelectHistograms(context.Context, *connect.Request[ingestv1.SelectHistogramsRequest]) (*connect.Response[ingestv1.SelectHistogramsResponse], error)
+	SelectTargetMetadata(context.Context, *connect.Request[ingestv1.SelectTargetMetadataRequest]) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error)
+	BlockMetadata(context.Context, *connect.Request[ingestv1.BlockMetadataRequest]) (*connect.Response[ingestv1.BlockMetadataResponse], error)
+	GetProfile(context.Context, *connect.Request[ingestv1.GetProfileRequest]) (*connect.Response[ingestv1.GetProfileResponse], error)
+	Capabilities(context.Context, *connect.Request[ingestv1.CapabilitiesRequest]) (*connect.Response[ingestv1.CapabilitiesResponse], error)
 }
 
 type responseFromIngesters[T interface{}] struct {
@@ -33,36 +45,107 @@ type IngesterFn[T interface{}] func(context.Context, IngesterQueryClient) (T, er
 type IngesterQuerier struct {
 	ring            ring.ReadRing
 	pool            *ring_client.Pool
+	limits          Limits
 	extraQueryDelay time.Duration
+	hedgeAfter      time.Duration
+	capabilities    *clientpool.Capabilities
+	latencies       *instanceLatencies
 }
 
-func NewIngesterQuerier(pool *ring_client.Pool, ring ring.ReadRing, extraQueryDelay time.Duration) *IngesterQuerier {
+func NewIngesterQuerier(pool *ring_client.Pool, ring ring.ReadRing, limits Limits, extraQueryDelay, hedgeAfter time.Duration) *IngesterQuerier {
 	return &IngesterQuerier{
 		ring:            ring,
 		pool:            pool,
+		limits:          limits,
 		extraQueryDelay: extraQueryDelay,
+		hedgeAfter:      hedgeAfter,
+		capabilities:    clientpool.NewCapabilities(pool),
+		latencies:       newInstanceLatencies(),
 	}
 }
 
 // forAllIngesters runs f, in parallel, for all ingesters
 func forAllIngesters[T any](ctx context.Context, q *IngesterQuerier, f IngesterFn[T]) ([]responseFromIngesters[T], error) {
-	replicationSet, err := q.ring.GetReplicationSetForOperation(ring.Read)
+	replicationSet, err := q.readReplicationSet(ctx)
 	if err != nil {
 		return nil, err
 	}
-
 	return forGivenIngesters(ctx, q, replicationSet, f)
 }
 
+// forAllIngestersHedged runs f for the ingesters needed for a quorum, the fastest ones, and for
+// the spare replicas only once the hedging threshold has elapsed without a quorum of responses.
+// The first successful responses forming a quorum are returned, and the others are cancelled, so
+// f must complete the read of the ingester. Without a hedging threshold, or when the replication
+// factor doesn't allow any failure, it's the same as forAllIngesters.
+func forAllIngestersHedged[T any](ctx context.Context, q *IngesterQuerier, f IngesterFn[T]) ([]responseFromIngesters[T], error) {
+	replicationSet, err := q.readReplicationSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if q.hedgeAfter <= 0 || replicationSet.MaxErrors == 0 {
+		return forGivenIngesters(ctx, q, replicationSet, f)
+	}
+	// The requests to the last instances are delayed.
+	replicationSet.Instances = q.latencies.sort(replicationSet.Instances)
+	return doIngesters(ctx, q, replicationSet, q.hedgeAfter, f)
+}
+
+func (q *IngesterQuerier) readReplicationSet(ctx context.Context) (ring.ReplicationSet, error) {
+	replicationSet, err := q.ring.GetReplicationSetForOperation(ring.Read)
+	if err != nil {
+		return ring.ReplicationSet{}, err
+	}
+	// adjust the tolerated failures to the replication factor of the tenant.
+	if tenantID, err := tenant.ExtractTenantIDFromContext(ctx); err == nil {
+		replicationSet, err = util.ReadReplicationSetForTenant(replicationSet, q.ring.ReplicationFactor(), q.limits.IngestionReplicationFactor(tenantID))
+		if err != nil {
+			return ring.ReplicationSet{}, err
+		}
+	}
+	return replicationSet, nil
+}
+
+// supported returns whether all the ingesters queried support the feature, so that it can be
+// used while the ingesters are upgraded.
+func (q *IngesterQuerier) supported(ctx context.Context, feature string) (bool, error) {
+	replicationSet, err := q.readReplicationSet(ctx)
+	if err != nil {
+		return false, err
+	}
+	return q.capabilities.Supported(ctx, replicationSet.Instances, feature), nil
+}
+
+// requireFeature fails with an actionable error when some of the ingesters queried don't
+// support the feature yet.
+func (q *IngesterQuerier) requireFeature(ctx context.Context, feature string) error {
+	ok, err := q.supported(ctx, feature)
+	if err != nil {
+		return connect.NewError(connect.CodeInternal, err)
+	}
+	if !ok {
+		return connect.NewError(connect.CodeFailedPrecondition, fmt.Errorf("the %s feature is not supported by all the ingesters yet: retry once they are upgraded", feature))
+	}
+	return nil
+}
+
 // forGivenIngesters runs f, in parallel, for given ingesters
 func forGivenIngesters[T any](ctx context.Context, q *IngesterQuerier, replicationSet ring.ReplicationSet, f IngesterFn[T]) ([]responseFromIngesters[T], error) {
-	results, err := replicationSet.Do(ctx, q.extraQueryDelay, func(ctx context.Context, ingester *ring.InstanceDesc) (interface{}, error) {
+	return doIngesters(ctx, q, replicationSet, q.extraQueryDelay, f)
+}
+
+// doIngesters runs f for the ingesters, delaying the requests to the last instances which can fail.
+func doIngesters[T any](ctx context.Context, q *IngesterQuerier, replicationSet ring.ReplicationSet, delay time.Duration, f IngesterFn[T]) ([]responseFromIngesters[T], error) {
+	results, err := replicationSet.Do(ctx, delay, func(ctx context.Context, ingester *ring.InstanceDesc) (interface{}, error) {
 		client, err := q.pool.GetClientFor(ingester.Addr)
 		if err != nil {
 			return nil, err
 		}
 
+		start := time.Now()
 		resp, err := f(ctx, client.(IngesterQueryClient))
+		// The requests cancelled once a quorum answered count as slow ones.
+		q.latencies.observe(ingester.Addr, time.Since(start))
 		if err != nil {
 			return nil, err
 		}
@@ -80,3 +163,64 @@ func forGivenIngesters[T any](ctx context.Context, q *IngesterQuerier, replicati
 
 	return responses, err
 }
+
+const (
+	// latencyDecay is the weight of the last latency observed in the moving average of an instance.
+	latencyDecay = 0.3
+	// latencyExpiry is how long the latency of an instance is kept once it's no longer queried.
+	latencyExpiry = time.Hour
+)
+
+// instanceLatencies tracks the moving average of the latency of the ingesters, to send the hedged
+// requests to the fastest ones first.
+type instanceLatencies struct {
+	mtx       sync.Mutex
+	latencies map[string]*instanceLatency
+}
+
+type instanceLatency struct {
+	average  float64
+	lastSeen time.Time
+}
+
+func newInstanceLatencies() *instanceLatencies {
+	return &instanceLatencies{latencies: make(map[string]*instanceLatency)}
+}
+
+func (l *instanceLatencies) observe(addr string, d time.Duration) {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	il, ok := l.latencies[addr]
+	if !ok {
+		l.latencies[addr] = &instanceLatency{average: float64(d), lastSeen: now}
+		return
+	}
+	il.average = latencyDecay*float64(d) + (1-latencyDecay)*il.average
+	il.lastSeen = now
+}
+
+// sort returns a copy of the instances ordered by increasing latency. The instances without
+// latency come first, so that they are measured.
+func (l *instanceLatencies) sort(instances []ring.InstanceDesc) []ring.InstanceDesc {
+	now := time.Now()
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for addr, il := range l.latencies {
+		if now.Sub(il.lastSeen) > latencyExpiry {
+			delete(l.latencies, addr)
+		}
+	}
+	latency := func(addr string) float64 {
+		if il, ok := l.latencies[addr]; ok {
+			return il.average
+		}
+		return 0
+	}
+	sorted := make([]ring.InstanceDesc, len(instances))
+	copy(sorted, instances)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return latency(sorted[i].Addr) < latency(sorted[j].Addr)
+	})
+	return sorted
+}
@@ -0,0 +1,483 @@
+package querier
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/services"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// LabelJoinsConfig configures the labels joined to the series of the query results from external
+// mappings.
+type LabelJoinsConfig struct {
+	Joins           []*LabelJoin  `yaml:"joins" category:"experimental" doc:"description=Labels joined to the series of the query results from an external mapping of the values of another label, e.g. the team owning each pod, so the profiles can be selected and grouped by them even if the agents don't attach them. Each join has a source_label and a target_label, and reads the mapping either from a csv file or URL of two columns, the source and the target values, or from the series of a Prometheus instant query, prometheus_query, sent to prometheus_url."`
+	RefreshInterval time.Duration `yaml:"refresh_interval" category:"experimental"`
+}
+
+// RegisterFlags registers the label joins flags.
+func (cfg *LabelJoinsConfig) RegisterFlags(f *flag.FlagSet) {
+	f.DurationVar(&cfg.RefreshInterval, "querier.label-joins.refresh-interval", 5*time.Minute, "Interval at which the mappings of the label joins are reloaded.")
+}
+
+// Validate validates the label joins.
+func (cfg *LabelJoinsConfig) Validate() error {
+	if len(cfg.Joins) == 0 {
+		return nil
+	}
+	if cfg.RefreshInterval <= 0 {
+		return fmt.Errorf("label joins refresh interval must be positive")
+	}
+	targets := map[string]struct{}{}
+	for i, j := range cfg.Joins {
+		if err := j.validate(); err != nil {
+			return fmt.Errorf("label join %d: %w", i, err)
+		}
+		if _, ok := targets[j.TargetLabel]; ok {
+			return fmt.Errorf("label join %d: target label %q is joined more than once", i, j.TargetLabel)
+		}
+		targets[j.TargetLabel] = struct{}{}
+	}
+	for i, j := range cfg.Joins {
+		if _, ok := targets[j.SourceLabel]; ok {
+			return fmt.Errorf("label join %d: source label %q is the target label of a join", i, j.SourceLabel)
+		}
+	}
+	return nil
+}
+
+// LabelJoin joins the target label to the series from a mapping of the values of their source
+// label.
+type LabelJoin struct {
+	// SourceLabel is the label of the series whose values are mapped, e.g. pod.
+	SourceLabel string `yaml:"source_label"`
+	// TargetLabel is the label joined, e.g. team.
+	TargetLabel string `yaml:"target_label"`
+	// CSV is the path or the http(s) URL, e.g. of an object storage bucket, of a CSV file of two
+	// columns: the value of the source label and the value of the target label.
+	CSV string `yaml:"csv,omitempty"`
+	// PrometheusURL and PrometheusQuery select the Prometheus series mapping the values, by
+	// their labels named as the source and the target labels.
+	PrometheusURL   string `yaml:"prometheus_url,omitempty"`
+	PrometheusQuery string `yaml:"prometheus_query,omitempty"`
+}
+
+func (j *LabelJoin) validate() error {
+	for _, name := range []string{j.SourceLabel, j.TargetLabel} {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if j.SourceLabel == j.TargetLabel {
+		return fmt.Errorf("source and target labels must differ")
+	}
+	switch {
+	case j.CSV != "" && (j.PrometheusURL != "" || j.PrometheusQuery != ""):
+		return fmt.Errorf("either csv or prometheus_url must be set, not both")
+	case j.CSV == "" && (j.PrometheusURL == "" || j.PrometheusQuery == ""):
+		return fmt.Errorf("csv, or prometheus_url and prometheus_query are required")
+	}
+	return nil
+}
+
+// load reads the mapping of the values of the source label to the values of the target label.
+func (j *LabelJoin) load(ctx context.Context, client *http.Client) (map[string]string, error) {
+	if j.CSV != "" {
+		return j.loadCSV(ctx, client)
+	}
+	return j.loadPrometheus(ctx, client)
+}
+
+func (j *LabelJoin) loadCSV(ctx context.Context, client *http.Client) (map[string]string, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(j.CSV, "http://") || strings.HasPrefix(j.CSV, "https://") {
+		body, err := httpGet(ctx, client, j.CSV)
+		if err != nil {
+			return nil, err
+		}
+		r = body
+	} else {
+		f, err := os.Open(j.CSV)
+		if err != nil {
+			return nil, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 2
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	mapping := make(map[string]string, len(records))
+	for i, record := range records {
+		// the header naming the labels is optional.
+		if i == 0 && record[0] == j.SourceLabel && record[1] == j.TargetLabel {
+			continue
+		}
+		if record[0] != "" && record[1] != "" {
+			mapping[record[0]] = record[1]
+		}
+	}
+	return mapping, nil
+}
+
+type prometheusQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (j *LabelJoin) loadPrometheus(ctx context.Context, client *http.Client) (map[string]string, error) {
+	u, err := url.Parse(strings.TrimSuffix(j.PrometheusURL, "/") + "/api/v1/query")
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"query": {j.PrometheusQuery}}.Encode()
+	body, err := httpGet(ctx, client, u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	var resp prometheusQueryResponse
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Status != "success" {
+		return nil, fmt.Errorf("prometheus query failed: %s", resp.Error)
+	}
+	if resp.Data.ResultType != "vector" {
+		return nil, fmt.Errorf("prometheus query must return a vector, got %s", resp.Data.ResultType)
+	}
+	mapping := make(map[string]string, len(resp.Data.Result))
+	for _, r := range resp.Data.Result {
+		source, target := r.Metric[j.SourceLabel], r.Metric[j.TargetLabel]
+		if source != "" && target != "" {
+			mapping[source] = target
+		}
+	}
+	return mapping, nil
+}
+
+func httpGet(ctx context.Context, client *http.Client, u string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, req.URL.Redacted())
+	}
+	return resp.Body, nil
+}
+
+// joinSelector rewrites the matchers of the joined labels of the selector of a query.
+func (q *Querier) joinSelector(selector string) (string, error) {
+	rewritten, err := q.joins.rewriteSelector(selector)
+	if err != nil {
+		return "", connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	return rewritten, nil
+}
+
+// labelJoiner joins the labels of the label joins to the query results. It rewrites the
+// matchers of the joined labels of the queries into matchers of their source labels, and adds
+// the joined labels to the series returned.
+type labelJoiner struct {
+	services.Service
+
+	joins  []*LabelJoin
+	client *http.Client
+	logger log.Logger
+
+	mtx      sync.RWMutex
+	mappings []map[string]string // by join, nil until loaded.
+}
+
+func newLabelJoiner(cfg LabelJoinsConfig, logger log.Logger) *labelJoiner {
+	j := &labelJoiner{
+		joins:    cfg.Joins,
+		client:   &http.Client{Timeout: time.Minute},
+		logger:   logger,
+		mappings: make([]map[string]string, len(cfg.Joins)),
+	}
+	if len(cfg.Joins) == 0 {
+		j.Service = services.NewIdleService(nil, nil)
+		return j
+	}
+	j.Service = services.NewTimerService(cfg.RefreshInterval, j.refresh, j.refresh, nil)
+	return j
+}
+
+// refresh reloads the mappings. The mappings failing to load are kept as they were, so an
+// unavailable source doesn't fail the queries.
+func (j *labelJoiner) refresh(ctx context.Context) error {
+	for i, join := range j.joins {
+		mapping, err := join.load(ctx, j.client)
+		if err != nil {
+			level.Warn(j.logger).Log("msg", "failed to load label join", "source_label", join.SourceLabel, "target_label", join.TargetLabel, "err", err)
+			continue
+		}
+		j.mtx.Lock()
+		j.mappings[i] = mapping
+		j.mtx.Unlock()
+	}
+	return nil
+}
+
+func (j *labelJoiner) mapping(i int) map[string]string {
+	j.mtx.RLock()
+	defer j.mtx.RUnlock()
+	return j.mappings[i]
+}
+
+// join returns the index of the join of the target label, or -1.
+func (j *labelJoiner) join(target string) int {
+	for i, join := range j.joins {
+		if join.TargetLabel == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// rewriteSelector replaces the matchers of the joined labels of the selector by matchers of the
+// values of their source label.
+func (j *labelJoiner) rewriteSelector(selector string) (string, error) {
+	if len(j.joins) == 0 || selector == "" {
+		return selector, nil
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return "", err
+	}
+	rewritten := make([]*labels.Matcher, 0, len(matchers))
+	changed := false
+	for _, m := range matchers {
+		i := j.join(m.Name)
+		if i < 0 {
+			rewritten = append(rewritten, m)
+			continue
+		}
+		changed = true
+		rewritten = append(rewritten, j.rewriteMatcher(i, m)...)
+	}
+	if !changed {
+		return selector, nil
+	}
+	return convertMatchersToString(rewritten), nil
+}
+
+// rewriteMatcher returns the matchers of the values of the source label of the join whose
+// mapped value matches m. The values not mapped match as the empty value.
+func (j *labelJoiner) rewriteMatcher(i int, m *labels.Matcher) []*labels.Matcher {
+	var (
+		source   = j.joins[i].SourceLabel
+		mapping  = j.mapping(i)
+		matchAll = m.Matches("")
+		values   []string
+	)
+	for s, t := range mapping {
+		// with matchAll, the values excluded are collected, otherwise the values included.
+		if m.Matches(t) != matchAll {
+			values = append(values, regexp.QuoteMeta(s))
+		}
+	}
+	sort.Strings(values)
+	switch {
+	case matchAll && len(values) == 0:
+		return nil
+	case matchAll:
+		return []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, source, strings.Join(values, "|"))}
+	case len(values) == 0:
+		// no value matches.
+		return []*labels.Matcher{
+			labels.MustNewMatcher(labels.MatchEqual, source, ""),
+			labels.MustNewMatcher(labels.MatchNotEqual, source, ""),
+		}
+	default:
+		return []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, source, strings.Join(values, "|"))}
+	}
+}
+
+// joinLabels adds the joined labels to the labels of a series, unless it has them already.
+func (j *labelJoiner) joinLabels(ls []*typesv1.LabelPair) []*typesv1.LabelPair {
+	if len(j.joins) == 0 {
+		return ls
+	}
+	added := false
+	for i, join := range j.joins {
+		source := phlaremodel.Labels(ls).Get(join.SourceLabel)
+		if source == "" || phlaremodel.Labels(ls).Get(join.TargetLabel) != "" {
+			continue
+		}
+		if target := j.mapping(i)[source]; target != "" {
+			ls = append(ls, &typesv1.LabelPair{Name: join.TargetLabel, Value: target})
+			added = true
+		}
+	}
+	if added {
+		sort.Sort(phlaremodel.Labels(ls))
+	}
+	return ls
+}
+
+// labelNames adds the joined labels to the label names which include their source label.
+func (j *labelJoiner) labelNames(names []string) []string {
+	if len(j.joins) == 0 {
+		return names
+	}
+	unique := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		unique[n] = struct{}{}
+	}
+	for _, join := range j.joins {
+		if _, ok := unique[join.SourceLabel]; ok {
+			unique[join.TargetLabel] = struct{}{}
+		}
+	}
+	if len(unique) == len(names) {
+		return names
+	}
+	result := make([]string, 0, len(unique))
+	for n := range unique {
+		result = append(result, n)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// labelValues returns the sorted joined values of the values of the source label of the join.
+func (j *labelJoiner) labelValues(i int, sourceValues []string) []string {
+	mapping := j.mapping(i)
+	unique := map[string]struct{}{}
+	for _, s := range sourceValues {
+		if t := mapping[s]; t != "" {
+			unique[t] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(unique))
+	for v := range unique {
+		result = append(result, v)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// groupBy returns the labels the ingesters group the series by for the requested labels: the
+// joined labels are replaced by their source label.
+func (j *labelJoiner) groupBy(by []string) []string {
+	if len(j.joins) == 0 {
+		return by
+	}
+	unique := make(map[string]struct{}, len(by))
+	for _, name := range by {
+		if i := j.join(name); i >= 0 {
+			name = j.joins[i].SourceLabel
+		}
+		unique[name] = struct{}{}
+	}
+	result := make([]string, 0, len(unique))
+	for name := range unique {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// joinSeries regroups the series grouped by the ingesters by the labels returned by groupBy,
+// by the requested labels. The values of the series joined to the same labels are summed.
+func (j *labelJoiner) joinSeries(series []*typesv1.Series, by []string) []*typesv1.Series {
+	joined := false
+	for _, name := range by {
+		if j.join(name) >= 0 {
+			joined = true
+			break
+		}
+	}
+	if !joined {
+		return series
+	}
+	byLabels := make(map[uint64]*typesv1.Series, len(series))
+	for _, s := range series {
+		ls := make([]*typesv1.LabelPair, 0, len(by))
+		for _, name := range by {
+			var value string
+			if i := j.join(name); i >= 0 {
+				value = j.mapping(i)[phlaremodel.Labels(s.Labels).Get(j.joins[i].SourceLabel)]
+			} else {
+				value = phlaremodel.Labels(s.Labels).Get(name)
+			}
+			if value != "" {
+				ls = append(ls, &typesv1.LabelPair{Name: name, Value: value})
+			}
+		}
+		sort.Sort(phlaremodel.Labels(ls))
+		h := phlaremodel.Labels(ls).Hash()
+		existing, ok := byLabels[h]
+		if !ok {
+			byLabels[h] = &typesv1.Series{Labels: ls, Points: s.Points}
+			continue
+		}
+		existing.Points = sumPoints(existing.Points, s.Points)
+	}
+	result := make([]*typesv1.Series, 0, len(byLabels))
+	for _, s := range byLabels {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	return result
+}
+
+// sumPoints merges the points sorted by timestamp, summing the values of the same timestamp.
+func sumPoints(a, b []*typesv1.Point) []*typesv1.Point {
+	result := make([]*typesv1.Point, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].Timestamp < b[0].Timestamp:
+			result, a = append(result, a[0]), a[1:]
+		case a[0].Timestamp > b[0].Timestamp:
+			result, b = append(result, b[0]), b[1:]
+		default:
+			result = append(result, &typesv1.Point{Timestamp: a[0].Timestamp, Value: a[0].Value + b[0].Value})
+			a, b = a[1:], b[1:]
+		}
+	}
+	result = append(result, a...)
+	return append(result, b...)
+}
@@ -0,0 +1,123 @@
+package querier
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/stretchr/testify/require"
+
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+func newTestLabelJoiner(t *testing.T) *labelJoiner {
+	t.Helper()
+	csvFile := filepath.Join(t.TempDir(), "teams.csv")
+	require.NoError(t, os.WriteFile(csvFile, []byte("pod,team\n# comment\npod-a,checkout\npod-b,checkout\npod-c,search\n"), 0o644))
+	cfg := LabelJoinsConfig{
+		Joins:           []*LabelJoin{{SourceLabel: "pod", TargetLabel: "team", CSV: csvFile}},
+		RefreshInterval: time.Minute,
+	}
+	require.NoError(t, cfg.Validate())
+	j := newLabelJoiner(cfg, log.NewNopLogger())
+	require.NoError(t, j.refresh(context.Background()))
+	return j
+}
+
+func TestLabelJoinsValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		joins []*LabelJoin
+		err   string
+	}{
+		{name: "no source", joins: []*LabelJoin{{SourceLabel: "pod", TargetLabel: "team"}}, err: "csv, or prometheus_url and prometheus_query are required"},
+		{name: "both sources", joins: []*LabelJoin{{SourceLabel: "pod", TargetLabel: "team", CSV: "teams.csv", PrometheusURL: "http://prometheus"}}, err: "not both"},
+		{name: "reserved label", joins: []*LabelJoin{{SourceLabel: "pod", TargetLabel: "__name__", CSV: "teams.csv"}}, err: "invalid label name"},
+		{name: "chained", joins: []*LabelJoin{
+			{SourceLabel: "pod", TargetLabel: "team", CSV: "teams.csv"},
+			{SourceLabel: "team", TargetLabel: "org", CSV: "orgs.csv"},
+		}, err: "is the target label of a join"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := LabelJoinsConfig{Joins: tc.joins, RefreshInterval: time.Minute}
+			require.ErrorContains(t, cfg.Validate(), tc.err)
+		})
+	}
+}
+
+func TestLabelJoinerRewriteSelector(t *testing.T) {
+	j := newTestLabelJoiner(t)
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{`{namespace="prod"}`, `{namespace="prod"}`},
+		{`{team="checkout"}`, `{pod=~"pod-a|pod-b"}`},
+		{`{namespace="prod",team=~"check.*|search"}`, `{namespace="prod",pod=~"pod-a|pod-b|pod-c"}`},
+		{`{team!="checkout"}`, `{pod!~"pod-a|pod-b"}`},
+		{`{team=""}`, `{pod!~"pod-a|pod-b|pod-c"}`},
+		{`{team=~".*"}`, `{}`},
+		{`{team="unknown"}`, `{pod="",pod!=""}`},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			out, err := j.rewriteSelector(tc.in)
+			require.NoError(t, err)
+			require.Equal(t, tc.out, out)
+		})
+	}
+}
+
+func TestLabelJoinerLabels(t *testing.T) {
+	j := newTestLabelJoiner(t)
+	require.Equal(t, []*typesv1.LabelPair{
+		{Name: "namespace", Value: "prod"},
+		{Name: "pod", Value: "pod-a"},
+		{Name: "team", Value: "checkout"},
+	}, j.joinLabels([]*typesv1.LabelPair{{Name: "namespace", Value: "prod"}, {Name: "pod", Value: "pod-a"}}))
+	// the labels attached by the agents are kept.
+	require.Equal(t, []*typesv1.LabelPair{
+		{Name: "pod", Value: "pod-a"},
+		{Name: "team", Value: "ads"},
+	}, j.joinLabels([]*typesv1.LabelPair{{Name: "pod", Value: "pod-a"}, {Name: "team", Value: "ads"}}))
+
+	require.Equal(t, []string{"namespace", "pod", "team"}, j.labelNames([]string{"namespace", "pod"}))
+	require.Equal(t, []string{"namespace"}, j.labelNames([]string{"namespace"}))
+	require.Equal(t, []string{"checkout", "search"}, j.labelValues(0, []string{"pod-a", "pod-b", "pod-c", "pod-d"}))
+}
+
+func TestLabelJoinerJoinSeries(t *testing.T) {
+	j := newTestLabelJoiner(t)
+	require.Equal(t, []string{"namespace", "pod"}, j.groupBy([]string{"namespace", "team"}))
+	series := []*typesv1.Series{
+		{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "pod-a"}}, Points: []*typesv1.Point{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}},
+		{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "pod-b"}}, Points: []*typesv1.Point{{Timestamp: 2, Value: 3}, {Timestamp: 3, Value: 4}}},
+		{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "pod-c"}}, Points: []*typesv1.Point{{Timestamp: 1, Value: 5}}},
+		{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "pod-d"}}, Points: []*typesv1.Point{{Timestamp: 1, Value: 6}}},
+	}
+	require.Equal(t, []*typesv1.Series{
+		{Labels: []*typesv1.LabelPair{}, Points: []*typesv1.Point{{Timestamp: 1, Value: 6}}},
+		{Labels: []*typesv1.LabelPair{{Name: "team", Value: "checkout"}}, Points: []*typesv1.Point{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 5}, {Timestamp: 3, Value: 4}}},
+		{Labels: []*typesv1.LabelPair{{Name: "team", Value: "search"}}, Points: []*typesv1.Point{{Timestamp: 1, Value: 5}}},
+	}, j.joinSeries(series, []string{"team"}))
+}
+
+func TestLabelJoinPrometheus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v1/query", r.URL.Path)
+		require.Equal(t, "kube_pod_labels", r.URL.Query().Get("query"))
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[
+			{"metric":{"pod":"pod-a","label_team":"checkout"},"value":[1,"1"]},
+			{"metric":{"pod":"pod-b"},"value":[1,"1"]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	join := &LabelJoin{SourceLabel: "pod", TargetLabel: "label_team", PrometheusURL: server.URL, PrometheusQuery: "kube_pod_labels"}
+	mapping, err := join.load(context.Background(), server.Client())
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"pod-a": "checkout"}, mapping)
+}
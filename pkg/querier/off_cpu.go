@@ -0,0 +1,123 @@
+package querier
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/common/model"
+	"golang.org/x/sync/errgroup"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+const (
+	defaultOnCPUProfileTypeID = "process_cpu:cpu:nanoseconds:cpu:nanoseconds"
+	// defaultWallProfileTypeID is the profile type of the wall-clock profiles of fgprof.
+	defaultWallProfileTypeID = "fgprof:time:nanoseconds:wallclock:nanoseconds"
+)
+
+// SelectOffCPU overlays the on-CPU and the wall-clock profiles of the same selector: the off-CPU
+// time of a stacktrace is approximated by its wall-clock time minus its on-CPU time, the time
+// spent waiting. The two profile types are sampled independently, so the subtraction is only as
+// accurate as their sampling.
+func (q *Querier) SelectOffCPU(ctx context.Context, req *connect.Request[querierv1.SelectOffCPURequest]) (*connect.Response[querierv1.SelectOffCPUResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectOffCPU")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("selector", req.Msg.LabelSelector),
+			otlog.String("on_cpu_profile_id", req.Msg.OnCpuProfileTypeID),
+			otlog.String("wall_profile_id", req.Msg.WallProfileTypeID),
+		)
+		sp.Finish()
+	}()
+
+	if req.Msg.OnCpuProfileTypeID == "" {
+		req.Msg.OnCpuProfileTypeID = defaultOnCPUProfileTypeID
+	}
+	if req.Msg.WallProfileTypeID == "" {
+		req.Msg.WallProfileTypeID = defaultWallProfileTypeID
+	}
+	onCPUType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.OnCpuProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	wallType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.WallProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if onCPUType.SampleUnit != wallType.SampleUnit {
+		return nil, connect.NewError(connect.CodeInvalidArgument,
+			fmt.Errorf("the on-CPU and wall-clock profile types have different units: %s and %s", onCPUType.SampleUnit, wallType.SampleUnit))
+	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
+
+	var onCPU, wall []stacktraces
+	g, gCtx := errgroup.WithContext(ctx)
+	selectStacktraces := func(t *typesv1.ProfileType, result *[]stacktraces) {
+		g.Go(func() error {
+			st, _, err := q.selectStacktraces(gCtx, &ingestv1.SelectProfilesRequest{
+				LabelSelector: req.Msg.LabelSelector,
+				Start:         req.Msg.Start,
+				End:           req.Msg.End,
+				Type:          t,
+			}, 0)
+			*result = st
+			return err
+		})
+	}
+	selectStacktraces(onCPUType, &onCPU)
+	selectStacktraces(wallType, &wall)
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&querierv1.SelectOffCPUResponse{
+		OnCpu:  NewFlameGraph(newTree(onCPU)),
+		OffCpu: NewFlameGraph(newTree(offCPUStacktraces(onCPU, wall))),
+	}), nil
+}
+
+// offCPUStacktraces approximates the wall-clock time of the stacktraces not spent on-CPU. The
+// profilers sample the time independently, so the on-CPU time of a stacktrace can exceed its
+// wall-clock time: the off-CPU time is then zero.
+func offCPUStacktraces(onCPU, wall []stacktraces) []stacktraces {
+	onCPUValues := make(map[string]int64, len(onCPU))
+	for _, st := range onCPU {
+		onCPUValues[stacktraceKey(st.locations)] += st.value
+	}
+	var (
+		result    = make([]stacktraces, 0, len(wall))
+		wallIndex = make(map[string]int, len(wall))
+	)
+	for _, st := range wall {
+		k := stacktraceKey(st.locations)
+		if i, ok := wallIndex[k]; ok {
+			result[i].value += st.value
+			continue
+		}
+		wallIndex[k] = len(result)
+		result = append(result, stacktraces{locations: st.locations, value: st.value})
+	}
+	for i := range result {
+		result[i].value -= onCPUValues[stacktraceKey(result[i].locations)]
+		if result[i].value < 0 {
+			result[i].value = 0
+		}
+	}
+	return result
+}
+
+func stacktraceKey(locations []string) string {
+	return strings.Join(locations, "\x00")
+}
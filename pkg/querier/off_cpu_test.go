@@ -0,0 +1,27 @@
+package querier
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffCPUStacktraces(t *testing.T) {
+	onCPU := []stacktraces{
+		{locations: []string{"compute", "main"}, value: 30},
+		{locations: []string{"read", "main"}, value: 5},
+		{locations: []string{"gc", "runtime"}, value: 10},
+	}
+	wall := []stacktraces{
+		{locations: []string{"compute", "main"}, value: 20},
+		{locations: []string{"read", "main"}, value: 60},
+		{locations: []string{"sleep", "main"}, value: 100},
+		{locations: []string{"read", "main"}, value: 15},
+	}
+	require.Equal(t, []stacktraces{
+		// the on-CPU time sampled above the wall-clock time.
+		{locations: []string{"compute", "main"}, value: 0},
+		{locations: []string{"read", "main"}, value: 70},
+		{locations: []string{"sleep", "main"}, value: 100},
+	}, offCPUStacktraces(onCPU, wall))
+}
@@ -0,0 +1,136 @@
+package querier
+
+import (
+	"github.com/grafana/phlare/pkg/arrow"
+	"github.com/grafana/phlare/pkg/openapi"
+)
+
+// The documentation of the HTTP endpoints of the querier in the OpenAPI document, the method and
+// path of each being set where it is registered.
+var (
+	ProfileTypesDoc = openapi.Route{
+		Summary:  "Lists the profile types ingested.",
+		Response: jsonContent(apiProfileTypesResponse{}),
+	}
+	LabelsDoc = openapi.Route{
+		Summary:  "Lists the label names.",
+		Response: jsonContent(apiNamesResponse{}),
+	}
+	LabelValuesDoc = openapi.Route{
+		Summary:    "Lists the values of a label.",
+		Parameters: []openapi.Parameter{{Name: "name", In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}}},
+		Response:   jsonContent(apiValuesResponse{}),
+	}
+	QueryDoc = openapi.Route{
+		Summary: "Returns the time series of the totals of the profiles matching the query.",
+		Parameters: append(selectParameters(),
+			stringParameter("step", "The step of the series, for example 1m. Defaults to 15s."),
+			openapi.Parameter{Name: "group_by", In: "query", Description: "A label to aggregate the series by, repeatable.", Schema: &openapi.Schema{Type: "array", Items: &openapi.Schema{Type: "string"}}},
+		),
+		Response: jsonContent(apiQueryResponse{}),
+	}
+	FlamegraphDoc = openapi.Route{
+		Summary:     "Merges the profiles matching the query into flamegraphs.",
+		Description: "With the group_by parameter, one flamegraph is returned per value of the label, up to limit values.",
+		Parameters: append(selectParameters(),
+			stringParameter("group_by", "The label to split the flamegraphs by."),
+			openapi.Parameter{Name: "limit", In: "query", Description: "The maximum number of groups, defaults to 10.", Schema: &openapi.Schema{Type: "integer", Format: "int32"}},
+			openapi.Parameter{Name: "truncate", In: "query", Description: "The truncation strategy of the flamegraphs.", Schema: &openapi.Schema{Type: "string", Enum: []string{truncateCollapseUnderOther, truncateMinValueFraction, truncateTopKPerDepth}}},
+			openapi.Parameter{Name: "max_nodes", In: "query", Description: "The number of nodes kept by the collapse_under_other strategy.", Schema: &openapi.Schema{Type: "integer", Format: "int32"}},
+			openapi.Parameter{Name: "min_value_fraction", In: "query", Description: "The fraction of the total of the nodes kept by the min_value_fraction strategy.", Schema: &openapi.Schema{Type: "number", Format: "double"}},
+			openapi.Parameter{Name: "top_k", In: "query", Description: "The number of nodes of each depth kept by the top_k_per_depth strategy.", Schema: &openapi.Schema{Type: "integer", Format: "int32"}},
+		),
+		Response: jsonContent(flamegraphGroupsResponse{}),
+	}
+	MultiFlamegraphDoc = openapi.Route{
+		Summary:     "Merges the profiles matching each of the queries of the body into a flamegraph per query.",
+		Description: "Each query has its own selector and time range. The profiles of all the queries are read once.",
+		Parameters: []openapi.Parameter{
+			{Name: "truncate", In: "query", Description: "The truncation strategy of the flamegraphs.", Schema: &openapi.Schema{Type: "string", Enum: []string{truncateCollapseUnderOther, truncateMinValueFraction, truncateTopKPerDepth}}},
+			{Name: "max_nodes", In: "query", Description: "The number of nodes kept by the collapse_under_other strategy.", Schema: &openapi.Schema{Type: "integer", Format: "int32"}},
+		},
+		RequestBody: jsonContent(multiFlamegraphRequest{}),
+		Response:    jsonContent(multiFlamegraphResponse{}),
+	}
+	PprofDoc = openapi.Route{
+		Summary:    "Exports the merge of the profiles matching the query in the pprof format.",
+		Parameters: selectParameters(),
+		Response:   map[string]*openapi.Schema{"application/octet-stream": {Type: "string", Format: "binary"}},
+	}
+	BaselineDiffDoc = openapi.Route{
+		Summary:     "Compares the merge of the profiles matching the query to a baseline.",
+		Description: "The flamegraph is in the diff format, the baseline being the left side.",
+		Parameters: append(selectParameters(),
+			openapi.Parameter{Name: "baseline", In: "query", Required: true, Description: "The name of the baseline.", Schema: &openapi.Schema{Type: "string"}},
+			openapi.Parameter{Name: "max_nodes", In: "query", Description: "The maximum number of nodes of the flamegraph, defaults to 1024.", Schema: &openapi.Schema{Type: "integer", Format: "int32"}},
+		),
+		Response: jsonContent(baselineDiffResponse{}),
+	}
+	ListBaselinesDoc = openapi.Route{
+		Summary:  "Lists the baselines.",
+		Response: jsonContent(baselinesResponse{}),
+	}
+	GetBaselineDoc = openapi.Route{
+		Summary:    "Returns a baseline with its flamegraph.",
+		Parameters: []openapi.Parameter{baselineNameParameter},
+		Response:   jsonContent(baselineResponse{}),
+	}
+	CreateBaselineDoc = openapi.Route{
+		Summary:     "Stores the merge of the profiles matching the query as a baseline.",
+		Description: "The baseline of the same name is replaced.",
+		Parameters:  append([]openapi.Parameter{baselineNameParameter}, selectParameters()...),
+		Response:    jsonContent(Baseline{}),
+	}
+	DeleteBaselineDoc = openapi.Route{
+		Summary:    "Removes a baseline.",
+		Parameters: []openapi.Parameter{baselineNameParameter},
+	}
+	TargetMetadataDoc = openapi.Route{
+		Summary:     "Returns the metadata of the targets of the matching series, such as their build version.",
+		Description: "Each value has the time range it was seen in. The metadata is sent by the agent when it is enabled in its scrape configs.",
+		Parameters: []openapi.Parameter{
+			stringParameter("selector", `The label selector of the series, for example {namespace="prod"}. Defaults to all the series.`),
+			stringParameter("match", `The selector of the metadata the targets must have, for example {build_version="v1.2.3"}.`),
+			stringParameter("from", "The start of the query, relative to now, for example now-1h, or in RFC3339 or Unix seconds. Defaults to an hour before until."),
+			stringParameter("until", "The end of the query, in the formats of from. Defaults to now."),
+		},
+		Response: jsonContent(targetMetadataResponse{}),
+	}
+	SQLDoc = openapi.Route{
+		Summary: "Runs a SQL query over the samples of the profiles.",
+		Tag:     "experimental",
+		Parameters: []openapi.Parameter{
+			{Name: "query", In: "query", Required: true, Description: "The SQL query.", Schema: &openapi.Schema{Type: "string"}},
+			stringParameter("from", "The start of the query relative to now, for example now-1h. Defaults to now-1h."),
+		},
+		Response: jsonContent(sqlResponse{}),
+	}
+	ArrowDoc = openapi.Route{
+		Summary: "Exports the time series of the profiles matching the query in the Arrow IPC format.",
+		Tag:     "experimental",
+		Parameters: append(selectParameters(),
+			stringParameter("step", "The step of the series, for example 1m."),
+		),
+		Response: map[string]*openapi.Schema{arrow.ContentType: {Type: "string", Format: "binary"}},
+	}
+)
+
+var baselineNameParameter = openapi.Parameter{Name: "name", In: "path", Required: true, Description: "The name of the baseline.", Schema: &openapi.Schema{Type: "string"}}
+
+func jsonContent(v interface{}) map[string]*openapi.Schema {
+	return map[string]*openapi.Schema{"application/json": openapi.SchemaOf(v)}
+}
+
+func stringParameter(name, description string) openapi.Parameter {
+	return openapi.Parameter{Name: name, In: "query", Description: description, Schema: &openapi.Schema{Type: "string"}}
+}
+
+// selectParameters are the parameters selecting the profiles, parsed by parseSelectProfilesRequest.
+func selectParameters() []openapi.Parameter {
+	return []openapi.Parameter{
+		{Name: "query", In: "query", Required: true, Description: `The profile type and label selector, for example process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}.`, Schema: &openapi.Schema{Type: "string"}},
+		stringParameter("from", "The start of the query, relative to now, for example now-1h, or in RFC3339 or Unix seconds. Defaults to an hour before until."),
+		stringParameter("until", "The end of the query, in the formats of from. Defaults to now."),
+		{Name: "approx", In: "query", Description: "Whether the query may be answered approximately from a sample of the profiles.", Schema: &openapi.Schema{Type: "boolean"}},
+	}
+}
@@ -0,0 +1,187 @@
+package querier
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+)
+
+// pprofChunkSize is the size of the chunks of the encoded profile written to the response.
+const pprofChunkSize = 64 << 10
+
+// PprofHandler exports the merge of the profiles matching the query in the pprof format:
+//
+//	/api/v1/pprof?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="prod"}&from=now-24h
+//
+// The profiles are merged with their mappings, locations and functions, as by
+// SelectMergeProfile. The merged profile is encoded while it is written in chunks, so the
+// response doesn't hold a second copy of it in its encoded form.
+type PprofHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewPprofHandler(client querierv1connect.QuerierServiceClient) *PprofHandler {
+	return &PprofHandler{client: client}
+}
+
+func (h *PprofHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectParams, _, err := parseSelectProfilesRequest(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.client.SelectMergeProfile(req.Context(), connect.NewRequest(&querierv1.SelectMergeProfileRequest{
+		ProfileTypeID: selectParams.ProfileTypeID,
+		LabelSelector: selectParams.LabelSelector,
+		Start:         selectParams.Start,
+		End:           selectParams.End,
+	}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	p := res.Msg
+	if p.TimeNanos == 0 {
+		p.TimeNanos = model.Time(selectParams.Start).UnixNano()
+	}
+	if p.DurationNanos == 0 {
+		p.DurationNanos = model.Time(selectParams.End).Sub(model.Time(selectParams.Start)).Nanoseconds()
+	}
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Disposition", `attachment; filename="profile.pb.gz"`)
+	gw := gzip.NewWriter(w)
+	if err := newPprofStreamWriter(gw).writeProfile(p); err != nil {
+		// closing the connection without the end of the gzip stream marks it as truncated.
+		panic(http.ErrAbortHandler)
+	}
+	if err := gw.Close(); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// pprofStreamWriter encodes a pprof profile field by field, writing the encoded fields once they
+// fill a chunk.
+type pprofStreamWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	// msg is the buffer used to encode the nested messages.
+	msg []byte
+}
+
+func newPprofStreamWriter(w io.Writer) *pprofStreamWriter {
+	return &pprofStreamWriter{w: bufio.NewWriterSize(w, pprofChunkSize)}
+}
+
+// vtMessage is a message encoded by the vtprotobuf generated code.
+type vtMessage interface {
+	SizeVT() int
+	MarshalToSizedBufferVT([]byte) (int, error)
+}
+
+// message appends the field of a nested message.
+func (pw *pprofStreamWriter) message(num protowire.Number, m vtMessage) error {
+	size := m.SizeVT()
+	if cap(pw.msg) < size {
+		pw.msg = make([]byte, size)
+	}
+	pw.msg = pw.msg[:size]
+	if _, err := m.MarshalToSizedBufferVT(pw.msg); err != nil {
+		return err
+	}
+	pw.buf = protowire.AppendTag(pw.buf, num, protowire.BytesType)
+	pw.buf = protowire.AppendBytes(pw.buf, pw.msg)
+	return pw.flush(false)
+}
+
+func (pw *pprofStreamWriter) varint(num protowire.Number, v int64) {
+	if v == 0 {
+		return
+	}
+	pw.buf = protowire.AppendTag(pw.buf, num, protowire.VarintType)
+	pw.buf = protowire.AppendVarint(pw.buf, uint64(v))
+}
+
+// flush writes the encoded fields once they fill a chunk.
+func (pw *pprofStreamWriter) flush(force bool) error {
+	if !force && len(pw.buf) < pprofChunkSize {
+		return nil
+	}
+	if _, err := pw.w.Write(pw.buf); err != nil {
+		return err
+	}
+	pw.buf = pw.buf[:0]
+	if force {
+		return pw.w.Flush()
+	}
+	return nil
+}
+
+// writeProfile writes the fields of the profile in the order of their numbers, and flushes it.
+func (pw *pprofStreamWriter) writeProfile(p *profilev1.Profile) error {
+	for _, t := range p.SampleType {
+		if err := pw.message(1, t); err != nil {
+			return err
+		}
+	}
+	for _, s := range p.Sample {
+		if err := pw.message(2, s); err != nil {
+			return err
+		}
+	}
+	for _, m := range p.Mapping {
+		if err := pw.message(3, m); err != nil {
+			return err
+		}
+	}
+	for _, l := range p.Location {
+		if err := pw.message(4, l); err != nil {
+			return err
+		}
+	}
+	for _, f := range p.Function {
+		if err := pw.message(5, f); err != nil {
+			return err
+		}
+	}
+	for _, s := range p.StringTable {
+		pw.buf = protowire.AppendTag(pw.buf, 6, protowire.BytesType)
+		pw.buf = protowire.AppendString(pw.buf, s)
+		if err := pw.flush(false); err != nil {
+			return err
+		}
+	}
+	pw.varint(7, p.DropFrames)
+	pw.varint(8, p.KeepFrames)
+	pw.varint(9, p.TimeNanos)
+	pw.varint(10, p.DurationNanos)
+	if p.PeriodType != nil {
+		if err := pw.message(11, p.PeriodType); err != nil {
+			return err
+		}
+	}
+	pw.varint(12, p.Period)
+	if len(p.Comment) > 0 {
+		var comments []byte
+		for _, c := range p.Comment {
+			comments = protowire.AppendVarint(comments, uint64(c))
+		}
+		pw.buf = protowire.AppendTag(pw.buf, 13, protowire.BytesType)
+		pw.buf = protowire.AppendBytes(pw.buf, comments)
+	}
+	pw.varint(14, p.DefaultSampleType)
+	return pw.flush(true)
+}
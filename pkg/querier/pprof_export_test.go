@@ -0,0 +1,131 @@
+package querier
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	profilev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+)
+
+type fakePprofClient struct {
+	querierv1connect.QuerierServiceClient
+	profile *profilev1.Profile
+	req     *querierv1.SelectMergeProfileRequest
+}
+
+func (c *fakePprofClient) SelectMergeProfile(_ context.Context, req *connect.Request[querierv1.SelectMergeProfileRequest]) (*connect.Response[profilev1.Profile], error) {
+	c.req = req.Msg
+	return connect.NewResponse(proto.Clone(c.profile).(*profilev1.Profile)), nil
+}
+
+// testPprofProfile returns a profile with the functions of the stacks, from the leaf to the root,
+// the function names being followed by their filename.
+func testPprofProfile(t testing.TB, stacks [][]string) *profilev1.Profile {
+	t.Helper()
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "inuse_space", Unit: "bytes"}},
+		PeriodType: &profile.ValueType{Type: "space", Unit: "bytes"},
+		Period:     1,
+	}
+	functions := map[string]*profile.Function{}
+	locations := map[string]*profile.Location{}
+	for i, stack := range stacks {
+		sample := &profile.Sample{Value: []int64{int64(i + 1)}}
+		for _, frame := range stack {
+			loc, ok := locations[frame]
+			if !ok {
+				name, filename, _ := strings.Cut(frame, ":")
+				fn := &profile.Function{ID: uint64(len(functions) + 1), Name: name, SystemName: name, Filename: filename}
+				functions[frame] = fn
+				p.Function = append(p.Function, fn)
+				loc = &profile.Location{ID: uint64(len(locations) + 1), Line: []profile.Line{{Function: fn, Line: 1}}}
+				locations[frame] = loc
+				p.Location = append(p.Location, loc)
+			}
+			sample.Location = append(sample.Location, loc)
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.WriteUncompressed(&buf))
+	var result profilev1.Profile
+	require.NoError(t, result.UnmarshalVT(buf.Bytes()))
+	return &result
+}
+
+// pprofStacks returns the samples of the profile as functions, with their filename, from the root
+// to the leaf, followed by their value.
+func pprofStacks(p *profile.Profile) []string {
+	var result []string
+	for _, s := range p.Sample {
+		names := make([]string, 0, len(s.Location))
+		for i := len(s.Location) - 1; i >= 0; i-- {
+			fn := s.Location[i].Line[0].Function
+			names = append(names, fn.Name+":"+fn.Filename)
+		}
+		result = append(result, strings.Join(names, ";")+" "+strconv.FormatInt(s.Value[0], 10))
+	}
+	sort.Strings(result)
+	return result
+}
+
+func Test_PprofHandler(t *testing.T) {
+	client := &fakePprofClient{profile: testPprofProfile(t, [][]string{
+		{"b:b.go", "a:a.go"},
+		// a function of the same name in another file is kept apart.
+		{"b:vendor/b.go", "a:a.go"},
+		{"a:a.go"},
+	})}
+	rec := httptest.NewRecorder()
+	NewPprofHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/experimental/pprof?query=memory:inuse_space:bytes:space:bytes{namespace="prod"}&from=now-1h`, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "memory:inuse_space:bytes:space:bytes", client.req.ProfileTypeID)
+	require.Equal(t, `{namespace="prod"}`, client.req.LabelSelector)
+
+	p, err := profile.Parse(bytes.NewReader(rec.Body.Bytes()))
+	require.NoError(t, err)
+	require.NoError(t, p.CheckValid())
+	require.Equal(t, []*profile.ValueType{{Type: "inuse_space", Unit: "bytes"}}, p.SampleType)
+	require.Equal(t, &profile.ValueType{Type: "space", Unit: "bytes"}, p.PeriodType)
+	require.Equal(t, int64(3600e9), p.DurationNanos)
+	require.Equal(t, []string{"a:a.go 3", "a:a.go;b:b.go 1", "a:a.go;b:vendor/b.go 2"}, pprofStacks(p))
+
+	rec = httptest.NewRecorder()
+	NewPprofHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/experimental/pprof`, nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_PprofStreamWriter_Chunks(t *testing.T) {
+	// enough distinct stacks for the profile to be written in several chunks.
+	var stacks [][]string
+	for i := 0; i < 10000; i++ {
+		stacks = append(stacks, []string{
+			"leaf" + strings.Repeat("x", i%7) + string(rune('a'+i%26)) + ":leaf.go",
+			"fn" + string(rune('a'+i%13)) + strings.Repeat("y", i/26) + ":fn.go",
+			"main:main.go",
+		})
+	}
+	p := testPprofProfile(t, stacks)
+	p.TimeNanos, p.DurationNanos = 1, 1000
+	var buf bytes.Buffer
+	require.NoError(t, newPprofStreamWriter(&buf).writeProfile(p))
+	require.Greater(t, buf.Len(), 2*pprofChunkSize)
+
+	// the profile is encoded as by its generated code.
+	expected, err := p.MarshalVT()
+	require.NoError(t, err)
+	require.Equal(t, expected, buf.Bytes())
+}
@@ -0,0 +1,41 @@
+package querier
+
+import (
+	"sort"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+)
+
+// mergeProfileIDs deduplicates the profiles of the ingesters by ID, the replicas of a profile
+// sharing the ID assigned at ingestion. The profiles are sorted by decreasing timestamp and at most
+// limit profiles are returned when limit is positive.
+func mergeProfileIDs(responses []responseFromIngesters[[]*ingestv1.Profile], limit int64) []*querierv1.ProfileRef {
+	profiles := make(map[string]*querierv1.ProfileRef)
+	for _, r := range responses {
+		for _, p := range r.response {
+			if _, ok := profiles[p.ID]; ok {
+				continue
+			}
+			profiles[p.ID] = &querierv1.ProfileRef{
+				ID:        p.ID,
+				Labels:    p.Labels,
+				Timestamp: p.Timestamp,
+			}
+		}
+	}
+	result := make([]*querierv1.ProfileRef, 0, len(profiles))
+	for _, p := range profiles {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Timestamp != result[j].Timestamp {
+			return result[i].Timestamp > result[j].Timestamp
+		}
+		return result[i].ID < result[j].ID
+	})
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return result
+}
@@ -3,12 +3,18 @@ package querier
 import (
 	"context"
 	"flag"
+	"fmt"
+	"math"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bufbuild/connect-go"
 	"github.com/go-kit/log"
+	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/ring"
 	ring_client "github.com/grafana/dskit/ring/client"
 	"github.com/grafana/dskit/services"
@@ -28,6 +34,8 @@ import (
 	"github.com/grafana/phlare/pkg/ingester/clientpool"
 	"github.com/grafana/phlare/pkg/iter"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/pprof"
+	"github.com/grafana/phlare/pkg/tenant"
 )
 
 // todo: move to non global metrics.
@@ -40,12 +48,41 @@ var clients = promauto.NewGauge(prometheus.GaugeOpts{
 type Config struct {
 	PoolConfig      clientpool.PoolConfig `yaml:"pool_config,omitempty"`
 	ExtraQueryDelay time.Duration         `yaml:"extra_query_delay,omitempty"`
+	HedgeReadsAfter time.Duration         `yaml:"hedge_reads_after" category:"advanced"`
+	MaxSendMsgSize  int                   `yaml:"max_send_msg_size" category:"advanced"`
+
+	ResponseCompressionMinBytes int `yaml:"response_compression_min_bytes" category:"advanced"`
+
+	LabelJoins LabelJoinsConfig `yaml:"label_joins"`
 }
 
 // RegisterFlags registers distributor-related flags.
 func (cfg *Config) RegisterFlags(fs *flag.FlagSet) {
 	cfg.PoolConfig.RegisterFlagsWithPrefix("querier", fs)
 	fs.DurationVar(&cfg.ExtraQueryDelay, "querier.extra-query-delay", 0, "Time to wait before sending more than the minimum successful query requests.")
+	fs.DurationVar(&cfg.HedgeReadsAfter, "querier.hedge-reads-after", 0, "Latency after which the reads of labels, series and profiles not yet answered by the ingesters needed for a quorum, the fastest ones, are also sent to the spare replicas. The first responses forming a quorum are used. 0 to disable.")
+	fs.IntVar(&cfg.MaxSendMsgSize, "querier.max-send-msg-size", 0, "Maximum size of a query response message in bytes. 0 to disable.")
+	fs.IntVar(&cfg.ResponseCompressionMinBytes, "querier.response-compression-min-bytes", 1024, "Minimum size of the query responses compressed with zstd or gzip, as negotiated with the Accept-Encoding header of the requests. Smaller responses are sent uncompressed. 0 to disable the compression.")
+	cfg.LabelJoins.RegisterFlags(fs)
+}
+
+func (cfg *Config) Validate() error {
+	if err := cfg.LabelJoins.Validate(); err != nil {
+		return err
+	}
+	return cfg.PoolConfig.Validate()
+}
+
+const (
+	// approximateSamplingFraction is the fraction of the row groups of the profiles merged by
+	// the ingesters for the approximate queries.
+	approximateSamplingFraction = 0.1
+	// approximateConfidence is the z-score of the 95% confidence interval of the approximations.
+	approximateConfidence = 1.96
+)
+
+type Limits interface {
+	IngestionReplicationFactor(tenantID string) int
 }
 
 type Querier struct {
@@ -59,24 +96,26 @@ type Querier struct {
 	ingestersRing   ring.ReadRing
 	pool            *ring_client.Pool
 	ingesterQuerier *IngesterQuerier
+	joins           *labelJoiner
 }
 
-func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, logger log.Logger, clientsOptions ...connect.ClientOption) (*Querier, error) {
+func New(cfg Config, ingestersRing ring.ReadRing, factory ring_client.PoolFactory, limits Limits, logger log.Logger, clientsOptions ...connect.ClientOption) (*Querier, error) {
 	q := &Querier{
 		cfg:           cfg,
 		logger:        logger,
 		ingestersRing: ingestersRing,
 		pool:          clientpool.NewPool(cfg.PoolConfig, ingestersRing, factory, clients, logger, clientsOptions...),
+		joins:         newLabelJoiner(cfg.LabelJoins, logger),
 	}
 	var err error
-	q.subservices, err = services.NewManager(q.pool)
+	q.subservices, err = services.NewManager(q.pool, q.joins)
 	if err != nil {
 		return nil, errors.Wrap(err, "services manager")
 	}
 	q.subservicesWatcher = services.NewFailureWatcher()
 	q.subservicesWatcher.WatchManager(q.subservices)
 	q.Service = services.NewBasicService(q.starting, q.running, q.stopping)
-	q.ingesterQuerier = NewIngesterQuerier(q.pool, ingestersRing, cfg.ExtraQueryDelay)
+	q.ingesterQuerier = NewIngesterQuerier(q.pool, ingestersRing, limits, cfg.ExtraQueryDelay, cfg.HedgeReadsAfter)
 	return q, nil
 }
 
@@ -101,7 +140,7 @@ func (q *Querier) ProfileTypes(ctx context.Context, req *connect.Request[querier
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "ProfileTypes")
 	defer sp.Finish()
 
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*typesv1.ProfileType, error) {
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*typesv1.ProfileType, error) {
 		res, err := ic.ProfileTypes(childCtx, connect.NewRequest(&ingestv1.ProfileTypesRequest{}))
 		if err != nil {
 			return nil, err
@@ -139,9 +178,14 @@ func (q *Querier) LabelValues(ctx context.Context, req *connect.Request[querierv
 		)
 		sp.Finish()
 	}()
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
+	// the values of a joined label are mapped from the values of its source label.
+	name, join := req.Msg.Name, q.joins.join(req.Msg.Name)
+	if join >= 0 {
+		name = q.joins.joins[join].SourceLabel
+	}
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
 		res, err := ic.LabelValues(childCtx, connect.NewRequest(&ingestv1.LabelValuesRequest{
-			Name: req.Msg.Name,
+			Name: name,
 		}))
 		if err != nil {
 			return nil, err
@@ -152,15 +196,19 @@ func (q *Querier) LabelValues(ctx context.Context, req *connect.Request[querierv
 		return nil, err
 	}
 
+	values := uniqueSortedStrings(responses)
+	if join >= 0 {
+		values = q.joins.labelValues(join, values)
+	}
 	return connect.NewResponse(&querierv1.LabelValuesResponse{
-		Names: uniqueSortedStrings(responses),
+		Names: values,
 	}), nil
 }
 
 func (q *Querier) LabelNames(ctx context.Context, req *connect.Request[querierv1.LabelNamesRequest]) (*connect.Response[querierv1.LabelNamesResponse], error) {
 	sp, ctx := opentracing.StartSpanFromContext(ctx, "LabelNames")
 	defer sp.Finish()
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]string, error) {
 		res, err := ic.LabelNames(childCtx, connect.NewRequest(&ingestv1.LabelNamesRequest{}))
 		if err != nil {
 			return nil, err
@@ -172,7 +220,7 @@ func (q *Querier) LabelNames(ctx context.Context, req *connect.Request[querierv1
 	}
 
 	return connect.NewResponse(&querierv1.LabelNamesResponse{
-		Names: uniqueSortedStrings(responses),
+		Names: q.joins.labelNames(uniqueSortedStrings(responses)),
 	}), nil
 }
 
@@ -184,9 +232,16 @@ func (q *Querier) Series(ctx context.Context, req *connect.Request[querierv1.Ser
 		)
 		sp.Finish()
 	}()
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*typesv1.Labels, error) {
+	matchers := make([]string, len(req.Msg.Matchers))
+	for i, m := range req.Msg.Matchers {
+		var err error
+		if matchers[i], err = q.joinSelector(m); err != nil {
+			return nil, err
+		}
+	}
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*typesv1.Labels, error) {
 		res, err := ic.Series(childCtx, connect.NewRequest(&ingestv1.SeriesRequest{
-			Matchers: req.Msg.Matchers,
+			Matchers: matchers,
 		}))
 		if err != nil {
 			return nil, err
@@ -199,6 +254,9 @@ func (q *Querier) Series(ctx context.Context, req *connect.Request[querierv1.Ser
 	return connect.NewResponse(&querierv1.SeriesResponse{
 		LabelsSet: lo.UniqBy(
 			lo.FlatMap(responses, func(r responseFromIngesters[[]*typesv1.Labels], _ int) []*typesv1.Labels {
+				for _, ls := range r.response {
+					ls.Labels = q.joins.joinLabels(ls.Labels)
+				}
 				return r.response
 			}),
 			func(t *typesv1.Labels) uint64 {
@@ -223,16 +281,175 @@ func (q *Querier) SelectMergeStacktraces(ctx context.Context, req *connect.Reque
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
+	// ingesters which don't support the sampling would merge all the profiles, so the result
+	// is only approximated once they all do, and is exact until then.
+	approximate := req.Msg.Approximate
+	if approximate {
+		if approximate, err = q.ingesterQuerier.supported(ctx, clientpool.FeatureMergeSampling); err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+	}
+	var samplingFraction float64
+	if approximate {
+		samplingFraction = approximateSamplingFraction
+	}
+
+	st, variance, err := q.selectStacktraces(ctx, &ingestv1.SelectProfilesRequest{
+		LabelSelector: req.Msg.LabelSelector,
+		Start:         req.Msg.Start,
+		End:           req.Msg.End,
+		Type:          profileType,
+	}, samplingFraction)
+	if err != nil {
+		return nil, err
+	}
+	res := &querierv1.SelectMergeStacktracesResponse{
+		Flamegraph: NewFlameGraph(newTree(st)),
+	}
+	if approximate {
+		res.Approximation = &querierv1.Approximation{
+			SamplingFraction: samplingFraction,
+			ErrorBound:       int64(math.Ceil(approximateConfidence * math.Sqrt(variance))),
+		}
+	}
+	return connect.NewResponse(res), nil
+}
+
+// maxMultiQueries is the maximum number of sub-queries of a SelectMergeStacktracesMulti request,
+// which is the maximum number of requests the ingesters merge in a single pass.
+const maxMultiQueries = 64
+
+// SelectMergeStacktracesMulti merges the stacktraces of several queries. Their profiles are
+// selected and read once by the ingesters, so that comparing queries over the same profiles
+// doesn't fan out once per query.
+func (q *Querier) SelectMergeStacktracesMulti(ctx context.Context, req *connect.Request[querierv1.SelectMergeStacktracesMultiRequest]) (*connect.Response[querierv1.SelectMergeStacktracesMultiResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectMergeStacktracesMulti")
+	defer func() {
+		sp.LogFields(otlog.Int("queries", len(req.Msg.Queries)))
+		sp.Finish()
+	}()
+
+	if len(req.Msg.Queries) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("at least one query is required"))
+	}
+	if len(req.Msg.Queries) > maxMultiQueries {
+		return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("at most %d queries are allowed, got %d", maxMultiQueries, len(req.Msg.Queries)))
+	}
+	names := lo.Keys(req.Msg.Queries)
+	sort.Strings(names)
+
+	var (
+		requests    = make([]*ingestv1.SelectProfilesRequest, len(names))
+		approximate bool
+	)
+	for i, name := range names {
+		query := req.Msg.Queries[name]
+		if query == nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("query %q is empty", name))
+		}
+		profileType, err := phlaremodel.ParseProfileTypeSelector(query.ProfileTypeID)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("query %q: %w", name, err))
+		}
+		selector, err := q.joinSelector(query.LabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		requests[i] = &ingestv1.SelectProfilesRequest{
+			LabelSelector: selector,
+			Start:         query.Start,
+			End:           query.End,
+			Type:          profileType,
+		}
+		approximate = approximate || query.Approximate
+	}
+
+	res := &querierv1.SelectMergeStacktracesMultiResponse{
+		Results: make(map[string]*querierv1.SelectMergeStacktracesResponse, len(names)),
+	}
+	// the sampling applies to the profiles of a single request, so approximate queries, as well as
+	// ingesters not upgraded yet, are merged one query at a time.
+	supported, err := q.ingesterQuerier.supported(ctx, clientpool.FeatureMultiSelect)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if approximate || !supported {
+		var (
+			lock sync.Mutex
+			g    errgroup.Group
+		)
+		for _, name := range names {
+			name := name
+			g.Go(func() error {
+				r, err := q.SelectMergeStacktraces(ctx, connect.NewRequest(req.Msg.Queries[name]))
+				if err != nil {
+					return err
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				res.Results[name] = r.Msg
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		return connect.NewResponse(res), nil
+	}
+
+	st, err := q.selectStacktracesMulti(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		res.Results[name] = &querierv1.SelectMergeStacktracesResponse{
+			Flamegraph: NewFlameGraph(newTree(st[i])),
+		}
+	}
+	return connect.NewResponse(res), nil
+}
+
+// selectStacktracesMulti merges the stacktraces of the profiles selected by each of the requests
+// in a single pass over the ingesters.
+func (q *Querier) selectStacktracesMulti(ctx context.Context, requests []*ingestv1.SelectProfilesRequest) ([][]stacktraces, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesStacktraces, error) {
+		return ic.MergeProfilesStacktraces(ctx), nil
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, r := range responses {
+		r := r
+		g.Go(func() error {
+			return r.response.Send(&ingestv1.MergeProfilesStacktracesRequest{
+				Requests: requests,
+			})
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	return selectMergeStacktracesMulti(gCtx, responses, len(requests))
+}
 
+// selectStacktraces merges the stacktraces of the profiles selected by the request, sampling
+// their row groups when samplingFraction is set.
+func (q *Querier) selectStacktraces(ctx context.Context, req *ingestv1.SelectProfilesRequest, samplingFraction float64) ([]stacktraces, float64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesStacktraces, error) {
 		// we plan to use those streams to merge profiles
 		// so we use the main context here otherwise will be canceled
 		return ic.MergeProfilesStacktraces(ctx), nil
 	})
 	if err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+		return nil, 0, connect.NewError(connect.CodeInternal, err)
 	}
 	// send the first initial request to all ingesters.
 	g, gCtx := errgroup.WithContext(ctx)
@@ -240,27 +457,21 @@ func (q *Querier) SelectMergeStacktraces(ctx context.Context, req *connect.Reque
 		r := r
 		g.Go(func() error {
 			return r.response.Send(&ingestv1.MergeProfilesStacktracesRequest{
-				Request: &ingestv1.SelectProfilesRequest{
-					LabelSelector: req.Msg.LabelSelector,
-					Start:         req.Msg.Start,
-					End:           req.Msg.End,
-					Type:          profileType,
-				},
+				Request:          req,
+				SamplingFraction: samplingFraction,
 			})
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return nil, connect.NewError(connect.CodeInternal, err)
+		return nil, 0, connect.NewError(connect.CodeInternal, err)
 	}
 
 	// merge all profiles
-	st, err := selectMergeStacktraces(gCtx, responses)
+	st, variance, err := selectMergeStacktraces(gCtx, responses)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
-		Flamegraph: NewFlameGraph(newTree(st)),
-	}), nil
+	return st, variance, nil
 }
 
 func (q *Querier) SelectMergeProfile(ctx context.Context, req *connect.Request[querierv1.SelectMergeProfileRequest]) (*connect.Response[googlev1.Profile], error) {
@@ -279,6 +490,9 @@ func (q *Querier) SelectMergeProfile(ctx context.Context, req *connect.Request[q
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -329,6 +543,7 @@ func (q *Querier) SelectSeries(ctx context.Context, req *connect.Request[querier
 			otlog.String("profile_id", req.Msg.ProfileTypeID),
 			otlog.String("group_by", strings.Join(req.Msg.GroupBy, ",")),
 			otlog.Float64("step", req.Msg.Step),
+			otlog.String("function", req.Msg.Function),
 		)
 		sp.Finish()
 	}()
@@ -336,62 +551,493 @@ func (q *Querier) SelectSeries(ctx context.Context, req *connect.Request[querier
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInvalidArgument, err)
 	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
 
 	if req.Msg.Start > req.Msg.End {
 		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
 	}
 
-	if req.Msg.Step == 0 {
-		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("step must be non-zero"))
+	stepMs, err := stepMillis(req.Msg.Step)
+	if err != nil {
+		return nil, err
 	}
 
-	stepMs := time.Duration(req.Msg.Step * float64(time.Second)).Milliseconds()
-	// we need to request profile from start - step to end since start is inclusive.
-	// The first step starts at start-step to start.
-	start := req.Msg.Start - stepMs
+	if _, err := regexp.Compile(req.Msg.Function); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "invalid function"))
+	}
+
+	first := req.Msg.Start
+	if req.Msg.Alignment != nil {
+		first = alignStep(req.Msg.Start, stepMs, *req.Msg.Alignment)
+	}
+	if err := checkFilledSteps(first, req.Msg.End, stepMs, req.Msg.Fill); err != nil {
+		return nil, err
+	}
+	// we need to request profile from first - step to end since first is inclusive.
+	// The first step starts at first-step to first.
+	start := first - stepMs
 	sort.Strings(req.Msg.GroupBy)
+	groupBy := q.joins.groupBy(req.Msg.GroupBy)
+	if req.Msg.Function != "" {
+		if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureFunctionFilter); err != nil {
+			return nil, err
+		}
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesLabels, error) {
-		return ic.MergeProfilesLabels(ctx), nil
+	it, err := q.selectSeries(ctx, &ingestv1.MergeProfilesLabelsRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: req.Msg.LabelSelector,
+			Start:         start,
+			End:           req.Msg.End,
+			Type:          profileType,
+		},
+		By:            groupBy,
+		Function:      req.Msg.Function,
+		FunctionTotal: req.Msg.FunctionTotal,
 	})
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	// send the first initial request to all ingesters.
-	g, gCtx := errgroup.WithContext(ctx)
+	series := q.joins.joinSeries(rangeSeries(it, first, req.Msg.End, stepMs), req.Msg.GroupBy)
+	result := fillSeries(series, first, req.Msg.End, stepMs, req.Msg.Fill)
+	if it.Err() != nil {
+		return nil, connect.NewError(connect.CodeInternal, it.Err())
+	}
+
+	return connect.NewResponse(&querierv1.SelectSeriesResponse{
+		Series: result,
+	}), nil
+}
+
+func (q *Querier) SelectHeatmap(ctx context.Context, req *connect.Request[querierv1.SelectHeatmapRequest]) (*connect.Response[querierv1.SelectHeatmapResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectHeatmap")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("selector", req.Msg.LabelSelector),
+			otlog.String("profile_id", req.Msg.ProfileTypeID),
+			otlog.Float64("step", req.Msg.Step),
+			otlog.Int("buckets", len(req.Msg.Buckets)),
+		)
+		sp.Finish()
+	}()
+	profileType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.ProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
+
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+
+	stepMs, err := stepMillis(req.Msg.Step)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(req.Msg.Buckets); i++ {
+		if req.Msg.Buckets[i] <= req.Msg.Buckets[i-1] {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("buckets must be in increasing order"))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	series, ok, err := q.selectHeatmapHistograms(ctx, req.Msg, profileType, stepMs)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	if ok {
+		return connect.NewResponse(&querierv1.SelectHeatmapResponse{
+			Series: series,
+		}), nil
+	}
+
+	// Without grouping, each point of the series is the total of a single profile.
+	it, err := q.selectSeries(ctx, &ingestv1.MergeProfilesLabelsRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: req.Msg.LabelSelector,
+			Start:         req.Msg.Start - stepMs + 1,
+			End:           req.Msg.End,
+			Type:          profileType,
+		},
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+	result := heatmapSeries(it, req.Msg.Start, req.Msg.End, stepMs, req.Msg.Buckets)
+	if it.Err() != nil {
+		return nil, connect.NewError(connect.CodeInternal, it.Err())
+	}
+
+	return connect.NewResponse(&querierv1.SelectHeatmapResponse{
+		Series: result,
+	}), nil
+}
+
+// selectHeatmapHistograms computes the heatmap from the histograms of the profile totals stored by
+// the ingesters, without reading the samples of the profiles. It returns false when the
+// histograms don't give the exact heatmap, as the steps or the bounds split them, or as some of
+// the ingesters or of their blocks don't store them yet.
+func (q *Querier) selectHeatmapHistograms(ctx context.Context, req *querierv1.SelectHeatmapRequest, profileType *typesv1.ProfileType, step int64) ([]*typesv1.Series, bool, error) {
+	if !histogramsHeatmapExact(req.Start, step, req.Buckets) {
+		return nil, false, nil
+	}
+	supported, err := q.ingesterQuerier.supported(ctx, clientpool.FeatureHistograms)
+	if err != nil || !supported {
+		return nil, false, err
+	}
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) (*ingestv1.SelectHistogramsResponse, error) {
+		res, err := ic.SelectHistograms(childCtx, connect.NewRequest(&ingestv1.SelectHistogramsRequest{
+			LabelSelector: req.LabelSelector,
+			Type:          profileType,
+			Start:         req.Start - step + 1,
+			End:           req.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
 	for _, r := range responses {
-		r := r
-		g.Go(func() error {
-			return r.response.Send(&ingestv1.MergeProfilesLabelsRequest{
-				Request: &ingestv1.SelectProfilesRequest{
-					LabelSelector: req.Msg.LabelSelector,
-					Start:         start,
-					End:           req.Msg.End,
-					Type:          profileType,
-				},
-				By: req.Msg.GroupBy,
-			})
-		})
+		if !r.response.Complete {
+			return nil, false, nil
+		}
 	}
-	if err := g.Wait(); err != nil {
+	histograms := dedupeHistograms(responses, q.replicationFactor(ctx))
+	return heatmapHistograms(histograms, req.Start, req.End, step, req.Buckets), true, nil
+}
+
+func (q *Querier) StorageUsage(ctx context.Context, req *connect.Request[querierv1.StorageUsageRequest]) (*connect.Response[querierv1.StorageUsageResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "StorageUsage")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("label_name", req.Msg.LabelName),
+		)
+		sp.Finish()
+	}()
+	if req.Msg.LabelName == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("label name is required"))
+	}
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureStorageUsage); err != nil {
+		return nil, err
+	}
+	// The usage of an ingester can't be inferred from the others, so all of them must answer.
+	replicationSet, err := q.ingesterQuerier.ring.GetReplicationSetForOperation(ring.Read)
+	if err != nil {
+		return nil, err
+	}
+	replicationSet.MaxErrors = 0
+	replicationSet.MaxUnavailableZones = 0
+	responses, err := forGivenIngesters(ctx, q.ingesterQuerier, replicationSet, func(childCtx context.Context, ic IngesterQueryClient) ([]*ingestv1.LabelValueUsage, error) {
+		res, err := ic.StorageUsage(childCtx, connect.NewRequest(&ingestv1.StorageUsageRequest{
+			LabelName: req.Msg.LabelName,
+			Start:     req.Msg.Start,
+			End:       req.Msg.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.Usage, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return connect.NewResponse(&querierv1.StorageUsageResponse{
+		Usage: mergeStorageUsage(responses, q.replicationFactor(ctx)),
+	}), nil
+}
+
+func (q *Querier) SelectProfileIDs(ctx context.Context, req *connect.Request[querierv1.SelectProfileIDsRequest]) (*connect.Response[querierv1.SelectProfileIDsResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectProfileIDs")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("selector", req.Msg.LabelSelector),
+			otlog.String("profile_id", req.Msg.ProfileTypeID),
+			otlog.Int64("limit", req.Msg.Limit),
+		)
+		sp.Finish()
+	}()
+	profileType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.ProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureProfileIDs); err != nil {
+		return nil, err
+	}
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*ingestv1.Profile, error) {
+		res, err := ic.SelectProfileIDs(childCtx, connect.NewRequest(&ingestv1.SelectProfileIDsRequest{
+			Request: &ingestv1.SelectProfilesRequest{
+				LabelSelector: req.Msg.LabelSelector,
+				Start:         req.Msg.Start,
+				End:           req.Msg.End,
+				Type:          profileType,
+			},
+			Limit: req.Msg.Limit,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.Profiles, nil
+	})
+	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	it, err := selectMergeSeries(gCtx, responses)
+
+	return connect.NewResponse(&querierv1.SelectProfileIDsResponse{
+		Profiles: mergeProfileIDs(responses, req.Msg.Limit),
+	}), nil
+}
+
+func (q *Querier) GetProfile(ctx context.Context, req *connect.Request[querierv1.GetProfileRequest]) (*connect.Response[googlev1.Profile], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "GetProfile")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("profile_id", req.Msg.ProfileTypeID),
+			otlog.String("id", req.Msg.ID),
+		)
+		sp.Finish()
+	}()
+	profileType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.ProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if _, err := uuid.Parse(req.Msg.ID); err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "invalid profile ID"))
+	}
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureProfileIDs); err != nil {
+		return nil, err
+	}
+	responses, err := forAllIngestersHedged(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]byte, error) {
+		res, err := ic.GetProfile(childCtx, connect.NewRequest(&ingestv1.GetProfileRequest{
+			Type:  profileType,
+			ID:    req.Msg.ID,
+			Start: req.Msg.Start,
+			End:   req.Msg.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.Result, nil
+	})
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInternal, err)
+	}
+
+	// The replicas of a profile are identical, the first one found is returned.
+	for _, r := range responses {
+		if len(r.response) == 0 {
+			continue
+		}
+		p, err := profile.ParseUncompressed(r.response)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		result, err := pprof.FromProfile(p)
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInternal, err)
+		}
+		return connect.NewResponse(result), nil
+	}
+	return nil, connect.NewError(connect.CodeNotFound, errors.Errorf("profile %s not found", req.Msg.ID))
+}
+
+func (q *Querier) SelectStackSeries(ctx context.Context, req *connect.Request[querierv1.SelectStackSeriesRequest]) (*connect.Response[querierv1.SelectStackSeriesResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectStackSeries")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("selector", req.Msg.LabelSelector),
+			otlog.String("profile_id", req.Msg.ProfileTypeID),
+			otlog.String("stack", strings.Join(req.Msg.Stack, ";")),
+			otlog.String("group_by", strings.Join(req.Msg.GroupBy, ",")),
+			otlog.Int64("limit", req.Msg.Limit),
+		)
+		sp.Finish()
+	}()
+	profileType, err := phlaremodel.ParseProfileTypeSelector(req.Msg.ProfileTypeID)
+	if err != nil {
+		return nil, connect.NewError(connect.CodeInvalidArgument, err)
+	}
+	if req.Msg.LabelSelector, err = q.joinSelector(req.Msg.LabelSelector); err != nil {
+		return nil, err
+	}
+
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+
+	if len(req.Msg.Stack) == 0 {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("stack is required"))
+	}
+
+	sort.Strings(req.Msg.GroupBy)
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureStackFilter); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	it, err := q.selectSeries(ctx, &ingestv1.MergeProfilesLabelsRequest{
+		Request: &ingestv1.SelectProfilesRequest{
+			LabelSelector: req.Msg.LabelSelector,
+			Start:         req.Msg.Start,
+			End:           req.Msg.End,
+			Type:          profileType,
+		},
+		By:    req.Msg.GroupBy,
+		Stack: req.Msg.Stack,
+	})
 	if err != nil {
 		return nil, connect.NewError(connect.CodeInternal, err)
 	}
-	result := rangeSeries(it, req.Msg.Start, req.Msg.End, stepMs)
+	result := topStackSeries(it, req.Msg.Limit)
 	if it.Err() != nil {
 		return nil, connect.NewError(connect.CodeInternal, it.Err())
 	}
 
-	return connect.NewResponse(&querierv1.SelectSeriesResponse{
+	return connect.NewResponse(&querierv1.SelectStackSeriesResponse{
 		Series: result,
 	}), nil
 }
 
+// replicationFactor returns the number of ingesters the profiles of the tenant are sent to.
+func (q *Querier) replicationFactor(ctx context.Context) int {
+	rf := q.ingesterQuerier.ring.ReplicationFactor()
+	if tenantID, err := tenant.ExtractTenantIDFromContext(ctx); err == nil {
+		if tenantRF := q.ingesterQuerier.limits.IngestionReplicationFactor(tenantID); tenantRF > 0 && tenantRF < rf {
+			rf = tenantRF
+		}
+	}
+	return rf
+}
+
+// selectSeries sends the merge request to all ingesters and returns the values of the profiles
+// grouped by the requested labels.
+func (q *Querier) selectSeries(ctx context.Context, req *ingestv1.MergeProfilesLabelsRequest) (iter.Iterator[ProfileValue], error) {
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(_ context.Context, ic IngesterQueryClient) (clientpool.BidiClientMergeProfilesLabels, error) {
+		return ic.MergeProfilesLabels(ctx), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// send the first initial request to all ingesters.
+	g, gCtx := errgroup.WithContext(ctx)
+	for _, r := range responses {
+		r := r
+		g.Go(func() error {
+			return r.response.Send(req)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return selectMergeSeries(gCtx, responses)
+}
+
+// stepMillis returns the step of a range query in milliseconds. The steps shorter than a
+// millisecond are rejected, as the ranges are iterated by step.
+func stepMillis(step float64) (int64, error) {
+	stepMs := time.Duration(step * float64(time.Second)).Milliseconds()
+	if stepMs <= 0 {
+		return 0, connect.NewError(connect.CodeInvalidArgument, errors.New("step must be at least a millisecond"))
+	}
+	return stepMs, nil
+}
+
+// alignStep returns the first timestamp from start which is a multiple of the step shifted by the offset.
+func alignStep(start, step, offset int64) int64 {
+	r := (start - offset) % step
+	if r < 0 {
+		r += step
+	}
+	if r == 0 {
+		return start
+	}
+	return start + step - r
+}
+
+// maxFilledSeriesSteps is the maximum number of steps of the series filled by a fill policy, each
+// of which has a point.
+const maxFilledSeriesSteps = 11000
+
+// checkFilledSteps rejects the fill policies of the time ranges split in more than
+// maxFilledSeriesSteps steps.
+func checkFilledSteps(start, end, step int64, fill querierv1.FillPolicy) error {
+	if fill != querierv1.FillPolicy_FILL_POLICY_ZERO && fill != querierv1.FillPolicy_FILL_POLICY_PREVIOUS {
+		return nil
+	}
+	if steps := (end-start)/step + 1; steps > maxFilledSeriesSteps {
+		return connect.NewError(connect.CodeInvalidArgument, fmt.Errorf("the time range would be filled with %d steps, more than the maximum of %d: increase the step", steps, maxFilledSeriesSteps))
+	}
+	return nil
+}
+
+// fillSeries adds the points of the steps without profiles, from start to end, according to the fill policy.
+func fillSeries(series []*typesv1.Series, start, end, step int64, fill querierv1.FillPolicy) []*typesv1.Series {
+	if fill != querierv1.FillPolicy_FILL_POLICY_ZERO && fill != querierv1.FillPolicy_FILL_POLICY_PREVIOUS {
+		return series
+	}
+	for _, s := range series {
+		var (
+			points = make([]*typesv1.Point, 0, (end-start)/step+1)
+			prev   *typesv1.Point
+			i      int
+		)
+		for ts := start; ts <= end; ts += step {
+			if i < len(s.Points) && s.Points[i].Timestamp == ts {
+				prev = s.Points[i]
+				points = append(points, prev)
+				i++
+				continue
+			}
+			switch {
+			case fill == querierv1.FillPolicy_FILL_POLICY_ZERO:
+				points = append(points, &typesv1.Point{Timestamp: ts})
+			case prev != nil:
+				points = append(points, &typesv1.Point{Timestamp: ts, Value: prev.Value})
+			}
+		}
+		s.Points = points
+	}
+	return series
+}
+
 // rangeSeries aggregates profiles into series.
 // Series contains points spaced by step from start to end.
 // Profiles from the same step are aggregated into one point.
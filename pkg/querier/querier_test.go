@@ -3,6 +3,7 @@ package querier
 import (
 	"bytes"
 	"context"
+	"errors"
 	"os"
 	"sort"
 	"testing"
@@ -12,11 +13,13 @@ import (
 	"github.com/go-kit/log"
 	"github.com/gogo/protobuf/proto"
 	"github.com/google/pprof/profile"
+	"github.com/google/uuid"
 	"github.com/grafana/dskit/ring"
 	"github.com/grafana/dskit/ring/client"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
 
 	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
 	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
@@ -26,6 +29,7 @@ import (
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 	pprofth "github.com/grafana/phlare/pkg/pprof/testhelper"
 	"github.com/grafana/phlare/pkg/testhelper"
+	"github.com/grafana/phlare/pkg/validation"
 )
 
 func Test_QuerySampleType(t *testing.T) {
@@ -64,7 +68,7 @@ func Test_QuerySampleType(t *testing.T) {
 				}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.ProfileTypes(context.Background(), connect.NewRequest(&querierv1.ProfileTypesRequest{}))
@@ -76,6 +80,51 @@ func Test_QuerySampleType(t *testing.T) {
 	require.Equal(t, []string{"bar", "buzz", "foo"}, ids)
 }
 
+func Test_HedgedReads(t *testing.T) {
+	var slowCalls atomic.Int32
+	querier, err := New(Config{
+		PoolConfig:      clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+		HedgeReadsAfter: 50 * time.Millisecond,
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		if addr == "1" {
+			// The slow ingester only answers once the request is cancelled.
+			q.On("ProfileTypes", mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) {
+					slowCalls.Inc()
+					<-args.Get(0).(context.Context).Done()
+				}).
+				Return(nil, context.Canceled)
+			return q, nil
+		}
+		q.On("ProfileTypes", mock.Anything, mock.Anything).
+			Return(connect.NewResponse(&ingestv1.ProfileTypesResponse{
+				ProfileTypes: []*typesv1.ProfileType{{ID: addr}},
+			}), nil)
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewNopLogger())
+	require.NoError(t, err)
+
+	// The request to the third ingester is hedged once the first one is too slow.
+	out, err := querier.ProfileTypes(context.Background(), connect.NewRequest(&querierv1.ProfileTypesRequest{}))
+	require.NoError(t, err)
+	require.Len(t, out.Msg.ProfileTypes, 2)
+	require.Equal(t, int32(1), slowCalls.Load())
+
+	// The slow ingester is now queried last, and the quorum is reached without it.
+	require.Eventually(t, func() bool {
+		return querier.ingesterQuerier.latencies.sort([]ring.InstanceDesc{{Addr: "1"}, {Addr: "2"}, {Addr: "3"}})[2].Addr == "1"
+	}, time.Second, 10*time.Millisecond)
+	out, err = querier.ProfileTypes(context.Background(), connect.NewRequest(&querierv1.ProfileTypesRequest{}))
+	require.NoError(t, err)
+	require.Len(t, out.Msg.ProfileTypes, 2)
+	require.Equal(t, int32(1), slowCalls.Load())
+}
+
 func Test_QueryLabelValues(t *testing.T) {
 	req := connect.NewRequest(&querierv1.LabelValuesRequest{Name: "foo"})
 	querier, err := New(Config{
@@ -95,7 +144,7 @@ func Test_QueryLabelValues(t *testing.T) {
 			q.On("LabelValues", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{"buzz", "foo"}}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.LabelValues(context.Background(), req)
@@ -122,7 +171,7 @@ func Test_QueryLabelNames(t *testing.T) {
 			q.On("LabelNames", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.LabelNamesResponse{Names: []string{"buzz", "foo"}}), nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.LabelNames(context.Background(), req)
@@ -155,7 +204,7 @@ func Test_Series(t *testing.T) {
 			q.On("Series", mock.Anything, mock.Anything).Return(ingesterReponse, nil)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 
 	require.NoError(t, err)
 	out, err := querier.Series(context.Background(), req)
@@ -166,6 +215,292 @@ func Test_Series(t *testing.T) {
 	}, out.Msg.LabelsSet)
 }
 
+func Test_StorageUsage(t *testing.T) {
+	req := connect.NewRequest(&querierv1.StorageUsageRequest{LabelName: "service_name", Start: 0, End: 1000})
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		switch addr {
+		case "1":
+			q.On("StorageUsage", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.StorageUsageResponse{Usage: []*ingestv1.LabelValueUsage{
+				{Value: "api", Bytes: 100, Profiles: 10},
+				{Value: "db", Bytes: 300, Profiles: 20},
+			}}), nil)
+		case "2":
+			q.On("StorageUsage", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.StorageUsageResponse{Usage: []*ingestv1.LabelValueUsage{
+				{Value: "api", Bytes: 300, Profiles: 10},
+				{Value: "db", Bytes: 300, Profiles: 20},
+				{Value: "", Bytes: 50, Profiles: 4},
+			}}), nil)
+		}
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+
+	require.NoError(t, err)
+	out, err := querier.StorageUsage(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, []*querierv1.LabelValueUsage{
+		{Value: "db", Bytes: 300, Profiles: 20},
+		{Value: "api", Bytes: 200, Profiles: 10},
+		{Value: "", Bytes: 25, Profiles: 2},
+	}, out.Msg.Usage)
+
+	_, err = querier.StorageUsage(context.Background(), connect.NewRequest(&querierv1.StorageUsageRequest{}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func Test_MixedVersionIngesters(t *testing.T) {
+	ctx := context.Background()
+	ingesters := []ring.InstanceDesc{
+		{Addr: "1", RegisteredTimestamp: 1},
+		{Addr: "2", RegisteredTimestamp: 1},
+	}
+	legacy := newFakeQuerier()
+	legacy.legacy = true
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing(ingesters, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		if addr == "2" {
+			q = legacy
+		}
+		q.On("StorageUsage", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.StorageUsageResponse{}), nil)
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	// the ingester not upgraded yet doesn't support any feature.
+	supported, err := querier.ingesterQuerier.supported(ctx, clientpool.FeatureMergeSampling)
+	require.NoError(t, err)
+	require.False(t, supported)
+	_, err = querier.StorageUsage(ctx, connect.NewRequest(&querierv1.StorageUsageRequest{LabelName: "service_name"}))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+	_, err = querier.SelectSeries(ctx, connect.NewRequest(&querierv1.SelectSeriesRequest{
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		LabelSelector: `{app="foo"}`,
+		Function:      "foo",
+		Step:          1,
+	}))
+	require.Equal(t, connect.CodeFailedPrecondition, connect.CodeOf(err))
+
+	// its features are requested again once it registers with a new version.
+	legacy.legacy = false
+	ingesters[1].RegisteredTimestamp = 2
+	supported, err = querier.ingesterQuerier.supported(ctx, clientpool.FeatureMergeSampling)
+	require.NoError(t, err)
+	require.True(t, supported)
+	_, err = querier.StorageUsage(ctx, connect.NewRequest(&querierv1.StorageUsageRequest{LabelName: "service_name"}))
+	require.NoError(t, err)
+}
+
+func Test_SelectProfileIDs(t *testing.T) {
+	req := connect.NewRequest(&querierv1.SelectProfileIDsRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         0,
+		End:           10,
+		Limit:         2,
+	})
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		switch addr {
+		case "1":
+			q.On("SelectProfileIDs", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.SelectProfileIDsResponse{Profiles: []*ingestv1.Profile{
+				{ID: "b", Labels: foobarlabels, Timestamp: 5},
+				{ID: "a", Labels: foobarlabels, Timestamp: 1},
+			}}), nil)
+		case "2":
+			q.On("SelectProfileIDs", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.SelectProfileIDsResponse{Profiles: []*ingestv1.Profile{
+				{ID: "c", Labels: foobuzzlabels, Timestamp: 7},
+				{ID: "b", Labels: foobarlabels, Timestamp: 5},
+			}}), nil)
+		}
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	out, err := querier.SelectProfileIDs(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, []*querierv1.ProfileRef{
+		{ID: "c", Labels: foobuzzlabels, Timestamp: 7},
+		{ID: "b", Labels: foobarlabels, Timestamp: 5},
+	}, out.Msg.Profiles)
+}
+
+func Test_SelectHeatmapHistograms(t *testing.T) {
+	histogram := func(ts int64, totals ...int64) *ingestv1.Histogram {
+		h := &ingestv1.Histogram{Timestamp: ts}
+		for _, v := range totals {
+			phlaremodel.ObserveHistogram(h, v)
+		}
+		return h
+	}
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		q.On("SelectHistograms", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.SelectHistogramsResponse{
+			Complete: true,
+			Series: []*ingestv1.SeriesHistograms{
+				{Fingerprint: 1, Histograms: []*ingestv1.Histogram{histogram(15000, 3, 5), histogram(30000, 100)}},
+				{Fingerprint: 2, Histograms: []*ingestv1.Histogram{histogram(45000, 0)}},
+			},
+		}), nil)
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	out, err := querier.SelectHeatmap(context.Background(), connect.NewRequest(&querierv1.SelectHeatmapRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         15000,
+		End:           45000,
+		Step:          30,
+		Buckets:       []float64{4, 8},
+	}))
+	require.NoError(t, err)
+	bucket := func(le string, points ...*typesv1.Point) *typesv1.Series {
+		return &typesv1.Series{Labels: []*typesv1.LabelPair{{Name: "le", Value: le}}, Points: points}
+	}
+	testhelper.EqualProto(t, []*typesv1.Series{
+		bucket("4", &typesv1.Point{Timestamp: 15000, Value: 1}, &typesv1.Point{Timestamp: 45000, Value: 1}),
+		bucket("8", &typesv1.Point{Timestamp: 15000, Value: 1}),
+		bucket("+Inf", &typesv1.Point{Timestamp: 45000, Value: 1}),
+	}, out.Msg.Series)
+
+	// a step rounded down to 0ms would never advance.
+	_, err = querier.SelectHeatmap(context.Background(), connect.NewRequest(&querierv1.SelectHeatmapRequest{
+		LabelSelector: `{app="foo"}`,
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		Start:         15000,
+		End:           45000,
+		Step:          0.0001,
+	}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func Test_SelectTargetMetadata(t *testing.T) {
+	series := func(pod, profileType string, fp uint64, metadata ...*typesv1.TargetMetadata) *ingestv1.SeriesTargetMetadata {
+		return &ingestv1.SeriesTargetMetadata{
+			Labels: []*typesv1.LabelPair{
+				{Name: phlaremodel.LabelNameProfileType, Value: profileType},
+				{Name: "pod", Value: pod},
+			},
+			Fingerprint: fp,
+			Metadata:    metadata,
+		}
+	}
+	version := func(v string, first, last int64) *typesv1.TargetMetadata {
+		return &typesv1.TargetMetadata{Name: "build_version", Value: v, FirstSeen: first, LastSeen: last}
+	}
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		// the replicas have seen the versions of pod a at different times.
+		last := int64(2000)
+		if addr == "2" {
+			last = 2500
+		}
+		q.On("SelectTargetMetadata", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.SelectTargetMetadataResponse{
+			Series: []*ingestv1.SeriesTargetMetadata{
+				series("a", "process_cpu:cpu:nanoseconds:cpu:nanoseconds", 1, version("v1", 1000, last), version("v2", 3000, 4000)),
+				series("a", "memory:inuse_space:bytes:space:bytes", 2, version("v1", 1000, last)),
+				series("b", "process_cpu:cpu:nanoseconds:cpu:nanoseconds", 3, version("v2", 3000, 4000)),
+			},
+		}), nil)
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	selectTargetMetadata := func(t *testing.T, metadataSelector string) []*querierv1.TargetMetadataSet {
+		t.Helper()
+		out, err := querier.SelectTargetMetadata(context.Background(), connect.NewRequest(&querierv1.SelectTargetMetadataRequest{
+			LabelSelector:    `{namespace="prod"}`,
+			MetadataSelector: metadataSelector,
+			Start:            0,
+			End:              5000,
+		}))
+		require.NoError(t, err)
+		return out.Msg.Targets
+	}
+	target := func(pod string, metadata ...*typesv1.TargetMetadata) *querierv1.TargetMetadataSet {
+		return &querierv1.TargetMetadataSet{Labels: []*typesv1.LabelPair{{Name: "pod", Value: pod}}, Metadata: metadata}
+	}
+
+	testhelper.EqualProto(t, []*querierv1.TargetMetadataSet{
+		target("a", version("v1", 1000, 2500), version("v2", 3000, 4000)),
+		target("b", version("v2", 3000, 4000)),
+	}, selectTargetMetadata(t, ""))
+	testhelper.EqualProto(t, []*querierv1.TargetMetadataSet{
+		target("a", version("v1", 1000, 2500), version("v2", 3000, 4000)),
+	}, selectTargetMetadata(t, `{build_version="v1"}`))
+	require.Empty(t, selectTargetMetadata(t, `{build_version="v3"}`))
+
+	_, err = querier.SelectTargetMetadata(context.Background(), connect.NewRequest(&querierv1.SelectTargetMetadataRequest{
+		MetadataSelector: "{",
+		End:              5000,
+	}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
+func Test_GetProfile(t *testing.T) {
+	id := uuid.New().String()
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "inuse_space", Unit: "bytes"}},
+		Sample:     []*profile.Sample{{Value: []int64{42}}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, p.WriteUncompressed(&buf))
+
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+	}, 2), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		switch addr {
+		case "1":
+			q.On("GetProfile", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.GetProfileResponse{}), nil)
+		case "2":
+			q.On("GetProfile", mock.Anything, mock.Anything).Return(connect.NewResponse(&ingestv1.GetProfileResponse{Result: buf.Bytes()}), nil)
+		}
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	req := &querierv1.GetProfileRequest{
+		ProfileTypeID: "memory:inuse_space:bytes:space:byte",
+		ID:            id,
+		Start:         0,
+		End:           10,
+	}
+	out, err := querier.GetProfile(context.Background(), connect.NewRequest(req))
+	require.NoError(t, err)
+	require.Len(t, out.Msg.Sample, 1)
+	require.Equal(t, []int64{42}, out.Msg.Sample[0].Value)
+
+	req.ID = "not-an-id"
+	_, err = querier.GetProfile(context.Background(), connect.NewRequest(req))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
 func Test_SelectMergeStacktraces(t *testing.T) {
 	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
 		LabelSelector: `{app="foo"}`,
@@ -241,7 +576,7 @@ func Test_SelectMergeStacktraces(t *testing.T) {
 			q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidi3)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	flame, err := querier.SelectMergeStacktraces(context.Background(), req)
 	require.NoError(t, err)
@@ -271,6 +606,66 @@ func Test_SelectMergeStacktraces(t *testing.T) {
 		}, selected)
 }
 
+func Test_SelectMergeStacktracesMulti(t *testing.T) {
+	newBidi := func() *fakeBidiClientStacktraces {
+		return newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
+			{
+				LabelsSets: []*typesv1.Labels{
+					{Labels: []*typesv1.LabelPair{{Name: "app", Value: "foo"}}},
+					{Labels: []*typesv1.LabelPair{{Name: "app", Value: "bar"}}},
+				},
+				Profiles: []*ingestv1.SeriesProfile{
+					{Timestamp: 1, LabelIndex: 0},
+					{Timestamp: 2, LabelIndex: 1},
+				},
+			},
+		})
+	}
+	bidis := map[string]*fakeBidiClientStacktraces{"1": newBidi(), "2": newBidi(), "3": newBidi()}
+	querier, err := New(Config{
+		PoolConfig: clientpool.PoolConfig{ClientCleanupPeriod: 1 * time.Millisecond},
+	}, testhelper.NewMockRing([]ring.InstanceDesc{
+		{Addr: "1"},
+		{Addr: "2"},
+		{Addr: "3"},
+	}, 3), func(addr string) (client.PoolClient, error) {
+		q := newFakeQuerier()
+		q.On("MergeProfilesStacktraces", mock.Anything).Once().Return(bidis[addr])
+		return q, nil
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
+	require.NoError(t, err)
+
+	res, err := querier.SelectMergeStacktracesMulti(context.Background(), connect.NewRequest(&querierv1.SelectMergeStacktracesMultiRequest{
+		Queries: map[string]*querierv1.SelectMergeStacktracesRequest{
+			"before": {LabelSelector: `{app="foo"}`, ProfileTypeID: "memory:inuse_space:bytes:space:byte", Start: 0, End: 1},
+			"after":  {LabelSelector: `{app="foo"}`, ProfileTypeID: "memory:inuse_space:bytes:space:byte", Start: 1, End: 2},
+		},
+	}))
+	require.NoError(t, err)
+	// the queries are sent at once, in the order of their names.
+	var (
+		queried int64
+		kept    []testProfile
+	)
+	for _, bidi := range bidis {
+		if bidi.requests == 0 {
+			// the replicas beyond the quorum may not be queried.
+			continue
+		}
+		require.Equal(t, 2, bidi.requests)
+		queried++
+		kept = append(kept, bidi.kept...)
+	}
+	require.Len(t, res.Msg.Results, 2)
+	require.Equal(t, queried, res.Msg.Results["after"].Flamegraph.Total)
+	require.Equal(t, 2*queried, res.Msg.Results["before"].Flamegraph.Total)
+	// the profiles are deduplicated across the replicas once for all the queries.
+	require.Len(t, kept, 2)
+
+	_, err = querier.SelectMergeStacktracesMulti(context.Background(), connect.NewRequest(&querierv1.SelectMergeStacktracesMultiRequest{}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+}
+
 func Test_SelectMergeProfile(t *testing.T) {
 	req := connect.NewRequest(&querierv1.SelectMergeProfileRequest{
 		LabelSelector: `{app="foo"}`,
@@ -346,7 +741,7 @@ func Test_SelectMergeProfile(t *testing.T) {
 			q.On("MergeProfilesPprof", mock.Anything).Once().Return(bidi3)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	res, err := querier.SelectMergeProfile(context.Background(), req)
 	require.NoError(t, err)
@@ -459,7 +854,7 @@ func TestSelectSeries(t *testing.T) {
 			q.On("MergeProfilesLabels", mock.Anything).Once().Return(bidi3)
 		}
 		return q, nil
-	}, log.NewLogfmtLogger(os.Stdout))
+	}, validation.MockDefaultOverrides(), log.NewLogfmtLogger(os.Stdout))
 	require.NoError(t, err)
 	res, err := querier.SelectSeries(context.Background(), req)
 	require.NoError(t, err)
@@ -490,6 +885,8 @@ func TestSelectSeries(t *testing.T) {
 type fakeQuerierIngester struct {
 	mock.Mock
 	testhelper.FakePoolClient
+	// legacy ingesters don't implement the Capabilities endpoint.
+	legacy bool
 }
 
 func newFakeQuerier() *fakeQuerierIngester {
@@ -568,6 +965,8 @@ type fakeBidiClientStacktraces struct {
 	batches  []*ingestv1.ProfileSets
 	kept     []testProfile
 	cur      *ingestv1.ProfileSets
+	// requests is the number of requests merged at once.
+	requests int
 }
 
 func newFakeBidiClientStacktraces(batches []*ingestv1.ProfileSets) *fakeBidiClientStacktraces {
@@ -581,7 +980,8 @@ func newFakeBidiClientStacktraces(batches []*ingestv1.ProfileSets) *fakeBidiClie
 }
 
 func (f *fakeBidiClientStacktraces) Send(in *ingestv1.MergeProfilesStacktracesRequest) error {
-	if in.Request != nil {
+	if in.Request != nil || len(in.Requests) > 0 {
+		f.requests = len(in.Requests)
 		return nil
 	}
 	for i, b := range in.Profiles {
@@ -604,14 +1004,23 @@ func (f *fakeBidiClientStacktraces) Send(in *ingestv1.MergeProfilesStacktracesRe
 func (f *fakeBidiClientStacktraces) Receive() (*ingestv1.MergeProfilesStacktracesResponse, error) {
 	profiles := <-f.profiles
 	if profiles == nil {
-		return &ingestv1.MergeProfilesStacktracesResponse{
-			Result: &ingestv1.MergeProfilesStacktracesResult{
+		result := func(value int64) *ingestv1.MergeProfilesStacktracesResult {
+			return &ingestv1.MergeProfilesStacktracesResult{
 				Stacktraces: []*ingestv1.StacktraceSample{
-					{FunctionIds: []int32{0, 1, 2}, Value: 1},
+					{FunctionIds: []int32{0, 1, 2}, Value: value},
 				},
 				FunctionNames: []string{"foo", "bar", "buzz"},
-			},
-		}, nil
+			}
+		}
+		if f.requests > 0 {
+			// the value of the stacktrace of the result of the i-th request is i+1.
+			res := &ingestv1.MergeProfilesStacktracesResponse{}
+			for i := 0; i < f.requests; i++ {
+				res.Results = append(res.Results, result(int64(i+1)))
+			}
+			return res, nil
+		}
+		return &ingestv1.MergeProfilesStacktracesResponse{Result: result(1)}, nil
 	}
 	f.cur = profiles
 	return &ingestv1.MergeProfilesStacktracesResponse{
@@ -734,6 +1143,103 @@ func (f *fakeBidiClientSeries) Receive() (*ingestv1.MergeProfilesLabelsResponse,
 func (f *fakeBidiClientSeries) CloseRequest() error  { return nil }
 func (f *fakeBidiClientSeries) CloseResponse() error { return nil }
 
+func (f *fakeQuerierIngester) StorageUsage(ctx context.Context, req *connect.Request[ingestv1.StorageUsageRequest]) (*connect.Response[ingestv1.StorageUsageResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.StorageUsageResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.StorageUsageResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) SelectProfileIDs(ctx context.Context, req *connect.Request[ingestv1.SelectProfileIDsRequest]) (*connect.Response[ingestv1.SelectProfileIDsResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.SelectProfileIDsResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.SelectProfileIDsResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) SelectHistograms(ctx context.Context, req *connect.Request[ingestv1.SelectHistogramsRequest]) (*connect.Response[ingestv1.SelectHistogramsResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.SelectHistogramsResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.SelectHistogramsResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) SelectTargetMetadata(ctx context.Context, req *connect.Request[ingestv1.SelectTargetMetadataRequest]) (*connect.Response[ingestv1.SelectTargetMetadataResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.SelectTargetMetadataResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.SelectTargetMetadataResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) BlockMetadata(ctx context.Context, req *connect.Request[ingestv1.BlockMetadataRequest]) (*connect.Response[ingestv1.BlockMetadataResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.BlockMetadataResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.BlockMetadataResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) GetProfile(ctx context.Context, req *connect.Request[ingestv1.GetProfileRequest]) (*connect.Response[ingestv1.GetProfileResponse], error) {
+	var (
+		args = f.Called(ctx, req)
+		res  *connect.Response[ingestv1.GetProfileResponse]
+		err  error
+	)
+	if args[0] != nil {
+		res = args[0].(*connect.Response[ingestv1.GetProfileResponse])
+	}
+	if args[1] != nil {
+		err = args.Get(1).(error)
+	}
+	return res, err
+}
+
+func (f *fakeQuerierIngester) Capabilities(ctx context.Context, req *connect.Request[ingestv1.CapabilitiesRequest]) (*connect.Response[ingestv1.CapabilitiesResponse], error) {
+	if f.legacy {
+		return nil, connect.NewError(connect.CodeUnimplemented, errors.New("not implemented"))
+	}
+	return connect.NewResponse(&ingestv1.CapabilitiesResponse{Features: clientpool.Features}), nil
+}
+
 func (f *fakeQuerierIngester) MergeProfilesStacktraces(ctx context.Context) clientpool.BidiClientMergeProfilesStacktraces {
 	var (
 		args = f.Called(ctx)
@@ -840,6 +1346,82 @@ func TestRangeSeries(t *testing.T) {
 	}
 }
 
+func TestStepMillis(t *testing.T) {
+	step, err := stepMillis(0.001)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), step)
+	for _, s := range []float64{0, 0.0001, -1} {
+		_, err := stepMillis(s)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	}
+}
+
+func TestCheckFilledSteps(t *testing.T) {
+	require.NoError(t, checkFilledSteps(0, 30*24*time.Hour.Milliseconds(), 1, querierv1.FillPolicy_FILL_POLICY_NULL))
+	require.NoError(t, checkFilledSteps(0, 10999, 1, querierv1.FillPolicy_FILL_POLICY_ZERO))
+	for _, fill := range []querierv1.FillPolicy{querierv1.FillPolicy_FILL_POLICY_ZERO, querierv1.FillPolicy_FILL_POLICY_PREVIOUS} {
+		err := checkFilledSteps(0, 30*24*time.Hour.Milliseconds(), 1, fill)
+		require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	}
+}
+
+func TestAlignStep(t *testing.T) {
+	require.Equal(t, int64(20), alignStep(11, 10, 0))
+	require.Equal(t, int64(20), alignStep(20, 10, 0))
+	require.Equal(t, int64(13), alignStep(11, 10, 3))
+	require.Equal(t, int64(-7), alignStep(-15, 10, 3))
+	require.Equal(t, int64(17), alignStep(11, 10, -3))
+}
+
+func TestFillSeries(t *testing.T) {
+	in := func() []*typesv1.Series {
+		return []*typesv1.Series{{
+			Labels: foobarlabels,
+			Points: []*typesv1.Point{
+				{Timestamp: 2, Value: 2},
+				{Timestamp: 4, Value: 4},
+			},
+		}}
+	}
+	for _, tc := range []struct {
+		fill querierv1.FillPolicy
+		out  []*typesv1.Point
+	}{
+		{
+			fill: querierv1.FillPolicy_FILL_POLICY_UNSPECIFIED,
+			out:  in()[0].Points,
+		},
+		{
+			fill: querierv1.FillPolicy_FILL_POLICY_NULL,
+			out:  in()[0].Points,
+		},
+		{
+			fill: querierv1.FillPolicy_FILL_POLICY_ZERO,
+			out: []*typesv1.Point{
+				{Timestamp: 1, Value: 0},
+				{Timestamp: 2, Value: 2},
+				{Timestamp: 3, Value: 0},
+				{Timestamp: 4, Value: 4},
+				{Timestamp: 5, Value: 0},
+			},
+		},
+		{
+			fill: querierv1.FillPolicy_FILL_POLICY_PREVIOUS,
+			out: []*typesv1.Point{
+				{Timestamp: 2, Value: 2},
+				{Timestamp: 3, Value: 2},
+				{Timestamp: 4, Value: 4},
+				{Timestamp: 5, Value: 4},
+			},
+		},
+	} {
+		t.Run(tc.fill.String(), func(t *testing.T) {
+			out := fillSeries(in(), 1, 5, 1, tc.fill)
+			testhelper.EqualProto(t, []*typesv1.Series{{Labels: foobarlabels, Points: tc.out}}, out)
+		})
+	}
+}
+
 // The code below can be useful for testing deduping directly to a cluster.
 // func TestDedupeLive(t *testing.T) {
 // 	clients, err := createClients(context.Background())
@@ -0,0 +1,91 @@
+package querier
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+)
+
+// LookbackLimits are the limits of the time range of the queries.
+type LookbackLimits interface {
+	MaxQueryLookback(tenantID string) time.Duration
+}
+
+type queryLookback struct {
+	limits LookbackLimits
+	now    func() model.Time
+}
+
+// NewQueryLookbackInterceptor returns the interceptor of the querier API which enforces the
+// maximum look-back of the tenants. The time ranges of the queries starting before it are
+// clamped, and the queries ending before it are rejected.
+func NewQueryLookbackInterceptor(limits LookbackLimits) connect.Interceptor {
+	l := &queryLookback{limits: limits, now: model.Now}
+	return connect.UnaryInterceptorFunc(l.wrapUnary)
+}
+
+func (l *queryLookback) wrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient {
+			return next(ctx, req)
+		}
+		tenantID, err := tenant.ExtractTenantIDFromContext(ctx)
+		if err != nil {
+			return next(ctx, req)
+		}
+		lookback := l.limits.MaxQueryLookback(tenantID)
+		if lookback <= 0 {
+			return next(ctx, req)
+		}
+		minStart := int64(l.now().Add(-lookback))
+		clamp := func(start, end *int64) error {
+			if *end < minStart {
+				return fmt.Errorf("the query time range ends before the maximum look-back of %s (max_query_lookback)", model.Duration(lookback))
+			}
+			if *start < minStart {
+				*start = minStart
+			}
+			return nil
+		}
+
+		switch msg := req.Any().(type) {
+		case *querierv1.SelectMergeStacktracesRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectMergeProfileRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectSeriesRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectHeatmapRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.StorageUsageRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectProfileIDsRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.GetProfileRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectStackSeriesRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectOffCPURequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectTargetMetadataRequest:
+			err = clamp(&msg.Start, &msg.End)
+		case *querierv1.SelectMergeStacktracesMultiRequest:
+			for name, q := range msg.Queries {
+				if err = clamp(&q.Start, &q.End); err != nil {
+					err = fmt.Errorf("query %q: %w", name, err)
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		return next(ctx, req)
+	}
+}
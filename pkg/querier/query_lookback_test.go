@@ -0,0 +1,57 @@
+package querier
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/pkg/tenant"
+	"github.com/grafana/phlare/pkg/validation"
+)
+
+func Test_QueryLookback(t *testing.T) {
+	overrides := validation.MockOverrides(func(defaults *validation.Limits, tenantLimits map[string]*validation.Limits) {
+		l := validation.MockDefaultLimits()
+		l.MaxQueryLookback = model.Duration(24 * time.Hour)
+		tenantLimits["user-1"] = l
+	})
+	now := model.TimeFromUnixNano(time.Date(2023, time.June, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	l := &queryLookback{limits: overrides, now: func() model.Time { return now }}
+	var received connect.AnyRequest
+	call := l.wrapUnary(func(_ context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		received = req
+		return nil, nil
+	})
+
+	minStart := int64(now.Add(-24 * time.Hour))
+	req := connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{Start: 0, End: int64(now)})
+	_, err := call(tenant.InjectTenantID(context.Background(), "user-1"), req)
+	require.NoError(t, err)
+	require.Equal(t, minStart, received.Any().(*querierv1.SelectMergeStacktracesRequest).Start)
+
+	// the queries within the look-back are left untouched.
+	req = connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{Start: minStart + 1, End: int64(now)})
+	_, err = call(tenant.InjectTenantID(context.Background(), "user-1"), req)
+	require.NoError(t, err)
+	require.Equal(t, minStart+1, req.Msg.Start)
+
+	// the queries ending before it are rejected.
+	_, err = call(tenant.InjectTenantID(context.Background(), "user-1"), connect.NewRequest(&querierv1.SelectSeriesRequest{Start: 0, End: minStart - 1}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	_, err = call(tenant.InjectTenantID(context.Background(), "user-1"), connect.NewRequest(&querierv1.SelectMergeStacktracesMultiRequest{
+		Queries: map[string]*querierv1.SelectMergeStacktracesRequest{"before": {Start: 0, End: minStart - 1}},
+	}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+	require.Contains(t, err.Error(), `query "before"`)
+
+	// the tenants without limit are left untouched.
+	req = connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{Start: 0, End: int64(now)})
+	_, err = call(tenant.InjectTenantID(context.Background(), "user-2"), req)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), req.Msg.Start)
+}
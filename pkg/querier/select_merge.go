@@ -3,6 +3,7 @@ package querier
 import (
 	"container/heap"
 	"context"
+	"fmt"
 
 	"github.com/google/pprof/profile"
 	"github.com/grafana/dskit/multierror"
@@ -168,7 +169,12 @@ func (s *mergeIterator[R, Req, Res]) Result() (R, error) {
 			s.err = err
 			return result, err
 		}
-		result = any(res.Result).(R)
+		// the merges of several requests are returned per request.
+		if results, ok := any(res.Results).(R); ok {
+			result = results
+		} else {
+			result = any(res.Result).(R)
+		}
 	case BidiClientMerge[*ingestv1.MergeProfilesLabelsRequest, *ingestv1.MergeProfilesLabelsResponse]:
 		res, err := bidi.Receive()
 		if err != nil {
@@ -307,7 +313,8 @@ type stacktraces struct {
 }
 
 // selectMergeStacktraces selects the  profile from each ingester by deduping them and request merges of stacktraces of them.
-func selectMergeStacktraces(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]) ([]stacktraces, error) {
+// It returns the variance of the total of the stacktraces, estimated when the ingesters sample the profiles.
+func selectMergeStacktraces(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]) ([]stacktraces, float64, error) {
 	mergeResults := make([]MergeResult[*ingestv1.MergeProfilesStacktracesResult], len(responses))
 	iters := make([]MergeIterator, len(responses))
 	for i, resp := range responses {
@@ -321,7 +328,7 @@ func selectMergeStacktraces(ctx context.Context, responses []responseFromIngeste
 	}
 
 	if err := skipDuplicates(iters); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	// Collects the results in parallel.
@@ -342,9 +349,10 @@ func selectMergeStacktraces(ctx context.Context, responses []responseFromIngeste
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	return mergeProfilesStacktracesResult(results), nil
+	st, variance := mergeProfilesStacktracesResult(results)
+	return st, variance, nil
 }
 
 // selectMergePprofProfile selects the  profile from each ingester by deduping them and request merges of stacktraces in the pprof format.
@@ -397,7 +405,7 @@ func selectMergePprofProfile(ctx context.Context, responses []responseFromIngest
 }
 
 // mergeProfilesStacktracesResult merges the results of multiple MergeProfilesStacktraces into a single result.
-func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktracesResult) []stacktraces {
+func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktracesResult) ([]stacktraces, float64) {
 	merge := phlaremodel.MergeBatchMergeStacktraces(results...)
 	result := make([]stacktraces, 0, len(merge.Stacktraces))
 	for _, st := range merge.Stacktraces {
@@ -410,7 +418,58 @@ func mergeProfilesStacktracesResult(results []*ingestv1.MergeProfilesStacktraces
 			locations: locs,
 		})
 	}
-	return result
+	return result, merge.TotalVariance
+}
+
+// selectMergeStacktracesMulti selects the profiles of each of the n requests from all ingesters,
+// dedupes them and merges their stacktraces per request.
+func selectMergeStacktracesMulti(ctx context.Context, responses []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces], n int) ([][]stacktraces, error) {
+	mergeResults := make([]MergeResult[[]*ingestv1.MergeProfilesStacktracesResult], len(responses))
+	iters := make([]MergeIterator, len(responses))
+	for i, resp := range responses {
+		it := NewMergeIterator[[]*ingestv1.MergeProfilesStacktracesResult](
+			ctx, responseFromIngesters[BidiClientMerge[*ingestv1.MergeProfilesStacktracesRequest, *ingestv1.MergeProfilesStacktracesResponse]]{
+				addr:     resp.addr,
+				response: resp.response,
+			})
+		iters[i] = it
+		mergeResults[i] = it
+	}
+
+	if err := skipDuplicates(iters); err != nil {
+		return nil, err
+	}
+
+	// Collects the results in parallel, per request.
+	results := make([][]*ingestv1.MergeProfilesStacktracesResult, n)
+	s := lo.Synchronize()
+	g, _ := errgroup.WithContext(ctx)
+	for _, iter := range mergeResults {
+		iter := iter
+		g.Go(func() error {
+			result, err := iter.Result()
+			if err != nil {
+				return err
+			}
+			if len(result) != n {
+				return fmt.Errorf("expected %d results, got %d", n, len(result))
+			}
+			s.Do(func() {
+				for i := range results {
+					results[i] = append(results[i], result[i])
+				}
+			})
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	st := make([][]stacktraces, n)
+	for i := range results {
+		st[i], _ = mergeProfilesStacktracesResult(results[i])
+	}
+	return st, nil
 }
 
 type ProfileValue struct {
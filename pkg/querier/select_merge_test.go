@@ -64,7 +64,7 @@ func TestSelectMergeStacktraces(t *testing.T) {
 			},
 		},
 	})
-	res, err := selectMergeStacktraces(context.Background(), []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]{
+	res, _, err := selectMergeStacktraces(context.Background(), []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]{
 		{
 			response: resp1,
 		},
@@ -90,7 +90,7 @@ func TestSelectMergeStacktraces(t *testing.T) {
 		{Ts: 5, Labels: &typesv1.Labels{Labels: foobarlabels}},
 		{Ts: 6, Labels: &typesv1.Labels{Labels: foobarlabels}},
 	})
-	res, err = selectMergeStacktraces(context.Background(), []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]{
+	res, _, err = selectMergeStacktraces(context.Background(), []responseFromIngesters[clientpool.BidiClientMergeProfilesStacktraces]{
 		{
 			response: newFakeBidiClientStacktraces([]*ingestv1.ProfileSets{
 				{
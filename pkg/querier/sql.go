@@ -0,0 +1,298 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+type sqlResponse struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// sqlRow is a group of samples, with the values of the grouped columns and the sum of the samples.
+type sqlRow struct {
+	keys  []string
+	value float64
+}
+
+// SQLHandler runs restricted SQL queries over the samples of the profiles, from the time range
+// given by the from parameter:
+//
+//	/api/experimental/sql?query=SELECT pod, sum(value) FROM samples WHERE profile_type = '...' GROUP BY pod&from=now-1h
+//
+// The queries are planned on top of the querier API, sent through the given client: samples
+// grouped by function are merged into a flamegraph, other groups are merged into series.
+type SQLHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewSQLHandler(client querierv1connect.QuerierServiceClient) *SQLHandler {
+	return &SQLHandler{client: client}
+}
+
+func (h *SQLHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Form.Get("query") == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+	q, err := parseSQL(req.Form.Get("query"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse query: %v", err), http.StatusBadRequest)
+		return
+	}
+	// default start and end to now-1h
+	end := model.TimeFromUnixNano(time.Now().UnixNano())
+	start := end.Add(-time.Hour)
+	if from := req.Form.Get("from"); from != "" {
+		from, err := parseRelativeTime(from)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse from: %v", err), http.StatusBadRequest)
+			return
+		}
+		start = end.Add(-from)
+	}
+
+	rows, err := h.execute(req.Context(), q, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	resp := sqlResponse{
+		Columns: make([]string, len(q.columns)),
+		Rows:    make([][]interface{}, 0, len(rows)),
+	}
+	for i, c := range q.columns {
+		resp.Columns[i] = c.String()
+	}
+	for _, r := range rows {
+		resp.Rows = append(resp.Rows, q.project(r))
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// execute runs the query and returns the rows, ordered and limited.
+func (h *SQLHandler) execute(ctx context.Context, q *sqlQuery, start, end model.Time) ([]sqlRow, error) {
+	var (
+		profileType string
+		functions   []sqlCondition
+		matchers    []*labels.Matcher
+	)
+	for _, c := range q.conditions {
+		switch c.column {
+		case sqlColumnProfileType:
+			profileType = c.value
+		case sqlColumnFunction:
+			functions = append(functions, c)
+		default:
+			m, err := labels.NewMatcher(c.matchType(), c.column, c.pattern())
+			if err != nil {
+				return nil, connect.NewError(connect.CodeInvalidArgument, err)
+			}
+			matchers = append(matchers, m)
+		}
+	}
+	// the profile type matcher makes sure the selector is never empty.
+	selector := convertMatchersToString(append([]*labels.Matcher{
+		labels.MustNewMatcher(labels.MatchEqual, phlaremodel.LabelNameProfileType, profileType),
+	}, matchers...))
+
+	var (
+		rows []sqlRow
+		err  error
+	)
+	if len(q.groupBy) == 1 && q.groupBy[0] == sqlColumnFunction {
+		rows, err = h.selectFunctions(ctx, profileType, selector, functions, start, end)
+	} else {
+		rows, err = h.selectLabels(ctx, q, profileType, selector, functions, start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+	q.sort(rows)
+	if q.limit > 0 && len(rows) > q.limit {
+		rows = rows[:q.limit]
+	}
+	return rows, nil
+}
+
+// selectFunctions sums the self values of the functions of the flamegraph, which are the values of
+// the samples with the function as leaf.
+func (h *SQLHandler) selectFunctions(ctx context.Context, profileType, selector string, conditions []sqlCondition, start, end model.Time) ([]sqlRow, error) {
+	filters := make([]func(string) bool, 0, len(conditions))
+	for _, c := range conditions {
+		re, err := regexp.Compile("^(?:" + c.pattern() + ")$")
+		if err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, err)
+		}
+		negate := c.op == sqlOpNotEqual || c.op == sqlOpNotLike
+		filters = append(filters, func(name string) bool { return re.MatchString(name) != negate })
+	}
+	res, err := h.client.SelectMergeStacktraces(ctx, connect.NewRequest(&querierv1.SelectMergeStacktracesRequest{
+		ProfileTypeID: profileType,
+		LabelSelector: selector,
+		Start:         int64(start),
+		End:           int64(end),
+	}))
+	if err != nil {
+		return nil, err
+	}
+	fg := res.Msg.Flamegraph
+	if fg == nil {
+		return nil, nil
+	}
+	self := map[string]float64{}
+	for _, level := range fg.Levels {
+		for i := 0; i+3 < len(level.Values); i += 4 {
+			if level.Values[i+2] != 0 {
+				self[fg.Names[level.Values[i+3]]] += float64(level.Values[i+2])
+			}
+		}
+	}
+	rows := make([]sqlRow, 0, len(self))
+Names:
+	for name, value := range self {
+		for _, f := range filters {
+			if !f(name) {
+				continue Names
+			}
+		}
+		rows = append(rows, sqlRow{keys: []string{name}, value: value})
+	}
+	return rows, nil
+}
+
+// selectLabels sums the values of the series grouped by the labels, with a single step covering
+// the time range. Conditions on functions are applied by the ingesters.
+func (h *SQLHandler) selectLabels(ctx context.Context, q *sqlQuery, profileType, selector string, functions []sqlCondition, start, end model.Time) ([]sqlRow, error) {
+	req := &querierv1.SelectSeriesRequest{
+		ProfileTypeID: profileType,
+		LabelSelector: selector,
+		Start:         int64(end),
+		End:           int64(end),
+		GroupBy:       q.groupBy,
+		Step:          end.Sub(start).Seconds(),
+	}
+	if len(functions) > 0 {
+		req.Function = functions[0].pattern()
+	}
+	res, err := h.client.SelectSeries(ctx, connect.NewRequest(req))
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]sqlRow, 0, len(res.Msg.Series))
+	for _, s := range res.Msg.Series {
+		r := sqlRow{keys: make([]string, len(q.groupBy))}
+		for i, name := range q.groupBy {
+			r.keys[i] = phlaremodel.Labels(s.Labels).Get(name)
+		}
+		for _, p := range s.Points {
+			r.value += p.Value
+		}
+		rows = append(rows, r)
+	}
+	// without grouping, there is always a single row.
+	if len(q.groupBy) == 0 && len(rows) == 0 {
+		rows = append(rows, sqlRow{})
+	}
+	return rows, nil
+}
+
+func (c sqlCondition) matchType() labels.MatchType {
+	switch c.op {
+	case sqlOpNotEqual:
+		return labels.MatchNotEqual
+	case sqlOpLike:
+		return labels.MatchRegexp
+	case sqlOpNotLike:
+		return labels.MatchNotRegexp
+	}
+	return labels.MatchEqual
+}
+
+// pattern returns the value of the condition for equality operators, or the regular expression
+// of its LIKE pattern.
+func (c sqlCondition) pattern() string {
+	switch c.op {
+	case sqlOpLike, sqlOpNotLike:
+		return likeToRegexp(c.value)
+	case sqlOpEqual, sqlOpNotEqual:
+		if c.column == sqlColumnFunction {
+			return regexp.QuoteMeta(c.value)
+		}
+	}
+	return c.value
+}
+
+// sort orders the rows by the ordered column, or by the grouped columns.
+func (q *sqlQuery) sort(rows []sqlRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return q.less(rows[i], rows[j])
+	})
+}
+
+func (q *sqlQuery) less(a, b sqlRow) bool {
+	if q.orderBy != nil {
+		c := q.columns[q.orderBy.column]
+		if c.sum {
+			if a.value != b.value {
+				return (a.value < b.value) != q.orderBy.desc
+			}
+		} else if ka, kb := a.keys[q.groupIndex(c.name)], b.keys[q.groupIndex(c.name)]; ka != kb {
+			return (ka < kb) != q.orderBy.desc
+		}
+	}
+	for i := range a.keys {
+		if a.keys[i] != b.keys[i] {
+			return a.keys[i] < b.keys[i]
+		}
+	}
+	return false
+}
+
+func (q *sqlQuery) groupIndex(name string) int {
+	for i, n := range q.groupBy {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// project returns the selected columns of the row. The sum of a query without grouping and
+// without samples is null.
+func (q *sqlQuery) project(r sqlRow) []interface{} {
+	values := make([]interface{}, len(q.columns))
+	for i, c := range q.columns {
+		switch {
+		case !c.sum:
+			values[i] = r.keys[q.groupIndex(c.name)]
+		case r.keys == nil:
+			values[i] = nil
+		default:
+			values[i] = r.value
+		}
+	}
+	return values
+}
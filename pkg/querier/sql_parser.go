@@ -0,0 +1,474 @@
+package querier
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	sqlTable = "samples"
+
+	sqlColumnProfileType = "profile_type"
+	sqlColumnFunction    = "function"
+	sqlColumnValue       = "value"
+
+	sqlOpEqual    = "="
+	sqlOpNotEqual = "!="
+	sqlOpLike     = "LIKE"
+	sqlOpNotLike  = "NOT LIKE"
+)
+
+// sqlQuery is a query over the samples table, which has a row per sample with the name of its leaf
+// function, its value and the labels of its series as columns.
+//
+//	SELECT pod, sum(value) AS cpu FROM samples
+//	WHERE profile_type = 'process_cpu:cpu:nanoseconds:cpu:nanoseconds' AND namespace = 'prod'
+//	GROUP BY pod ORDER BY cpu DESC LIMIT 10
+type sqlQuery struct {
+	columns    []sqlColumn
+	conditions []sqlCondition
+	groupBy    []string
+	orderBy    *sqlOrder
+	limit      int
+}
+
+// sqlColumn is a selected column: a grouped column or sum(value).
+type sqlColumn struct {
+	name  string
+	sum   bool
+	alias string
+}
+
+func (c sqlColumn) String() string {
+	switch {
+	case c.alias != "":
+		return c.alias
+	case c.sum:
+		return "sum(value)"
+	}
+	return c.name
+}
+
+type sqlCondition struct {
+	column string
+	op     string
+	value  string
+}
+
+type sqlOrder struct {
+	// column is the index of the ordered column in the selected columns.
+	column int
+	desc   bool
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenEOF sqlTokenKind = iota
+	sqlTokenIdent
+	sqlTokenString
+	sqlTokenNumber
+	sqlTokenSymbol
+)
+
+type sqlToken struct {
+	kind  sqlTokenKind
+	value string
+	// quoted identifiers are never keywords.
+	quoted bool
+}
+
+func (t sqlToken) String() string {
+	switch t.kind {
+	case sqlTokenEOF:
+		return "end of query"
+	case sqlTokenString:
+		return strconv.Quote(t.value)
+	}
+	return t.value
+}
+
+func lexSQL(s string) ([]sqlToken, error) {
+	var tokens []sqlToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isSQLIdentChar(c) && !isDigit(c):
+			j := i + 1
+			for j < len(s) && isSQLIdentChar(s[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenIdent, value: s[i:j]})
+			i = j
+		case isDigit(c):
+			j := i + 1
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenNumber, value: s[i:j]})
+			i = j
+		case c == '\'' || c == '"':
+			// quotes are escaped by doubling them.
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						value.WriteByte(s[j])
+						j++
+						continue
+					}
+					break
+				}
+				value.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, fmt.Errorf("unterminated quoted string at position %d", i)
+			}
+			if c == '\'' {
+				tokens = append(tokens, sqlToken{kind: sqlTokenString, value: value.String()})
+			} else {
+				tokens = append(tokens, sqlToken{kind: sqlTokenIdent, value: value.String(), quoted: true})
+			}
+			i = j + 1
+		case strings.HasPrefix(s[i:], "!=") || strings.HasPrefix(s[i:], "<>"):
+			tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, value: sqlOpNotEqual})
+			i += 2
+		case strings.IndexByte("(),=;", c) >= 0:
+			tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, value: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+		}
+	}
+	return append(tokens, sqlToken{kind: sqlTokenEOF}), nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isSQLIdentChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || isDigit(c)
+}
+
+type sqlParser struct {
+	tokens []sqlToken
+	pos    int
+}
+
+// parseSQL parses a query over the samples table. Only a subset of SQL is supported: the
+// conditions are a conjunction of comparisons of a column with a string, and the only aggregation
+// is sum(value).
+func parseSQL(s string) (*sqlQuery, error) {
+	tokens, err := lexSQL(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{tokens: tokens}
+	q, err := p.parseQuery()
+	if err != nil {
+		return nil, err
+	}
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *sqlParser) next() sqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != sqlTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next tokens if they are the given keywords.
+func (p *sqlParser) keyword(keywords ...string) bool {
+	t := p.peek()
+	if t.kind != sqlTokenIdent || t.quoted || !strings.EqualFold(t.value, keywords[0]) {
+		return false
+	}
+	for i, k := range keywords[1:] {
+		next := p.tokens[p.pos+i+1]
+		if next.kind != sqlTokenIdent || next.quoted || !strings.EqualFold(next.value, k) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+func (p *sqlParser) expectKeyword(keywords ...string) error {
+	if !p.keyword(keywords...) {
+		return fmt.Errorf("expected %s, got %s", strings.Join(keywords, " "), p.peek())
+	}
+	return nil
+}
+
+func (p *sqlParser) symbol(s string) bool {
+	if t := p.peek(); t.kind == sqlTokenSymbol && t.value == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expectSymbol(s string) error {
+	if !p.symbol(s) {
+		return fmt.Errorf("expected %q, got %s", s, p.peek())
+	}
+	return nil
+}
+
+func (p *sqlParser) identifier() (string, error) {
+	t := p.next()
+	if t.kind != sqlTokenIdent || (!t.quoted && isSQLKeyword(t.value)) {
+		return "", fmt.Errorf("expected a column, got %s", t)
+	}
+	return t.value, nil
+}
+
+func isSQLKeyword(s string) bool {
+	switch strings.ToUpper(s) {
+	case "SELECT", "FROM", "WHERE", "AND", "GROUP", "BY", "ORDER", "ASC", "DESC", "LIMIT", "AS", "NOT", "LIKE":
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) parseQuery() (*sqlQuery, error) {
+	q := &sqlQuery{}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	for {
+		c, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		q.columns = append(q.columns, c)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	if table != sqlTable {
+		return nil, fmt.Errorf("unknown table %q, only %q can be queried", table, sqlTable)
+	}
+	if p.keyword("WHERE") {
+		for {
+			c, err := p.parseCondition()
+			if err != nil {
+				return nil, err
+			}
+			q.conditions = append(q.conditions, c)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("GROUP", "BY") {
+		for {
+			name, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			q.groupBy = append(q.groupBy, name)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("ORDER", "BY") {
+		if q.orderBy, err = p.parseOrder(q.columns); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("LIMIT") {
+		t := p.next()
+		if t.kind != sqlTokenNumber {
+			return nil, fmt.Errorf("expected a number after LIMIT, got %s", t)
+		}
+		if q.limit, err = strconv.Atoi(t.value); err != nil || q.limit == 0 {
+			return nil, fmt.Errorf("invalid limit %s", t.value)
+		}
+	}
+	p.symbol(";")
+	if t := p.peek(); t.kind != sqlTokenEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return q, nil
+}
+
+func (p *sqlParser) parseColumn() (sqlColumn, error) {
+	var c sqlColumn
+	if t := p.peek(); t.kind == sqlTokenIdent && !t.quoted && strings.EqualFold(t.value, "sum") && p.tokens[p.pos+1].value == "(" {
+		p.pos += 2
+		name, err := p.identifier()
+		if err != nil {
+			return c, err
+		}
+		if name != sqlColumnValue {
+			return c, fmt.Errorf("only %s can be summed", sqlColumnValue)
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return c, err
+		}
+		c.sum = true
+	} else {
+		name, err := p.identifier()
+		if err != nil {
+			return c, err
+		}
+		c.name = name
+	}
+	if p.keyword("AS") {
+		alias, err := p.identifier()
+		if err != nil {
+			return c, err
+		}
+		c.alias = alias
+	}
+	return c, nil
+}
+
+func (p *sqlParser) parseCondition() (sqlCondition, error) {
+	var (
+		c   sqlCondition
+		err error
+	)
+	if c.column, err = p.identifier(); err != nil {
+		return c, err
+	}
+	switch {
+	case p.symbol("="):
+		c.op = sqlOpEqual
+	case p.symbol(sqlOpNotEqual):
+		c.op = sqlOpNotEqual
+	case p.keyword("LIKE"):
+		c.op = sqlOpLike
+	case p.keyword("NOT", "LIKE"):
+		c.op = sqlOpNotLike
+	default:
+		return c, fmt.Errorf("expected a comparison operator, got %s", p.peek())
+	}
+	t := p.next()
+	if t.kind != sqlTokenString {
+		return c, fmt.Errorf("expected a string, got %s", t)
+	}
+	c.value = t.value
+	return c, nil
+}
+
+// parseOrder parses the ordered column, which must be one of the selected columns, by name or by alias.
+func (p *sqlParser) parseOrder(columns []sqlColumn) (*sqlOrder, error) {
+	var (
+		o    = &sqlOrder{column: -1}
+		name string
+		err  error
+	)
+	if t := p.peek(); t.kind == sqlTokenIdent && !t.quoted && strings.EqualFold(t.value, "sum") && p.tokens[p.pos+1].value == "(" {
+		c, err := p.parseColumn()
+		if err != nil {
+			return nil, err
+		}
+		name = c.String()
+		for i, c := range columns {
+			if c.sum {
+				o.column = i
+			}
+		}
+	} else if name, err = p.identifier(); err != nil {
+		return nil, err
+	}
+	for i, c := range columns {
+		if o.column < 0 && (c.String() == name || (!c.sum && c.name == name)) {
+			o.column = i
+		}
+	}
+	if o.column < 0 {
+		return nil, fmt.Errorf("cannot order by %s, which is not selected", name)
+	}
+	if !p.keyword("ASC") {
+		o.desc = p.keyword("DESC")
+	}
+	return o, nil
+}
+
+func (q *sqlQuery) validate() error {
+	grouped := map[string]bool{}
+	for _, name := range q.groupBy {
+		if name == sqlColumnValue || name == sqlColumnProfileType {
+			return fmt.Errorf("cannot group by %s", name)
+		}
+		grouped[name] = true
+	}
+	for _, c := range q.columns {
+		if !c.sum && !grouped[c.name] {
+			return fmt.Errorf("column %s must be grouped or summed", c.name)
+		}
+	}
+	if grouped[sqlColumnFunction] && len(q.groupBy) > 1 {
+		return fmt.Errorf("cannot group by %s and by labels", sqlColumnFunction)
+	}
+	var profileTypes, functions int
+	for _, c := range q.conditions {
+		switch c.column {
+		case sqlColumnValue:
+			return fmt.Errorf("cannot filter on %s", sqlColumnValue)
+		case sqlColumnProfileType:
+			if c.op != sqlOpEqual {
+				return fmt.Errorf("%s can only be compared with =", sqlColumnProfileType)
+			}
+			profileTypes++
+		case sqlColumnFunction:
+			// without grouping by function, the samples are filtered by the ingesters, which only
+			// select the matching functions.
+			if !grouped[sqlColumnFunction] && c.op != sqlOpEqual && c.op != sqlOpLike {
+				return fmt.Errorf("%s can only be compared with = or LIKE unless grouped", sqlColumnFunction)
+			}
+			functions++
+		}
+	}
+	if !grouped[sqlColumnFunction] && functions > 1 {
+		return fmt.Errorf("%s can only be filtered once unless grouped", sqlColumnFunction)
+	}
+	if profileTypes != 1 {
+		return fmt.Errorf("exactly one condition on %s is required", sqlColumnProfileType)
+	}
+	return nil
+}
+
+// likeToRegexp converts a LIKE pattern to an anchored regular expression.
+func likeToRegexp(pattern string) string {
+	var re strings.Builder
+	re.WriteByte('^')
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteByte('.')
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteByte('$')
+	return re.String()
+}
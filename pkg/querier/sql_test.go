@@ -0,0 +1,133 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+type fakeSQLClient struct {
+	querierv1connect.QuerierServiceClient
+	series   []*typesv1.Series
+	requests []interface{}
+}
+
+func (c *fakeSQLClient) SelectSeries(_ context.Context, req *connect.Request[querierv1.SelectSeriesRequest]) (*connect.Response[querierv1.SelectSeriesResponse], error) {
+	c.requests = append(c.requests, req.Msg)
+	return connect.NewResponse(&querierv1.SelectSeriesResponse{Series: c.series}), nil
+}
+
+// SelectMergeStacktraces returns the flamegraph of main (self 1) calling a (self 5) and b (self 3),
+// which also calls a (self 2).
+func (c *fakeSQLClient) SelectMergeStacktraces(_ context.Context, req *connect.Request[querierv1.SelectMergeStacktracesRequest]) (*connect.Response[querierv1.SelectMergeStacktracesResponse], error) {
+	c.requests = append(c.requests, req.Msg)
+	return connect.NewResponse(&querierv1.SelectMergeStacktracesResponse{
+		Flamegraph: &querierv1.FlameGraph{
+			Names: []string{"total", "main", "a", "b"},
+			Levels: []*querierv1.Level{
+				{Values: []int64{0, 11, 0, 0}},
+				{Values: []int64{0, 11, 1, 1}},
+				{Values: []int64{0, 5, 5, 2, 0, 5, 3, 3}},
+				{Values: []int64{5, 2, 2, 2}},
+			},
+			Total: 11,
+		},
+	}), nil
+}
+
+func Test_ParseSQL(t *testing.T) {
+	q, err := parseSQL(`select pod, SUM(value) as cpu from samples where profile_type = 'cpu' and "namespace" like 'prod-%' group by pod order by cpu desc limit 2;`)
+	require.NoError(t, err)
+	require.Equal(t, &sqlQuery{
+		columns: []sqlColumn{{name: "pod"}, {sum: true, alias: "cpu"}},
+		conditions: []sqlCondition{
+			{column: "profile_type", op: sqlOpEqual, value: "cpu"},
+			{column: "namespace", op: sqlOpLike, value: "prod-%"},
+		},
+		groupBy: []string{"pod"},
+		orderBy: &sqlOrder{column: 1, desc: true},
+		limit:   2,
+	}, q)
+
+	for _, query := range []string{
+		`SELECT sum(value) FROM profiles WHERE profile_type = 'cpu'`,
+		`SELECT sum(value) FROM samples`,
+		`SELECT pod FROM samples WHERE profile_type = 'cpu'`,
+		`SELECT sum(timestamp) FROM samples WHERE profile_type = 'cpu'`,
+		`SELECT function, pod, sum(value) FROM samples WHERE profile_type = 'cpu' GROUP BY function, pod`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu' AND function != 'main'`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu' AND value = '1'`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu' ORDER BY pod`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu' LIMIT 0`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu`,
+		`SELECT sum(value) FROM samples WHERE profile_type = 'cpu' OR pod = 'a'`,
+	} {
+		_, err := parseSQL(query)
+		require.Error(t, err, query)
+	}
+}
+
+func Test_LikeToRegexp(t *testing.T) {
+	require.Equal(t, `^runtime\.gc.*Worker..$`, likeToRegexp("runtime.gc%Worker__"))
+}
+
+func Test_SQLHandler(t *testing.T) {
+	query := func(t *testing.T, client querierv1connect.QuerierServiceClient, sql string) (int, sqlResponse) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		NewSQLHandler(client).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/experimental/sql?"+url.Values{"query": []string{sql}}.Encode(), nil))
+		var resp sqlResponse
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		}
+		return rec.Code, resp
+	}
+
+	t.Run("group by labels", func(t *testing.T) {
+		client := &fakeSQLClient{series: []*typesv1.Series{
+			{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "a"}}, Points: []*typesv1.Point{{Value: 1}, {Value: 2}}},
+			{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "b"}}, Points: []*typesv1.Point{{Value: 5}}},
+			{Labels: []*typesv1.LabelPair{{Name: "pod", Value: "c"}}, Points: []*typesv1.Point{{Value: 4}}},
+		}}
+		code, resp := query(t, client, `SELECT pod, sum(value) FROM samples WHERE profile_type = 'process_cpu:cpu:nanoseconds:cpu:nanoseconds' AND namespace != 'dev' AND function LIKE 'runtime.%' GROUP BY pod ORDER BY sum(value) DESC LIMIT 2`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"pod", "sum(value)"}, resp.Columns)
+		require.Equal(t, [][]interface{}{{"b", 5.}, {"c", 4.}}, resp.Rows)
+
+		require.Len(t, client.requests, 1)
+		req := client.requests[0].(*querierv1.SelectSeriesRequest)
+		require.Equal(t, `{__profile_type__="process_cpu:cpu:nanoseconds:cpu:nanoseconds",namespace!="dev"}`, req.LabelSelector)
+		require.Equal(t, []string{"pod"}, req.GroupBy)
+		require.Equal(t, `^runtime\..*$`, req.Function)
+		require.Equal(t, req.Start, req.End)
+		require.Equal(t, 3600., req.Step)
+	})
+
+	t.Run("without group by and samples", func(t *testing.T) {
+		code, resp := query(t, &fakeSQLClient{}, `SELECT sum(value) FROM samples WHERE profile_type = 'process_cpu:cpu:nanoseconds:cpu:nanoseconds'`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, [][]interface{}{{nil}}, resp.Rows)
+	})
+
+	t.Run("group by function", func(t *testing.T) {
+		code, resp := query(t, &fakeSQLClient{}, `SELECT function, sum(value) AS self FROM samples WHERE profile_type = 'process_cpu:cpu:nanoseconds:cpu:nanoseconds' AND function != 'b' GROUP BY function`)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"function", "self"}, resp.Columns)
+		require.Equal(t, [][]interface{}{{"a", 7.}, {"main", 1.}}, resp.Rows)
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		code, _ := query(t, &fakeSQLClient{}, `SELECT * FROM samples`)
+		require.Equal(t, http.StatusBadRequest, code)
+	})
+}
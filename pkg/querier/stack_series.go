@@ -0,0 +1,47 @@
+package querier
+
+import (
+	"sort"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// topStackSeries sums the values of the profiles per series and returns the series by decreasing
+// value. Series without value under the node are left out. At most limit series are returned
+// when limit is positive.
+func topStackSeries(it iter.Iterator[ProfileValue], limit int64) []*querierv1.StackSeries {
+	defer it.Close()
+	seriesByHash := map[uint64]*querierv1.StackSeries{}
+	var result []*querierv1.StackSeries
+	for it.Next() {
+		p := it.At()
+		series, ok := seriesByHash[p.LabelsHash]
+		if !ok {
+			series = &querierv1.StackSeries{Labels: p.Lbs}
+			seriesByHash[p.LabelsHash] = series
+			result = append(result, series)
+		}
+		series.Value += int64(p.Value)
+	}
+
+	n := 0
+	for _, s := range result {
+		if s.Value > 0 {
+			result[n] = s
+			n++
+		}
+	}
+	result = result[:n]
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Value != result[j].Value {
+			return result[i].Value > result[j].Value
+		}
+		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package querier
+
+import (
+	"testing"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/iter"
+	"github.com/grafana/phlare/pkg/testhelper"
+)
+
+func TestTopStackSeries(t *testing.T) {
+	pod := func(name string) []*typesv1.LabelPair {
+		return []*typesv1.LabelPair{{Name: "pod", Value: name}}
+	}
+	in := []ProfileValue{
+		{Ts: 1, Lbs: pod("a"), LabelsHash: 1, Value: 3},
+		{Ts: 2, Lbs: pod("a"), LabelsHash: 1, Value: 4},
+		{Ts: 1, Lbs: pod("b"), LabelsHash: 2, Value: 10},
+		{Ts: 1, Lbs: pod("c"), LabelsHash: 3, Value: 0},
+		{Ts: 1, Lbs: pod("d"), LabelsHash: 4, Value: 7},
+	}
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		out   []*querierv1.StackSeries
+	}{
+		{
+			name: "no limit",
+			out: []*querierv1.StackSeries{
+				{Labels: pod("b"), Value: 10},
+				{Labels: pod("a"), Value: 7},
+				{Labels: pod("d"), Value: 7},
+			},
+		},
+		{
+			name:  "limit",
+			limit: 2,
+			out: []*querierv1.StackSeries{
+				{Labels: pod("b"), Value: 10},
+				{Labels: pod("a"), Value: 7},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testhelper.EqualProto(t, tc.out, topStackSeries(iter.NewSliceIterator(in), tc.limit))
+		})
+	}
+}
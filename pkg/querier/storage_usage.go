@@ -0,0 +1,40 @@
+package querier
+
+import (
+	"sort"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+)
+
+// mergeStorageUsage sums the usage of the ingesters per label value, by decreasing bytes. Each
+// profile is stored by as many ingesters as the replication factor, so the sums are divided by it.
+func mergeStorageUsage(responses []responseFromIngesters[[]*ingestv1.LabelValueUsage], replicationFactor int) []*querierv1.LabelValueUsage {
+	usage := make(map[string]*querierv1.LabelValueUsage)
+	for _, r := range responses {
+		for _, u := range r.response {
+			m, ok := usage[u.Value]
+			if !ok {
+				m = &querierv1.LabelValueUsage{Value: u.Value}
+				usage[u.Value] = m
+			}
+			m.Bytes += u.Bytes
+			m.Profiles += u.Profiles
+		}
+	}
+	result := make([]*querierv1.LabelValueUsage, 0, len(usage))
+	for _, u := range usage {
+		if replicationFactor > 1 {
+			u.Bytes /= uint64(replicationFactor)
+			u.Profiles /= uint64(replicationFactor)
+		}
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result
+}
@@ -0,0 +1,220 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/opentracing/opentracing-go"
+	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/ingester/clientpool"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+)
+
+// profileTypeLabels are the labels of a series set from its profile type, which are not labels of
+// its target.
+var profileTypeLabels = map[string]struct{}{
+	model.MetricNameLabel:            {},
+	phlaremodel.LabelNameProfileType: {},
+	phlaremodel.LabelNameType:        {},
+	phlaremodel.LabelNameUnit:        {},
+	phlaremodel.LabelNamePeriodType:  {},
+	phlaremodel.LabelNamePeriodUnit:  {},
+}
+
+// SelectTargetMetadata returns the metadata of the targets of the matching series seen in the
+// time range, such as their build version, by target. The series of all the profile types of a
+// target share its metadata.
+func (q *Querier) SelectTargetMetadata(ctx context.Context, req *connect.Request[querierv1.SelectTargetMetadataRequest]) (*connect.Response[querierv1.SelectTargetMetadataResponse], error) {
+	sp, ctx := opentracing.StartSpanFromContext(ctx, "SelectTargetMetadata")
+	defer func() {
+		sp.LogFields(
+			otlog.String("start", model.Time(req.Msg.Start).Time().String()),
+			otlog.String("end", model.Time(req.Msg.End).Time().String()),
+			otlog.String("selector", req.Msg.LabelSelector),
+			otlog.String("metadata_selector", req.Msg.MetadataSelector),
+		)
+		sp.Finish()
+	}()
+	if req.Msg.Start > req.Msg.End {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("start must be before end"))
+	}
+	var metadataMatchers []*labels.Matcher
+	if req.Msg.MetadataSelector != "" {
+		var err error
+		if metadataMatchers, err = phlaremodel.ParseSelector(req.Msg.MetadataSelector); err != nil {
+			return nil, connect.NewError(connect.CodeInvalidArgument, errors.Wrap(err, "failed to parse metadata selector"))
+		}
+	}
+	selector := req.Msg.LabelSelector
+	if selector == "" {
+		selector = "{}"
+	}
+	selector, err := q.joinSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if err := q.ingesterQuerier.requireFeature(ctx, clientpool.FeatureTargetMetadata); err != nil {
+		return nil, err
+	}
+
+	responses, err := forAllIngesters(ctx, q.ingesterQuerier, func(childCtx context.Context, ic IngesterQueryClient) ([]*ingestv1.SeriesTargetMetadata, error) {
+		res, err := ic.SelectTargetMetadata(childCtx, connect.NewRequest(&ingestv1.SelectTargetMetadataRequest{
+			LabelSelector: selector,
+			Start:         req.Msg.Start,
+			End:           req.Msg.End,
+		}))
+		if err != nil {
+			return nil, err
+		}
+		return res.Msg.Series, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		byTarget = make(map[uint64]*querierv1.TargetMetadataSet)
+		targets  []*querierv1.TargetMetadataSet
+	)
+	for _, r := range responses {
+		for _, series := range r.response {
+			targetLabels := targetLabels(series.Labels)
+			h := targetLabels.Hash()
+			target, ok := byTarget[h]
+			if !ok {
+				target = &querierv1.TargetMetadataSet{Labels: q.joins.joinLabels(targetLabels)}
+				byTarget[h] = target
+				targets = append(targets, target)
+			}
+			// the replicas of a series and its profile types have the same metadata, which is
+			// merged.
+			target.Metadata = phlaremodel.MergeTargetMetadata(target.Metadata, series.Metadata)
+		}
+	}
+	result := targets[:0]
+	for _, target := range targets {
+		if matchTargetMetadata(target.Metadata, metadataMatchers) {
+			result = append(result, target)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return phlaremodel.CompareLabelPairs(result[i].Labels, result[j].Labels) < 0
+	})
+	return connect.NewResponse(&querierv1.SelectTargetMetadataResponse{Targets: result}), nil
+}
+
+// targetLabels returns the labels of a series without the labels of its profile type.
+func targetLabels(ls []*typesv1.LabelPair) phlaremodel.Labels {
+	result := make(phlaremodel.Labels, 0, len(ls))
+	for _, l := range ls {
+		if _, ok := profileTypeLabels[l.Name]; !ok {
+			result = append(result, l)
+		}
+	}
+	return result
+}
+
+// matchTargetMetadata returns whether each of the matchers matches a value of the metadata of its
+// name.
+func matchTargetMetadata(metadata []*typesv1.TargetMetadata, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		matched := false
+		for _, md := range metadata {
+			if md.Name == m.Name && m.Matches(md.Value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+type targetMetadataResponse struct {
+	Targets []targetMetadata `json:"targets"`
+}
+
+type targetMetadata struct {
+	Labels   map[string]string     `json:"labels"`
+	Metadata []targetMetadataValue `json:"metadata"`
+}
+
+type targetMetadataValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// FirstSeen and LastSeen are in milliseconds.
+	FirstSeen int64 `json:"firstSeen"`
+	LastSeen  int64 `json:"lastSeen"`
+}
+
+// TargetMetadataHandler returns the metadata of the targets of the series matching the selector,
+// such as their build version, with the time range each value was seen in. The targets can be
+// filtered by their metadata:
+//
+//	GET /api/v1/targets/metadata?selector={service_name="checkout"}&match={build_version="v1.2.3"}&from=now-6h
+type TargetMetadataHandler struct {
+	client querierv1connect.QuerierServiceClient
+}
+
+func NewTargetMetadataHandler(client querierv1connect.QuerierServiceClient) *TargetMetadataHandler {
+	return &TargetMetadataHandler{client: client}
+}
+
+func (h *TargetMetadataHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, err := parseTimeRange(req.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := h.client.SelectTargetMetadata(req.Context(), connect.NewRequest(&querierv1.SelectTargetMetadataRequest{
+		LabelSelector:    req.Form.Get("selector"),
+		MetadataSelector: req.Form.Get("match"),
+		Start:            int64(start),
+		End:              int64(end),
+	}))
+	if err != nil {
+		http.Error(w, err.Error(), httpStatusFromConnectError(err))
+		return
+	}
+	resp := targetMetadataResponse{Targets: make([]targetMetadata, 0, len(res.Msg.Targets))}
+	for _, target := range res.Msg.Targets {
+		t := targetMetadata{
+			Labels:   make(map[string]string, len(target.Labels)),
+			Metadata: make([]targetMetadataValue, 0, len(target.Metadata)),
+		}
+		for _, l := range target.Labels {
+			t.Labels[l.Name] = l.Value
+		}
+		for _, m := range target.Metadata {
+			t.Metadata = append(t.Metadata, targetMetadataValue{
+				Name:      m.Name,
+				Value:     m.Value,
+				FirstSeen: m.FirstSeen,
+				LastSeen:  m.LastSeen,
+			})
+		}
+		resp.Targets = append(resp.Targets, t)
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,56 @@
+package querier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+)
+
+type fakeTargetMetadataClient struct {
+	querierv1connect.QuerierServiceClient
+	req *querierv1.SelectTargetMetadataRequest
+}
+
+func (c *fakeTargetMetadataClient) SelectTargetMetadata(_ context.Context, req *connect.Request[querierv1.SelectTargetMetadataRequest]) (*connect.Response[querierv1.SelectTargetMetadataResponse], error) {
+	c.req = req.Msg
+	return connect.NewResponse(&querierv1.SelectTargetMetadataResponse{
+		Targets: []*querierv1.TargetMetadataSet{{
+			Labels:   []*typesv1.LabelPair{{Name: "pod", Value: "a"}},
+			Metadata: []*typesv1.TargetMetadata{{Name: "build_version", Value: "v1", FirstSeen: 1000, LastSeen: 2000}},
+		}},
+	}), nil
+}
+
+func Test_TargetMetadataHandler(t *testing.T) {
+	client := &fakeTargetMetadataClient{}
+	h := NewTargetMetadataHandler(client)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, `/api/v1/targets/metadata?selector={pod="a"}&match={build_version="v1"}&from=1&until=2`, nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var resp targetMetadataResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, targetMetadataResponse{Targets: []targetMetadata{{
+		Labels:   map[string]string{"pod": "a"},
+		Metadata: []targetMetadataValue{{Name: "build_version", Value: "v1", FirstSeen: 1000, LastSeen: 2000}},
+	}}}, resp)
+	require.Equal(t, &querierv1.SelectTargetMetadataRequest{
+		LabelSelector:    `{pod="a"}`,
+		MetadataSelector: `{build_version="v1"}`,
+		Start:            1000,
+		End:              2000,
+	}, client.req)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/targets/metadata?from=now&until=now-1h", nil))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,177 @@
+package querier
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+)
+
+const (
+	// truncateCollapseUnderOther keeps the max_nodes largest nodes.
+	truncateCollapseUnderOther = "collapse_under_other"
+	// truncateMinValueFraction keeps the nodes with at least min_value_fraction of the total.
+	truncateMinValueFraction = "min_value_fraction"
+	// truncateTopKPerDepth keeps the top_k largest nodes of each depth.
+	truncateTopKPerDepth = "top_k_per_depth"
+
+	otherNodeName = "other"
+)
+
+// truncation selects the nodes of a flamegraph to keep. The truncated children of a node are
+// collapsed into a single "other" child, so the totals of the kept nodes are unchanged.
+type truncation struct {
+	strategy         string
+	maxNodes         int
+	minValueFraction float64
+	topK             int
+}
+
+// parseTruncation parses the truncate parameter and the parameter of the selected strategy.
+// Without truncate, the collapse_under_other strategy is used, which keeps all nodes unless
+// max_nodes is set.
+func parseTruncation(req *http.Request) (truncation, error) {
+	var (
+		t   = truncation{strategy: req.Form.Get("truncate")}
+		err error
+	)
+	if t.strategy == "" {
+		t.strategy = truncateCollapseUnderOther
+	}
+	switch t.strategy {
+	case truncateCollapseUnderOther:
+		if s := req.Form.Get("max_nodes"); s != "" {
+			if t.maxNodes, err = strconv.Atoi(s); err != nil || t.maxNodes < 0 {
+				return t, fmt.Errorf("max_nodes must be a positive integer")
+			}
+		}
+	case truncateMinValueFraction:
+		if t.minValueFraction, err = strconv.ParseFloat(req.Form.Get("min_value_fraction"), 64); err != nil || t.minValueFraction <= 0 || t.minValueFraction >= 1 {
+			return t, fmt.Errorf("min_value_fraction must be between 0 and 1")
+		}
+	case truncateTopKPerDepth:
+		if t.topK, err = strconv.Atoi(req.Form.Get("top_k")); err != nil || t.topK <= 0 {
+			return t, fmt.Errorf("top_k must be a positive integer")
+		}
+	default:
+		return t, fmt.Errorf("unknown truncate strategy %q, must be one of %s, %s or %s", t.strategy, truncateCollapseUnderOther, truncateMinValueFraction, truncateTopKPerDepth)
+	}
+	return t, nil
+}
+
+func (t truncation) enabled() bool {
+	return t.strategy != truncateCollapseUnderOther || t.maxNodes > 0
+}
+
+// Truncate returns the flamegraph with only the nodes selected by the strategy.
+func (t truncation) Truncate(fg *querierv1.FlameGraph) *querierv1.FlameGraph {
+	if fg == nil || !t.enabled() {
+		return fg
+	}
+	tr := flameGraphToTree(fg)
+	var keep func(n *node, depth int) bool
+	switch t.strategy {
+	case truncateCollapseUnderOther:
+		var totals []int64
+		tr.walk(func(n *node, _ int) { totals = append(totals, n.total) })
+		if len(totals) <= t.maxNodes {
+			return fg
+		}
+		minTotal := kthLargest(totals, t.maxNodes)
+		keep = func(n *node, _ int) bool { return n.total >= minTotal }
+	case truncateMinValueFraction:
+		minTotal := int64(t.minValueFraction * float64(fg.Total))
+		keep = func(n *node, _ int) bool { return n.total >= minTotal }
+	case truncateTopKPerDepth:
+		var totals [][]int64
+		tr.walk(func(n *node, depth int) {
+			if depth == len(totals) {
+				totals = append(totals, nil)
+			}
+			totals[depth] = append(totals[depth], n.total)
+		})
+		mins := make([]int64, len(totals))
+		for depth := range totals {
+			mins[depth] = kthLargest(totals[depth], t.topK)
+		}
+		keep = func(n *node, depth int) bool { return n.total >= mins[depth] }
+	}
+	tr.root = truncateNodes(nil, tr.root, 0, keep)
+	return NewFlameGraph(tr)
+}
+
+// kthLargest returns the k-th largest value, or the smallest one if there are less than k values.
+func kthLargest(values []int64, k int) int64 {
+	sort.Slice(values, func(i, j int) bool { return values[i] > values[j] })
+	if k > len(values) {
+		k = len(values)
+	}
+	return values[k-1]
+}
+
+func truncateNodes(parent *node, nodes []*node, depth int, keep func(n *node, depth int) bool) []*node {
+	var other int64
+	kept := nodes[:0]
+	for _, n := range nodes {
+		if !keep(n, depth) {
+			other += n.total
+			continue
+		}
+		n.children = truncateNodes(n, n.children, depth+1, keep)
+		kept = append(kept, n)
+	}
+	if other > 0 {
+		kept = append(kept, &node{parent: parent, name: otherNodeName, self: other, total: other})
+	}
+	return kept
+}
+
+// walk calls fn for every node of the tree, with the depth of the node.
+func (t *tree) walk(fn func(n *node, depth int)) {
+	var walk func(nodes []*node, depth int)
+	walk = func(nodes []*node, depth int) {
+		for _, n := range nodes {
+			fn(n, depth)
+			walk(n.children, depth+1)
+		}
+	}
+	walk(t.root, 0)
+}
+
+// flameGraphToTree rebuilds the tree of a flamegraph. The parent of a node is the node of the
+// previous level whose range contains its x offset.
+func flameGraphToTree(fg *querierv1.FlameGraph) *tree {
+	type position struct {
+		node *node
+		x    int64
+	}
+	root := &node{total: fg.Total}
+	if len(fg.Levels) == 0 {
+		return emptyTree()
+	}
+	parents := []position{{node: root}}
+	// the first level only contains the total node.
+	for _, level := range fg.Levels[1:] {
+		var (
+			current []position
+			x       int64
+			p       int
+		)
+		for i := 0; i+3 < len(level.Values); i += 4 {
+			x += level.Values[i]
+			total, self, name := level.Values[i+1], level.Values[i+2], fg.Names[level.Values[i+3]]
+			for p < len(parents)-1 && x >= parents[p].x+parents[p].node.total {
+				p++
+			}
+			current = append(current, position{node: parents[p].node.Add(name, self, total), x: x})
+			x += total
+		}
+		parents = current
+	}
+	for _, n := range root.children {
+		n.parent = nil
+	}
+	return &tree{root: root.children}
+}
@@ -0,0 +1,91 @@
+package querier
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Truncate(t *testing.T) {
+	input := func() *tree {
+		tr := emptyTree()
+		main := tr.Add("main", 0, 100)
+		main.Add("a", 10, 60).Add("a1", 50, 50)
+		b := main.Add("b", 5, 30)
+		b.Add("b1", 20, 20)
+		b.Add("b2", 5, 5)
+		main.Add("c", 10, 10)
+		return tr
+	}
+	for _, tc := range []struct {
+		name     string
+		params   url.Values
+		expected func() *tree
+	}{
+		{
+			"no truncation",
+			url.Values{},
+			input,
+		},
+		{
+			"collapse under other",
+			url.Values{"max_nodes": []string{"4"}},
+			func() *tree {
+				tr := emptyTree()
+				main := tr.Add("main", 0, 100)
+				main.Add("a", 10, 60).Add("a1", 50, 50)
+				main.Add("b", 5, 30).Add("other", 25, 25)
+				main.Add("other", 10, 10)
+				return tr
+			},
+		},
+		{
+			"min value fraction",
+			url.Values{"truncate": []string{"min_value_fraction"}, "min_value_fraction": []string{"0.15"}},
+			func() *tree {
+				tr := emptyTree()
+				main := tr.Add("main", 0, 100)
+				main.Add("a", 10, 60).Add("a1", 50, 50)
+				b := main.Add("b", 5, 30)
+				b.Add("b1", 20, 20)
+				b.Add("other", 5, 5)
+				main.Add("other", 10, 10)
+				return tr
+			},
+		},
+		{
+			"top k per depth",
+			url.Values{"truncate": []string{"top_k_per_depth"}, "top_k": []string{"1"}},
+			func() *tree {
+				tr := emptyTree()
+				main := tr.Add("main", 0, 100)
+				main.Add("a", 10, 60).Add("a1", 50, 50)
+				main.Add("other", 40, 40)
+				return tr
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &http.Request{Form: tc.params}
+			truncation, err := parseTruncation(req)
+			require.NoError(t, err)
+			actual := flameGraphToTree(truncation.Truncate(NewFlameGraph(input())))
+			require.Equal(t, tc.expected().String(), actual.String())
+		})
+	}
+}
+
+func Test_ParseTruncation(t *testing.T) {
+	for _, params := range []url.Values{
+		{"truncate": []string{"unknown"}},
+		{"max_nodes": []string{"-1"}},
+		{"truncate": []string{"min_value_fraction"}},
+		{"truncate": []string{"min_value_fraction"}, "min_value_fraction": []string{"1.5"}},
+		{"truncate": []string{"top_k_per_depth"}, "top_k": []string{"0"}},
+	} {
+		_, err := parseTruncation(&http.Request{Form: params})
+		require.Error(t, err, params.Encode())
+	}
+}
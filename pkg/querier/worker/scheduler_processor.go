@@ -33,6 +33,7 @@ import (
 	"github.com/grafana/phlare/pkg/frontend/frontendpb"
 	querier_stats "github.com/grafana/phlare/pkg/querier/stats"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerpb"
+	"github.com/grafana/phlare/pkg/tenant"
 	util_log "github.com/grafana/phlare/pkg/util"
 	"github.com/grafana/phlare/pkg/util/httpgrpc"
 	"github.com/grafana/phlare/pkg/util/httpgrpcutil"
@@ -54,6 +55,7 @@ func newSchedulerProcessor(cfg Config, handler RequestHandler, log log.Logger, r
 		maxMessageSize:  cfg.GRPCClientConfig.MaxSendMsgSize,
 		querierID:       cfg.QuerierID,
 		grpcConfig:      cfg.GRPCClientConfig,
+		internalSecret:  cfg.InternalSecret,
 		maxLoopDuration: cfg.MaxLoopDuration,
 
 		schedulerClientFactory: func(conn *grpc.ClientConn) schedulerpb.SchedulerForQuerierClient {
@@ -90,6 +92,7 @@ type schedulerProcessor struct {
 	maxMessageSize  int
 	querierID       string
 	maxLoopDuration time.Duration
+	internalSecret  string
 
 	frontendPool                  *client.Pool
 	frontendClientRequestDuration *prometheus.HistogramVec
@@ -278,6 +281,7 @@ func (sp *schedulerProcessor) createFrontendClient(addr string) (client.PoolClie
 	if err != nil {
 		return nil, err
 	}
+	opts = append(opts, tenant.InternalSecretDialOption(sp.internalSecret))
 
 	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
@@ -19,9 +19,11 @@ import (
 	"github.com/grafana/dskit/services"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"google.golang.org/grpc"
 
 	"github.com/grafana/phlare/pkg/scheduler/schedulerdiscovery"
+	"github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/util/httpgrpc"
 	"github.com/grafana/phlare/pkg/util/servicediscovery"
 )
@@ -36,6 +38,7 @@ type Config struct {
 	MaxConcurrentRequests   int                       `yaml:"-"` // Must be same as passed to PromQL Engine.
 	QuerySchedulerDiscovery schedulerdiscovery.Config `yaml:"-"`
 	MaxLoopDuration         time.Duration             `yaml:"-"`
+	InternalSecret          string                    `yaml:"-"`
 }
 
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
@@ -102,6 +105,15 @@ func NewQuerierWorker(cfg Config, handler RequestHandler, log log.Logger, reg pr
 		cfg.QuerierID = hostname
 	}
 
+	// the busy workers are counted around the handler, so they are whichever the processor.
+	handler = &busyWorkersHandler{
+		RequestHandler: handler,
+		busy: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "cortex_querier_busy_workers",
+			Help: "Number of querier workers processing a query.",
+		}),
+	}
+
 	var processor processor
 	var servs []services.Service
 	var factory serviceDiscoveryFactory
@@ -120,7 +132,38 @@ func NewQuerierWorker(cfg Config, handler RequestHandler, log log.Logger, reg pr
 		return nil, errors.New("no query-scheduler or query-frontend address")
 	}
 
-	return newQuerierWorkerWithProcessor(cfg, log, processor, factory, servs)
+	w, err := newQuerierWorkerWithProcessor(cfg, log, processor, factory, servs)
+	if err != nil {
+		return nil, err
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_querier_workers",
+		Help: "Number of querier workers, each processing a single query at a time.",
+	}, w.getWorkersMetric)
+	return w, nil
+}
+
+func (w *querierWorker) getWorkersMetric() float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var workers int32
+	for _, m := range w.managers {
+		workers += m.currentProcessors.Load()
+	}
+	return float64(workers)
+}
+
+// busyWorkersHandler counts the querier workers handling a query.
+type busyWorkersHandler struct {
+	RequestHandler
+	busy prometheus.Gauge
+}
+
+func (h *busyWorkersHandler) Handle(ctx context.Context, req *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error) {
+	h.busy.Inc()
+	defer h.busy.Dec()
+	return h.RequestHandler.Handle(ctx, req)
 }
 
 func newQuerierWorkerWithProcessor(cfg Config, log log.Logger, processor processor, newServiceDiscovery serviceDiscoveryFactory, servs []services.Service) (*querierWorker, error) {
@@ -345,6 +388,7 @@ func (w *querierWorker) connect(ctx context.Context, address string) (*grpc.Clie
 	if err != nil {
 		return nil, err
 	}
+	opts = append(opts, tenant.InternalSecretDialOption(w.cfg.InternalSecret))
 
 	conn, err := grpc.DialContext(ctx, address, opts...)
 	if err != nil {
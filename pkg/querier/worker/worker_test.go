@@ -15,11 +15,15 @@ import (
 	"github.com/grafana/dskit/flagext"
 	"github.com/grafana/dskit/services"
 	"github.com/grafana/dskit/test"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 
 	"github.com/grafana/phlare/pkg/scheduler/schedulerdiscovery"
+	"github.com/grafana/phlare/pkg/util/httpgrpc"
 	"github.com/grafana/phlare/pkg/util/servicediscovery"
 )
 
@@ -243,3 +247,17 @@ func (m mockProcessor) processQueriesOnSingleStream(ctx context.Context, _ *grpc
 }
 
 func (m mockProcessor) notifyShutdown(_ context.Context, _ *grpc.ClientConn, _ string) {}
+
+func TestBusyWorkersHandler(t *testing.T) {
+	busy := prometheus.NewGauge(prometheus.GaugeOpts{Name: "busy"})
+	next := &requestHandlerMock{}
+	next.On("Handle", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		assert.Equal(t, 1., testutil.ToFloat64(busy))
+	}).Return(&httpgrpc.HTTPResponse{}, nil)
+
+	h := &busyWorkersHandler{RequestHandler: next, busy: busy}
+	_, err := h.Handle(context.Background(), &httpgrpc.HTTPRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 0., testutil.ToFloat64(busy))
+	next.AssertNumberOfCalls(t, "Handle", 1)
+}
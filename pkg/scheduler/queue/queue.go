@@ -55,6 +55,7 @@ type RequestQueue struct {
 	services.Service
 
 	connectedQuerierWorkers *atomic.Int32
+	queuedRequests          *atomic.Int32
 
 	mtx     sync.Mutex
 	cond    contextCond // Notified when request is enqueued or dequeued, or querier is disconnected.
@@ -69,6 +70,7 @@ func NewRequestQueue(maxOutstandingPerTenant int, forgetDelay time.Duration, que
 	q := &RequestQueue{
 		queues:                  newUserQueues(maxOutstandingPerTenant, forgetDelay),
 		connectedQuerierWorkers: atomic.NewInt32(0),
+		queuedRequests:          atomic.NewInt32(0),
 		queueLength:             queueLength,
 		discardedRequests:       discardedRequests,
 	}
@@ -101,6 +103,7 @@ func (q *RequestQueue) EnqueueRequest(userID string, req Request, maxQueriers in
 	select {
 	case queue <- req:
 		q.queueLength.WithLabelValues(userID).Inc()
+		q.queuedRequests.Inc()
 		q.cond.Broadcast()
 		// Call this function while holding a lock. This guarantees that no querier can fetch the request before function returns.
 		if successFn != nil {
@@ -152,6 +155,7 @@ FindQueue:
 			}
 
 			q.queueLength.WithLabelValues(userID).Dec()
+			q.queuedRequests.Dec()
 
 			// Tell close() we've processed a request.
 			q.cond.Broadcast()
@@ -222,6 +226,11 @@ func (q *RequestQueue) GetConnectedQuerierWorkersMetric() float64 {
 	return float64(q.connectedQuerierWorkers.Load())
 }
 
+// GetQueuedRequestsMetric returns the number of requests in the queues of all the users.
+func (q *RequestQueue) GetQueuedRequestsMetric() float64 {
+	return float64(q.queuedRequests.Load())
+}
+
 // contextCond is a *sync.Cond with Wait() method overridden to support context-based waiting.
 type contextCond struct {
 	*sync.Cond
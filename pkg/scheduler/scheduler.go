@@ -33,6 +33,7 @@ import (
 	"github.com/grafana/phlare/pkg/scheduler/queue"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerdiscovery"
 	"github.com/grafana/phlare/pkg/scheduler/schedulerpb"
+	phlaretenant "github.com/grafana/phlare/pkg/tenant"
 	"github.com/grafana/phlare/pkg/util"
 	"github.com/grafana/phlare/pkg/util/httpgrpc"
 	"github.com/grafana/phlare/pkg/util/httpgrpcutil"
@@ -74,6 +75,11 @@ type Scheduler struct {
 	queueDuration            prometheus.Histogram
 	inflightRequests         prometheus.Summary
 
+	// Metrics meant for the autoscaling of the queriers. Their names are stable.
+	queuedRequests      prometheus.GaugeFunc
+	processingRequests  prometheus.GaugeFunc
+	querierWorkersUsage prometheus.GaugeFunc
+
 	schedulerpb.UnimplementedSchedulerForFrontendServer
 	schedulerpb.UnimplementedSchedulerForQuerierServer
 }
@@ -97,6 +103,9 @@ type Config struct {
 	QuerierForgetDelay      time.Duration             `yaml:"querier_forget_delay" category:"experimental"`
 	GRPCClientConfig        grpcclient.Config         `yaml:"grpc_client_config" doc:"description=This configures the gRPC client used to report errors back to the query-frontend."`
 	ServiceDiscovery        schedulerdiscovery.Config `yaml:",inline"`
+
+	// This configuration is injected internally.
+	InternalSecret string `yaml:"-"`
 }
 
 func (cfg *Config) RegisterFlags(f *flag.FlagSet, logger log.Logger) {
@@ -161,6 +170,19 @@ func NewScheduler(cfg Config, limits Limits, log log.Logger, registerer promethe
 		AgeBuckets: 6,
 	})
 
+	s.queuedRequests = promauto.With(registerer).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_query_scheduler_queued_requests",
+		Help: "Number of queries in the queue of all the tenants.",
+	}, s.requestQueue.GetQueuedRequestsMetric)
+	s.processingRequests = promauto.With(registerer).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_query_scheduler_processing_requests",
+		Help: "Number of queries dispatched to querier workers and not finished yet, which is the number of busy querier workers.",
+	}, s.getProcessingRequestsMetric)
+	s.querierWorkersUsage = promauto.With(registerer).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "cortex_query_scheduler_querier_workers_usage",
+		Help: "Estimated pending work: the number of queries queued or processing per connected querier worker. Above 1, queries wait for a querier worker.",
+	}, s.getQuerierWorkersUsageMetric)
+
 	s.activeUsers = util.NewActiveUsersCleanupWithDefaultValues(s.cleanupMetricsForInactiveUser)
 	subservices := []services.Service{s.requestQueue, s.activeUsers}
 
@@ -535,6 +557,7 @@ func (s *Scheduler) forwardErrorToFrontend(ctx context.Context, req *schedulerRe
 		level.Warn(s.log).Log("msg", "failed to create gRPC options for the connection to frontend to report error", "frontend", req.frontendAddress, "err", err, "requestErr", requestErr)
 		return
 	}
+	opts = append(opts, phlaretenant.InternalSecretDialOption(s.cfg.InternalSecret))
 
 	conn, err := grpc.DialContext(ctx, req.frontendAddress, opts...)
 	if err != nil {
@@ -583,6 +606,34 @@ func (s *Scheduler) starting(ctx context.Context) error {
 	return nil
 }
 
+// inflight returns the number of requests queued or dispatched to queriers, and the number of queued requests.
+func (s *Scheduler) inflight() (inflight, queued int) {
+	s.pendingRequestsMu.Lock()
+	defer s.pendingRequestsMu.Unlock()
+	return len(s.pendingRequests), int(s.requestQueue.GetQueuedRequestsMetric())
+}
+
+func (s *Scheduler) getProcessingRequestsMetric() float64 {
+	inflight, queued := s.inflight()
+	if inflight < queued {
+		return 0
+	}
+	return float64(inflight - queued)
+}
+
+func (s *Scheduler) getQuerierWorkersUsageMetric() float64 {
+	inflight, queued := s.inflight()
+	if queued > inflight {
+		inflight = queued
+	}
+	workers := s.requestQueue.GetConnectedQuerierWorkersMetric()
+	if workers < 1 {
+		// Without querier worker, any pending query needs one.
+		workers = 1
+	}
+	return float64(inflight) / workers
+}
+
 func (s *Scheduler) running(ctx context.Context) error {
 	// We observe inflight requests frequently and at regular intervals, to have a good
 	// approximation of max inflight requests over percentiles of time. We also do it with
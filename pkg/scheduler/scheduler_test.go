@@ -459,6 +459,60 @@ func TestSchedulerMetrics(t *testing.T) {
 	`), "cortex_query_scheduler_queue_length"))
 }
 
+func TestSchedulerAutoscalingMetrics(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+
+	_, frontendClient, querierClient := setupScheduler(t, reg)
+
+	frontendLoop := initFrontendLoop(t, frontendClient, "frontend-12345")
+	for i, userID := range []string{"test", "another"} {
+		frontendToScheduler(t, frontendLoop, &schedulerpb.FrontendToScheduler{
+			Type:        schedulerpb.FrontendToSchedulerType_ENQUEUE,
+			QueryID:     uint64(i + 1),
+			UserID:      userID,
+			HttpRequest: &httpgrpc.HTTPRequest{Method: "GET", Url: "/hello"},
+		})
+	}
+	metrics := []string{"cortex_query_scheduler_queued_requests", "cortex_query_scheduler_processing_requests", "cortex_query_scheduler_querier_workers_usage"}
+
+	require.NoError(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_query_scheduler_processing_requests Number of queries dispatched to querier workers and not finished yet, which is the number of busy querier workers.
+		# TYPE cortex_query_scheduler_processing_requests gauge
+		cortex_query_scheduler_processing_requests 0
+		# HELP cortex_query_scheduler_querier_workers_usage Estimated pending work: the number of queries queued or processing per connected querier worker. Above 1, queries wait for a querier worker.
+		# TYPE cortex_query_scheduler_querier_workers_usage gauge
+		cortex_query_scheduler_querier_workers_usage 2
+		# HELP cortex_query_scheduler_queued_requests Number of queries in the queue of all the tenants.
+		# TYPE cortex_query_scheduler_queued_requests gauge
+		cortex_query_scheduler_queued_requests 2
+	`), metrics...))
+
+	// A querier worker picks a request up, without finishing it.
+	querierLoop, err := querierClient.QuerierLoop(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, querierLoop.Send(&schedulerpb.QuerierToScheduler{QuerierID: "querier-1"}))
+	_, err = querierLoop.Recv()
+	require.NoError(t, err)
+
+	require.NoError(t, promtest.GatherAndCompare(reg, strings.NewReader(`
+		# HELP cortex_query_scheduler_processing_requests Number of queries dispatched to querier workers and not finished yet, which is the number of busy querier workers.
+		# TYPE cortex_query_scheduler_processing_requests gauge
+		cortex_query_scheduler_processing_requests 1
+		# HELP cortex_query_scheduler_querier_workers_usage Estimated pending work: the number of queries queued or processing per connected querier worker. Above 1, queries wait for a querier worker.
+		# TYPE cortex_query_scheduler_querier_workers_usage gauge
+		cortex_query_scheduler_querier_workers_usage 2
+		# HELP cortex_query_scheduler_queued_requests Number of queries in the queue of all the tenants.
+		# TYPE cortex_query_scheduler_queued_requests gauge
+		cortex_query_scheduler_queued_requests 1
+	`), metrics...))
+
+	// Process the remaining request, so the scheduler can shut down.
+	require.NoError(t, querierLoop.Send(&schedulerpb.QuerierToScheduler{}))
+	_, err = querierLoop.Recv()
+	require.NoError(t, err)
+	require.NoError(t, querierLoop.Send(&schedulerpb.QuerierToScheduler{}))
+}
+
 func initFrontendLoop(t *testing.T, client schedulerpb.SchedulerForFrontendClient, frontendAddr string) schedulerpb.SchedulerForFrontend_FrontendLoopClient {
 	loop, err := client.FrontendLoop(context.Background())
 	require.NoError(t, err)
@@ -0,0 +1,338 @@
+package tenant
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/grafana/dskit/flagext"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+	"google.golang.org/grpc"
+	"gopkg.in/yaml.v2"
+)
+
+// Role is the set of routes an API key gives access to.
+type Role string
+
+const (
+	// RoleReader gives access to the query routes.
+	RoleReader Role = "reader"
+	// RoleWriter gives access to the push routes.
+	RoleWriter Role = "writer"
+	// RoleAdmin gives access to all the routes of its tenant.
+	RoleAdmin Role = "admin"
+	// RoleOperator gives access to all the routes, including the cluster-wide ones acting on all
+	// the tenants, such as the ingester snapshots, the rings or the runtime configuration.
+	RoleOperator Role = "operator"
+
+	// roleInternal marks the routes between the components, which require the internal secret.
+	roleInternal Role = "internal"
+	// roleNone marks the routes open to all, such as the readiness probe.
+	roleNone Role = "none"
+)
+
+func (r Role) valid() bool {
+	return r == RoleReader || r == RoleWriter || r == RoleAdmin || r == RoleOperator
+}
+
+// allows returns whether the role gives access to the routes requiring the other role.
+func (r Role) allows(required Role) bool {
+	switch r {
+	case RoleOperator:
+		return required != roleInternal
+	case RoleAdmin:
+		return required != RoleOperator
+	default:
+		return r == required
+	}
+}
+
+// APIKey is the tenant and the role an API key is bound to.
+type APIKey struct {
+	TenantID string
+	Role     Role
+}
+
+// ErrUnknownAPIKey is returned by the resolvers for the keys they don't know.
+var ErrUnknownAPIKey = errors.New("unknown API key")
+
+// APIKeyResolver maps the API keys of the requests to their tenant and role. It is the extension
+// point to plug an external store of keys, the keys of a file being used otherwise.
+type APIKeyResolver interface {
+	// ResolveAPIKey returns ErrUnknownAPIKey for the keys it doesn't know.
+	ResolveAPIKey(ctx context.Context, key string) (APIKey, error)
+}
+
+// APIKeysConfig configures the API keys read from a file.
+type APIKeysConfig struct {
+	File           string         `yaml:"file" category:"experimental"`
+	InternalSecret flagext.Secret `yaml:"internal_secret" category:"experimental"`
+}
+
+func (c *APIKeysConfig) RegisterFlags(f *flag.FlagSet) {
+	f.StringVar(&c.File, "auth.api-keys.file", "", "Path of the YAML file of the API keys, mapping the SHA-256 of each key to a tenant and a role, reader, writer, admin or operator. When set, the requests must authenticate with an API key, in a bearer token or the password of the basic authentication, and the tenant ID is set from the key.")
+	f.Var(&c.InternalSecret, "auth.internal-secret", "Secret shared by all the components, sent in the requests between them. It is required with the API keys and the tenant resolution rules: the routes between the components, such as the ingester RPCs, are then only served to the requests holding it.")
+}
+
+// InternalSecretHeader is the header of the requests between the components holding the secret they
+// share, which gives access to their routes when the API keys are required.
+const InternalSecretHeader = "X-Phlare-Internal-Secret"
+
+// NewInternalSecretInterceptor returns the interceptor of the clients between the components,
+// sending the internal secret in their requests. The handlers are left untouched, as the secret is
+// checked by the API key middleware. Without secret, the requests are left untouched.
+func NewInternalSecretInterceptor(secret string) connect.Interceptor {
+	return &internalSecretInterceptor{secret: secret}
+}
+
+type internalSecretInterceptor struct {
+	secret string
+}
+
+func (i *internalSecretInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		if req.Spec().IsClient && i.secret != "" {
+			req.Header().Set(InternalSecretHeader, i.secret)
+		}
+		return next(ctx, req)
+	}
+}
+
+func (i *internalSecretInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, s connect.Spec) connect.StreamingClientConn {
+		conn := next(ctx, s)
+		if i.secret != "" {
+			conn.RequestHeader().Set(InternalSecretHeader, i.secret)
+		}
+		return conn
+	}
+}
+
+func (i *internalSecretInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
+
+// hasInternalSecret returns whether the request holds the internal secret, which must be set.
+func hasInternalSecret(r *http.Request, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(InternalSecretHeader)), []byte(secret)) == 1
+}
+
+func writeInternalRouteError(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, fmt.Sprintf("%s is only served to the other components", r.URL.Path), http.StatusUnauthorized)
+}
+
+// InternalSecretDialOption returns the dial option of the gRPC clients between the components,
+// sending the internal secret in the metadata of their requests.
+func InternalSecretDialOption(secret string) grpc.DialOption {
+	if secret == "" {
+		return grpc.EmptyDialOption{}
+	}
+	return grpc.WithPerRPCCredentials(internalSecretCredentials(secret))
+}
+
+type internalSecretCredentials string
+
+func (c internalSecretCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{strings.ToLower(InternalSecretHeader): string(c)}, nil
+}
+
+// RequireTransportSecurity is false, as the components may communicate in plain text.
+func (internalSecretCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+type apiKeysFile struct {
+	Keys []apiKeyEntry `yaml:"keys"`
+}
+
+type apiKeyEntry struct {
+	// SHA256 is the hex encoded SHA-256 of the key, so that the file doesn't hold the keys.
+	SHA256 string `yaml:"sha256"`
+	Tenant string `yaml:"tenant"`
+	Role   Role   `yaml:"role"`
+}
+
+// staticAPIKeys resolves the keys of a file, by their SHA-256.
+type staticAPIKeys struct {
+	keys map[[sha256.Size]byte]APIKey
+}
+
+// NewFileAPIKeyResolver returns the resolver of the keys of the file of the config, nil when the
+// config has no file.
+func NewFileAPIKeyResolver(cfg APIKeysConfig) (APIKeyResolver, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(cfg.File)
+	if err != nil {
+		return nil, fmt.Errorf("reading the API keys: %w", err)
+	}
+	var file apiKeysFile
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, fmt.Errorf("parsing the API keys of %s: %w", cfg.File, err)
+	}
+	return newStaticAPIKeys(file.Keys)
+}
+
+func newStaticAPIKeys(entries []apiKeyEntry) (*staticAPIKeys, error) {
+	s := &staticAPIKeys{keys: make(map[[sha256.Size]byte]APIKey, len(entries))}
+	for i, e := range entries {
+		var hash [sha256.Size]byte
+		if n, err := hex.Decode(hash[:], []byte(e.SHA256)); err != nil || n != sha256.Size {
+			return nil, fmt.Errorf("API key %d: the sha256 must be the hex encoded SHA-256 of the key", i)
+		}
+		if e.Tenant == "" {
+			return nil, fmt.Errorf("API key %d: the tenant is required", i)
+		}
+		if !e.Role.valid() {
+			return nil, fmt.Errorf("API key %d: unknown role %q, must be one of %s, %s, %s or %s", i, e.Role, RoleReader, RoleWriter, RoleAdmin, RoleOperator)
+		}
+		if _, ok := s.keys[hash]; ok {
+			return nil, fmt.Errorf("API key %d: duplicated key", i)
+		}
+		s.keys[hash] = APIKey{TenantID: e.Tenant, Role: e.Role}
+	}
+	return s, nil
+}
+
+func (s *staticAPIKeys) ResolveAPIKey(_ context.Context, key string) (APIKey, error) {
+	// the keys are looked up by their hash, which doesn't leak their content through timing.
+	k, ok := s.keys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return k, nil
+}
+
+// routeRoles are the roles required by the routes, by path prefix, optionally preceded by the
+// method of the requests, e.g. "GET /api/v1/baselines". The first one matching wins, and the other
+// routes, which act on the whole cluster, require the operator role.
+var routeRoles = []struct {
+	prefix string
+	role   Role
+}{
+	{"/ready", roleNone},
+	{"/api/v1/modules", roleNone},
+
+	{"/push.v1.PusherService/", RoleWriter},
+	{"/api/v1/push", RoleWriter},
+
+	{"/querier.v1.QuerierService/", RoleReader},
+	{"/api/v1/profile_types", RoleReader},
+	{"/api/v1/labels", RoleReader},
+	{"/api/v1/label/", RoleReader},
+	{"/api/v1/query", RoleReader},
+	{"/api/v1/flamegraph", RoleReader},
+	{"/api/v1/pprof", RoleReader},
+	{"/api/experimental/", RoleReader},
+	{"GET /api/v1/baselines", RoleReader},
+	{"/api/v1/baselines", RoleWriter},
+	{"/distributor/label_cardinality", RoleReader},
+	{"/api/openapi.json", RoleReader},
+	{"/api/swagger.json", RoleReader},
+
+	{"/api/v1/tenant_limits", RoleAdmin},
+	{"/api/v1/agent/", RoleAdmin},
+	{"/querier/blocks", RoleAdmin},
+
+	{"/ingester.v1.IngesterService/", roleInternal},
+	{"/schedulerpb.", roleInternal},
+	{"/frontendpb.", roleInternal},
+	{"/httpgrpc.HTTP/", roleInternal},
+	{"/grpc.health.v1.Health/", roleInternal},
+}
+
+// requiredRole returns the role required by the route of the method and the path.
+func requiredRole(method, path string) Role {
+	for _, r := range routeRoles {
+		prefix := r.prefix
+		if m, p, ok := strings.Cut(prefix, " "); ok {
+			if m != method {
+				continue
+			}
+			prefix = p
+		}
+		if strings.HasPrefix(path, prefix) {
+			return r.role
+		}
+	}
+	return RoleOperator
+}
+
+// apiKey returns the API key of the request, sent as a bearer token or as the password of the
+// basic authentication.
+func apiKey(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len(prefix) && strings.EqualFold(auth[:len(prefix)], prefix) {
+		return auth[len(prefix):]
+	}
+	return ""
+}
+
+// NewAPIKeyMiddleware returns the middleware authenticating the requests with their API key, and
+// checking the role of the key gives access to the route. The tenant ID of the key is set in the
+// X-Scope-OrgID header read by the authentication middleware and interceptor, replacing the one
+// sent by the client. The routes between the components don't require a key but the internal
+// secret, as their requests carry the tenant ID of the requests they serve. Without resolver, the
+// requests are left untouched.
+func NewAPIKeyMiddleware(resolver APIKeyResolver, internalSecret string) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		if resolver == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			required := requiredRole(r.Method, r.URL.Path)
+			if required == roleNone {
+				next.ServeHTTP(w, r)
+				return
+			}
+			internal := hasInternalSecret(r, internalSecret)
+			r.Header.Del(InternalSecretHeader)
+			if required == roleInternal {
+				if !internal {
+					writeInternalRouteError(w, r)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := apiKey(r)
+			if key == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="phlare"`)
+				http.Error(w, "an API key is required", http.StatusUnauthorized)
+				return
+			}
+			k, err := resolver.ResolveAPIKey(r.Context(), key)
+			if errors.Is(err, ErrUnknownAPIKey) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="phlare"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("resolving the API key: %v", err), http.StatusInternalServerError)
+				return
+			}
+			if !k.Role.allows(required) {
+				http.Error(w, fmt.Sprintf("the %s role of the API key doesn't give access to %s", k.Role, r.URL.Path), http.StatusForbidden)
+				return
+			}
+			r.Header.Set(user.OrgIDHeaderName, k.TenantID)
+			// the key isn't passed on to the handlers.
+			r.Header.Del("Authorization")
+			next.ServeHTTP(w, r)
+		})
+	})
+}
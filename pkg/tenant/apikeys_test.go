@@ -0,0 +1,251 @@
+package tenant
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Hex(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func TestAPIKeyMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+keys:
+  - sha256: `+sha256Hex("reader-key")+`
+    tenant: team-a
+    role: reader
+  - sha256: `+sha256Hex("writer-key")+`
+    tenant: team-b
+    role: writer
+  - sha256: `+sha256Hex("admin-key")+`
+    tenant: team-a
+    role: admin
+  - sha256: `+sha256Hex("operator-key")+`
+    tenant: ops
+    role: operator
+`), 0o644))
+	resolver, err := NewFileAPIKeyResolver(APIKeysConfig{File: path})
+	require.NoError(t, err)
+
+	handler := NewAPIKeyMiddleware(resolver, "internal-secret").Wrap(NewHTTPAuthMiddleware(true).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.Header.Get("Authorization"))
+		require.Empty(t, r.Header.Get(InternalSecretHeader))
+		tenantID, err := ExtractTenantIDFromContext(r.Context())
+		require.NoError(t, err)
+		_, _ = w.Write([]byte(tenantID))
+	})))
+
+	for _, tc := range []struct {
+		name           string
+		method         string
+		path           string
+		setAuth        func(r *http.Request)
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "reader queries",
+			path:           "/querier.v1.QuerierService/LabelNames",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-a",
+		},
+		{
+			name:           "reader can't push",
+			path:           "/push.v1.PusherService/Push",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "writer pushes with basic auth",
+			path:           "/api/v1/push/pprof",
+			setAuth:        func(r *http.Request) { r.SetBasicAuth("team-b", "writer-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-b",
+		},
+		{
+			name:           "writer can't query",
+			path:           "/api/v1/query",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer writer-key") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin route",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenant_limits",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin",
+			method:         http.MethodGet,
+			path:           "/api/v1/tenant_limits",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-a",
+		},
+		{
+			name:           "admin queries",
+			path:           "/querier.v1.QuerierService/LabelNames",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-a",
+		},
+		{
+			name:           "admin can't call the cluster-wide routes",
+			path:           "/ingester/snapshot",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer admin-key") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "operator",
+			path:           "/ingester/read-only",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer operator-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "ops",
+		},
+		{
+			name:           "operator pushes",
+			path:           "/push.v1.PusherService/Push",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer operator-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "ops",
+		},
+		{
+			name:           "reader lists the baselines",
+			method:         http.MethodGet,
+			path:           "/api/v1/baselines",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-a",
+		},
+		{
+			name:           "reader can't create a baseline",
+			method:         http.MethodPut,
+			path:           "/api/v1/baselines/v1",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") },
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "writer deletes a baseline",
+			method:         http.MethodDelete,
+			path:           "/api/v1/baselines/v1",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer writer-key") },
+			expectedStatus: http.StatusOK,
+			expected:       "team-b",
+		},
+		{
+			name:           "modules health",
+			path:           "/api/v1/modules",
+			setAuth:        func(r *http.Request) {},
+			expectedStatus: http.StatusOK,
+			expected:       "spoofed",
+		},
+		{
+			name:           "unknown key",
+			path:           "/api/v1/labels",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer other") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "missing key",
+			path:           "/api/v1/labels",
+			setAuth:        func(r *http.Request) {},
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "internal route",
+			path: "/ingester.v1.IngesterService/LabelNames",
+			setAuth: func(r *http.Request) {
+				r.Header.Set("X-Scope-OrgID", "internal")
+				r.Header.Set(InternalSecretHeader, "internal-secret")
+			},
+			expectedStatus: http.StatusOK,
+			expected:       "internal",
+		},
+		{
+			name:           "internal route without secret",
+			path:           "/ingester.v1.IngesterService/LabelNames",
+			setAuth:        func(r *http.Request) { r.Header.Set("X-Scope-OrgID", "internal") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "internal route with an API key",
+			path:           "/ingester.v1.IngesterService/BlockMetadata",
+			setAuth:        func(r *http.Request) { r.Header.Set("Authorization", "Bearer operator-key") },
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "internal route with a wrong secret",
+			path: "/schedulerpb.SchedulerForQuerier/QuerierLoop",
+			setAuth: func(r *http.Request) {
+				r.Header.Set(InternalSecretHeader, "guess")
+			},
+			expectedStatus: http.StatusUnauthorized,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			method := tc.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			req := httptest.NewRequest(method, tc.path, nil)
+			// the tenant ID sent by the client is replaced by the one of the key.
+			req.Header.Set("X-Scope-OrgID", "spoofed")
+			tc.setAuth(req)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, tc.expectedStatus, rec.Code, rec.Body.String())
+			if tc.expected != "" {
+				require.Equal(t, tc.expected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewFileAPIKeyResolver_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"keys: [{sha256: abc, tenant: a, role: reader}]",
+		"keys: [{sha256: " + sha256Hex("k") + ", role: reader}]",
+		"keys: [{sha256: " + sha256Hex("k") + ", tenant: a, role: owner}]",
+		"keys: [{sha256: " + sha256Hex("k") + ", tenant: a, role: reader}, {sha256: " + sha256Hex("k") + ", tenant: b, role: writer}]",
+	} {
+		path := filepath.Join(t.TempDir(), "keys.yaml")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err := NewFileAPIKeyResolver(APIKeysConfig{File: path})
+		require.Error(t, err, content)
+	}
+}
+
+func TestInternalSecretInterceptor(t *testing.T) {
+	i := NewInternalSecretInterceptor("internal-secret")
+	_, err := i.WrapUnary(func(ctx context.Context, ar connect.AnyRequest) (connect.AnyResponse, error) {
+		require.Equal(t, "internal-secret", ar.Header().Get(InternalSecretHeader))
+		return nil, nil
+	})(context.Background(), newFakeReq(true))
+	require.NoError(t, err)
+
+	// the handlers don't send the secret back.
+	_, err = i.WrapUnary(func(ctx context.Context, ar connect.AnyRequest) (connect.AnyResponse, error) {
+		require.Empty(t, ar.Header().Get(InternalSecretHeader))
+		return nil, nil
+	})(context.Background(), newFakeReq(false))
+	require.NoError(t, err)
+
+	md, err := internalSecretCredentials("internal-secret").GetRequestMetadata(context.Background())
+	require.NoError(t, err)
+	// the gRPC metadata is sent as the header read by the middleware.
+	require.Equal(t, map[string]string{"x-phlare-internal-secret": "internal-secret"}, md)
+}
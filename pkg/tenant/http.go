@@ -0,0 +1,28 @@
+package tenant
+
+import (
+	"net/http"
+
+	"github.com/weaveworks/common/middleware"
+)
+
+// NewHTTPAuthMiddleware is the plain HTTP counterpart of NewAuthInterceptor.
+//
+// If enabled, the middleware requires the tenant ID in the request header and injects it into the context,
+// otherwise it will inject the default tenant ID into the context.
+func NewHTTPAuthMiddleware(enabled bool) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !enabled {
+				next.ServeHTTP(w, r.WithContext(InjectTenantID(r.Context(), DefaultTenantID)))
+				return
+			}
+			_, ctx, err := ExtractTenantIDFromHeaders(r.Context(), r.Header)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+}
@@ -0,0 +1,162 @@
+package tenant
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/grafana/dskit/tenant"
+	"github.com/weaveworks/common/middleware"
+	"github.com/weaveworks/common/user"
+)
+
+// The sources of the tenant IDs of the resolution rules.
+const (
+	SourceHeader         = "header"
+	SourceCertCommonName = "cert_common_name"
+	SourceCertDNSSAN     = "cert_dns_san"
+	SourceCertURISAN     = "cert_uri_san"
+	SourceCertEmailSAN   = "cert_email_san"
+)
+
+// ResolutionConfig configures how the tenant ID of the requests is resolved when multi-tenancy is
+// enabled. Without rules, it is read from the X-Scope-OrgID header.
+type ResolutionConfig struct {
+	Rules []*ResolutionRule `yaml:"rules" doc:"description=Rules resolving the tenant ID of the requests, from the client certificate or a header. The first rule matching wins, and requests matched by none are rejected. Without rules, the tenant ID is read from the X-Scope-OrgID header."`
+}
+
+// ResolutionRule derives the tenant ID from the client certificate or a header of the requests.
+type ResolutionRule struct {
+	// Source is where the tenant ID is read from, one of the Source constants.
+	Source string `yaml:"source"`
+	// Header is the header read, for the header source.
+	Header string `yaml:"header,omitempty"`
+	// Regex must match the whole value read, '(.+)' by default.
+	Regex string `yaml:"regex,omitempty"`
+	// Replacement is the tenant ID, expanded with the groups of the regex, '$1' by default.
+	Replacement string `yaml:"replacement,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// Validate validates the rules and prepares their regexes.
+func (c *ResolutionConfig) Validate() error {
+	for i, r := range c.Rules {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("tenant resolution rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *ResolutionRule) validate() error {
+	switch r.Source {
+	case SourceHeader:
+		if r.Header == "" {
+			return fmt.Errorf("header is required with the %s source", SourceHeader)
+		}
+		// the header read by default would let the clients choose their tenant.
+		if http.CanonicalHeaderKey(r.Header) == http.CanonicalHeaderKey(user.OrgIDHeaderName) {
+			return fmt.Errorf("the %s header can't be read, as the clients would choose their tenant", user.OrgIDHeaderName)
+		}
+	case SourceCertCommonName, SourceCertDNSSAN, SourceCertURISAN, SourceCertEmailSAN:
+	default:
+		return fmt.Errorf("unknown source %q", r.Source)
+	}
+	if r.Regex == "" {
+		r.Regex = "(.+)"
+	}
+	if r.Replacement == "" {
+		r.Replacement = "$1"
+	}
+	regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", r.Regex, err)
+	}
+	r.regex = regex
+	return nil
+}
+
+// values returns the values read by the rule from the request.
+func (r *ResolutionRule) values(req *http.Request) []string {
+	if r.Source == SourceHeader {
+		return req.Header.Values(r.Header)
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return certificateValues(req.TLS.PeerCertificates[0], r.Source)
+}
+
+func certificateValues(cert *x509.Certificate, source string) []string {
+	switch source {
+	case SourceCertCommonName:
+		return []string{cert.Subject.CommonName}
+	case SourceCertDNSSAN:
+		return cert.DNSNames
+	case SourceCertURISAN:
+		values := make([]string, 0, len(cert.URIs))
+		for _, u := range cert.URIs {
+			values = append(values, u.String())
+		}
+		return values
+	case SourceCertEmailSAN:
+		return cert.EmailAddresses
+	}
+	return nil
+}
+
+// resolve returns the tenant ID of the first value of the request matching the rule, if any.
+func (r *ResolutionRule) resolve(req *http.Request) (string, bool) {
+	for _, v := range r.values(req) {
+		match := r.regex.FindStringSubmatchIndex(v)
+		if match == nil {
+			continue
+		}
+		if tenantID := string(r.regex.ExpandString(nil, r.Replacement, v, match)); tenantID != "" {
+			return tenantID, true
+		}
+	}
+	return "", false
+}
+
+// NewResolutionMiddleware returns the middleware resolving the tenant ID of the external requests
+// with the rules, and setting it in the X-Scope-OrgID header read by the authentication middleware
+// and interceptor. The tenant ID sent by the clients in the header is replaced, and removed when no
+// rule matches. The tenant IDs resolved which aren't valid are rejected. The requests to the routes
+// between the components are left untouched, as they carry the tenant ID of the requests they
+// serve, but they must hold the internal secret. Without rules, the requests are left untouched.
+func NewResolutionMiddleware(cfg ResolutionConfig, internalSecret string) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		if len(cfg.Rules) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if requiredRole(r.Method, r.URL.Path) == roleInternal {
+				if !hasInternalSecret(r, internalSecret) {
+					writeInternalRouteError(w, r)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+			tenantID := ""
+			for _, rule := range cfg.Rules {
+				if id, ok := rule.resolve(r); ok {
+					tenantID = id
+					break
+				}
+			}
+			r.Header.Del(user.OrgIDHeaderName)
+			if tenantID != "" {
+				if err := tenant.ValidTenantID(tenantID); err != nil {
+					http.Error(w, fmt.Sprintf("invalid tenant ID resolved: %v", err), http.StatusUnauthorized)
+					return
+				}
+				r.Header.Set(user.OrgIDHeaderName, tenantID)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
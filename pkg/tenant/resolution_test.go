@@ -0,0 +1,115 @@
+package tenant
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestResolutionMiddleware(t *testing.T) {
+	var cfg ResolutionConfig
+	require.NoError(t, yaml.Unmarshal([]byte(`
+rules:
+  - source: cert_uri_san
+    regex: 'spiffe://example.org/tenant/([a-z0-9-]+)/.*'
+  - source: cert_common_name
+    regex: '(.+)\.tenants\.example\.org'
+  - source: header
+    header: X-Team
+    replacement: team-$1
+`), &cfg))
+	require.NoError(t, cfg.Validate())
+
+	handler := NewResolutionMiddleware(cfg, "internal-secret").Wrap(NewHTTPAuthMiddleware(true).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantID, err := ExtractTenantIDFromContext(r.Context())
+		require.NoError(t, err)
+		_, _ = w.Write([]byte(tenantID))
+	})))
+
+	spiffe, err := url.Parse("spiffe://example.org/tenant/acme/ns/prod/sa/agent")
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name     string
+		path     string
+		cert     *x509.Certificate
+		headers  map[string]string
+		expected string
+	}{
+		{
+			name:     "uri san",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "other.tenants.example.org"}, URIs: []*url.URL{spiffe}},
+			headers:  map[string]string{"X-Scope-OrgID": "spoofed"},
+			expected: "acme",
+		},
+		{
+			name:     "common name",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "globex.tenants.example.org"}},
+			expected: "globex",
+		},
+		{
+			name:     "header",
+			cert:     &x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}},
+			headers:  map[string]string{"X-Team": "payments"},
+			expected: "team-payments",
+		},
+		{
+			name:    "no match",
+			headers: map[string]string{"X-Scope-OrgID": "spoofed"},
+		},
+		{
+			name:    "invalid tenant ID",
+			headers: map[string]string{"X-Team": "../other"},
+		},
+		{
+			name:     "internal route",
+			path:     "/ingester.v1.IngesterService/LabelNames",
+			headers:  map[string]string{"X-Scope-OrgID": "acme", InternalSecretHeader: "internal-secret"},
+			expected: "acme",
+		},
+		{
+			name:    "internal route without secret",
+			path:    "/ingester.v1.IngesterService/LabelNames",
+			headers: map[string]string{"X-Scope-OrgID": "acme"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := tc.path
+			if path == "" {
+				path = "/"
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if tc.cert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{tc.cert}}
+			}
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if tc.expected == "" {
+				require.Equal(t, http.StatusUnauthorized, rec.Code)
+				return
+			}
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, tc.expected, rec.Body.String())
+		})
+	}
+}
+
+func TestResolutionConfig_Validate(t *testing.T) {
+	for _, r := range []*ResolutionRule{
+		{Source: "cookie"},
+		{Source: SourceHeader},
+		{Source: SourceCertCommonName, Regex: "("},
+		{Source: SourceHeader, Header: "x-scope-orgid"},
+	} {
+		require.Error(t, (&ResolutionConfig{Rules: []*ResolutionRule{r}}).Validate())
+	}
+}
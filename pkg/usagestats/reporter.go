@@ -7,6 +7,8 @@ import (
 	"flag"
 	"io"
 	"math"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-kit/log"
@@ -16,6 +18,7 @@ import (
 	"github.com/grafana/dskit/kv"
 	"github.com/grafana/dskit/multierror"
 	"github.com/grafana/dskit/services"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/prometheus/client_golang/prometheus"
 
 	phlareobjstore "github.com/grafana/phlare/pkg/objstore"
@@ -40,13 +43,23 @@ var (
 )
 
 type Config struct {
-	Enabled bool `yaml:"reporting_enabled"`
-	Leader  bool `yaml:"-"`
+	Enabled bool   `yaml:"reporting_enabled"`
+	URL     string `yaml:"reporting_url" category:"advanced"`
+	Leader  bool   `yaml:"-"`
 }
 
 // RegisterFlags adds the flags required to config this to the given FlagSet
 func (cfg *Config) RegisterFlags(f *flag.FlagSet) {
 	f.BoolVar(&cfg.Enabled, "usage-stats.enabled", true, "Enable anonymous usage reporting.")
+	f.StringVar(&cfg.URL, "usage-stats.url", usageStatsURL, "URL the anonymous usage reports are sent to, for example an internal collector.")
+}
+
+// url returns the URL the reports are sent to.
+func (cfg *Config) url() string {
+	if cfg.URL == "" {
+		return usageStatsURL
+	}
+	return cfg.URL
 }
 
 type Reporter struct {
@@ -58,8 +71,10 @@ type Reporter struct {
 
 	conf       Config
 	kvConfig   kv.Config
-	cluster    ClusterSeed
 	lastReport time.Time
+
+	mtx     sync.Mutex
+	cluster ClusterSeed
 }
 
 func NewReporter(config Config, kvConfig kv.Config, objectClient phlareobjstore.Bucket, logger log.Logger, reg prometheus.Registerer) (*Reporter, error) {
@@ -171,14 +186,24 @@ func ensureStableKey(ctx context.Context, kvClient kv.Client, logger log.Logger)
 }
 
 func (rep *Reporter) init(ctx context.Context) {
+	var seed ClusterSeed
 	if rep.conf.Leader {
-		rep.cluster = rep.initLeader(ctx)
-		return
+		seed = rep.initLeader(ctx)
+	} else {
+		// follower only wait for the cluster seed to be set.
+		// it will try forever to fetch the cluster seed.
+		seed, _ = rep.fetchSeed(ctx, nil)
 	}
-	// follower only wait for the cluster seed to be set.
-	// it will try forever to fetch the cluster seed.
-	seed, _ := rep.fetchSeed(ctx, nil)
+	rep.mtx.Lock()
 	rep.cluster = seed
+	rep.mtx.Unlock()
+}
+
+// seed returns the cluster seed, empty until the reporter is initialized.
+func (rep *Reporter) seed() ClusterSeed {
+	rep.mtx.Lock()
+	defer rep.mtx.Unlock()
+	return rep.cluster
 }
 
 // fetchSeed fetches the cluster seed from the object store and try until it succeeds.
@@ -300,7 +325,7 @@ func (rep *Reporter) reportUsage(ctx context.Context, interval time.Time) error
 	})
 	var errs multierror.MultiError
 	for backoff.Ongoing() {
-		if err := sendReport(ctx, rep.cluster, interval); err != nil {
+		if err := sendReport(ctx, rep.conf.url(), rep.seed(), interval); err != nil {
 			level.Info(rep.logger).Log("msg", "failed to send usage report", "retries", backoff.NumRetries(), "err", err)
 			errs.Add(err)
 			backoff.Wait()
@@ -318,3 +343,35 @@ func nextReport(interval time.Duration, createdAt, now time.Time) time.Time {
 	// createdAt * (x * interval ) >= now
 	return createdAt.Add(time.Duration(math.Ceil(float64(now.Sub(createdAt))/float64(interval))) * interval)
 }
+
+type reportPreview struct {
+	Enabled bool   `json:"enabled"`
+	URL     string `json:"url"`
+	Report  Report `json:"report"`
+}
+
+// NewReportHandler returns the handler showing the report the instance would send now, and where.
+// The counters are not reset, so inspecting the report doesn't change the next one sent. The
+// reporter is nil when the reports are not sent.
+func NewReportHandler(cfg Config, rep *Reporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var seed ClusterSeed
+		if rep != nil {
+			seed = rep.seed()
+		}
+		interval := nextReport(reportInterval, seed.CreatedAt, time.Now())
+		if seed.CreatedAt.IsZero() {
+			interval = time.Now()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := jsoniter.NewEncoder(w)
+		enc.SetIndent("", " ")
+		if err := enc.Encode(reportPreview{
+			Enabled: rep != nil,
+			URL:     cfg.url(),
+			Report:  previewReport(seed, interval),
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -174,3 +174,21 @@ func TestWrongKV(t *testing.T) {
 	}()
 	require.Equal(t, nil, r.running(ctx))
 }
+
+func TestReportHandler(t *testing.T) {
+	c := NewCounter("test_preview_counter")
+	c.Inc(10)
+	Feature("test_feature", true)
+
+	rec := httptest.NewRecorder()
+	NewReportHandler(Config{URL: "http://collector.internal/usage"}, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/usage-stats/report", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var preview reportPreview
+	require.NoError(t, jsoniter.NewDecoder(rec.Body).Decode(&preview))
+	require.False(t, preview.Enabled)
+	require.Equal(t, "http://collector.internal/usage", preview.URL)
+	require.True(t, preview.Report.Features["test_feature"])
+	require.Equal(t, float64(10), preview.Report.Metrics["test_preview_counter"].(map[string]interface{})["total"])
+	require.Equal(t, int64(10), c.Value()["total"], "the preview doesn't reset the counters")
+}
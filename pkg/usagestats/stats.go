@@ -41,17 +41,18 @@ type Report struct {
 	Os                     string                 `json:"os"`
 	Arch                   string                 `json:"arch"`
 	Edition                string                 `json:"edition"`
+	Features               map[string]bool        `json:"features"`
 	Metrics                map[string]interface{} `json:"metrics"`
 }
 
 // sendReport sends the report to the stats server
-func sendReport(ctx context.Context, seed ClusterSeed, interval time.Time) error {
+func sendReport(ctx context.Context, url string, seed ClusterSeed, interval time.Time) error {
 	report := buildReport(seed, interval)
 	out, err := jsoniter.MarshalIndent(report, "", " ")
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest(http.MethodPost, usageStatsURL, bytes.NewBuffer(out))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(out))
 	if err != nil {
 		return err
 	}
@@ -71,8 +72,17 @@ func sendReport(ctx context.Context, seed ClusterSeed, interval time.Time) error
 	return nil
 }
 
-// buildReport builds the report to be sent to the stats server
+// buildReport builds the report to be sent to the stats server, and resets the counters.
 func buildReport(seed ClusterSeed, interval time.Time) Report {
+	return newReport(seed, interval, true)
+}
+
+// previewReport builds the report without resetting the counters.
+func previewReport(seed ClusterSeed, interval time.Time) Report {
+	return newReport(seed, interval, false)
+}
+
+func newReport(seed ClusterSeed, interval time.Time, reset bool) Report {
 	var (
 		targetName  string
 		editionName string
@@ -98,12 +108,13 @@ func buildReport(seed ClusterSeed, interval time.Time) Report {
 		Arch:              runtime.GOARCH,
 		Target:            targetName,
 		Edition:           editionName,
-		Metrics:           buildMetrics(),
+		Features:          buildFeatures(),
+		Metrics:           buildMetrics(reset),
 	}
 }
 
 // buildMetrics builds the metrics part of the report to be sent to the stats server
-func buildMetrics() map[string]interface{} {
+func buildMetrics(reset bool) map[string]interface{} {
 	result := map[string]interface{}{
 		"memstats":      memstats(),
 		"num_cpu":       runtime.NumCPU(),
@@ -124,6 +135,10 @@ func buildMetrics() map[string]interface{} {
 		case *Statistics:
 			value = v.Value()
 		case *Counter:
+			if !reset {
+				value = v.peek()
+				break
+			}
 			v.updateRate()
 			value = v.Value()
 			v.reset()
@@ -202,6 +217,28 @@ func Edition(edition string) {
 	NewString(editionKey).Set(edition)
 }
 
+var (
+	featuresMtx sync.Mutex
+	features    = map[string]bool{}
+)
+
+// Feature records whether a feature is enabled. This can be set multiple times.
+func Feature(name string, enabled bool) {
+	featuresMtx.Lock()
+	defer featuresMtx.Unlock()
+	features[name] = enabled
+}
+
+func buildFeatures() map[string]bool {
+	featuresMtx.Lock()
+	defer featuresMtx.Unlock()
+	result := make(map[string]bool, len(features))
+	for name, enabled := range features {
+		result[name] = enabled
+	}
+	return result
+}
+
 type Statistics struct {
 	min   *atomic.Float64
 	max   *atomic.Float64
@@ -340,6 +377,15 @@ func (c *Counter) updateRate() {
 	c.rate.Store(float64(total) / time.Since(c.resetTime).Seconds())
 }
 
+// peek returns the value the counter would report now, without updating its rate.
+func (c *Counter) peek() map[string]interface{} {
+	total := c.total.Load()
+	return map[string]interface{}{
+		"total": total,
+		"rate":  float64(total) / time.Since(c.resetTime).Seconds(),
+	}
+}
+
 func (c *Counter) reset() {
 	c.total.Store(0)
 	c.rate.Store(0)
@@ -0,0 +1,253 @@
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/weaveworks/common/middleware"
+)
+
+// The encodings of the compressed responses.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() any { return gzip.NewWriter(io.Discard) },
+	}
+	zstdEncoderPool = sync.Pool{
+		New: func() any {
+			e, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+			return e
+		},
+	}
+)
+
+// NegotiateEncoding returns the encoding of a response accepted by the Accept-Encoding header of
+// a request, zstd or gzip, or an empty string when the response can't be compressed. zstd, which
+// is faster at a similar ratio, is preferred when both are accepted with the same quality.
+func NegotiateEncoding(acceptEncoding string) string {
+	var (
+		best    string
+		bestQ   float64
+		wildQ   = -1.0
+		qValues = map[string]float64{}
+	)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			parsed, err := strconv.ParseFloat(params[len("q="):], 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildQ = q
+			continue
+		}
+		qValues[name] = q
+	}
+	for _, encoding := range []string{EncodingZstd, EncodingGzip} {
+		q, ok := qValues[encoding]
+		if !ok {
+			q = wildQ
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// CompressionHTTPMiddleware compresses the responses with zstd or gzip, negotiated with the
+// Accept-Encoding header of the requests. The responses smaller than minBytes, and the responses
+// already encoded by the handler, are sent as they are. A minBytes of 0 disables the compression.
+func CompressionHTTPMiddleware(minBytes int) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		if minBytes <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: minBytes}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	})
+}
+
+// compressWriter buffers the beginning of a response until it reaches the minimum size of the
+// compressed responses, so the small responses are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+
+	code    int
+	buf     bytes.Buffer
+	started bool
+	w       io.Writer
+	encoder io.WriteCloser
+}
+
+func (c *compressWriter) WriteHeader(code int) {
+	if c.started || c.code != 0 {
+		return
+	}
+	c.code = code
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+	if c.started {
+		return c.w.Write(p)
+	}
+	n, _ := c.buf.Write(p)
+	if c.buf.Len() >= c.minBytes {
+		if err := c.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// start sends the header and the buffered beginning of the response, compressed when it can be.
+func (c *compressWriter) start(compress bool) error {
+	c.started = true
+	if c.code == 0 {
+		c.code = http.StatusOK
+	}
+	h := c.Header()
+	c.w = c.ResponseWriter
+	if compress && h.Get("Content-Encoding") == "" && bodyAllowed(c.code) {
+		h.Set("Content-Encoding", c.encoding)
+		h.Del("Content-Length")
+		switch c.encoding {
+		case EncodingZstd:
+			e := zstdEncoderPool.Get().(*zstd.Encoder)
+			e.Reset(c.ResponseWriter)
+			c.encoder = e
+		default:
+			gw := gzipWriterPool.Get().(*gzip.Writer)
+			gw.Reset(c.ResponseWriter)
+			c.encoder = gw
+		}
+		c.w = c.encoder
+	}
+	c.ResponseWriter.WriteHeader(c.code)
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.w.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// Flush sends the response written so far, compressed: the responses flushed are streamed.
+func (c *compressWriter) Flush() {
+	if !c.started {
+		if c.code == 0 && c.buf.Len() == 0 {
+			return
+		}
+		if err := c.start(true); err != nil {
+			return
+		}
+	}
+	switch e := c.encoder.(type) {
+	case *gzip.Writer:
+		_ = e.Flush()
+	case *zstd.Encoder:
+		_ = e.Flush()
+	}
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the handlers take over the connections, e.g. for websockets.
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return h.Hijack()
+}
+
+func (c *compressWriter) close() {
+	if !c.started {
+		if c.code == 0 {
+			return
+		}
+		_ = c.start(false)
+		return
+	}
+	if c.encoder == nil {
+		return
+	}
+	_ = c.encoder.Close()
+	switch e := c.encoder.(type) {
+	case *gzip.Writer:
+		e.Reset(io.Discard)
+		gzipWriterPool.Put(e)
+	case *zstd.Encoder:
+		e.Reset(io.Discard)
+		zstdEncoderPool.Put(e)
+	}
+}
+
+func bodyAllowed(code int) bool {
+	return code >= http.StatusOK && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// CompressionHandlerOptions are the options of the connect handlers compressing their responses
+// with zstd or gzip, negotiated with the Accept-Encoding header of the unary requests and the
+// Connect-Accept-Encoding or Grpc-Accept-Encoding headers of the streams. The messages smaller
+// than minBytes are sent as they are. A minBytes of 0 disables the compression of the responses.
+func CompressionHandlerOptions(minBytes int) []connect.HandlerOption {
+	if minBytes <= 0 {
+		// the requests are still decompressed.
+		return []connect.HandlerOption{connect.WithCompressMinBytes(1<<31 - 1)}
+	}
+	return []connect.HandlerOption{
+		connect.WithCompression(EncodingZstd, newZstdDecompressor, newZstdCompressor),
+		connect.WithCompressMinBytes(minBytes),
+	}
+}
+
+func newZstdCompressor() connect.Compressor {
+	e, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return e
+}
+
+// zstdDecompressor keeps its decoder usable after Close: connect reuses the decompressors.
+type zstdDecompressor struct {
+	*zstd.Decoder
+}
+
+func newZstdDecompressor() connect.Decompressor {
+	d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	return &zstdDecompressor{Decoder: d}
+}
+
+func (d *zstdDecompressor) Close() error { return nil }
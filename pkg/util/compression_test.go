@@ -0,0 +1,138 @@
+package util_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      "gzip",
+		"gzip, deflate, br":         "gzip",
+		"gzip, deflate, br, zstd":   "zstd",
+		"zstd;q=0.5, gzip":          "gzip",
+		"ZSTD":                      "zstd",
+		"gzip;q=0, zstd;q=0":        "",
+		"*":                         "zstd",
+		"*;q=0.5, gzip":             "gzip",
+		"zstd;q=invalid, gzip;q=.1": "gzip",
+	} {
+		assert.Equal(t, expected, util.NegotiateEncoding(accept), accept)
+	}
+}
+
+func TestCompressionHTTPMiddleware(t *testing.T) {
+	large := strings.Repeat("flamegraph ", 200)
+	handler := util.CompressionHTTPMiddleware(1024).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			_, _ = io.WriteString(w, "small")
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "gzip")
+			gw := gzip.NewWriter(w)
+			_, _ = io.WriteString(gw, large)
+			_ = gw.Close()
+		default:
+			w.WriteHeader(http.StatusAccepted)
+			// written in several parts.
+			_, _ = io.WriteString(w, large[:100])
+			_, _ = io.WriteString(w, large[100:])
+		}
+	}))
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept-Encoding", accept)
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/small", "gzip")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Equal(t, "small", w.Body.String())
+
+	w = get("/large", "")
+	assert.Equal(t, "", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, large, w.Body.String())
+
+	w = get("/large", "gzip")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gr, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	w = get("/large", "gzip, zstd")
+	assert.Equal(t, "zstd", w.Header().Get("Content-Encoding"))
+	assert.Less(t, w.Body.Len(), len(large))
+	zr, err := zstd.NewReader(w.Body)
+	require.NoError(t, err)
+	defer zr.Close()
+	body, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	// the responses already encoded by the handler are sent as they are.
+	w = get("/encoded", "zstd")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gr, err = gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+}
+
+type profileTypesHandler struct {
+	querierv1connect.UnimplementedQuerierServiceHandler
+	types []*typesv1.ProfileType
+}
+
+func (h *profileTypesHandler) ProfileTypes(context.Context, *connect.Request[querierv1.ProfileTypesRequest]) (*connect.Response[querierv1.ProfileTypesResponse], error) {
+	return connect.NewResponse(&querierv1.ProfileTypesResponse{ProfileTypes: h.types}), nil
+}
+
+func TestCompressionHandlerOptions(t *testing.T) {
+	h := &profileTypesHandler{}
+	for i := 0; i < 100; i++ {
+		h.types = append(h.types, &typesv1.ProfileType{ID: "process_cpu:cpu:nanoseconds:cpu:nanoseconds", Name: "process_cpu"})
+	}
+	mux := http.NewServeMux()
+	mux.Handle(querierv1connect.NewQuerierServiceHandler(h, util.CompressionHandlerOptions(1024)...))
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	post := func(accept string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, s.URL+"/querier.v1.QuerierService/ProfileTypes", strings.NewReader("{}"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+	assert.Equal(t, "zstd", post("zstd").Header.Get("Content-Encoding"))
+	assert.Equal(t, "gzip", post("gzip").Header.Get("Content-Encoding"))
+	assert.Equal(t, "", post("identity").Header.Get("Content-Encoding"))
+}
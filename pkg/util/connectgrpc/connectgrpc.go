@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/bufbuild/connect-go"
 	"google.golang.org/protobuf/proto"
@@ -19,10 +21,20 @@ func HandleUnary[Req any, Res any](ctx context.Context, req *httpgrpc.HTTPReques
 	if err != nil {
 		return nil, err
 	}
+	if timeout, ok := requestTimeout(req); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 	connectResp, err := u(ctx, connectReq)
 	if err != nil {
-		if errors.Is(err, tenant.ErrNoTenantID) {
+		switch {
+		case errors.Is(err, tenant.ErrNoTenantID):
 			err = connect.NewError(connect.CodeUnauthenticated, err)
+		case errors.Is(err, context.DeadlineExceeded):
+			err = connect.NewError(connect.CodeDeadlineExceeded, err)
+		case errors.Is(err, context.Canceled):
+			err = connect.NewError(connect.CodeCanceled, err)
 		}
 		var connectErr *connect.Error
 		if errors.As(err, &connectErr) {
@@ -51,6 +63,7 @@ func RoundTripUnary[Req any, Res any](rt GRPCRoundTripper, ctx context.Context,
 	if err != nil {
 		return nil, err
 	}
+	setRequestTimeout(ctx, req)
 	res, err := rt.RoundTripGRPC(ctx, req)
 	if err != nil {
 		return nil, err
@@ -122,6 +135,47 @@ func encodeRequest[Req any](req *connect.Request[Req]) (*httpgrpc.HTTPRequest, e
 	return out, nil
 }
 
+// timeoutHeader is the header of the Connect protocol carrying the timeout of the requests, so that
+// the deadline of the clients is applied to the requests forwarded to the queriers.
+const timeoutHeader = "Connect-Timeout-Ms"
+
+// setRequestTimeout sets the timeout header of the request from the deadline of the context,
+// replacing the one sent by the client.
+func setRequestTimeout(ctx context.Context, req *httpgrpc.HTTPRequest) {
+	headers := req.Headers[:0]
+	for _, h := range req.Headers {
+		if http.CanonicalHeaderKey(h.Key) != timeoutHeader {
+			headers = append(headers, h)
+		}
+	}
+	req.Headers = headers
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	// Round up, a timeout of 0 would not be applied.
+	ms := (time.Until(deadline) + time.Millisecond - 1).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	req.Headers = append(req.Headers, &httpgrpc.Header{Key: timeoutHeader, Values: []string{strconv.FormatInt(ms, 10)}})
+}
+
+// requestTimeout returns the timeout of the request, if any.
+func requestTimeout(req *httpgrpc.HTTPRequest) (time.Duration, bool) {
+	for _, h := range req.Headers {
+		if http.CanonicalHeaderKey(h.Key) != timeoutHeader || len(h.Values) == 0 {
+			continue
+		}
+		ms, err := strconv.ParseInt(h.Values[0], 10, 64)
+		if err != nil || ms <= 0 {
+			return 0, false
+		}
+		return time.Duration(ms) * time.Millisecond, true
+	}
+	return 0, false
+}
+
 func CodeToHTTP(code connect.Code) int32 {
 	// Return literals rather than named constants from the HTTP package to make
 	// it easier to compare this function to the Connect specification.
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/bufbuild/connect-go"
 	"github.com/gorilla/mux"
@@ -14,6 +15,7 @@ import (
 
 	querierv1 "github.com/grafana/phlare/api/gen/proto/go/querier/v1"
 	"github.com/grafana/phlare/api/gen/proto/go/querier/v1/querierv1connect"
+	"github.com/grafana/phlare/pkg/util/httpgrpc"
 )
 
 type fakeQuerier struct {
@@ -55,3 +57,31 @@ func Test_DecodeGRPC(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, req.Name, decoded.Msg.Name)
 }
+
+type handlerRoundTripper func(ctx context.Context, req *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error)
+
+func (f handlerRoundTripper) RoundTripGRPC(ctx context.Context, req *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error) {
+	return f(ctx, req)
+}
+
+func Test_RoundTripUnary_Deadline(t *testing.T) {
+	var deadline time.Time
+	rt := handlerRoundTripper(func(_ context.Context, req *httpgrpc.HTTPRequest) (*httpgrpc.HTTPResponse, error) {
+		// The handler runs without the context of the client, like in the queriers.
+		return HandleUnary(context.Background(), req, func(ctx context.Context, _ *connect.Request[querierv1.LabelValuesRequest]) (*connect.Response[querierv1.LabelValuesResponse], error) {
+			var ok bool
+			deadline, ok = ctx.Deadline()
+			require.True(t, ok)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := connect.NewRequest(&querierv1.LabelValuesRequest{Name: "foo"})
+	req.Header().Set(timeoutHeader, "3600000")
+	_, err := RoundTripUnary[querierv1.LabelValuesRequest, querierv1.LabelValuesResponse](rt, ctx, req)
+	require.Equal(t, connect.CodeDeadlineExceeded, connect.CodeOf(err))
+	require.WithinDuration(t, time.Now(), deadline, time.Second)
+}
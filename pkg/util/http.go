@@ -6,10 +6,14 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"html/template"
 	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/felixge/httpsnoop"
@@ -105,6 +109,13 @@ func (l Log) logWithRequest(r *http.Request) logging.Interface {
 		}
 	}
 
+	// the tenant is only injected into the context by the handlers.
+	if _, err := user.ExtractOrgID(r.Context()); err != nil {
+		if tenantID := r.Header.Get(user.OrgIDHeaderName); tenantID != "" {
+			localLog = localLog.WithField("tenant", tenantID)
+		}
+	}
+
 	return user.LogWith(r.Context(), localLog)
 }
 
@@ -333,6 +344,21 @@ func WriteTextResponse(w http.ResponseWriter, message string) {
 	_, _ = w.Write([]byte(message))
 }
 
+// RenderHTTPResponse writes the value as JSON when the request accepts it, and renders it with the
+// HTML template otherwise, so the same endpoint serves the API and the admin page.
+func RenderHTTPResponse(w http.ResponseWriter, v interface{}, t *template.Template, r *http.Request) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") || r.URL.Query().Get("format") == "json" {
+		WriteJSONResponse(w, v)
+		return
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	WriteHTMLResponse(w, buf.String())
+}
+
 // WriteJSONResponse writes some JSON as a HTTP response.
 func WriteJSONResponse(w http.ResponseWriter, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
@@ -348,3 +374,91 @@ func WriteJSONResponse(w http.ResponseWriter, v interface{}) {
 	// Also this isn't internal error, but error communicating with client.
 	_, _ = w.Write(data)
 }
+
+// DeprecatedHTTPMiddleware marks the responses of a deprecated route with the Deprecation and
+// Sunset headers (RFC 8594), and links the route replacing it, so that the clients notice the
+// deprecation before the route is removed, after the sunset date.
+func DeprecatedHTTPMiddleware(successor string, sunset time.Time) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			if successor != "" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+// MaxBytesHTTPMiddleware limits the size of request bodies to maxBytes.
+// Requests announcing a larger Content-Length are rejected with 413 before
+// their body is read. Otherwise the body is limited while it is being read,
+// and error responses caused by exceeding the limit are sent with status 413.
+// A maxBytes of 0 disables the limit.
+func MaxBytesHTTPMiddleware(maxBytes int64) middleware.Interface {
+	return middleware.Func(func(next http.Handler) http.Handler {
+		if maxBytes <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > maxBytes {
+				http.Error(w, fmt.Sprintf("request body too large: %d bytes exceeds the limit of %d bytes", r.ContentLength, maxBytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			body := &maxBytesBody{ReadCloser: http.MaxBytesReader(w, r.Body, maxBytes)}
+			r.Body = body
+			w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+					return func(code int) {
+						if code >= http.StatusBadRequest && body.exceeded.Load() {
+							code = http.StatusRequestEntityTooLarge
+						}
+						next(code)
+					}
+				},
+			})
+			next.ServeHTTP(w, r)
+		})
+	})
+}
+
+type maxBytesBody struct {
+	io.ReadCloser
+	exceeded atomic.Bool
+}
+
+func (b *maxBytesBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		b.exceeded.Store(true)
+	}
+	return n, err
+}
+
+// HTTP2ServerConfig configures the HTTP/2 connections accepted by the HTTP server, which carry
+// the pushes of the agents and the requests between the components.
+type HTTP2ServerConfig struct {
+	MaxConcurrentStreams uint          `yaml:"max_concurrent_streams" category:"advanced"`
+	IdleTimeout          time.Duration `yaml:"idle_timeout" category:"advanced"`
+}
+
+// RegisterFlags registers the HTTP/2 server flags.
+func (cfg *HTTP2ServerConfig) RegisterFlags(f *flag.FlagSet) {
+	f.UintVar(&cfg.MaxConcurrentStreams, "server.http2-max-concurrent-streams", 250, "Maximum number of concurrent requests on a single HTTP/2 connection. Further requests wait on the client side for a request to complete.")
+	f.DurationVar(&cfg.IdleTimeout, "server.http2-idle-timeout", 0, "Time after which an idle HTTP/2 connection is closed. 0 to use -server.http-idle-timeout.")
+}
+
+// Server returns the HTTP/2 server, closing idle connections after defaultIdleTimeout unless
+// configured otherwise.
+func (cfg *HTTP2ServerConfig) Server(defaultIdleTimeout time.Duration) *http2.Server {
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	return &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.MaxConcurrentStreams),
+		IdleTimeout:          idleTimeout,
+	}
+}
@@ -1,8 +1,13 @@
 package util_test
 
 import (
+	"html/template"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -18,3 +23,69 @@ func TestWriteTextResponse(t *testing.T) {
 	assert.Equal(t, "hello world", w.Body.String())
 	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
 }
+
+func TestRenderHTTPResponse(t *testing.T) {
+	tmpl := template.Must(template.New("page").Parse(`<p>{{ .Name }}</p>`))
+	v := struct{ Name string }{Name: "<tenant>"}
+
+	w := httptest.NewRecorder()
+	util.RenderHTTPResponse(w, v, tmpl, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, "text/html", w.Header().Get("Content-Type"))
+	assert.Equal(t, "<p>&lt;tenant&gt;</p>", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	util.RenderHTTPResponse(w, v, tmpl, req)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"Name":"\u003ctenant\u003e"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	util.RenderHTTPResponse(w, v, tmpl, httptest.NewRequest("GET", "/?format=json", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+}
+
+func TestDeprecatedHTTPMiddleware(t *testing.T) {
+	sunset := time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+	handler := util.DeprecatedHTTPMiddleware("/api/v1/pprof", sunset).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/experimental/pprof", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("Deprecation"))
+	assert.Equal(t, "Thu, 01 Apr 2027 00:00:00 GMT", w.Header().Get("Sunset"))
+	assert.Equal(t, `</api/v1/pprof>; rel="successor-version"`, w.Header().Get("Link"))
+}
+
+func TestMaxBytesHTTPMiddleware(t *testing.T) {
+	handler := util.MaxBytesHTTPMiddleware(4).Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		name          string
+		body          string
+		contentLength int64
+		expectedCode  int
+	}{
+		{name: "within limit", body: "1234", contentLength: 4, expectedCode: http.StatusOK},
+		{name: "content length exceeds limit", body: "12345", contentLength: 5, expectedCode: http.StatusRequestEntityTooLarge},
+		{name: "streamed body exceeds limit", body: "12345", contentLength: -1, expectedCode: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.ContentLength = tc.contentLength
+
+			handler.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.expectedCode, w.Code)
+		})
+	}
+}
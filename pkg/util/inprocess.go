@@ -0,0 +1,103 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// InProcessHTTPClient returns a client serving its requests with the handler, in the same process,
+// without going through the network. The bodies of the requests and of the responses are streamed,
+// so that the bidirectional connect streams are supported.
+func InProcessHTTPClient(handler http.Handler) *http.Client {
+	return &http.Client{
+		Transport: WrapWithInstrumentedHTTPTransport(&inProcessTransport{handler: handler}),
+	}
+}
+
+type inProcessTransport struct {
+	handler http.Handler
+}
+
+func (t *inProcessTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverReq := req.Clone(req.Context())
+	serverReq.Proto, serverReq.ProtoMajor, serverReq.ProtoMinor = "HTTP/2.0", 2, 0
+	serverReq.RequestURI = req.URL.RequestURI()
+	serverReq.RemoteAddr = "in-process"
+	if serverReq.Body == nil {
+		serverReq.Body = http.NoBody
+	}
+	if serverReq.Host == "" {
+		serverReq.Host = req.URL.Host
+	}
+
+	body, bodyWriter := io.Pipe()
+	w := &inProcessResponseWriter{
+		header:  http.Header{},
+		body:    bodyWriter,
+		written: make(chan struct{}),
+	}
+	go func() {
+		var err error
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("in-process handler panic: %v", p)
+			}
+			w.WriteHeader(http.StatusOK)
+			_ = serverReq.Body.Close()
+			_ = bodyWriter.CloseWithError(err)
+		}()
+		t.handler.ServeHTTP(w, serverReq)
+	}()
+
+	select {
+	case <-w.written:
+	case <-req.Context().Done():
+		_ = body.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        w.sentHeader,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// inProcessResponseWriter streams the response to the client, its header is sent with the first
+// write or flush of the body.
+type inProcessResponseWriter struct {
+	header     http.Header
+	sentHeader http.Header
+	status     int
+	body       *io.PipeWriter
+
+	once    sync.Once
+	written chan struct{}
+}
+
+func (w *inProcessResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *inProcessResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sentHeader = w.header.Clone()
+		close(w.written)
+	})
+}
+
+func (w *inProcessResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(p)
+}
+
+func (w *inProcessResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
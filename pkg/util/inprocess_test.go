@@ -0,0 +1,74 @@
+package util_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/bufbuild/connect-go"
+	"github.com/stretchr/testify/require"
+
+	ingestv1 "github.com/grafana/phlare/api/gen/proto/go/ingester/v1"
+	"github.com/grafana/phlare/api/gen/proto/go/ingester/v1/ingesterv1connect"
+	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	"github.com/grafana/phlare/pkg/util"
+)
+
+type echoIngester struct {
+	ingesterv1connect.UnimplementedIngesterServiceHandler
+}
+
+func (echoIngester) LabelValues(_ context.Context, req *connect.Request[ingestv1.LabelValuesRequest]) (*connect.Response[ingestv1.LabelValuesResponse], error) {
+	if req.Msg.Name == "" {
+		return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("no name"))
+	}
+	return connect.NewResponse(&ingestv1.LabelValuesResponse{Names: []string{req.Msg.Name}}), nil
+}
+
+// MergeProfilesLabels replies to each request with as many series as labels to merge by.
+func (echoIngester) MergeProfilesLabels(_ context.Context, stream *connect.BidiStream[ingestv1.MergeProfilesLabelsRequest, ingestv1.MergeProfilesLabelsResponse]) error {
+	for {
+		req, err := stream.Receive()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&ingestv1.MergeProfilesLabelsResponse{Series: make([]*typesv1.Series, len(req.By))}); err != nil {
+			return err
+		}
+	}
+}
+
+func TestInProcessHTTPClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle(ingesterv1connect.NewIngesterServiceHandler(echoIngester{}))
+	client := ingesterv1connect.NewIngesterServiceClient(util.InProcessHTTPClient(mux), "http://in-process")
+	ctx := context.Background()
+
+	resp, err := client.LabelValues(ctx, connect.NewRequest(&ingestv1.LabelValuesRequest{Name: "foo"}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, resp.Msg.Names)
+
+	_, err = client.LabelValues(ctx, connect.NewRequest(&ingestv1.LabelValuesRequest{}))
+	require.Equal(t, connect.CodeInvalidArgument, connect.CodeOf(err))
+
+	_, err = client.LabelNames(ctx, connect.NewRequest(&ingestv1.LabelNamesRequest{}))
+	require.Equal(t, connect.CodeUnimplemented, connect.CodeOf(err))
+
+	// The requests and the responses of the stream are interleaved.
+	stream := client.MergeProfilesLabels(ctx)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&ingestv1.MergeProfilesLabelsRequest{By: make([]string, i)}))
+		resp, err := stream.Receive()
+		require.NoError(t, err)
+		require.Len(t, resp.Series, i)
+	}
+	require.NoError(t, stream.CloseRequest())
+	_, err = stream.Receive()
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, stream.CloseResponse())
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/grafana/dskit/flagext"
+)
+
+// LogConfig configures the filtering of the log lines, on top of the global log level.
+type LogConfig struct {
+	LevelOverrides flagext.StringSliceCSV `yaml:"level_overrides" category:"advanced"`
+	SamplingLimit  int                    `yaml:"sampling_limit" category:"advanced"`
+}
+
+// RegisterFlags registers the log flags.
+func (cfg *LogConfig) RegisterFlags(f *flag.FlagSet) {
+	f.Var(&cfg.LevelOverrides, "log.level-overrides", "Comma-separated list of per-component log levels overriding the global log level, e.g. 'phlaredb=debug,querier=warn'. The component is the value of the 'component' field of the log lines.")
+	f.IntVar(&cfg.SamplingLimit, "log.sampling-limit", 0, "Maximum number of log lines with the same component and message logged per second. Error log lines are never dropped. 0 to disable.")
+}
+
+// Validate validates the log config.
+func (cfg *LogConfig) Validate() error {
+	_, err := cfg.levelOverrides()
+	return err
+}
+
+func (cfg *LogConfig) levelOverrides() (map[string]int, error) {
+	overrides := make(map[string]int, len(cfg.LevelOverrides))
+	for _, o := range cfg.LevelOverrides {
+		component, lvl, ok := strings.Cut(o, "=")
+		if !ok || component == "" {
+			return nil, fmt.Errorf("invalid log level override %q, expected <component>=<level>", o)
+		}
+		rank, ok := levelRanks[lvl]
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q for component %s", lvl, component)
+		}
+		overrides[component] = rank
+	}
+	return overrides, nil
+}
+
+var levelRanks = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+}
+
+// NewLogFilter returns a logger dropping the log lines below the level of their component, which
+// defaults to the given level, and sampling the log lines as configured. Log lines without level
+// are always logged. Invalid level overrides are ignored, they are rejected by Validate.
+func NewLogFilter(next log.Logger, defaultLevel string, cfg LogConfig) log.Logger {
+	overrides, _ := cfg.levelOverrides()
+	f := &logFilter{
+		next:      next,
+		minRank:   levelRanks[defaultLevel],
+		overrides: overrides,
+	}
+	if cfg.SamplingLimit > 0 {
+		f.sampler = &logSampler{limit: cfg.SamplingLimit, now: time.Now}
+	}
+	return f
+}
+
+type logFilter struct {
+	next      log.Logger
+	minRank   int
+	overrides map[string]int
+	sampler   *logSampler
+}
+
+func (f *logFilter) Log(keyvals ...interface{}) error {
+	var (
+		rank      = -1
+		component string
+		msg       interface{}
+	)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch keyvals[i] {
+		case level.Key():
+			if v, ok := keyvals[i+1].(level.Value); ok {
+				rank = levelRanks[v.String()]
+			}
+		case "component":
+			// the last component is the most specific one.
+			if c, ok := keyvals[i+1].(string); ok {
+				component = c
+			}
+		case "msg":
+			msg = keyvals[i+1]
+		}
+	}
+	if rank < 0 {
+		return f.next.Log(keyvals...)
+	}
+	minRank := f.minRank
+	if r, ok := f.overrides[component]; ok {
+		minRank = r
+	}
+	if rank < minRank {
+		return nil
+	}
+	if f.sampler != nil && rank < levelRanks["error"] && !f.sampler.allow(component, fmt.Sprint(msg)) {
+		return nil
+	}
+	return f.next.Log(keyvals...)
+}
+
+type samplingKey struct {
+	component, msg string
+}
+
+// logSampler allows a limited number of log lines with the same key per second.
+type logSampler struct {
+	limit int
+	now   func() time.Time
+
+	mtx    sync.Mutex
+	second int64
+	counts map[samplingKey]int
+}
+
+func (s *logSampler) allow(component, msg string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if now := s.now().Unix(); now != s.second || s.counts == nil {
+		s.second = now
+		s.counts = make(map[samplingKey]int)
+	}
+	k := samplingKey{component: component, msg: msg}
+	s.counts[k]++
+	return s.counts[k] <= s.limit
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFilter_LevelOverrides(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogFilter(log.NewLogfmtLogger(&buf), "info", LogConfig{
+		LevelOverrides: []string{"phlaredb=debug", "querier=error"},
+	})
+
+	phlaredb := log.With(logger, "component", "ingester", "component", "phlaredb")
+	querier := log.With(logger, "component", "querier")
+
+	level.Debug(logger).Log("msg", "dropped")
+	level.Info(logger).Log("msg", "kept")
+	level.Debug(phlaredb).Log("msg", "phlaredb debug")
+	level.Warn(querier).Log("msg", "dropped")
+	level.Error(querier).Log("msg", "querier error")
+	logger.Log("msg", "without level")
+
+	require.Equal(t, []string{
+		"level=info msg=kept",
+		"level=debug component=ingester component=phlaredb msg=\"phlaredb debug\"",
+		"level=error component=querier msg=\"querier error\"",
+		"msg=\"without level\"",
+	}, strings.Split(strings.TrimSpace(buf.String()), "\n"))
+}
+
+func TestLogFilter_Sampling(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogFilter(log.NewLogfmtLogger(&buf), "debug", LogConfig{SamplingLimit: 2}).(*logFilter)
+	now := time.Unix(100, 0)
+	logger.sampler.now = func() time.Time { return now }
+
+	for i := 0; i < 5; i++ {
+		level.Info(logger).Log("msg", "frequent")
+		level.Error(logger).Log("msg", "error")
+	}
+	level.Info(logger).Log("msg", "other")
+	now = now.Add(time.Second)
+	level.Info(logger).Log("msg", "frequent")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	count := map[string]int{}
+	for _, l := range lines {
+		count[l]++
+	}
+	require.Equal(t, map[string]int{
+		"level=info msg=frequent": 3,
+		"level=error msg=error":   5,
+		"level=info msg=other":    1,
+	}, count)
+}
+
+func TestLogConfig_Validate(t *testing.T) {
+	require.NoError(t, (&LogConfig{LevelOverrides: []string{"phlaredb=debug"}}).Validate())
+	require.Error(t, (&LogConfig{LevelOverrides: []string{"phlaredb"}}).Validate())
+	require.Error(t, (&LogConfig{LevelOverrides: []string{"phlaredb=verbose"}}).Validate())
+}
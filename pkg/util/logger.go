@@ -31,6 +31,17 @@ func LoggerWithTraceID(traceID string, l log.Logger) log.Logger {
 	return log.With(l, "traceID", traceID)
 }
 
+// LoggerWithTraceContext returns a Logger that has information about the trace of the context,
+// if any, in its details. Unlike LoggerWithContext, it doesn't add the user, for loggers
+// which already have it.
+func LoggerWithTraceContext(ctx context.Context, l log.Logger) log.Logger {
+	traceID, ok := tracing.ExtractSampledTraceID(ctx)
+	if !ok {
+		return l
+	}
+	return LoggerWithTraceID(traceID, l)
+}
+
 // LoggerWithContext returns a Logger that has information about the current user or users
 // and trace in its details.
 //
@@ -0,0 +1,50 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/grafana/dskit/ring"
+)
+
+// WriteReplicationSetForTenant restricts the replication set returned by the ring for a write
+// to the replication factor of a tenant. The tenant replication factor can only lower the ring
+// replication factor: values lower than 1 or greater than the ring one are ignored.
+func WriteReplicationSetForTenant(set ring.ReplicationSet, ringRF, tenantRF int) (ring.ReplicationSet, error) {
+	if tenantRF <= 0 || tenantRF >= ringRF {
+		return set, nil
+	}
+	if len(set.Instances) > tenantRF {
+		set.Instances = set.Instances[:tenantRF]
+	}
+	minSuccess := (tenantRF / 2) + 1
+	if len(set.Instances) < minSuccess {
+		return ring.ReplicationSet{}, fmt.Errorf("at least %d live replicas required, could only find %d", minSuccess, len(set.Instances))
+	}
+	set.MaxErrors = len(set.Instances) - minSuccess
+	set.MaxUnavailableZones = 0
+	return set, nil
+}
+
+// ReadReplicationSetForTenant adjusts the failures tolerated by the replication set returned by
+// the ring for a read to the replication factor of a tenant. The tenant replication factor can
+// only lower the ring replication factor: values lower than 1 or greater than the ring one are
+// ignored.
+func ReadReplicationSetForTenant(set ring.ReplicationSet, ringRF, tenantRF int) (ring.ReplicationSet, error) {
+	if tenantRF <= 0 || tenantRF >= ringRF {
+		return set, nil
+	}
+	if set.MaxUnavailableZones > 0 {
+		// zone-aware replication sets tolerate failures on a zone basis.
+		if set.MaxUnavailableZones > tenantRF/2 {
+			set.MaxUnavailableZones = tenantRF / 2
+		}
+		return set, nil
+	}
+	// The ring tolerates ringRF/2 unavailable instances, a lower replication
+	// factor tolerates fewer of them.
+	set.MaxErrors -= ringRF/2 - tenantRF/2
+	if set.MaxErrors < 0 {
+		return ring.ReplicationSet{}, fmt.Errorf("too many unhealthy instances in the ring for replication factor %d", tenantRF)
+	}
+	return set, nil
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/grafana/dskit/ring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteReplicationSetForTenant(t *testing.T) {
+	set := ring.ReplicationSet{
+		Instances: []ring.InstanceDesc{{Addr: "1"}, {Addr: "2"}, {Addr: "3"}},
+		MaxErrors: 1,
+	}
+
+	res, err := WriteReplicationSetForTenant(set, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, set, res)
+
+	res, err = WriteReplicationSetForTenant(set, 3, 5)
+	require.NoError(t, err)
+	require.Equal(t, set, res)
+
+	res, err = WriteReplicationSetForTenant(set, 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, []ring.InstanceDesc{{Addr: "1"}}, res.Instances)
+	require.Equal(t, 0, res.MaxErrors)
+
+	res, err = WriteReplicationSetForTenant(ring.ReplicationSet{
+		Instances: []ring.InstanceDesc{{Addr: "1"}, {Addr: "2"}, {Addr: "3"}, {Addr: "4"}, {Addr: "5"}},
+		MaxErrors: 2,
+	}, 5, 3)
+	require.NoError(t, err)
+	require.Len(t, res.Instances, 3)
+	require.Equal(t, 1, res.MaxErrors)
+
+	_, err = WriteReplicationSetForTenant(ring.ReplicationSet{
+		Instances: []ring.InstanceDesc{{Addr: "1"}},
+	}, 5, 3)
+	require.Error(t, err)
+}
+
+func TestReadReplicationSetForTenant(t *testing.T) {
+	set := ring.ReplicationSet{
+		Instances: []ring.InstanceDesc{{Addr: "1"}, {Addr: "2"}, {Addr: "3"}, {Addr: "4"}},
+		MaxErrors: 1,
+	}
+
+	res, err := ReadReplicationSetForTenant(set, 3, 0)
+	require.NoError(t, err)
+	require.Equal(t, set, res)
+
+	res, err = ReadReplicationSetForTenant(set, 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, 0, res.MaxErrors)
+
+	// one instance is already unhealthy
+	set.MaxErrors = 0
+	_, err = ReadReplicationSetForTenant(set, 3, 1)
+	require.Error(t, err)
+
+	res, err = ReadReplicationSetForTenant(ring.ReplicationSet{
+		Instances:           set.Instances,
+		MaxUnavailableZones: 1,
+	}, 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, 0, res.MaxUnavailableZones)
+}
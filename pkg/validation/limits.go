@@ -3,15 +3,33 @@ package validation
 import (
 	"encoding/json"
 	"flag"
+	"regexp"
 	"time"
 
+	"github.com/grafana/dskit/flagext"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
+
+	phlaremodel "github.com/grafana/phlare/pkg/model"
+	"github.com/grafana/phlare/pkg/pprof"
 )
 
 const (
 	bytesInMB = 1048576
+
+	// OverflowProfileLabelValue replaces the values of the pprof labels beyond the limit of
+	// distinct values per key.
+	OverflowProfileLabelValue = "other"
+
+	// The actions on the series exceeding the limit of distinct values per label name.
+	LabelValuesLimitReject  = "reject"
+	LabelValuesLimitRewrite = "rewrite"
+
+	// FutureTimestampsReject and FutureTimestampsClamp are the actions on the profiles whose
+	// timestamps are beyond the creation grace period.
+	FutureTimestampsReject = "reject"
+	FutureTimestampsClamp  = "clamp"
 )
 
 // Limits describe all the limits for tenants; can be used to describe global default
@@ -20,11 +38,34 @@ const (
 // to support tenant-friendly duration format (e.g: "1h30m45s") in JSON value.
 type Limits struct {
 	// Distributor enforced limits.
-	IngestionRateMB        float64 `yaml:"ingestion_rate_mb" json:"ingestion_rate_mb"`
-	IngestionBurstSizeMB   float64 `yaml:"ingestion_burst_size_mb" json:"ingestion_burst_size_mb"`
-	MaxLabelNameLength     int     `yaml:"max_label_name_length" json:"max_label_name_length"`
-	MaxLabelValueLength    int     `yaml:"max_label_value_length" json:"max_label_value_length"`
-	MaxLabelNamesPerSeries int     `yaml:"max_label_names_per_series" json:"max_label_names_per_series"`
+	IngestionRateMB         float64 `yaml:"ingestion_rate_mb" json:"ingestion_rate_mb"`
+	IngestionBurstSizeMB    float64 `yaml:"ingestion_burst_size_mb" json:"ingestion_burst_size_mb"`
+	MaxLabelNameLength      int     `yaml:"max_label_name_length" json:"max_label_name_length"`
+	MaxLabelValueLength     int     `yaml:"max_label_value_length" json:"max_label_value_length"`
+	MaxLabelNamesPerSeries  int     `yaml:"max_label_names_per_series" json:"max_label_names_per_series"`
+	MaxProfileSizeBytes     int     `yaml:"max_profile_size_bytes" json:"max_profile_size_bytes"`
+	MaxInflightPushRequests int     `yaml:"max_inflight_push_requests" json:"max_inflight_push_requests"`
+
+	IngestionEnabledProfileTypes  flagext.StringSliceCSV `yaml:"ingestion_enabled_profile_types" json:"ingestion_enabled_profile_types"`
+	IngestionDisabledProfileTypes flagext.StringSliceCSV `yaml:"ingestion_disabled_profile_types" json:"ingestion_disabled_profile_types"`
+	CreationGracePeriod           model.Duration         `yaml:"creation_grace_period" json:"creation_grace_period"`
+	FutureTimestampsAction        string                 `yaml:"future_timestamps_action" json:"future_timestamps_action"`
+
+	// Distributor ingest options.
+	MaxProfileStacktraceDepth int    `yaml:"max_profile_stacktrace_depth" json:"max_profile_stacktrace_depth"`
+	IngestionDropFrames       string `yaml:"ingestion_drop_frames" json:"ingestion_drop_frames"`
+	NormalizeGoSymbols        bool   `yaml:"ingestion_normalize_go_symbols" json:"ingestion_normalize_go_symbols"`
+	CanonicalizeSampleTypes   bool   `yaml:"ingestion_canonicalize_sample_types" json:"ingestion_canonicalize_sample_types"`
+	DetectRuntimeLabels       bool   `yaml:"ingestion_detect_runtime_labels" json:"ingestion_detect_runtime_labels"`
+	SanitizeLabelNames        bool   `yaml:"sanitize_label_names" json:"sanitize_label_names"`
+	MaxProfileLabelValues     int    `yaml:"max_profile_label_values" json:"max_profile_label_values"`
+	MaxLabelValuesPerName     int    `yaml:"max_label_values_per_label_name" json:"max_label_values_per_label_name"`
+	LabelValuesLimitAction    string `yaml:"label_values_limit_action" json:"label_values_limit_action"`
+	RejectMalformedSymbols    bool   `yaml:"reject_malformed_symbols" json:"reject_malformed_symbols"`
+	MaxFunctionNameLength     int    `yaml:"max_function_name_length" json:"max_function_name_length"`
+
+	// Distributor and querier enforced limits.
+	IngestionReplicationFactor int `yaml:"ingestion_replication_factor" json:"ingestion_replication_factor"`
 
 	// Ingester enforced limits.
 	MaxLocalSeriesPerTenant  int `yaml:"max_local_series_per_tenant" json:"max_local_series_per_tenant"`
@@ -34,6 +75,10 @@ type Limits struct {
 	MaxQueryLookback    model.Duration `yaml:"max_query_lookback" json:"max_query_lookback"`
 	MaxQueryLength      model.Duration `yaml:"max_query_length" json:"max_query_length"`
 	MaxQueryParallelism int            `yaml:"max_query_parallelism" json:"max_query_parallelism"`
+
+	// ingestionDropFramesRegexp is IngestionDropFrames compiled when the limits are loaded or
+	// validated, so it isn't compiled again by each push.
+	ingestionDropFramesRegexp *regexp.Regexp
 }
 
 // LimitError are errors that do not comply with the limits specified.
@@ -50,6 +95,37 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	f.IntVar(&l.MaxLabelNameLength, "validation.max-length-label-name", 1024, "Maximum length accepted for label names.")
 	f.IntVar(&l.MaxLabelValueLength, "validation.max-length-label-value", 2048, "Maximum length accepted for label value. This setting also applies to the metric name.")
 	f.IntVar(&l.MaxLabelNamesPerSeries, "validation.max-label-names-per-series", 30, "Maximum number of label names per series.")
+	f.IntVar(&l.MaxProfileSizeBytes, "validation.max-profile-size-bytes", 0, "Maximum size of a profile after decompression. Decompression is aborted as soon as the limit is exceeded. 0 to disable.")
+	f.IntVar(&l.MaxInflightPushRequests, "distributor.max-inflight-push-requests", 0, "Per-tenant maximum number of push requests processed at the same time by each distributor. Pushes exceeding the limit wait for up to -distributor.push-queue-timeout, then are rejected with 429. 0 to disable.")
+
+	f.Var(&l.IngestionEnabledProfileTypes, "distributor.ingestion-enabled-profile-types", "Comma-separated list of the profile types ingested, by the name of their series, for example process_cpu,memory. The profiles of the other types are dropped. Empty to ingest all the profile types.")
+	f.Var(&l.IngestionDisabledProfileTypes, "distributor.ingestion-disabled-profile-types", "Comma-separated list of the profile types dropped at ingest, by the name of their series, for example mutex,block. It takes precedence over -distributor.ingestion-enabled-profile-types.")
+
+	f.IntVar(&l.MaxProfileStacktraceDepth, "validation.max-profile-stacktrace-depth", 0, "Maximum depth of the stacktraces of a profile. Deeper stacktraces are truncated to their leaf-most frames instead of being rejected, and the samples which become identical are aggregated. 0 to disable.")
+	f.StringVar(&l.IngestionDropFrames, "distributor.ingestion-drop-frames", "", "Regular expression matching the function names of the frames to drop from the stacktraces of ingested profiles, for example 'runtime\\..*'. The samples which become identical are aggregated. Empty to disable.")
+
+	f.BoolVar(&l.NormalizeGoSymbols, "distributor.ingestion-normalize-go-symbols", false, "Canonicalize the names of the Go generic functions of ingested profiles, and merge the frames which become identical, so profiles of different Go versions compare cleanly.")
+
+	f.BoolVar(&l.CanonicalizeSampleTypes, "distributor.ingestion-canonicalize-sample-types", false, "Rename the wall-clock, off-CPU, itimer and lock contention sample types of the common profilers, e.g. async-profiler or py-spy, to their canonical names, and convert their time units to nanoseconds, so profiles of different languages are queried with a single profile type. The profiles with these sample types in other units are rejected.")
+
+	f.BoolVar(&l.DetectRuntimeLabels, "distributor.ingestion-detect-runtime-labels", false, "Label the ingested profiles with their runtime, detected from their comments, symbols and mappings: '"+phlaremodel.LabelNameRuntime+"', e.g. 'go' among the known runtimes, the runtime version, e.g. 'go_version', and '"+phlaremodel.LabelNameSpy+"', the profiler or SDK. The labels set by the clients are kept. The detected labels count against the maximum number of label names per series.")
+
+	f.BoolVar(&l.SanitizeLabelNames, "validation.sanitize-label-names", false, "Sanitize the label names of the ingested profiles instead of rejecting them: invalid characters are replaced by underscores, unknown reserved names starting with '__' are stripped of their underscores, and names longer than the maximum length are truncated.")
+
+	f.IntVar(&l.MaxProfileLabelValues, "validation.max-profile-label-values", 0, "Maximum number of distinct values per key of the pprof labels of the samples, tracked by each distributor over an hour. The limit applies to each distributor, not to the cluster. Further values are replaced by '"+OverflowProfileLabelValue+"', and the samples which become identical are aggregated. 0 to disable.")
+
+	f.IntVar(&l.MaxLabelValuesPerName, "validation.max-label-values-per-label-name", 0, "Maximum number of distinct values per label name of the series of a tenant, counted by each distributor over the last one to two hours. The series adding a value beyond the limit are handled according to -validation.label-values-limit-action. The label names starting with '__' aren't limited. 0 to disable.")
+	f.StringVar(&l.LabelValuesLimitAction, "validation.label-values-limit-action", LabelValuesLimitReject, "Action on the series exceeding -validation.max-label-values-per-label-name: '"+LabelValuesLimitReject+"' rejects the push, '"+LabelValuesLimitRewrite+"' replaces the value of the label by '"+OverflowProfileLabelValue+"'.")
+
+	f.BoolVar(&l.RejectMalformedSymbols, "validation.reject-malformed-symbols", false, "Reject the profiles whose symbol tables duplicate mapping, function or location IDs, or reference missing records or strings, instead of repairing them. The repairs are counted by the phlare_distributor_repaired_symbols_total metric either way.")
+
+	f.IntVar(&l.MaxFunctionNameLength, "validation.max-function-name-length", 0, "Maximum length of the function names of the ingested profiles, e.g. of C++ template instantiations. Longer names are truncated in the middle, where '"+pprof.TruncatedSymbolMarker+"' is inserted, and the functions which become identical are merged. 0 to disable.")
+
+	_ = l.CreationGracePeriod.Set("10m")
+	f.Var(&l.CreationGracePeriod, "validation.create-grace-period", "Duration the timestamps of the ingested profiles can be in the future, to tolerate the clock skew of the clients. The profiles beyond it are handled according to -validation.future-timestamps-action. 0 to disable.")
+	f.StringVar(&l.FutureTimestampsAction, "validation.future-timestamps-action", FutureTimestampsReject, "Action on the profiles whose timestamps are beyond -validation.create-grace-period: '"+FutureTimestampsReject+"' rejects the push, '"+FutureTimestampsClamp+"' sets their timestamps to the time they are received.")
+
+	f.IntVar(&l.IngestionReplicationFactor, "distributor.ingestion-replication-factor", 0, "Per-tenant replication factor of the ingested profiles. It can only be lower than the ring replication factor. 0 to use the ring replication factor.")
 
 	f.IntVar(&l.MaxLocalSeriesPerTenant, "ingester.max-local-series-per-tenant", 0, "Maximum number of active series of profiles per tenant, per ingester. 0 to disable.")
 	f.IntVar(&l.MaxGlobalSeriesPerTenant, "ingester.max-global-series-per-tenant", 5000, "Maximum number of active series of profiles per tenant, across the cluster. 0 to disable. When the global limit is enabled, each ingester is configured with a dynamic local limit based on the replication factor and the current number of healthy ingesters, and is kept updated whenever the number of ingesters change.")
@@ -58,7 +134,7 @@ func (l *Limits) RegisterFlags(f *flag.FlagSet) {
 	f.Var(&l.MaxQueryLength, "querier.max-query-length", "The limit to length of queries. 0 to disable.")
 
 	_ = l.MaxQueryLookback.Set("0s")
-	f.Var(&l.MaxQueryLookback, "querier.max-query-lookback", "Limit how far back in profiling data can be queried, up until lookback duration ago. This limit is enforced in the query frontend. If the requested time range is outside the allowed range, the request will not fail, but will be modified to only query data within the allowed time range. The default value of 0 does not set a limit.")
+	f.Var(&l.MaxQueryLookback, "querier.max-query-lookback", "Limit how far back in profiling data can be queried, up until lookback duration ago. This limit is enforced in the query frontend. If the requested time range starts before the allowed range, the request will not fail, but will be modified to only query data within the allowed time range. The requests whose time range ends before it are rejected. The default value of 0 does not set a limit.")
 	f.IntVar(&l.MaxQueryParallelism, "querier.max-query-parallelism", 32, "Maximum number of queries that will be scheduled in parallel by the frontend.")
 }
 
@@ -79,14 +155,64 @@ func (l *Limits) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return errors.Wrap(err, "cloning limits (unmarshaling)")
 		}
 	}
-	return unmarshal((*plain)(l))
+	if err := unmarshal((*plain)(l)); err != nil {
+		return err
+	}
+	// an invalid expression is reported by Validate, along with the tenant of the limits.
+	_ = l.compileIngestionDropFrames()
+	return nil
 }
 
 // Validate validates that this limits config is valid.
 func (l *Limits) Validate() error {
+	if err := l.compileIngestionDropFrames(); err != nil {
+		return err
+	}
+	switch l.FutureTimestampsAction {
+	case "", FutureTimestampsReject, FutureTimestampsClamp:
+	default:
+		return errors.Errorf("invalid future timestamps action %q: expected %q or %q", l.FutureTimestampsAction, FutureTimestampsReject, FutureTimestampsClamp)
+	}
+	switch l.LabelValuesLimitAction {
+	case "", LabelValuesLimitReject, LabelValuesLimitRewrite:
+	default:
+		return errors.Errorf("invalid label values limit action %q: expected %q or %q", l.LabelValuesLimitAction, LabelValuesLimitReject, LabelValuesLimitRewrite)
+	}
 	return nil
 }
 
+// IngestionDropFramesRegexp returns the compiled IngestionDropFrames expression. It
+// returns nil if frames are not dropped.
+func (l *Limits) IngestionDropFramesRegexp() (*regexp.Regexp, error) {
+	if l.IngestionDropFrames == "" {
+		return nil, nil
+	}
+	pattern := ingestionDropFramesPattern(l.IngestionDropFrames)
+	// the compiled expression is kept along with its pattern, the limits built in code are
+	// neither loaded nor validated.
+	if re := l.ingestionDropFramesRegexp; re != nil && re.String() == pattern {
+		return re, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+func (l *Limits) compileIngestionDropFrames() error {
+	l.ingestionDropFramesRegexp = nil
+	if l.IngestionDropFrames == "" {
+		return nil
+	}
+	re, err := regexp.Compile(ingestionDropFramesPattern(l.IngestionDropFrames))
+	if err != nil {
+		return errors.Wrap(err, "invalid ingestion drop frames expression")
+	}
+	l.ingestionDropFramesRegexp = re
+	return nil
+}
+
+func ingestionDropFramesPattern(expr string) string {
+	return "^(?:" + expr + ")$"
+}
+
 // When we load YAML from disk, we want the various per-customer limits
 // to default to any values specified on the command line, not default
 // command line values.  This global contains those values.  I (Tom) cannot
@@ -156,6 +282,94 @@ func (o *Overrides) MaxLabelNamesPerSeries(tenantID string) int {
 	return o.getOverridesForTenant(tenantID).MaxLabelNamesPerSeries
 }
 
+// MaxProfileSizeBytes returns the maximum size of a decompressed profile.
+func (o *Overrides) MaxProfileSizeBytes(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileSizeBytes
+}
+
+// MaxInflightPushRequests returns the maximum number of pushes of the tenant processed at the same time by a distributor.
+func (o *Overrides) MaxInflightPushRequests(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxInflightPushRequests
+}
+
+// MaxProfileStacktraceDepth returns the maximum depth of the stacktraces of a profile.
+func (o *Overrides) MaxProfileStacktraceDepth(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileStacktraceDepth
+}
+
+// IngestionDropFrames returns the expression matching the function names of the frames
+// dropped at ingest, or nil if frames are not dropped.
+func (o *Overrides) IngestionDropFrames(tenantID string) (*regexp.Regexp, error) {
+	return o.getOverridesForTenant(tenantID).IngestionDropFramesRegexp()
+}
+
+// ProfileTypeEnabled returns whether the profiles of the name, e.g. process_cpu, are ingested for the tenant.
+func (o *Overrides) ProfileTypeEnabled(tenantID, name string) bool {
+	l := o.getOverridesForTenant(tenantID)
+	return phlaremodel.ProfileTypeEnabled(name, l.IngestionEnabledProfileTypes, l.IngestionDisabledProfileTypes)
+}
+
+// DetectRuntimeLabels returns whether the profiles of the tenant are labeled with their runtime at ingest.
+func (o *Overrides) DetectRuntimeLabels(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).DetectRuntimeLabels
+}
+
+// NormalizeGoSymbols returns whether the Go symbols of the profiles of the tenant are normalized at ingest.
+func (o *Overrides) NormalizeGoSymbols(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).NormalizeGoSymbols
+}
+
+// CanonicalizeSampleTypes returns whether the sample types of the profiles of the tenant are canonicalized at ingest.
+func (o *Overrides) CanonicalizeSampleTypes(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).CanonicalizeSampleTypes
+}
+
+// SanitizeLabelNames returns whether the label names of the profiles of the tenant are sanitized instead of being rejected.
+func (o *Overrides) SanitizeLabelNames(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).SanitizeLabelNames
+}
+
+// MaxProfileLabelValues returns the maximum number of distinct values per key of the pprof labels of the tenant,
+// which each distributor enforces on its own.
+func (o *Overrides) MaxProfileLabelValues(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxProfileLabelValues
+}
+
+// MaxLabelValuesPerName returns the maximum number of distinct values per label name of the series of the tenant.
+func (o *Overrides) MaxLabelValuesPerName(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxLabelValuesPerName
+}
+
+// LabelValuesLimitAction returns the action on the series of the tenant exceeding the maximum number of distinct values per label name.
+func (o *Overrides) LabelValuesLimitAction(tenantID string) string {
+	return o.getOverridesForTenant(tenantID).LabelValuesLimitAction
+}
+
+// MaxFunctionNameLength returns the maximum length of the function names of the profiles of the tenant.
+func (o *Overrides) MaxFunctionNameLength(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).MaxFunctionNameLength
+}
+
+// CreationGracePeriod returns how far in the future the timestamps of the profiles of the tenant can be.
+func (o *Overrides) CreationGracePeriod(tenantID string) time.Duration {
+	return time.Duration(o.getOverridesForTenant(tenantID).CreationGracePeriod)
+}
+
+// FutureTimestampsAction returns the action on the profiles of the tenant beyond the creation grace period.
+func (o *Overrides) FutureTimestampsAction(tenantID string) string {
+	return o.getOverridesForTenant(tenantID).FutureTimestampsAction
+}
+
+// RejectMalformedSymbols returns whether the profiles of the tenant with malformed symbol tables are rejected instead of being repaired.
+func (o *Overrides) RejectMalformedSymbols(tenantID string) bool {
+	return o.getOverridesForTenant(tenantID).RejectMalformedSymbols
+}
+
+// IngestionReplicationFactor returns the replication factor of the tenant, or 0 to use the ring one.
+func (o *Overrides) IngestionReplicationFactor(tenantID string) int {
+	return o.getOverridesForTenant(tenantID).IngestionReplicationFactor
+}
+
 // MaxLocalSeriesPerTenant returns the maximum number of series a tenant is allowed to store
 // in a single ingester.
 func (o *Overrides) MaxLocalSeriesPerTenant(tenantID string) int {
@@ -158,3 +158,27 @@ func TestOverwriteMarshalingStringMapYAML(t *testing.T) {
 	require.Nil(t, yaml.Unmarshal(out, &back))
 	require.Equal(t, m, back)
 }
+
+func TestLimitsIngestionDropFrames(t *testing.T) {
+	var limits Limits
+	require.NoError(t, yaml.Unmarshal([]byte(`ingestion_drop_frames: 'runtime\..*'`), &limits))
+
+	// the expression is compiled once, when the limits are loaded.
+	re, err := limits.IngestionDropFramesRegexp()
+	require.NoError(t, err)
+	require.True(t, re.MatchString("runtime.mallocgc"))
+	require.False(t, re.MatchString("main.runtime.foo"))
+	again, err := limits.IngestionDropFramesRegexp()
+	require.NoError(t, err)
+	require.Same(t, re, again)
+
+	// the limits changed in code aren't matched by the stale expression.
+	limits.IngestionDropFrames = "main"
+	re, err = limits.IngestionDropFramesRegexp()
+	require.NoError(t, err)
+	require.True(t, re.MatchString("main"))
+
+	limits = Limits{}
+	require.NoError(t, yaml.Unmarshal([]byte(`ingestion_drop_frames: 'runtime\.('`), &limits))
+	require.ErrorContains(t, limits.Validate(), "invalid ingestion drop frames expression")
+}
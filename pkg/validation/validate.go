@@ -10,6 +10,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/common/model"
 
+	googlev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
 	phlaremodel "github.com/grafana/phlare/pkg/model"
 )
@@ -39,6 +40,27 @@ const (
 	// SeriesLimit is a reason for discarding lines when we can't create a new stream
 	// because the limit of active streams has been reached.
 	SeriesLimit Reason = "series_limit"
+	// ProfileSizeLimit is a reason for discarding a profile which exceeds the maximum
+	// decompressed size.
+	ProfileSizeLimit Reason = "profile_size_limit"
+	// InflightLimit is a reason for discarding a push which waited too long for the
+	// in-flight push limits.
+	InflightLimit Reason = "inflight_limit"
+	// MalformedSymbols is a reason for discarding a profile whose symbol tables duplicate IDs or
+	// reference missing records, when the tenant rejects them instead of repairing them.
+	MalformedSymbols Reason = "malformed_symbols"
+	// LabelValuesLimit is a reason for discarding a series adding a value to a label name which
+	// exceeds the limit of distinct values.
+	LabelValuesLimit Reason = "label_values_limit"
+	// ProfileTypeDisabled is a reason for discarding a series whose profile type isn't ingested
+	// for the tenant.
+	ProfileTypeDisabled Reason = "profile_type_disabled"
+	// TooFarInFuture is a reason for discarding a profile whose timestamp is beyond the creation
+	// grace period.
+	TooFarInFuture Reason = "too_far_in_future"
+	// InvalidSampleType is a reason for discarding a profile with a sample type of a common
+	// profiler, e.g. `wall-clock`, in a unit which can't be canonicalized.
+	InvalidSampleType Reason = "invalid_sample_type"
 
 	SeriesLimitErrorMsg            = "Maximum active series limit exceeded (%d/%d), reduce the number of active streams (reduce labels or reduce label values), or contact your administrator to see if the limit can be increased"
 	MissingLabelsErrorMsg          = "error at least one label pair is required per profile"
@@ -47,6 +69,11 @@ const (
 	LabelNameTooLongErrorMsg       = "profile with labels '%s' has label name too long: '%s'"
 	LabelValueTooLongErrorMsg      = "profile with labels '%s' has label value too long: '%s'"
 	DuplicateLabelNamesErrorMsg    = "profile with labels '%s' has duplicate label name: '%s'"
+	ProfileSizeLimitErrorMsg       = "profile with labels '%s' exceeds the size limit (max_profile_size_bytes) of %d bytes after decompression"
+	MalformedSymbolsErrorMsg       = "profile with labels '%s' has %d malformed or duplicate mapping, function, location or string references (reject_malformed_symbols)"
+	LabelValuesLimitErrorMsg       = "profile with labels '%s' exceeds the limit of %d distinct values of the label '%s' (max_label_values_per_label_name)"
+	TooFarInFutureErrorMsg         = "profile with labels '%s' has timestamp %s, which is more than %s in the future (creation_grace_period)"
+	InvalidSampleTypeErrorMsg      = "profile with labels '%s' has sample type '%s' in unit '%s', which is neither a unit of time nor a count it measures"
 )
 
 var (
@@ -112,6 +139,105 @@ func ValidateLabels(limits LabelValidationLimits, userID string, ls []*typesv1.L
 	return nil
 }
 
+// ValidateSampleTypes validates that the sample types of the common profilers, e.g. `wall-clock` or
+// `lock`, are in a unit they can be canonicalized to.
+func ValidateSampleTypes(ls []*typesv1.LabelPair, p *googlev1.Profile) error {
+	for _, st := range p.SampleType {
+		if st.Type < 0 || st.Type >= int64(len(p.StringTable)) || st.Unit < 0 || st.Unit >= int64(len(p.StringTable)) {
+			continue
+		}
+		sampleType, unit := p.StringTable[st.Type], p.StringTable[st.Unit]
+		if !phlaremodel.ValidSampleTypeUnit(sampleType, unit) {
+			return NewErrorf(InvalidSampleType, InvalidSampleTypeErrorMsg, phlaremodel.LabelPairsString(ls), sampleType, unit)
+		}
+	}
+	return nil
+}
+
+// reservedLabelNames are the label names starting with `__` known to Phlare.
+var reservedLabelNames = map[string]struct{}{
+	model.MetricNameLabel:            {},
+	phlaremodel.LabelNameProfileType: {},
+	phlaremodel.LabelNameType:        {},
+	phlaremodel.LabelNameUnit:        {},
+	phlaremodel.LabelNamePeriodType:  {},
+	phlaremodel.LabelNamePeriodUnit:  {},
+	phlaremodel.LabelNameRuntime:     {},
+	phlaremodel.LabelNameSpy:         {},
+}
+
+// SanitizeLabelNames normalizes the label names of a profile, so profiles from clients using
+// other naming conventions, e.g. dotted label names, are accepted instead of being rejected:
+//
+//   - invalid characters are replaced by `_`, and names starting with a digit are prefixed by `_`.
+//   - names starting with `__` are reserved, unknown ones are stripped of their surrounding `_`.
+//   - names longer than maxLength are truncated.
+//
+// Labels whose sanitized name is already used by another label are dropped.
+func SanitizeLabelNames(ls []*typesv1.LabelPair, maxLength int) []*typesv1.LabelPair {
+	names := make(map[string]struct{}, len(ls))
+	changed := false
+	for _, l := range ls {
+		if sanitizeLabelName(l.Name, maxLength) == l.Name {
+			names[l.Name] = struct{}{}
+		} else {
+			changed = true
+		}
+	}
+	if !changed {
+		return ls
+	}
+	result := ls[:0]
+	for _, l := range ls {
+		if _, ok := names[l.Name]; !ok {
+			name := sanitizeLabelName(l.Name, maxLength)
+			if _, ok := names[name]; ok {
+				continue
+			}
+			names[name] = struct{}{}
+			l.Name = name
+		}
+		result = append(result, l)
+	}
+	return result
+}
+
+// SanitizeLabelName replaces the characters invalid in a label name by underscores.
+func SanitizeLabelName(name string) string {
+	return sanitizeLabelName(name, 0)
+}
+
+func sanitizeLabelName(name string, maxLength int) string {
+	if _, ok := reservedLabelNames[name]; !ok && strings.HasPrefix(name, model.ReservedLabelPrefix) {
+		name = strings.Trim(name, "_")
+	}
+	if !model.LabelName(name).IsValid() {
+		var b strings.Builder
+		b.Grow(len(name) + 1)
+		for i, r := range name {
+			switch {
+			case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+				b.WriteRune(r)
+			case r >= '0' && r <= '9':
+				if i == 0 {
+					b.WriteByte('_')
+				}
+				b.WriteRune(r)
+			default:
+				b.WriteByte('_')
+			}
+		}
+		name = b.String()
+		if name == "" {
+			name = "_"
+		}
+	}
+	if maxLength > 0 && len(name) > maxLength {
+		name = name[:maxLength]
+	}
+	return name
+}
+
 type Error struct {
 	Reason Reason
 	msg    string
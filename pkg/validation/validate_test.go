@@ -6,7 +6,9 @@ import (
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 
+	googlev1 "github.com/grafana/phlare/api/gen/proto/go/google/v1"
 	typesv1 "github.com/grafana/phlare/api/gen/proto/go/types/v1"
+	phlaremodel "github.com/grafana/phlare/pkg/model"
 )
 
 func TestValidateLabels(t *testing.T) {
@@ -101,3 +103,94 @@ type fakeLabelsLimits struct{}
 func (fakeLabelsLimits) MaxLabelNameLength(userID string) int     { return 10 }
 func (fakeLabelsLimits) MaxLabelValueLength(userID string) int    { return 10 }
 func (fakeLabelsLimits) MaxLabelNamesPerSeries(userID string) int { return 3 }
+
+func TestValidateSampleTypes(t *testing.T) {
+	ls := []*typesv1.LabelPair{{Name: model.MetricNameLabel, Value: "wall"}}
+	p := &googlev1.Profile{
+		SampleType:  []*googlev1.ValueType{{Type: 1, Unit: 2}, {Type: 3, Unit: 4}},
+		StringTable: []string{"", "samples", "count", "wall-clock", "microseconds"},
+	}
+	require.NoError(t, ValidateSampleTypes(ls, p))
+
+	p.StringTable[4] = "bytes"
+	err := ValidateSampleTypes(ls, p)
+	require.Error(t, err)
+	require.Equal(t, InvalidSampleType, ReasonOf(err))
+	require.Equal(t, `profile with labels '{__name__="wall"}' has sample type 'wall-clock' in unit 'bytes', which is neither a unit of time nor a count it measures`, err.Error())
+}
+
+func TestSanitizeLabelNames(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		maxLength int
+		in        []*typesv1.LabelPair
+		expected  []*typesv1.LabelPair
+	}{
+		{
+			name: "valid",
+			in: []*typesv1.LabelPair{
+				{Name: model.MetricNameLabel, Value: "cpu"},
+				{Name: phlaremodel.LabelNamePeriodType, Value: "cpu"},
+				{Name: "service_name", Value: "svc"},
+			},
+			expected: []*typesv1.LabelPair{
+				{Name: model.MetricNameLabel, Value: "cpu"},
+				{Name: phlaremodel.LabelNamePeriodType, Value: "cpu"},
+				{Name: "service_name", Value: "svc"},
+			},
+		},
+		{
+			name: "invalid characters",
+			in: []*typesv1.LabelPair{
+				{Name: "service.name", Value: "svc"},
+				{Name: "k8s-pod", Value: "pod"},
+				{Name: "1st", Value: "first"},
+			},
+			expected: []*typesv1.LabelPair{
+				{Name: "service_name", Value: "svc"},
+				{Name: "k8s_pod", Value: "pod"},
+				{Name: "_1st", Value: "first"},
+			},
+		},
+		{
+			name: "unknown reserved names",
+			in: []*typesv1.LabelPair{
+				{Name: "__custom__", Value: "a"},
+				{Name: "__", Value: "b"},
+			},
+			expected: []*typesv1.LabelPair{
+				{Name: "custom", Value: "a"},
+				{Name: "_", Value: "b"},
+			},
+		},
+		{
+			name:      "too long",
+			maxLength: 10,
+			in: []*typesv1.LabelPair{
+				{Name: "abcdefghijk", Value: "a"},
+			},
+			expected: []*typesv1.LabelPair{
+				{Name: "abcdefghij", Value: "a"},
+			},
+		},
+		{
+			name: "duplicates are dropped",
+			in: []*typesv1.LabelPair{
+				{Name: "service.name", Value: "dotted"},
+				{Name: "service_name", Value: "svc"},
+				{Name: "service-name", Value: "dashed"},
+			},
+			expected: []*typesv1.LabelPair{
+				{Name: "service_name", Value: "svc"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			maxLength := tc.maxLength
+			if maxLength == 0 {
+				maxLength = 1024
+			}
+			require.Equal(t, tc.expected, SanitizeLabelNames(tc.in, maxLength))
+		})
+	}
+}